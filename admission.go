@@ -0,0 +1,35 @@
+package prioritize
+
+import "context"
+
+// AdmissionHook decides whether a submission is let into the queue, see `WithAdmissionHook`.
+// It returns the priority to queue it with (e.g. `priority` as is), or the error to reject it with.
+type AdmissionHook func(ctx context.Context, priority int, arg interface{}) (int, error)
+
+// WithAdmissionHook makes the engine call `hooks` on every submission, before it is queued,
+// e.g. for quota checks, auth, or load shedding. The first one returning an error rejects it,
+// and that error is returned by the submit call as is. Each can also re-prioritize it,
+// and the next one is given the priority returned by the previous one.
+// Giving this option more than once adds to the previous ones.
+//
+// Hooks run on the submitting goroutine, so keep them short.
+// Retried (see `WithRetry`) or yielding tasks are already admitted, so they don't go through them again.
+func WithAdmissionHook(hooks ...AdmissionHook) Option {
+	return func(e *Engine) error {
+		e.admission = append(e.admission, hooks...)
+		return nil
+	}
+}
+
+// admit runs the admission hooks on a submission, returning the priority to queue it with
+func (e *Engine) admit(ctx context.Context, priority int, arg interface{}) (int, error) {
+	for _, hook := range e.admission {
+		admitted, err := hook(ctx, priority, arg)
+		if err != nil {
+			e.onRejected(priority, err)
+			return priority, err
+		}
+		priority = admitted
+	}
+	return priority, nil
+}
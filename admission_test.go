@@ -0,0 +1,67 @@
+package prioritize
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aarondwi/prioritize/priority"
+)
+
+func TestEngineWithAdmissionHook(t *testing.T) {
+	errOverQuota := errors.New("over quota")
+	pq, _ := priority.NewPriorityQueue(2048, 4)
+	engine, _ := New(pq, 1,
+		WithAdmissionHook(func(ctx context.Context, priority int, arg interface{}) (int, error) {
+			if arg == "greedy" {
+				return priority, errOverQuota
+			}
+			return priority, nil
+		}),
+		WithAdmissionHook(func(ctx context.Context, priority int, arg interface{}) (int, error) {
+			// vip ones are bumped to the highest
+			if arg == "vip" {
+				return 3, nil
+			}
+			return priority, nil
+		}))
+	defer engine.Close()
+
+	gate := make(chan bool)
+	engine.Submit(context.Background(), 0, func(ctx context.Context, arg interface{}) (interface{}, error) {
+		<-gate
+		return nil, nil
+	}, nil)
+	for engine.Len() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	order := make(chan interface{}, 10)
+	fn := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		order <- arg
+		return arg, nil
+	}
+	if _, err := engine.Submit(context.Background(), 1, fn, "greedy"); err == nil || err != errOverQuota {
+		t.Fatalf("It should return the error of the hook, but instead we got %v", err)
+	}
+	if err := engine.SubmitAndForget(context.Background(), 1, fn, "greedy"); err == nil || err != errOverQuota {
+		t.Fatalf("It should return the error of the hook, but instead we got %v", err)
+	}
+	tasks, err := engine.SubmitBatch(context.Background(), 1, fn, []interface{}{"a", "greedy", "b"})
+	if err == nil || err != errOverQuota || len(tasks) != 1 {
+		t.Fatalf("It should only queue the ones before the rejected one, but instead we got %d and %v", len(tasks), err)
+	}
+	if engine.Len() != 1 || engine.Stats().Rejected != 3 {
+		t.Fatalf("Expected 1 queued and 3 rejected, but instead we got %d and %d", engine.Len(), engine.Stats().Rejected)
+	}
+
+	vip, _ := engine.Submit(context.Background(), 0, fn, "vip")
+	if vip.Priority() != 3 {
+		t.Fatalf("It should be re-prioritized by the hook, but instead we got %d", vip.Priority())
+	}
+	close(gate)
+	if first, second := <-order, <-order; first != "vip" || second != "a" {
+		t.Fatalf("It should run the re-prioritized task first, but instead we got %v then %v", first, second)
+	}
+}
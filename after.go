@@ -0,0 +1,92 @@
+package prioritize
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrDependencyFailed is matched (with `errors.Is`) by the error of a task
+// whose dependency failed, see `SubmitAfterTasks`
+var ErrDependencyFailed = errors.New("A dependency of the task failed")
+
+// DependencyError is the error of a task whose dependency failed, see `SubmitAfterTasks`
+type DependencyError struct {
+	// ID of the failed dependency
+	ID  uint64
+	Err error
+}
+
+func (de *DependencyError) Error() string {
+	return fmt.Sprintf("Dependency task %d failed: %v", de.ID, de.Err)
+}
+
+// Unwrap returns the error of the failed dependency
+func (de *DependencyError) Unwrap() error {
+	return de.Err
+}
+
+// Is makes `errors.Is(err, ErrDependencyFailed)` true
+func (de *DependencyError) Is(target error) bool {
+	return target == ErrDependencyFailed
+}
+
+// SubmitAfterTasks is the same as `Submit`, but the task is only queued
+// once all of `deps` have completed successfully. The deps may come from other engines.
+//
+// If any of them fails, the task is not run, and completes with a `*DependencyError`.
+// It also completes without running if its ctx is done (`ErrCtxAlreadyCancelled`),
+// or the engine is closed (`ErrAlreadyClosed`), while waiting.
+// Until queued, it does not count towards `Len()`, and its priority can't be boosted.
+func (e *Engine) SubmitAfterTasks(
+	ctx context.Context,
+	deps []*Task,
+	priority int,
+	fn TaskFunc,
+	arg interface{}) (*Task, error) {
+
+	select {
+	case <-e.closeChan:
+		e.onRejected(priority, ErrAlreadyClosed)
+		return nil, ErrAlreadyClosed
+	default:
+	}
+
+	priority, err := e.admit(ctx, priority, arg)
+	if err != nil {
+		return nil, err
+	}
+	task, item := e.prepare(ctx, priority, fn, arg, nil, nil, false)
+	if task.expiry != nil {
+		// re-armed once queued
+		task.expiry.Stop()
+	}
+	go func() {
+		for _, dep := range deps {
+			select {
+			case <-dep.Done():
+			case <-task.Done():
+				// e.g. cancelled
+				return
+			case <-ctx.Done():
+				e.complete(task, nil, ErrCtxAlreadyCancelled)
+				return
+			case <-e.closeChan:
+				e.complete(task, nil, ErrAlreadyClosed)
+				return
+			}
+			if _, err := dep.Result(); err != nil {
+				e.complete(task, nil, &DependencyError{ID: dep.ID(), Err: err})
+				return
+			}
+		}
+		if err := e.repush(item, task); err != nil {
+			e.complete(task, nil, err)
+			return
+		}
+		if e.maxWorkers > 0 {
+			e.maybeGrow()
+		}
+	}()
+	return task, nil
+}
@@ -0,0 +1,79 @@
+package prioritize
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aarondwi/prioritize/priority"
+)
+
+func TestEngineSubmitAfterTasks(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	engine, _ := New(pq, 2)
+	defer engine.Close()
+
+	gate := make(chan bool)
+	slow := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		<-gate
+		return arg, nil
+	}
+	first, _ := engine.Submit(context.Background(), 0, slow, 1)
+	second, _ := engine.Submit(context.Background(), 0, slow, 2)
+	sum, err := engine.SubmitAfterTasks(context.Background(), []*Task{first, second}, 0,
+		func(ctx context.Context, arg interface{}) (interface{}, error) {
+			a, _ := first.Result()
+			b, _ := second.Result()
+			return a.(int) + b.(int), nil
+		}, nil)
+	if err != nil {
+		t.Fatalf("It should not error, because all are correct parameters, instead we got %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if sum.Status() != TaskQueued {
+		t.Fatalf("It should wait for its dependencies, but instead we got %v", sum.Status())
+	}
+	close(gate)
+	result, err := sum.Result()
+	if err != nil || result.(int) != 3 {
+		t.Fatalf("Expected 3, but instead we got %v and %v", result, err)
+	}
+
+	errFailing := errors.New("failing")
+	failing, _ := engine.Submit(context.Background(), 0, func(ctx context.Context, arg interface{}) (interface{}, error) {
+		return nil, errFailing
+	}, nil)
+	ran := false
+	next, _ := engine.SubmitAfterTasks(context.Background(), []*Task{failing}, 0,
+		func(ctx context.Context, arg interface{}) (interface{}, error) {
+			ran = true
+			return nil, nil
+		}, nil)
+	_, err = next.Result()
+	var depErr *DependencyError
+	if !errors.Is(err, ErrDependencyFailed) || !errors.Is(err, errFailing) ||
+		!errors.As(err, &depErr) || depErr.ID != failing.ID() || ran {
+		t.Fatalf("It should propagate the failure without running, but instead we got %v", err)
+	}
+
+	blocked, _ := engine.SubmitAfterTasks(context.Background(), []*Task{next, sum}, 0, slow, nil)
+	_, err = blocked.Result()
+	if !errors.Is(err, ErrDependencyFailed) {
+		t.Fatalf("It should fail transitively, but instead we got %v", err)
+	}
+
+	never := make(chan bool)
+	defer close(never)
+	pending, _ := engine.Submit(context.Background(), 0, func(ctx context.Context, arg interface{}) (interface{}, error) {
+		<-never
+		return nil, nil
+	}, nil)
+	waiting, _ := engine.SubmitAfterTasks(context.Background(), []*Task{pending}, 0, slow, nil)
+	if err := waiting.Cancel(); err != nil {
+		t.Fatalf("It should be cancellable while waiting, but instead we got %v", err)
+	}
+	if _, err := waiting.Result(); err == nil || err != ErrTaskCancelled {
+		t.Fatalf("Expected ErrTaskCancelled, but instead we got %v", err)
+	}
+}
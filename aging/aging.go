@@ -0,0 +1,288 @@
+package aging
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+)
+
+// ErrPriorityUpdateNotSupported is returned by `Wrap`
+// if the wrapped queue does not implement `common.PriorityUpdater`
+var ErrPriorityUpdateNotSupported = errors.New("The queue does not support updating priority")
+
+// Queue wraps another queue, raising the priority of items by 1
+// for every `boostInterval` they wait, up to `maxPriority`.
+//
+// With a strict priority queue (e.g. `priority.PriorityQueue`),
+// low priority items are starved as long as higher ones keep coming.
+// With this, an item waiting long enough eventually competes at the top.
+//
+// This struct is thread(goroutine)-safe, if the wrapped queue is.
+type Queue struct {
+	q             common.PriorityUpdater
+	inner         common.QInterface
+	boostInterval time.Duration
+	maxPriority   int
+
+	mu      sync.Mutex
+	waiting map[uint64]*waitingItem
+
+	closeOnce sync.Once
+	closeChan chan struct{}
+}
+
+type waitingItem struct {
+	priority  int
+	nextBoost time.Time
+}
+
+// Wrap creates Queue around `q`, which should implement `common.PriorityUpdater`
+// (as `priority.PriorityQueue` and `fair.FairQueue` do).
+//
+// It starts a goroutine checking every `boostInterval`, stopped by `Close`.
+func Wrap(q common.QInterface, boostInterval time.Duration, maxPriority int) (*Queue, error) {
+	if boostInterval <= 0 {
+		return nil, common.ErrParamShouldBePositive
+	}
+	updater, ok := q.(common.PriorityUpdater)
+	if !ok {
+		return nil, ErrPriorityUpdateNotSupported
+	}
+
+	aq := &Queue{
+		q:             updater,
+		inner:         q,
+		boostInterval: boostInterval,
+		maxPriority:   maxPriority,
+		waiting:       make(map[uint64]*waitingItem),
+		closeChan:     make(chan struct{}),
+	}
+	go aq.boostLoop()
+	return aq, nil
+}
+
+func (aq *Queue) boostLoop() {
+	ticker := time.NewTicker(aq.boostInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-aq.closeChan:
+			return
+		case now := <-ticker.C:
+			aq.boost(now)
+		}
+	}
+}
+
+// boost raises the priority of items which have waited for `boostInterval` at `now`
+func (aq *Queue) boost(now time.Time) {
+	aq.mu.Lock()
+	defer aq.mu.Unlock()
+	for id, w := range aq.waiting {
+		if w.priority >= aq.maxPriority || now.Before(w.nextBoost) {
+			continue
+		}
+		err := aq.q.UpdatePriority(id, w.priority+1)
+		if err == common.ErrItemNotFound {
+			// already popped, the pop removes it from waiting soon
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		w.priority++
+		w.nextBoost = now.Add(aq.boostInterval)
+	}
+}
+
+// PushOrError pushes the item into the wrapped queue, and starts aging it
+func (aq *Queue) PushOrError(item common.QItem) error {
+	// under our lock, so boost never sees the item before it is pushed
+	aq.mu.Lock()
+	defer aq.mu.Unlock()
+	err := aq.inner.PushOrError(item)
+	if err != nil {
+		return err
+	}
+	aq.waiting[item.ID] = &waitingItem{
+		priority:  item.Priority,
+		nextBoost: time.Now().Add(aq.boostInterval),
+	}
+	return nil
+}
+
+// PushOrWaitCtx is the same as PushOrError, but waits for a slot while the wrapped queue is full,
+// if it implements `common.CtxPusher`, else it is the same as PushOrError
+func (aq *Queue) PushOrWaitCtx(ctx context.Context, item common.QItem) error {
+	pusher, ok := aq.inner.(common.CtxPusher)
+	if !ok {
+		return aq.PushOrError(item)
+	}
+	// not holding our lock while waiting, boost skips the item until it is pushed
+	aq.mu.Lock()
+	aq.waiting[item.ID] = &waitingItem{
+		priority:  item.Priority,
+		nextBoost: time.Now().Add(aq.boostInterval),
+	}
+	aq.mu.Unlock()
+	err := pusher.PushOrWaitCtx(ctx, item)
+	if err != nil {
+		aq.mu.Lock()
+		delete(aq.waiting, item.ID)
+		aq.mu.Unlock()
+	}
+	return err
+}
+
+// PopOrWaitTillClose pops from the wrapped queue.
+// The returned item has its boosted priority.
+func (aq *Queue) PopOrWaitTillClose() (common.QItem, error) {
+	return aq.PopOrWaitCtx(context.Background())
+}
+
+// PopOrWaitCtx is the same as PopOrWaitTillClose, but also returns `ctx.Err()`
+// once `ctx` is done while waiting. If the wrapped queue does not implement
+// `common.CtxPopper`, it waits just like PopOrWaitTillClose.
+func (aq *Queue) PopOrWaitCtx(ctx context.Context) (common.QItem, error) {
+	var item common.QItem
+	var err error
+	if ctxPopper, ok := aq.inner.(common.CtxPopper); ok {
+		item, err = ctxPopper.PopOrWaitCtx(ctx)
+	} else {
+		item, err = aq.inner.PopOrWaitTillClose()
+	}
+	if err != nil {
+		return item, err
+	}
+	aq.mu.Lock()
+	delete(aq.waiting, item.ID)
+	aq.mu.Unlock()
+	return item, nil
+}
+
+// TryPop pops from the wrapped queue without waiting,
+// or returns `common.ErrNotSupported` if it does not implement `common.TryPopper`
+func (aq *Queue) TryPop() (common.QItem, error) {
+	popper, ok := aq.inner.(common.TryPopper)
+	if !ok {
+		return common.MinQItem, common.ErrNotSupported
+	}
+	item, err := popper.TryPop()
+	if err != nil {
+		return item, err
+	}
+	aq.mu.Lock()
+	delete(aq.waiting, item.ID)
+	aq.mu.Unlock()
+	return item, nil
+}
+
+// Peek returns the item at the head of the wrapped queue without removing it, with its boosted priority,
+// or `common.ErrNotSupported` if the wrapped queue can't peek
+func (aq *Queue) Peek() (common.QItem, error) {
+	if q, ok := aq.inner.(interface{ Peek() (common.QItem, error) }); ok {
+		return q.Peek()
+	}
+	return common.MinQItem, common.ErrNotSupported
+}
+
+// UpdatePriority updates the priority in the wrapped queue,
+// and ages the item from `newPriority` onwards
+func (aq *Queue) UpdatePriority(id uint64, newPriority int) error {
+	aq.mu.Lock()
+	defer aq.mu.Unlock()
+	err := aq.q.UpdatePriority(id, newPriority)
+	if err != nil {
+		return err
+	}
+	if w, ok := aq.waiting[id]; ok {
+		w.priority = newPriority
+	}
+	return nil
+}
+
+// Remove takes out the item with `id` from the wrapped queue.
+// If the wrapped queue does not implement `common.Remover`,
+// it returns `common.ErrNotSupported`.
+func (aq *Queue) Remove(id uint64) (common.QItem, error) {
+	remover, ok := aq.inner.(common.Remover)
+	if !ok {
+		return common.MinQItem, common.ErrNotSupported
+	}
+	aq.mu.Lock()
+	defer aq.mu.Unlock()
+	item, err := remover.Remove(id)
+	if err != nil {
+		return item, err
+	}
+	delete(aq.waiting, id)
+	return item, nil
+}
+
+// Len returns the number of items in the wrapped queue, or 0 if it can't tell
+func (aq *Queue) Len() int {
+	if q, ok := aq.inner.(interface{ Len() int }); ok {
+		return q.Len()
+	}
+	return 0
+}
+
+// Cap returns the capacity of the wrapped queue, or 0 if it can't tell
+func (aq *Queue) Cap() int {
+	if q, ok := aq.inner.(interface{ Cap() int }); ok {
+		return q.Cap()
+	}
+	return 0
+}
+
+// DepthPerPriority returns the number of items in each priority of the wrapped queue,
+// or nil if it can't tell
+func (aq *Queue) DepthPerPriority() []int {
+	if q, ok := aq.inner.(interface{ DepthPerPriority() []int }); ok {
+		return q.DepthPerPriority()
+	}
+	return nil
+}
+
+// WaitUntilEmpty waits until the wrapped queue holds no item,
+// or returns `common.ErrNotSupported` if it does not implement `common.EmptyWaiter`
+func (aq *Queue) WaitUntilEmpty(ctx context.Context) error {
+	waiter, ok := aq.inner.(common.EmptyWaiter)
+	if !ok {
+		return common.ErrNotSupported
+	}
+	return waiter.WaitUntilEmpty(ctx)
+}
+
+// Close stops aging, and closes the wrapped queue
+func (aq *Queue) Close() error {
+	aq.closeOnce.Do(func() { close(aq.closeChan) })
+	return aq.inner.Close()
+}
+
+// IsClosed returns whether the wrapped queue is closed,
+// or false if it does not implement `common.ClosedNotifier`
+func (aq *Queue) IsClosed() bool {
+	if notifier, ok := aq.inner.(common.ClosedNotifier); ok {
+		return notifier.IsClosed()
+	}
+	return false
+}
+
+// Closed returns the channel of the wrapped queue closed once it is closed,
+// or nil if it does not implement `common.ClosedNotifier`
+func (aq *Queue) Closed() <-chan struct{} {
+	if notifier, ok := aq.inner.(common.ClosedNotifier); ok {
+		return notifier.Closed()
+	}
+	return nil
+}
+
+// CloseGracefully stops aging, and closes the wrapped queue gracefully
+func (aq *Queue) CloseGracefully() {
+	aq.closeOnce.Do(func() { close(aq.closeChan) })
+	aq.inner.CloseGracefully()
+}
@@ -0,0 +1,115 @@
+package aging
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/linkedslice"
+	"github.com/aarondwi/prioritize/priority"
+	"github.com/aarondwi/prioritize/queuetest"
+)
+
+func TestWrapErrors(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	_, err := Wrap(pq, 0, 7)
+	if err == nil || err != common.ErrParamShouldBePositive {
+		t.Fatalf("It should error, cause boostInterval can't be zero, but instead we got %v", err)
+	}
+	_, err = Wrap(linkedslice.NewLinkedSlice(), time.Second, 7)
+	if err == nil || err != ErrPriorityUpdateNotSupported {
+		t.Fatalf("It should error, cause LinkedSlice can't update priority, but instead we got %v", err)
+	}
+}
+
+func TestQueueBoostsWaitingItems(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 4)
+	// long interval, we call boost ourselves
+	aq, _ := Wrap(pq, time.Hour, 3)
+
+	aq.PushOrError(common.QItem{ID: 1, Priority: 0})
+	now := time.Now()
+	for i := 1; i <= 5; i++ {
+		aq.boost(now.Add(time.Duration(i) * time.Hour))
+	}
+	// a newer one, not boosted yet
+	aq.PushOrError(common.QItem{ID: 2, Priority: 2})
+	if aq.Len() != 2 || aq.Cap() != 2048 {
+		t.Fatalf("It should pass through Len and Cap, but instead we got %d and %d", aq.Len(), aq.Cap())
+	}
+
+	item, _ := aq.PopOrWaitTillClose()
+	if item.ID != 1 || item.Priority != 3 {
+		t.Fatalf("Waiting item should be boosted up to max priority 3 and popped first, but instead we got %v", item)
+	}
+	item, _ = aq.PopOrWaitTillClose()
+	if item.ID != 2 || item.Priority != 2 {
+		t.Fatalf("Expected ID 2 with priority 2, but instead we got %v", item)
+	}
+	if len(aq.waiting) != 0 {
+		t.Fatalf("Popped items should not be tracked anymore, but %d are", len(aq.waiting))
+	}
+
+	aq.Close()
+	_, err := aq.PopOrWaitTillClose()
+	if err == nil || err != common.ErrQueueIsClosed {
+		t.Fatalf("It should be closed, but instead we got %v", err)
+	}
+}
+
+func TestQueueBoostLoop(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 4)
+	aq, _ := Wrap(pq, 10*time.Millisecond, 3)
+	defer aq.Close()
+
+	aq.PushOrError(common.QItem{ID: 1, Priority: 0})
+	time.Sleep(100 * time.Millisecond)
+	aq.PushOrError(common.QItem{ID: 2, Priority: 2})
+
+	item, _ := aq.PopOrWaitTillClose()
+	if item.ID != 1 {
+		t.Fatalf("Item waiting long enough should be popped first, but instead we got %v", item)
+	}
+}
+
+func TestQueueWaitUntilEmpty(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(16, 8)
+	aq, _ := Wrap(pq, time.Hour, 7)
+	aq.PushOrError(common.QItem{ID: 1, Priority: 1})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- aq.WaitUntilEmpty(context.Background())
+	}()
+	aq.PopOrWaitTillClose()
+	if err := <-done; err != nil {
+		t.Fatalf("It should return once the wrapped queue is empty, but instead we got %v", err)
+	}
+}
+
+func TestQueueConformance(t *testing.T) {
+	queuetest.Run(t, func(sizeLimit int) (common.ExtendedQInterface, error) {
+		pq, err := priority.NewPriorityQueue(sizeLimit, 8)
+		if err != nil {
+			return nil, err
+		}
+		return Wrap(pq, time.Hour, 7)
+	})
+}
+
+// updateOnly hides all methods of the wrapped queue, except UpdatePriority
+type updateOnly struct {
+	common.QInterface
+	common.PriorityUpdater
+}
+
+func TestQueueRemoveUnsupportedByWrappedQueue(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	aq, _ := Wrap(updateOnly{pq, pq}, time.Hour, 7)
+	aq.PushOrError(common.QItem{ID: 1, Priority: 1})
+	if _, err := aq.Remove(1); err == nil || err != common.ErrNotSupported {
+		t.Fatalf("It should return ErrNotSupported, cause the wrapped queue can't remove, but instead we got %v", err)
+	}
+	aq.Close()
+}
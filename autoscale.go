@@ -0,0 +1,221 @@
+package prioritize
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+)
+
+// ErrAutoscaleNotSupported is returned when `WithMaxWorkers` is given,
+// but the queue does not implement `common.CtxPopper`, or `WithLocalBatch` is given too
+var ErrAutoscaleNotSupported = errors.New("The engine can't autoscale workers with this queue or options")
+
+// ErrInvalidWorkerBounds is returned when `numOfWorker` is not between
+// the ones given with `WithMinWorkers` and `WithMaxWorkers`,
+// or there are no workers left unreserved, see `WithReservedWorkers`
+var ErrInvalidWorkerBounds = errors.New("Number of workers should be between min and max workers")
+
+const defaultIdleTimeout = time.Minute
+
+// WithMaxWorkers lets the engine start more workers, up to `n`,
+// when tasks are waiting in the queue while no worker is idle.
+// Workers above the min (see `WithMinWorkers`) exit once they have been idle
+// for `WithIdleTimeout` (1 minute by default).
+//
+// It requires the queue to implement `common.CtxPopper` (built-in ones do),
+// and can't be used with `WithLocalBatch`, else `ErrAutoscaleNotSupported` is returned.
+func WithMaxWorkers(n int) Option {
+	return func(e *Engine) error {
+		if n <= 0 {
+			return common.ErrParamShouldBePositive
+		}
+		if _, ok := e.queue().(common.CtxPopper); !ok {
+			return ErrAutoscaleNotSupported
+		}
+		e.maxWorkers = int32(n)
+		return nil
+	}
+}
+
+// WithMinWorkers lets idle workers exit until only `n` are left,
+// see `WithMaxWorkers`. By default, it is the `numOfWorker` given on creation.
+func WithMinWorkers(n int) Option {
+	return func(e *Engine) error {
+		if n <= 0 {
+			return common.ErrParamShouldBePositive
+		}
+		e.minWorkers = int32(n)
+		return nil
+	}
+}
+
+// WithIdleTimeout sets how long a worker waits for a task before exiting,
+// if there are more than the min workers, see `WithMaxWorkers`.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(e *Engine) error {
+		if d <= 0 {
+			return common.ErrParamShouldBePositive
+		}
+		e.idleTimeout = d
+		return nil
+	}
+}
+
+// checkWorkerBounds fills in the defaults after all options are applied,
+// and validates them against the starting `numOfWorker`.
+func (e *Engine) checkWorkerBounds() error {
+	if e.maxWorkers == 0 {
+		if e.minWorkers > e.numOfWorker || e.reservedWorkers >= e.numOfWorker {
+			return ErrInvalidWorkerBounds
+		}
+		// without max, workers never exit early, so min does nothing
+		return nil
+	}
+	if e.localBatch > 0 {
+		return ErrAutoscaleNotSupported
+	}
+	if e.minWorkers == 0 {
+		e.minWorkers = e.numOfWorker
+	}
+	if e.idleTimeout == 0 {
+		e.idleTimeout = defaultIdleTimeout
+	}
+	if e.minWorkers > e.numOfWorker || e.numOfWorker > e.maxWorkers ||
+		e.reservedWorkers >= e.minWorkers {
+		return ErrInvalidWorkerBounds
+	}
+	return nil
+}
+
+// maybeGrow starts 1 more worker if there are more tasks waiting than idle workers,
+// unless the engine is closed, or already has the max workers.
+// It returns whether it does.
+func (e *Engine) maybeGrow() bool {
+	if atomic.LoadInt32(&e.numOfWorker) >= e.maxWorkers {
+		// fast path, no need to take the lock
+		return false
+	}
+	e.scaleMu.Lock()
+	defer e.scaleMu.Unlock()
+	select {
+	case <-e.closeChan:
+		// workers may already be exiting, so can't add to workersWg anymore
+		return false
+	default:
+	}
+	n := atomic.LoadInt32(&e.numOfWorker)
+	if n >= e.maxWorkers {
+		return false
+	}
+	// reserved workers can't take all tasks, so they are never counted as idle
+	idle := n - e.reservedWorkers - atomic.LoadInt32(&e.busyWorker)
+	if int32(e.Len()) <= idle {
+		return false
+	}
+	atomic.StoreInt32(&e.numOfWorker, n+1)
+	e.workersWg.Add(1)
+	go e.workLoop(int(n))
+	return true
+}
+
+// retire returns true if an idle worker can exit,
+// which is only while there are more than the min workers.
+func (e *Engine) retire() bool {
+	e.scaleMu.Lock()
+	defer e.scaleMu.Unlock()
+	if atomic.LoadInt32(&e.numOfWorker) <= e.minWorkers {
+		return false
+	}
+	atomic.AddInt32(&e.numOfWorker, -1)
+	return true
+}
+
+// popOrIdle pops like `PopOrWaitTillClose`,
+// but returns `context.DeadlineExceeded` after waiting for `idleTimeout`.
+func (e *Engine) popOrIdle() (common.QItem, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), e.idleTimeout)
+	defer cancel()
+	return e.queue().(common.CtxPopper).PopOrWaitCtx(ctx)
+}
+
+// SetWorkerCount starts or stops workers until there are `n` of them,
+// e.g. to throttle processing during a downstream incident, without losing queued tasks.
+// Workers running a task finish it before stopping. Reserved workers (see `WithReservedWorkers`)
+// are never stopped, so `n` should be higher than their number, else `ErrInvalidWorkerBounds` is returned.
+//
+// It requires the queue to implement `common.CtxPopper` (built-in ones do),
+// and can't be used with `WithMaxWorkers` or `WithLocalBatch`, else `ErrAutoscaleNotSupported` is returned.
+func (e *Engine) SetWorkerCount(n int) error {
+	if n <= 0 {
+		return ErrNumOfWorkerIsNegativeOrZero
+	}
+	if _, ok := e.queue().(common.CtxPopper); !ok || e.maxWorkers > 0 || e.localBatch > 0 {
+		return ErrAutoscaleNotSupported
+	}
+	if int32(n) <= e.reservedWorkers {
+		return ErrInvalidWorkerBounds
+	}
+
+	e.scaleMu.Lock()
+	defer e.scaleMu.Unlock()
+	select {
+	case <-e.closeChan:
+		// workers may already be exiting, so can't add to workersWg anymore
+		return ErrAlreadyClosed
+	default:
+	}
+	atomic.StoreInt32(&e.targetWorkers, int32(n))
+	// those over `n` may still be running, and leave later
+	current := atomic.LoadInt32(&e.numOfWorker)
+	for ; current < int32(n); current++ {
+		e.workersWg.Add(1)
+		go e.workLoop(int(current))
+	}
+	atomic.StoreInt32(&e.numOfWorker, current)
+	if current > int32(n) {
+		// wake up the idle ones, so they see they should leave
+		e.wakeWorkers()
+	}
+	return nil
+}
+
+// wakeSignal wakes up all workers waiting on the queue when cancelled, see `wakeWorkers`
+type wakeSignal struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newWakeSignal() *wakeSignal {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &wakeSignal{ctx: ctx, cancel: cancel}
+}
+
+// wakeWorkers wakes up all workers waiting on the queue, if it implements `common.CtxPopper`
+func (e *Engine) wakeWorkers() {
+	e.wake.Swap(newWakeSignal()).(*wakeSignal).cancel()
+}
+
+// leave returns true if worker `i` should exit,
+// because there are more workers than set with `SetWorkerCount`.
+func (e *Engine) leave(i int) bool {
+	target := atomic.LoadInt32(&e.targetWorkers)
+	if target == 0 || int32(i) < e.reservedWorkers || atomic.LoadInt32(&e.numOfWorker) <= target {
+		return false
+	}
+	e.scaleMu.Lock()
+	defer e.scaleMu.Unlock()
+	if atomic.LoadInt32(&e.numOfWorker) <= atomic.LoadInt32(&e.targetWorkers) {
+		return false
+	}
+	atomic.AddInt32(&e.numOfWorker, -1)
+	return true
+}
+
+// NumOfWorker returns the number of workers currently running,
+// which only changes with `WithMaxWorkers` or `SetWorkerCount`.
+func (e *Engine) NumOfWorker() int {
+	return int(atomic.LoadInt32(&e.numOfWorker))
+}
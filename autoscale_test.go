@@ -0,0 +1,140 @@
+package prioritize
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/priority"
+)
+
+func TestEngineWorkerBounds(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	_, err := New(pq, 1, WithMaxWorkers(0))
+	if !errors.Is(err, common.ErrParamShouldBePositive) {
+		t.Fatalf("It should error, cause max workers can't be zero, instead we got %v", err)
+	}
+	_, err = New(pq, 1, WithIdleTimeout(0))
+	if !errors.Is(err, common.ErrParamShouldBePositive) {
+		t.Fatalf("It should error, cause idle timeout can't be zero, instead we got %v", err)
+	}
+	_, err = New(pq, 4, WithMaxWorkers(2))
+	if err == nil || err != ErrInvalidWorkerBounds {
+		t.Fatalf("It should error, cause numOfWorker is above max, instead we got %v", err)
+	}
+	_, err = New(pq, 2, WithMinWorkers(3), WithMaxWorkers(4))
+	if err == nil || err != ErrInvalidWorkerBounds {
+		t.Fatalf("It should error, cause numOfWorker is below min, instead we got %v", err)
+	}
+	_, err = New(pq, 1, WithMaxWorkers(4), WithLocalBatch(2))
+	if err == nil || err != ErrAutoscaleNotSupported {
+		t.Fatalf("It should error, cause local batch can't be autoscaled, instead we got %v", err)
+	}
+	pq.Close()
+}
+
+func TestEngineAutoscale(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	engine, err := New(pq, 2,
+		WithMinWorkers(1), WithMaxWorkers(4), WithIdleTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("It should not error, because all are correct parameters, instead we got %v", err)
+	}
+	defer engine.Close()
+
+	block := make(chan struct{})
+	fn := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		<-block
+		return arg, nil
+	}
+	tasks := make([]*Task, 0, 6)
+	for i := 0; i < 6; i++ {
+		task, _ := engine.Submit(context.Background(), 0, fn, i)
+		tasks = append(tasks, task)
+	}
+	for engine.Len() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	if engine.NumOfWorker() != 4 {
+		t.Fatalf("It should grow up to the max workers, but instead we got %d", engine.NumOfWorker())
+	}
+
+	close(block)
+	for i, task := range tasks {
+		if result, err := task.Result(); err != nil || result.(int) != i {
+			t.Fatalf("Expected %d, but instead we got %v and %v", i, result, err)
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for engine.NumOfWorker() != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if engine.NumOfWorker() != 1 {
+		t.Fatalf("Idle workers should exit down to the min, but instead we got %d", engine.NumOfWorker())
+	}
+
+	task, _ := engine.Submit(context.Background(), 0,
+		func(ctx context.Context, arg interface{}) (interface{}, error) {
+			return arg, nil
+		}, 7)
+	if result, err := task.Result(); err != nil || result.(int) != 7 {
+		t.Fatalf("The remaining worker should still run tasks, but instead we got %v and %v", result, err)
+	}
+}
+
+func TestEngineSetWorkerCount(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	engine, _ := New(pq, 1, WithMaxWorkers(2))
+	if err := engine.SetWorkerCount(2); err == nil || err != ErrAutoscaleNotSupported {
+		t.Fatalf("It should error, cause the engine autoscales already, instead we got %v", err)
+	}
+	engine.Close()
+
+	pq, _ = priority.NewPriorityQueue(2048, 8)
+	engine, _ = New(pq, 4)
+	defer engine.Close()
+	if err := engine.SetWorkerCount(0); err == nil || err != ErrNumOfWorkerIsNegativeOrZero {
+		t.Fatalf("It should error, cause there would be no worker, instead we got %v", err)
+	}
+
+	// all idle, waiting on the queue
+	if err := engine.SetWorkerCount(1); err != nil {
+		t.Fatalf("It should not error, instead we got %v", err)
+	}
+	for engine.NumOfWorker() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	gate := make(chan bool)
+	started := make(chan bool, 3)
+	fn := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		started <- true
+		<-gate
+		return nil, nil
+	}
+	for i := 0; i < 3; i++ {
+		engine.Submit(context.Background(), 0, fn, nil)
+	}
+	<-started
+	time.Sleep(10 * time.Millisecond)
+	if len(started) != 0 {
+		t.Fatalf("Only 1 worker should be running, but instead %d more started", len(started))
+	}
+
+	if err := engine.SetWorkerCount(3); err != nil {
+		t.Fatalf("It should not error, instead we got %v", err)
+	}
+	<-started
+	<-started
+	if engine.NumOfWorker() != 3 {
+		t.Fatalf("Expected 3 workers, but instead we got %d", engine.NumOfWorker())
+	}
+	close(gate)
+
+	engine.Close()
+	if err := engine.SetWorkerCount(2); err == nil || err != ErrAlreadyClosed {
+		t.Fatalf("It should error, cause the engine is closed, instead we got %v", err)
+	}
+}
@@ -0,0 +1,388 @@
+package bands
+
+import (
+	"context"
+	"sync"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/linkedslice"
+	"github.com/aarondwi/prioritize/policy"
+)
+
+// BandsQueue is a queue with 2 tiers.
+//
+// The express lane, for items pushed with the highest priority (numOfPriority-1),
+// is always checked first, e.g. for interactive requests.
+// It has its own, usually small, capacity, so it can't take over the whole queue.
+//
+// The normal lane holds the other priorities, e.g. for batch work,
+// and pops 1 item from each of its non-empty priorities in turn (see `policy.RoundRobin`),
+// once the express lane is empty.
+//
+// Inside a priority, it is FIFO.
+type BandsQueue struct {
+	// synchronization primitive
+	// read-only calls (e.g. Len) only take the read lock,
+	// so they don't contend with each other
+	mu       *sync.RWMutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	// broadcast once both lanes are empty, see `WaitUntilEmpty`
+	emptied *sync.Cond
+
+	express          *linkedslice.LinkedSlice
+	expressSize      int
+	expressSizeLimit int
+
+	// we separate number tracking from the queues
+	// so the policy only needs to look at this
+	numberOfTasksInEachQueue []int
+	normal                   []*linkedslice.LinkedSlice
+	normalSize               int
+	normalSizeLimit          int
+	normalPolicy             *policy.RoundRobin
+
+	// simple metadata
+	limitPriority int
+	running       bool
+	closed        chan struct{}
+	draining      bool
+	logger        common.Logger
+}
+
+// Option configures optional behavior of BandsQueue
+type Option func(*BandsQueue) error
+
+// WithLogger makes the queue log to `logger` the items left in either lane when closing it.
+// By default, nothing is logged.
+func WithLogger(logger common.Logger) Option {
+	return func(bq *BandsQueue) error {
+		bq.logger = logger
+		return nil
+	}
+}
+
+// NewBandsQueue creates our 2-tier queue, allowing priority [0,numOfPriority).
+//
+// The express lane caps at expressSizeLimit, and takes priority numOfPriority-1.
+// The normal lane caps at normalSizeLimit, and takes the rest,
+// so numOfPriority should be at least 2.
+func NewBandsQueue(expressSizeLimit, normalSizeLimit, numOfPriority int, opts ...Option) (*BandsQueue, error) {
+	if expressSizeLimit <= 0 || normalSizeLimit <= 0 || numOfPriority < 2 {
+		return nil, common.ErrParamShouldBePositive
+	}
+
+	mu := &sync.RWMutex{}
+	normal := make([]*linkedslice.LinkedSlice, numOfPriority-1)
+	for i := range normal {
+		normal[i] = linkedslice.NewLinkedSlice()
+	}
+	bq := &BandsQueue{
+		mu:                       mu,
+		notEmpty:                 sync.NewCond(mu),
+		notFull:                  sync.NewCond(mu),
+		emptied:                  sync.NewCond(mu),
+		express:                  linkedslice.NewLinkedSlice(),
+		expressSizeLimit:         expressSizeLimit,
+		numberOfTasksInEachQueue: make([]int, numOfPriority-1),
+		normal:                   normal,
+		normalSizeLimit:          normalSizeLimit,
+		normalPolicy:             &policy.RoundRobin{},
+		limitPriority:            numOfPriority,
+		running:                  true,
+		closed:                   make(chan struct{}),
+		logger:                   common.NopLogger{},
+	}
+	for _, opt := range opts {
+		if err := opt(bq); err != nil {
+			return nil, err
+		}
+	}
+	return bq, nil
+}
+
+// PushOrError put the item into its lane, and returns error if that lane has no slot available.
+// A full express lane doesn't overflow into the normal one, nor the other way.
+func (bq *BandsQueue) PushOrError(item common.QItem) error {
+	bq.mu.Lock()
+	defer bq.mu.Unlock()
+	if item.Priority < 0 || item.Priority >= bq.limitPriority {
+		return bq.queueErrorLocked("PushOrError", item, common.ErrPriorityOutOfRange)
+	}
+	if err := bq.pushLocked(item); err != nil {
+		return bq.queueErrorLocked("PushOrError", item, err)
+	}
+	return nil
+}
+
+// PushOrWaitCtx is the same as PushOrError, but waits for a slot while the queue is full,
+// and returns `ctx.Err()` once `ctx` is done while waiting
+func (bq *BandsQueue) PushOrWaitCtx(ctx context.Context, item common.QItem) error {
+	bq.mu.Lock()
+	defer bq.mu.Unlock()
+	if item.Priority < 0 || item.Priority >= bq.limitPriority {
+		return bq.queueErrorLocked("PushOrWaitCtx", item, common.ErrPriorityOutOfRange)
+	}
+	err := bq.pushLocked(item)
+	if err == common.ErrQueueIsFull {
+		defer common.WakeOnDone(ctx, bq.notFull)()
+	}
+	for err == common.ErrQueueIsFull {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		bq.notFull.Wait()
+		err = bq.pushLocked(item)
+	}
+	if err != nil {
+		return bq.queueErrorLocked("PushOrWaitCtx", item, err)
+	}
+	return nil
+}
+
+// queueErrorLocked adds what the lane of `item` looks like right now to `err`, see `common.QueueError`
+func (bq *BandsQueue) queueErrorLocked(op string, item common.QItem, err error) error {
+	if item.Priority == bq.limitPriority-1 {
+		return &common.QueueError{Op: op, Priority: item.Priority, Size: bq.expressSize, Limit: bq.expressSizeLimit, Err: err}
+	}
+	return &common.QueueError{Op: op, Priority: item.Priority, Size: bq.normalSize, Limit: bq.normalSizeLimit, Err: err}
+}
+
+func (bq *BandsQueue) pushLocked(item common.QItem) error {
+	if !bq.running || bq.draining {
+		return common.ErrQueueIsClosed
+	}
+
+	if item.Priority == bq.limitPriority-1 {
+		if bq.expressSize == bq.expressSizeLimit {
+			return common.ErrQueueIsFull
+		}
+		// meaning already closed, cause linkedslices is unbounded
+		if err := bq.express.PushOrError(item); err != nil {
+			return err
+		}
+		bq.expressSize++
+	} else {
+		if bq.normalSize == bq.normalSizeLimit {
+			return common.ErrQueueIsFull
+		}
+		if err := bq.normal[item.Priority].PushOrError(item); err != nil {
+			return err
+		}
+		bq.numberOfTasksInEachQueue[item.Priority]++
+		bq.normalSize++
+	}
+	bq.notEmpty.Signal()
+	return nil
+}
+
+// PopOrWaitTillClose returns 1 QItem from the express lane if any,
+// else from the normal lane, or waits if none exists
+func (bq *BandsQueue) PopOrWaitTillClose() (common.QItem, error) {
+	return bq.PopOrWaitCtx(context.Background())
+}
+
+// PopOrWaitCtx is the same as PopOrWaitTillClose,
+// but also returns `ctx.Err()` once `ctx` is done while waiting
+func (bq *BandsQueue) PopOrWaitCtx(ctx context.Context) (common.QItem, error) {
+	bq.mu.Lock()
+	defer bq.mu.Unlock()
+	if !bq.running {
+		return common.MinQItem, common.ErrQueueIsClosed
+	}
+	if bq.expressSize+bq.normalSize == 0 {
+		defer common.WakeOnDone(ctx, bq.notEmpty)()
+	}
+	for bq.expressSize+bq.normalSize == 0 {
+		if bq.draining {
+			bq.closeLocked()
+			return common.MinQItem, common.ErrQueueIsClosed
+		}
+		if err := ctx.Err(); err != nil {
+			return common.MinQItem, err
+		}
+		bq.notEmpty.Wait()
+		// double check, ensuring see the changes after wait call
+		if !bq.running {
+			return common.MinQItem, common.ErrQueueIsClosed
+		}
+	}
+	return bq.popLocked()
+}
+
+// TryPop is the non-blocking version of PopOrWaitTillClose.
+// It returns `common.ErrQueueIsEmpty` right away if the queue is empty.
+func (bq *BandsQueue) TryPop() (common.QItem, error) {
+	bq.mu.Lock()
+	defer bq.mu.Unlock()
+	if !bq.running {
+		return common.MinQItem, common.ErrQueueIsClosed
+	}
+	if bq.expressSize+bq.normalSize == 0 {
+		return common.MinQItem, common.ErrQueueIsEmpty
+	}
+	return bq.popLocked()
+}
+
+// popLocked takes the next item, there should be at least 1
+func (bq *BandsQueue) popLocked() (common.QItem, error) {
+	// if we wait blindly, it gonna stuck
+	// but we are tracking it manually, ensuring it will never wait
+	var result common.QItem
+	var err error
+	if bq.expressSize > 0 {
+		result, err = bq.express.PopOrWaitTillClose()
+		if err != nil {
+			return common.MinQItem, err
+		}
+		bq.expressSize--
+	} else {
+		p := bq.normalPolicy.Next(bq.numberOfTasksInEachQueue)
+		result, err = bq.normal[p].PopOrWaitTillClose()
+		if err != nil {
+			return common.MinQItem, err
+		}
+		bq.numberOfTasksInEachQueue[p]--
+		bq.normalSize--
+	}
+
+	// pushes waiting for the other lane can't take this slot, so all of them check
+	bq.notFull.Broadcast()
+	if bq.expressSize+bq.normalSize == 0 {
+		bq.emptied.Broadcast()
+		if bq.draining {
+			bq.closeLocked()
+		}
+	}
+	return result, nil
+}
+
+// WaitUntilEmpty waits until both lanes hold no item, and returns nil.
+// It returns `common.ErrQueueIsClosed` if BandsQueue is closed with items left,
+// or `ctx.Err()` once `ctx` is done while waiting.
+func (bq *BandsQueue) WaitUntilEmpty(ctx context.Context) error {
+	bq.mu.Lock()
+	defer bq.mu.Unlock()
+	if bq.expressSize+bq.normalSize > 0 {
+		defer common.WakeOnDone(ctx, bq.emptied)()
+	}
+	for bq.expressSize+bq.normalSize > 0 {
+		if !bq.running {
+			return common.ErrQueueIsClosed
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		bq.emptied.Wait()
+	}
+	return nil
+}
+
+// Peek returns the item the next pop returns, without removing it,
+// or `common.ErrQueueIsEmpty` if both lanes are empty.
+func (bq *BandsQueue) Peek() (common.QItem, error) {
+	bq.mu.RLock()
+	defer bq.mu.RUnlock()
+	if !bq.running {
+		return common.MinQItem, common.ErrQueueIsClosed
+	}
+	if bq.expressSize > 0 {
+		item, _ := bq.express.Peek()
+		return item, nil
+	}
+	if bq.normalSize > 0 {
+		// asking a copy, so the turn of the normal lane stays
+		rr := *bq.normalPolicy
+		item, _ := bq.normal[rr.Next(bq.numberOfTasksInEachQueue)].Peek()
+		return item, nil
+	}
+	return common.MinQItem, common.ErrQueueIsEmpty
+}
+
+// Len returns the number of items currently in both lanes
+func (bq *BandsQueue) Len() int {
+	bq.mu.RLock()
+	defer bq.mu.RUnlock()
+	return bq.expressSize + bq.normalSize
+}
+
+// Cap returns the maximum number of items both lanes can hold
+func (bq *BandsQueue) Cap() int {
+	return bq.expressSizeLimit + bq.normalSizeLimit
+}
+
+// DepthPerPriority returns the number of items currently in each priority,
+// the last one being the express lane
+func (bq *BandsQueue) DepthPerPriority() []int {
+	bq.mu.RLock()
+	defer bq.mu.RUnlock()
+	depths := make([]int, bq.limitPriority)
+	copy(depths, bq.numberOfTasksInEachQueue)
+	depths[bq.limitPriority-1] = bq.expressSize
+	return depths
+}
+
+// Close is the same as CloseNow
+func (bq *BandsQueue) Close() error {
+	return bq.CloseNow()
+}
+
+// CloseNow closes BandsQueue, preventing it from accepting new request.
+// Remaining items are dropped, and waiting pops return immediately.
+// Closing it again does nothing, only returning `common.ErrQueueIsClosed`.
+func (bq *BandsQueue) CloseNow() error {
+	bq.mu.Lock()
+	defer bq.mu.Unlock()
+	if !bq.running {
+		return common.ErrQueueIsClosed
+	}
+	bq.closeLocked()
+	return nil
+}
+
+// CloseGracefully stops BandsQueue from accepting new request,
+// but pops keep returning the remaining items.
+// Once it is empty, it is closed the same way as CloseNow.
+func (bq *BandsQueue) CloseGracefully() {
+	bq.mu.Lock()
+	if bq.running {
+		bq.draining = true
+		if bq.expressSize+bq.normalSize == 0 {
+			bq.closeLocked()
+		}
+	}
+	bq.mu.Unlock()
+}
+
+// IsClosed returns whether BandsQueue is closed, after which no item is popped anymore
+func (bq *BandsQueue) IsClosed() bool {
+	bq.mu.RLock()
+	defer bq.mu.RUnlock()
+	return !bq.running
+}
+
+// Closed returns a channel which is closed once BandsQueue is closed,
+// so other goroutines can select on it
+func (bq *BandsQueue) Closed() <-chan struct{} {
+	return bq.closed
+}
+
+func (bq *BandsQueue) closeLocked() {
+	if !bq.running {
+		// already closed, bq.closed can't be closed twice
+		return
+	}
+	bq.running = false
+	close(bq.closed)
+	if bq.expressSize+bq.normalSize > 0 {
+		bq.logger.Warn("queue closed, dropping items",
+			"express", bq.expressSize, "normal", bq.normalSize)
+	}
+	bq.express.Close()
+	for _, q := range bq.normal {
+		q.Close()
+	}
+	bq.notEmpty.Broadcast()
+	bq.notFull.Broadcast()
+	bq.emptied.Broadcast()
+}
@@ -0,0 +1,137 @@
+package bands
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/queuetest"
+)
+
+func TestNewBandsQueueErrors(t *testing.T) {
+	_, err := NewBandsQueue(0, 10, 4)
+	if err == nil || err != common.ErrParamShouldBePositive {
+		t.Fatalf("It should error, cause expressSizeLimit can't be zero, but instead we got %v", err)
+	}
+	_, err = NewBandsQueue(1, 10, 1)
+	if err == nil || err != common.ErrParamShouldBePositive {
+		t.Fatalf("It should error, cause there is no priority for the normal lane, but instead we got %v", err)
+	}
+
+	bq, _ := NewBandsQueue(1, 2, 4)
+	err = bq.PushOrError(common.QItem{ID: 1, Priority: 4})
+	if !errors.Is(err, common.ErrPriorityOutOfRange) {
+		t.Fatalf("It should error, cause priority is out of range, but instead we got %v", err)
+	}
+	bq.PushOrError(common.QItem{ID: 1, Priority: 3})
+	err = bq.PushOrError(common.QItem{ID: 2, Priority: 3})
+	if !errors.Is(err, common.ErrQueueIsFull) {
+		t.Fatalf("It should error, cause express lane is full, but instead we got %v", err)
+	}
+	if err = bq.PushOrError(common.QItem{ID: 3, Priority: 0}); err != nil {
+		t.Fatalf("It should not error, cause normal lane has its own capacity, but instead we got %v", err)
+	}
+	if bq.Len() != 2 || bq.Cap() != 3 {
+		t.Fatalf("It should have Len 2 and Cap 3, but instead we got %d and %d", bq.Len(), bq.Cap())
+	}
+}
+
+func TestBandsQueue(t *testing.T) {
+	bq, _ := NewBandsQueue(10, 100, 4)
+	bq.PushOrError(common.QItem{ID: 1, Priority: 0})
+	bq.PushOrError(common.QItem{ID: 2, Priority: 0})
+	bq.PushOrError(common.QItem{ID: 3, Priority: 2})
+	bq.PushOrError(common.QItem{ID: 4, Priority: 2})
+	bq.PushOrError(common.QItem{ID: 5, Priority: 3})
+	bq.PushOrError(common.QItem{ID: 6, Priority: 3})
+
+	// express first, then the normal lane takes turns
+	expected := []uint64{5, 6, 3, 1, 4, 2}
+	for _, e := range expected {
+		item, err := bq.PopOrWaitTillClose()
+		if err != nil || item.ID != e {
+			t.Fatalf("Expected ID %d, but instead we got %v and %v", e, item, err)
+		}
+	}
+
+	bq.PushOrError(common.QItem{ID: 7, Priority: 1})
+	bq.CloseGracefully()
+	item, err := bq.PopOrWaitTillClose()
+	if err != nil || item.ID != 7 {
+		t.Fatalf("It should still return the remaining item, but instead we got %v and %v", item, err)
+	}
+	_, err = bq.PopOrWaitTillClose()
+	if err == nil || err != common.ErrQueueIsClosed {
+		t.Fatalf("It should be closed after draining, but instead we got %v", err)
+	}
+}
+
+func TestBandsQueueDepthPerPriority(t *testing.T) {
+	bq, _ := NewBandsQueue(2, 8, 3)
+	bq.PushOrError(common.QItem{ID: 1, Priority: 2})
+	bq.PushOrError(common.QItem{ID: 2, Priority: 0})
+	bq.PushOrError(common.QItem{ID: 3, Priority: 2})
+	if depths := bq.DepthPerPriority(); !reflect.DeepEqual(depths, []int{1, 0, 2}) {
+		t.Fatalf("Expected depths [1 0 2], with the express lane last, but instead we got %v", depths)
+	}
+	bq.Close()
+}
+
+func TestBandsQueueWaitUntilEmpty(t *testing.T) {
+	bq, _ := NewBandsQueue(10, 100, 4)
+	bq.PushOrError(common.QItem{ID: 1})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := bq.WaitUntilEmpty(ctx); err == nil || err != context.DeadlineExceeded {
+		t.Fatalf("It should return context.DeadlineExceeded, cause nothing is popped, but instead we got %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- bq.WaitUntilEmpty(context.Background())
+	}()
+	bq.PopOrWaitTillClose()
+	if err := <-done; err != nil {
+		t.Fatalf("It should return once the last item is popped, but instead we got %v", err)
+	}
+
+	bq.PushOrError(common.QItem{ID: 2})
+	bq.Close()
+	if err := bq.WaitUntilEmpty(context.Background()); err == nil || err != common.ErrQueueIsClosed {
+		t.Fatalf("It should return ErrQueueIsClosed, cause closed with items left, but instead we got %v", err)
+	}
+}
+
+func TestBandsQueueConformance(t *testing.T) {
+	queuetest.Run(t, func(sizeLimit int) (common.ExtendedQInterface, error) {
+		return NewBandsQueue(1, sizeLimit, 4)
+	})
+}
+
+type recordingLogger struct {
+	msgs []string
+}
+
+func (l *recordingLogger) Info(msg string, keyvals ...interface{}) {
+	l.msgs = append(l.msgs, "info: "+msg)
+}
+func (l *recordingLogger) Warn(msg string, keyvals ...interface{}) {
+	l.msgs = append(l.msgs, "warn: "+msg)
+}
+func (l *recordingLogger) Error(msg string, keyvals ...interface{}) {
+	l.msgs = append(l.msgs, "error: "+msg)
+}
+
+func TestBandsQueueWithLogger(t *testing.T) {
+	logger := &recordingLogger{}
+	bq, _ := NewBandsQueue(1, 1, 4, WithLogger(logger))
+	bq.PushOrError(common.QItem{ID: 1, Priority: 3})
+	bq.CloseNow()
+	if len(logger.msgs) != 1 || logger.msgs[0] != "warn: queue closed, dropping items" {
+		t.Fatalf("It should log the dropped items, but instead we got %v", logger.msgs)
+	}
+}
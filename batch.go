@@ -0,0 +1,90 @@
+package prioritize
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/aarondwi/prioritize/common"
+)
+
+// SubmitBatch is the same as calling `Submit` for each of `args`, all with the same `priority` and `fn`,
+// but the queue is only locked once for all of them, if it implements `common.BatchPusher`
+// (as built-in ones do).
+//
+// If the queue can't take all of them (e.g. it is full), the ones already queued are kept,
+// and their tasks are returned, in the same order as `args`, together with the error.
+func (e *Engine) SubmitBatch(
+	ctx context.Context,
+	priority int,
+	fn TaskFunc,
+	args []interface{}) ([]*Task, error) {
+
+	select {
+	case <-e.closeChan:
+		for range args {
+			e.onRejected(priority, ErrAlreadyClosed)
+		}
+		return nil, ErrAlreadyClosed
+	default:
+	}
+
+	tasks := make([]*Task, 0, len(args))
+	items := make([]common.QItem, 0, len(args))
+	var rejected error
+	for _, arg := range args {
+		admitted, err := e.admit(ctx, priority, arg)
+		if err != nil {
+			// the ones before are still queued, just like when the queue is full
+			rejected = err
+			break
+		}
+		task, item := e.prepare(ctx, admitted, fn, arg, nil, nil, false)
+		tasks = append(tasks, task)
+		items = append(items, item)
+	}
+	for _, task := range tasks {
+		e.track(task)
+	}
+
+	n, err := e.pushBatch(ctx, items)
+	for _, item := range items[:n] {
+		e.onEnqueued(item.Priority)
+	}
+	for i, task := range tasks[n:] {
+		e.withdraw(task, err)
+		e.onRejected(items[n+i].Priority, err)
+	}
+	if e.maxWorkers > 0 {
+		// maybe more than 1 worker is needed now
+		for i := 0; i < n; i++ {
+			if !e.maybeGrow() {
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = rejected
+	}
+	return tasks[:n], err
+}
+
+// pushBatch pushes `items` in order, in 1 go if the queue and the full policy allow,
+// returning how many are pushed, see `common.BatchPusher`
+func (e *Engine) pushBatch(ctx context.Context, items []common.QItem) (int, error) {
+	pushed := 0
+	swaps := atomic.LoadUint64(&e.swaps)
+	if pusher, ok := e.queue().(common.BatchPusher); ok && e.fullPolicy == FullReject {
+		n, err := pusher.PushBatchOrError(items)
+		if !e.swappedSince(swaps, err) {
+			return n, err
+		}
+		// the rest go to the new queue 1 by 1, see `SwapQueue`
+		pushed = n
+	}
+	for i := pushed; i < len(items); i++ {
+		if err := e.push(ctx, items[i]); err != nil {
+			return i, err
+		}
+	}
+	return len(items), nil
+}
@@ -0,0 +1,68 @@
+package prioritize
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/linkedslice"
+	"github.com/aarondwi/prioritize/priority"
+)
+
+func TestEngineSubmitBatch(t *testing.T) {
+	var _ common.BatchPusher = &priority.PriorityQueue{}
+	pq, _ := priority.NewPriorityQueue(4, 8)
+	engine, _ := New(pq, 1)
+	defer engine.Close()
+
+	block := make(chan struct{})
+	engine.Submit(context.Background(), 0,
+		func(ctx context.Context, arg interface{}) (interface{}, error) {
+			<-block
+			return nil, nil
+		}, nil)
+	for engine.Len() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	fn := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		return arg, nil
+	}
+	tasks, err := engine.SubmitBatch(context.Background(), 1, fn, []interface{}{0, 1, 2, 3, 4, 5})
+	if !errors.Is(err, common.ErrQueueIsFull) {
+		t.Fatalf("It should return ErrQueueIsFull, cause only 4 fit, instead we got %v", err)
+	}
+	if len(tasks) != 4 || engine.Len() != 4 {
+		t.Fatalf("It should keep the 4 queued, but instead we got %d and %d", len(tasks), engine.Len())
+	}
+	close(block)
+	for i, task := range tasks {
+		if result, err := task.Result(); err != nil || result.(int) != i {
+			t.Fatalf("Expected %d, but instead we got %v and %v", i, result, err)
+		}
+	}
+}
+
+func TestEngineSubmitBatchWithoutBatchPusher(t *testing.T) {
+	engine, _ := New(linkedslice.NewLinkedSlice(), 2)
+	fn := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		return arg, nil
+	}
+	tasks, err := engine.SubmitBatch(context.Background(), 0, fn, []interface{}{0, 1, 2})
+	if err != nil || len(tasks) != 3 {
+		t.Fatalf("It should push 1 by 1, but instead we got %d and %v", len(tasks), err)
+	}
+	for i, task := range tasks {
+		if result, err := task.Result(); err != nil || result.(int) != i {
+			t.Fatalf("Expected %d, but instead we got %v and %v", i, result, err)
+		}
+	}
+
+	engine.Close()
+	_, err = engine.SubmitBatch(context.Background(), 0, fn, []interface{}{3})
+	if err == nil || err != ErrAlreadyClosed {
+		t.Fatalf("It should return ErrAlreadyClosed, instead we got %v", err)
+	}
+}
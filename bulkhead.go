@@ -0,0 +1,92 @@
+package prioritize
+
+import (
+	"context"
+	"errors"
+
+	"github.com/aarondwi/prioritize/common"
+)
+
+// ErrBulkheadNotFound is returned when submitting to a bulkhead name not given on creation
+var ErrBulkheadNotFound = errors.New("No bulkhead with the given name")
+
+// Bulkhead configures 1 partition of `Bulkheads`
+type Bulkhead struct {
+	Queue       common.QInterface
+	NumOfWorker int
+}
+
+// Bulkheads partitions workers into named groups (e.g. per tenant or traffic class),
+// each with its own queue and workers.
+//
+// Unlike `NewWithTenants`, in which tenants share workers,
+// a flood (or slow tasks) in 1 bulkhead can never take workers of another,
+// at the cost of workers idling in 1 bulkhead while another is busy.
+type Bulkheads struct {
+	engines map[string]*Engine
+}
+
+// NewBulkheads creates 1 engine for each of `bulkheads`, all with the same `opts`
+func NewBulkheads(bulkheads map[string]Bulkhead, opts ...Option) (*Bulkheads, error) {
+	if len(bulkheads) == 0 {
+		return nil, common.ErrParamShouldBePositive
+	}
+
+	b := &Bulkheads{engines: make(map[string]*Engine, len(bulkheads))}
+	for name, bulkhead := range bulkheads {
+		e, err := New(bulkhead.Queue, bulkhead.NumOfWorker, opts...)
+		if err != nil {
+			b.Close()
+			return nil, err
+		}
+		b.engines[name] = e
+	}
+	return b, nil
+}
+
+// Submit is the same as `Engine.Submit`, on the engine of `bulkhead`.
+//
+// It returns `ErrBulkheadNotFound` if there is no such bulkhead.
+func (b *Bulkheads) Submit(
+	ctx context.Context,
+	bulkhead string,
+	priority int,
+	fn TaskFunc,
+	arg interface{}) (*Task, error) {
+
+	e, ok := b.engines[bulkhead]
+	if !ok {
+		return nil, ErrBulkheadNotFound
+	}
+	return e.Submit(ctx, priority, fn, arg)
+}
+
+// Engine returns the engine of `bulkhead`, e.g. to check its `Pressure()`,
+// or nil if there is no such bulkhead
+func (b *Bulkheads) Engine(bulkhead string) *Engine {
+	return b.engines[bulkhead]
+}
+
+// Close is the same as CloseNow
+func (b *Bulkheads) Close() {
+	b.CloseNow()
+}
+
+// CloseNow closes the engines of all bulkheads, see `Engine.CloseNow`
+func (b *Bulkheads) CloseNow() {
+	for _, e := range b.engines {
+		e.CloseNow()
+	}
+}
+
+// CloseGracefully closes the engines of all bulkheads gracefully,
+// see `Engine.CloseGracefully`. It returns after all of them have exited.
+func (b *Bulkheads) CloseGracefully() {
+	// all begin first, so they drain at the same time
+	for _, e := range b.engines {
+		e.beginCloseGracefully()
+	}
+	for _, e := range b.engines {
+		e.waitWorkers()
+	}
+}
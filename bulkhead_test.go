@@ -0,0 +1,75 @@
+package prioritize
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aarondwi/prioritize/priority"
+)
+
+func TestNewBulkheadsErrors(t *testing.T) {
+	_, err := NewBulkheads(nil)
+	if err == nil {
+		t.Fatal("It should error, cause there is no bulkhead, but it is not")
+	}
+
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	_, err = NewBulkheads(map[string]Bulkhead{"web": {Queue: pq, NumOfWorker: 0}})
+	if err == nil || err != ErrNumOfWorkerIsNegativeOrZero {
+		t.Fatalf("It should error, cause numOfWorker can't be zero, instead we got %v", err)
+	}
+}
+
+func TestBulkheadsIsolation(t *testing.T) {
+	webQ, _ := priority.NewPriorityQueue(2048, 8)
+	batchQ, _ := priority.NewPriorityQueue(2048, 8)
+	b, err := NewBulkheads(map[string]Bulkhead{
+		"web":   {Queue: webQ, NumOfWorker: 1},
+		"batch": {Queue: batchQ, NumOfWorker: 1},
+	})
+	if err != nil {
+		t.Fatalf("It should not error, because all are correct parameters, instead we got %v", err)
+	}
+
+	_, err = b.Submit(context.Background(), "unknown", 0, nil, nil)
+	if err == nil || err != ErrBulkheadNotFound {
+		t.Fatalf("It should error, cause there is no such bulkhead, instead we got %v", err)
+	}
+
+	// flood the batch bulkhead with blocking tasks
+	block := make(chan struct{})
+	started := make(chan struct{}, 10)
+	for i := 0; i < 10; i++ {
+		b.Submit(context.Background(), "batch", 0, func(ctx context.Context, arg interface{}) (interface{}, error) {
+			started <- struct{}{}
+			<-block
+			return nil, nil
+		}, nil)
+	}
+	// the only batch worker is now stuck
+	<-started
+
+	task, _ := b.Submit(context.Background(), "web", 0, func(ctx context.Context, arg interface{}) (interface{}, error) {
+		return "web", nil
+	}, nil)
+	done := make(chan struct{})
+	go func() {
+		task.Result()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Web task should not wait for the flooded batch bulkhead")
+	}
+	if b.Engine("batch").Len() != 9 {
+		t.Fatalf("Batch bulkhead should still have 9 queued, but instead we got %d", b.Engine("batch").Len())
+	}
+
+	close(block)
+	b.CloseGracefully()
+	if b.Engine("batch").Len() != 0 {
+		t.Fatalf("All batch tasks should be done after closing gracefully, but %d are left", b.Engine("batch").Len())
+	}
+}
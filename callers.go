@@ -0,0 +1,91 @@
+package prioritize
+
+import (
+	"context"
+	"errors"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/sfq"
+)
+
+// ErrFairCallersNotEnabled is returned when `SubmitForCaller()` is called
+// on an engine not created with `NewWithFairCallers()`
+var ErrFairCallersNotEnabled = errors.New("This engine is not created with fair callers")
+
+type callerKey struct{}
+
+// NewWithFairCallers creates a prioritization engine sharing workers fairly between callers
+// at the same priority, so 1 noisy caller can't crowd out the others.
+//
+// It uses `sfq.SFQueue`, which caps at `sizeLimit`, allows priority [0,numOfPriority),
+// and hashes callers into `numOfBuckets` buckets per priority, taking turns between them.
+// The highest priority still goes first. Note that turns are counted in tasks, not in worker time,
+// and callers hashed into the same bucket share its turn, so pick enough buckets.
+//
+// Use `SubmitForCaller` to submit for a caller. Other submissions share the bucket of caller `""`.
+func NewWithFairCallers(
+	sizeLimit, numOfPriority, numOfBuckets, numOfWorker int,
+	opts ...Option) (*Engine, error) {
+
+	if numOfWorker <= 0 {
+		return nil, ErrNumOfWorkerIsNegativeOrZero
+	}
+	// only called on push, once e is set
+	var e *Engine
+	q, err := sfq.NewSFQueue(sizeLimit, numOfPriority, numOfBuckets, func(item common.QItem) uint64 {
+		return e.callerOf(item)
+	})
+	if err != nil {
+		return nil, err
+	}
+	e, err = newEngine(q, numOfWorker, opts)
+	if err != nil {
+		return nil, err
+	}
+	e.fairCallers = true
+	return e, nil
+}
+
+// SubmitForCaller is the same as `Submit`, but the task gets the turns of `caller`.
+// `caller` is any key identifying the submitter, e.g. the name of the calling service.
+//
+// It returns `ErrFairCallersNotEnabled` if the engine is not created with `NewWithFairCallers`.
+func (e *Engine) SubmitForCaller(
+	ctx context.Context,
+	caller string,
+	priority int,
+	fn TaskFunc,
+	arg interface{}) (*Task, error) {
+
+	if !e.fairCallers {
+		return nil, ErrFairCallersNotEnabled
+	}
+	return e.Submit(context.WithValue(ctx, callerKey{}, hashCaller(caller)), priority, fn, arg)
+}
+
+// callerOf returns the hashed caller of `item`, see `SubmitForCaller`
+func (e *Engine) callerOf(item common.QItem) uint64 {
+	var ctx context.Context
+	switch payload := item.Payload.(type) {
+	case *Task:
+		ctx = payload.ctx
+	case *forgottenTask:
+		ctx = payload.ctx
+	default:
+		return hashCaller("")
+	}
+	if caller, ok := ctx.Value(callerKey{}).(uint64); ok {
+		return caller
+	}
+	return hashCaller("")
+}
+
+// hashCaller is FNV-1a, inlined as `hash/fnv` allocates
+func hashCaller(caller string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(caller); i++ {
+		h ^= uint64(caller[i])
+		h *= 1099511628211
+	}
+	return h
+}
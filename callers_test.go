@@ -0,0 +1,58 @@
+package prioritize
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aarondwi/prioritize/priority"
+)
+
+func TestEngineWithFairCallers(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	engine, _ := New(pq, 1)
+	_, err := engine.SubmitForCaller(context.Background(), "noisy", 0, nil, nil)
+	if err == nil || err != ErrFairCallersNotEnabled {
+		t.Fatalf("It should error, cause the engine is not created with fair callers, instead we got %v", err)
+	}
+	engine.Close()
+
+	engine, err = NewWithFairCallers(2048, 4, 64, 1)
+	if err != nil {
+		t.Fatalf("It should not error, because all are correct parameters, instead we got %v", err)
+	}
+	defer engine.Close()
+
+	gate := make(chan bool)
+	engine.Submit(context.Background(), 0, func(ctx context.Context, arg interface{}) (interface{}, error) {
+		<-gate
+		return nil, nil
+	}, nil)
+	for engine.Len() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	var mu sync.Mutex
+	var order []string
+	fn := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		mu.Lock()
+		order = append(order, arg.(string))
+		mu.Unlock()
+		return nil, nil
+	}
+	for i := 0; i < 10; i++ {
+		engine.SubmitForCaller(context.Background(), "noisy", 0, fn, "noisy")
+	}
+	last, _ := engine.SubmitForCaller(context.Background(), "quiet", 0, fn, "quiet")
+	close(gate)
+	last.Result()
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i, caller := range order {
+		if caller == "quiet" && i > 1 {
+			t.Fatalf("The quiet caller should take its turn right away, but instead we got %v", order)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package prioritize
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+
+	"github.com/aarondwi/prioritize/common"
+)
+
+// ErrTaskCancelled is returned by `Task.Result()` after the task is cancelled, see `Engine.Cancel`
+var ErrTaskCancelled = errors.New("Task is cancelled")
+
+// ErrTaskAlreadyCompleted is returned when cancelling a task which is already completed
+var ErrTaskAlreadyCompleted = errors.New("Task is already completed")
+
+// Cancel completes `task` right away with `ErrTaskCancelled`.
+//
+// If it is still queued, it is removed from the queue, freeing its slot,
+// if the queue implements `common.Remover` (built-in ones do), else it is skipped once popped.
+// If it is running, the ctx given to its fn is cancelled, but the worker still waits for fn to return.
+//
+// It returns `ErrTaskAlreadyCompleted` if `task` is already completed.
+func (e *Engine) Cancel(task *Task) error {
+	if remover, ok := e.queue().(common.Remover); ok {
+		// if it is not in the queue anymore, a worker already has it,
+		// and is gonna see it is completed
+		if _, err := remover.Remove(task.id); err == nil {
+			e.untrack(task)
+		}
+	}
+
+	task.mu.Lock()
+	completed := e.complete(task, nil, ErrTaskCancelled)
+	cancel := task.cancel
+	task.mu.Unlock()
+	if !completed {
+		return ErrTaskAlreadyCompleted
+	}
+	if cancel != nil {
+		cancel()
+	}
+	return nil
+}
+
+// Cancel is the same as `Engine.Cancel` on the engine `t` is submitted to
+func (t *Task) Cancel() error {
+	return t.engine.Cancel(t)
+}
+
+var noCancel context.CancelFunc = func() {}
+
+// start returns the ctx fn runs with, which is cancelled by `Engine.Cancel`.
+// It returns false if the task is already completed, e.g. cancelled while queued.
+func (t *Task) start() (context.Context, context.CancelFunc, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if atomic.LoadInt32(&t.completed) == 1 {
+		return nil, nil, false
+	}
+	// nobody has a handle to cancel it with, see `Engine.SubmitAndNotify`
+	cancel := noCancel
+	ctx := t.ctx
+	if !t.recycle {
+		ctx, cancel = context.WithCancel(t.ctx)
+		t.cancel = cancel
+	}
+	t.runCtx = runContext{Context: ctx, task: t}
+	atomic.StoreInt32(&t.status, int32(TaskRunning))
+	return &t.runCtx, cancel, true
+}
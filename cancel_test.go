@@ -0,0 +1,90 @@
+package prioritize
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aarondwi/prioritize/linkedslice"
+	"github.com/aarondwi/prioritize/priority"
+)
+
+func TestEngineCancel(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	engine, _ := New(pq, 1)
+	defer engine.Close()
+
+	started := make(chan struct{})
+	running, _ := engine.Submit(context.Background(), 0,
+		func(ctx context.Context, arg interface{}) (interface{}, error) {
+			close(started)
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}, 0)
+	<-started
+
+	fn := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		return arg, nil
+	}
+	queued, _ := engine.Submit(context.Background(), 0, fn, 1)
+	if err := queued.Cancel(); err != nil {
+		t.Fatalf("It should cancel the queued task, but instead we got %v", err)
+	}
+	if _, err := queued.Result(); err == nil || err != ErrTaskCancelled {
+		t.Fatalf("It should return ErrTaskCancelled, but instead we got %v", err)
+	}
+	if pq.Len() != 0 || engine.Len() != 0 {
+		t.Fatalf("It should be removed from the queue, but instead we got %d and %d", pq.Len(), engine.Len())
+	}
+
+	if err := engine.Cancel(running); err != nil {
+		t.Fatalf("It should cancel the running task, but instead we got %v", err)
+	}
+	if _, err := running.Result(); err == nil || err != ErrTaskCancelled {
+		t.Fatalf("It should return ErrTaskCancelled, but instead we got %v", err)
+	}
+
+	// the worker is freed, as the running fn sees its ctx cancelled
+	done, _ := engine.Submit(context.Background(), 0, fn, 2)
+	if result, err := done.Result(); err != nil || result.(int) != 2 {
+		t.Fatalf("Expected 2, but instead we got %v and %v", result, err)
+	}
+	if err := done.Cancel(); err == nil || err != ErrTaskAlreadyCompleted {
+		t.Fatalf("It should return ErrTaskAlreadyCompleted, but instead we got %v", err)
+	}
+}
+
+func TestEngineCancelWithoutRemover(t *testing.T) {
+	// LinkedSlice does not implement common.Remover
+	engine, _ := New(linkedslice.NewLinkedSlice(), 1)
+	defer engine.Close()
+
+	gate := make(chan struct{})
+	engine.Submit(context.Background(), 0,
+		func(ctx context.Context, arg interface{}) (interface{}, error) {
+			<-gate
+			return nil, nil
+		}, 0)
+	for engine.Len() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ran := false
+	queued, _ := engine.Submit(context.Background(), 0,
+		func(ctx context.Context, arg interface{}) (interface{}, error) {
+			ran = true
+			return nil, nil
+		}, 1)
+	queued.Cancel()
+	close(gate)
+
+	// runs after the cancelled one is popped and skipped
+	last, _ := engine.Submit(context.Background(), 0,
+		func(ctx context.Context, arg interface{}) (interface{}, error) {
+			return arg, nil
+		}, 2)
+	last.Result()
+	if _, err := queued.Result(); err == nil || err != ErrTaskCancelled || ran {
+		t.Fatalf("It should be skipped once popped, but instead we got %v and ran is %v", err, ran)
+	}
+}
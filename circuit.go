@@ -0,0 +1,127 @@
+package prioritize
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+)
+
+// ErrCircuitOpen is returned by `Task.Result()` of a task failed without running,
+// because its tag has failed too many times in a row, see `WithCircuitBreaker`
+var ErrCircuitOpen = errors.New("The circuit of the task tag is open")
+
+type tagKey struct{}
+
+// ContextWithTag returns a copy of `ctx` tagging the task submitted with it,
+// e.g. with the name of the downstream it calls, see `WithCircuitBreaker`.
+func ContextWithTag(ctx context.Context, tag string) context.Context {
+	return context.WithValue(ctx, tagKey{}, tag)
+}
+
+// tagOf returns the tag set with `ContextWithTag`, or "" if none
+func tagOf(ctx context.Context) string {
+	tag, _ := ctx.Value(tagKey{}).(string)
+	return tag
+}
+
+// WithCircuitBreaker makes the engine stop running tasks of a tag (see `ContextWithTag`)
+// once `failures` of them in a row return an error, e.g. because the downstream they call is down.
+// For `cooldown` afterwards, tasks of that tag taken by workers fail right away with `ErrCircuitOpen`,
+// without running, nor being retried, instead of burning workers. They do go to the deadletter (see `WithDeadletter`).
+// Then 1 task is let through as a trial, closing the circuit if it succeeds, or opening it again if not.
+//
+// Each failed attempt counts, so retries (see `WithRetry`) can open the circuit too.
+// Untagged tasks are never failed by the circuit breaker.
+func WithCircuitBreaker(failures int, cooldown time.Duration) Option {
+	return func(e *Engine) error {
+		if failures <= 0 || cooldown <= 0 {
+			return common.ErrParamShouldBePositive
+		}
+		e.breaker = &circuitBreaker{
+			failures: failures,
+			cooldown: cooldown,
+			circuits: make(map[string]*circuit),
+		}
+		return nil
+	}
+}
+
+// circuitBreaker tracks consecutive failures of each tag, see `WithCircuitBreaker`.
+//
+// This struct is thread(goroutine)-safe.
+type circuitBreaker struct {
+	failures int
+	cooldown time.Duration
+
+	mu       sync.Mutex
+	circuits map[string]*circuit
+}
+
+type circuit struct {
+	failures  int
+	openUntil time.Time
+}
+
+// allow returns whether a task of `tag` can run now.
+// Once the cooldown passes, it lets 1 through, and opens the circuit again while it runs.
+func (cb *circuitBreaker) allow(tag string) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	c, ok := cb.circuits[tag]
+	if !ok || c.failures < cb.failures {
+		return true
+	}
+	now := time.Now()
+	if now.Before(c.openUntil) {
+		return false
+	}
+	// the trial, if it never reports back (e.g. cancelled), another is let through after the cooldown
+	c.openUntil = now.Add(cb.cooldown)
+	return true
+}
+
+// record counts the outcome of a task of `tag`, returning true if it opens the circuit
+func (cb *circuitBreaker) record(tag string, err error) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	c, ok := cb.circuits[tag]
+	if err == nil {
+		if ok {
+			delete(cb.circuits, tag)
+		}
+		return false
+	}
+	if !ok {
+		c = &circuit{}
+		cb.circuits[tag] = c
+	}
+	c.failures++
+	if c.failures < cb.failures {
+		return false
+	}
+	c.openUntil = time.Now().Add(cb.cooldown)
+	return c.failures == cb.failures
+}
+
+// circuitAllows returns whether a task submitted with `ctx` can run, see `WithCircuitBreaker`
+func (e *Engine) circuitAllows(ctx context.Context) bool {
+	if e.breaker == nil {
+		return true
+	}
+	tag := tagOf(ctx)
+	return tag == "" || e.breaker.allow(tag)
+}
+
+// circuitRecord counts the outcome of a task submitted with `ctx`, see `WithCircuitBreaker`
+func (e *Engine) circuitRecord(ctx context.Context, err error) {
+	if e.breaker == nil || err == ErrYield {
+		return
+	}
+	tag := tagOf(ctx)
+	if tag != "" && e.breaker.record(tag, err) {
+		e.logger.Warn("circuit opened", "tag", tag, "failures", e.breaker.failures)
+	}
+}
@@ -0,0 +1,83 @@
+package prioritize
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/priority"
+)
+
+func TestEngineWithCircuitBreaker(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	_, err := New(pq, 1, WithCircuitBreaker(0, time.Second))
+	if !errors.Is(err, common.ErrParamShouldBePositive) {
+		t.Fatalf("It should error, cause failures is not positive, instead we got %v", err)
+	}
+
+	var deadlettered int32
+	engine, err := New(pq, 1,
+		WithCircuitBreaker(2, 30*time.Millisecond),
+		WithDeadletter(func(task *Task, err error) {
+			atomic.AddInt32(&deadlettered, 1)
+		}))
+	if err != nil {
+		t.Fatalf("It should not error, because all are correct parameters, instead we got %v", err)
+	}
+	defer engine.Close()
+
+	errFailing := errors.New("failing")
+	var runs int32
+	failing := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		atomic.AddInt32(&runs, 1)
+		if arg != nil {
+			return nil, arg.(error)
+		}
+		return nil, nil
+	}
+	submit := func(ctx context.Context, arg interface{}) error {
+		task, _ := engine.Submit(ctx, 0, failing, arg)
+		_, err := task.Result()
+		return err
+	}
+	tagged := ContextWithTag(context.Background(), "downstream")
+
+	for i := 0; i < 2; i++ {
+		if err := submit(tagged, errFailing); err != errFailing {
+			t.Fatalf("Expected errFailing, but instead we got %v", err)
+		}
+	}
+	if err := submit(tagged, nil); err == nil || err != ErrCircuitOpen {
+		t.Fatalf("Expected the circuit to be open, but instead we got %v", err)
+	}
+	if atomic.LoadInt32(&runs) != 2 || atomic.LoadInt32(&deadlettered) != 3 {
+		t.Fatalf("Expected 2 runs and 3 deadlettered, but instead we got %d and %d", runs, deadlettered)
+	}
+	// other tags and untagged tasks are not affected
+	if err := submit(ContextWithTag(context.Background(), "other"), nil); err != nil {
+		t.Fatalf("It should not error, instead we got %v", err)
+	}
+	if err := submit(context.Background(), nil); err != nil {
+		t.Fatalf("It should not error, instead we got %v", err)
+	}
+
+	// a failing trial opens it again
+	time.Sleep(40 * time.Millisecond)
+	if err := submit(tagged, errFailing); err != errFailing {
+		t.Fatalf("Expected the trial to run, but instead we got %v", err)
+	}
+	if err := submit(tagged, nil); err == nil || err != ErrCircuitOpen {
+		t.Fatalf("Expected the circuit to be open again, but instead we got %v", err)
+	}
+
+	// while a succeeding one closes it
+	time.Sleep(40 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if err := submit(tagged, nil); err != nil {
+			t.Fatalf("Expected the circuit to be closed, but instead we got %v", err)
+		}
+	}
+}
@@ -0,0 +1,432 @@
+package coalesce
+
+import (
+	"context"
+	"sync"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/linkedslice"
+)
+
+// Merged is an item returned by `CoalescingQueue`,
+// together with how many pushes were merged into it.
+type Merged struct {
+	common.QItem
+	Count int
+}
+
+// KeyFunc returns the dedup key of an item.
+// Items with the same key are merged while queued.
+type KeyFunc func(item common.QItem) uint64
+
+// CoalescingQueue is a queue which always returns the highest priority first,
+// just like `priority.PriorityQueue`, but pushing an item whose key is already queued
+// merges it into the queued one, instead of queueing it again.
+//
+// The merged item keeps the fields (ID, EnqueuedAt, etc) of the first push,
+// except it is raised to the highest priority among the merged pushes.
+// This suits workloads like cache refresh or notifications, where doing duplicate work is wasteful.
+//
+// Only distinct keys count towards sizeLimit, so merging never fails with `common.ErrQueueIsFull`.
+// The ID and Payload of merged pushes are dropped, and reported to the `OnMerge` callback, if any.
+// Note that an `Engine` never completes the tasks of merged pushes,
+// so with an `Engine`, use `prioritize.Engine.SubmitDedup` instead.
+type CoalescingQueue struct {
+	// synchronization primitive
+	// read-only calls (e.g. Len) only take the read lock,
+	// so they don't contend with each other
+	mu       *sync.RWMutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	// broadcast once the size reaches 0, see `WaitUntilEmpty`
+	emptied *sync.Cond
+
+	// we separate number tracking from the queues
+	// so checking numberOfTasksInEachQueue just need 1 cache miss (putting into cpu L1 cache)
+	numberOfTasksInEachQueue []int
+	queues                   []*linkedslice.LinkedSlice
+
+	key     KeyFunc
+	queued  map[uint64]*entry
+	onMerge func(common.QItem)
+
+	// simple metadata
+	limitPriority int
+	size          int
+	sizeLimit     int
+	running       bool
+	closed        chan struct{}
+	draining      bool
+}
+
+// entry tracks the queued item of a key
+type entry struct {
+	id       uint64
+	priority int
+	count    int
+}
+
+// Option configures optional behavior of CoalescingQueue
+type Option func(*CoalescingQueue) error
+
+// OnMerge makes CoalescingQueue call `fn` with each push merged into an already queued item,
+// e.g. to complete whatever its Payload is waiting for.
+// It is called from the pushing goroutine, before the push returns,
+// so it should be fast, and never call the queue itself.
+func OnMerge(fn func(item common.QItem)) Option {
+	return func(cq *CoalescingQueue) error {
+		cq.onMerge = fn
+		return nil
+	}
+}
+
+// NewCoalescingQueue creates our coalescing queue, which caps at sizeLimit distinct keys,
+// and allows priority [0,numOfPriority).
+//
+// `key` returns the dedup key of an item. If nil, the item ID is used.
+func NewCoalescingQueue(sizeLimit, numOfPriority int, key KeyFunc, opts ...Option) (*CoalescingQueue, error) {
+	if sizeLimit <= 0 || numOfPriority <= 0 {
+		return nil, common.ErrParamShouldBePositive
+	}
+	if key == nil {
+		key = func(item common.QItem) uint64 { return item.ID }
+	}
+
+	mu := &sync.RWMutex{}
+	queues := make([]*linkedslice.LinkedSlice, numOfPriority)
+	for i := range queues {
+		queues[i] = linkedslice.NewLinkedSlice()
+	}
+	cq := &CoalescingQueue{
+		mu:                       mu,
+		notEmpty:                 sync.NewCond(mu),
+		notFull:                  sync.NewCond(mu),
+		emptied:                  sync.NewCond(mu),
+		numberOfTasksInEachQueue: make([]int, numOfPriority),
+		queues:                   queues,
+		key:                      key,
+		queued:                   make(map[uint64]*entry),
+		limitPriority:            numOfPriority,
+		sizeLimit:                sizeLimit,
+		running:                  true,
+		closed:                   make(chan struct{}),
+	}
+	for _, opt := range opts {
+		if err := opt(cq); err != nil {
+			return nil, err
+		}
+	}
+	return cq, nil
+}
+
+// PushOrError put the item into the queue, or merges it into the queued item with the same key.
+// It returns error if the key is not queued yet, and no slot available.
+func (cq *CoalescingQueue) PushOrError(item common.QItem) error {
+	cq.mu.Lock()
+	merged, err := cq.pushLocked(item)
+	if err != nil {
+		err = cq.queueErrorLocked("PushOrError", item, err)
+	}
+	cq.mu.Unlock()
+	if merged {
+		cq.merged(item)
+	}
+	return err
+}
+
+// PushOrWaitCtx is the same as PushOrError, but waits for a slot while the queue is full,
+// and returns `ctx.Err()` once `ctx` is done while waiting
+func (cq *CoalescingQueue) PushOrWaitCtx(ctx context.Context, item common.QItem) error {
+	merged, err := cq.pushOrWaitCtx(ctx, item)
+	if merged {
+		cq.merged(item)
+	}
+	return err
+}
+
+func (cq *CoalescingQueue) pushOrWaitCtx(ctx context.Context, item common.QItem) (bool, error) {
+	cq.mu.Lock()
+	defer cq.mu.Unlock()
+	merged, err := cq.pushLocked(item)
+	if err == common.ErrQueueIsFull {
+		defer common.WakeOnDone(ctx, cq.notFull)()
+	}
+	for err == common.ErrQueueIsFull {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return false, ctxErr
+		}
+		cq.notFull.Wait()
+		merged, err = cq.pushLocked(item)
+	}
+	if err != nil {
+		return false, cq.queueErrorLocked("PushOrWaitCtx", item, err)
+	}
+	return merged, nil
+}
+
+// queueErrorLocked adds what cq looks like right now to `err`, see `common.QueueError`
+func (cq *CoalescingQueue) queueErrorLocked(op string, item common.QItem, err error) error {
+	return &common.QueueError{Op: op, Priority: item.Priority, Size: cq.size, Limit: cq.sizeLimit, Err: err}
+}
+
+// merged reports `item` to the `OnMerge` callback, if any, outside of the lock
+func (cq *CoalescingQueue) merged(item common.QItem) {
+	if cq.onMerge != nil {
+		cq.onMerge(item)
+	}
+}
+
+// pushLocked returns true if `item` is merged into the queued item with the same key
+func (cq *CoalescingQueue) pushLocked(item common.QItem) (bool, error) {
+	if item.Priority < 0 || item.Priority >= cq.limitPriority {
+		return false, common.ErrPriorityOutOfRange
+	}
+	if !cq.running || cq.draining {
+		return false, common.ErrQueueIsClosed
+	}
+
+	k := cq.key(item)
+	if e, ok := cq.queued[k]; ok {
+		e.count++
+		if item.Priority > e.priority {
+			// raise the queued one, to the back of the new priority
+			queuedItem, _ := cq.queues[e.priority].Remove(e.id)
+			cq.numberOfTasksInEachQueue[e.priority]--
+			queuedItem.Priority = item.Priority
+			cq.queues[item.Priority].PushOrError(queuedItem)
+			cq.numberOfTasksInEachQueue[item.Priority]++
+			e.priority = item.Priority
+		}
+		return true, nil
+	}
+
+	if cq.size == cq.sizeLimit {
+		return false, common.ErrQueueIsFull
+	}
+	err := cq.queues[item.Priority].PushOrError(item)
+	// meaning already closed, cause linkedslices is unbounded
+	if err != nil {
+		return false, err
+	}
+	cq.queued[k] = &entry{id: item.ID, priority: item.Priority, count: 1}
+	cq.numberOfTasksInEachQueue[item.Priority]++
+	cq.size++
+	cq.notEmpty.Signal()
+	return false, nil
+}
+
+// PopOrWaitTillClose returns the highest priority item, or waits if none exists.
+// Use PopMergedOrWaitTillClose to also know how many pushes were merged.
+func (cq *CoalescingQueue) PopOrWaitTillClose() (common.QItem, error) {
+	return cq.PopOrWaitCtx(context.Background())
+}
+
+// PopOrWaitCtx is the same as PopOrWaitTillClose,
+// but also returns `ctx.Err()` once `ctx` is done while waiting
+func (cq *CoalescingQueue) PopOrWaitCtx(ctx context.Context) (common.QItem, error) {
+	m, err := cq.PopMergedOrWaitCtx(ctx)
+	if err != nil {
+		return common.MinQItem, err
+	}
+	return m.QItem, nil
+}
+
+// PopMergedOrWaitTillClose returns the highest priority item,
+// together with how many pushes were merged into it, or waits if none exists.
+func (cq *CoalescingQueue) PopMergedOrWaitTillClose() (Merged, error) {
+	return cq.PopMergedOrWaitCtx(context.Background())
+}
+
+// PopMergedOrWaitCtx is the same as PopMergedOrWaitTillClose,
+// but also returns `ctx.Err()` once `ctx` is done while waiting
+func (cq *CoalescingQueue) PopMergedOrWaitCtx(ctx context.Context) (Merged, error) {
+	cq.mu.Lock()
+	defer cq.mu.Unlock()
+	if !cq.running {
+		return Merged{QItem: common.MinQItem}, common.ErrQueueIsClosed
+	}
+	if cq.size == 0 {
+		defer common.WakeOnDone(ctx, cq.notEmpty)()
+	}
+	for cq.size == 0 {
+		if cq.draining {
+			cq.closeLocked()
+			return Merged{QItem: common.MinQItem}, common.ErrQueueIsClosed
+		}
+		if err := ctx.Err(); err != nil {
+			return Merged{QItem: common.MinQItem}, err
+		}
+		cq.notEmpty.Wait()
+		// double check, ensuring see the changes after wait call
+		if !cq.running {
+			return Merged{QItem: common.MinQItem}, common.ErrQueueIsClosed
+		}
+	}
+	return cq.popLocked()
+}
+
+// TryPop is the non-blocking version of PopOrWaitTillClose.
+// It returns `common.ErrQueueIsEmpty` right away if the queue is empty.
+func (cq *CoalescingQueue) TryPop() (common.QItem, error) {
+	cq.mu.Lock()
+	defer cq.mu.Unlock()
+	if !cq.running {
+		return common.MinQItem, common.ErrQueueIsClosed
+	}
+	if cq.size == 0 {
+		return common.MinQItem, common.ErrQueueIsEmpty
+	}
+	m, err := cq.popLocked()
+	if err != nil {
+		return common.MinQItem, err
+	}
+	return m.QItem, nil
+}
+
+// popLocked takes the highest priority item, there should be at least 1
+func (cq *CoalescingQueue) popLocked() (Merged, error) {
+	p := cq.limitPriority - 1
+	for cq.numberOfTasksInEachQueue[p] == 0 {
+		p--
+	}
+	// if we wait blindly, it gonna stuck
+	// but we are tracking it manually, ensuring it will never wait
+	item, err := cq.queues[p].PopOrWaitTillClose()
+	if err != nil {
+		return Merged{QItem: common.MinQItem}, err
+	}
+	k := cq.key(item)
+	result := Merged{QItem: item, Count: cq.queued[k].count}
+	delete(cq.queued, k)
+	cq.numberOfTasksInEachQueue[p]--
+	cq.size--
+	cq.notFull.Signal()
+
+	if cq.size == 0 {
+		cq.emptied.Broadcast()
+		if cq.draining {
+			cq.closeLocked()
+		}
+	}
+	return result, nil
+}
+
+// Peek returns the item the next pop returns, without removing it,
+// or `common.ErrQueueIsEmpty` if the queue is empty.
+func (cq *CoalescingQueue) Peek() (common.QItem, error) {
+	cq.mu.RLock()
+	defer cq.mu.RUnlock()
+	if !cq.running {
+		return common.MinQItem, common.ErrQueueIsClosed
+	}
+	for p := cq.limitPriority - 1; p >= 0; p-- {
+		if cq.numberOfTasksInEachQueue[p] > 0 {
+			item, _ := cq.queues[p].Peek()
+			return item, nil
+		}
+	}
+	return common.MinQItem, common.ErrQueueIsEmpty
+}
+
+// Len returns the number of distinct keys currently in the queue
+func (cq *CoalescingQueue) Len() int {
+	cq.mu.RLock()
+	defer cq.mu.RUnlock()
+	return cq.size
+}
+
+// Cap returns the maximum number of distinct keys the queue can hold
+func (cq *CoalescingQueue) Cap() int {
+	return cq.sizeLimit
+}
+
+// DepthPerPriority returns the number of items currently in each priority,
+// counting merged pushes once, just like Len
+func (cq *CoalescingQueue) DepthPerPriority() []int {
+	cq.mu.RLock()
+	defer cq.mu.RUnlock()
+	depths := make([]int, cq.limitPriority)
+	copy(depths, cq.numberOfTasksInEachQueue)
+	return depths
+}
+
+// Close is the same as CloseNow
+func (cq *CoalescingQueue) Close() error {
+	return cq.CloseNow()
+}
+
+// CloseNow closes CoalescingQueue, preventing it from accepting new request.
+// Remaining items are dropped, and waiting pops return immediately.
+// Closing it again does nothing, only returning `common.ErrQueueIsClosed`.
+func (cq *CoalescingQueue) CloseNow() error {
+	cq.mu.Lock()
+	defer cq.mu.Unlock()
+	if !cq.running {
+		return common.ErrQueueIsClosed
+	}
+	cq.closeLocked()
+	return nil
+}
+
+// CloseGracefully stops CoalescingQueue from accepting new request,
+// but pops keep returning the remaining items.
+// Once it is empty, it is closed the same way as CloseNow.
+func (cq *CoalescingQueue) CloseGracefully() {
+	cq.mu.Lock()
+	if cq.running {
+		cq.draining = true
+		if cq.size == 0 {
+			cq.closeLocked()
+		}
+	}
+	cq.mu.Unlock()
+}
+
+// WaitUntilEmpty waits until CoalescingQueue holds no item, and returns nil.
+// It returns `common.ErrQueueIsClosed` if CoalescingQueue is closed with items left,
+// or `ctx.Err()` once `ctx` is done while waiting.
+func (cq *CoalescingQueue) WaitUntilEmpty(ctx context.Context) error {
+	cq.mu.Lock()
+	defer cq.mu.Unlock()
+	if cq.size > 0 {
+		defer common.WakeOnDone(ctx, cq.emptied)()
+	}
+	for cq.size > 0 {
+		if !cq.running {
+			return common.ErrQueueIsClosed
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		cq.emptied.Wait()
+	}
+	return nil
+}
+
+// IsClosed returns whether CoalescingQueue is closed, after which no item is popped anymore
+func (cq *CoalescingQueue) IsClosed() bool {
+	cq.mu.RLock()
+	defer cq.mu.RUnlock()
+	return !cq.running
+}
+
+// Closed returns a channel which is closed once CoalescingQueue is closed,
+// so other goroutines can select on it
+func (cq *CoalescingQueue) Closed() <-chan struct{} {
+	return cq.closed
+}
+
+func (cq *CoalescingQueue) closeLocked() {
+	if !cq.running {
+		// already closed, cq.closed can't be closed twice
+		return
+	}
+	cq.running = false
+	close(cq.closed)
+	for _, q := range cq.queues {
+		q.Close()
+	}
+	cq.notEmpty.Broadcast()
+	cq.notFull.Broadcast()
+	cq.emptied.Broadcast()
+}
@@ -0,0 +1,131 @@
+package coalesce
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/queuetest"
+)
+
+func TestNewCoalescingQueueErrors(t *testing.T) {
+	_, err := NewCoalescingQueue(0, 4, nil)
+	if err == nil || err != common.ErrParamShouldBePositive {
+		t.Fatalf("It should error, cause sizeLimit can't be zero, but instead we got %v", err)
+	}
+
+	cq, _ := NewCoalescingQueue(1, 4, nil)
+	err = cq.PushOrError(common.QItem{ID: 1, Priority: 4})
+	if !errors.Is(err, common.ErrPriorityOutOfRange) {
+		t.Fatalf("It should error, cause priority is out of range, but instead we got %v", err)
+	}
+	cq.PushOrError(common.QItem{ID: 1})
+	if err = cq.PushOrError(common.QItem{ID: 1}); err != nil {
+		t.Fatalf("It should be merged even when full, but instead we got %v", err)
+	}
+	err = cq.PushOrError(common.QItem{ID: 2})
+	if !errors.Is(err, common.ErrQueueIsFull) {
+		t.Fatalf("It should error, cause queue is full, but instead we got %v", err)
+	}
+}
+
+func TestCoalescingQueueMerges(t *testing.T) {
+	// ID / 10 is the key, e.g. the cache entry to refresh
+	cq, _ := NewCoalescingQueue(2048, 4, func(item common.QItem) uint64 { return item.ID / 10 })
+	cq.PushOrError(common.QItem{ID: 10, Priority: 1})
+	cq.PushOrError(common.QItem{ID: 20, Priority: 2})
+	cq.PushOrError(common.QItem{ID: 11, Priority: 0})
+	cq.PushOrError(common.QItem{ID: 12, Priority: 3})
+	cq.PushOrError(common.QItem{ID: 21, Priority: 1})
+	if cq.Len() != 2 {
+		t.Fatalf("It should only have 2 distinct keys, but instead we got %d", cq.Len())
+	}
+
+	expected := []Merged{
+		{QItem: common.QItem{ID: 10, Priority: 3}, Count: 3},
+		{QItem: common.QItem{ID: 20, Priority: 2}, Count: 2},
+	}
+	for _, e := range expected {
+		m, err := cq.PopMergedOrWaitTillClose()
+		if err != nil || m != e {
+			t.Fatalf("Expected %v, but instead we got %v and %v", e, m, err)
+		}
+	}
+
+	// popped keys are queued anew
+	cq.PushOrError(common.QItem{ID: 13, Priority: 0})
+	cq.CloseGracefully()
+	item, err := cq.PopOrWaitTillClose()
+	if err != nil || item.ID != 13 {
+		t.Fatalf("It should still return the remaining item, but instead we got %v and %v", item, err)
+	}
+	_, err = cq.PopOrWaitTillClose()
+	if err == nil || err != common.ErrQueueIsClosed {
+		t.Fatalf("It should be closed after draining, but instead we got %v", err)
+	}
+}
+
+func TestCoalescingQueueOnMerge(t *testing.T) {
+	var merged []uint64
+	cq, _ := NewCoalescingQueue(1, 4, func(item common.QItem) uint64 { return item.ID / 10 },
+		OnMerge(func(item common.QItem) { merged = append(merged, item.ID) }))
+	cq.PushOrError(common.QItem{ID: 10})
+	cq.PushOrError(common.QItem{ID: 11})
+	cq.PushOrWaitCtx(context.Background(), common.QItem{ID: 12})
+	if len(merged) != 2 || merged[0] != 11 || merged[1] != 12 {
+		t.Fatalf("It should report the merged pushes 11 and 12, but instead we got %v", merged)
+	}
+	item, err := cq.PopOrWaitTillClose()
+	if err != nil || item.ID != 10 {
+		t.Fatalf("It should return the first push, but instead we got %v and %v", item, err)
+	}
+}
+
+func TestCoalescingQueueWaitUntilEmpty(t *testing.T) {
+	cq, _ := NewCoalescingQueue(10, 4, nil)
+	cq.PushOrError(common.QItem{ID: 1})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := cq.WaitUntilEmpty(ctx); err == nil || err != context.DeadlineExceeded {
+		t.Fatalf("It should return context.DeadlineExceeded, cause nothing is popped, but instead we got %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cq.WaitUntilEmpty(context.Background())
+	}()
+	cq.PopOrWaitTillClose()
+	if err := <-done; err != nil {
+		t.Fatalf("It should return once the last item is popped, but instead we got %v", err)
+	}
+
+	cq.PushOrError(common.QItem{ID: 2})
+	cq.Close()
+	if err := cq.WaitUntilEmpty(context.Background()); err == nil || err != common.ErrQueueIsClosed {
+		t.Fatalf("It should return ErrQueueIsClosed, cause closed with items left, but instead we got %v", err)
+	}
+}
+
+func TestCoalescingQueueConformance(t *testing.T) {
+	queuetest.Run(t, func(sizeLimit int) (common.ExtendedQInterface, error) {
+		return NewCoalescingQueue(sizeLimit, 4, nil)
+	})
+}
+
+func TestCoalescingQueuePeek(t *testing.T) {
+	cq, _ := NewCoalescingQueue(10, 4, nil)
+	cq.PushOrError(common.QItem{ID: 1, Priority: 0})
+	cq.PushOrError(common.QItem{ID: 2, Priority: 3})
+	item, err := cq.Peek()
+	if err != nil || item.ID != 2 {
+		t.Fatalf("It should peek ID 2, but instead we got %v and %v", item, err)
+	}
+	popped, _ := cq.PopOrWaitTillClose()
+	if popped.ID != item.ID {
+		t.Fatalf("It should pop the peeked item, but instead we got %v", popped)
+	}
+	cq.Close()
+}
@@ -0,0 +1,305 @@
+package codel
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+)
+
+// ErrShedding is returned when a low priority item is pushed,
+// while items have been waiting longer than the target for too long
+var ErrShedding = errors.New("queue is overloaded, shedding low priority qitem")
+
+// Queue wraps another queue, shedding low priority pushes when it is overloaded,
+// in the spirit of CoDel (controlled delay).
+//
+// It measures how long each popped item waited (its sojourn time).
+// Once the sojourn time stays above `target` for at least `interval`,
+// pushes with a priority below `minPriority` are rejected with `ErrShedding`,
+// until a popped item waited `target` or less again, the wrapped queue is empty,
+// or nothing is popped for `interval` (e.g. the workers are gone).
+// This keeps the tail latency of the higher priorities bounded under overload,
+// instead of letting the queue fill up first.
+//
+// Push times are tracked by item ID.
+//
+// This struct is thread(goroutine)-safe, if the wrapped queue is.
+type Queue struct {
+	q           common.QInterface
+	target      time.Duration
+	interval    time.Duration
+	minPriority int
+	now         func() time.Time
+
+	mu       sync.Mutex
+	pushedAt map[uint64]time.Time
+	// when the sojourn time first went above target, or zero if it is not above now
+	aboveSince time.Time
+	lastPop    time.Time
+	shedding   bool
+}
+
+// Option configures optional behavior of Queue
+type Option func(*Queue) error
+
+// WithClock makes the Queue read the time from `now`, instead of `time.Now`.
+// Mainly for testing.
+func WithClock(now func() time.Time) Option {
+	return func(cq *Queue) error {
+		cq.now = now
+		return nil
+	}
+}
+
+// New creates Queue wrapping `q`.
+// Both `target` and `interval` should be positive.
+func New(q common.QInterface, target, interval time.Duration, minPriority int, opts ...Option) (*Queue, error) {
+	if target <= 0 || interval <= 0 {
+		return nil, common.ErrParamShouldBePositive
+	}
+	cq := &Queue{
+		q:           q,
+		target:      target,
+		interval:    interval,
+		minPriority: minPriority,
+		now:         time.Now,
+		pushedAt:    make(map[uint64]time.Time),
+	}
+	for _, opt := range opts {
+		if err := opt(cq); err != nil {
+			return nil, err
+		}
+	}
+	return cq, nil
+}
+
+// Shedding returns whether low priority pushes are currently rejected
+func (cq *Queue) Shedding() bool {
+	cq.mu.Lock()
+	defer cq.mu.Unlock()
+	return cq.sheddingLocked(cq.now())
+}
+
+// sheddingLocked stops shedding first, if nothing is left to measure the sojourn time with
+func (cq *Queue) sheddingLocked(now time.Time) bool {
+	if cq.shedding && (len(cq.pushedAt) == 0 || now.Sub(cq.lastPop) >= cq.interval) {
+		cq.aboveSince = time.Time{}
+		cq.shedding = false
+	}
+	return cq.shedding
+}
+
+// PushOrError pushes the item into the wrapped queue,
+// or returns `ErrShedding` if it is below `minPriority` while shedding
+func (cq *Queue) PushOrError(item common.QItem) error {
+	return cq.push(item, cq.q.PushOrError)
+}
+
+// PushOrWaitCtx is the same as PushOrError, but waits for a slot while the wrapped queue is full,
+// if it implements `common.CtxPusher`, else it is the same as PushOrError
+func (cq *Queue) PushOrWaitCtx(ctx context.Context, item common.QItem) error {
+	pusher, ok := cq.q.(common.CtxPusher)
+	if !ok {
+		return cq.PushOrError(item)
+	}
+	return cq.push(item, func(item common.QItem) error {
+		return pusher.PushOrWaitCtx(ctx, item)
+	})
+}
+
+// push checks whether `item` is shed, and notes when it is pushed with `pushFn`
+func (cq *Queue) push(item common.QItem, pushFn func(common.QItem) error) error {
+	now := cq.now()
+	cq.mu.Lock()
+	if item.Priority < cq.minPriority && cq.sheddingLocked(now) {
+		cq.mu.Unlock()
+		return ErrShedding
+	}
+	cq.pushedAt[item.ID] = now
+	cq.mu.Unlock()
+
+	err := pushFn(item)
+	if err != nil {
+		cq.mu.Lock()
+		delete(cq.pushedAt, item.ID)
+		cq.mu.Unlock()
+	}
+	return err
+}
+
+// popped updates the shedding state by how long `item` waited
+func (cq *Queue) popped(item common.QItem, now time.Time) {
+	cq.mu.Lock()
+	defer cq.mu.Unlock()
+	pushedAt, ok := cq.pushedAt[item.ID]
+	if !ok {
+		return
+	}
+	delete(cq.pushedAt, item.ID)
+	cq.lastPop = now
+
+	if now.Sub(pushedAt) <= cq.target {
+		cq.aboveSince = time.Time{}
+		cq.shedding = false
+		return
+	}
+	if cq.aboveSince.IsZero() {
+		cq.aboveSince = now
+	}
+	if now.Sub(cq.aboveSince) >= cq.interval {
+		cq.shedding = true
+	}
+}
+
+// PopOrWaitTillClose pops from the wrapped queue
+func (cq *Queue) PopOrWaitTillClose() (common.QItem, error) {
+	return cq.PopOrWaitCtx(context.Background())
+}
+
+// PopOrWaitCtx is the same as PopOrWaitTillClose, but also returns `ctx.Err()`
+// once `ctx` is done while waiting. If the wrapped queue does not implement
+// `common.CtxPopper`, it waits just like PopOrWaitTillClose.
+func (cq *Queue) PopOrWaitCtx(ctx context.Context) (common.QItem, error) {
+	var item common.QItem
+	var err error
+	if ctxPopper, ok := cq.q.(common.CtxPopper); ok {
+		item, err = ctxPopper.PopOrWaitCtx(ctx)
+	} else {
+		item, err = cq.q.PopOrWaitTillClose()
+	}
+	if err != nil {
+		return common.MinQItem, err
+	}
+	cq.popped(item, cq.now())
+	return item, nil
+}
+
+// TryPop pops from the wrapped queue without waiting,
+// or returns `common.ErrNotSupported` if it does not implement `common.TryPopper`
+func (cq *Queue) TryPop() (common.QItem, error) {
+	popper, ok := cq.q.(common.TryPopper)
+	if !ok {
+		return common.MinQItem, common.ErrNotSupported
+	}
+	item, err := popper.TryPop()
+	if err != nil {
+		return common.MinQItem, err
+	}
+	cq.popped(item, cq.now())
+	return item, nil
+}
+
+// Peek returns the item at the head of the wrapped queue without removing it,
+// or `common.ErrNotSupported` if the wrapped queue can't peek
+func (cq *Queue) Peek() (common.QItem, error) {
+	if q, ok := cq.q.(interface{ Peek() (common.QItem, error) }); ok {
+		return q.Peek()
+	}
+	return common.MinQItem, common.ErrNotSupported
+}
+
+// PopBatchOrWaitTillClose pops several items if the wrapped queue implements
+// `common.BatchPopper`, else only 1 item
+func (cq *Queue) PopBatchOrWaitTillClose(max int) ([]common.QItem, error) {
+	batchPopper, ok := cq.q.(common.BatchPopper)
+	if !ok {
+		item, err := cq.PopOrWaitTillClose()
+		if err != nil {
+			return nil, err
+		}
+		return []common.QItem{item}, nil
+	}
+
+	items, err := batchPopper.PopBatchOrWaitTillClose(max)
+	if err != nil {
+		return nil, err
+	}
+	now := cq.now()
+	for _, item := range items {
+		cq.popped(item, now)
+	}
+	return items, nil
+}
+
+// Remove takes out the item with `id` from the wrapped queue.
+// If the wrapped queue does not implement `common.Remover`,
+// it returns `common.ErrNotSupported`.
+func (cq *Queue) Remove(id uint64) (common.QItem, error) {
+	remover, ok := cq.q.(common.Remover)
+	if !ok {
+		return common.MinQItem, common.ErrNotSupported
+	}
+	item, err := remover.Remove(id)
+	if err == nil {
+		cq.mu.Lock()
+		delete(cq.pushedAt, id)
+		cq.mu.Unlock()
+	}
+	return item, err
+}
+
+// Len returns the number of items in the wrapped queue, or 0 if it can't tell
+func (cq *Queue) Len() int {
+	if q, ok := cq.q.(interface{ Len() int }); ok {
+		return q.Len()
+	}
+	return 0
+}
+
+// Cap returns the capacity of the wrapped queue, or 0 if it can't tell
+func (cq *Queue) Cap() int {
+	if q, ok := cq.q.(interface{ Cap() int }); ok {
+		return q.Cap()
+	}
+	return 0
+}
+
+// DepthPerPriority returns the number of items in each priority of the wrapped queue,
+// or nil if it can't tell
+func (cq *Queue) DepthPerPriority() []int {
+	if q, ok := cq.q.(interface{ DepthPerPriority() []int }); ok {
+		return q.DepthPerPriority()
+	}
+	return nil
+}
+
+// WaitUntilEmpty waits until the wrapped queue holds no item,
+// or returns `common.ErrNotSupported` if it does not implement `common.EmptyWaiter`
+func (cq *Queue) WaitUntilEmpty(ctx context.Context) error {
+	waiter, ok := cq.q.(common.EmptyWaiter)
+	if !ok {
+		return common.ErrNotSupported
+	}
+	return waiter.WaitUntilEmpty(ctx)
+}
+
+// Close closes the wrapped queue
+func (cq *Queue) Close() error {
+	return cq.q.Close()
+}
+
+// IsClosed returns whether the wrapped queue is closed,
+// or false if it does not implement `common.ClosedNotifier`
+func (cq *Queue) IsClosed() bool {
+	if notifier, ok := cq.q.(common.ClosedNotifier); ok {
+		return notifier.IsClosed()
+	}
+	return false
+}
+
+// Closed returns the channel of the wrapped queue closed once it is closed,
+// or nil if it does not implement `common.ClosedNotifier`
+func (cq *Queue) Closed() <-chan struct{} {
+	if notifier, ok := cq.q.(common.ClosedNotifier); ok {
+		return notifier.Closed()
+	}
+	return nil
+}
+
+// CloseGracefully closes the wrapped queue gracefully
+func (cq *Queue) CloseGracefully() {
+	cq.q.CloseGracefully()
+}
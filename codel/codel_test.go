@@ -0,0 +1,158 @@
+package codel
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/priority"
+	"github.com/aarondwi/prioritize/queuetest"
+)
+
+func TestNewErrors(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	_, err := New(pq, 0, time.Second, 4)
+	if err == nil || err != common.ErrParamShouldBePositive {
+		t.Fatalf("It should error, cause target can't be zero, but instead we got %v", err)
+	}
+}
+
+func TestQueueShedsWhenOverloaded(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	now := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	cq, err := New(pq, 10*time.Millisecond, 100*time.Millisecond, 4,
+		WithClock(func() time.Time { return now }))
+	if err != nil {
+		t.Fatalf("It should not error, because all are correct parameters, but instead we got %v", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		cq.PushOrError(common.QItem{ID: uint64(i), Priority: 4})
+	}
+	// each pop waited 50ms, above the target
+	for i := 0; i < 3; i++ {
+		now = now.Add(50 * time.Millisecond)
+		cq.PopOrWaitTillClose()
+		if i < 2 && cq.Shedding() {
+			t.Fatalf("It should not shed before the interval passes, but it is at pop %d", i)
+		}
+	}
+	if !cq.Shedding() {
+		t.Fatal("It should shed, cause sojourn time is above target for the whole interval, but it is not")
+	}
+
+	err = cq.PushOrError(common.QItem{ID: 100, Priority: 3})
+	if err == nil || err != ErrShedding {
+		t.Fatalf("It should shed low priority push, but instead we got %v", err)
+	}
+	if err = cq.PushOrError(common.QItem{ID: 101, Priority: 4}); err != nil {
+		t.Fatalf("It should still accept high priority push, but instead we got %v", err)
+	}
+
+	// drained quickly, back below target
+	for i := 0; i < 8; i++ {
+		cq.PopOrWaitTillClose()
+	}
+	if cq.Shedding() {
+		t.Fatal("It should stop shedding once sojourn time is below target, but it is not")
+	}
+	if err = cq.PushOrError(common.QItem{ID: 102, Priority: 0}); err != nil {
+		t.Fatalf("It should accept low priority push again, but instead we got %v", err)
+	}
+	cq.Close()
+}
+
+func TestQueueStopsSheddingWithoutPops(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	now := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	cq, _ := New(pq, 10*time.Millisecond, 100*time.Millisecond, 4,
+		WithClock(func() time.Time { return now }))
+
+	overload := func() {
+		for i := 0; i < 4; i++ {
+			cq.PushOrError(common.QItem{ID: uint64(i), Priority: 4})
+		}
+		for i := 0; i < 3; i++ {
+			now = now.Add(50 * time.Millisecond)
+			cq.PopOrWaitTillClose()
+		}
+		if !cq.Shedding() {
+			t.Fatal("It should shed, cause sojourn time is above target for the whole interval, but it is not")
+		}
+	}
+
+	overload()
+	// nothing popped for the whole interval, e.g. all workers are gone
+	now = now.Add(100 * time.Millisecond)
+	if err := cq.PushOrError(common.QItem{ID: 100, Priority: 0}); err != nil {
+		t.Fatalf("It should stop shedding once nothing is popped for the interval, but instead we got %v", err)
+	}
+	cq.PopOrWaitTillClose()
+	cq.PopOrWaitTillClose()
+
+	overload()
+	// the last one popped too, nothing is left to measure
+	cq.PopOrWaitTillClose()
+	if cq.Shedding() {
+		t.Fatal("It should stop shedding once the wrapped queue is empty, but it is not")
+	}
+	if err := cq.PushOrError(common.QItem{ID: 101, Priority: 0}); err != nil {
+		t.Fatalf("It should accept low priority push again, but instead we got %v", err)
+	}
+	cq.Close()
+}
+
+func TestQueueWaitUntilEmpty(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(16, 8)
+	cq, _ := New(pq, 10*time.Millisecond, 100*time.Millisecond, 4)
+	cq.PushOrError(common.QItem{ID: 1, Priority: 4})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cq.WaitUntilEmpty(context.Background())
+	}()
+	cq.PopOrWaitTillClose()
+	if err := <-done; err != nil {
+		t.Fatalf("It should return once the wrapped queue is empty, but instead we got %v", err)
+	}
+
+	// hides the methods of pq not in common.QInterface
+	hidden, _ := New(struct{ common.QInterface }{pq}, 10*time.Millisecond, 100*time.Millisecond, 4)
+	if err := hidden.WaitUntilEmpty(context.Background()); err == nil || err != common.ErrNotSupported {
+		t.Fatalf("It should return ErrNotSupported, cause the wrapped queue can't wait, but instead we got %v", err)
+	}
+}
+
+func TestQueueConformance(t *testing.T) {
+	queuetest.Run(t, func(sizeLimit int) (common.ExtendedQInterface, error) {
+		pq, err := priority.NewPriorityQueue(sizeLimit, 8)
+		if err != nil {
+			return nil, err
+		}
+		return New(pq, 10*time.Millisecond, 100*time.Millisecond, 0)
+	})
+}
+
+func TestQueueExtendedQInterfaceUnsupportedByWrappedQueue(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	// hides the methods of pq not in common.QInterface
+	hidden, _ := New(struct{ common.QInterface }{pq}, 10*time.Millisecond, 100*time.Millisecond, 4)
+	if _, err := hidden.TryPop(); err == nil || err != common.ErrNotSupported {
+		t.Fatalf("It should return ErrNotSupported, cause the wrapped queue can't try to pop, but instead we got %v", err)
+	}
+	if _, err := hidden.Peek(); err == nil || err != common.ErrNotSupported {
+		t.Fatalf("It should return ErrNotSupported, cause the wrapped queue can't peek, but instead we got %v", err)
+	}
+}
+
+func TestQueueRemoveUnsupportedByWrappedQueue(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	// hides the methods of pq not in common.QInterface
+	cq, _ := New(struct{ common.QInterface }{pq}, 10*time.Millisecond, 100*time.Millisecond, 4)
+	cq.PushOrError(common.QItem{ID: 1, Priority: 4})
+	if _, err := cq.Remove(1); err == nil || err != common.ErrNotSupported {
+		t.Fatalf("It should return ErrNotSupported, cause the wrapped queue can't remove, but instead we got %v", err)
+	}
+	cq.Close()
+}
@@ -0,0 +1,35 @@
+package common
+
+import (
+	"fmt"
+	"io"
+)
+
+// Snapshotter is implemented by queues which can list their items without removing them.
+type Snapshotter interface {
+	// Snapshot returns a copy of all items currently in the queue,
+	// in the order they would be popped.
+	Snapshot() []QItem
+}
+
+// DebugDump writes the items of `q` to `w`, 1 per line in the order they would be popped,
+// e.g. to see why items are stuck in production without a debugger.
+// If `q` also implements `Inspector`, its Len and Cap are written first.
+//
+// The format is meant for humans, and may change.
+func DebugDump(w io.Writer, q Snapshotter) error {
+	if inspector, ok := q.(Inspector); ok {
+		_, err := fmt.Fprintf(w, "len=%d cap=%d\n", inspector.Len(), inspector.Cap())
+		if err != nil {
+			return err
+		}
+	}
+	for i, item := range q.Snapshot() {
+		_, err := fmt.Fprintf(w, "%d\tid=%d priority=%d enqueuedAt=%d deadline=%d cost=%d\n",
+			i, item.ID, item.Priority, item.EnqueuedAt, item.Deadline, item.Cost)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
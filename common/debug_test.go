@@ -0,0 +1,29 @@
+package common
+
+import (
+	"bytes"
+	"testing"
+)
+
+type snapshotStub []QItem
+
+func (s snapshotStub) Snapshot() []QItem { return s }
+func (s snapshotStub) Len() int          { return len(s) }
+func (s snapshotStub) Cap() int          { return 8 }
+func (s snapshotStub) DepthPerPriority() []int {
+	return nil
+}
+
+func TestDebugDump(t *testing.T) {
+	buf := &bytes.Buffer{}
+	err := DebugDump(buf, snapshotStub{{ID: 2, Priority: 3}, {ID: 1, Priority: 0, Cost: 5}})
+	if err != nil {
+		t.Fatalf("It should not error, but instead we got %v", err)
+	}
+	expected := "len=2 cap=8\n" +
+		"0\tid=2 priority=3 enqueuedAt=0 deadline=0 cost=0\n" +
+		"1\tid=1 priority=0 enqueuedAt=0 deadline=0 cost=5\n"
+	if buf.String() != expected {
+		t.Fatalf("Expected %q, but instead we got %q", expected, buf.String())
+	}
+}
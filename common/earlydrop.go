@@ -0,0 +1,47 @@
+package common
+
+import (
+	"math/rand"
+	"time"
+)
+
+// EarlyDrop is a RED (random early detection) style admission check.
+//
+// Once occupancy goes above `threshold` (a fraction of the size limit),
+// pushes below `minPriority` are rejected with a probability
+// growing linearly from 0 at `threshold`, to 1 when full.
+// So low priorities back off before the queue is completely full,
+// and high priorities still find room.
+//
+// This struct is NOT thread(goroutine)-safe,
+// as it is meant to be guarded by the lock of its owner (e.g. the queue).
+type EarlyDrop struct {
+	threshold   float64
+	minPriority int
+	rand        *rand.Rand
+}
+
+// NewEarlyDrop creates EarlyDrop. `threshold` should be in [0, 1).
+func NewEarlyDrop(threshold float64, minPriority int) (*EarlyDrop, error) {
+	if threshold < 0 || threshold >= 1 {
+		return nil, ErrParamShouldBePositive
+	}
+	return &EarlyDrop{
+		threshold:   threshold,
+		minPriority: minPriority,
+		rand:        rand.New(rand.NewSource(time.Now().UnixNano())),
+	}, nil
+}
+
+// Reject returns whether a push of `priority` should be rejected,
+// given the queue currently holds `size` out of `sizeLimit` items
+func (ed *EarlyDrop) Reject(priority, size, sizeLimit int) bool {
+	if priority >= ed.minPriority {
+		return false
+	}
+	occupancy := float64(size) / float64(sizeLimit)
+	if occupancy <= ed.threshold {
+		return false
+	}
+	return ed.rand.Float64() < (occupancy-ed.threshold)/(1-ed.threshold)
+}
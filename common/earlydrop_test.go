@@ -0,0 +1,34 @@
+package common
+
+import "testing"
+
+func TestEarlyDrop(t *testing.T) {
+	_, err := NewEarlyDrop(1, 4)
+	if err == nil || err != ErrParamShouldBePositive {
+		t.Fatalf("It should error, cause threshold should be below 1, but instead we got %v", err)
+	}
+
+	ed, _ := NewEarlyDrop(0.5, 4)
+	for i := 0; i < 100; i++ {
+		if ed.Reject(0, 50, 100) {
+			t.Fatal("It should never reject at the threshold, but it does")
+		}
+		if ed.Reject(4, 99, 100) {
+			t.Fatal("It should never reject priority at or above minPriority, but it does")
+		}
+		if !ed.Reject(3, 100, 100) {
+			t.Fatal("It should always reject low priority when full, but it does not")
+		}
+	}
+
+	rejected := 0
+	for i := 0; i < 10000; i++ {
+		if ed.Reject(0, 75, 100) {
+			rejected++
+		}
+	}
+	// halfway between threshold and full, so about half
+	if rejected < 4000 || rejected > 6000 {
+		t.Fatalf("It should reject about half, but instead we got %d out of 10000", rejected)
+	}
+}
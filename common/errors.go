@@ -1,21 +1,62 @@
-package common
-
-import "errors"
-
-// ErrQueueIsFull is returned to prevent some task to getting too high latency.
-//
-// Better fail fast than seems as down.
-var ErrQueueIsFull = errors.New("queue is full, rejecting new qitem")
-
-// ErrQueueIsClosed is returned when PushOrError() or PopOrWaitTillClose()
-// is called after Close() is called
-var ErrQueueIsClosed = errors.New("queue is already closed, can't accept new request")
-
-// ErrParamShouldBePositive is returned when either sizeLimit or priority parameter is negative
-var ErrParamShouldBePositive = errors.New("sizeLimit and priority given should be positive")
-
-// ErrPriorityOutOfRange is returned if priority given is outside of range
-//
-// If we accept it, to maintain the guarantee, needs to maintain too much queue,
-// and hard to scan over.
-var ErrPriorityOutOfRange = errors.New("Roundrobin Priority Queue is full, rejecting new qitem")
+package common
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrQueueIsFull is returned to prevent some task to getting too high latency.
+//
+// Better fail fast than seems as down.
+var ErrQueueIsFull = errors.New("queue is full, rejecting new qitem")
+
+// ErrQueueIsClosed is returned when PushOrError() or PopOrWaitTillClose()
+// is called after Close() is called
+var ErrQueueIsClosed = errors.New("queue is already closed, can't accept new request")
+
+// ErrParamShouldBePositive is returned when either sizeLimit or priority parameter is negative
+var ErrParamShouldBePositive = errors.New("sizeLimit and priority given should be positive")
+
+// ErrPriorityOutOfRange is returned if priority given is outside of range
+//
+// If we accept it, to maintain the guarantee, needs to maintain too much queue,
+// and hard to scan over.
+var ErrPriorityOutOfRange = errors.New("Roundrobin Priority Queue is full, rejecting new qitem")
+
+// ErrItemNotFound is returned when the item with the given ID is not in the queue,
+// e.g. because it is already popped
+var ErrItemNotFound = errors.New("item is not found in the queue")
+
+// ErrPriorityNotEmpty is returned when removing priorities which still have items queued
+var ErrPriorityNotEmpty = errors.New("priority to remove still has items in the queue")
+
+// ErrQueueIsEmpty is returned by non-blocking pops (e.g. `TryPop`) when no item can be popped right now
+var ErrQueueIsEmpty = errors.New("queue is empty, no qitem to pop right now")
+
+// ErrNotSupported is returned by queues wrapping another one (e.g. `codel.Queue`)
+// when the wrapped queue does not implement the method called
+var ErrNotSupported = errors.New("the wrapped queue does not support this operation")
+
+// QueueError adds context to an error returned by a queue operation,
+// so callers can log which priority or operation failed without parsing strings.
+//
+// The built-in queues return it from every push (and evict), wrapping one of the sentinel errors above,
+// so check it with `errors.Is`, e.g. `errors.Is(err, ErrQueueIsFull)`.
+type QueueError struct {
+	// Op is the name of the failed method, e.g. "PushOrError"
+	Op       string
+	Priority int
+	// Size and Limit are the number of items in the queue and its capacity, when it failed
+	Size  int
+	Limit int
+	Err   error
+}
+
+func (e *QueueError) Error() string {
+	return fmt.Sprintf("%s priority %d (size %d of %d): %v", e.Op, e.Priority, e.Size, e.Limit, e.Err)
+}
+
+// Unwrap returns the wrapped sentinel error
+func (e *QueueError) Unwrap() error {
+	return e.Err
+}
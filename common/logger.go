@@ -0,0 +1,24 @@
+package common
+
+// Logger receives structured logs, from the engine (see `prioritize.WithLogger`),
+// and from the queues dropping or evicting items (e.g. `priority.WithLogger`).
+// `keyvals` are alternating keys and values, e.g. "id", 1, "priority", 3.
+//
+// Its methods match those of `*slog.Logger`, so it can be given as is.
+type Logger interface {
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+// NopLogger logs nothing. It is what is used until a logger is given.
+type NopLogger struct{}
+
+// Info does nothing
+func (NopLogger) Info(msg string, keyvals ...interface{}) {}
+
+// Warn does nothing
+func (NopLogger) Warn(msg string, keyvals ...interface{}) {}
+
+// Error does nothing
+func (NopLogger) Error(msg string, keyvals ...interface{}) {}
@@ -1,17 +1,173 @@
-package common
-
-// QInterface is the interface for queue used inside our main engine
-// You may implement this to create custom priority queuing mechanism
-//
-// Our implementation has different semantic on Push/Pop.
-// Push returns error, while Pop waits.
-// This is by design, as we want Push to error fast
-// (to notify customer and not overburden our system),
-// but we want our Pop to wait until a task exists (so can do work).
-//
-// Those implementing this interface should be thread(goroutine)-safe.
-type QInterface interface {
-	PushOrError(item QItem) error
-	PopOrWaitTillClose() (QItem, error)
-	Close()
-}
+package common
+
+import (
+	"context"
+	"time"
+)
+
+// QInterface is the interface for queue used inside our main engine
+// You may implement this to create custom priority queuing mechanism
+//
+// Our implementation has different semantic on Push/Pop.
+// Push returns error, while Pop waits.
+// This is by design, as we want Push to error fast
+// (to notify customer and not overburden our system),
+// but we want our Pop to wait until a task exists (so can do work).
+//
+// There are 2 ways to close the queue.
+// `Close` drops remaining items, and any pop returns `ErrQueueIsClosed` right away.
+// Closing an already closed queue should do nothing, only returning `ErrQueueIsClosed`.
+// `CloseGracefully` only rejects new push, and pop keeps returning remaining items
+// until the queue is empty, then returns `ErrQueueIsClosed`.
+//
+// Those implementing this interface should be thread(goroutine)-safe.
+type QInterface interface {
+	PushOrError(item QItem) error
+	PopOrWaitTillClose() (QItem, error)
+	Close() error
+	CloseGracefully()
+}
+
+// ExtendedQInterface is the full set of operations shared by all built-in queues,
+// except `linkedslice.LinkedSlice`, which is unbounded, and only meant as a building block.
+// Wrapping queues (e.g. `codel.Queue`) implement it too, falling back, or returning `ErrNotSupported`,
+// when the queue they wrap can't do it.
+// Depend on it instead of the concrete types, when QInterface is not enough.
+type ExtendedQInterface interface {
+	QInterface
+	CtxPusher
+	CtxPopper
+	TryPopper
+	EmptyWaiter
+	ClosedNotifier
+
+	// Len returns the number of items currently in the queue.
+	Len() int
+	// Cap returns the maximum number of items the queue can hold.
+	Cap() int
+	// Peek returns the item at the head of the queue without removing it,
+	// or `ErrQueueIsEmpty` if none. See each implementation on how it relates to the next pop.
+	Peek() (QItem, error)
+}
+
+// PriorityUpdater is implemented by queues which can change
+// the priority of an item still in the queue.
+type PriorityUpdater interface {
+	// UpdatePriority moves the item with `id` to `newPriority`,
+	// or returns `ErrItemNotFound` if it is not in the queue anymore.
+	UpdatePriority(id uint64, newPriority int) error
+}
+
+// BatchPopper is implemented by queues which can pop several items
+// while only taking their lock once.
+type BatchPopper interface {
+	// PopBatchOrWaitTillClose waits like `PopOrWaitTillClose`,
+	// and then returns between 1 and `max` items.
+	PopBatchOrWaitTillClose(max int) ([]QItem, error)
+}
+
+// BatchPusher is implemented by queues which can push several items
+// while only taking their lock once.
+type BatchPusher interface {
+	// PushBatchOrError pushes `items` in order, stopping at the first one which can't be pushed.
+	// It returns how many are pushed, and the error of the one which is not.
+	PushBatchOrError(items []QItem) (int, error)
+}
+
+// Remover is implemented by queues which can take out an item
+// still in the queue, e.g. because its task is cancelled.
+type Remover interface {
+	// Remove takes out the item with `id`, freeing its slot,
+	// or returns `ErrItemNotFound` if it is not in the queue anymore.
+	Remove(id uint64) (QItem, error)
+}
+
+// Requeuer is implemented by queues which can take back a popped item
+// which is not done yet, e.g. a multi-level feedback queue.
+type Requeuer interface {
+	// Requeue puts back `item`, 1 level down if `demote`.
+	Requeue(item QItem, demote bool) error
+
+	// Quantum returns how long an item can run before it should be demoted.
+	Quantum() time.Duration
+}
+
+// Drainer is implemented by queues which can give up all their items at once.
+type Drainer interface {
+	// Drain removes and returns all items currently in the queue.
+	Drain() []QItem
+}
+
+// Pauser is implemented by queues whose pops can be held temporarily, while still accepting pushes.
+type Pauser interface {
+	// Pause makes pops wait, without erroring, until Resume is called.
+	Pause()
+	// Resume lets pops take items again.
+	Resume()
+}
+
+// EmptyWaiter is implemented by queues which can wait for all their items to be taken out,
+// e.g. to know a burst of work has drained before starting the next phase.
+type EmptyWaiter interface {
+	// WaitUntilEmpty waits until the queue holds no item, and returns nil.
+	// It returns `ErrQueueIsClosed` if the queue is closed with items left,
+	// or `ctx.Err()` once `ctx` is done while waiting.
+	WaitUntilEmpty(ctx context.Context) error
+}
+
+// ClosedNotifier is implemented by queues which expose whether they are closed.
+type ClosedNotifier interface {
+	// IsClosed returns whether the queue is closed.
+	IsClosed() bool
+	// Closed returns a channel which is closed once the queue is closed.
+	Closed() <-chan struct{}
+}
+
+// TryPopper is implemented by queues which can pop without waiting.
+type TryPopper interface {
+	// TryPop pops 1 item, or returns `ErrQueueIsEmpty` right away if none can be popped now.
+	TryPop() (QItem, error)
+}
+
+// CtxPopper is implemented by queues whose waiting pop can be cancelled.
+type CtxPopper interface {
+	// PopOrWaitCtx waits like `PopOrWaitTillClose`,
+	// but also returns `ctx.Err()` once `ctx` is done while waiting.
+	PopOrWaitCtx(ctx context.Context) (QItem, error)
+}
+
+// FilteredPopper is implemented by queues which can pop only high priority items,
+// e.g. to reserve some consumers for urgent ones.
+type FilteredPopper interface {
+	// PopAtLeastOrWaitCtx waits like `PopOrWaitCtx`, but only takes items
+	// whose priority is at least `minPriority`, even if there are lower ones.
+	PopAtLeastOrWaitCtx(ctx context.Context, minPriority int) (QItem, error)
+}
+
+// CtxPusher is implemented by queues which can wait for a slot when full,
+// with the waiting push cancellable.
+type CtxPusher interface {
+	// PushOrWaitCtx waits while the queue is full, instead of returning `ErrQueueIsFull`,
+	// and returns `ctx.Err()` once `ctx` is done while waiting.
+	PushOrWaitCtx(ctx context.Context, item QItem) error
+}
+
+// Evicter is implemented by queues which can make room for a push when full,
+// by evicting a lower priority item.
+type Evicter interface {
+	// PushOrEvict is like PushOrError, but if the queue is full, it evicts a lower priority item,
+	// and returns it together with true. If there is none, it returns `ErrQueueIsFull`.
+	PushOrEvict(item QItem) (QItem, bool, error)
+}
+
+// Inspector is implemented by queues which expose their occupancy,
+// e.g. for metrics, without reaching into their internals.
+type Inspector interface {
+	// Len returns the number of items currently in the queue.
+	Len() int
+	// Cap returns the maximum number of items the queue can hold.
+	Cap() int
+	// DepthPerPriority returns the number of items currently in each priority,
+	// indexed by priority. It may return nil if the queue has no fixed range of priority.
+	DepthPerPriority() []int
+}
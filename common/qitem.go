@@ -1,22 +1,40 @@
-package common
-
-import "math"
-
-// QItem is the item we put into our priority queue implementation.
-// It is basically an index equivalent in usual DBMS.
-//
-// Given this is small (8 bytes for uint64 and usually 4 bytes for int),
-// it gonna results in 12 bytes (let's assume 16 bytes, cause buffer or 64-bit alignment, shall we?).
-// For 1000 items (which is a lot of task waiting for most webserver/batch), it will only be 16KB,
-// well far below the usual size of L1 cache (64KB).
-// So checking and swapping will be really fast.
-//
-// Of course, as long as not be used as a pointer individually.
-type QItem struct {
-	ID       uint64
-	Priority int
-}
-
-// MinQItem is a holder
-// for the lowest possible priority for an item
-var MinQItem = QItem{Priority: math.MinInt32}
+package common
+
+import "math"
+
+// QItem is the item we put into our priority queue implementation.
+// It is basically an index equivalent in usual DBMS.
+//
+// Given this is small (8 bytes each for uint64, 2 ints, and 2 int64s, plus 16 bytes for Payload),
+// it gonna results in 56 bytes.
+// For 1000 items (which is a lot of task waiting for most webserver/batch), it will only be 56KB,
+// still below the usual size of L1 cache (64KB).
+// So checking and swapping will be really fast.
+//
+// Of course, as long as not be used as a pointer individually.
+type QItem struct {
+	ID       uint64
+	Priority int
+
+	// EnqueuedAt is the unix nano timestamp this item is put into a queue.
+	// It is set by queues that need it (e.g. for global FIFO ordering),
+	// so callers don't need to fill it.
+	EnqueuedAt int64
+
+	// Deadline is the unix nano timestamp this item should be done by,
+	// or 0 if it has none. Only used by queues ordering by deadline (e.g. edf).
+	Deadline int64
+
+	// Cost is how expensive this item is to run, in any unit the caller picks.
+	// Only used by queues sharing by cost (e.g. drr), 0 means free.
+	Cost int
+
+	// Payload is carried as is by queues, e.g. the engine puts the task of the item here,
+	// so it never has to look it up by ID.
+	// Queues should not keep it once the item leaves them, so it can be garbage collected.
+	Payload interface{}
+}
+
+// MinQItem is a holder
+// for the lowest possible priority for an item
+var MinQItem = QItem{Priority: math.MinInt32}
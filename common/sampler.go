@@ -0,0 +1,29 @@
+package common
+
+import "sync/atomic"
+
+// Sampler decides whether an operation should be recorded,
+// so only 1 out of every N operations pays the observability cost.
+//
+// This struct is thread(goroutine)-safe.
+type Sampler struct {
+	// first, to keep it 64-bit aligned for atomic operations
+	counter uint64
+	n       uint64
+}
+
+// NewSampler creates a Sampler recording 1 out of every `n` operations
+func NewSampler(n int) (*Sampler, error) {
+	if n <= 0 {
+		return nil, ErrParamShouldBePositive
+	}
+	return &Sampler{n: uint64(n)}, nil
+}
+
+// Sample returns true if this operation should be recorded
+func (s *Sampler) Sample() bool {
+	if s.n == 1 {
+		return true
+	}
+	return atomic.AddUint64(&s.counter, 1)%s.n == 0
+}
@@ -0,0 +1,28 @@
+package common
+
+import "testing"
+
+func TestSampler(t *testing.T) {
+	_, err := NewSampler(0)
+	if err == nil || err != ErrParamShouldBePositive {
+		t.Fatalf("It should error, cause n can't be zero, but instead we got %v", err)
+	}
+
+	s, _ := NewSampler(3)
+	count := 0
+	for i := 0; i < 9; i++ {
+		if s.Sample() {
+			count++
+		}
+	}
+	if count != 3 {
+		t.Fatalf("It should sample 3 out of 9, but instead we got %d", count)
+	}
+
+	s, _ = NewSampler(1)
+	for i := 0; i < 3; i++ {
+		if !s.Sample() {
+			t.Fatal("It should sample everything, but it is not")
+		}
+	}
+}
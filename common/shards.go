@@ -0,0 +1,20 @@
+package common
+
+import "runtime"
+
+// ShardCount returns how many shards a sharded structure should have,
+// based on the current GOMAXPROCS.
+//
+// It gives 4 shards per P, rounded up to a power of 2,
+// so the shard of a key can be found by masking instead of modulo.
+// Structures holding many items (e.g. `sharded.ShardedQueue`) call it again from time to time,
+// and re-balance if the result changes (e.g. GOMAXPROCS is updated at runtime).
+// Those only holding a few may keep the count they are created with.
+func ShardCount() int {
+	target := 4 * runtime.GOMAXPROCS(0)
+	n := 1
+	for n < target {
+		n <<= 1
+	}
+	return n
+}
@@ -0,0 +1,20 @@
+package common
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestShardCount(t *testing.T) {
+	prev := runtime.GOMAXPROCS(3)
+	defer runtime.GOMAXPROCS(prev)
+
+	if n := ShardCount(); n != 16 {
+		t.Fatalf("It should be 12 rounded up to power of 2, which is 16, but instead we got %d", n)
+	}
+
+	runtime.GOMAXPROCS(1)
+	if n := ShardCount(); n != 4 {
+		t.Fatalf("It should be 4, but instead we got %d", n)
+	}
+}
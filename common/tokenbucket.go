@@ -0,0 +1,59 @@
+package common
+
+import "time"
+
+// TokenBucket is a simple token bucket rate limiter.
+//
+// It starts full, refills at `ratePerSecond`, and holds at most `burst` tokens.
+//
+// This struct is NOT thread(goroutine)-safe,
+// as it is meant to be guarded by the lock of its owner (e.g. the queue).
+type TokenBucket struct {
+	ratePerSecond float64
+	burst         float64
+	tokens        float64
+	last          time.Time
+}
+
+// NewTokenBucket creates a full TokenBucket.
+func NewTokenBucket(ratePerSecond float64, burst int) (*TokenBucket, error) {
+	if ratePerSecond <= 0 || burst <= 0 {
+		return nil, ErrParamShouldBePositive
+	}
+	return &TokenBucket{
+		ratePerSecond: ratePerSecond,
+		burst:         float64(burst),
+		tokens:        float64(burst),
+		last:          time.Now(),
+	}, nil
+}
+
+func (tb *TokenBucket) refill(now time.Time) {
+	if now.After(tb.last) {
+		tb.tokens += now.Sub(tb.last).Seconds() * tb.ratePerSecond
+		if tb.tokens > tb.burst {
+			tb.tokens = tb.burst
+		}
+		tb.last = now
+	}
+}
+
+// Available returns whether at least 1 token can be taken at `now`
+func (tb *TokenBucket) Available(now time.Time) bool {
+	tb.refill(now)
+	return tb.tokens >= 1
+}
+
+// Take consumes 1 token. Should only be called after `Available` returns true.
+func (tb *TokenBucket) Take() {
+	tb.tokens--
+}
+
+// Delay returns how long from `now` until 1 token is available
+func (tb *TokenBucket) Delay(now time.Time) time.Duration {
+	tb.refill(now)
+	if tb.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - tb.tokens) / tb.ratePerSecond * float64(time.Second))
+}
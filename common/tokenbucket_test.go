@@ -0,0 +1,44 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	_, err := NewTokenBucket(0, 1)
+	if err == nil || err != ErrParamShouldBePositive {
+		t.Fatalf("It should error, cause rate can't be zero, but instead we got %v", err)
+	}
+	_, err = NewTokenBucket(1, -1)
+	if err == nil || err != ErrParamShouldBePositive {
+		t.Fatalf("It should error, cause burst can't be negative, but instead we got %v", err)
+	}
+
+	tb, _ := NewTokenBucket(10, 2)
+	now := tb.last
+	for i := 0; i < 2; i++ {
+		if !tb.Available(now) {
+			t.Fatalf("It should start full, but token %d is not available", i)
+		}
+		tb.Take()
+	}
+	if tb.Available(now) {
+		t.Fatal("It should be empty after taking burst tokens, but it is not")
+	}
+	if d := tb.Delay(now); d != 100*time.Millisecond {
+		t.Fatalf("1 token at 10/s should take 100ms, but instead we got %v", d)
+	}
+
+	now = now.Add(100 * time.Millisecond)
+	if !tb.Available(now) {
+		t.Fatal("It should be refilled after 100ms, but it is not")
+	}
+
+	// refill never goes above burst
+	now = now.Add(time.Hour)
+	tb.Available(now)
+	if tb.tokens != 2 {
+		t.Fatalf("It should be capped at burst, but instead we got %f", tb.tokens)
+	}
+}
@@ -0,0 +1,30 @@
+package common
+
+import (
+	"context"
+	"sync"
+)
+
+// WakeOnDone broadcasts `cond` once `ctx` is done,
+// so goroutines waiting on it can check `ctx.Err()` and stop waiting.
+// A `sync.Cond` can't select on a channel, so this is how its waits are made cancellable.
+//
+// `stop` should be called once waiting is over, to release the goroutine watching `ctx`.
+// It is fine to call it while holding `cond.L`.
+func WakeOnDone(ctx context.Context, cond *sync.Cond) (stop func()) {
+	if ctx.Done() == nil {
+		// never done, e.g. context.Background()
+		return func() {}
+	}
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			cond.L.Lock()
+			cond.Broadcast()
+			cond.L.Unlock()
+		case <-stopped:
+		}
+	}()
+	return func() { close(stopped) }
+}
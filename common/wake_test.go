@@ -0,0 +1,26 @@
+package common
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWakeOnDone(t *testing.T) {
+	mu := &sync.Mutex{}
+	cond := sync.NewCond(mu)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	mu.Lock()
+	stop := WakeOnDone(ctx, cond)
+	for ctx.Err() == nil {
+		cond.Wait()
+	}
+	stop()
+	mu.Unlock()
+
+	// never done, so nothing to release
+	WakeOnDone(context.Background(), cond)()
+}
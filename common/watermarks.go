@@ -0,0 +1,46 @@
+package common
+
+// Watermarks calls back when the size of a queue crosses its watermarks,
+// e.g. to pause ingestion upstream once the queue is getting full,
+// and resume it once enough is drained.
+//
+// `onHigh` is called once the size reaches `high`, and `onLow` once it then goes down to `low`.
+// Nothing is called again in between, so the callbacks alternate, starting with `onHigh`.
+//
+// This struct is NOT thread(goroutine)-safe,
+// as it is meant to be guarded by the lock of its owner (e.g. the queue).
+type Watermarks struct {
+	high   int
+	low    int
+	onHigh func(size int)
+	onLow  func(size int)
+	above  bool
+}
+
+// NewWatermarks creates Watermarks. `low` should be in [0, high), and either callback may be nil.
+func NewWatermarks(high, low int, onHigh, onLow func(size int)) (*Watermarks, error) {
+	if low < 0 || high <= low {
+		return nil, ErrParamShouldBePositive
+	}
+	return &Watermarks{
+		high:   high,
+		low:    low,
+		onHigh: onHigh,
+		onLow:  onLow,
+	}, nil
+}
+
+// Update should be called with the new size each time the size of the queue changes
+func (w *Watermarks) Update(size int) {
+	if !w.above && size >= w.high {
+		w.above = true
+		if w.onHigh != nil {
+			w.onHigh(size)
+		}
+	} else if w.above && size <= w.low {
+		w.above = false
+		if w.onLow != nil {
+			w.onLow(size)
+		}
+	}
+}
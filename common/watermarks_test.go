@@ -0,0 +1,24 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestWatermarks(t *testing.T) {
+	_, err := NewWatermarks(4, 4, nil, nil)
+	if err == nil || err != ErrParamShouldBePositive {
+		t.Fatalf("It should error, cause low should be below high, but instead we got %v", err)
+	}
+
+	calls := []int{}
+	w, _ := NewWatermarks(4, 1,
+		func(size int) { calls = append(calls, size) },
+		func(size int) { calls = append(calls, -size) })
+	for _, size := range []int{1, 2, 3, 4, 5, 4, 3, 2, 1, 0, 1, 2, 3, 4} {
+		w.Update(size)
+	}
+	if !reflect.DeepEqual(calls, []int{4, -1, 4}) {
+		t.Fatalf("Expected calls [4 -1 4], but instead we got %v", calls)
+	}
+}
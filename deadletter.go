@@ -0,0 +1,49 @@
+package prioritize
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// WithDeadletter makes the engine call `fn` with tasks which fail for good,
+// that is returning an error after all retries (see `WithRetry`) are used up,
+// when a retry can't be queued, or panicking. E.g. to persist them for later inspection.
+//
+// `fn` is called on the worker, before `Task.Result()` returns,
+// so keep it short, as the worker does not take other tasks in the meantime.
+// Tasks completed by the engine itself (e.g. cancelled, or `ErrQueueTimeout`) are not passed to it,
+// except those failed by the circuit breaker (see `WithCircuitBreaker`).
+//
+// A panicking task is passed with a `*PanicError`, right before the panic goes on,
+// as panics are not recovered (see README).
+func WithDeadletter(fn func(task *Task, err error)) Option {
+	return func(e *Engine) error {
+		e.deadletter = fn
+		return nil
+	}
+}
+
+// PanicError is what the deadletter gets for a task whose fn panicked, see `WithDeadletter`
+type PanicError struct {
+	// Value is what the fn panicked with
+	Value interface{}
+}
+
+func (pe *PanicError) Error() string {
+	return fmt.Sprintf("Task panicked: %v", pe.Value)
+}
+
+// fail completes `task` with the error of its fn, after it is given up on,
+// passing it to the deadletter first, if any.
+func (e *Engine) fail(task *Task, result interface{}, err error) {
+	e.toDeadletter(task, err)
+	e.complete(task, result, err)
+}
+
+// toDeadletter passes `task` to the deadletter, if any
+func (e *Engine) toDeadletter(task *Task, err error) {
+	// already completed, e.g. cancelled while running
+	if e.deadletter != nil && atomic.LoadInt32(&task.completed) == 0 {
+		e.deadletter(task, err)
+	}
+}
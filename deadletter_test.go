@@ -0,0 +1,78 @@
+package prioritize
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aarondwi/prioritize/priority"
+)
+
+func TestEngineWithDeadletter(t *testing.T) {
+	type failure struct {
+		priority int
+		arg      interface{}
+		err      error
+	}
+	failures := make(chan failure, 2)
+	deadletter := func(task *Task, err error) {
+		failures <- failure{task.Priority(), task.Arg(), err}
+	}
+
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	engine, _ := New(pq, 1,
+		WithRetry(1, time.Millisecond, time.Millisecond), WithDeadletter(deadletter))
+	defer engine.Close()
+
+	errFailing := errors.New("failing")
+	task, _ := engine.Submit(context.Background(), 3,
+		func(ctx context.Context, arg interface{}) (interface{}, error) {
+			return nil, errFailing
+		}, "payload")
+	if _, err := task.Result(); err == nil || err != errFailing {
+		t.Fatalf("It should return errFailing, but instead we got %v", err)
+	}
+	select {
+	case f := <-failures:
+		if f.priority != 3 || f.arg.(string) != "payload" || f.err != errFailing {
+			t.Fatalf("It should pass the failed task, but instead we got %v", f)
+		}
+	default:
+		t.Fatal("It should be passed to the deadletter before Result returns, but it is not")
+	}
+	if len(failures) != 0 {
+		t.Fatalf("It should only be passed once, after its retry, but instead we got %d more", len(failures))
+	}
+
+	task, _ = engine.Submit(context.Background(), 3,
+		func(ctx context.Context, arg interface{}) (interface{}, error) {
+			return arg, nil
+		}, 1)
+	task.Result()
+	if len(failures) != 0 {
+		t.Fatalf("Successful tasks should not be passed, but instead we got %d", len(failures))
+	}
+}
+
+func TestEngineDeadletterOnPanic(t *testing.T) {
+	var got error
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	engine, _ := New(pq, 1, WithDeadletter(func(task *Task, err error) {
+		got = err
+	}))
+	defer engine.Close()
+
+	defer func() {
+		if r := recover(); r != "boom" {
+			t.Fatalf("Expected the panic to go on, but instead we got %v", r)
+		}
+		var perr *PanicError
+		if !errors.As(got, &perr) || perr.Value != "boom" {
+			t.Fatalf("It should pass the panic to the deadletter, but instead we got %v", got)
+		}
+	}()
+	engine.runFn(context.Background(), &Task{fn: func(ctx context.Context, arg interface{}) (interface{}, error) {
+		panic("boom")
+	}})
+}
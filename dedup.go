@@ -0,0 +1,117 @@
+package prioritize
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+)
+
+// WithDedupCache makes `SubmitDedup` keep each successful task for `ttl` after it completes,
+// so later submissions with the same key get its result right away, without running again.
+// Failed tasks are never kept.
+func WithDedupCache(ttl time.Duration) Option {
+	return func(e *Engine) error {
+		if ttl <= 0 {
+			return common.ErrParamShouldBePositive
+		}
+		e.dedup.ttl = ttl
+		return nil
+	}
+}
+
+// SubmitDedup is the same as `Submit`, but while a task submitted with the same `key` is not completed yet,
+// no new task is submitted, and that same `Task` is returned instead (singleflight semantics),
+// so all callers share 1 run of the fn, and get the same result.
+// With `WithDedupCache`, successful tasks are shared for a while after they complete too.
+//
+// As they are shared, the task runs with the `ctx`, `fn` and `arg` of the first caller,
+// and cancelling it (or its ctx) fails it for all callers.
+// If a later caller gives a higher priority, the queued task is escalated to it, if the queue supports it
+// (see `Escalate`). If the first submission is rejected, concurrent callers get the same error.
+func (e *Engine) SubmitDedup(
+	ctx context.Context,
+	key string,
+	priority int,
+	fn TaskFunc,
+	arg interface{}) (*Task, error) {
+
+	entry, found := e.dedup.getOrAdd(key)
+	if found {
+		<-entry.ready
+		if entry.err == nil {
+			// best effort, it may have started already,
+			// and does nothing if the priority is not higher
+			e.Escalate(entry.task, priority)
+		}
+		return entry.task, entry.err
+	}
+
+	entry.task, entry.err = e.SubmitWithCallback(ctx, priority, fn, arg,
+		func(result interface{}, err error) {
+			e.dedup.done(key, entry, err)
+		})
+	close(entry.ready)
+	if entry.err != nil {
+		e.dedup.remove(key, entry)
+	}
+	return entry.task, entry.err
+}
+
+// dedupTasks keeps the tasks of `SubmitDedup` by key,
+// from their submission until they complete (or their ttl passes, see `WithDedupCache`).
+type dedupTasks struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*dedupEntry
+}
+
+// dedupEntry is the submission of a key.
+// Its task and err are only set once ready is closed.
+type dedupEntry struct {
+	ready     chan struct{}
+	task      *Task
+	err       error
+	expiresAt time.Time
+}
+
+// getOrAdd returns the entry of `key` and true, or adds a new one, which the caller should submit
+func (dt *dedupTasks) getOrAdd(key string) (*dedupEntry, bool) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	if entry, ok := dt.entries[key]; ok &&
+		(entry.expiresAt.IsZero() || time.Now().Before(entry.expiresAt)) {
+		return entry, true
+	}
+	if dt.entries == nil {
+		dt.entries = make(map[string]*dedupEntry)
+	}
+	entry := &dedupEntry{ready: make(chan struct{})}
+	dt.entries[key] = entry
+	return entry, false
+}
+
+// done is called once the task of `entry` completes, keeping it for a while if it succeeds
+func (dt *dedupTasks) done(key string, entry *dedupEntry, err error) {
+	if err != nil || dt.ttl == 0 {
+		dt.remove(key, entry)
+		return
+	}
+	dt.mu.Lock()
+	entry.expiresAt = time.Now().Add(dt.ttl)
+	dt.mu.Unlock()
+	time.AfterFunc(dt.ttl, func() {
+		dt.remove(key, entry)
+	})
+}
+
+// remove removes `entry`, unless `key` already has a newer one
+func (dt *dedupTasks) remove(key string, entry *dedupEntry) {
+	dt.mu.Lock()
+	if dt.entries[key] == entry {
+		delete(dt.entries, key)
+	}
+	dt.mu.Unlock()
+}
@@ -0,0 +1,94 @@
+package prioritize
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/priority"
+)
+
+func TestEngineSubmitDedup(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	engine, _ := New(pq, 4)
+	defer engine.Close()
+
+	var runs int32
+	gate := make(chan bool)
+	fn := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		atomic.AddInt32(&runs, 1)
+		<-gate
+		return arg, nil
+	}
+	var wg sync.WaitGroup
+	tasks := make([]*Task, 10)
+	for i := range tasks {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tasks[i], _ = engine.SubmitDedup(context.Background(), "key", 0, fn, i)
+		}(i)
+	}
+	wg.Wait()
+	close(gate)
+	first, _ := tasks[0].Result()
+	for _, task := range tasks {
+		if result, err := task.Result(); err != nil || result != first {
+			t.Fatalf("Expected all to share the result %v, but instead we got %v and %v", first, result, err)
+		}
+	}
+	if atomic.LoadInt32(&runs) != 1 {
+		t.Fatalf("Expected 1 run, but instead we got %d", runs)
+	}
+
+	// without a cache, a completed task is not shared anymore
+	task, _ := engine.SubmitDedup(context.Background(), "key", 0, fn, nil)
+	task.Result()
+	if atomic.LoadInt32(&runs) != 2 {
+		t.Fatalf("Expected 2 runs, but instead we got %d", runs)
+	}
+}
+
+func TestEngineWithDedupCache(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	_, err := New(pq, 1, WithDedupCache(0))
+	if !errors.Is(err, common.ErrParamShouldBePositive) {
+		t.Fatalf("It should error, cause the ttl is not positive, instead we got %v", err)
+	}
+
+	engine, _ := New(pq, 1, WithDedupCache(20*time.Millisecond))
+	defer engine.Close()
+
+	var runs int32
+	fn := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		atomic.AddInt32(&runs, 1)
+		if arg != nil {
+			return nil, arg.(error)
+		}
+		return nil, nil
+	}
+	task, _ := engine.SubmitDedup(context.Background(), "key", 0, fn, nil)
+	task.Result()
+	cached, _ := engine.SubmitDedup(context.Background(), "key", 0, fn, nil)
+	if cached != task || atomic.LoadInt32(&runs) != 1 {
+		t.Fatalf("Expected the completed task to be cached, but instead we got %d runs", runs)
+	}
+	time.Sleep(40 * time.Millisecond)
+	task, _ = engine.SubmitDedup(context.Background(), "key", 0, fn, nil)
+	task.Result()
+	if atomic.LoadInt32(&runs) != 2 {
+		t.Fatalf("Expected the cached task to expire, but instead we got %d runs", runs)
+	}
+
+	errFailing := errors.New("failing")
+	task, _ = engine.SubmitDedup(context.Background(), "failing", 0, fn, errFailing)
+	task.Result()
+	task, _ = engine.SubmitDedup(context.Background(), "failing", 0, fn, errFailing)
+	if _, err := task.Result(); err != errFailing || atomic.LoadInt32(&runs) != 4 {
+		t.Fatalf("Expected failed tasks not to be cached, but instead we got %d runs", runs)
+	}
+}
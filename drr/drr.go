@@ -0,0 +1,414 @@
+package drr
+
+import (
+	"context"
+	"sync"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/linkedslice"
+)
+
+// DRRQueue is a deficit round robin queue.
+//
+// Like `fair.FairQueue`, non-empty priorities take turns, going downwards and rolled back from highest.
+// But instead of 1 item per turn, each priority gets `quanta[priority]` of credit per turn
+// (its deficit counter), and items are taken while the counter covers their `Cost`.
+// Unused credit carries over to the next turn, but is reset once the priority is empty.
+//
+// So the share of each priority follows the total cost of its items, not how many there are,
+// which is fair for tasks of wildly different sizes.
+type DRRQueue struct {
+	// synchronization primitive
+	// read-only calls (e.g. Len) only take the read lock,
+	// so they don't contend with each other
+	mu       *sync.RWMutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	// broadcast once the size reaches 0, see `WaitUntilEmpty`
+	emptied *sync.Cond
+
+	// we separate number tracking from the queues
+	// so checking numberOfTasksInEachQueue just need 1 cache miss (putting into cpu L1 cache)
+	numberOfTasksInEachQueue []int
+	queues                   []*linkedslice.LinkedSlice
+
+	quanta   []int
+	deficits []int
+
+	// the priority having its turn, or -1 if none
+	current int
+
+	// simple metadata
+	limitPriority int
+	size          int
+	sizeLimit     int
+	running       bool
+	closed        chan struct{}
+	draining      bool
+}
+
+// NewDRRQueue creates our deficit round robin queue.
+//
+// It caps at sizeLimit, and allows priority [0,len(quanta)),
+// in which all quanta should be positive.
+func NewDRRQueue(sizeLimit int, quanta []int) (*DRRQueue, error) {
+	if sizeLimit <= 0 || len(quanta) == 0 {
+		return nil, common.ErrParamShouldBePositive
+	}
+	for _, q := range quanta {
+		if q <= 0 {
+			return nil, common.ErrParamShouldBePositive
+		}
+	}
+
+	mu := &sync.RWMutex{}
+	queues := make([]*linkedslice.LinkedSlice, len(quanta))
+	for i := range queues {
+		queues[i] = linkedslice.NewLinkedSlice()
+	}
+	return &DRRQueue{
+		mu:                       mu,
+		notEmpty:                 sync.NewCond(mu),
+		notFull:                  sync.NewCond(mu),
+		emptied:                  sync.NewCond(mu),
+		numberOfTasksInEachQueue: make([]int, len(quanta)),
+		queues:                   queues,
+		quanta:                   quanta,
+		deficits:                 make([]int, len(quanta)),
+		current:                  -1,
+		limitPriority:            len(quanta),
+		sizeLimit:                sizeLimit,
+		running:                  true,
+		closed:                   make(chan struct{}),
+	}, nil
+}
+
+// PushOrError put the item into the queue, and returns error if no slot available.
+// Negative cost is rejected with `common.ErrParamShouldBePositive`.
+func (dq *DRRQueue) PushOrError(item common.QItem) error {
+	dq.mu.Lock()
+	defer dq.mu.Unlock()
+	if item.Priority < 0 || item.Priority >= dq.limitPriority {
+		return dq.queueErrorLocked("PushOrError", item, common.ErrPriorityOutOfRange)
+	}
+	if item.Cost < 0 {
+		return dq.queueErrorLocked("PushOrError", item, common.ErrParamShouldBePositive)
+	}
+	if err := dq.pushLocked(item); err != nil {
+		return dq.queueErrorLocked("PushOrError", item, err)
+	}
+	return nil
+}
+
+// PushOrWaitCtx is the same as PushOrError, but waits for a slot while the queue is full,
+// and returns `ctx.Err()` once `ctx` is done while waiting
+func (dq *DRRQueue) PushOrWaitCtx(ctx context.Context, item common.QItem) error {
+	dq.mu.Lock()
+	defer dq.mu.Unlock()
+	if item.Priority < 0 || item.Priority >= dq.limitPriority {
+		return dq.queueErrorLocked("PushOrWaitCtx", item, common.ErrPriorityOutOfRange)
+	}
+	if item.Cost < 0 {
+		return dq.queueErrorLocked("PushOrWaitCtx", item, common.ErrParamShouldBePositive)
+	}
+	err := dq.pushLocked(item)
+	if err == common.ErrQueueIsFull {
+		defer common.WakeOnDone(ctx, dq.notFull)()
+	}
+	for err == common.ErrQueueIsFull {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		dq.notFull.Wait()
+		err = dq.pushLocked(item)
+	}
+	if err != nil {
+		return dq.queueErrorLocked("PushOrWaitCtx", item, err)
+	}
+	return nil
+}
+
+// queueErrorLocked adds what dq looks like right now to `err`, see `common.QueueError`
+func (dq *DRRQueue) queueErrorLocked(op string, item common.QItem, err error) error {
+	return &common.QueueError{Op: op, Priority: item.Priority, Size: dq.size, Limit: dq.sizeLimit, Err: err}
+}
+
+func (dq *DRRQueue) pushLocked(item common.QItem) error {
+	if !dq.running || dq.draining {
+		return common.ErrQueueIsClosed
+	}
+	if dq.size == dq.sizeLimit {
+		return common.ErrQueueIsFull
+	}
+
+	err := dq.queues[item.Priority].PushOrError(item)
+	// meaning already closed, cause linkedslices is unbounded
+	if err != nil {
+		return err
+	}
+	dq.numberOfTasksInEachQueue[item.Priority]++
+	dq.size++
+	dq.notEmpty.Signal()
+	return nil
+}
+
+// PopOrWaitTillClose returns 1 QItem from the priority having its turn, or waits if none exists
+func (dq *DRRQueue) PopOrWaitTillClose() (common.QItem, error) {
+	return dq.PopOrWaitCtx(context.Background())
+}
+
+// PopOrWaitCtx is the same as PopOrWaitTillClose,
+// but also returns `ctx.Err()` once `ctx` is done while waiting
+func (dq *DRRQueue) PopOrWaitCtx(ctx context.Context) (common.QItem, error) {
+	dq.mu.Lock()
+	defer dq.mu.Unlock()
+	if !dq.running {
+		return common.MinQItem, common.ErrQueueIsClosed
+	}
+	if dq.size == 0 {
+		defer common.WakeOnDone(ctx, dq.notEmpty)()
+	}
+	for dq.size == 0 {
+		if dq.draining {
+			dq.closeLocked()
+			return common.MinQItem, common.ErrQueueIsClosed
+		}
+		if err := ctx.Err(); err != nil {
+			return common.MinQItem, err
+		}
+		dq.notEmpty.Wait()
+		// double check, ensuring see the changes after wait call
+		if !dq.running {
+			return common.MinQItem, common.ErrQueueIsClosed
+		}
+	}
+	return dq.popLocked()
+}
+
+// TryPop is the non-blocking version of PopOrWaitTillClose.
+// It returns `common.ErrQueueIsEmpty` right away if the queue is empty.
+func (dq *DRRQueue) TryPop() (common.QItem, error) {
+	dq.mu.Lock()
+	defer dq.mu.Unlock()
+	if !dq.running {
+		return common.MinQItem, common.ErrQueueIsClosed
+	}
+	if dq.size == 0 {
+		return common.MinQItem, common.ErrQueueIsEmpty
+	}
+	return dq.popLocked()
+}
+
+// popLocked takes the next item, there should be at least 1
+func (dq *DRRQueue) popLocked() (common.QItem, error) {
+	// rounds nobody can send in are skipped at once,
+	// so this takes at most 1 more round, however big the costs are
+	for {
+		if dq.current == -1 || dq.numberOfTasksInEachQueue[dq.current] == 0 {
+			dq.nextTurnLocked()
+		}
+		head, _ := dq.queues[dq.current].Peek()
+		if head.Cost <= dq.deficits[dq.current] {
+			break
+		}
+		dq.skipRoundsLocked()
+		dq.nextTurnLocked()
+	}
+
+	p := dq.current
+	// if we wait blindly, it gonna stuck
+	// but we are tracking it manually, ensuring it will never wait
+	result, err := dq.queues[p].PopOrWaitTillClose()
+	if err != nil {
+		return common.MinQItem, err
+	}
+	dq.deficits[p] -= result.Cost
+	dq.numberOfTasksInEachQueue[p]--
+	dq.size--
+	if dq.numberOfTasksInEachQueue[p] == 0 {
+		// credit is not hoarded while having nothing to send
+		dq.deficits[p] = 0
+	}
+	dq.notFull.Signal()
+	if dq.size == 0 {
+		dq.emptied.Broadcast()
+		if dq.draining {
+			dq.closeLocked()
+		}
+	}
+	return result, nil
+}
+
+// Peek returns the oldest item of the priority having its turn, without removing it,
+// or `common.ErrQueueIsEmpty` if the queue is empty. If that priority has no item left,
+// it is the one of the next non-empty priority. This is the item the next pop returns,
+// unless the deficit of its priority does not cover its cost, and the turn moves on.
+func (dq *DRRQueue) Peek() (common.QItem, error) {
+	dq.mu.RLock()
+	defer dq.mu.RUnlock()
+	if !dq.running {
+		return common.MinQItem, common.ErrQueueIsClosed
+	}
+	if dq.size == 0 {
+		return common.MinQItem, common.ErrQueueIsEmpty
+	}
+	start := dq.limitPriority - 1
+	if dq.current != -1 {
+		start = dq.current + dq.limitPriority
+	}
+	for k := 0; k < dq.limitPriority; k++ {
+		i := (start - k) % dq.limitPriority
+		if dq.numberOfTasksInEachQueue[i] > 0 {
+			item, _ := dq.queues[i].Peek()
+			return item, nil
+		}
+	}
+	return common.MinQItem, common.ErrQueueIsEmpty
+}
+
+// nextTurnLocked gives the turn to the next non-empty priority, adding its quantum.
+// There should be at least 1 item.
+func (dq *DRRQueue) nextTurnLocked() {
+	start := dq.limitPriority - 1
+	if dq.current != -1 {
+		start = dq.current - 1 + dq.limitPriority
+	}
+	for k := 0; k < dq.limitPriority; k++ {
+		i := (start - k) % dq.limitPriority
+		if dq.numberOfTasksInEachQueue[i] > 0 {
+			dq.current = i
+			dq.deficits[i] += dq.quanta[i]
+			return
+		}
+	}
+}
+
+// skipRoundsLocked adds the quanta of all the whole rounds in which no head item is covered yet,
+// to each non-empty priority, the same as taking those turns one by one
+func (dq *DRRQueue) skipRoundsLocked() {
+	rounds := -1
+	for i, n := range dq.numberOfTasksInEachQueue {
+		if n == 0 {
+			continue
+		}
+		head, _ := dq.queues[i].Peek()
+		need := 0
+		if head.Cost > dq.deficits[i] {
+			need = (head.Cost - dq.deficits[i] + dq.quanta[i] - 1) / dq.quanta[i]
+		}
+		if rounds == -1 || need < rounds {
+			rounds = need
+		}
+	}
+	// the last round is taken turn by turn, as whoever is covered first sends
+	if rounds <= 1 {
+		return
+	}
+	for i, n := range dq.numberOfTasksInEachQueue {
+		if n > 0 {
+			dq.deficits[i] += (rounds - 1) * dq.quanta[i]
+		}
+	}
+}
+
+// Len returns the number of items currently in the queue
+func (dq *DRRQueue) Len() int {
+	dq.mu.RLock()
+	defer dq.mu.RUnlock()
+	return dq.size
+}
+
+// Cap returns the maximum number of items the queue can hold
+func (dq *DRRQueue) Cap() int {
+	return dq.sizeLimit
+}
+
+// DepthPerPriority returns the number of items currently in each priority
+func (dq *DRRQueue) DepthPerPriority() []int {
+	dq.mu.RLock()
+	defer dq.mu.RUnlock()
+	depths := make([]int, dq.limitPriority)
+	copy(depths, dq.numberOfTasksInEachQueue)
+	return depths
+}
+
+// Close is the same as CloseNow
+func (dq *DRRQueue) Close() error {
+	return dq.CloseNow()
+}
+
+// CloseNow closes DRRQueue, preventing it from accepting new request.
+// Remaining items are dropped, and waiting pops return immediately.
+// Closing it again does nothing, only returning `common.ErrQueueIsClosed`.
+func (dq *DRRQueue) CloseNow() error {
+	dq.mu.Lock()
+	defer dq.mu.Unlock()
+	if !dq.running {
+		return common.ErrQueueIsClosed
+	}
+	dq.closeLocked()
+	return nil
+}
+
+// CloseGracefully stops DRRQueue from accepting new request,
+// but pops keep returning the remaining items.
+// Once it is empty, it is closed the same way as CloseNow.
+func (dq *DRRQueue) CloseGracefully() {
+	dq.mu.Lock()
+	if dq.running {
+		dq.draining = true
+		if dq.size == 0 {
+			dq.closeLocked()
+		}
+	}
+	dq.mu.Unlock()
+}
+
+// WaitUntilEmpty waits until DRRQueue holds no item, and returns nil.
+// It returns `common.ErrQueueIsClosed` if DRRQueue is closed with items left,
+// or `ctx.Err()` once `ctx` is done while waiting.
+func (dq *DRRQueue) WaitUntilEmpty(ctx context.Context) error {
+	dq.mu.Lock()
+	defer dq.mu.Unlock()
+	if dq.size > 0 {
+		defer common.WakeOnDone(ctx, dq.emptied)()
+	}
+	for dq.size > 0 {
+		if !dq.running {
+			return common.ErrQueueIsClosed
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		dq.emptied.Wait()
+	}
+	return nil
+}
+
+// IsClosed returns whether DRRQueue is closed, after which no item is popped anymore
+func (dq *DRRQueue) IsClosed() bool {
+	dq.mu.RLock()
+	defer dq.mu.RUnlock()
+	return !dq.running
+}
+
+// Closed returns a channel which is closed once DRRQueue is closed,
+// so other goroutines can select on it
+func (dq *DRRQueue) Closed() <-chan struct{} {
+	return dq.closed
+}
+
+func (dq *DRRQueue) closeLocked() {
+	if !dq.running {
+		// already closed, dq.closed can't be closed twice
+		return
+	}
+	dq.running = false
+	close(dq.closed)
+	for _, q := range dq.queues {
+		q.Close()
+	}
+	dq.notEmpty.Broadcast()
+	dq.notFull.Broadcast()
+	dq.emptied.Broadcast()
+}
@@ -0,0 +1,148 @@
+package drr
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/queuetest"
+)
+
+func TestNewDRRQueueErrors(t *testing.T) {
+	_, err := NewDRRQueue(10, []int{1, 0})
+	if err == nil || err != common.ErrParamShouldBePositive {
+		t.Fatalf("It should error, cause quantum can't be zero, but instead we got %v", err)
+	}
+	_, err = NewDRRQueue(0, []int{1})
+	if err == nil || err != common.ErrParamShouldBePositive {
+		t.Fatalf("It should error, cause sizeLimit can't be zero, but instead we got %v", err)
+	}
+
+	dq, _ := NewDRRQueue(1, []int{1})
+	err = dq.PushOrError(common.QItem{ID: 1, Cost: -1})
+	if !errors.Is(err, common.ErrParamShouldBePositive) {
+		t.Fatalf("It should error, cause cost can't be negative, but instead we got %v", err)
+	}
+	err = dq.PushOrError(common.QItem{ID: 1, Priority: 1})
+	if !errors.Is(err, common.ErrPriorityOutOfRange) {
+		t.Fatalf("It should error, cause priority is out of range, but instead we got %v", err)
+	}
+	dq.PushOrError(common.QItem{ID: 1})
+	err = dq.PushOrError(common.QItem{ID: 2})
+	if !errors.Is(err, common.ErrQueueIsFull) {
+		t.Fatalf("It should error, cause queue is full, but instead we got %v", err)
+	}
+}
+
+func TestDRRQueueSharesByCost(t *testing.T) {
+	dq, _ := NewDRRQueue(2048, []int{10, 10})
+	// priority 1 has big items, priority 0 has small ones
+	for i := 0; i < 10; i++ {
+		dq.PushOrError(common.QItem{ID: uint64(i), Priority: 1, Cost: 10})
+		dq.PushOrError(common.QItem{ID: uint64(100 + i), Priority: 0, Cost: 2})
+	}
+
+	costs := make([]int, 2)
+	for i := 0; i < 12; i++ {
+		item, _ := dq.PopOrWaitTillClose()
+		costs[item.Priority] += item.Cost
+	}
+	// 2 turns each: 2 big items, and 10 small ones
+	if costs[0] != 20 || costs[1] != 20 {
+		t.Fatalf("Both should get the same total cost, but instead we got %v", costs)
+	}
+	dq.Close()
+}
+
+func TestDRRQueueCarriesDeficit(t *testing.T) {
+	dq, _ := NewDRRQueue(2048, []int{5, 4})
+	dq.PushOrError(common.QItem{ID: 1, Priority: 1, Cost: 10})
+	dq.PushOrError(common.QItem{ID: 2, Priority: 0, Cost: 1})
+	dq.PushOrError(common.QItem{ID: 3, Priority: 0, Cost: 1})
+
+	// priority 1 needs 3 turns to cover cost 10, priority 0 is served meanwhile
+	expected := []uint64{2, 3, 1}
+	for _, e := range expected {
+		item, _ := dq.PopOrWaitTillClose()
+		if item.ID != e {
+			t.Fatalf("Expected ID %d, but instead we got %v", e, item)
+		}
+	}
+
+	dq.PushOrError(common.QItem{ID: 4, Priority: 0})
+	dq.CloseGracefully()
+	item, err := dq.PopOrWaitTillClose()
+	if err != nil || item.ID != 4 {
+		t.Fatalf("It should still return the remaining item, but instead we got %v and %v", item, err)
+	}
+	_, err = dq.PopOrWaitTillClose()
+	if err == nil || err != common.ErrQueueIsClosed {
+		t.Fatalf("It should be closed after draining, but instead we got %v", err)
+	}
+}
+
+func TestDRRQueueSkipsRounds(t *testing.T) {
+	dq, _ := NewDRRQueue(2048, []int{1, 1})
+	// about a billion turns each, if taken one by one
+	dq.PushOrError(common.QItem{ID: 1, Priority: 0, Cost: 1 << 30})
+	dq.PushOrError(common.QItem{ID: 2, Priority: 1, Cost: 1 << 30})
+	dq.PushOrError(common.QItem{ID: 3, Priority: 0, Cost: 1})
+
+	// priority 1 has its turn first, so it is covered first on a tie
+	expected := []uint64{2, 1, 3}
+	for _, e := range expected {
+		item, _ := dq.PopOrWaitTillClose()
+		if item.ID != e {
+			t.Fatalf("Expected ID %d, but instead we got %v", e, item)
+		}
+	}
+}
+
+func TestDRRQueueWaitUntilEmpty(t *testing.T) {
+	dq, _ := NewDRRQueue(10, []int{1, 1})
+	dq.PushOrError(common.QItem{ID: 1, Cost: 1})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := dq.WaitUntilEmpty(ctx); err == nil || err != context.DeadlineExceeded {
+		t.Fatalf("It should return context.DeadlineExceeded, cause nothing is popped, but instead we got %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- dq.WaitUntilEmpty(context.Background())
+	}()
+	dq.PopOrWaitTillClose()
+	if err := <-done; err != nil {
+		t.Fatalf("It should return once the last item is popped, but instead we got %v", err)
+	}
+
+	dq.PushOrError(common.QItem{ID: 2, Cost: 1})
+	dq.Close()
+	if err := dq.WaitUntilEmpty(context.Background()); err == nil || err != common.ErrQueueIsClosed {
+		t.Fatalf("It should return ErrQueueIsClosed, cause closed with items left, but instead we got %v", err)
+	}
+}
+
+func TestDRRQueueConformance(t *testing.T) {
+	queuetest.Run(t, func(sizeLimit int) (common.ExtendedQInterface, error) {
+		return NewDRRQueue(sizeLimit, []int{1, 1})
+	})
+}
+
+func TestDRRQueuePeek(t *testing.T) {
+	dq, _ := NewDRRQueue(10, []int{1, 1})
+	dq.PushOrError(common.QItem{ID: 1, Priority: 0, Cost: 1})
+	dq.PushOrError(common.QItem{ID: 2, Priority: 1, Cost: 1})
+	item, err := dq.Peek()
+	if err != nil || item.ID != 2 {
+		t.Fatalf("It should peek ID 2, but instead we got %v and %v", item, err)
+	}
+	popped, _ := dq.PopOrWaitTillClose()
+	if popped.ID != item.ID {
+		t.Fatalf("It should pop the peeked item, but instead we got %v", popped)
+	}
+	dq.Close()
+}
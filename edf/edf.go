@@ -0,0 +1,410 @@
+package edf
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+)
+
+// EDFQueue is a queue which always returns the item with the nearest deadline first
+// (earliest deadline first), ignoring the priority of items.
+//
+// Items without deadline (`Deadline` 0) come after all items having one.
+// Items with the same deadline are returned in the order they are pushed.
+//
+// Unlike the other built-in queues, deadlines don't fit into a small number of bands,
+// so this one is heap-based.
+type EDFQueue struct {
+	// synchronization primitive
+	// read-only calls (e.g. Len) only take the read lock,
+	// so they don't contend with each other
+	mu       *sync.RWMutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	// broadcast once the queue is empty, see `WaitUntilEmpty`
+	emptied *sync.Cond
+
+	items itemHeap
+
+	// simple metadata
+	sizeLimit        int
+	running          bool
+	closed           chan struct{}
+	draining         bool
+	lastEnqueuedTime int64
+}
+
+// Option configures optional behavior of EDFQueue
+type Option func(*EDFQueue) error
+
+// WithLess replaces how items are ordered: `less(a, b)` should return true if a goes before b.
+//
+// This allows deadline-like keys not fitting `Deadline`, e.g. a cost kept by the caller
+// for each item ID. `EnqueuedAt` is set before pushing, so it can be used to break ties.
+// Note that `less` is called while holding the queue lock,
+// so it should be fast, and never call the queue itself.
+func WithLess(less func(a, b common.QItem) bool) Option {
+	return func(eq *EDFQueue) error {
+		eq.items.less = less
+		return nil
+	}
+}
+
+// NewEDFQueue creates our edf queue, which caps at sizeLimit
+func NewEDFQueue(sizeLimit int, opts ...Option) (*EDFQueue, error) {
+	if sizeLimit <= 0 {
+		return nil, common.ErrParamShouldBePositive
+	}
+
+	mu := &sync.RWMutex{}
+	eq := &EDFQueue{
+		mu:       mu,
+		notEmpty: sync.NewCond(mu),
+		notFull:  sync.NewCond(mu),
+		emptied:  sync.NewCond(mu),
+		items: itemHeap{
+			arr:  make([]common.QItem, 0, sizeLimit),
+			less: nearestDeadlineFirst,
+		},
+		sizeLimit: sizeLimit,
+		running:   true,
+		closed:    make(chan struct{}),
+	}
+	for _, opt := range opts {
+		if err := opt(eq); err != nil {
+			return nil, err
+		}
+	}
+	return eq, nil
+}
+
+// PushOrError put the item into the queue, and returns error if no slot available
+func (eq *EDFQueue) PushOrError(item common.QItem) error {
+	eq.mu.Lock()
+	defer eq.mu.Unlock()
+	if err := eq.pushLocked(item); err != nil {
+		return eq.queueErrorLocked("PushOrError", item, err)
+	}
+	return nil
+}
+
+// PushOrWaitCtx is the same as PushOrError, but waits for a slot while the queue is full,
+// and returns `ctx.Err()` once `ctx` is done while waiting
+func (eq *EDFQueue) PushOrWaitCtx(ctx context.Context, item common.QItem) error {
+	eq.mu.Lock()
+	defer eq.mu.Unlock()
+	err := eq.pushLocked(item)
+	if err == common.ErrQueueIsFull {
+		defer common.WakeOnDone(ctx, eq.notFull)()
+	}
+	for err == common.ErrQueueIsFull {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		eq.notFull.Wait()
+		err = eq.pushLocked(item)
+	}
+	if err != nil {
+		return eq.queueErrorLocked("PushOrWaitCtx", item, err)
+	}
+	return nil
+}
+
+// queueErrorLocked adds what eq looks like right now to `err`, see `common.QueueError`
+func (eq *EDFQueue) queueErrorLocked(op string, item common.QItem, err error) error {
+	return &common.QueueError{Op: op, Priority: item.Priority, Size: eq.items.Len(), Limit: eq.sizeLimit, Err: err}
+}
+
+func (eq *EDFQueue) pushLocked(item common.QItem) error {
+	if !eq.running || eq.draining {
+		return common.ErrQueueIsClosed
+	}
+	if eq.items.Len() == eq.sizeLimit {
+		return common.ErrQueueIsFull
+	}
+
+	// strictly increasing, so it also breaks ties between same deadlines
+	item.EnqueuedAt = time.Now().UnixNano()
+	if item.EnqueuedAt <= eq.lastEnqueuedTime {
+		item.EnqueuedAt = eq.lastEnqueuedTime + 1
+	}
+	eq.lastEnqueuedTime = item.EnqueuedAt
+
+	heap.Push(&eq.items, item)
+	eq.notEmpty.Signal()
+	return nil
+}
+
+// PopOrWaitTillClose returns the item with the nearest deadline, or waits if none exists
+func (eq *EDFQueue) PopOrWaitTillClose() (common.QItem, error) {
+	return eq.PopOrWaitCtx(context.Background())
+}
+
+// PopOrWaitCtx is the same as PopOrWaitTillClose,
+// but also returns `ctx.Err()` once `ctx` is done while waiting
+func (eq *EDFQueue) PopOrWaitCtx(ctx context.Context) (common.QItem, error) {
+	eq.mu.Lock()
+	defer eq.mu.Unlock()
+	if err := eq.waitLocked(ctx); err != nil {
+		return common.MinQItem, err
+	}
+	return eq.popLocked(), nil
+}
+
+// TryPop is the non-blocking version of PopOrWaitTillClose.
+// It returns `common.ErrQueueIsEmpty` right away if the queue is empty.
+func (eq *EDFQueue) TryPop() (common.QItem, error) {
+	eq.mu.Lock()
+	defer eq.mu.Unlock()
+	if !eq.running {
+		return common.MinQItem, common.ErrQueueIsClosed
+	}
+	if eq.items.Len() == 0 {
+		return common.MinQItem, common.ErrQueueIsEmpty
+	}
+	return eq.popLocked(), nil
+}
+
+// popLocked takes the item with the nearest deadline, there should be at least 1
+func (eq *EDFQueue) popLocked() common.QItem {
+	result := heap.Pop(&eq.items).(common.QItem)
+	eq.notFull.Signal()
+	if eq.items.Len() == 0 {
+		eq.emptied.Broadcast()
+		if eq.draining {
+			eq.closeLocked()
+		}
+	}
+	return result
+}
+
+// Peek returns the item the next pop returns, without removing it,
+// or `common.ErrQueueIsEmpty` if the queue is empty.
+func (eq *EDFQueue) Peek() (common.QItem, error) {
+	eq.mu.RLock()
+	defer eq.mu.RUnlock()
+	if !eq.running {
+		return common.MinQItem, common.ErrQueueIsClosed
+	}
+	if eq.items.Len() == 0 {
+		return common.MinQItem, common.ErrQueueIsEmpty
+	}
+	return eq.items.arr[0], nil
+}
+
+// PopBatchOrWaitTillClose waits like PopOrWaitTillClose,
+// and then returns up to `max` items in the same order as popping them one by one,
+// only taking the lock once.
+func (eq *EDFQueue) PopBatchOrWaitTillClose(max int) ([]common.QItem, error) {
+	eq.mu.Lock()
+	defer eq.mu.Unlock()
+	if err := eq.waitLocked(context.Background()); err != nil {
+		return nil, err
+	}
+	results := make([]common.QItem, 0, max)
+	for len(results) < max && eq.items.Len() > 0 {
+		results = append(results, heap.Pop(&eq.items).(common.QItem))
+	}
+	eq.notFull.Broadcast()
+	if eq.items.Len() == 0 {
+		eq.emptied.Broadcast()
+		if eq.draining {
+			eq.closeLocked()
+		}
+	}
+	return results, nil
+}
+
+// waitLocked waits until there is an item,
+// or returns error if the queue is closed, or `ctx` is done, in the meantime.
+func (eq *EDFQueue) waitLocked(ctx context.Context) error {
+	if !eq.running {
+		return common.ErrQueueIsClosed
+	}
+	if eq.items.Len() == 0 {
+		defer common.WakeOnDone(ctx, eq.notEmpty)()
+	}
+	for eq.items.Len() == 0 {
+		if eq.draining {
+			eq.closeLocked()
+			return common.ErrQueueIsClosed
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		eq.notEmpty.Wait()
+		// double check, ensuring see the changes after wait call
+		if !eq.running {
+			return common.ErrQueueIsClosed
+		}
+	}
+	return nil
+}
+
+// Remove takes out the item with `id`, freeing its slot,
+// or returns `common.ErrItemNotFound` if it is not in the queue anymore.
+//
+// Finding the item is O(n).
+func (eq *EDFQueue) Remove(id uint64) (common.QItem, error) {
+	eq.mu.Lock()
+	defer eq.mu.Unlock()
+	if !eq.running {
+		return common.MinQItem, common.ErrQueueIsClosed
+	}
+
+	for i := range eq.items.arr {
+		if eq.items.arr[i].ID == id {
+			result := heap.Remove(&eq.items, i).(common.QItem)
+			eq.notFull.Signal()
+			if eq.items.Len() == 0 {
+				eq.emptied.Broadcast()
+				if eq.draining {
+					eq.closeLocked()
+				}
+			}
+			return result, nil
+		}
+	}
+	return common.MinQItem, common.ErrItemNotFound
+}
+
+// Len returns the number of items currently in the queue
+func (eq *EDFQueue) Len() int {
+	eq.mu.RLock()
+	defer eq.mu.RUnlock()
+	return eq.items.Len()
+}
+
+// Cap returns the maximum number of items the queue can hold
+func (eq *EDFQueue) Cap() int {
+	return eq.sizeLimit
+}
+
+// DepthPerPriority always returns nil, as items are ordered by deadline,
+// not by priority. Use Len instead.
+func (eq *EDFQueue) DepthPerPriority() []int {
+	return nil
+}
+
+// Close is the same as CloseNow
+func (eq *EDFQueue) Close() error {
+	return eq.CloseNow()
+}
+
+// CloseNow closes EDFQueue, preventing it from accepting new request.
+// Remaining items are dropped, and waiting pops return immediately.
+// Closing it again does nothing, only returning `common.ErrQueueIsClosed`.
+func (eq *EDFQueue) CloseNow() error {
+	eq.mu.Lock()
+	defer eq.mu.Unlock()
+	if !eq.running {
+		return common.ErrQueueIsClosed
+	}
+	eq.closeLocked()
+	return nil
+}
+
+// CloseGracefully stops EDFQueue from accepting new request,
+// but pops keep returning the remaining items.
+// Once it is empty, it is closed the same way as CloseNow.
+func (eq *EDFQueue) CloseGracefully() {
+	eq.mu.Lock()
+	if eq.running {
+		eq.draining = true
+		if eq.items.Len() == 0 {
+			eq.closeLocked()
+		}
+	}
+	eq.mu.Unlock()
+}
+
+// WaitUntilEmpty waits until EDFQueue holds no item, and returns nil.
+// It returns `common.ErrQueueIsClosed` if EDFQueue is closed with items left,
+// or `ctx.Err()` once `ctx` is done while waiting.
+func (eq *EDFQueue) WaitUntilEmpty(ctx context.Context) error {
+	eq.mu.Lock()
+	defer eq.mu.Unlock()
+	if eq.items.Len() > 0 {
+		defer common.WakeOnDone(ctx, eq.emptied)()
+	}
+	for eq.items.Len() > 0 {
+		if !eq.running {
+			return common.ErrQueueIsClosed
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		eq.emptied.Wait()
+	}
+	return nil
+}
+
+// IsClosed returns whether EDFQueue is closed, after which no item is popped anymore
+func (eq *EDFQueue) IsClosed() bool {
+	eq.mu.RLock()
+	defer eq.mu.RUnlock()
+	return !eq.running
+}
+
+// Closed returns a channel which is closed once EDFQueue is closed,
+// so other goroutines can select on it
+func (eq *EDFQueue) Closed() <-chan struct{} {
+	return eq.closed
+}
+
+func (eq *EDFQueue) closeLocked() {
+	if !eq.running {
+		// already closed, eq.closed can't be closed twice
+		return
+	}
+	eq.running = false
+	close(eq.closed)
+	eq.notEmpty.Broadcast()
+	eq.notFull.Broadcast()
+	eq.emptied.Broadcast()
+}
+
+// itemHeap implements `container/heap.Interface`,
+// with the item `less` says goes first on top
+type itemHeap struct {
+	arr  []common.QItem
+	less func(a, b common.QItem) bool
+}
+
+func (h *itemHeap) Len() int { return len(h.arr) }
+
+func (h *itemHeap) Less(i, j int) bool { return h.less(h.arr[i], h.arr[j]) }
+
+func (h *itemHeap) Swap(i, j int) { h.arr[i], h.arr[j] = h.arr[j], h.arr[i] }
+
+func (h *itemHeap) Push(x interface{}) {
+	h.arr = append(h.arr, x.(common.QItem))
+}
+
+func (h *itemHeap) Pop() interface{} {
+	n := len(h.arr)
+	item := h.arr[n-1]
+	// so its payload can be garbage collected
+	h.arr[n-1] = common.QItem{}
+	h.arr = h.arr[:n-1]
+	return item
+}
+
+// nearestDeadlineFirst is the default ordering.
+// Items without deadline go after all others, and ties are broken by push order.
+func nearestDeadlineFirst(a, b common.QItem) bool {
+	if a.Deadline != b.Deadline {
+		// no deadline means it can wait for everything else
+		if a.Deadline == 0 {
+			return false
+		}
+		if b.Deadline == 0 {
+			return true
+		}
+		return a.Deadline < b.Deadline
+	}
+	return a.EnqueuedAt < b.EnqueuedAt
+}
@@ -0,0 +1,190 @@
+package edf
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/queuetest"
+)
+
+func TestNewEDFQueueError(t *testing.T) {
+	_, err := NewEDFQueue(0)
+	if err == nil || err != common.ErrParamShouldBePositive {
+		t.Fatalf("It should error, cause sizeLimit can't be zero, but instead we got %v", err)
+	}
+}
+
+func TestEDFQueueOrder(t *testing.T) {
+	eq, _ := NewEDFQueue(5)
+	eq.PushOrError(common.QItem{ID: 1, Deadline: 0})
+	eq.PushOrError(common.QItem{ID: 2, Deadline: 300})
+	eq.PushOrError(common.QItem{ID: 3, Deadline: 100, Priority: 1})
+	eq.PushOrError(common.QItem{ID: 4, Deadline: 300})
+	eq.PushOrError(common.QItem{ID: 5, Deadline: 0})
+	err := eq.PushOrError(common.QItem{ID: 6, Deadline: 50})
+	if !errors.Is(err, common.ErrQueueIsFull) {
+		t.Fatalf("It should error, cause queue is full, but instead we got %v", err)
+	}
+	if eq.Len() != 5 || eq.Cap() != 5 {
+		t.Fatalf("Expected Len and Cap 5, but instead we got %d and %d", eq.Len(), eq.Cap())
+	}
+
+	// nearest deadline first, FIFO on ties, no deadline last
+	items, _ := eq.PopBatchOrWaitTillClose(2)
+	result, _ := eq.PopOrWaitTillClose()
+	items = append(items, result)
+	expected := []uint64{3, 2, 4}
+	for i, e := range expected {
+		if items[i].ID != e {
+			t.Fatalf("Expected ID %d at %d, but instead we got %v", e, i, items)
+		}
+	}
+
+	_, err = eq.Remove(1)
+	if err != nil {
+		t.Fatalf("It should remove ID 1, but instead we got %v", err)
+	}
+	result, _ = eq.PopOrWaitTillClose()
+	if result.ID != 5 {
+		t.Fatalf("Expected ID 5, but instead we got %v", result)
+	}
+	eq.Close()
+}
+
+func TestEDFQueueClose(t *testing.T) {
+	eq, _ := NewEDFQueue(5)
+	eq.PushOrError(common.QItem{ID: 1, Deadline: 10})
+	eq.CloseGracefully()
+	err := eq.PushOrError(common.QItem{ID: 2})
+	if !errors.Is(err, common.ErrQueueIsClosed) {
+		t.Fatalf("It should error, cause queue is closing, but instead we got %v", err)
+	}
+	result, err := eq.PopOrWaitTillClose()
+	if err != nil || result.ID != 1 {
+		t.Fatalf("It should still return the remaining item, but instead we got %v and %v", result, err)
+	}
+	_, err = eq.PopOrWaitTillClose()
+	if err == nil || err != common.ErrQueueIsClosed {
+		t.Fatalf("It should be closed after draining, but instead we got %v", err)
+	}
+}
+
+func TestEDFQueueWithLess(t *testing.T) {
+	// latest deadline first, just to differ from the default
+	eq, _ := NewEDFQueue(5, WithLess(func(a, b common.QItem) bool {
+		return a.Deadline > b.Deadline
+	}))
+	eq.PushOrError(common.QItem{ID: 1, Deadline: 100})
+	eq.PushOrError(common.QItem{ID: 2, Deadline: 300})
+	eq.PushOrError(common.QItem{ID: 3, Deadline: 200})
+
+	expected := []uint64{2, 3, 1}
+	for _, e := range expected {
+		item, _ := eq.PopOrWaitTillClose()
+		if item.ID != e {
+			t.Fatalf("Expected ID %d, but instead we got %v", e, item)
+		}
+	}
+	eq.Close()
+}
+
+func TestEDFQueuePopWait(t *testing.T) {
+	eq, _ := NewEDFQueue(100)
+
+	c := make(chan uint64, 1)
+	go func() {
+		item, err := eq.PopOrWaitTillClose()
+		if err != nil {
+			c <- 0
+			return
+		}
+		c <- item.ID
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	deadline := time.Now().Add(time.Second).UnixNano()
+	err := eq.PushOrError(common.QItem{ID: 7, Deadline: deadline})
+	if err != nil {
+		t.Fatalf("It should not error because slots are available, but we got %v", err)
+	}
+
+	select {
+	case id := <-c:
+		if id != 7 {
+			t.Fatalf("Waiting pop should receive ID 7, but instead we got %d", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Waiting pop should be woken up by the push, but it is not")
+	}
+}
+
+func TestEDFQueueCloseReleasesWaitingPop(t *testing.T) {
+	eq, _ := NewEDFQueue(100)
+
+	c := make(chan error, 1)
+	go func() {
+		_, err := eq.PopOrWaitTillClose()
+		c <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	eq.Close()
+	select {
+	case err := <-c:
+		if err == nil || err != common.ErrQueueIsClosed {
+			t.Fatalf("It should return ErrQueueIsClosed, but instead we got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Waiting pop should be released by Close, but it is not")
+	}
+}
+
+func TestEDFQueueWaitUntilEmpty(t *testing.T) {
+	eq, _ := NewEDFQueue(10)
+	eq.PushOrError(common.QItem{ID: 1})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := eq.WaitUntilEmpty(ctx); err == nil || err != context.DeadlineExceeded {
+		t.Fatalf("It should return context.DeadlineExceeded, cause nothing is popped, but instead we got %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- eq.WaitUntilEmpty(context.Background())
+	}()
+	eq.PopOrWaitTillClose()
+	if err := <-done; err != nil {
+		t.Fatalf("It should return once the last item is popped, but instead we got %v", err)
+	}
+
+	eq.PushOrError(common.QItem{ID: 2})
+	eq.Close()
+	if err := eq.WaitUntilEmpty(context.Background()); err == nil || err != common.ErrQueueIsClosed {
+		t.Fatalf("It should return ErrQueueIsClosed, cause closed with items left, but instead we got %v", err)
+	}
+}
+
+func TestEDFQueueConformance(t *testing.T) {
+	queuetest.Run(t, func(sizeLimit int) (common.ExtendedQInterface, error) {
+		return NewEDFQueue(sizeLimit)
+	})
+}
+
+func TestEDFQueuePeek(t *testing.T) {
+	eq, _ := NewEDFQueue(10)
+	eq.PushOrError(common.QItem{ID: 1, Deadline: 200})
+	eq.PushOrError(common.QItem{ID: 2, Deadline: 100})
+	item, err := eq.Peek()
+	if err != nil || item.ID != 2 {
+		t.Fatalf("It should peek ID 2, but instead we got %v and %v", item, err)
+	}
+	popped, _ := eq.PopOrWaitTillClose()
+	if popped.ID != item.ID {
+		t.Fatalf("It should pop the peeked item, but instead we got %v", popped)
+	}
+	eq.Close()
+}
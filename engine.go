@@ -1,129 +1,951 @@
-package prioritize
-
-import (
-	"context"
-	"errors"
-	"sync"
-
-	"github.com/aarondwi/prioritize/common"
-)
-
-// Engine is our prioritizing engine.
-// It has 3 parts: queue, worker, and mapping.
-//
-// Worker is designed as a goroutine pool,
-// in which each will take an item from queue, get the task from the mapping,
-// and then do the work
-type Engine struct {
-	sync.Mutex
-	lastID    uint64
-	q         common.QInterface
-	mapping   map[uint64]*Task
-	closeChan chan bool
-}
-
-// ErrNumOfWorkerIsNegativeOrZero is returned when `numOfWorker` parameter is <= 0
-var ErrNumOfWorkerIsNegativeOrZero = errors.New("number of workers should be positive")
-
-// ErrCtxAlreadyCancelled is returned when task.ctx taken by worker is already done
-var ErrCtxAlreadyCancelled = errors.New("Context is already cancelled when it is gonna be taken")
-
-// ErrAlreadyClosed is returned when `Submit()` is called after `Close()`
-var ErrAlreadyClosed = errors.New("This engine is already closed")
-
-// New creates our new prioritization engine.
-func New(q common.QInterface, numOfWorker int) (*Engine, error) {
-	if numOfWorker <= 0 {
-		return nil, ErrNumOfWorkerIsNegativeOrZero
-	}
-	e := &Engine{
-		q:         q,
-		mapping:   make(map[uint64]*Task),
-		closeChan: make(chan bool),
-	}
-	for i := 0; i < numOfWorker; i++ {
-		go e.workLoop()
-	}
-	return e, nil
-}
-
-func (e *Engine) workLoop() {
-	for {
-		select {
-		case <-e.closeChan:
-			return
-		default:
-			// we need these to return by themselves.
-			// because probably we already waiting on `PopOrWaitTillClose`
-			// when closeChan is closed
-			item, err := e.q.PopOrWaitTillClose()
-			if err != nil {
-				return
-			}
-
-			e.Lock()
-			task, ok := e.mapping[item.ID]
-			if !ok {
-				panic("Broken implementation: ID not found in the mapping!")
-			}
-			delete(e.mapping, item.ID)
-			e.Unlock()
-
-			select {
-			case <-task.ctx.Done():
-				// fast path
-				// already timeout/done, skip with error
-				task.set(nil, ErrCtxAlreadyCancelled)
-				break
-			default:
-				result, err := task.fn(task.ctx, task.arg)
-				task.set(result, err)
-				break
-			}
-		}
-	}
-}
-
-// Submit creates task to be done in the worker goroutine
-//
-// The callee can call `.Result()` call to wait for result and error returned by fn
-func (e *Engine) Submit(
-	ctx context.Context,
-	priority int,
-	fn TaskFunc,
-	arg interface{}) (*Task, error) {
-
-	select {
-	case <-e.closeChan:
-		return nil, ErrAlreadyClosed
-	default:
-		e.Lock()
-
-		// increment first
-		// if crash/error, at most we lost 1 ID (out of 2^64, which basically is nothing)
-		e.lastID++
-
-		// Create mapping first.
-		// Because we don't want race condition to happen between
-		// fetching from queue and looking for the task to be run
-		task := newTask(ctx, priority, fn, arg)
-		e.mapping[e.lastID] = task
-
-		err := e.q.PushOrError(common.QItem{ID: e.lastID, Priority: priority})
-		if err != nil {
-			delete(e.mapping, e.lastID)
-			e.Unlock()
-			return nil, err
-		}
-		e.Unlock()
-		return task, nil
-	}
-}
-
-// Close the instance, and all background goroutine worker
-//
-// Subsequent request will be rejected.
-func (e *Engine) Close() {
-	close(e.closeChan)
-	e.q.Close()
-}
+package prioritize
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/edf"
+)
+
+// Engine is our prioritizing engine.
+// It has 2 parts: queue and worker.
+//
+// Worker is designed as a goroutine pool,
+// in which each will take an item from queue, get the task carried in the item payload,
+// and then do the work
+type Engine struct {
+	// first, to keep them 64-bit aligned for atomic operations
+	lastID   uint64
+	timedOut uint64
+	// number of tasks in the queue, see `Len`
+	queued int64
+	// items taken by workers, not yet done with, see `Flush`
+	taken int64
+	// how many times the queue is swapped, see `SwapQueue`
+	swaps uint64
+
+	// counters, see `Stats`
+	enqueued  uint64
+	dequeued  uint64
+	succeeded uint64
+	failed    uint64
+	rejected  uint64
+
+	// guards the task dependencies
+	sync.RWMutex
+	// the current queue, always read with `queue()`, see `SwapQueue`
+	q atomic.Value
+	// swapMu makes closing wait for a swap in progress, and guards paused
+	swapMu    sync.Mutex
+	paused    bool
+	closeChan chan bool
+	closeOnce sync.Once
+	workersWg sync.WaitGroup
+	// flushed wakes those waiting in `Flush`, only broadcast while flushers > 0
+	flushMu  sync.Mutex
+	flushed  *sync.Cond
+	flushers int32
+
+	// only set if created with `NewWithTenants`, in which case q is this too
+	tenants *tenantQueue
+	// only set if created with `NewWithFairCallers`
+	fairCallers bool
+
+	// telemetry
+	sampler         *common.Sampler
+	queueWait       *ewma
+	queueWaitRecent *ewma
+	runTime         *ewma
+	numOfWorker     int32
+	busyWorker      int32
+
+	// only set with `WithReservedWorkers`
+	reservedWorkers     int32
+	reservedMinPriority int
+
+	// only set with `WithMaxWorkers`, scaleMu guards adding and removing workers
+	scaleMu     sync.Mutex
+	minWorkers  int32
+	maxWorkers  int32
+	idleTimeout time.Duration
+	// only set with `SetWorkerCount`, wake holds a *wakeSignal
+	targetWorkers int32
+	wake          atomic.Value
+
+	// per-worker buffers, only set with `WithLocalBatch`
+	localBatch int
+	buffers    []*localBuffer
+	closedNow  int32
+
+	// only set with `WithCancelledTaskReaping` and `WithMaxQueueWait`
+	reapInterval time.Duration
+	reapable     *queuedTasks
+	maxQueueWait time.Duration
+
+	// only set if created with `NewEDF`, in which case priority is ignored
+	deadlineOrder bool
+
+	// only set with `WithResultStore`
+	results *resultStore
+
+	// only set with `WithRetry`
+	maxRetries     int
+	retryBaseDelay time.Duration
+	retryMaxDelay  time.Duration
+
+	// only set with `WithDeadletter`
+	deadletter func(task *Task, err error)
+
+	// only set with `WithMetricsSink`
+	sink MetricsSink
+
+	// only set with `WithTracer`
+	tracer Tracer
+
+	// only set with `WithMiddleware`
+	middleware []Middleware
+
+	// only set with `WithAdmissionHook`
+	admission []AdmissionHook
+
+	// only set with `WithFullPolicy` or `WithShedding`
+	fullPolicy FullPolicy
+	shedder    *shedder
+
+	// only set with `WithMaxConcurrentPerPriority`
+	limits *concurrencyLimits
+
+	// only set with `WithRateLimit`
+	rates *rateLimits
+
+	// only set with `WithCircuitBreaker`
+	breaker *circuitBreaker
+
+	// no-op, unless set with `WithLogger`
+	logger            Logger
+	slowTaskThreshold time.Duration
+
+	// tasks currently run by workers, see `Snapshot`
+	inflight *inflightTasks
+	// only set with `WithProgressCallback`
+	onProgress func(task *Task, fraction float64, stage string)
+	// only set with `WithStuckTaskDetection`
+	stuckThreshold time.Duration
+
+	// tasks of `SubmitDedup`, only kept after completion with `WithDedupCache`
+	dedup dedupTasks
+}
+
+// Option configures optional behavior of Engine
+type Option func(*Engine) error
+
+// WithTelemetrySampling makes the engine only measure 1 out of every `n` tasks,
+// keeping the telemetry overhead bounded for very hot engines.
+// By default, every task is measured.
+func WithTelemetrySampling(n int) Option {
+	return func(e *Engine) error {
+		sampler, err := common.NewSampler(n)
+		if err != nil {
+			return err
+		}
+		e.sampler = sampler
+		return nil
+	}
+}
+
+// ErrNumOfWorkerIsNegativeOrZero is returned when `numOfWorker` parameter is <= 0
+var ErrNumOfWorkerIsNegativeOrZero = errors.New("number of workers should be positive")
+
+// ErrCtxAlreadyCancelled is returned when task.ctx taken by worker is already done
+var ErrCtxAlreadyCancelled = errors.New("Context is already cancelled when it is gonna be taken")
+
+// ErrAlreadyClosed is returned when `Submit()` is called after `Close()`
+var ErrAlreadyClosed = errors.New("This engine is already closed")
+
+// ErrPriorityUpdateNotSupported is returned when a queued task needs its priority changed,
+// but the queue does not implement `common.PriorityUpdater`, or wraps one which does not
+var ErrPriorityUpdateNotSupported = errors.New("The queue does not support updating priority")
+
+// ErrTaskAlreadyStarted is returned when escalating a task which is already taken by a worker
+var ErrTaskAlreadyStarted = errors.New("Task is already taken by a worker")
+
+// ErrRemoveNotSupported is returned when reaping cancelled tasks is requested,
+// but the queue does not implement `common.Remover`
+var ErrRemoveNotSupported = errors.New("The queue does not support removing items")
+
+// ErrPauseNotSupported is returned when pausing the engine is requested,
+// but the queue does not implement `common.Pauser`
+var ErrPauseNotSupported = errors.New("The queue does not support pausing")
+
+// ErrQueueTimeout is returned when a task is not taken by any worker
+// within the time given with `WithMaxQueueWait`
+var ErrQueueTimeout = errors.New("Task is not taken by any worker in time")
+
+// ErrYield can be returned by a TaskFunc which is not done yet, to give way to other tasks.
+// If the queue implements `common.Requeuer` (e.g. `mlfq.MLFQ`), the task is put back
+// into the queue, and demoted if it ran for at least the queue's quantum.
+// Else, it is returned as the error of the task.
+var ErrYield = errors.New("Task yields, and wants to be run again later")
+
+// ErrReservationNotSupported is returned when reserving workers is requested,
+// but the queue does not implement `common.FilteredPopper`
+var ErrReservationNotSupported = errors.New("The queue does not support popping only high priorities")
+
+// ErrTenantsNotEnabled is returned when `SubmitForTenant()` is called
+// on an engine not created with `NewWithTenants()`
+var ErrTenantsNotEnabled = errors.New("This engine is not created with tenants")
+
+// WithLocalBatch makes each worker take up to `n` items from the queue at once
+// (if the queue implements `common.BatchPopper`, as built-in ones do),
+// keeping them in its own buffer. A worker with an empty buffer
+// steals half of another worker's buffer before going back to the queue.
+//
+// This reduces contention on the queue lock with many workers,
+// at the cost of priority: a higher priority task coming later
+// still waits for the buffered ones.
+// Note that a worker already waiting on the queue does not steal.
+func WithLocalBatch(n int) Option {
+	return func(e *Engine) error {
+		if n <= 0 {
+			return common.ErrParamShouldBePositive
+		}
+		e.localBatch = n
+		return nil
+	}
+}
+
+// WithReservedWorkers makes `k` of the workers only ever take tasks
+// with priority `minPriority` or higher, so urgent tasks still get a worker right away
+// even when the others are all busy with long, low priority ones.
+//
+// `k` should be lower than `numOfWorker` (or the min, with `WithMinWorkers`),
+// else `ErrInvalidWorkerBounds` is returned. Reserved workers never exit early.
+// It requires the queue to implement `common.FilteredPopper` (e.g. `priority.PriorityQueue`),
+// else `ErrReservationNotSupported` is returned.
+func WithReservedWorkers(k, minPriority int) Option {
+	return func(e *Engine) error {
+		if k <= 0 {
+			return common.ErrParamShouldBePositive
+		}
+		if minPriority < 0 {
+			return common.ErrPriorityOutOfRange
+		}
+		if _, ok := e.queue().(common.FilteredPopper); !ok {
+			return ErrReservationNotSupported
+		}
+		e.reservedWorkers = int32(k)
+		e.reservedMinPriority = minPriority
+		return nil
+	}
+}
+
+// New creates our new prioritization engine.
+func New(q common.QInterface, numOfWorker int, opts ...Option) (*Engine, error) {
+	if numOfWorker <= 0 {
+		return nil, ErrNumOfWorkerIsNegativeOrZero
+	}
+	return newEngine(q, numOfWorker, opts)
+}
+
+// NewWithTenants creates a prioritization engine whose workers are shared between tenants.
+//
+// Each tenant gets its own queue, created by `newQueue` on its first submission.
+// When several tenants have tasks waiting, workers take them proportionally to `weights`,
+// e.g. a tenant with weight 3 gets 3 times as many tasks done as a tenant with weight 1.
+// Tenants not listed in `weights` have weight 1.
+//
+// Use `SubmitForTenant` to submit for a tenant. `Submit` goes to the default tenant `""`.
+func NewWithTenants(
+	newQueue func() (common.QInterface, error),
+	weights map[string]int,
+	numOfWorker int,
+	opts ...Option) (*Engine, error) {
+
+	if numOfWorker <= 0 {
+		return nil, ErrNumOfWorkerIsNegativeOrZero
+	}
+	tq, err := newTenantQueue(newQueue, weights)
+	if err != nil {
+		return nil, err
+	}
+	e, err := newEngine(tq, numOfWorker, opts)
+	if err != nil {
+		return nil, err
+	}
+	e.tenants = tq
+	return e, nil
+}
+
+// NewEDF creates a prioritization engine ordering tasks by their deadline instead of priority,
+// using `edf.EDFQueue` which caps at `sizeLimit`.
+//
+// The task whose ctx has the nearest deadline is run first,
+// and tasks whose ctx has no deadline are run after all others.
+// The priority given on submission is ignored.
+func NewEDF(sizeLimit, numOfWorker int, opts ...Option) (*Engine, error) {
+	if numOfWorker <= 0 {
+		return nil, ErrNumOfWorkerIsNegativeOrZero
+	}
+	q, err := edf.NewEDFQueue(sizeLimit)
+	if err != nil {
+		return nil, err
+	}
+	e, err := newEngine(q, numOfWorker, opts)
+	if err != nil {
+		return nil, err
+	}
+	e.deadlineOrder = true
+	return e, nil
+}
+
+func newEngine(q common.QInterface, numOfWorker int, opts []Option) (*Engine, error) {
+	// sampling every task never errors
+	sampler, _ := common.NewSampler(1)
+	e := &Engine{
+		closeChan:       make(chan bool),
+		sampler:         sampler,
+		queueWait:       newEWMA(0.1),
+		queueWaitRecent: newEWMA(0.5),
+		runTime:         newEWMA(0.1),
+		logger:          common.NopLogger{},
+		inflight:        newInflightTasks(),
+		numOfWorker:     int32(numOfWorker),
+	}
+	e.flushed = sync.NewCond(&e.flushMu)
+	e.setQueue(q)
+	for _, opt := range opts {
+		if err := opt(e); err != nil {
+			return nil, err
+		}
+	}
+	if err := e.checkWorkerBounds(); err != nil {
+		return nil, err
+	}
+	e.wake.Store(newWakeSignal())
+	if e.localBatch > 0 {
+		e.buffers = make([]*localBuffer, numOfWorker)
+		for i := range e.buffers {
+			e.buffers[i] = &localBuffer{}
+		}
+	}
+	if e.reapInterval > 0 {
+		go e.reapLoop()
+	}
+	if e.stuckThreshold > 0 {
+		go e.watchLoop()
+	}
+	e.workersWg.Add(numOfWorker)
+	for i := 0; i < numOfWorker; i++ {
+		go e.workLoop(i)
+	}
+	return e, nil
+}
+
+func (e *Engine) workLoop(i int) {
+	defer e.workersWg.Done()
+	defer func() {
+		// those held after CloseNow has dropped them, e.g. batched right before
+		if atomic.LoadInt32(&e.closedNow) == 1 {
+			e.dropHeld()
+		}
+	}()
+	// with `WithMaxConcurrentPerPriority`, the priority of the previous item,
+	// whose slot is released once the worker is back here
+	holding, holds := 0, false
+	// whether the previous item is counted in e.taken, until the worker is back here
+	taking := false
+	defer func() {
+		if taking {
+			atomic.AddInt64(&e.taken, -1)
+			e.settled()
+		}
+	}()
+	for {
+		if taking {
+			atomic.AddInt64(&e.taken, -1)
+			e.settled()
+			taking = false
+		}
+		var item common.QItem
+		var err error
+		handedOff, fromRates := false, false
+		if holds {
+			holds = false
+			item, handedOff = e.limits.release(holding)
+		}
+		if !handedOff {
+			if e.leave(i) {
+				return
+			}
+			if e.rates != nil {
+				item, fromRates = e.rates.ready()
+			}
+		}
+		if !handedOff && !fromRates {
+			// we don't check closeChan here,
+			// because on graceful close, workers should keep taking
+			// the remaining items until the queue says it is closed.
+			swaps := atomic.LoadUint64(&e.swaps)
+			item, err = e.next(i)
+			if errors.Is(err, context.DeadlineExceeded) {
+				// idle for too long, see `WithMaxWorkers`
+				if e.retire() {
+					return
+				}
+				continue
+			}
+			if errors.Is(err, context.Canceled) {
+				// woken up, see `wakeWorkers`
+				continue
+			}
+			if e.swappedSince(swaps, err) {
+				// the queue is closed because it is swapped out, see `SwapQueue`
+				continue
+			}
+			if err != nil {
+				// held items still have to run, see `WithRateLimit`
+				if e.rates != nil && atomic.LoadInt32(&e.closedNow) == 0 && e.rates.wait() {
+					continue
+				}
+				return
+			}
+			if e.rates != nil {
+				var ok bool
+				if item, ok = e.rates.acquire(item); !ok {
+					continue
+				}
+			}
+		}
+		// counted before it leaves `Len()`, so `Flush` always sees 1 of them
+		atomic.AddInt64(&e.taken, 1)
+		taking = true
+		// buffered items are dropped on CloseNow, just like queued ones
+		if atomic.LoadInt32(&e.closedNow) == 1 {
+			e.drop(item)
+			return
+		}
+		if e.limits != nil {
+			// a handed off item already has the slot of the previous one
+			if !handedOff && !e.limits.acquire(item) {
+				continue
+			}
+			holding, holds = item.Priority, true
+		}
+
+		task, ok := item.Payload.(*Task)
+		if !ok {
+			ft, ok := item.Payload.(*forgottenTask)
+			if !ok {
+				panic("Broken implementation: the queue did not keep the item payload!")
+			}
+			f := *ft
+			e.untrackForgotten(ft)
+			e.onDequeued(item.Priority, 0)
+			e.runForgotten(item, f)
+			continue
+		}
+		if !e.untrack(task) {
+			continue
+		}
+
+		var wait time.Duration
+		if !task.enqueuedAt.IsZero() {
+			wait = time.Since(task.enqueuedAt)
+		}
+		e.onDequeued(item.Priority, wait)
+		if task.span != nil {
+			task.span.AddEvent(EventDequeued)
+		}
+
+		// already expired, and only not yet removed from the queue
+		if task.expiry != nil && !task.expiry.Stop() {
+			e.complete(task, nil, ErrQueueTimeout)
+			continue
+		}
+
+		if !task.enqueuedAt.IsZero() {
+			e.queueWait.observe(wait)
+			e.queueWaitRecent.observe(wait)
+		}
+
+		select {
+		case <-task.ctx.Done():
+			// fast path
+			// already timeout/done, skip with error
+			e.complete(task, nil, ErrCtxAlreadyCancelled)
+		default:
+			if !e.circuitAllows(task.ctx) {
+				e.fail(task, nil, ErrCircuitOpen)
+				continue
+			}
+			ctx, cancel, ok := task.start()
+			if !ok {
+				// cancelled while queued, but the queue can't remove it
+				continue
+			}
+			var runSpan Span
+			if e.tracer != nil {
+				ctx, runSpan = e.tracer.Start(ctx, SpanRun, item.Priority)
+			}
+			atomic.AddInt32(&e.busyWorker, 1)
+			e.inflight.start(item.ID, item.Priority)
+			start := time.Now()
+			result, err := e.runFn(ctx, task)
+			ran := time.Since(start)
+			e.inflight.stop(item.ID)
+			atomic.AddInt32(&e.busyWorker, -1)
+			cancel()
+			e.logRun(task, item.Priority, ran)
+			if runSpan != nil {
+				runSpan.End(err)
+			}
+			task.setRan(ran)
+			e.circuitRecord(task.ctx, err)
+			if !task.enqueuedAt.IsZero() {
+				e.runTime.observe(ran)
+			}
+			if err == ErrYield && e.requeue(item, task, ran) {
+				continue
+			}
+			if err != nil && err != ErrYield && e.maxRetries > 0 && e.retry(item, task, err) {
+				continue
+			}
+			if err != nil {
+				e.fail(task, result, err)
+				continue
+			}
+			e.complete(task, result, nil)
+		}
+	}
+}
+
+// requeue puts a yielding task back into the queue, see `ErrYield`.
+// It returns false if the queue can't take it back.
+func (e *Engine) requeue(item common.QItem, task *Task, ran time.Duration) bool {
+	requeuer, ok := e.queue().(common.Requeuer)
+	if !ok {
+		return false
+	}
+	task.requeued()
+	e.track(task)
+	if err := requeuer.Requeue(item, ran >= requeuer.Quantum()); err != nil {
+		e.untrack(task)
+		return false
+	}
+	e.onEnqueued(item.Priority)
+	return true
+}
+
+// Submit creates task to be done in the worker goroutine
+//
+// The callee can call `.Result()` call to wait for result and error returned by fn
+func (e *Engine) Submit(
+	ctx context.Context,
+	priority int,
+	fn TaskFunc,
+	arg interface{}) (*Task, error) {
+	return e.submit(ctx, priority, fn, arg, nil, nil, false)
+}
+
+// SubmitWithCallback is the same as `Submit`, but also calls `onComplete`
+// with the same result and error `Task.Result()` returns, once the task completes,
+// so fire-and-forget callers don't need a goroutine per task waiting for it.
+//
+// `onComplete` is called by whoever completes the task, which is the worker right after fn returns,
+// unless the engine completes it early (e.g. `Engine.Cancel` or `WithMaxQueueWait`).
+// Keep it short, as the worker does not take other tasks in the meantime.
+func (e *Engine) SubmitWithCallback(
+	ctx context.Context,
+	priority int,
+	fn TaskFunc,
+	arg interface{},
+	onComplete func(result interface{}, err error)) (*Task, error) {
+	return e.submit(ctx, priority, fn, arg, onComplete, nil, false)
+}
+
+// SubmitOrWait is the same as `Submit`, but waits while the queue is full,
+// instead of returning `common.ErrQueueIsFull`, giving backpressure to the callers.
+// It stops waiting once `ctx` is done, returning `ctx.Err()`.
+//
+// If the engine is closed while waiting, it returns `ErrAlreadyClosed`, just like `Submit`.
+//
+// If the queue does not implement `common.CtxPusher`, it does not wait, just like `Submit`.
+func (e *Engine) SubmitOrWait(
+	ctx context.Context,
+	priority int,
+	fn TaskFunc,
+	arg interface{}) (*Task, error) {
+
+	if _, ok := e.queue().(common.CtxPusher); !ok {
+		return e.Submit(ctx, priority, fn, arg)
+	}
+	task, err := e.submit(ctx, priority, fn, arg, nil, func(item common.QItem) error {
+		return e.retrySwapped(func(q common.QInterface) error {
+			if pusher, ok := q.(common.CtxPusher); ok {
+				return pusher.PushOrWaitCtx(ctx, item)
+			}
+			return q.PushOrError(item)
+		})
+	}, false)
+	if errors.Is(err, common.ErrQueueIsClosed) {
+		return nil, ErrAlreadyClosed
+	}
+	return task, err
+}
+
+// SubmitForTenant is the same as `Submit`, but the task is queued under `tenant`.
+//
+// It returns `ErrTenantsNotEnabled` if the engine is not created with `NewWithTenants`.
+func (e *Engine) SubmitForTenant(
+	ctx context.Context,
+	tenant string,
+	priority int,
+	fn TaskFunc,
+	arg interface{}) (*Task, error) {
+
+	if e.tenants == nil {
+		return nil, ErrTenantsNotEnabled
+	}
+	return e.submit(ctx, priority, fn, arg, nil, func(item common.QItem) error {
+		return e.tenants.pushForTenant(tenant, item)
+	}, false)
+}
+
+func (e *Engine) submit(
+	ctx context.Context,
+	priority int,
+	fn TaskFunc,
+	arg interface{},
+	onComplete func(result interface{}, err error),
+	push func(common.QItem) error,
+	recycle bool) (*Task, error) {
+
+	select {
+	case <-e.closeChan:
+		e.onRejected(priority, ErrAlreadyClosed)
+		return nil, ErrAlreadyClosed
+	default:
+		admitted, err := e.admit(ctx, priority, arg)
+		if err != nil {
+			return nil, err
+		}
+		// counted first, as a worker may take it right after it is pushed
+		task, item := e.prepare(ctx, admitted, fn, arg, onComplete, push, recycle)
+		e.track(task)
+
+		err = e.pushTask(task, item)
+		if err != nil {
+			e.withdraw(task, err)
+			e.onRejected(item.Priority, err)
+			return nil, err
+		}
+		e.onEnqueued(item.Priority)
+		if e.maxWorkers > 0 {
+			e.maybeGrow()
+		}
+		return task, nil
+	}
+}
+
+// prepare creates the task of a submission, and the item to queue for it
+func (e *Engine) prepare(
+	ctx context.Context,
+	priority int,
+	fn TaskFunc,
+	arg interface{},
+	onComplete func(result interface{}, err error),
+	push func(common.QItem) error,
+	recycle bool) (*Task, common.QItem) {
+
+	if e.deadlineOrder {
+		priority = 0
+	}
+	id := e.nextID()
+	var span Span
+	if e.tracer != nil {
+		ctx, span = e.tracer.Start(ctx, SpanTask, priority)
+	}
+	task := newTask(ctx, priority, e.wrap(fn), arg, recycle)
+	task.id = id
+	task.span = span
+	task.engine = e
+	task.push = push
+	task.onComplete = onComplete
+	if e.sampler.Sample() {
+		task.enqueuedAt = time.Now()
+	}
+	if e.maxQueueWait > 0 {
+		task.expiry = time.AfterFunc(e.maxQueueWait, func() { e.expire(task) })
+	}
+
+	item := common.QItem{ID: id, Priority: priority, Payload: task}
+	if deadline, ok := ctx.Deadline(); ok {
+		item.Deadline = deadline.UnixNano()
+	}
+	return task, item
+}
+
+// withdraw undoes `prepare`, for a task which can't be queued because of `err`
+func (e *Engine) withdraw(task *Task, err error) {
+	e.untrack(task)
+	if task.expiry != nil {
+		task.expiry.Stop()
+	}
+	if task.span != nil {
+		task.span.End(err)
+	}
+}
+
+// nextID returns the ID for a new submission
+func (e *Engine) nextID() uint64 {
+	// increment first
+	// if crash/error, at most we lost 1 ID (out of 2^64, which basically is nothing)
+	return atomic.AddUint64(&e.lastID, 1)
+}
+
+// Len returns the number of submitted tasks not yet taken by any worker
+func (e *Engine) Len() int {
+	return int(atomic.LoadInt64(&e.queued))
+}
+
+// DeclareDependency tells the engine that `waiter` waits for `dependency` to finish.
+//
+// If `dependency` is still queued with a lower priority than `waiter`,
+// it is boosted to `waiter`'s priority, together with whatever it depends on,
+// so a high priority task never waits behind low priority ones (priority inversion).
+// Later boosts of `waiter` are passed on to `dependency` too.
+//
+// It requires the queue to implement `common.PriorityUpdater`,
+// else `ErrPriorityUpdateNotSupported` is returned.
+func (e *Engine) DeclareDependency(waiter, dependency *Task) error {
+	e.Lock()
+	defer e.Unlock()
+	waiter.dependencies = append(waiter.dependencies, dependency)
+	return e.boostLocked(dependency, waiter.priority)
+}
+
+func (e *Engine) boostLocked(task *Task, priority int) error {
+	if task.priority >= priority {
+		return nil
+	}
+	if atomic.LoadInt32(&task.inQueue) == 1 {
+		updater, ok := e.queue().(common.PriorityUpdater)
+		if !ok {
+			return ErrPriorityUpdateNotSupported
+		}
+		err := updater.UpdatePriority(task.id, priority)
+		if err == common.ErrItemNotFound {
+			// already popped by a worker, nothing to boost anymore
+			return nil
+		}
+		if err == common.ErrNotSupported {
+			// a wrapping queue, whose wrapped one can't update it
+			return ErrPriorityUpdateNotSupported
+		}
+		if err != nil {
+			return err
+		}
+	}
+	task.priority = priority
+	for _, dependency := range task.dependencies {
+		if err := e.boostLocked(dependency, priority); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Escalate moves a queued `task` up to `newPriority`, e.g. to push a stuck job ahead during an incident.
+// Just like `DeclareDependency`, whatever it depends on is boosted too.
+// If `newPriority` is not higher than its current one, nothing changes.
+//
+// It returns `ErrTaskAlreadyStarted` if a worker has already taken it,
+// or `ErrTaskAlreadyCompleted` if it is completed (e.g. cancelled).
+// It requires the queue to implement `common.PriorityUpdater`,
+// else `ErrPriorityUpdateNotSupported` is returned.
+func (e *Engine) Escalate(task *Task, newPriority int) error {
+	if newPriority < 0 {
+		return common.ErrPriorityOutOfRange
+	}
+	if _, ok := e.queue().(common.PriorityUpdater); !ok {
+		return ErrPriorityUpdateNotSupported
+	}
+
+	e.Lock()
+	defer e.Unlock()
+	if atomic.LoadInt32(&task.completed) == 1 {
+		return ErrTaskAlreadyCompleted
+	}
+	if atomic.LoadInt32(&task.inQueue) == 0 {
+		return ErrTaskAlreadyStarted
+	}
+	if task.priority >= newPriority {
+		return nil
+	}
+	if err := e.boostLocked(task, newPriority); err != nil {
+		return err
+	}
+	if task.priority != newPriority {
+		// popped, e.g. into a worker buffer, but not yet run
+		return ErrTaskAlreadyStarted
+	}
+	return nil
+}
+
+// AvgQueueWait returns the moving average of how long
+// (sampled) tasks wait in the queue before being taken by a worker
+func (e *Engine) AvgQueueWait() time.Duration {
+	return e.queueWait.get()
+}
+
+// Pressure returns a score in [0, 1], of how loaded the engine is.
+// Upstream layers (e.g. http middleware) can use this to throttle before the queue is full.
+//
+// It is the highest of:
+//
+// 1. queue fill ratio, if the queue has `Len() int` and `Cap() int` (as built-in ones do)
+//
+// 2. how much recent queue wait rises above its long-term average
+// (twice the average or more gives 1)
+//
+// 3. ratio of workers currently running a task (out of the max, with `WithMaxWorkers`)
+//
+// We take the highest, because any of them reaching 1 already means tasks are gonna wait.
+func (e *Engine) Pressure() float64 {
+	workers := e.maxWorkers
+	if workers == 0 {
+		workers = atomic.LoadInt32(&e.numOfWorker)
+	}
+	pressure := float64(atomic.LoadInt32(&e.busyWorker)) / float64(workers)
+
+	if q, ok := e.queue().(interface {
+		Len() int
+		Cap() int
+	}); ok && q.Cap() > 0 {
+		if fill := float64(q.Len()) / float64(q.Cap()); fill > pressure {
+			pressure = fill
+		}
+	}
+
+	if avg := e.queueWait.get(); avg > 0 {
+		trend := float64(e.queueWaitRecent.get()-avg) / float64(avg)
+		if trend > pressure {
+			pressure = trend
+		}
+	}
+
+	if pressure > 1 {
+		pressure = 1
+	}
+	return pressure
+}
+
+// Pause stops workers from taking new tasks, e.g. for maintenance or throttling,
+// while submits are still queued. Tasks already taken by workers,
+// including those batched with `WithLocalBatch`, still run.
+// `CloseGracefully` waits for `Resume`, as queued tasks can't be taken before that.
+//
+// It returns `ErrPauseNotSupported` if the queue does not implement `common.Pauser`.
+func (e *Engine) Pause() error {
+	e.swapMu.Lock()
+	defer e.swapMu.Unlock()
+	pauser, ok := e.queue().(common.Pauser)
+	if !ok {
+		return ErrPauseNotSupported
+	}
+	pauser.Pause()
+	e.paused = true
+	return nil
+}
+
+// Resume lets workers take tasks again after `Pause`.
+//
+// It returns `ErrPauseNotSupported` if the queue does not implement `common.Pauser`.
+func (e *Engine) Resume() error {
+	e.swapMu.Lock()
+	defer e.swapMu.Unlock()
+	pauser, ok := e.queue().(common.Pauser)
+	if !ok {
+		return ErrPauseNotSupported
+	}
+	pauser.Resume()
+	e.paused = false
+	return nil
+}
+
+// Close is the same as CloseNow
+func (e *Engine) Close() {
+	e.CloseNow()
+}
+
+// CloseNow closes the instance, and all background goroutine worker
+//
+// Subsequent request will be rejected.
+// Tasks still in the queue are dropped, and their `Result()` returns `ErrAlreadyClosed`,
+// while running ones are left to finish.
+func (e *Engine) CloseNow() {
+	e.closeOnce.Do(e.closeSubmissions)
+	atomic.StoreInt32(&e.closedNow, 1)
+	e.waitSwap()
+	e.drainQueue()
+	e.queue().Close()
+	e.dropHeld()
+}
+
+// drainQueue drops all items left in the queue, see `CloseNow`
+func (e *Engine) drainQueue() {
+	if drainer, ok := e.queue().(common.Drainer); ok {
+		for _, item := range drainer.Drain() {
+			e.drop(item)
+		}
+	}
+	if pauser, ok := e.queue().(common.Pauser); ok {
+		// else pops below wait
+		pauser.Resume()
+	}
+	// once closed gracefully, pops only return the items left, without waiting for new ones
+	e.queue().CloseGracefully()
+	for {
+		item, err := e.queue().PopOrWaitTillClose()
+		if err != nil {
+			return
+		}
+		e.drop(item)
+	}
+}
+
+// closeSubmissions rejects subsequent request,
+// and stops adding workers, see `maybeGrow`.
+func (e *Engine) closeSubmissions() {
+	e.scaleMu.Lock()
+	close(e.closeChan)
+	e.scaleMu.Unlock()
+}
+
+// CloseGracefully rejects subsequent request,
+// but lets workers finish all tasks already in the queue.
+// It returns after all background goroutine worker have exited.
+//
+// It is fine to call CloseNow from another goroutine while waiting,
+// e.g. if draining takes too long.
+func (e *Engine) CloseGracefully() {
+	e.beginCloseGracefully()
+	e.waitWorkers()
+}
+
+// beginCloseGracefully rejects subsequent request, and lets the queue drain,
+// without waiting for the workers, see `CloseGracefully`
+func (e *Engine) beginCloseGracefully() {
+	e.closeOnce.Do(e.closeSubmissions)
+	e.waitSwap()
+	e.queue().CloseGracefully()
+}
+
+// waitWorkers waits until all background goroutine worker have exited
+func (e *Engine) waitWorkers() {
+	e.workersWg.Wait()
+}
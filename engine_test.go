@@ -1,79 +1,643 @@
-package prioritize
-
-import (
-	"context"
-	"testing"
-
-	"github.com/aarondwi/prioritize/fair"
-)
-
-func TestPrioritizeEngine(t *testing.T) {
-	fq, _ := fair.NewFairQueue(2048, 16)
-	engine, err := New(fq, 5)
-	if err != nil {
-		t.Fatalf("It should not error, because all are correct parameters, instead we got %v", err)
-	}
-
-	val := 1
-	fn := func(ctx context.Context, arg interface{}) (interface{}, error) {
-		return val + 1, nil
-	}
-
-	task, err := engine.Submit(
-		context.Background(), 1, fn, nil)
-
-	result, err := task.Result()
-	if err != nil {
-		t.Fatalf("It should be nil, because we return so, but it is not")
-	}
-	if result.(int) != 2 {
-		t.Fatalf("Expected 2, received %d", result.(int))
-	}
-
-	engine.Close()
-}
-
-func TestPriorityEngineCtxFinished(t *testing.T) {
-	fq, _ := fair.NewFairQueue(2048, 16)
-	engine, err := New(fq, 5)
-	if err != nil {
-		t.Fatalf("It should not error, because all are correct parameters, instead we got %v", err)
-	}
-
-	val := 1
-	fn := func(ctx context.Context, arg interface{}) (interface{}, error) {
-		return val + 1, nil
-	}
-
-	ctxCancelled, cancelFunc := context.WithCancel(
-		context.Background())
-	cancelFunc()
-	task, err := engine.Submit(ctxCancelled, 1, fn, nil)
-
-	_, err = task.Result()
-	if err == nil || err != ErrCtxAlreadyCancelled {
-		t.Fatalf("It should not be nil, because context already cancelled, instead we got %v", err)
-	}
-
-	engine.Close()
-}
-
-func TestSubmitCallAfterClose(t *testing.T) {
-	fq, _ := fair.NewFairQueue(2048, 16)
-	engine, err := New(fq, 5)
-	if err != nil {
-		t.Fatalf("It should not error, because all are correct parameters, instead we got %v", err)
-	}
-
-	val := 1
-	fn := func(ctx context.Context, arg interface{}) (interface{}, error) {
-		return val + 1, nil
-	}
-	engine.Close()
-
-	_, err = engine.Submit(context.Background(), 1, fn, nil)
-
-	if err == nil || err != ErrAlreadyClosed {
-		t.Fatalf("It should not be nil, because context already cancelled, instead we got %v", err)
-	}
-}
+package prioritize
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/edf"
+	"github.com/aarondwi/prioritize/fair"
+	"github.com/aarondwi/prioritize/mlfq"
+	"github.com/aarondwi/prioritize/priority"
+	"github.com/aarondwi/prioritize/timepolicy"
+)
+
+func TestPrioritizeEngine(t *testing.T) {
+	fq, _ := fair.NewFairQueue(2048, 16)
+	engine, err := New(fq, 5)
+	if err != nil {
+		t.Fatalf("It should not error, because all are correct parameters, instead we got %v", err)
+	}
+
+	val := 1
+	fn := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		return val + 1, nil
+	}
+
+	task, err := engine.Submit(
+		context.Background(), 1, fn, nil)
+
+	result, err := task.Result()
+	if err != nil {
+		t.Fatalf("It should be nil, because we return so, but it is not")
+	}
+	if result.(int) != 2 {
+		t.Fatalf("Expected 2, received %d", result.(int))
+	}
+	if engine.Len() != 0 {
+		t.Fatalf("Task already done, so none should be pending, but we got %d", engine.Len())
+	}
+
+	engine.Close()
+}
+
+func TestPriorityEngineCtxFinished(t *testing.T) {
+	fq, _ := fair.NewFairQueue(2048, 16)
+	engine, err := New(fq, 5)
+	if err != nil {
+		t.Fatalf("It should not error, because all are correct parameters, instead we got %v", err)
+	}
+
+	val := 1
+	fn := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		return val + 1, nil
+	}
+
+	ctxCancelled, cancelFunc := context.WithCancel(
+		context.Background())
+	cancelFunc()
+	task, err := engine.Submit(ctxCancelled, 1, fn, nil)
+
+	_, err = task.Result()
+	if err == nil || err != ErrCtxAlreadyCancelled {
+		t.Fatalf("It should not be nil, because context already cancelled, instead we got %v", err)
+	}
+
+	engine.Close()
+}
+
+func TestSubmitCallAfterClose(t *testing.T) {
+	fq, _ := fair.NewFairQueue(2048, 16)
+	engine, err := New(fq, 5)
+	if err != nil {
+		t.Fatalf("It should not error, because all are correct parameters, instead we got %v", err)
+	}
+
+	val := 1
+	fn := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		return val + 1, nil
+	}
+	engine.Close()
+
+	_, err = engine.Submit(context.Background(), 1, fn, nil)
+
+	if err == nil || err != ErrAlreadyClosed {
+		t.Fatalf("It should not be nil, because context already cancelled, instead we got %v", err)
+	}
+}
+
+func TestEngineCloseGracefully(t *testing.T) {
+	fq, _ := fair.NewFairQueue(2048, 16)
+	engine, err := New(fq, 2)
+	if err != nil {
+		t.Fatalf("It should not error, because all are correct parameters, instead we got %v", err)
+	}
+
+	fn := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		time.Sleep(10 * time.Millisecond)
+		return arg, nil
+	}
+
+	tasks := make([]*Task, 0, 10)
+	for i := 0; i < 10; i++ {
+		task, err := engine.Submit(context.Background(), i%16, fn, i)
+		if err != nil {
+			t.Fatalf("It should not error, because not closed yet, instead we got %v", err)
+		}
+		tasks = append(tasks, task)
+	}
+
+	engine.CloseGracefully()
+
+	_, err = engine.Submit(context.Background(), 1, fn, nil)
+	if err == nil || err != ErrAlreadyClosed {
+		t.Fatalf("It should be error, because already closed, instead we got %v", err)
+	}
+
+	for i, task := range tasks {
+		result, err := task.Result()
+		if err != nil {
+			t.Fatalf("Queued task should still be done on graceful close, instead we got %v", err)
+		}
+		if result.(int) != i {
+			t.Fatalf("Expected %d, received %d", i, result.(int))
+		}
+	}
+}
+
+func TestEngineTelemetrySampling(t *testing.T) {
+	fq, _ := fair.NewFairQueue(2048, 16)
+	_, err := New(fq, 1, WithTelemetrySampling(0))
+	if err == nil || err != common.ErrParamShouldBePositive {
+		t.Fatalf("It should error, cause sampling rate can't be zero, instead we got %v", err)
+	}
+
+	engine, err := New(fq, 1, WithTelemetrySampling(2))
+	if err != nil {
+		t.Fatalf("It should not error, because all are correct parameters, instead we got %v", err)
+	}
+	fn := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		time.Sleep(50 * time.Millisecond)
+		return nil, nil
+	}
+
+	// the first task is not sampled, the second one waits for the first
+	first, _ := engine.Submit(context.Background(), 1, fn, nil)
+	second, _ := engine.Submit(context.Background(), 1, fn, nil)
+	first.Result()
+	second.Result()
+
+	if engine.AvgQueueWait() < 30*time.Millisecond {
+		t.Fatalf("Sampled task waits for around 50ms, but the average is %v", engine.AvgQueueWait())
+	}
+	engine.Close()
+}
+
+func TestEnginePressure(t *testing.T) {
+	// priority 1 only allows 1 pop, so the rest stays in the queue
+	pq, _ := priority.NewPriorityQueue(4, 2, priority.WithRateLimit(1, 0.001, 1))
+	engine, _ := New(pq, 1)
+	if engine.Pressure() != 0 {
+		t.Fatalf("Nothing is running yet, but pressure is %f", engine.Pressure())
+	}
+
+	fn := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		return nil, nil
+	}
+	task, _ := engine.Submit(context.Background(), 1, fn, nil)
+	task.Result()
+	engine.Submit(context.Background(), 1, fn, nil)
+	engine.Submit(context.Background(), 1, fn, nil)
+
+	if engine.Pressure() != 0.5 {
+		t.Fatalf("Queue is half full, and no worker is busy, but pressure is %f", engine.Pressure())
+	}
+	engine.Close()
+
+	fq, _ := fair.NewFairQueue(2048, 16)
+	engine, _ = New(fq, 1)
+	started := make(chan bool)
+	gate := make(chan bool)
+	engine.Submit(context.Background(), 0,
+		func(ctx context.Context, arg interface{}) (interface{}, error) {
+			started <- true
+			<-gate
+			return nil, nil
+		}, nil)
+	<-started
+	if engine.Pressure() != 1 {
+		t.Fatalf("The only worker is busy, but pressure is %f", engine.Pressure())
+	}
+	close(gate)
+	engine.CloseGracefully()
+}
+
+func TestEngineDeclareDependency(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	engine, _ := New(pq, 1)
+
+	started := make(chan bool)
+	gate := make(chan bool)
+	engine.Submit(context.Background(), 0,
+		func(ctx context.Context, arg interface{}) (interface{}, error) {
+			started <- true
+			<-gate
+			return nil, nil
+		}, nil)
+	<-started
+
+	mu := sync.Mutex{}
+	order := make([]string, 0, 3)
+	fn := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		mu.Lock()
+		order = append(order, arg.(string))
+		mu.Unlock()
+		return nil, nil
+	}
+	waiter, _ := engine.Submit(context.Background(), 5, fn, "waiter")
+	other, _ := engine.Submit(context.Background(), 2, fn, "other")
+	dependency, _ := engine.Submit(context.Background(), 1, fn, "dependency")
+
+	err := engine.DeclareDependency(waiter, dependency)
+	if err != nil {
+		t.Fatalf("It should not error, cause priority queue supports updating priority, instead we got %v", err)
+	}
+
+	close(gate)
+	waiter.Result()
+	other.Result()
+	dependency.Result()
+	if order[1] != "dependency" {
+		t.Fatalf("Dependency should inherit the waiter's priority, but the order is %v", order)
+	}
+
+	// already done, nothing to boost
+	err = engine.DeclareDependency(waiter, other)
+	if err != nil {
+		t.Fatalf("It should not error, cause nothing to boost, instead we got %v", err)
+	}
+	engine.Close()
+}
+
+func TestEngineEscalate(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	engine, _ := New(pq, 1)
+	defer engine.Close()
+
+	started := make(chan bool)
+	gate := make(chan bool)
+	running, _ := engine.Submit(context.Background(), 0,
+		func(ctx context.Context, arg interface{}) (interface{}, error) {
+			started <- true
+			<-gate
+			return nil, nil
+		}, nil)
+	<-started
+
+	mu := sync.Mutex{}
+	order := make([]string, 0, 2)
+	fn := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		mu.Lock()
+		order = append(order, arg.(string))
+		mu.Unlock()
+		return nil, nil
+	}
+	other, _ := engine.Submit(context.Background(), 3, fn, "other")
+	stuck, _ := engine.Submit(context.Background(), 1, fn, "stuck")
+
+	if err := engine.Escalate(stuck, -1); !errors.Is(err, common.ErrPriorityOutOfRange) {
+		t.Fatalf("It should error, cause the priority is negative, instead we got %v", err)
+	}
+	if err := engine.Escalate(stuck, 6); err != nil {
+		t.Fatalf("It should not error, cause the task is still queued, instead we got %v", err)
+	}
+	if stuck.Priority() != 6 {
+		t.Fatalf("Expected priority 6, but instead we got %d", stuck.Priority())
+	}
+	if err := engine.Escalate(running, 7); err == nil || err != ErrTaskAlreadyStarted {
+		t.Fatalf("It should error, cause the task is running, instead we got %v", err)
+	}
+
+	close(gate)
+	other.Result()
+	stuck.Result()
+	if order[0] != "stuck" {
+		t.Fatalf("The escalated task should go first, but the order is %v", order)
+	}
+	if err := engine.Escalate(stuck, 7); err == nil || err != ErrTaskAlreadyCompleted {
+		t.Fatalf("It should error, cause the task is completed, instead we got %v", err)
+	}
+
+	engine, _ = NewEDF(2048, 1)
+	defer engine.Close()
+	task, _ := engine.Submit(context.Background(), 0, fn, "unsupported")
+	if err := engine.Escalate(task, 1); err == nil || err != ErrPriorityUpdateNotSupported {
+		t.Fatalf("It should error, cause edf queue can't update priority, instead we got %v", err)
+	}
+
+	// a wrapping queue updates priority, only if the queue it wraps does
+	eq, _ := edf.NewEDFQueue(2048)
+	tq, _ := timepolicy.New(eq, []timepolicy.Window{{Start: 0, End: time.Hour, Adjust: func(p int) int { return p }}})
+	engine, _ = New(tq, 1)
+	defer engine.Close()
+	block := make(chan struct{})
+	engine.Submit(context.Background(), 0, func(ctx context.Context, arg interface{}) (interface{}, error) {
+		<-block
+		return nil, nil
+	}, nil)
+	task, _ = engine.Submit(context.Background(), 0, fn, "wrapped")
+	if err := engine.Escalate(task, 1); err == nil || err != ErrPriorityUpdateNotSupported {
+		t.Fatalf("It should error, cause the wrapped edf queue can't update priority, instead we got %v", err)
+	}
+	close(block)
+}
+
+func TestEngineEDF(t *testing.T) {
+	_, err := NewEDF(0, 1)
+	if err == nil || err != common.ErrParamShouldBePositive {
+		t.Fatalf("It should error, cause sizeLimit can't be zero, instead we got %v", err)
+	}
+	engine, err := NewEDF(2048, 1)
+	if err != nil {
+		t.Fatalf("It should not error, because all are correct parameters, instead we got %v", err)
+	}
+
+	// keep the only worker busy, so the others queue up
+	block := make(chan struct{})
+	engine.Submit(context.Background(), 0, func(ctx context.Context, arg interface{}) (interface{}, error) {
+		<-block
+		return nil, nil
+	}, nil)
+	for engine.Len() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	var mu sync.Mutex
+	order := []int{}
+	fn := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		mu.Lock()
+		order = append(order, arg.(int))
+		mu.Unlock()
+		return nil, nil
+	}
+	tasks := []*Task{}
+	// higher priority, but no deadline, so it is last
+	task, _ := engine.Submit(context.Background(), 100, fn, 3)
+	tasks = append(tasks, task)
+	for i, d := range []time.Duration{time.Hour, time.Minute} {
+		ctx, cancel := context.WithTimeout(context.Background(), d)
+		defer cancel()
+		task, _ = engine.Submit(ctx, 0, fn, 2-i)
+		tasks = append(tasks, task)
+	}
+
+	close(block)
+	for _, task := range tasks {
+		task.Result()
+	}
+	for i, v := range order {
+		if v != i+1 {
+			t.Fatalf("It should run by nearest deadline, but instead we got %v", order)
+		}
+	}
+	engine.Close()
+}
+
+func TestEngineYieldWithMLFQ(t *testing.T) {
+	m, _ := mlfq.NewMLFQ(2048, 3, 10*time.Millisecond)
+	engine, _ := New(m, 1)
+
+	var mu sync.Mutex
+	order := []string{}
+	runs := 0
+	long := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		mu.Lock()
+		order = append(order, "long")
+		runs++
+		done := runs == 3
+		mu.Unlock()
+		if !done {
+			// use up the whole quantum, then yield
+			time.Sleep(15 * time.Millisecond)
+			return nil, ErrYield
+		}
+		return "long", nil
+	}
+	short := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		mu.Lock()
+		order = append(order, "short")
+		mu.Unlock()
+		return "short", nil
+	}
+
+	longTask, _ := engine.Submit(context.Background(), 0, long, nil)
+	time.Sleep(5 * time.Millisecond)
+	shortTask, _ := engine.Submit(context.Background(), 0, short, nil)
+
+	if result, err := longTask.Result(); err != nil || result.(string) != "long" {
+		t.Fatalf("Expected long, but instead we got %v and %v", result, err)
+	}
+	shortTask.Result()
+	if len(order) != 4 || order[1] != "short" {
+		t.Fatalf("Demoted long task should give way to the short one, but instead we got %v", order)
+	}
+	engine.Close()
+
+	// without requeue support, ErrYield is just the error
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	engine, _ = New(pq, 1)
+	task, _ := engine.Submit(context.Background(), 0, func(ctx context.Context, arg interface{}) (interface{}, error) {
+		return nil, ErrYield
+	}, nil)
+	if _, err := task.Result(); err != ErrYield {
+		t.Fatalf("It should return ErrYield, cause the queue can't requeue, but instead we got %v", err)
+	}
+	engine.Close()
+}
+
+func TestEngineSubmitWithCallback(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	engine, _ := New(pq, 1)
+	defer engine.Close()
+
+	type outcome struct {
+		result interface{}
+		err    error
+	}
+	outcomes := make(chan outcome, 2)
+	onComplete := func(result interface{}, err error) {
+		outcomes <- outcome{result, err}
+	}
+
+	errFailing := errors.New("failing")
+	engine.SubmitWithCallback(context.Background(), 0,
+		func(ctx context.Context, arg interface{}) (interface{}, error) {
+			return arg, nil
+		}, 1, onComplete)
+	engine.SubmitWithCallback(context.Background(), 0,
+		func(ctx context.Context, arg interface{}) (interface{}, error) {
+			return arg, errFailing
+		}, 2, onComplete)
+
+	if o := <-outcomes; o.err != nil || o.result.(int) != 1 {
+		t.Fatalf("Expected 1, but instead we got %v and %v", o.result, o.err)
+	}
+	if o := <-outcomes; o.err != errFailing || o.result != nil {
+		t.Fatalf("Expected errFailing and no result, just like Result(), but instead we got %v and %v", o.result, o.err)
+	}
+}
+
+func TestEngineSubmitOrWait(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(1, 8)
+	engine, _ := New(pq, 1)
+
+	started := make(chan bool)
+	gate := make(chan bool)
+	engine.Submit(context.Background(), 0,
+		func(ctx context.Context, arg interface{}) (interface{}, error) {
+			started <- true
+			<-gate
+			return nil, nil
+		}, nil)
+	<-started
+
+	fn := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		return arg, nil
+	}
+	// fills the queue, as the only worker is busy
+	_, err := engine.Submit(context.Background(), 1, fn, 1)
+	if err != nil {
+		t.Fatalf("It should not error, cause there is still a slot, instead we got %v", err)
+	}
+	_, err = engine.Submit(context.Background(), 1, fn, 2)
+	if !errors.Is(err, common.ErrQueueIsFull) {
+		t.Fatalf("It should return ErrQueueIsFull, instead we got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = engine.SubmitOrWait(ctx, 1, fn, 2)
+	if err == nil || err != context.DeadlineExceeded {
+		t.Fatalf("It should return context.DeadlineExceeded, cause the queue stays full, instead we got %v", err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(gate)
+	}()
+	task, err := engine.SubmitOrWait(context.Background(), 1, fn, 3)
+	if err != nil {
+		t.Fatalf("It should wait for a slot, instead we got %v", err)
+	}
+	res, err := task.Result()
+	if err != nil || res.(int) != 3 {
+		t.Fatalf("Expected result 3, but instead we got %v and %v", res, err)
+	}
+	engine.Close()
+}
+
+func TestEngineCloseCompletesQueuedTasks(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	// edf can't drain, so its items are popped instead
+	eq, _ := edf.NewEDFQueue(2048)
+	for _, q := range []common.QInterface{pq, eq} {
+		engine, _ := New(q, 1)
+		gate := make(chan bool)
+		fn := func(ctx context.Context, arg interface{}) (interface{}, error) {
+			<-gate
+			return arg, nil
+		}
+		running, _ := engine.Submit(context.Background(), 0, fn, 0)
+		for engine.Len() != 0 {
+			time.Sleep(time.Millisecond)
+		}
+		tasks := make([]*Task, 0, 10)
+		for i := 1; i <= 10; i++ {
+			task, _ := engine.Submit(context.Background(), i%8, fn, i)
+			tasks = append(tasks, task)
+		}
+
+		engine.Close()
+		for _, task := range tasks {
+			_, err := task.Result()
+			if err == nil || err != ErrAlreadyClosed {
+				t.Fatalf("It should return ErrAlreadyClosed, cause the task is still queued on close, instead we got %v", err)
+			}
+		}
+		if engine.Len() != 0 {
+			t.Fatalf("Expected no task left, but instead we got %d", engine.Len())
+		}
+
+		close(gate)
+		result, err := running.Result()
+		if err != nil || result.(int) != 0 {
+			t.Fatalf("Running task should be left to finish, but instead we got %v and %v", result, err)
+		}
+	}
+}
+
+func TestEngineSubmitOrWaitReleasedByClose(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(1, 8)
+	engine, _ := New(pq, 1)
+	gate := make(chan bool)
+	defer close(gate)
+	fn := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		<-gate
+		return nil, nil
+	}
+	engine.Submit(context.Background(), 0, fn, nil)
+	for engine.Len() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	engine.Submit(context.Background(), 0, fn, nil)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		engine.Close()
+	}()
+	_, err := engine.SubmitOrWait(context.Background(), 0, fn, nil)
+	if err == nil || err != ErrAlreadyClosed {
+		t.Fatalf("It should return ErrAlreadyClosed, cause the engine is closed while waiting, instead we got %v", err)
+	}
+}
+
+func TestEngineReservedWorkers(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	_, err := New(pq, 2, WithReservedWorkers(2, 5))
+	if err == nil || err != ErrInvalidWorkerBounds {
+		t.Fatalf("It should error, cause no worker is left unreserved, instead we got %v", err)
+	}
+	fq, _ := fair.NewFairQueue(2048, 8)
+	_, err = New(fq, 2, WithReservedWorkers(1, 5))
+	if err == nil || err != ErrReservationNotSupported {
+		t.Fatalf("It should error, cause fair queue can't pop by priority, instead we got %v", err)
+	}
+	fq.Close()
+
+	engine, err := New(pq, 2, WithReservedWorkers(1, 5))
+	if err != nil {
+		t.Fatalf("It should not error, because all are correct parameters, instead we got %v", err)
+	}
+	defer engine.Close()
+
+	block := make(chan struct{})
+	slow := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		<-block
+		return arg, nil
+	}
+	fast := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		return arg, nil
+	}
+	// the unreserved worker takes 1, while the reserved one leaves the other queued
+	engine.Submit(context.Background(), 0, slow, 0)
+	engine.Submit(context.Background(), 0, slow, 1)
+	for engine.Len() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	urgent, _ := engine.Submit(context.Background(), 6, fast, 2)
+	if result, err := urgent.Result(); err != nil || result.(int) != 2 {
+		t.Fatalf("The reserved worker should run the urgent task, but instead we got %v and %v", result, err)
+	}
+	if engine.Len() != 1 {
+		t.Fatalf("The low priority task should still be queued, but instead Len is %d", engine.Len())
+	}
+	close(block)
+}
+
+func TestEnginePauseResume(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	engine, _ := New(pq, 1)
+	if err := engine.Pause(); err != nil {
+		t.Fatalf("It should not error, cause priority queue supports pausing, instead we got %v", err)
+	}
+
+	task, err := engine.Submit(context.Background(), 1,
+		func(ctx context.Context, arg interface{}) (interface{}, error) {
+			return arg, nil
+		}, 1)
+	if err != nil {
+		t.Fatalf("It should accept submits while paused, instead we got %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if engine.Len() != 1 {
+		t.Fatalf("The task should not be taken while paused, but instead Len is %d", engine.Len())
+	}
+
+	engine.Resume()
+	res, err := task.Result()
+	if err != nil || res.(int) != 1 {
+		t.Fatalf("Expected result 1, but instead we got %v and %v", res, err)
+	}
+	engine.Close()
+
+	m, _ := mlfq.NewMLFQ(16, 2, time.Second)
+	engine, _ = New(m, 1)
+	if err := engine.Pause(); err == nil || err != ErrPauseNotSupported {
+		t.Fatalf("It should return ErrPauseNotSupported, instead we got %v", err)
+	}
+	engine.Close()
+}
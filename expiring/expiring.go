@@ -0,0 +1,289 @@
+package expiring
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+)
+
+// Queue wraps another queue, dropping items which waited longer than `maxAge` when they are popped,
+// so stale work doesn't take a worker anymore.
+// Dropped items are reported to the `OnExpire` callback, if any.
+//
+// The age is counted from when the item is pushed into Queue, tracked by item ID,
+// as the wrapped queue may have its own use for `EnqueuedAt`.
+// Note that an `Engine` never completes the tasks of dropped items,
+// so with an `Engine`, use `prioritize.WithMaxQueueWait` instead.
+//
+// This struct is thread(goroutine)-safe, if the wrapped queue is.
+type Queue struct {
+	q        common.QInterface
+	maxAge   time.Duration
+	onExpire func(common.QItem)
+	now      func() time.Time
+
+	mu       sync.Mutex
+	pushedAt map[uint64]time.Time
+}
+
+// Option configures optional behavior of Queue
+type Option func(*Queue) error
+
+// OnExpire makes Queue call `fn` with each dropped item.
+// It is called from the popping goroutine, before the pop returns,
+// so it should be fast, and never call the queue itself.
+func OnExpire(fn func(item common.QItem)) Option {
+	return func(eq *Queue) error {
+		eq.onExpire = fn
+		return nil
+	}
+}
+
+// WithClock makes the Queue read the time from `now`, instead of `time.Now`.
+// Mainly for testing.
+func WithClock(now func() time.Time) Option {
+	return func(eq *Queue) error {
+		eq.now = now
+		return nil
+	}
+}
+
+// New creates Queue wrapping `q`, dropping items older than `maxAge`
+func New(q common.QInterface, maxAge time.Duration, opts ...Option) (*Queue, error) {
+	if maxAge <= 0 {
+		return nil, common.ErrParamShouldBePositive
+	}
+	eq := &Queue{
+		q:        q,
+		maxAge:   maxAge,
+		now:      time.Now,
+		pushedAt: make(map[uint64]time.Time),
+	}
+	for _, opt := range opts {
+		if err := opt(eq); err != nil {
+			return nil, err
+		}
+	}
+	return eq, nil
+}
+
+// expired forgets `item`, and reports it to the callback if it is too old
+func (eq *Queue) expired(item common.QItem, now time.Time) bool {
+	eq.mu.Lock()
+	pushedAt := eq.pushedAt[item.ID]
+	delete(eq.pushedAt, item.ID)
+	eq.mu.Unlock()
+
+	if now.Sub(pushedAt) <= eq.maxAge {
+		return false
+	}
+	if eq.onExpire != nil {
+		eq.onExpire(item)
+	}
+	return true
+}
+
+// PushOrError notes when the item is pushed, then pushes it into the wrapped queue
+func (eq *Queue) PushOrError(item common.QItem) error {
+	eq.mu.Lock()
+	eq.pushedAt[item.ID] = eq.now()
+	eq.mu.Unlock()
+
+	err := eq.q.PushOrError(item)
+	if err != nil {
+		eq.forget(item.ID)
+	}
+	return err
+}
+
+func (eq *Queue) forget(id uint64) {
+	eq.mu.Lock()
+	delete(eq.pushedAt, id)
+	eq.mu.Unlock()
+}
+
+// PushOrWaitCtx is the same as PushOrError, but waits for a slot while the wrapped queue is full,
+// if it implements `common.CtxPusher`, else it is the same as PushOrError.
+// The age is counted from when it starts waiting.
+func (eq *Queue) PushOrWaitCtx(ctx context.Context, item common.QItem) error {
+	pusher, ok := eq.q.(common.CtxPusher)
+	if !ok {
+		return eq.PushOrError(item)
+	}
+	eq.mu.Lock()
+	eq.pushedAt[item.ID] = eq.now()
+	eq.mu.Unlock()
+
+	err := pusher.PushOrWaitCtx(ctx, item)
+	if err != nil {
+		eq.forget(item.ID)
+	}
+	return err
+}
+
+// PopOrWaitTillClose pops from the wrapped queue, skipping expired items
+func (eq *Queue) PopOrWaitTillClose() (common.QItem, error) {
+	return eq.PopOrWaitCtx(context.Background())
+}
+
+// PopOrWaitCtx is the same as PopOrWaitTillClose, but also returns `ctx.Err()`
+// once `ctx` is done while waiting. If the wrapped queue does not implement
+// `common.CtxPopper`, it waits just like PopOrWaitTillClose.
+func (eq *Queue) PopOrWaitCtx(ctx context.Context) (common.QItem, error) {
+	ctxPopper, ok := eq.q.(common.CtxPopper)
+	for {
+		var item common.QItem
+		var err error
+		if ok {
+			item, err = ctxPopper.PopOrWaitCtx(ctx)
+		} else {
+			item, err = eq.q.PopOrWaitTillClose()
+		}
+		if err != nil {
+			return common.MinQItem, err
+		}
+		if !eq.expired(item, eq.now()) {
+			return item, nil
+		}
+	}
+}
+
+// TryPop pops from the wrapped queue without waiting, skipping expired items,
+// or returns `common.ErrNotSupported` if it does not implement `common.TryPopper`
+func (eq *Queue) TryPop() (common.QItem, error) {
+	popper, ok := eq.q.(common.TryPopper)
+	if !ok {
+		return common.MinQItem, common.ErrNotSupported
+	}
+	for {
+		item, err := popper.TryPop()
+		if err != nil {
+			return common.MinQItem, err
+		}
+		if !eq.expired(item, eq.now()) {
+			return item, nil
+		}
+	}
+}
+
+// Peek returns the item at the head of the wrapped queue without removing it,
+// or `common.ErrNotSupported` if the wrapped queue can't peek.
+// The item may be expired, in which case the next pop drops it instead.
+func (eq *Queue) Peek() (common.QItem, error) {
+	if q, ok := eq.q.(interface{ Peek() (common.QItem, error) }); ok {
+		return q.Peek()
+	}
+	return common.MinQItem, common.ErrNotSupported
+}
+
+// PopBatchOrWaitTillClose pops several items if the wrapped queue implements
+// `common.BatchPopper`, else only 1 item. Expired items are skipped,
+// and it only returns once at least 1 item is not expired.
+func (eq *Queue) PopBatchOrWaitTillClose(max int) ([]common.QItem, error) {
+	batchPopper, ok := eq.q.(common.BatchPopper)
+	if !ok {
+		item, err := eq.PopOrWaitTillClose()
+		if err != nil {
+			return nil, err
+		}
+		return []common.QItem{item}, nil
+	}
+
+	for {
+		items, err := batchPopper.PopBatchOrWaitTillClose(max)
+		if err != nil {
+			return nil, err
+		}
+		now := eq.now()
+		results := items[:0]
+		for _, item := range items {
+			if !eq.expired(item, now) {
+				results = append(results, item)
+			}
+		}
+		if len(results) > 0 {
+			return results, nil
+		}
+	}
+}
+
+// Remove takes out the item with `id` from the wrapped queue.
+// If the wrapped queue does not implement `common.Remover`,
+// it returns `common.ErrNotSupported`.
+func (eq *Queue) Remove(id uint64) (common.QItem, error) {
+	remover, ok := eq.q.(common.Remover)
+	if !ok {
+		return common.MinQItem, common.ErrNotSupported
+	}
+	item, err := remover.Remove(id)
+	if err == nil {
+		eq.forget(id)
+	}
+	return item, err
+}
+
+// Len returns the number of items in the wrapped queue, or 0 if it can't tell.
+// It includes expired items not popped yet.
+func (eq *Queue) Len() int {
+	if q, ok := eq.q.(interface{ Len() int }); ok {
+		return q.Len()
+	}
+	return 0
+}
+
+// Cap returns the capacity of the wrapped queue, or 0 if it can't tell
+func (eq *Queue) Cap() int {
+	if q, ok := eq.q.(interface{ Cap() int }); ok {
+		return q.Cap()
+	}
+	return 0
+}
+
+// DepthPerPriority returns the number of items in each priority of the wrapped queue,
+// or nil if it can't tell
+func (eq *Queue) DepthPerPriority() []int {
+	if q, ok := eq.q.(interface{ DepthPerPriority() []int }); ok {
+		return q.DepthPerPriority()
+	}
+	return nil
+}
+
+// WaitUntilEmpty waits until the wrapped queue holds no item, expired ones counting until a pop drops them.
+// It returns `common.ErrNotSupported` if the wrapped queue does not implement `common.EmptyWaiter`.
+func (eq *Queue) WaitUntilEmpty(ctx context.Context) error {
+	waiter, ok := eq.q.(common.EmptyWaiter)
+	if !ok {
+		return common.ErrNotSupported
+	}
+	return waiter.WaitUntilEmpty(ctx)
+}
+
+// Close closes the wrapped queue
+func (eq *Queue) Close() error {
+	return eq.q.Close()
+}
+
+// IsClosed returns whether the wrapped queue is closed,
+// or false if it does not implement `common.ClosedNotifier`
+func (eq *Queue) IsClosed() bool {
+	if notifier, ok := eq.q.(common.ClosedNotifier); ok {
+		return notifier.IsClosed()
+	}
+	return false
+}
+
+// Closed returns the channel of the wrapped queue closed once it is closed,
+// or nil if it does not implement `common.ClosedNotifier`
+func (eq *Queue) Closed() <-chan struct{} {
+	if notifier, ok := eq.q.(common.ClosedNotifier); ok {
+		return notifier.Closed()
+	}
+	return nil
+}
+
+// CloseGracefully closes the wrapped queue gracefully
+func (eq *Queue) CloseGracefully() {
+	eq.q.CloseGracefully()
+}
@@ -0,0 +1,130 @@
+package expiring
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/priority"
+	"github.com/aarondwi/prioritize/queuetest"
+)
+
+func TestNewErrors(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	_, err := New(pq, 0)
+	if err == nil || err != common.ErrParamShouldBePositive {
+		t.Fatalf("It should error, cause maxAge can't be zero, but instead we got %v", err)
+	}
+}
+
+func TestQueueSkipsExpiredItems(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	now := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	expired := []uint64{}
+	eq, err := New(pq, time.Minute,
+		WithClock(func() time.Time { return now }),
+		OnExpire(func(item common.QItem) { expired = append(expired, item.ID) }))
+	if err != nil {
+		t.Fatalf("It should not error, because all are correct parameters, but instead we got %v", err)
+	}
+
+	eq.PushOrError(common.QItem{ID: 1, Priority: 7})
+	eq.PushOrError(common.QItem{ID: 2, Priority: 6})
+	now = now.Add(30 * time.Second)
+	eq.PushOrError(common.QItem{ID: 3, Priority: 5})
+	eq.PushOrError(common.QItem{ID: 4, Priority: 4})
+	eq.PushOrError(common.QItem{ID: 5, Priority: 3})
+	now = now.Add(45 * time.Second)
+
+	item, err := eq.PopOrWaitTillClose()
+	if err != nil || item.ID != 3 {
+		t.Fatalf("It should skip ID 1 and 2, but instead we got %v and %v", item, err)
+	}
+	if len(expired) != 2 || expired[0] != 1 || expired[1] != 2 {
+		t.Fatalf("ID 1 and 2 should be reported as expired, but instead we got %v", expired)
+	}
+
+	now = now.Add(time.Minute)
+	eq.PushOrError(common.QItem{ID: 6, Priority: 0})
+	items, err := eq.PopBatchOrWaitTillClose(8)
+	if err != nil || len(items) != 1 || items[0].ID != 6 {
+		t.Fatalf("It should only return ID 6, but instead we got %v and %v", items, err)
+	}
+	if len(expired) != 4 {
+		t.Fatalf("ID 4 and 5 should be reported as expired too, but instead we got %v", expired)
+	}
+
+	eq.CloseGracefully()
+	_, err = eq.PopOrWaitTillClose()
+	if err == nil || err != common.ErrQueueIsClosed {
+		t.Fatalf("It should be closed after draining, but instead we got %v", err)
+	}
+}
+
+func TestQueuePopOrWaitCtx(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(16, 4)
+	eq, _ := New(pq, time.Minute)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := eq.PopOrWaitCtx(ctx)
+	if err == nil || err != context.DeadlineExceeded {
+		t.Fatalf("It should return context.DeadlineExceeded, cause the wrapped queue supports it, but instead we got %v", err)
+	}
+	eq.Close()
+}
+
+func TestQueueWaitUntilEmpty(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(16, 8)
+	eq, _ := New(pq, time.Minute)
+	eq.PushOrError(common.QItem{ID: 1, Priority: 1})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- eq.WaitUntilEmpty(context.Background())
+	}()
+	eq.PopOrWaitTillClose()
+	if err := <-done; err != nil {
+		t.Fatalf("It should return once the wrapped queue is empty, but instead we got %v", err)
+	}
+
+	// hides the methods of pq not in common.QInterface
+	hidden, _ := New(struct{ common.QInterface }{pq}, time.Minute)
+	if err := hidden.WaitUntilEmpty(context.Background()); err == nil || err != common.ErrNotSupported {
+		t.Fatalf("It should return ErrNotSupported, cause the wrapped queue can't wait, but instead we got %v", err)
+	}
+}
+
+func TestQueueConformance(t *testing.T) {
+	queuetest.Run(t, func(sizeLimit int) (common.ExtendedQInterface, error) {
+		pq, err := priority.NewPriorityQueue(sizeLimit, 8)
+		if err != nil {
+			return nil, err
+		}
+		return New(pq, time.Minute)
+	})
+}
+
+func TestQueueExtendedQInterfaceUnsupportedByWrappedQueue(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	// hides the methods of pq not in common.QInterface
+	hidden, _ := New(struct{ common.QInterface }{pq}, time.Minute)
+	if _, err := hidden.TryPop(); err == nil || err != common.ErrNotSupported {
+		t.Fatalf("It should return ErrNotSupported, cause the wrapped queue can't try to pop, but instead we got %v", err)
+	}
+	if _, err := hidden.Peek(); err == nil || err != common.ErrNotSupported {
+		t.Fatalf("It should return ErrNotSupported, cause the wrapped queue can't peek, but instead we got %v", err)
+	}
+}
+
+func TestQueueRemoveUnsupportedByWrappedQueue(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	// hides the methods of pq not in common.QInterface
+	eq, _ := New(struct{ common.QInterface }{pq}, time.Minute)
+	eq.PushOrError(common.QItem{ID: 1, Priority: 4})
+	if _, err := eq.Remove(1); err == nil || err != common.ErrNotSupported {
+		t.Fatalf("It should return ErrNotSupported, cause the wrapped queue can't remove, but instead we got %v", err)
+	}
+	eq.Close()
+}
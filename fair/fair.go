@@ -1,182 +1,1280 @@
-package fair
-
-import (
-	"sync"
-
-	"github.com/aarondwi/prioritize/common"
-	"github.com/aarondwi/prioritize/linkedslice"
-)
-
-// FairQueue is a queue in which
-// each priority gets a chance to return value,
-// starting from first item put going downwards,
-// and then rolled back from highest.
-//
-// This behavior allows some starvation prevention for lower priorities,
-// assuming that highest priority tasks have much lower number of tasks,
-// else it gonna be pretty much not useful, just like random/normal queue.
-//
-// Internally, we are using unbounded linkedslice.
-// But because we need size limits, we track it here
-type FairQueue struct {
-	// synchronization primitive
-	mu       *sync.Mutex
-	notEmpty *sync.Cond
-
-	// we separate number tracking from the priorityQueues
-	// so checking numberOfTasksInEachQueue just need 1 cache miss (putting into cpu L1 cache)
-	numberOfTasksInEachQueue []int
-
-	// we also create separate queues for each priority
-	// so it is simple to push/pop the item
-	queues []*linkedslice.LinkedSlice
-
-	// simple metadata
-	limitPriority             int
-	size                      int
-	sizeLimit                 int
-	currentPriorityToRetrieve int
-	running                   bool
-}
-
-// NewFairQueue creates our fair queue.
-//
-// It caps at sizeLimit, and allows priorirty [0,numOfPriority)
-func NewFairQueue(sizeLimit, numOfPriority int) (*FairQueue, error) {
-	if sizeLimit <= 0 || numOfPriority <= 0 {
-		return nil, common.ErrParamShouldBePositive
-	}
-
-	mu := &sync.Mutex{}
-	notEmpty := sync.NewCond(mu)
-
-	numberOfTasksInEachQueue := make([]int, numOfPriority)
-	queues := make([]*linkedslice.LinkedSlice, numOfPriority)
-
-	return &FairQueue{
-		mu:                        mu,
-		notEmpty:                  notEmpty,
-		numberOfTasksInEachQueue:  numberOfTasksInEachQueue,
-		queues:                    queues,
-		limitPriority:             numOfPriority,
-		size:                      0,
-		sizeLimit:                 sizeLimit,
-		currentPriorityToRetrieve: -1,
-		running:                   true,
-	}, nil
-}
-
-// PushOrError put the item into the fq, and returns error if no slot available
-func (fq *FairQueue) PushOrError(item common.QItem) error {
-	if item.Priority < 0 || item.Priority >= fq.limitPriority {
-		return common.ErrPriorityOutOfRange
-	}
-
-	fq.mu.Lock()
-	if !fq.running {
-		fq.mu.Unlock()
-		return common.ErrQueueIsClosed
-	}
-	if fq.size == fq.sizeLimit {
-		fq.mu.Unlock()
-		return common.ErrQueueIsFull
-	}
-
-	if fq.queues[item.Priority] == nil {
-		fq.queues[item.Priority] = linkedslice.NewLinkedSlice()
-	}
-	err := fq.queues[item.Priority].PushOrError(item)
-	// meaning already closed, cause linkedslices is unbounded
-	if err != nil {
-		fq.mu.Unlock()
-		return err
-	}
-
-	// The only item in the queue, set this to position
-	if fq.size == 0 {
-		fq.currentPriorityToRetrieve = item.Priority
-	}
-
-	// update the tracker too
-	fq.numberOfTasksInEachQueue[item.Priority]++
-	fq.size++
-
-	fq.notEmpty.Signal()
-	fq.mu.Unlock()
-	return nil
-}
-
-// PopOrWaitTillClose returns 1 QItem from fq, or waits if none exists
-func (fq *FairQueue) PopOrWaitTillClose() (common.QItem, error) {
-	fq.mu.Lock()
-	if !fq.running {
-		fq.mu.Unlock()
-		return common.MinQItem, common.ErrQueueIsClosed
-	}
-
-	for fq.size == 0 {
-		fq.notEmpty.Wait()
-		// double check, ensuring see the changes after wait call
-		if !fq.running {
-			fq.mu.Unlock()
-			return common.MinQItem, common.ErrQueueIsClosed
-		}
-	}
-
-	// if we wait blindly, it gonna stuck
-	// but we are tracking it manually, ensuring it will never wait
-	qitem, err := fq.queues[fq.currentPriorityToRetrieve].PopOrWaitTillClose()
-	if err != nil {
-		// the only error possible here is closed already
-		// so we just continue it
-		fq.mu.Unlock()
-		return common.MinQItem, err
-	}
-	result := common.QItem{
-		ID:       qitem.ID,
-		Priority: fq.currentPriorityToRetrieve,
-	}
-	fq.numberOfTasksInEachQueue[fq.currentPriorityToRetrieve]--
-	fq.size--
-
-	if fq.size == 0 {
-		//fast path, no need to check rr.numberOfTasksInEachQueue
-		fq.currentPriorityToRetrieve = -1
-	} else {
-		// Check new rr.currentPosToRetrieve position, cause we still have item somewhere
-		newPos := -1
-		for i := fq.currentPriorityToRetrieve - 1; i >= 0; i-- {
-			if fq.numberOfTasksInEachQueue[i] > 0 {
-				newPos = i
-				break
-			}
-		}
-		// not yet found, meaning remaining items reside on higher index
-		// currentPriorityToRetrieve should be the last index to be checked
-		if newPos == -1 {
-			for i := fq.limitPriority - 1; i >= fq.currentPriorityToRetrieve; i-- {
-				if fq.numberOfTasksInEachQueue[i] > 0 {
-					newPos = i
-					break
-				}
-			}
-		}
-		fq.currentPriorityToRetrieve = newPos
-	}
-
-	fq.mu.Unlock()
-	return result, nil
-}
-
-// Close FairQueue, preventing it from accepting new request
-func (fq *FairQueue) Close() {
-	fq.mu.Lock()
-	fq.running = false
-	for i := 0; i < fq.limitPriority; i++ {
-		if fq.queues[i] != nil {
-			fq.queues[i].Close()
-		}
-	}
-	fq.notEmpty.Broadcast()
-	fq.mu.Unlock()
-}
+package fair
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/linkedslice"
+)
+
+// FairQueue is a queue in which
+// each priority gets a chance to return value,
+// starting from first item put going downwards,
+// and then rolled back from highest
+// (see `WithAscendingRotation` and `WithStartPriority` to change this).
+//
+// This behavior allows some starvation prevention for lower priorities,
+// assuming that highest priority tasks have much lower number of tasks,
+// else it gonna be pretty much not useful, just like random/normal queue.
+//
+// Internally, we are using unbounded linkedslice.
+// But because we need size limits, we track it here
+type FairQueue struct {
+	// synchronization primitive
+	// read-only calls (e.g. Len) only take the read lock,
+	// so they don't contend with each other
+	mu       *sync.RWMutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	// broadcast once the size reaches 0, see `WaitUntilEmpty`
+	emptied *sync.Cond
+
+	// we separate number tracking from the priorityQueues
+	// so checking numberOfTasksInEachQueue just need 1 cache miss (putting into cpu L1 cache)
+	numberOfTasksInEachQueue []int
+
+	// we also create separate queues for each priority
+	// so it is simple to push/pop the item
+	queues []*linkedslice.LinkedSlice
+
+	// simple metadata
+	limitPriority             int
+	size                      int
+	sizeLimit                 int
+	currentPriorityToRetrieve int
+	running                   bool
+	closed                    chan struct{}
+	draining                  bool
+	paused                    bool
+
+	// see `WithResumeRotation`, `WithAscendingRotation`, and `WithStartPriority`
+	resumeRotation bool
+	ascending      bool
+	startPriority  int
+
+	// global FIFO mode, see `WithGlobalFIFO`
+	globalFIFO       bool
+	servedInRound    []bool
+	lastEnqueuedTime int64
+
+	// nil means the priority is not rate-limited
+	rateLimiters []*common.TokenBucket
+
+	// see `WithLIFO`
+	lifo bool
+
+	// longest queue first mode, see `WithLongestQueueFirst`.
+	// skipped[p] is how many pops in a row passed over priority p while it had items
+	longestFirst bool
+	maxSkips     int
+	skipped      []int
+
+	// nil means no early drop, see `WithEarlyDrop`
+	earlyDrop *common.EarlyDrop
+	// nil means no callback, see `WithWatermarks`
+	watermarks *common.Watermarks
+
+	// once size reaches reservedFrom, only priorities >= reservedMinPriority are admitted,
+	// see `WithReservedHeadroom`
+	reservedFrom        int
+	reservedMinPriority int
+
+	// bands[p] is where items pushed with priority p are queued,
+	// see `RemapPriorities`
+	bands []int
+}
+
+// Option configures optional behavior of FairQueue
+type Option func(*FairQueue) error
+
+// WithGlobalFIFO changes how priorities are ordered inside one rotation.
+//
+// Each non-empty priority still gets exactly one pop per rotation,
+// but instead of going downwards from the first item put,
+// the priority whose head item was enqueued earliest goes first.
+// This bounds the worst-case wait of any item to about one rotation,
+// regardless of how the priorities are distributed.
+func WithGlobalFIFO() Option {
+	return func(fq *FairQueue) error {
+		fq.globalFIFO = true
+		return nil
+	}
+}
+
+// WithResumeRotation makes the rotation continue where it left off
+// when the queue gets items again after being empty.
+//
+// By default, the rotation restarts from the priority of the first item put
+// into the empty queue, which favors whichever priority bursts first.
+// With this, the priority next in line before the queue emptied is served first instead,
+// giving stricter fairness in the long run.
+func WithResumeRotation() Option {
+	return func(fq *FairQueue) error {
+		fq.resumeRotation = true
+		return nil
+	}
+}
+
+// WithAscendingRotation makes the rotation go upwards from the first item put,
+// and then roll back from the lowest, instead of going downwards.
+func WithAscendingRotation() Option {
+	return func(fq *FairQueue) error {
+		fq.ascending = true
+		return nil
+	}
+}
+
+// WithStartPriority makes the rotation always start from `priority`
+// (or the next non-empty one in rotation order) when the queue gets items after being empty,
+// instead of from the priority of the first item put.
+//
+// Combined with `WithResumeRotation`, it only applies to the very first rotation.
+func WithStartPriority(priority int) Option {
+	return func(fq *FairQueue) error {
+		if priority < 0 || priority >= fq.limitPriority {
+			return common.ErrPriorityOutOfRange
+		}
+		fq.startPriority = priority
+		return nil
+	}
+}
+
+// WithLongestQueueFirst changes how the next priority is picked.
+//
+// Instead of taking turns, the priority with the most items queued goes next,
+// so a backed-up priority drains faster than the others.
+// But once a non-empty priority is passed over `maxSkips` pops in a row,
+// it goes next regardless of its length, so no priority is starved.
+// Ties go to the higher priority.
+func WithLongestQueueFirst(maxSkips int) Option {
+	return func(fq *FairQueue) error {
+		if maxSkips <= 0 {
+			return common.ErrParamShouldBePositive
+		}
+		fq.longestFirst = true
+		fq.maxSkips = maxSkips
+		fq.skipped = make([]int, fq.limitPriority)
+		return nil
+	}
+}
+
+// WithLIFO makes each priority return its newest item first, instead of its oldest.
+//
+// Under overload, the oldest items are the most likely to have missed their deadline already,
+// so serving the newest first gets more requests done in time.
+// It only changes the order inside a priority, the rotation stays the same
+// (with `WithGlobalFIFO`, still by the oldest item of each priority).
+func WithLIFO() Option {
+	return func(fq *FairQueue) error {
+		fq.lifo = true
+		return nil
+	}
+}
+
+// WithEarlyDrop makes pushes below `minPriority` probabilistically rejected
+// with `common.ErrQueueIsFull` once the queue is more than `threshold` (in [0, 1)) full,
+// rejecting more the fuller it is, so higher priorities always find room.
+// See `common.EarlyDrop`.
+func WithEarlyDrop(threshold float64, minPriority int) Option {
+	return func(fq *FairQueue) error {
+		ed, err := common.NewEarlyDrop(threshold, minPriority)
+		if err != nil {
+			return err
+		}
+		fq.earlyDrop = ed
+		return nil
+	}
+}
+
+// WithReservedHeadroom keeps the last `fraction` (in [0, 1]) of the capacity
+// for priorities >= `minPriority`. Lower priorities get `common.ErrQueueIsFull` once the rest is used,
+// so a flood of them can't stop urgent items from being queued.
+func WithReservedHeadroom(fraction float64, minPriority int) Option {
+	return func(fq *FairQueue) error {
+		if fraction < 0 || fraction > 1 {
+			return common.ErrParamShouldBePositive
+		}
+		fq.reservedFrom = fq.sizeLimit - int(math.Ceil(fraction*float64(fq.sizeLimit)))
+		fq.reservedMinPriority = minPriority
+		return nil
+	}
+}
+
+// WithRateLimit limits how many items of `priority` can be popped,
+// to `ratePerSecond` with bursts up to `burst` items.
+//
+// While its bucket is empty, the priority is skipped in the rotation.
+func WithRateLimit(priority int, ratePerSecond float64, burst int) Option {
+	return func(fq *FairQueue) error {
+		if priority < 0 || priority >= fq.limitPriority {
+			return common.ErrPriorityOutOfRange
+		}
+		tb, err := common.NewTokenBucket(ratePerSecond, burst)
+		if err != nil {
+			return err
+		}
+		fq.rateLimiters[priority] = tb
+		return nil
+	}
+}
+
+// WithWatermarks calls `onHigh` once the queue holds `high` items,
+// and `onLow` once it then goes down to `low` (in [0, high)) items,
+// e.g. to pause ingestion upstream and resume it later. See `common.Watermarks`.
+//
+// Both are called while holding the queue lock, right as the size changes,
+// so they should be fast (e.g. flipping a flag), and never call the queue itself.
+func WithWatermarks(high, low int, onHigh, onLow func(size int)) Option {
+	return func(fq *FairQueue) error {
+		w, err := common.NewWatermarks(high, low, onHigh, onLow)
+		if err != nil {
+			return err
+		}
+		fq.watermarks = w
+		return nil
+	}
+}
+
+// NewFairQueue creates our fair queue.
+//
+// It caps at sizeLimit, and allows priorirty [0,numOfPriority)
+func NewFairQueue(sizeLimit, numOfPriority int, opts ...Option) (*FairQueue, error) {
+	if sizeLimit <= 0 || numOfPriority <= 0 {
+		return nil, common.ErrParamShouldBePositive
+	}
+
+	mu := &sync.RWMutex{}
+	notEmpty := sync.NewCond(mu)
+	notFull := sync.NewCond(mu)
+
+	numberOfTasksInEachQueue := make([]int, numOfPriority)
+	queues := make([]*linkedslice.LinkedSlice, numOfPriority)
+
+	fq := &FairQueue{
+		mu:                        mu,
+		notEmpty:                  notEmpty,
+		notFull:                   notFull,
+		emptied:                   sync.NewCond(mu),
+		numberOfTasksInEachQueue:  numberOfTasksInEachQueue,
+		queues:                    queues,
+		limitPriority:             numOfPriority,
+		size:                      0,
+		sizeLimit:                 sizeLimit,
+		reservedFrom:              sizeLimit,
+		currentPriorityToRetrieve: -1,
+		startPriority:             -1,
+		running:                   true,
+		closed:                    make(chan struct{}),
+		servedInRound:             make([]bool, numOfPriority),
+		rateLimiters:              make([]*common.TokenBucket, numOfPriority),
+		bands:                     identityBands(numOfPriority),
+	}
+	for _, opt := range opts {
+		if err := opt(fq); err != nil {
+			return nil, err
+		}
+	}
+	return fq, nil
+}
+
+// PushOrError put the item into the fq, and returns error if no slot available
+func (fq *FairQueue) PushOrError(item common.QItem) error {
+	fq.mu.Lock()
+	err := fq.admitLocked(item)
+	if err == nil {
+		err = fq.pushLocked(item)
+	}
+	if err != nil {
+		err = fq.queueErrorLocked("PushOrError", item, err)
+	}
+	fq.mu.Unlock()
+	return err
+}
+
+// PushBatchOrError pushes `items` in order, only taking the lock once.
+// It stops at the first item which can't be pushed, returning how many are pushed, and its error.
+func (fq *FairQueue) PushBatchOrError(items []common.QItem) (int, error) {
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+	for i, item := range items {
+		err := fq.admitLocked(item)
+		if err == nil {
+			err = fq.pushLocked(item)
+		}
+		if err != nil {
+			return i, fq.queueErrorLocked("PushBatchOrError", item, err)
+		}
+	}
+	return len(items), nil
+}
+
+// PushOrWaitTillClose put the item into the fq, waiting while no slot is available for it,
+// instead of returning `common.ErrQueueIsFull`, so producers get backpressure.
+// It returns `common.ErrQueueIsClosed` if fq is closed in the meantime.
+func (fq *FairQueue) PushOrWaitTillClose(item common.QItem) error {
+	return fq.PushOrWaitCtx(context.Background(), item)
+}
+
+// PushOrWaitCtx is the same as PushOrWaitTillClose,
+// but also returns `ctx.Err()` once `ctx` is done while waiting for a slot
+func (fq *FairQueue) PushOrWaitCtx(ctx context.Context, item common.QItem) error {
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+	err := fq.admitLocked(item)
+	if err == common.ErrQueueIsFull {
+		defer common.WakeOnDone(ctx, fq.notFull)()
+	}
+	for err == common.ErrQueueIsFull {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		fq.notFull.Wait()
+		err = fq.admitLocked(item)
+	}
+	if err == nil {
+		err = fq.pushLocked(item)
+	}
+	if err != nil {
+		return fq.queueErrorLocked("PushOrWaitCtx", item, err)
+	}
+	return nil
+}
+
+// admitLocked returns the error pushing `item` should fail with, if any
+func (fq *FairQueue) admitLocked(item common.QItem) error {
+	// checked under the lock, as the number of priorities can change, see `SetNumOfPriority`
+	if item.Priority < 0 || item.Priority >= fq.limitPriority {
+		return common.ErrPriorityOutOfRange
+	}
+	if !fq.running || fq.draining {
+		return common.ErrQueueIsClosed
+	}
+	if fq.size == fq.sizeLimit {
+		return common.ErrQueueIsFull
+	}
+	if fq.size >= fq.reservedFrom && item.Priority < fq.reservedMinPriority {
+		return common.ErrQueueIsFull
+	}
+	if fq.earlyDrop != nil && fq.earlyDrop.Reject(item.Priority, fq.size, fq.sizeLimit) {
+		return common.ErrQueueIsFull
+	}
+	return nil
+}
+
+// queueErrorLocked adds what fq looks like right now to `err`, see `common.QueueError`
+func (fq *FairQueue) queueErrorLocked(op string, item common.QItem, err error) error {
+	return &common.QueueError{Op: op, Priority: item.Priority, Size: fq.size, Limit: fq.sizeLimit, Err: err}
+}
+
+// PushOrEvict is like PushOrError, but if fq is full, it makes room by evicting
+// the oldest item of the lowest non-empty priority, and returns it together with true.
+// If that priority is not lower than `item`'s, nothing is evicted,
+// and it returns `common.ErrQueueIsFull`.
+//
+// Reserved headroom and early drop are not checked, as the caller chose to evict instead.
+func (fq *FairQueue) PushOrEvict(item common.QItem) (common.QItem, bool, error) {
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+	if item.Priority < 0 || item.Priority >= fq.limitPriority {
+		return common.MinQItem, false, fq.queueErrorLocked("PushOrEvict", item, common.ErrPriorityOutOfRange)
+	}
+	if !fq.running || fq.draining {
+		return common.MinQItem, false, fq.queueErrorLocked("PushOrEvict", item, common.ErrQueueIsClosed)
+	}
+
+	evicted, ok := common.MinQItem, false
+	if fq.size == fq.sizeLimit {
+		lowest := 0
+		for fq.numberOfTasksInEachQueue[lowest] == 0 {
+			lowest++
+		}
+		if lowest >= fq.bands[item.Priority] {
+			return common.MinQItem, false, fq.queueErrorLocked("PushOrEvict", item, common.ErrQueueIsFull)
+		}
+		// the queue is not closed, and it has items, so this never fails
+		evicted, _ = fq.queues[lowest].PopOrWaitTillClose()
+		fq.numberOfTasksInEachQueue[lowest]--
+		fq.size--
+		fq.fixRotationPositionLocked()
+		ok = true
+	}
+	if err := fq.pushLocked(item); err != nil {
+		return common.MinQItem, false, fq.queueErrorLocked("PushOrEvict", item, err)
+	}
+	return evicted, ok, nil
+}
+
+// pushLocked enqueues `item`, after all admission checks are passed
+func (fq *FairQueue) pushLocked(item common.QItem) error {
+	// strictly increasing, so global FIFO order is never ambiguous
+	item.EnqueuedAt = time.Now().UnixNano()
+	if item.EnqueuedAt <= fq.lastEnqueuedTime {
+		item.EnqueuedAt = fq.lastEnqueuedTime + 1
+	}
+	fq.lastEnqueuedTime = item.EnqueuedAt
+
+	band := fq.bands[item.Priority]
+	err := fq.enqueueLocked(band, item)
+	// meaning already closed, cause linkedslices is unbounded
+	if err != nil {
+		return err
+	}
+
+	// The only item in the queue, set this to position,
+	// unless we resume from where the rotation left off
+	if fq.size == 0 && !(fq.resumeRotation && fq.currentPriorityToRetrieve != -1) {
+		fq.currentPriorityToRetrieve = band
+		if fq.startPriority != -1 {
+			fq.currentPriorityToRetrieve = fq.bands[fq.startPriority]
+		}
+	}
+	fq.size++
+	fq.sizeChangedLocked()
+
+	fq.notEmpty.Signal()
+	return nil
+}
+
+// PopOrWaitTillClose returns 1 QItem from fq, or waits if none exists
+func (fq *FairQueue) PopOrWaitTillClose() (common.QItem, error) {
+	return fq.PopOrWaitCtx(context.Background())
+}
+
+// PopOrWaitCtx is the same as PopOrWaitTillClose,
+// but also returns `ctx.Err()` once `ctx` is done while waiting
+func (fq *FairQueue) PopOrWaitCtx(ctx context.Context) (common.QItem, error) {
+	fq.mu.Lock()
+	priorityToRetrieve, err := fq.waitForAllowedPriorityLocked(ctx)
+	if err != nil {
+		fq.mu.Unlock()
+		return common.MinQItem, err
+	}
+	result, err := fq.takeLocked(priorityToRetrieve)
+	if err != nil {
+		fq.mu.Unlock()
+		return common.MinQItem, err
+	}
+	if fq.draining && fq.size == 0 {
+		fq.closeLocked()
+	}
+	fq.mu.Unlock()
+	return result, nil
+}
+
+// TryPop is the non-blocking version of PopOrWaitTillClose.
+// It returns `common.ErrQueueIsEmpty` right away if no item can be popped now,
+// including when fq is paused, or all remaining items are rate-limited.
+func (fq *FairQueue) TryPop() (common.QItem, error) {
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+	if !fq.running {
+		return common.MinQItem, common.ErrQueueIsClosed
+	}
+	if fq.size == 0 || fq.paused {
+		return common.MinQItem, common.ErrQueueIsEmpty
+	}
+	priorityToRetrieve, _ := fq.nextAllowedPriority(time.Now())
+	if priorityToRetrieve == -1 {
+		return common.MinQItem, common.ErrQueueIsEmpty
+	}
+	result, err := fq.takeLocked(priorityToRetrieve)
+	if err != nil {
+		return common.MinQItem, err
+	}
+	if fq.draining && fq.size == 0 {
+		fq.closeLocked()
+	}
+	return result, nil
+}
+
+// Peek returns the oldest item (or the newest, with WithLIFO) of the highest non-empty priority,
+// without removing it, or `common.ErrQueueIsEmpty` if fq is empty.
+//
+// As fq rotates between priorities, the next pop may return an item from another priority.
+// Peek does not predict the rotation, so it does not change which priority is served next.
+func (fq *FairQueue) Peek() (common.QItem, error) {
+	fq.mu.RLock()
+	defer fq.mu.RUnlock()
+	if !fq.running {
+		return common.MinQItem, common.ErrQueueIsClosed
+	}
+	for i := fq.limitPriority - 1; i >= 0; i-- {
+		if fq.numberOfTasksInEachQueue[i] == 0 {
+			continue
+		}
+		var item common.QItem
+		var ok bool
+		if fq.lifo {
+			item, ok = fq.queues[i].PeekNewest()
+		} else {
+			item, ok = fq.queues[i].Peek()
+		}
+		if ok {
+			// same as takeLocked, the priority may differ, see `RemapPriorities`
+			item.Priority = i
+			return item, nil
+		}
+	}
+	return common.MinQItem, common.ErrQueueIsEmpty
+}
+
+// PopBatchOrWaitTillClose waits like PopOrWaitTillClose,
+// and then returns up to `max` items in the same order as popping them one by one,
+// only taking the lock once.
+func (fq *FairQueue) PopBatchOrWaitTillClose(max int) ([]common.QItem, error) {
+	fq.mu.Lock()
+	priorityToRetrieve, err := fq.waitForAllowedPriorityLocked(context.Background())
+	if err != nil {
+		fq.mu.Unlock()
+		return nil, err
+	}
+	results := make([]common.QItem, 0, max)
+	for priorityToRetrieve != -1 {
+		result, err := fq.takeLocked(priorityToRetrieve)
+		if err != nil {
+			fq.mu.Unlock()
+			return nil, err
+		}
+		results = append(results, result)
+		if len(results) == max || fq.size == 0 {
+			break
+		}
+		priorityToRetrieve, _ = fq.nextAllowedPriority(time.Now())
+	}
+	if fq.draining && fq.size == 0 {
+		fq.closeLocked()
+	}
+	fq.mu.Unlock()
+	return results, nil
+}
+
+// waitForAllowedPriorityLocked waits until there is an item which can be popped,
+// and returns its priority, or returns error if fq is closed, or `ctx` is done, in the meantime.
+func (fq *FairQueue) waitForAllowedPriorityLocked(ctx context.Context) (int, error) {
+	if !fq.running {
+		return -1, common.ErrQueueIsClosed
+	}
+
+	var stop func()
+	defer func() {
+		if stop != nil {
+			stop()
+		}
+	}()
+	priorityToRetrieve := -1
+	for priorityToRetrieve == -1 {
+		for fq.size == 0 || fq.paused {
+			if fq.draining && fq.size == 0 {
+				fq.closeLocked()
+				return -1, common.ErrQueueIsClosed
+			}
+			if err := ctx.Err(); err != nil {
+				return -1, err
+			}
+			if stop == nil {
+				stop = common.WakeOnDone(ctx, fq.notEmpty)
+			}
+			fq.notEmpty.Wait()
+			// double check, ensuring see the changes after wait call
+			if !fq.running {
+				return -1, common.ErrQueueIsClosed
+			}
+		}
+
+		var delay time.Duration
+		priorityToRetrieve, delay = fq.nextAllowedPriority(time.Now())
+		if priorityToRetrieve == -1 {
+			// all remaining items are rate-limited
+			if err := ctx.Err(); err != nil {
+				return -1, err
+			}
+			if stop == nil {
+				stop = common.WakeOnDone(ctx, fq.notEmpty)
+			}
+			fq.waitFor(delay)
+			if !fq.running {
+				return -1, common.ErrQueueIsClosed
+			}
+		}
+	}
+	return priorityToRetrieve, nil
+}
+
+// takeLocked pops 1 item of `priorityToRetrieve`, which should not be empty,
+// and moves the rotation position forward
+func (fq *FairQueue) takeLocked(priorityToRetrieve int) (common.QItem, error) {
+	// if we wait blindly, it gonna stuck
+	// but we are tracking it manually, ensuring it will never wait
+	var qitem common.QItem
+	var err error
+	if fq.lifo {
+		qitem, err = fq.queues[priorityToRetrieve].PopNewestOrWaitTillClose()
+	} else {
+		qitem, err = fq.queues[priorityToRetrieve].PopOrWaitTillClose()
+	}
+	if err != nil {
+		// the only error possible here is closed already
+		// so we just continue it
+		return common.MinQItem, err
+	}
+	// keep all fields, only the priority may differ, see `RemapPriorities`
+	result := qitem
+	result.Priority = priorityToRetrieve
+	fq.numberOfTasksInEachQueue[priorityToRetrieve]--
+	fq.size--
+	fq.sizeChangedLocked()
+	fq.notFull.Broadcast()
+	fq.currentPriorityToRetrieve = priorityToRetrieve
+
+	if fq.size == 0 && fq.resumeRotation {
+		// remember the next one in line, to resume from there
+		fq.currentPriorityToRetrieve = fq.rotate(priorityToRetrieve, 1)
+	} else if fq.size == 0 {
+		//fast path, no need to check rr.numberOfTasksInEachQueue
+		fq.currentPriorityToRetrieve = -1
+	} else {
+		// Check new rr.currentPosToRetrieve position, cause we still have item somewhere.
+		// currentPriorityToRetrieve itself should be the last index to be checked
+		newPos := -1
+		for k := 1; k <= fq.limitPriority; k++ {
+			i := fq.rotate(fq.currentPriorityToRetrieve, k)
+			if fq.numberOfTasksInEachQueue[i] > 0 {
+				newPos = i
+				break
+			}
+		}
+		fq.currentPriorityToRetrieve = newPos
+	}
+
+	return result, nil
+}
+
+// sizeChangedLocked lets the watermarks, if any, see the new size,
+// and wakes those waiting for fq to be empty
+func (fq *FairQueue) sizeChangedLocked() {
+	if fq.size == 0 {
+		fq.emptied.Broadcast()
+	}
+	if fq.watermarks != nil {
+		fq.watermarks.Update(fq.size)
+	}
+}
+
+// rotate returns the priority `k` steps after `i` in rotation order,
+// which is downwards and rolled back from highest, or the reverse with `WithAscendingRotation`
+func (fq *FairQueue) rotate(i, k int) int {
+	if fq.ascending {
+		return (i + k) % fq.limitPriority
+	}
+	return ((i-k)%fq.limitPriority + fq.limitPriority) % fq.limitPriority
+}
+
+// nextAllowedPriority returns the next priority to pop based on the rotation mode
+func (fq *FairQueue) nextAllowedPriority(now time.Time) (int, time.Duration) {
+	if fq.longestFirst {
+		return fq.longestOrMostSkipped(now)
+	}
+	if fq.globalFIFO {
+		return fq.oldestNotYetServedInRound(now)
+	}
+	return fq.nextAllowedInRotation(now)
+}
+
+// longestOrMostSkipped returns the non-empty priority not rate-limited
+// which is passed over the most, if it reaches maxSkips, else the longest one.
+// If all of them are rate-limited, it returns -1 and how long until one is allowed.
+func (fq *FairQueue) longestOrMostSkipped(now time.Time) (int, time.Duration) {
+	longest, mostSkipped := -1, -1
+	delay := time.Duration(-1)
+	for i := fq.limitPriority - 1; i >= 0; i-- {
+		if fq.numberOfTasksInEachQueue[i] == 0 {
+			fq.skipped[i] = 0
+			continue
+		}
+		if d := fq.rateLimitDelay(i, now); d > 0 {
+			if delay == -1 || d < delay {
+				delay = d
+			}
+			continue
+		}
+		if longest == -1 || fq.numberOfTasksInEachQueue[i] > fq.numberOfTasksInEachQueue[longest] {
+			longest = i
+		}
+		if fq.skipped[i] >= fq.maxSkips &&
+			(mostSkipped == -1 || fq.skipped[i] > fq.skipped[mostSkipped]) {
+			mostSkipped = i
+		}
+	}
+	if longest == -1 {
+		return -1, delay
+	}
+
+	pos := longest
+	if mostSkipped != -1 {
+		pos = mostSkipped
+	}
+	for i := 0; i < fq.limitPriority; i++ {
+		if fq.numberOfTasksInEachQueue[i] > 0 && i != pos {
+			fq.skipped[i]++
+		}
+	}
+	fq.skipped[pos] = 0
+	fq.takeToken(pos)
+	return pos, 0
+}
+
+// nextAllowedInRotation returns the first non-empty priority which is not rate-limited,
+// in rotation order starting from currentPriorityToRetrieve.
+// If all of them are rate-limited, it returns -1 and how long until one is allowed.
+func (fq *FairQueue) nextAllowedInRotation(now time.Time) (int, time.Duration) {
+	delay := time.Duration(-1)
+	for k := 0; k < fq.limitPriority; k++ {
+		i := fq.rotate(fq.currentPriorityToRetrieve, k)
+		if fq.numberOfTasksInEachQueue[i] == 0 {
+			continue
+		}
+		d := fq.rateLimitDelay(i, now)
+		if d == 0 {
+			fq.takeToken(i)
+			return i, 0
+		}
+		if delay == -1 || d < delay {
+			delay = d
+		}
+	}
+	return -1, delay
+}
+
+// oldestNotYetServedInRound returns the non-empty priority whose head item
+// is the oldest, among those not yet served in this rotation and not rate-limited,
+// and marks it as served.
+// If all of them are rate-limited, it returns -1 and how long until one is allowed.
+func (fq *FairQueue) oldestNotYetServedInRound(now time.Time) (int, time.Duration) {
+	for {
+		pos := -1
+		delay := time.Duration(-1)
+		anyServed := false
+		var oldest int64
+		for i := 0; i < fq.limitPriority; i++ {
+			if fq.numberOfTasksInEachQueue[i] == 0 {
+				continue
+			}
+			if d := fq.rateLimitDelay(i, now); d > 0 {
+				if delay == -1 || d < delay {
+					delay = d
+				}
+				continue
+			}
+			if fq.servedInRound[i] {
+				anyServed = true
+				continue
+			}
+			head, _ := fq.queues[i].Peek()
+			if pos == -1 || head.EnqueuedAt < oldest {
+				pos = i
+				oldest = head.EnqueuedAt
+			}
+		}
+		if pos != -1 {
+			fq.takeToken(pos)
+			fq.servedInRound[pos] = true
+			return pos, 0
+		}
+		if !anyServed {
+			return -1, delay
+		}
+		// every allowed non-empty priority has been served, start a new rotation
+		for i := range fq.servedInRound {
+			fq.servedInRound[i] = false
+		}
+	}
+}
+
+// rateLimitDelay returns 0 if priority `i` can be popped at `now`,
+// else how long until it can be
+func (fq *FairQueue) rateLimitDelay(i int, now time.Time) time.Duration {
+	if fq.rateLimiters[i] == nil {
+		return 0
+	}
+	return fq.rateLimiters[i].Delay(now)
+}
+
+func (fq *FairQueue) takeToken(i int) {
+	if fq.rateLimiters[i] != nil {
+		fq.rateLimiters[i].Take()
+	}
+}
+
+// waitFor waits until signalled, or `d` has passed.
+// Just like fq.notEmpty.Wait(), fq.mu should be held when calling this.
+func (fq *FairQueue) waitFor(d time.Duration) {
+	timer := time.AfterFunc(d, func() {
+		fq.mu.Lock()
+		fq.notEmpty.Broadcast()
+		fq.mu.Unlock()
+	})
+	fq.notEmpty.Wait()
+	timer.Stop()
+}
+
+// RemapPriorities changes, at runtime, which band each priority is queued in.
+//
+// `mapping` receives the priority an item is pushed with,
+// and returns the band (also in [0, numOfPriority)) it should be queued and popped as.
+// Queued items are moved accordingly, keeping their push order,
+// and subsequent pushes follow the same mapping.
+//
+// For example, mapping priority 0-3 into 3 collapses those into 1 band,
+// and remapping later with an identity function splits them back,
+// because items still remember the priority they are pushed with.
+// `mapping` is called while holding the lock, so it should never call fq itself.
+func (fq *FairQueue) RemapPriorities(mapping func(priority int) int) error {
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+	if !fq.running {
+		return common.ErrQueueIsClosed
+	}
+
+	bands := make([]int, fq.limitPriority)
+	for i := range bands {
+		bands[i] = mapping(i)
+		if bands[i] < 0 || bands[i] >= fq.limitPriority {
+			return common.ErrPriorityOutOfRange
+		}
+	}
+
+	items := make([]common.QItem, 0, fq.size)
+	for i := 0; i < fq.limitPriority; i++ {
+		for ; fq.numberOfTasksInEachQueue[i] > 0; fq.numberOfTasksInEachQueue[i]-- {
+			// tracked manually, so never waits
+			item, _ := fq.queues[i].PopOrWaitTillClose()
+			items = append(items, item)
+		}
+	}
+	sort.SliceStable(items, func(a, b int) bool {
+		return items[a].EnqueuedAt < items[b].EnqueuedAt
+	})
+
+	fq.bands = bands
+	for _, item := range items {
+		fq.enqueueLocked(bands[item.Priority], item)
+	}
+	fq.fixRotationPositionLocked()
+	for i := range fq.servedInRound {
+		fq.servedInRound[i] = false
+	}
+	return nil
+}
+
+// AddPriorityLevel adds 1 priority above the current highest one,
+// and returns it, without recreating the queue.
+func (fq *FairQueue) AddPriorityLevel() (int, error) {
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+	if !fq.running {
+		return -1, common.ErrQueueIsClosed
+	}
+	fq.setNumOfPriorityLocked(fq.limitPriority + 1)
+	return fq.limitPriority - 1, nil
+}
+
+// SetNumOfPriority changes, at runtime, the allowed priorities to [0,n).
+//
+// Growing always succeeds, and the new priorities are queued as themselves,
+// joining the rotation.
+// Shrinking returns `common.ErrPriorityNotEmpty` if any removed priority still has items,
+// or `common.ErrPriorityOutOfRange` if a kept priority is remapped into a removed one
+// (see `RemapPriorities`, remap it first), or `WithStartPriority` is a removed one.
+// Items pushed with a removed priority, but remapped into a kept one, stay there as that one.
+func (fq *FairQueue) SetNumOfPriority(n int) error {
+	if n <= 0 {
+		return common.ErrParamShouldBePositive
+	}
+
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+	if !fq.running {
+		return common.ErrQueueIsClosed
+	}
+	if n < fq.limitPriority {
+		for band := n; band < fq.limitPriority; band++ {
+			if fq.numberOfTasksInEachQueue[band] > 0 {
+				return common.ErrPriorityNotEmpty
+			}
+		}
+		for p := 0; p < n; p++ {
+			if fq.bands[p] >= n {
+				return common.ErrPriorityOutOfRange
+			}
+		}
+		if fq.startPriority >= n {
+			return common.ErrPriorityOutOfRange
+		}
+	}
+	fq.setNumOfPriorityLocked(n)
+	return nil
+}
+
+// setNumOfPriorityLocked resizes everything kept per priority, and fixes the rotation position.
+// When shrinking, removed bands should already be empty.
+func (fq *FairQueue) setNumOfPriorityLocked(n int) {
+	for p := n; p < fq.limitPriority; p++ {
+		if band := fq.bands[p]; band < n {
+			fq.renamePrioritiesLocked(band, n)
+		}
+	}
+	for band := n; band < fq.limitPriority; band++ {
+		if fq.queues[band] != nil {
+			// gives back its memory to the pool
+			fq.queues[band].Compact()
+		}
+	}
+
+	if n < fq.limitPriority {
+		fq.numberOfTasksInEachQueue = fq.numberOfTasksInEachQueue[:n]
+		fq.queues = fq.queues[:n]
+		fq.rateLimiters = fq.rateLimiters[:n]
+		fq.bands = fq.bands[:n]
+		fq.servedInRound = fq.servedInRound[:n]
+		if fq.longestFirst {
+			fq.skipped = fq.skipped[:n]
+		}
+	}
+	for p := fq.limitPriority; p < n; p++ {
+		fq.numberOfTasksInEachQueue = append(fq.numberOfTasksInEachQueue, 0)
+		fq.queues = append(fq.queues, nil)
+		fq.rateLimiters = append(fq.rateLimiters, nil)
+		fq.bands = append(fq.bands, p)
+		fq.servedInRound = append(fq.servedInRound, false)
+		if fq.longestFirst {
+			fq.skipped = append(fq.skipped, 0)
+		}
+	}
+	fq.limitPriority = n
+	// waiting pushes may be for a removed priority
+	fq.notFull.Broadcast()
+
+	if fq.currentPriorityToRetrieve >= n {
+		// restart from where a rotation starts
+		fq.currentPriorityToRetrieve = n - 1
+		if fq.ascending {
+			fq.currentPriorityToRetrieve = 0
+		}
+		fq.fixRotationPositionLocked()
+	}
+}
+
+// renamePrioritiesLocked sets the priority of items in `band` pushed with a priority >= n to `band`,
+// so they don't refer to a removed priority anymore
+func (fq *FairQueue) renamePrioritiesLocked(band, n int) {
+	count := fq.numberOfTasksInEachQueue[band]
+	for i := 0; i < count; i++ {
+		// tracked manually, so never waits
+		item, _ := fq.queues[band].PopOrWaitTillClose()
+		if item.Priority >= n {
+			item.Priority = band
+		}
+		fq.queues[band].PushOrError(item)
+	}
+}
+
+// UpdatePriority moves the queued item with `id` to `newPriority`.
+// It is put behind the items already in the new priority's band.
+//
+// It is O(n) over the items in the old band, so it is meant for rare operations.
+func (fq *FairQueue) UpdatePriority(id uint64, newPriority int) error {
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+	if newPriority < 0 || newPriority >= fq.limitPriority {
+		return common.ErrPriorityOutOfRange
+	}
+	if !fq.running {
+		return common.ErrQueueIsClosed
+	}
+
+	for band := 0; band < fq.limitPriority; band++ {
+		if fq.numberOfTasksInEachQueue[band] == 0 {
+			continue
+		}
+		item, ok := fq.queues[band].Remove(id)
+		if !ok {
+			continue
+		}
+		fq.numberOfTasksInEachQueue[band]--
+		item.Priority = newPriority
+		fq.enqueueLocked(fq.bands[newPriority], item)
+		fq.fixRotationPositionLocked()
+		return nil
+	}
+	return common.ErrItemNotFound
+}
+
+// fixRotationPositionLocked moves the rotation position
+// to the next non-empty band, if items are moved out of its band.
+func (fq *FairQueue) fixRotationPositionLocked() {
+	if fq.size > 0 && fq.numberOfTasksInEachQueue[fq.currentPriorityToRetrieve] == 0 {
+		for k := 1; k < fq.limitPriority; k++ {
+			i := fq.rotate(fq.currentPriorityToRetrieve, k)
+			if fq.numberOfTasksInEachQueue[i] > 0 {
+				fq.currentPriorityToRetrieve = i
+				break
+			}
+		}
+	}
+}
+
+// Snapshot returns a copy of all items in fq without removing them,
+// e.g. for debugging (see `common.DebugDump`).
+// Items are grouped by priority, highest first, each in the order they would be popped,
+// while actual pops interleave the priorities by rotation. It is O(n).
+func (fq *FairQueue) Snapshot() []common.QItem {
+	fq.mu.RLock()
+	defer fq.mu.RUnlock()
+	results := make([]common.QItem, 0, fq.size)
+	for p := fq.limitPriority - 1; p >= 0; p-- {
+		if fq.numberOfTasksInEachQueue[p] == 0 {
+			continue
+		}
+		items := fq.queues[p].Snapshot()
+		if fq.lifo {
+			reverse(items)
+		}
+		for _, item := range items {
+			// popped with the band's priority, see `takeLocked`
+			item.Priority = p
+			results = append(results, item)
+		}
+	}
+	return results
+}
+
+// Drain removes and returns all items in fq at once, highest priority first,
+// e.g. to persist or requeue them elsewhere before calling Close.
+// Rate limits are not applied. It returns nil if fq is already closed.
+func (fq *FairQueue) Drain() []common.QItem {
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+	if !fq.running {
+		return nil
+	}
+
+	// draining is not a turn of the rotation
+	position := fq.currentPriorityToRetrieve
+	results := make([]common.QItem, 0, fq.size)
+	for p := fq.limitPriority - 1; p >= 0; p-- {
+		for fq.numberOfTasksInEachQueue[p] > 0 {
+			item, err := fq.takeLocked(p)
+			if err != nil {
+				return results
+			}
+			results = append(results, item)
+		}
+	}
+	if fq.resumeRotation {
+		fq.currentPriorityToRetrieve = position
+	}
+	if fq.draining {
+		fq.closeLocked()
+	}
+	return results
+}
+
+// Remove takes out the item with `id`, freeing its slot,
+// or returns `common.ErrItemNotFound` if it is not in the queue anymore.
+//
+// It is O(n) on the band of the item, see `linkedslice.LinkedSlice.Remove`.
+func (fq *FairQueue) Remove(id uint64) (common.QItem, error) {
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+	if !fq.running {
+		return common.MinQItem, common.ErrQueueIsClosed
+	}
+
+	for band := 0; band < fq.limitPriority; band++ {
+		if fq.numberOfTasksInEachQueue[band] == 0 {
+			continue
+		}
+		item, ok := fq.queues[band].Remove(id)
+		if !ok {
+			continue
+		}
+		fq.numberOfTasksInEachQueue[band]--
+		fq.size--
+		fq.sizeChangedLocked()
+		fq.notFull.Broadcast()
+		if fq.size == 0 {
+			if !fq.resumeRotation {
+				fq.currentPriorityToRetrieve = -1
+			}
+			if fq.draining {
+				fq.closeLocked()
+			}
+		} else {
+			fq.fixRotationPositionLocked()
+		}
+		return item, nil
+	}
+	return common.MinQItem, common.ErrItemNotFound
+}
+
+// enqueueLocked puts item into the internal queue of `band`, and tracks it.
+// It doesn't update fq.size, so callers can use it to move items too.
+func (fq *FairQueue) enqueueLocked(band int, item common.QItem) error {
+	if fq.queues[band] == nil {
+		fq.queues[band] = linkedslice.NewLinkedSlice()
+	}
+	err := fq.queues[band].PushOrError(item)
+	if err != nil {
+		return err
+	}
+	fq.numberOfTasksInEachQueue[band]++
+	return nil
+}
+
+// Compact releases memory held by the queue of each priority, see `linkedslice.CompactAll`.
+func (fq *FairQueue) Compact() {
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+	linkedslice.CompactAll(fq.queues)
+}
+
+// Len returns the number of items currently in the fq
+func (fq *FairQueue) Len() int {
+	fq.mu.RLock()
+	defer fq.mu.RUnlock()
+	return fq.size
+}
+
+// Cap returns the maximum number of items the fq can hold
+func (fq *FairQueue) Cap() int {
+	return fq.sizeLimit
+}
+
+// DepthPerPriority returns the number of items currently in each priority of the fq
+func (fq *FairQueue) DepthPerPriority() []int {
+	fq.mu.RLock()
+	defer fq.mu.RUnlock()
+	depths := make([]int, fq.limitPriority)
+	copy(depths, fq.numberOfTasksInEachQueue)
+	return depths
+}
+
+// Pause makes pops wait, without erroring, until Resume is called.
+// Pushes are still accepted in the meantime, and Drain still takes items.
+// After CloseGracefully, remaining items are still only popped once resumed.
+func (fq *FairQueue) Pause() {
+	fq.mu.Lock()
+	fq.paused = true
+	fq.mu.Unlock()
+}
+
+// Resume lets pops take items from fq again, waking those waiting because of Pause
+func (fq *FairQueue) Resume() {
+	fq.mu.Lock()
+	fq.paused = false
+	fq.notEmpty.Broadcast()
+	fq.mu.Unlock()
+}
+
+// Close is the same as CloseNow
+func (fq *FairQueue) Close() error {
+	return fq.CloseNow()
+}
+
+// CloseNow closes FairQueue, preventing it from accepting new request.
+// Remaining items are dropped, and waiting pops return immediately.
+// Closing it again does nothing, only returning `common.ErrQueueIsClosed`.
+func (fq *FairQueue) CloseNow() error {
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+	if !fq.running {
+		return common.ErrQueueIsClosed
+	}
+	fq.closeLocked()
+	return nil
+}
+
+// CloseGracefully stops FairQueue from accepting new request,
+// but pops keep returning the remaining items.
+// Once it is empty, it is closed the same way as CloseNow.
+func (fq *FairQueue) CloseGracefully() {
+	fq.mu.Lock()
+	if fq.running {
+		fq.draining = true
+		// waiting pushes should return now
+		fq.notFull.Broadcast()
+		if fq.size == 0 {
+			fq.closeLocked()
+		}
+	}
+	fq.mu.Unlock()
+}
+
+// WaitUntilEmpty waits until FairQueue holds no item, e.g. to know a burst of work is all popped,
+// and returns nil. It returns `common.ErrQueueIsClosed` if FairQueue is closed with items left,
+// or `ctx.Err()` once `ctx` is done while waiting.
+func (fq *FairQueue) WaitUntilEmpty(ctx context.Context) error {
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+	if fq.size > 0 {
+		defer common.WakeOnDone(ctx, fq.emptied)()
+	}
+	for fq.size > 0 {
+		if !fq.running {
+			return common.ErrQueueIsClosed
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		fq.emptied.Wait()
+	}
+	return nil
+}
+
+// IsClosed returns whether FairQueue is closed, after which no item is popped anymore
+func (fq *FairQueue) IsClosed() bool {
+	fq.mu.RLock()
+	defer fq.mu.RUnlock()
+	return !fq.running
+}
+
+// Closed returns a channel which is closed once FairQueue is closed,
+// so other goroutines can select on it
+func (fq *FairQueue) Closed() <-chan struct{} {
+	return fq.closed
+}
+
+func (fq *FairQueue) closeLocked() {
+	if !fq.running {
+		// already closed, fq.closed can't be closed twice
+		return
+	}
+	fq.running = false
+	close(fq.closed)
+	for i := 0; i < fq.limitPriority; i++ {
+		if fq.queues[i] != nil {
+			fq.queues[i].Close()
+		}
+	}
+	fq.notEmpty.Broadcast()
+	fq.notFull.Broadcast()
+	fq.emptied.Broadcast()
+}
+
+func reverse(items []common.QItem) {
+	for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+		items[i], items[j] = items[j], items[i]
+	}
+}
+
+func identityBands(numOfPriority int) []int {
+	bands := make([]int, numOfPriority)
+	for i := range bands {
+		bands[i] = i
+	}
+	return bands
+}
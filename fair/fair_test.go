@@ -1,254 +1,937 @@
-package fair
-
-import (
-	"log"
-	"runtime"
-	"testing"
-	"time"
-
-	"github.com/aarondwi/prioritize/common"
-)
-
-func TestFairQueue(t *testing.T) {
-	fq, err := NewFairQueue(2048, 16)
-	if err != nil {
-		t.Fatalf("It should not error, cause both are positive, but we got %v", err)
-	}
-
-	err = fq.PushOrError(common.QItem{ID: 1, Priority: 8})
-	if err != nil {
-		t.Fatalf("It should not return error, cause not full yet, but we got %v", err)
-	}
-
-	err = fq.PushOrError(common.QItem{ID: 2, Priority: 13})
-	if err != nil {
-		t.Fatalf("It should not return error, cause not full yet, but we got %v", err)
-	}
-
-	err = fq.PushOrError(common.QItem{ID: 3, Priority: 5})
-	if err != nil {
-		t.Fatalf("It should not return error, cause not full yet, but we got %v", err)
-	}
-
-	err = fq.PushOrError(common.QItem{ID: 4, Priority: 13})
-	if err != nil {
-		t.Fatalf("It should not return error, cause not full yet, but we got %v", err)
-	}
-
-	result, err := fq.PopOrWaitTillClose()
-	if err != nil {
-		t.Fatalf("It should not error, cause not closed yet, but we got %v", err)
-	}
-	if result.ID != 1 || result.Priority != 8 {
-		t.Fatalf("First item should be returned first, but instead we got %v", result)
-	}
-
-	result, err = fq.PopOrWaitTillClose()
-	if err != nil {
-		t.Fatalf("It should not error, cause not closed yet, but we got %v", err)
-	}
-	if result.ID != 3 || result.Priority != 5 {
-		t.Fatalf("Left-hand side of first item should be returned first, but instead we got %v", result)
-	}
-
-	result, err = fq.PopOrWaitTillClose()
-	if err != nil {
-		t.Fatalf("It should not error, cause not closed yet, but we got %v", err)
-	}
-	if result.ID != 2 || result.Priority != 13 {
-		t.Fatalf("After left-hand side, should roll back to higher one, but instead we got %v", result)
-	}
-
-	result, err = fq.PopOrWaitTillClose()
-	if err != nil {
-		t.Fatalf("It should not error, cause not closed yet, but we got %v", err)
-	}
-	if result.ID != 4 || result.Priority != 13 {
-		t.Fatalf("After left-hand side, should roll back to higher one, but instead we got %v", result)
-	}
-	fq.Close()
-}
-
-func TestFairQueueValidation(t *testing.T) {
-	_, err := NewFairQueue(-2048, 1)
-	if err == nil || err != common.ErrParamShouldBePositive {
-		t.Fatal("It should error, cause sizeLimit can't be negative, but it is not")
-	}
-
-	_, err = NewFairQueue(2048, -16)
-	if err == nil || err != common.ErrParamShouldBePositive {
-		t.Fatal("It should error, cause numOfPriority can't be negative, but it is not")
-	}
-
-	fq, err := NewFairQueue(2048, 16)
-	if err != nil {
-		t.Fatalf("It should not error, instead we got %v", err)
-	}
-
-	err = fq.PushOrError(common.QItem{Priority: -1})
-	if err == nil || err != common.ErrPriorityOutOfRange {
-		t.Fatal("It should error, cause cannot accept negative priority, but it is not")
-	}
-
-	err = fq.PushOrError(common.QItem{Priority: 16})
-	if err == nil || err != common.ErrPriorityOutOfRange {
-		t.Fatal("It should error, cause can only accept priority [0, numOfPriority), but it is not")
-	}
-
-	if fq.size != 0 {
-		t.Fatalf("No item is added yet, but the size is %d", fq.size)
-	}
-
-	for i := 0; i < 2048; i++ {
-		err = fq.PushOrError(
-			common.QItem{ID: uint64(i), Priority: i % 16})
-		if err != nil {
-			t.Fatalf("It should not error, because slots left, but instead, at iteration %d, size %d, sizeLimit %d, we got %v", i, fq.size, fq.sizeLimit, err)
-		}
-	}
-
-	err = fq.PushOrError(common.QItem{ID: 2048, Priority: 1})
-	if err == nil {
-		t.Fatalf("It should error, because no slots left, but it is not")
-	}
-
-	fq.Close()
-}
-
-func TestFairQueuePopWait(t *testing.T) {
-	fq, err := NewFairQueue(100, 16)
-
-	c := make(chan bool, 1)
-	go func() {
-		time.Sleep(200 * time.Millisecond)
-		log.Println("timeout, returning")
-		c <- false
-	}()
-
-	go func() {
-		item, err := fq.PopOrWaitTillClose()
-		if err != nil {
-			c <- false
-			return
-		}
-		if item.Priority != 10 {
-			log.Printf("We received priority %d\n", item.Priority)
-			c <- false
-			return
-		}
-		c <- true
-	}()
-
-	time.Sleep(100 * time.Millisecond)
-	err = fq.PushOrError(common.QItem{Priority: 10})
-	if err != nil {
-		t.Fatalf("It should not error because slots are available, but we got %v", err)
-	}
-
-	result := <-c
-	if !result {
-		t.Fatal("We should receive true, because all the above are true, but we are not")
-	}
-	fq.Close()
-}
-
-func TestFairQueueAfterClose(t *testing.T) {
-	fq, _ := NewFairQueue(2000, 8)
-	fq.Close()
-
-	err := fq.PushOrError(common.QItem{})
-	if err == nil || err != common.ErrQueueIsClosed {
-		t.Fatalf("It should be error, cause already closed, but it is not")
-	}
-
-	_, err = fq.PopOrWaitTillClose()
-	if err == nil || err != common.ErrQueueIsClosed {
-		t.Fatalf("It should be error, cause already closed, but it is not")
-	}
-}
-
-func BenchmarkFairQueue(b *testing.B) {
-	fq, _ := NewFairQueue(1024, 8)
-	for i := 0; i < b.N; i++ {
-		fq.PushOrError(
-			common.QItem{ID: uint64(i), Priority: i % 8})
-		fq.PopOrWaitTillClose()
-	}
-	fq.Close()
-}
-
-func BenchmarkFairQueueInLoop(b *testing.B) {
-	fq, _ := NewFairQueue(1024, 8)
-	for i := 0; i < b.N; i++ {
-		for j := 0; j < 128; j++ {
-			fq.PushOrError(
-				common.QItem{ID: uint64(j), Priority: j % 8})
-		}
-		for j := 0; j < 128; j++ {
-			fq.PopOrWaitTillClose()
-		}
-	}
-	fq.Close()
-}
-
-func BenchmarkFairQueueParallelOneCoreOnly(b *testing.B) {
-	fq, _ := NewFairQueue(1024, 8)
-	runtime.GOMAXPROCS(1)
-	b.RunParallel(func(pb *testing.PB) {
-		j := 0
-		for pb.Next() {
-			j++
-			fq.PushOrError(
-				common.QItem{ID: uint64(j), Priority: j % 8})
-			fq.PopOrWaitTillClose()
-		}
-	})
-	fq.Close()
-}
-
-func BenchmarkFairQueueInLoopParallelOneCoreOnly(b *testing.B) {
-	fq, _ := NewFairQueue(1024, 8)
-	runtime.GOMAXPROCS(1)
-	b.RunParallel(func(pb *testing.PB) {
-		for pb.Next() {
-			for j := 0; j < 128; j++ {
-				fq.PushOrError(
-					common.QItem{ID: uint64(j), Priority: j % 8})
-			}
-			for j := 0; j < 128; j++ {
-				fq.PopOrWaitTillClose()
-			}
-		}
-	})
-	fq.Close()
-}
-
-func BenchmarkFairQueueParallel(b *testing.B) {
-	fq, _ := NewFairQueue(1024, 8)
-	b.RunParallel(func(pb *testing.PB) {
-		j := 0
-		for pb.Next() {
-			j++
-			fq.PushOrError(
-				common.QItem{ID: uint64(j), Priority: j % 8})
-			fq.PopOrWaitTillClose()
-		}
-	})
-	fq.Close()
-}
-
-func BenchmarkFairQueueInLoopParallel(b *testing.B) {
-	fq, _ := NewFairQueue(1024, 8)
-	b.RunParallel(func(pb *testing.PB) {
-		for pb.Next() {
-			for j := 0; j < 128; j++ {
-				fq.PushOrError(
-					common.QItem{ID: uint64(j), Priority: j % 8})
-			}
-			for j := 0; j < 128; j++ {
-				fq.PopOrWaitTillClose()
-			}
-		}
-	})
-	fq.Close()
-}
+package fair
+
+import (
+	"context"
+	"errors"
+	"log"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/queuetest"
+)
+
+func TestFairQueue(t *testing.T) {
+	fq, err := NewFairQueue(2048, 16)
+	if err != nil {
+		t.Fatalf("It should not error, cause both are positive, but we got %v", err)
+	}
+
+	err = fq.PushOrError(common.QItem{ID: 1, Priority: 8})
+	if err != nil {
+		t.Fatalf("It should not return error, cause not full yet, but we got %v", err)
+	}
+
+	err = fq.PushOrError(common.QItem{ID: 2, Priority: 13})
+	if err != nil {
+		t.Fatalf("It should not return error, cause not full yet, but we got %v", err)
+	}
+
+	err = fq.PushOrError(common.QItem{ID: 3, Priority: 5})
+	if err != nil {
+		t.Fatalf("It should not return error, cause not full yet, but we got %v", err)
+	}
+
+	err = fq.PushOrError(common.QItem{ID: 4, Priority: 13})
+	if err != nil {
+		t.Fatalf("It should not return error, cause not full yet, but we got %v", err)
+	}
+
+	result, err := fq.PopOrWaitTillClose()
+	if err != nil {
+		t.Fatalf("It should not error, cause not closed yet, but we got %v", err)
+	}
+	if result.ID != 1 || result.Priority != 8 {
+		t.Fatalf("First item should be returned first, but instead we got %v", result)
+	}
+
+	result, err = fq.PopOrWaitTillClose()
+	if err != nil {
+		t.Fatalf("It should not error, cause not closed yet, but we got %v", err)
+	}
+	if result.ID != 3 || result.Priority != 5 {
+		t.Fatalf("Left-hand side of first item should be returned first, but instead we got %v", result)
+	}
+
+	result, err = fq.PopOrWaitTillClose()
+	if err != nil {
+		t.Fatalf("It should not error, cause not closed yet, but we got %v", err)
+	}
+	if result.ID != 2 || result.Priority != 13 {
+		t.Fatalf("After left-hand side, should roll back to higher one, but instead we got %v", result)
+	}
+
+	result, err = fq.PopOrWaitTillClose()
+	if err != nil {
+		t.Fatalf("It should not error, cause not closed yet, but we got %v", err)
+	}
+	if result.ID != 4 || result.Priority != 13 {
+		t.Fatalf("After left-hand side, should roll back to higher one, but instead we got %v", result)
+	}
+	fq.Close()
+}
+
+func TestFairQueueValidation(t *testing.T) {
+	_, err := NewFairQueue(-2048, 1)
+	if err == nil || err != common.ErrParamShouldBePositive {
+		t.Fatal("It should error, cause sizeLimit can't be negative, but it is not")
+	}
+
+	_, err = NewFairQueue(2048, -16)
+	if err == nil || err != common.ErrParamShouldBePositive {
+		t.Fatal("It should error, cause numOfPriority can't be negative, but it is not")
+	}
+
+	fq, err := NewFairQueue(2048, 16)
+	if err != nil {
+		t.Fatalf("It should not error, instead we got %v", err)
+	}
+
+	err = fq.PushOrError(common.QItem{Priority: -1})
+	if !errors.Is(err, common.ErrPriorityOutOfRange) {
+		t.Fatal("It should error, cause cannot accept negative priority, but it is not")
+	}
+
+	err = fq.PushOrError(common.QItem{Priority: 16})
+	if !errors.Is(err, common.ErrPriorityOutOfRange) {
+		t.Fatal("It should error, cause can only accept priority [0, numOfPriority), but it is not")
+	}
+
+	if fq.Len() != 0 {
+		t.Fatalf("No item is added yet, but the size is %d", fq.Len())
+	}
+
+	for i := 0; i < 2048; i++ {
+		err = fq.PushOrError(
+			common.QItem{ID: uint64(i), Priority: i % 16})
+		if err != nil {
+			t.Fatalf("It should not error, because slots left, but instead, at iteration %d, size %d, sizeLimit %d, we got %v", i, fq.Len(), fq.Cap(), err)
+		}
+	}
+
+	if fq.Len() != 2048 || fq.Cap() != 2048 {
+		t.Fatalf("It should be full with 2048 items, but the size is %d of %d", fq.Len(), fq.Cap())
+	}
+
+	err = fq.PushOrError(common.QItem{ID: 2048, Priority: 1})
+	if err == nil {
+		t.Fatalf("It should error, because no slots left, but it is not")
+	}
+
+	fq.Close()
+}
+
+func TestFairQueuePopWait(t *testing.T) {
+	fq, err := NewFairQueue(100, 16)
+
+	c := make(chan bool, 1)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		log.Println("timeout, returning")
+		c <- false
+	}()
+
+	go func() {
+		item, err := fq.PopOrWaitTillClose()
+		if err != nil {
+			c <- false
+			return
+		}
+		if item.Priority != 10 {
+			log.Printf("We received priority %d\n", item.Priority)
+			c <- false
+			return
+		}
+		c <- true
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	err = fq.PushOrError(common.QItem{Priority: 10})
+	if err != nil {
+		t.Fatalf("It should not error because slots are available, but we got %v", err)
+	}
+
+	result := <-c
+	if !result {
+		t.Fatal("We should receive true, because all the above are true, but we are not")
+	}
+	fq.Close()
+}
+
+func TestFairQueueAfterClose(t *testing.T) {
+	fq, _ := NewFairQueue(2000, 8)
+	fq.Close()
+
+	err := fq.PushOrError(common.QItem{})
+	if !errors.Is(err, common.ErrQueueIsClosed) {
+		t.Fatalf("It should be error, cause already closed, but it is not")
+	}
+
+	_, err = fq.PopOrWaitTillClose()
+	if err == nil || err != common.ErrQueueIsClosed {
+		t.Fatalf("It should be error, cause already closed, but it is not")
+	}
+}
+
+func BenchmarkFairQueue(b *testing.B) {
+	fq, _ := NewFairQueue(1024, 8)
+	for i := 0; i < b.N; i++ {
+		fq.PushOrError(
+			common.QItem{ID: uint64(i), Priority: i % 8})
+		fq.PopOrWaitTillClose()
+	}
+	fq.Close()
+}
+
+func BenchmarkFairQueueInLoop(b *testing.B) {
+	fq, _ := NewFairQueue(1024, 8)
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < 128; j++ {
+			fq.PushOrError(
+				common.QItem{ID: uint64(j), Priority: j % 8})
+		}
+		for j := 0; j < 128; j++ {
+			fq.PopOrWaitTillClose()
+		}
+	}
+	fq.Close()
+}
+
+func BenchmarkFairQueueParallelOneCoreOnly(b *testing.B) {
+	fq, _ := NewFairQueue(1024, 8)
+	runtime.GOMAXPROCS(1)
+	b.RunParallel(func(pb *testing.PB) {
+		j := 0
+		for pb.Next() {
+			j++
+			fq.PushOrError(
+				common.QItem{ID: uint64(j), Priority: j % 8})
+			fq.PopOrWaitTillClose()
+		}
+	})
+	fq.Close()
+}
+
+func BenchmarkFairQueueInLoopParallelOneCoreOnly(b *testing.B) {
+	fq, _ := NewFairQueue(1024, 8)
+	runtime.GOMAXPROCS(1)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			for j := 0; j < 128; j++ {
+				fq.PushOrError(
+					common.QItem{ID: uint64(j), Priority: j % 8})
+			}
+			for j := 0; j < 128; j++ {
+				fq.PopOrWaitTillClose()
+			}
+		}
+	})
+	fq.Close()
+}
+
+func BenchmarkFairQueueParallel(b *testing.B) {
+	fq, _ := NewFairQueue(1024, 8)
+	b.RunParallel(func(pb *testing.PB) {
+		j := 0
+		for pb.Next() {
+			j++
+			fq.PushOrError(
+				common.QItem{ID: uint64(j), Priority: j % 8})
+			fq.PopOrWaitTillClose()
+		}
+	})
+	fq.Close()
+}
+
+func BenchmarkFairQueueInLoopParallel(b *testing.B) {
+	fq, _ := NewFairQueue(1024, 8)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			for j := 0; j < 128; j++ {
+				fq.PushOrError(
+					common.QItem{ID: uint64(j), Priority: j % 8})
+			}
+			for j := 0; j < 128; j++ {
+				fq.PopOrWaitTillClose()
+			}
+		}
+	})
+	fq.Close()
+}
+
+func TestFairQueueGlobalFIFO(t *testing.T) {
+	fq, err := NewFairQueue(2048, 16, WithGlobalFIFO())
+	if err != nil {
+		t.Fatalf("It should not error, cause both are positive, but we got %v", err)
+	}
+
+	items := []common.QItem{
+		{ID: 1, Priority: 8},
+		{ID: 2, Priority: 13},
+		{ID: 3, Priority: 5},
+		{ID: 4, Priority: 13},
+		{ID: 5, Priority: 8},
+	}
+	for _, item := range items {
+		err = fq.PushOrError(item)
+		if err != nil {
+			t.Fatalf("It should not return error, cause not full yet, but we got %v", err)
+		}
+	}
+
+	// first rotation goes by age of each priority's head, one item each,
+	// then the second rotation only has priority 13 and 8 left
+	expectedIDs := []uint64{1, 2, 3, 4, 5}
+	for _, expected := range expectedIDs {
+		result, err := fq.PopOrWaitTillClose()
+		if err != nil {
+			t.Fatalf("It should not error, cause not closed yet, but we got %v", err)
+		}
+		if result.ID != expected {
+			t.Fatalf("Expected ID %d to be returned, but instead we got %v", expected, result)
+		}
+	}
+	fq.Close()
+}
+
+func TestFairQueueGlobalFIFOOnePerRotation(t *testing.T) {
+	fq, _ := NewFairQueue(2048, 16, WithGlobalFIFO())
+
+	// priority 2 items are all older, but priority 10 still gets its turn
+	fq.PushOrError(common.QItem{ID: 1, Priority: 2})
+	fq.PushOrError(common.QItem{ID: 2, Priority: 2})
+	fq.PushOrError(common.QItem{ID: 3, Priority: 2})
+	fq.PushOrError(common.QItem{ID: 4, Priority: 10})
+
+	expectedIDs := []uint64{1, 4, 2, 3}
+	for _, expected := range expectedIDs {
+		result, err := fq.PopOrWaitTillClose()
+		if err != nil {
+			t.Fatalf("It should not error, cause not closed yet, but we got %v", err)
+		}
+		if result.ID != expected {
+			t.Fatalf("Expected ID %d to be returned, but instead we got %v", expected, result)
+		}
+	}
+	fq.Close()
+}
+
+func TestFairQueueCloseGracefully(t *testing.T) {
+	fq, _ := NewFairQueue(2000, 8)
+	for i := 0; i < 3; i++ {
+		fq.PushOrError(common.QItem{ID: uint64(i), Priority: i})
+	}
+	fq.CloseGracefully()
+
+	err := fq.PushOrError(common.QItem{})
+	if !errors.Is(err, common.ErrQueueIsClosed) {
+		t.Fatalf("It should be error, cause already closing, but instead we got %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		_, err = fq.PopOrWaitTillClose()
+		if err != nil {
+			t.Fatalf("It should not error, cause items remain, but we got %v", err)
+		}
+	}
+
+	_, err = fq.PopOrWaitTillClose()
+	if err == nil || err != common.ErrQueueIsClosed {
+		t.Fatalf("It should be error, cause already drained, but instead we got %v", err)
+	}
+}
+
+func TestFairQueueCloseGracefullyReleasesWaitingPop(t *testing.T) {
+	fq, _ := NewFairQueue(2000, 8)
+
+	c := make(chan error, 1)
+	go func() {
+		_, err := fq.PopOrWaitTillClose()
+		c <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	fq.CloseGracefully()
+
+	select {
+	case err := <-c:
+		if err == nil || err != common.ErrQueueIsClosed {
+			t.Fatalf("It should be error, cause closed while empty, but instead we got %v", err)
+		}
+	case <-time.After(200 * time.Millisecond):
+		t.Fatal("Waiting pop should be released, but it is not")
+	}
+}
+
+func TestFairQueueRateLimitValidation(t *testing.T) {
+	_, err := NewFairQueue(2048, 16, WithRateLimit(16, 10, 1))
+	if err == nil || err != common.ErrPriorityOutOfRange {
+		t.Fatalf("It should error, cause priority is out of range, but instead we got %v", err)
+	}
+
+	_, err = NewFairQueue(2048, 16, WithRateLimit(3, 0, 1))
+	if err == nil || err != common.ErrParamShouldBePositive {
+		t.Fatalf("It should error, cause rate should be positive, but instead we got %v", err)
+	}
+}
+
+func TestFairQueueRateLimitWait(t *testing.T) {
+	fq, _ := NewFairQueue(2048, 16, WithRateLimit(3, 20, 1))
+	fq.PushOrError(common.QItem{ID: 1, Priority: 3})
+	fq.PushOrError(common.QItem{ID: 2, Priority: 3})
+
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		_, err := fq.PopOrWaitTillClose()
+		if err != nil {
+			t.Fatalf("It should not error, cause not closed yet, but we got %v", err)
+		}
+	}
+	// 1 token is available right away, the next one is in 1/20s
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Fatalf("Second pop should wait for the rate limit, but it only took %v", elapsed)
+	}
+	fq.Close()
+}
+
+func TestFairQueueRateLimitSkip(t *testing.T) {
+	fq, _ := NewFairQueue(2048, 16, WithRateLimit(8, 0.001, 1))
+	fq.PushOrError(common.QItem{ID: 1, Priority: 8})
+	result, err := fq.PopOrWaitTillClose()
+	if err != nil || result.ID != 1 {
+		t.Fatalf("It should return the only item, but instead we got %v and %v", result, err)
+	}
+
+	// priority 8 is now the rotation position, but has no token left
+	fq.PushOrError(common.QItem{ID: 2, Priority: 8})
+	fq.PushOrError(common.QItem{ID: 3, Priority: 5})
+	result, err = fq.PopOrWaitTillClose()
+	if err != nil || result.ID != 3 {
+		t.Fatalf("It should skip the rate-limited priority, but instead we got %v and %v", result, err)
+	}
+	fq.Close()
+}
+
+func TestFairQueueRemapPriorities(t *testing.T) {
+	fq, _ := NewFairQueue(2048, 8)
+
+	err := fq.RemapPriorities(func(p int) int { return -1 })
+	if err == nil || err != common.ErrPriorityOutOfRange {
+		t.Fatalf("It should error, cause mapped out of range, but instead we got %v", err)
+	}
+
+	fq.PushOrError(common.QItem{ID: 1, Priority: 2})
+	fq.PushOrError(common.QItem{ID: 2, Priority: 0})
+	fq.PushOrError(common.QItem{ID: 3, Priority: 6})
+	fq.PushOrError(common.QItem{ID: 4, Priority: 1})
+
+	// collapse 0-3 into 0, rotation position (2) becomes empty
+	err = fq.RemapPriorities(func(p int) int {
+		if p <= 3 {
+			return 0
+		}
+		return p
+	})
+	if err != nil {
+		t.Fatalf("It should not error, cause all are in range, but instead we got %v", err)
+	}
+
+	expected := []common.QItem{
+		{ID: 1, Priority: 0},
+		{ID: 3, Priority: 6},
+		{ID: 2, Priority: 0},
+		{ID: 4, Priority: 0},
+	}
+	for _, e := range expected {
+		result, err := fq.PopOrWaitTillClose()
+		if err != nil {
+			t.Fatalf("It should not error, cause not closed yet, but we got %v", err)
+		}
+		if result.ID != e.ID || result.Priority != e.Priority {
+			t.Fatalf("Expected %v, but instead we got %v", e, result)
+		}
+	}
+	fq.Close()
+}
+
+func TestFairQueueUpdatePriority(t *testing.T) {
+	fq, _ := NewFairQueue(2048, 8)
+	fq.PushOrError(common.QItem{ID: 1, Priority: 2})
+	fq.PushOrError(common.QItem{ID: 2, Priority: 1})
+
+	err := fq.UpdatePriority(2, 8)
+	if err == nil || err != common.ErrPriorityOutOfRange {
+		t.Fatalf("It should error, cause priority is out of range, but instead we got %v", err)
+	}
+	err = fq.UpdatePriority(3, 5)
+	if err == nil || err != common.ErrItemNotFound {
+		t.Fatalf("It should error, cause ID 3 is not queued, but instead we got %v", err)
+	}
+
+	err = fq.UpdatePriority(2, 5)
+	if err != nil {
+		t.Fatalf("It should not error, cause ID 2 is queued, but instead we got %v", err)
+	}
+	if fq.Len() != 2 {
+		t.Fatalf("Updating priority should not change the size, but it is %d", fq.Len())
+	}
+
+	// rotation still starts from the first item put
+	result, _ := fq.PopOrWaitTillClose()
+	if result.ID != 1 {
+		t.Fatalf("Expected ID 1, but instead we got %v", result)
+	}
+	result, _ = fq.PopOrWaitTillClose()
+	if result.ID != 2 || result.Priority != 5 {
+		t.Fatalf("Updated item should be returned with its new priority, but instead we got %v", result)
+	}
+	fq.Close()
+}
+
+func TestFairQueuePopBatch(t *testing.T) {
+	fq, _ := NewFairQueue(2048, 8)
+	fq.PushOrError(common.QItem{ID: 1, Priority: 3})
+	fq.PushOrError(common.QItem{ID: 2, Priority: 6})
+	fq.PushOrError(common.QItem{ID: 3, Priority: 1})
+	fq.PushOrError(common.QItem{ID: 4, Priority: 3})
+	fq.PushOrError(common.QItem{ID: 5, Priority: 0})
+
+	// same order as popping one by one
+	expectedIDs := []uint64{1, 3, 5, 2, 4}
+	first, err := fq.PopBatchOrWaitTillClose(3)
+	if err != nil || len(first) != 3 {
+		t.Fatalf("It should return 3 items, but instead we got %v and %v", first, err)
+	}
+	second, err := fq.PopBatchOrWaitTillClose(10)
+	if err != nil || len(second) != 2 {
+		t.Fatalf("It should return the remaining 2 items, but instead we got %v and %v", second, err)
+	}
+	for i, item := range append(first, second...) {
+		if item.ID != expectedIDs[i] {
+			t.Fatalf("Expected ID %d at position %d, but instead we got %v", expectedIDs[i], i, item)
+		}
+	}
+
+	fq.CloseGracefully()
+	_, err = fq.PopBatchOrWaitTillClose(10)
+	if err == nil || err != common.ErrQueueIsClosed {
+		t.Fatalf("It should be error, cause already closed, but instead we got %v", err)
+	}
+}
+
+func TestFairQueueRemove(t *testing.T) {
+	fq, _ := NewFairQueue(2, 8)
+	fq.PushOrError(common.QItem{ID: 1, Priority: 2})
+	fq.PushOrError(common.QItem{ID: 2, Priority: 1})
+
+	_, err := fq.Remove(3)
+	if err == nil || err != common.ErrItemNotFound {
+		t.Fatalf("It should error, cause ID 3 is not queued, but instead we got %v", err)
+	}
+	item, err := fq.Remove(1)
+	if err != nil || item.ID != 1 {
+		t.Fatalf("It should remove ID 1, but instead we got %v and %v", item, err)
+	}
+	if fq.Len() != 1 {
+		t.Fatalf("Removing should free the slot, but size is %d", fq.Len())
+	}
+	err = fq.PushOrError(common.QItem{ID: 3, Priority: 0})
+	if err != nil {
+		t.Fatalf("It should not error, cause a slot is freed, but instead we got %v", err)
+	}
+
+	fq.CloseGracefully()
+	fq.Remove(3)
+	result, err := fq.PopOrWaitTillClose()
+	if err != nil || result.ID != 2 {
+		t.Fatalf("Expected ID 2, but instead we got %v and %v", result, err)
+	}
+	_, err = fq.PopOrWaitTillClose()
+	if err == nil || err != common.ErrQueueIsClosed {
+		t.Fatalf("It should be closed after draining, but instead we got %v", err)
+	}
+}
+
+func TestFairQueueResumeRotation(t *testing.T) {
+	pop := func(fq *FairQueue) []uint64 {
+		ids := []uint64{}
+		for fq.Len() > 0 {
+			item, _ := fq.PopOrWaitTillClose()
+			ids = append(ids, item.ID)
+		}
+		return ids
+	}
+
+	for _, resume := range []bool{false, true} {
+		opts := []Option{}
+		if resume {
+			opts = append(opts, WithResumeRotation())
+		}
+		fq, _ := NewFairQueue(2048, 4, opts...)
+		fq.PushOrError(common.QItem{ID: 1, Priority: 3})
+		fq.PushOrError(common.QItem{ID: 2, Priority: 1})
+		pop(fq)
+
+		// the rotation stopped right after priority 1
+		fq.PushOrError(common.QItem{ID: 3, Priority: 3})
+		fq.PushOrError(common.QItem{ID: 4, Priority: 0})
+		ids := pop(fq)
+
+		expected := []uint64{3, 4}
+		if resume {
+			expected = []uint64{4, 3}
+		}
+		for i, e := range expected {
+			if ids[i] != e {
+				t.Fatalf("With resume %v, expected %v, but instead we got %v", resume, expected, ids)
+			}
+		}
+		fq.Close()
+	}
+}
+
+func TestFairQueueRotationOptions(t *testing.T) {
+	_, err := NewFairQueue(2048, 4, WithStartPriority(4))
+	if err == nil || err != common.ErrPriorityOutOfRange {
+		t.Fatalf("It should error, cause start priority is out of range, but instead we got %v", err)
+	}
+
+	cases := []struct {
+		opts     []Option
+		expected []int
+	}{
+		{nil, []int{1, 0, 3, 2}},
+		{[]Option{WithAscendingRotation()}, []int{1, 2, 3, 0}},
+		{[]Option{WithStartPriority(3)}, []int{3, 2, 1, 0}},
+		{[]Option{WithAscendingRotation(), WithStartPriority(2)}, []int{2, 3, 0, 1}},
+	}
+	for _, c := range cases {
+		fq, _ := NewFairQueue(2048, 4, c.opts...)
+		for _, p := range []int{1, 0, 2, 3} {
+			fq.PushOrError(common.QItem{ID: uint64(p), Priority: p})
+		}
+		for _, e := range c.expected {
+			item, _ := fq.PopOrWaitTillClose()
+			if item.Priority != e {
+				t.Fatalf("Expected order %v, but priority %d is popped instead of %d", c.expected, item.Priority, e)
+			}
+		}
+		fq.Close()
+	}
+}
+
+func TestFairQueueWithEarlyDrop(t *testing.T) {
+	fq, _ := NewFairQueue(10, 8, WithEarlyDrop(0, 4))
+	for i := 0; i < 9; i++ {
+		if err := fq.PushOrError(common.QItem{ID: uint64(i), Priority: 7}); err != nil {
+			t.Fatalf("It should not reject priority at or above minPriority, but instead we got %v", err)
+		}
+	}
+	rejected := 0
+	for i := 0; i < 100; i++ {
+		err := fq.PushOrError(common.QItem{ID: 100, Priority: 3})
+		if errors.Is(err, common.ErrQueueIsFull) {
+			rejected++
+		} else {
+			fq.Remove(100)
+		}
+	}
+	if rejected == 0 || rejected == 100 {
+		t.Fatalf("It should reject some low priority pushes, but instead we got %d out of 100", rejected)
+	}
+	fq.Close()
+}
+
+func TestFairQueueWithReservedHeadroom(t *testing.T) {
+	fq, _ := NewFairQueue(4, 8, WithReservedHeadroom(0.5, 7))
+	fq.PushOrError(common.QItem{ID: 1, Priority: 0})
+	fq.PushOrError(common.QItem{ID: 2, Priority: 6})
+	err := fq.PushOrError(common.QItem{ID: 3, Priority: 6})
+	if !errors.Is(err, common.ErrQueueIsFull) {
+		t.Fatalf("It should error, cause the rest is reserved, but instead we got %v", err)
+	}
+	if err = fq.PushOrError(common.QItem{ID: 4, Priority: 7}); err != nil {
+		t.Fatalf("It should not error, cause the rest is reserved for it, but instead we got %v", err)
+	}
+	fq.Close()
+}
+
+func TestFairQueuePushOrEvict(t *testing.T) {
+	fq, _ := NewFairQueue(2, 8)
+	fq.PushOrError(common.QItem{ID: 1, Priority: 0})
+	fq.PushOrError(common.QItem{ID: 2, Priority: 5})
+
+	evicted, ok, err := fq.PushOrEvict(common.QItem{ID: 3, Priority: 3})
+	if err != nil || !ok || evicted.ID != 1 {
+		t.Fatalf("It should evict ID 1, but instead we got %v, %v and %v", evicted, ok, err)
+	}
+	_, _, err = fq.PushOrEvict(common.QItem{ID: 4, Priority: 3})
+	if !errors.Is(err, common.ErrQueueIsFull) {
+		t.Fatalf("It should error, cause nothing is lower than priority 3, but instead we got %v", err)
+	}
+
+	expected := []uint64{2, 3}
+	for _, e := range expected {
+		item, _ := fq.PopOrWaitTillClose()
+		if item.ID != e {
+			t.Fatalf("Expected ID %d, but instead we got %v", e, item)
+		}
+	}
+	fq.Close()
+}
+
+func TestFairQueueWithLIFO(t *testing.T) {
+	fq, _ := NewFairQueue(2048, 8, WithLIFO())
+	fq.PushOrError(common.QItem{ID: 1, Priority: 5})
+	fq.PushOrError(common.QItem{ID: 2, Priority: 5})
+	fq.PushOrError(common.QItem{ID: 3, Priority: 2})
+	fq.PushOrError(common.QItem{ID: 4, Priority: 2})
+	fq.PushOrError(common.QItem{ID: 5, Priority: 5})
+
+	expected := []uint64{5, 4, 2, 3, 1}
+	for _, e := range expected {
+		item, _ := fq.PopOrWaitTillClose()
+		if item.ID != e {
+			t.Fatalf("Expected ID %d, but instead we got %v", e, item)
+		}
+	}
+	fq.Close()
+}
+
+func TestFairQueueWithLongestQueueFirst(t *testing.T) {
+	_, err := NewFairQueue(2048, 8, WithLongestQueueFirst(0))
+	if err == nil || err != common.ErrParamShouldBePositive {
+		t.Fatalf("It should error, cause maxSkips can't be zero, but instead we got %v", err)
+	}
+
+	fq, _ := NewFairQueue(2048, 8, WithLongestQueueFirst(3))
+	for i := 0; i < 10; i++ {
+		fq.PushOrError(common.QItem{ID: uint64(i), Priority: 1})
+	}
+	fq.PushOrError(common.QItem{ID: 100, Priority: 6})
+	fq.PushOrError(common.QItem{ID: 101, Priority: 6})
+
+	// priority 1 is the longest, but priority 6 can only be skipped 3 times in a row
+	expected := []int{1, 1, 1, 6, 1, 1, 1, 6, 1, 1, 1, 1}
+	for i, e := range expected {
+		item, _ := fq.PopOrWaitTillClose()
+		if item.Priority != e {
+			t.Fatalf("Expected priority %d at %d, but instead we got %v", e, i, item)
+		}
+	}
+	fq.Close()
+}
+
+func TestFairQueueSetNumOfPriority(t *testing.T) {
+	fq, _ := NewFairQueue(2048, 3)
+	fq.PushOrError(common.QItem{ID: 1, Priority: 2})
+	fq.PushOrError(common.QItem{ID: 2, Priority: 0})
+	p, err := fq.AddPriorityLevel()
+	if err != nil || p != 3 {
+		t.Fatalf("It should add priority 3, but instead we got %d and %v", p, err)
+	}
+	fq.PushOrError(common.QItem{ID: 3, Priority: 3})
+
+	err = fq.SetNumOfPriority(3)
+	if err == nil || err != common.ErrPriorityNotEmpty {
+		t.Fatalf("It should error, cause priority 3 still has items, but instead we got %v", err)
+	}
+
+	// the new priority joins the rotation
+	expected := []uint64{1, 2, 3}
+	for _, e := range expected {
+		item, _ := fq.PopOrWaitTillClose()
+		if item.ID != e {
+			t.Fatalf("Expected ID %d, but instead we got %v", e, item)
+		}
+	}
+	if err = fq.SetNumOfPriority(1); err != nil {
+		t.Fatalf("It should shrink, cause removed priorities are empty, but instead we got %v", err)
+	}
+	fq.PushOrError(common.QItem{ID: 4, Priority: 0})
+	item, _ := fq.PopOrWaitTillClose()
+	if item.ID != 4 {
+		t.Fatalf("Expected ID 4, but instead we got %v", item)
+	}
+	fq.Close()
+}
+
+func TestFairQueuePushOrWaitTillClose(t *testing.T) {
+	fq, _ := NewFairQueue(1, 8)
+	fq.PushOrError(common.QItem{ID: 1, Priority: 1})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fq.PushOrWaitTillClose(common.QItem{ID: 2, Priority: 2})
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("It should wait, cause the queue is full, but instead it returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	item, _ := fq.PopOrWaitTillClose()
+	if item.ID != 1 {
+		t.Fatalf("Expected ID 1, but instead we got %v", item)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("It should push once a slot is available, but instead we got %v", err)
+	}
+
+	go func() {
+		done <- fq.PushOrWaitTillClose(common.QItem{ID: 3, Priority: 2})
+	}()
+	time.Sleep(50 * time.Millisecond)
+	fq.Close()
+	if err := <-done; !errors.Is(err, common.ErrQueueIsClosed) {
+		t.Fatalf("It should return ErrQueueIsClosed, but instead we got %v", err)
+	}
+}
+
+func TestFairQueuePopOrWaitCtx(t *testing.T) {
+	fq, _ := NewFairQueue(2048, 16)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := fq.PopOrWaitCtx(ctx)
+	if err == nil || err != context.DeadlineExceeded {
+		t.Fatalf("It should return context.DeadlineExceeded, cause nothing is pushed, but instead we got %v", err)
+	}
+
+	fq.PushOrError(common.QItem{ID: 1, Priority: 3})
+	item, err := fq.PopOrWaitCtx(ctx)
+	if err != nil || item.ID != 1 {
+		t.Fatalf("It should pop without waiting, but instead we got %v and %v", item, err)
+	}
+	fq.Close()
+}
+
+func TestFairQueueDrain(t *testing.T) {
+	fq, _ := NewFairQueue(2048, 4)
+	fq.PushOrError(common.QItem{ID: 1, Priority: 1})
+	fq.PushOrError(common.QItem{ID: 2, Priority: 3})
+	fq.PushOrError(common.QItem{ID: 3, Priority: 1})
+
+	items := fq.Drain()
+	if len(items) != 3 || items[0].ID != 2 || items[1].ID != 1 || items[2].ID != 3 {
+		t.Fatalf("Expected IDs 2, 1, 3, but instead we got %v", items)
+	}
+	if fq.Len() != 0 {
+		t.Fatalf("It should be empty after drain, but instead Len is %d", fq.Len())
+	}
+
+	fq.Close()
+	if items := fq.Drain(); items != nil {
+		t.Fatalf("It should return nil, cause already closed, but instead we got %v", items)
+	}
+}
+
+func TestFairQueuePauseResume(t *testing.T) {
+	fq, _ := NewFairQueue(2048, 4)
+	fq.Pause()
+	err := fq.PushOrError(common.QItem{ID: 1, Priority: 1})
+	if err != nil {
+		t.Fatalf("It should accept pushes while paused, but instead we got %v", err)
+	}
+
+	done := make(chan common.QItem, 1)
+	go func() {
+		item, _ := fq.PopOrWaitTillClose()
+		done <- item
+	}()
+	select {
+	case item := <-done:
+		t.Fatalf("It should wait, cause paused, but instead it returned %v", item)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	fq.Resume()
+	if item := <-done; item.ID != 1 {
+		t.Fatalf("Expected ID 1, but instead we got %v", item)
+	}
+	fq.Close()
+}
+
+func TestFairQueueWaitUntilEmpty(t *testing.T) {
+	fq, _ := NewFairQueue(2048, 4)
+
+	if err := fq.WaitUntilEmpty(context.Background()); err != nil {
+		t.Fatalf("It should return right away, cause it is empty, but instead we got %v", err)
+	}
+
+	fq.PushOrError(common.QItem{ID: 1, Priority: 1})
+	fq.PushOrError(common.QItem{ID: 2, Priority: 2})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := fq.WaitUntilEmpty(ctx); err == nil || err != context.DeadlineExceeded {
+		t.Fatalf("It should return context.DeadlineExceeded, cause nothing is popped, but instead we got %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fq.WaitUntilEmpty(context.Background())
+	}()
+	fq.PopOrWaitTillClose()
+	time.Sleep(20 * time.Millisecond)
+	if len(done) != 0 {
+		t.Fatalf("It should still wait, cause 1 item is left")
+	}
+	fq.PopOrWaitTillClose()
+	if err := <-done; err != nil {
+		t.Fatalf("It should return once the last item is popped, but instead we got %v", err)
+	}
+
+	fq.PushOrError(common.QItem{ID: 3, Priority: 1})
+	go func() {
+		done <- fq.WaitUntilEmpty(context.Background())
+	}()
+	time.Sleep(20 * time.Millisecond)
+	fq.Close()
+	if err := <-done; err == nil || err != common.ErrQueueIsClosed {
+		t.Fatalf("It should return ErrQueueIsClosed, cause closed with items left, but instead we got %v", err)
+	}
+}
+
+func TestFairQueueWithWatermarks(t *testing.T) {
+	_, err := NewFairQueue(8, 4, WithWatermarks(2, 2, nil, nil))
+	if err == nil || err != common.ErrParamShouldBePositive {
+		t.Fatalf("It should error, cause low should be below high, but instead we got %v", err)
+	}
+
+	high, low := 0, 0
+	fq, _ := NewFairQueue(8, 4, WithWatermarks(3, 1,
+		func(size int) { high++ },
+		func(size int) { low++ }))
+	for i := 0; i < 4; i++ {
+		fq.PushOrError(common.QItem{ID: uint64(i), Priority: 1})
+	}
+	if high != 1 || low != 0 {
+		t.Fatalf("Only the high watermark should be crossed once, but instead we got %d and %d", high, low)
+	}
+	for i := 0; i < 3; i++ {
+		fq.PopOrWaitTillClose()
+	}
+	if high != 1 || low != 1 {
+		t.Fatalf("The low watermark should be crossed once, but instead we got %d and %d", high, low)
+	}
+	fq.Close()
+}
+
+func TestFairQueueConformance(t *testing.T) {
+	queuetest.Run(t, func(sizeLimit int) (common.ExtendedQInterface, error) {
+		return NewFairQueue(sizeLimit, 4)
+	})
+}
+
+func TestFairQueuePeek(t *testing.T) {
+	fq, _ := NewFairQueue(2048, 4)
+	fq.PushOrError(common.QItem{ID: 1, Priority: 1})
+	fq.PushOrError(common.QItem{ID: 2, Priority: 3})
+	fq.PushOrError(common.QItem{ID: 3, Priority: 3})
+	item, err := fq.Peek()
+	if err != nil || item.ID != 2 {
+		t.Fatalf("It should peek the oldest of priority 3, but instead we got %v and %v", item, err)
+	}
+	fq.Close()
+}
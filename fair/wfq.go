@@ -0,0 +1,366 @@
+package fair
+
+import (
+	"context"
+	"sync"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/linkedslice"
+)
+
+// WeightedFairQueue is a weighted fair queue (WFQ).
+//
+// `FairQueue` gives each non-empty priority 1 pop per rotation, no matter how much it has queued.
+// Here, each item gets a virtual finish time when pushed, which grows by `1 / weights[priority]`
+// per item of its priority, and pops always take the earliest one.
+// So as long as priorities stay backlogged, they are served proportionally to their weights,
+// e.g. weights [1, 3] serve priority 1 three times as much as priority 0.
+//
+// A priority which was empty for a while restarts from the current virtual time,
+// so it does not get paid back for the time it had nothing queued.
+// Inside a priority, it is FIFO.
+type WeightedFairQueue struct {
+	// synchronization primitive
+	// read-only calls (e.g. Len) only take the read lock,
+	// so they don't contend with each other
+	mu       *sync.RWMutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	// broadcast once the size reaches 0, see `WaitUntilEmpty`
+	emptied *sync.Cond
+
+	// we separate number tracking from the queues
+	// so checking numberOfTasksInEachQueue just need 1 cache miss (putting into cpu L1 cache)
+	numberOfTasksInEachQueue []int
+	queues                   []*linkedslice.LinkedSlice
+
+	weights []int
+
+	// finishTimes[p] are the virtual finish times of the items of priority p, in the same order.
+	// virtualTime is the finish time of the last popped item.
+	finishTimes    [][]float64
+	lastFinishTime []float64
+	virtualTime    float64
+
+	// simple metadata
+	limitPriority int
+	size          int
+	sizeLimit     int
+	running       bool
+	closed        chan struct{}
+	draining      bool
+}
+
+// NewWeightedFairQueue creates our weighted fair queue.
+//
+// It caps at sizeLimit, and allows priority [0,len(weights)),
+// in which all weights should be positive.
+// `weights` is copied, so changing it afterwards doesn't affect the queue.
+func NewWeightedFairQueue(sizeLimit int, weights []int) (*WeightedFairQueue, error) {
+	if sizeLimit <= 0 || len(weights) == 0 {
+		return nil, common.ErrParamShouldBePositive
+	}
+	for _, w := range weights {
+		if w <= 0 {
+			return nil, common.ErrParamShouldBePositive
+		}
+	}
+
+	mu := &sync.RWMutex{}
+	queues := make([]*linkedslice.LinkedSlice, len(weights))
+	for i := range queues {
+		queues[i] = linkedslice.NewLinkedSlice()
+	}
+	return &WeightedFairQueue{
+		mu:                       mu,
+		notEmpty:                 sync.NewCond(mu),
+		notFull:                  sync.NewCond(mu),
+		emptied:                  sync.NewCond(mu),
+		numberOfTasksInEachQueue: make([]int, len(weights)),
+		queues:                   queues,
+		weights:                  append([]int(nil), weights...),
+		finishTimes:              make([][]float64, len(weights)),
+		lastFinishTime:           make([]float64, len(weights)),
+		limitPriority:            len(weights),
+		sizeLimit:                sizeLimit,
+		running:                  true,
+		closed:                   make(chan struct{}),
+	}, nil
+}
+
+// PushOrError put the item into the queue, and returns error if no slot available
+func (wq *WeightedFairQueue) PushOrError(item common.QItem) error {
+	wq.mu.Lock()
+	defer wq.mu.Unlock()
+	if item.Priority < 0 || item.Priority >= wq.limitPriority {
+		return wq.queueErrorLocked("PushOrError", item, common.ErrPriorityOutOfRange)
+	}
+	if err := wq.pushLocked(item); err != nil {
+		return wq.queueErrorLocked("PushOrError", item, err)
+	}
+	return nil
+}
+
+// PushOrWaitCtx is the same as PushOrError, but waits for a slot while the queue is full,
+// and returns `ctx.Err()` once `ctx` is done while waiting
+func (wq *WeightedFairQueue) PushOrWaitCtx(ctx context.Context, item common.QItem) error {
+	wq.mu.Lock()
+	defer wq.mu.Unlock()
+	if item.Priority < 0 || item.Priority >= wq.limitPriority {
+		return wq.queueErrorLocked("PushOrWaitCtx", item, common.ErrPriorityOutOfRange)
+	}
+	err := wq.pushLocked(item)
+	if err == common.ErrQueueIsFull {
+		defer common.WakeOnDone(ctx, wq.notFull)()
+	}
+	for err == common.ErrQueueIsFull {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		wq.notFull.Wait()
+		err = wq.pushLocked(item)
+	}
+	if err != nil {
+		return wq.queueErrorLocked("PushOrWaitCtx", item, err)
+	}
+	return nil
+}
+
+// queueErrorLocked adds what wq looks like right now to `err`, see `common.QueueError`
+func (wq *WeightedFairQueue) queueErrorLocked(op string, item common.QItem, err error) error {
+	return &common.QueueError{Op: op, Priority: item.Priority, Size: wq.size, Limit: wq.sizeLimit, Err: err}
+}
+
+func (wq *WeightedFairQueue) pushLocked(item common.QItem) error {
+	if !wq.running || wq.draining {
+		return common.ErrQueueIsClosed
+	}
+	if wq.size == wq.sizeLimit {
+		return common.ErrQueueIsFull
+	}
+
+	p := item.Priority
+	err := wq.queues[p].PushOrError(item)
+	// meaning already closed, cause linkedslices is unbounded
+	if err != nil {
+		return err
+	}
+
+	start := wq.lastFinishTime[p]
+	if start < wq.virtualTime {
+		start = wq.virtualTime
+	}
+	finish := start + 1/float64(wq.weights[p])
+	wq.lastFinishTime[p] = finish
+	wq.finishTimes[p] = append(wq.finishTimes[p], finish)
+
+	wq.numberOfTasksInEachQueue[p]++
+	wq.size++
+	wq.notEmpty.Signal()
+	return nil
+}
+
+// PopOrWaitTillClose returns the item with the earliest virtual finish time, or waits if none exists
+func (wq *WeightedFairQueue) PopOrWaitTillClose() (common.QItem, error) {
+	return wq.PopOrWaitCtx(context.Background())
+}
+
+// PopOrWaitCtx is the same as PopOrWaitTillClose,
+// but also returns `ctx.Err()` once `ctx` is done while waiting
+func (wq *WeightedFairQueue) PopOrWaitCtx(ctx context.Context) (common.QItem, error) {
+	wq.mu.Lock()
+	defer wq.mu.Unlock()
+	if !wq.running {
+		return common.MinQItem, common.ErrQueueIsClosed
+	}
+	if wq.size == 0 {
+		defer common.WakeOnDone(ctx, wq.notEmpty)()
+	}
+	for wq.size == 0 {
+		if wq.draining {
+			wq.closeLocked()
+			return common.MinQItem, common.ErrQueueIsClosed
+		}
+		if err := ctx.Err(); err != nil {
+			return common.MinQItem, err
+		}
+		wq.notEmpty.Wait()
+		// double check, ensuring see the changes after wait call
+		if !wq.running {
+			return common.MinQItem, common.ErrQueueIsClosed
+		}
+	}
+	return wq.popLocked()
+}
+
+// TryPop is the non-blocking version of PopOrWaitTillClose.
+// It returns `common.ErrQueueIsEmpty` right away if the queue is empty.
+func (wq *WeightedFairQueue) TryPop() (common.QItem, error) {
+	wq.mu.Lock()
+	defer wq.mu.Unlock()
+	if !wq.running {
+		return common.MinQItem, common.ErrQueueIsClosed
+	}
+	if wq.size == 0 {
+		return common.MinQItem, common.ErrQueueIsEmpty
+	}
+	return wq.popLocked()
+}
+
+// popLocked takes the next item, there should be at least 1
+func (wq *WeightedFairQueue) popLocked() (common.QItem, error) {
+	p := wq.nextLocked()
+
+	// if we wait blindly, it gonna stuck
+	// but we are tracking it manually, ensuring it will never wait
+	result, err := wq.queues[p].PopOrWaitTillClose()
+	if err != nil {
+		return common.MinQItem, err
+	}
+	wq.virtualTime = wq.finishTimes[p][0]
+	wq.finishTimes[p] = wq.finishTimes[p][1:]
+	wq.numberOfTasksInEachQueue[p]--
+	wq.size--
+
+	wq.notFull.Signal()
+	if wq.size == 0 {
+		wq.emptied.Broadcast()
+		if wq.draining {
+			wq.closeLocked()
+		}
+	}
+	return result, nil
+}
+
+// nextLocked returns the priority whose head item has the earliest virtual finish time,
+// there should be at least 1 item
+func (wq *WeightedFairQueue) nextLocked() int {
+	// ties go to the higher priority
+	p := -1
+	for i := wq.limitPriority - 1; i >= 0; i-- {
+		if wq.numberOfTasksInEachQueue[i] == 0 {
+			continue
+		}
+		if p == -1 || wq.finishTimes[i][0] < wq.finishTimes[p][0] {
+			p = i
+		}
+	}
+	return p
+}
+
+// Peek returns the item the next pop returns, without removing it,
+// or `common.ErrQueueIsEmpty` if the queue is empty.
+func (wq *WeightedFairQueue) Peek() (common.QItem, error) {
+	wq.mu.RLock()
+	defer wq.mu.RUnlock()
+	if !wq.running {
+		return common.MinQItem, common.ErrQueueIsClosed
+	}
+	if wq.size == 0 {
+		return common.MinQItem, common.ErrQueueIsEmpty
+	}
+	item, _ := wq.queues[wq.nextLocked()].Peek()
+	return item, nil
+}
+
+// Len returns the number of items currently in the queue
+func (wq *WeightedFairQueue) Len() int {
+	wq.mu.RLock()
+	defer wq.mu.RUnlock()
+	return wq.size
+}
+
+// Cap returns the maximum number of items the queue can hold
+func (wq *WeightedFairQueue) Cap() int {
+	return wq.sizeLimit
+}
+
+// DepthPerPriority returns the number of items currently in each priority
+func (wq *WeightedFairQueue) DepthPerPriority() []int {
+	wq.mu.RLock()
+	defer wq.mu.RUnlock()
+	depths := make([]int, wq.limitPriority)
+	copy(depths, wq.numberOfTasksInEachQueue)
+	return depths
+}
+
+// Close is the same as CloseNow
+func (wq *WeightedFairQueue) Close() error {
+	return wq.CloseNow()
+}
+
+// CloseNow closes WeightedFairQueue, preventing it from accepting new request.
+// Remaining items are dropped, and waiting pops return immediately.
+// Closing it again does nothing, only returning `common.ErrQueueIsClosed`.
+func (wq *WeightedFairQueue) CloseNow() error {
+	wq.mu.Lock()
+	defer wq.mu.Unlock()
+	if !wq.running {
+		return common.ErrQueueIsClosed
+	}
+	wq.closeLocked()
+	return nil
+}
+
+// CloseGracefully stops WeightedFairQueue from accepting new request,
+// but pops keep returning the remaining items.
+// Once it is empty, it is closed the same way as CloseNow.
+func (wq *WeightedFairQueue) CloseGracefully() {
+	wq.mu.Lock()
+	if wq.running {
+		wq.draining = true
+		if wq.size == 0 {
+			wq.closeLocked()
+		}
+	}
+	wq.mu.Unlock()
+}
+
+// WaitUntilEmpty waits until WeightedFairQueue holds no item, and returns nil.
+// It returns `common.ErrQueueIsClosed` if WeightedFairQueue is closed with items left,
+// or `ctx.Err()` once `ctx` is done while waiting.
+func (wq *WeightedFairQueue) WaitUntilEmpty(ctx context.Context) error {
+	wq.mu.Lock()
+	defer wq.mu.Unlock()
+	if wq.size > 0 {
+		defer common.WakeOnDone(ctx, wq.emptied)()
+	}
+	for wq.size > 0 {
+		if !wq.running {
+			return common.ErrQueueIsClosed
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		wq.emptied.Wait()
+	}
+	return nil
+}
+
+// IsClosed returns whether WeightedFairQueue is closed, after which no item is popped anymore
+func (wq *WeightedFairQueue) IsClosed() bool {
+	wq.mu.RLock()
+	defer wq.mu.RUnlock()
+	return !wq.running
+}
+
+// Closed returns a channel which is closed once WeightedFairQueue is closed,
+// so other goroutines can select on it
+func (wq *WeightedFairQueue) Closed() <-chan struct{} {
+	return wq.closed
+}
+
+func (wq *WeightedFairQueue) closeLocked() {
+	if !wq.running {
+		// already closed, wq.closed can't be closed twice
+		return
+	}
+	wq.running = false
+	close(wq.closed)
+	for _, q := range wq.queues {
+		q.Close()
+	}
+	wq.notEmpty.Broadcast()
+	wq.notFull.Broadcast()
+	wq.emptied.Broadcast()
+}
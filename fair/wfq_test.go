@@ -0,0 +1,135 @@
+package fair
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/queuetest"
+)
+
+func TestNewWeightedFairQueueErrors(t *testing.T) {
+	_, err := NewWeightedFairQueue(10, []int{1, 0})
+	if err == nil || err != common.ErrParamShouldBePositive {
+		t.Fatalf("It should error, cause weight can't be zero, but instead we got %v", err)
+	}
+	_, err = NewWeightedFairQueue(0, []int{1})
+	if err == nil || err != common.ErrParamShouldBePositive {
+		t.Fatalf("It should error, cause sizeLimit can't be zero, but instead we got %v", err)
+	}
+
+	wq, _ := NewWeightedFairQueue(1, []int{1})
+	err = wq.PushOrError(common.QItem{ID: 1, Priority: 1})
+	if !errors.Is(err, common.ErrPriorityOutOfRange) {
+		t.Fatalf("It should error, cause priority is out of range, but instead we got %v", err)
+	}
+	wq.PushOrError(common.QItem{ID: 1})
+	err = wq.PushOrError(common.QItem{ID: 2})
+	if !errors.Is(err, common.ErrQueueIsFull) {
+		t.Fatalf("It should error, cause queue is full, but instead we got %v", err)
+	}
+}
+
+func TestWeightedFairQueueFollowsWeights(t *testing.T) {
+	weights := []int{1, 3}
+	wq, _ := NewWeightedFairQueue(2048, weights)
+	// copied, so this has no effect
+	weights[0] = 3
+	for i := 0; i < 100; i++ {
+		wq.PushOrError(common.QItem{ID: uint64(i), Priority: 0})
+		wq.PushOrError(common.QItem{ID: uint64(100 + i), Priority: 1})
+	}
+
+	served := make([]int, 2)
+	for i := 0; i < 40; i++ {
+		item, _ := wq.PopOrWaitTillClose()
+		served[item.Priority]++
+	}
+	if served[0] != 10 || served[1] != 30 {
+		t.Fatalf("It should follow the weights 1:3, but instead we got %v", served)
+	}
+	wq.Close()
+}
+
+func TestWeightedFairQueueIdlePriorityIsNotPaidBack(t *testing.T) {
+	wq, _ := NewWeightedFairQueue(2048, []int{1, 1})
+	for i := 0; i < 10; i++ {
+		wq.PushOrError(common.QItem{ID: uint64(i), Priority: 1})
+	}
+	for i := 0; i < 5; i++ {
+		wq.PopOrWaitTillClose()
+	}
+
+	// priority 0 was idle, it should only alternate from now on
+	for i := 0; i < 5; i++ {
+		wq.PushOrError(common.QItem{ID: uint64(100 + i), Priority: 0})
+	}
+	served := make([]int, 2)
+	for i := 0; i < 6; i++ {
+		item, _ := wq.PopOrWaitTillClose()
+		served[item.Priority]++
+	}
+	if served[0] != 3 || served[1] != 3 {
+		t.Fatalf("It should alternate, but instead we got %v", served)
+	}
+
+	wq.CloseGracefully()
+	for i := 0; i < 4; i++ {
+		if _, err := wq.PopOrWaitTillClose(); err != nil {
+			t.Fatalf("It should still return the remaining items, but instead we got %v", err)
+		}
+	}
+	_, err := wq.PopOrWaitTillClose()
+	if err == nil || err != common.ErrQueueIsClosed {
+		t.Fatalf("It should be closed after draining, but instead we got %v", err)
+	}
+}
+
+func TestWeightedFairQueueWaitUntilEmpty(t *testing.T) {
+	wq, _ := NewWeightedFairQueue(10, []int{1, 1})
+	wq.PushOrError(common.QItem{ID: 1})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := wq.WaitUntilEmpty(ctx); err == nil || err != context.DeadlineExceeded {
+		t.Fatalf("It should return context.DeadlineExceeded, cause nothing is popped, but instead we got %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- wq.WaitUntilEmpty(context.Background())
+	}()
+	wq.PopOrWaitTillClose()
+	if err := <-done; err != nil {
+		t.Fatalf("It should return once the last item is popped, but instead we got %v", err)
+	}
+
+	wq.PushOrError(common.QItem{ID: 2})
+	wq.Close()
+	if err := wq.WaitUntilEmpty(context.Background()); err == nil || err != common.ErrQueueIsClosed {
+		t.Fatalf("It should return ErrQueueIsClosed, cause closed with items left, but instead we got %v", err)
+	}
+}
+
+func TestWeightedFairQueueConformance(t *testing.T) {
+	queuetest.Run(t, func(sizeLimit int) (common.ExtendedQInterface, error) {
+		return NewWeightedFairQueue(sizeLimit, []int{1, 1})
+	})
+}
+
+func TestWeightedFairQueuePeek(t *testing.T) {
+	wq, _ := NewWeightedFairQueue(10, []int{1, 1})
+	wq.PushOrError(common.QItem{ID: 1, Priority: 0})
+	wq.PushOrError(common.QItem{ID: 2, Priority: 1})
+	item, err := wq.Peek()
+	if err != nil || item.ID != 2 {
+		t.Fatalf("It should peek ID 2, but instead we got %v and %v", item, err)
+	}
+	popped, _ := wq.PopOrWaitTillClose()
+	if popped.ID != item.ID {
+		t.Fatalf("It should pop the peeked item, but instead we got %v", popped)
+	}
+	wq.Close()
+}
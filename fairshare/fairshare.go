@@ -0,0 +1,430 @@
+package fairshare
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/linkedslice"
+)
+
+// numOfBuckets is how many parts the window is split into.
+// The window slides 1 bucket at a time.
+const numOfBuckets = 10
+
+// FairShareQueue is a queue in which each priority has a configured share,
+// and pops go to the priority which is served the least compared to its share,
+// counted over a sliding window.
+//
+// Unlike `fair.FairQueue`, which is fair per round,
+// this gives long-term fairness: a priority which was starved for a while
+// (e.g. it only started having items) is not paid back beyond the window,
+// and a priority which got more than its share recently is served less.
+// Inside a priority, it is FIFO.
+type FairShareQueue struct {
+	// synchronization primitive
+	// read-only calls (e.g. Len) only take the read lock,
+	// so they don't contend with each other
+	mu       *sync.RWMutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	// broadcast once the size reaches 0, see `WaitUntilEmpty`
+	emptied *sync.Cond
+
+	// we separate number tracking from the queues
+	// so checking numberOfTasksInEachQueue just need 1 cache miss (putting into cpu L1 cache)
+	numberOfTasksInEachQueue []int
+	queues                   []*linkedslice.LinkedSlice
+
+	shares []int
+
+	// served[b][p] is how many items of priority p are popped in bucket b,
+	// and servedInWindow[p] is the sum over all buckets
+	served             [][]int
+	servedInWindow     []int
+	bucketWidth        time.Duration
+	currentBucket      int
+	currentBucketStart time.Time
+	now                func() time.Time
+
+	// simple metadata
+	limitPriority int
+	size          int
+	sizeLimit     int
+	running       bool
+	closed        chan struct{}
+	draining      bool
+}
+
+// Option configures optional behavior of FairShareQueue
+type Option func(*FairShareQueue) error
+
+// WithClock makes the queue read the time from `now`, instead of `time.Now`.
+// Mainly for testing.
+func WithClock(now func() time.Time) Option {
+	return func(fsq *FairShareQueue) error {
+		fsq.now = now
+		return nil
+	}
+}
+
+// NewFairShareQueue creates our fair share queue.
+//
+// It caps at sizeLimit, and allows priority [0,len(shares)),
+// in which priority p should get shares[p] out of the sum of shares,
+// counted over the last `window`.
+func NewFairShareQueue(
+	sizeLimit int,
+	shares []int,
+	window time.Duration,
+	opts ...Option) (*FairShareQueue, error) {
+
+	if sizeLimit <= 0 || len(shares) == 0 || window <= 0 {
+		return nil, common.ErrParamShouldBePositive
+	}
+	for _, share := range shares {
+		if share <= 0 {
+			return nil, common.ErrParamShouldBePositive
+		}
+	}
+
+	mu := &sync.RWMutex{}
+	numOfPriority := len(shares)
+	served := make([][]int, numOfBuckets)
+	for i := range served {
+		served[i] = make([]int, numOfPriority)
+	}
+
+	fsq := &FairShareQueue{
+		mu:                       mu,
+		notEmpty:                 sync.NewCond(mu),
+		notFull:                  sync.NewCond(mu),
+		emptied:                  sync.NewCond(mu),
+		numberOfTasksInEachQueue: make([]int, numOfPriority),
+		queues:                   make([]*linkedslice.LinkedSlice, numOfPriority),
+		shares:                   shares,
+		served:                   served,
+		servedInWindow:           make([]int, numOfPriority),
+		bucketWidth:              window / numOfBuckets,
+		now:                      time.Now,
+		limitPriority:            numOfPriority,
+		sizeLimit:                sizeLimit,
+		running:                  true,
+		closed:                   make(chan struct{}),
+	}
+	for _, opt := range opts {
+		if err := opt(fsq); err != nil {
+			return nil, err
+		}
+	}
+	if fsq.bucketWidth == 0 {
+		fsq.bucketWidth = 1
+	}
+	fsq.currentBucketStart = fsq.now()
+	return fsq, nil
+}
+
+// PushOrError put the item into the queue, and returns error if no slot available
+func (fsq *FairShareQueue) PushOrError(item common.QItem) error {
+	fsq.mu.Lock()
+	defer fsq.mu.Unlock()
+	if item.Priority < 0 || item.Priority >= fsq.limitPriority {
+		return fsq.queueErrorLocked("PushOrError", item, common.ErrPriorityOutOfRange)
+	}
+	if err := fsq.pushLocked(item); err != nil {
+		return fsq.queueErrorLocked("PushOrError", item, err)
+	}
+	return nil
+}
+
+// PushOrWaitCtx is the same as PushOrError, but waits for a slot while the queue is full,
+// and returns `ctx.Err()` once `ctx` is done while waiting
+func (fsq *FairShareQueue) PushOrWaitCtx(ctx context.Context, item common.QItem) error {
+	fsq.mu.Lock()
+	defer fsq.mu.Unlock()
+	if item.Priority < 0 || item.Priority >= fsq.limitPriority {
+		return fsq.queueErrorLocked("PushOrWaitCtx", item, common.ErrPriorityOutOfRange)
+	}
+	err := fsq.pushLocked(item)
+	if err == common.ErrQueueIsFull {
+		defer common.WakeOnDone(ctx, fsq.notFull)()
+	}
+	for err == common.ErrQueueIsFull {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		fsq.notFull.Wait()
+		err = fsq.pushLocked(item)
+	}
+	if err != nil {
+		return fsq.queueErrorLocked("PushOrWaitCtx", item, err)
+	}
+	return nil
+}
+
+// queueErrorLocked adds what fsq looks like right now to `err`, see `common.QueueError`
+func (fsq *FairShareQueue) queueErrorLocked(op string, item common.QItem, err error) error {
+	return &common.QueueError{Op: op, Priority: item.Priority, Size: fsq.size, Limit: fsq.sizeLimit, Err: err}
+}
+
+func (fsq *FairShareQueue) pushLocked(item common.QItem) error {
+	if !fsq.running || fsq.draining {
+		return common.ErrQueueIsClosed
+	}
+	if fsq.size == fsq.sizeLimit {
+		return common.ErrQueueIsFull
+	}
+
+	if fsq.queues[item.Priority] == nil {
+		fsq.queues[item.Priority] = linkedslice.NewLinkedSlice()
+	}
+	err := fsq.queues[item.Priority].PushOrError(item)
+	// meaning already closed, cause linkedslices is unbounded
+	if err != nil {
+		return err
+	}
+	fsq.numberOfTasksInEachQueue[item.Priority]++
+	fsq.size++
+	fsq.notEmpty.Signal()
+	return nil
+}
+
+// PopOrWaitTillClose returns 1 QItem from the priority most behind its share,
+// or waits if none exists
+func (fsq *FairShareQueue) PopOrWaitTillClose() (common.QItem, error) {
+	return fsq.PopOrWaitCtx(context.Background())
+}
+
+// PopOrWaitCtx is the same as PopOrWaitTillClose,
+// but also returns `ctx.Err()` once `ctx` is done while waiting
+func (fsq *FairShareQueue) PopOrWaitCtx(ctx context.Context) (common.QItem, error) {
+	fsq.mu.Lock()
+	defer fsq.mu.Unlock()
+	if !fsq.running {
+		return common.MinQItem, common.ErrQueueIsClosed
+	}
+	if fsq.size == 0 {
+		defer common.WakeOnDone(ctx, fsq.notEmpty)()
+	}
+	for fsq.size == 0 {
+		if fsq.draining {
+			fsq.closeLocked()
+			return common.MinQItem, common.ErrQueueIsClosed
+		}
+		if err := ctx.Err(); err != nil {
+			return common.MinQItem, err
+		}
+		fsq.notEmpty.Wait()
+		// double check, ensuring see the changes after wait call
+		if !fsq.running {
+			return common.MinQItem, common.ErrQueueIsClosed
+		}
+	}
+	return fsq.popLocked()
+}
+
+// TryPop is the non-blocking version of PopOrWaitTillClose.
+// It returns `common.ErrQueueIsEmpty` right away if the queue is empty.
+func (fsq *FairShareQueue) TryPop() (common.QItem, error) {
+	fsq.mu.Lock()
+	defer fsq.mu.Unlock()
+	if !fsq.running {
+		return common.MinQItem, common.ErrQueueIsClosed
+	}
+	if fsq.size == 0 {
+		return common.MinQItem, common.ErrQueueIsEmpty
+	}
+	return fsq.popLocked()
+}
+
+// popLocked takes the next item, there should be at least 1
+func (fsq *FairShareQueue) popLocked() (common.QItem, error) {
+	fsq.slideLocked(fsq.now())
+	p := fsq.mostBehindLocked()
+
+	// if we wait blindly, it gonna stuck
+	// but we are tracking it manually, ensuring it will never wait
+	result, err := fsq.queues[p].PopOrWaitTillClose()
+	if err != nil {
+		return common.MinQItem, err
+	}
+	fsq.numberOfTasksInEachQueue[p]--
+	fsq.size--
+	fsq.served[fsq.currentBucket][p]++
+	fsq.servedInWindow[p]++
+
+	fsq.notFull.Signal()
+	if fsq.size == 0 {
+		fsq.emptied.Broadcast()
+		if fsq.draining {
+			fsq.closeLocked()
+		}
+	}
+	return result, nil
+}
+
+// Peek returns the item the next pop returns, without removing it,
+// or `common.ErrQueueIsEmpty` if the queue is empty.
+// It takes the write lock, as the window may need to slide first, just like for a pop.
+func (fsq *FairShareQueue) Peek() (common.QItem, error) {
+	fsq.mu.Lock()
+	defer fsq.mu.Unlock()
+	if !fsq.running {
+		return common.MinQItem, common.ErrQueueIsClosed
+	}
+	if fsq.size == 0 {
+		return common.MinQItem, common.ErrQueueIsEmpty
+	}
+	fsq.slideLocked(fsq.now())
+	item, _ := fsq.queues[fsq.mostBehindLocked()].Peek()
+	return item, nil
+}
+
+// slideLocked drops the buckets which are already out of the window at `now`
+func (fsq *FairShareQueue) slideLocked(now time.Time) {
+	steps := int(now.Sub(fsq.currentBucketStart) / fsq.bucketWidth)
+	if steps <= 0 {
+		return
+	}
+	fsq.currentBucketStart = fsq.currentBucketStart.Add(time.Duration(steps) * fsq.bucketWidth)
+	if steps > numOfBuckets {
+		steps = numOfBuckets
+	}
+	for i := 0; i < steps; i++ {
+		fsq.currentBucket = (fsq.currentBucket + 1) % numOfBuckets
+		bucket := fsq.served[fsq.currentBucket]
+		for p, count := range bucket {
+			fsq.servedInWindow[p] -= count
+			bucket[p] = 0
+		}
+	}
+}
+
+// mostBehindLocked returns the non-empty priority with the lowest served/share ratio.
+// Ties go to the higher priority.
+func (fsq *FairShareQueue) mostBehindLocked() int {
+	chosen := -1
+	for p := fsq.limitPriority - 1; p >= 0; p-- {
+		if fsq.numberOfTasksInEachQueue[p] == 0 {
+			continue
+		}
+		// served[p]/shares[p] < served[chosen]/shares[chosen], without division
+		if chosen == -1 ||
+			fsq.servedInWindow[p]*fsq.shares[chosen] < fsq.servedInWindow[chosen]*fsq.shares[p] {
+			chosen = p
+		}
+	}
+	return chosen
+}
+
+// Compact releases memory held by the queue of each priority, see `linkedslice.CompactAll`.
+func (fsq *FairShareQueue) Compact() {
+	fsq.mu.Lock()
+	defer fsq.mu.Unlock()
+	linkedslice.CompactAll(fsq.queues)
+}
+
+// Len returns the number of items currently in the queue
+func (fsq *FairShareQueue) Len() int {
+	fsq.mu.RLock()
+	defer fsq.mu.RUnlock()
+	return fsq.size
+}
+
+// Cap returns the maximum number of items the queue can hold
+func (fsq *FairShareQueue) Cap() int {
+	return fsq.sizeLimit
+}
+
+// DepthPerPriority returns the number of items currently in each priority
+func (fsq *FairShareQueue) DepthPerPriority() []int {
+	fsq.mu.RLock()
+	defer fsq.mu.RUnlock()
+	depths := make([]int, fsq.limitPriority)
+	copy(depths, fsq.numberOfTasksInEachQueue)
+	return depths
+}
+
+// Close is the same as CloseNow
+func (fsq *FairShareQueue) Close() error {
+	return fsq.CloseNow()
+}
+
+// CloseNow closes FairShareQueue, preventing it from accepting new request.
+// Remaining items are dropped, and waiting pops return immediately.
+// Closing it again does nothing, only returning `common.ErrQueueIsClosed`.
+func (fsq *FairShareQueue) CloseNow() error {
+	fsq.mu.Lock()
+	defer fsq.mu.Unlock()
+	if !fsq.running {
+		return common.ErrQueueIsClosed
+	}
+	fsq.closeLocked()
+	return nil
+}
+
+// CloseGracefully stops FairShareQueue from accepting new request,
+// but pops keep returning the remaining items.
+// Once it is empty, it is closed the same way as CloseNow.
+func (fsq *FairShareQueue) CloseGracefully() {
+	fsq.mu.Lock()
+	if fsq.running {
+		fsq.draining = true
+		if fsq.size == 0 {
+			fsq.closeLocked()
+		}
+	}
+	fsq.mu.Unlock()
+}
+
+// WaitUntilEmpty waits until FairShareQueue holds no item, and returns nil.
+// It returns `common.ErrQueueIsClosed` if FairShareQueue is closed with items left,
+// or `ctx.Err()` once `ctx` is done while waiting.
+func (fsq *FairShareQueue) WaitUntilEmpty(ctx context.Context) error {
+	fsq.mu.Lock()
+	defer fsq.mu.Unlock()
+	if fsq.size > 0 {
+		defer common.WakeOnDone(ctx, fsq.emptied)()
+	}
+	for fsq.size > 0 {
+		if !fsq.running {
+			return common.ErrQueueIsClosed
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		fsq.emptied.Wait()
+	}
+	return nil
+}
+
+// IsClosed returns whether FairShareQueue is closed, after which no item is popped anymore
+func (fsq *FairShareQueue) IsClosed() bool {
+	fsq.mu.RLock()
+	defer fsq.mu.RUnlock()
+	return !fsq.running
+}
+
+// Closed returns a channel which is closed once FairShareQueue is closed,
+// so other goroutines can select on it
+func (fsq *FairShareQueue) Closed() <-chan struct{} {
+	return fsq.closed
+}
+
+func (fsq *FairShareQueue) closeLocked() {
+	if !fsq.running {
+		// already closed, fsq.closed can't be closed twice
+		return
+	}
+	fsq.running = false
+	close(fsq.closed)
+	for i := 0; i < fsq.limitPriority; i++ {
+		if fsq.queues[i] != nil {
+			fsq.queues[i].Close()
+		}
+	}
+	fsq.notEmpty.Broadcast()
+	fsq.notFull.Broadcast()
+	fsq.emptied.Broadcast()
+}
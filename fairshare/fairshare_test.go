@@ -0,0 +1,150 @@
+package fairshare
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/queuetest"
+)
+
+func TestNewFairShareQueueErrors(t *testing.T) {
+	_, err := NewFairShareQueue(0, []int{1}, time.Second)
+	if err == nil || err != common.ErrParamShouldBePositive {
+		t.Fatalf("It should error, cause sizeLimit can't be zero, but instead we got %v", err)
+	}
+	_, err = NewFairShareQueue(10, []int{1, 0}, time.Second)
+	if err == nil || err != common.ErrParamShouldBePositive {
+		t.Fatalf("It should error, cause share can't be zero, but instead we got %v", err)
+	}
+	_, err = NewFairShareQueue(10, []int{1}, 0)
+	if err == nil || err != common.ErrParamShouldBePositive {
+		t.Fatalf("It should error, cause window can't be zero, but instead we got %v", err)
+	}
+}
+
+func TestFairShareQueuePushErrors(t *testing.T) {
+	fsq, _ := NewFairShareQueue(1, []int{1, 1}, time.Second)
+	err := fsq.PushOrError(common.QItem{ID: 1, Priority: 2})
+	if !errors.Is(err, common.ErrPriorityOutOfRange) {
+		t.Fatalf("It should error, cause priority is out of range, but instead we got %v", err)
+	}
+	fsq.PushOrError(common.QItem{ID: 1, Priority: 0})
+	err = fsq.PushOrError(common.QItem{ID: 2, Priority: 0})
+	if !errors.Is(err, common.ErrQueueIsFull) {
+		t.Fatalf("It should error, cause queue is full, but instead we got %v", err)
+	}
+	fsq.Close()
+	err = fsq.PushOrError(common.QItem{ID: 3, Priority: 1})
+	if !errors.Is(err, common.ErrQueueIsClosed) {
+		t.Fatalf("It should error, cause queue is closed, but instead we got %v", err)
+	}
+}
+
+func TestFairShareQueueFollowsShares(t *testing.T) {
+	fsq, _ := NewFairShareQueue(2048, []int{1, 3}, time.Minute)
+	for i := 0; i < 100; i++ {
+		fsq.PushOrError(common.QItem{ID: uint64(i), Priority: i % 2})
+	}
+
+	counts := make([]int, 2)
+	for i := 0; i < 40; i++ {
+		item, _ := fsq.PopOrWaitTillClose()
+		counts[item.Priority]++
+	}
+	if counts[0] != 10 || counts[1] != 30 {
+		t.Fatalf("It should follow the 1:3 shares, but instead we got %v", counts)
+	}
+	fsq.Close()
+}
+
+func TestFairShareQueueSlidingWindow(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	fsq, _ := NewFairShareQueue(2048, []int{1, 1}, 10*time.Second,
+		WithClock(func() time.Time { return now }))
+
+	// only priority 1 has items for a while, so it gets served a lot
+	for i := 0; i < 5; i++ {
+		fsq.PushOrError(common.QItem{ID: uint64(i), Priority: 1})
+		fsq.PopOrWaitTillClose()
+	}
+
+	fsq.PushOrError(common.QItem{ID: 10, Priority: 1})
+	fsq.PushOrError(common.QItem{ID: 11, Priority: 0})
+	item, _ := fsq.PopOrWaitTillClose()
+	if item.ID != 11 {
+		t.Fatalf("Priority 0 is behind its share, so ID 11 should be popped, but instead we got %v", item)
+	}
+
+	// after the window passes, earlier service is forgotten, and ties go to higher priority
+	now = now.Add(11 * time.Second)
+	fsq.PushOrError(common.QItem{ID: 12, Priority: 0})
+	item, _ = fsq.PopOrWaitTillClose()
+	if item.ID != 10 {
+		t.Fatalf("Both are even after the window slides, so ID 10 should be popped, but instead we got %v", item)
+	}
+	fsq.Close()
+}
+
+func TestFairShareQueueCloseGracefully(t *testing.T) {
+	fsq, _ := NewFairShareQueue(2048, []int{1, 1}, time.Second)
+	fsq.PushOrError(common.QItem{ID: 1, Priority: 0})
+	fsq.CloseGracefully()
+	item, err := fsq.PopOrWaitTillClose()
+	if err != nil || item.ID != 1 {
+		t.Fatalf("It should still return the remaining item, but instead we got %v and %v", item, err)
+	}
+	_, err = fsq.PopOrWaitTillClose()
+	if err == nil || err != common.ErrQueueIsClosed {
+		t.Fatalf("It should be closed after draining, but instead we got %v", err)
+	}
+}
+
+func TestFairShareQueueWaitUntilEmpty(t *testing.T) {
+	fsq, _ := NewFairShareQueue(10, []int{1, 1}, time.Second)
+	fsq.PushOrError(common.QItem{ID: 1})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := fsq.WaitUntilEmpty(ctx); err == nil || err != context.DeadlineExceeded {
+		t.Fatalf("It should return context.DeadlineExceeded, cause nothing is popped, but instead we got %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fsq.WaitUntilEmpty(context.Background())
+	}()
+	fsq.PopOrWaitTillClose()
+	if err := <-done; err != nil {
+		t.Fatalf("It should return once the last item is popped, but instead we got %v", err)
+	}
+
+	fsq.PushOrError(common.QItem{ID: 2})
+	fsq.Close()
+	if err := fsq.WaitUntilEmpty(context.Background()); err == nil || err != common.ErrQueueIsClosed {
+		t.Fatalf("It should return ErrQueueIsClosed, cause closed with items left, but instead we got %v", err)
+	}
+}
+
+func TestFairShareQueueConformance(t *testing.T) {
+	queuetest.Run(t, func(sizeLimit int) (common.ExtendedQInterface, error) {
+		return NewFairShareQueue(sizeLimit, []int{1, 1}, time.Second)
+	})
+}
+
+func TestFairShareQueuePeek(t *testing.T) {
+	fsq, _ := NewFairShareQueue(10, []int{1, 1}, time.Second)
+	fsq.PushOrError(common.QItem{ID: 1, Priority: 0})
+	fsq.PushOrError(common.QItem{ID: 2, Priority: 1})
+	item, err := fsq.Peek()
+	if err != nil || item.ID != 2 {
+		t.Fatalf("It should peek ID 2, but instead we got %v and %v", item, err)
+	}
+	popped, _ := fsq.PopOrWaitTillClose()
+	if popped.ID != item.ID {
+		t.Fatalf("It should pop the peeked item, but instead we got %v", popped)
+	}
+	fsq.Close()
+}
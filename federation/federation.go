@@ -0,0 +1,100 @@
+package federation
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/aarondwi/prioritize"
+	"github.com/aarondwi/prioritize/common"
+)
+
+// Submitter is anything tasks can be submitted to, e.g. `*prioritize.Engine`,
+// or a client of a remote one.
+type Submitter interface {
+	Submit(ctx context.Context, priority int, fn prioritize.TaskFunc, arg interface{}) (*prioritize.Task, error)
+}
+
+// Federation submits to a local Engine, forwarding submissions it can't take
+// to a secondary one.
+//
+// A submission is forwarded when the local engine rejects it because its queue is full,
+// or, if configured, when the local engine is over its SLA
+// (see `WithMaxPressure` and `WithMaxQueueWait`).
+// Either way, the caller gets a `*prioritize.Task` to wait on, no matter which engine runs it.
+type Federation struct {
+	local        *prioritize.Engine
+	secondary    Submitter
+	maxPressure  float64
+	maxQueueWait time.Duration
+}
+
+// Option configures optional behavior of Federation
+type Option func(*Federation) error
+
+// WithMaxPressure forwards submissions while `local.Pressure()` is at least `p`,
+// which should be in (0, 1]
+func WithMaxPressure(p float64) Option {
+	return func(f *Federation) error {
+		if p <= 0 || p > 1 {
+			return common.ErrParamShouldBePositive
+		}
+		f.maxPressure = p
+		return nil
+	}
+}
+
+// WithMaxQueueWait forwards submissions while `local.AvgQueueWait()` is at least `d`
+func WithMaxQueueWait(d time.Duration) Option {
+	return func(f *Federation) error {
+		if d <= 0 {
+			return common.ErrParamShouldBePositive
+		}
+		f.maxQueueWait = d
+		return nil
+	}
+}
+
+// New creates Federation of `local`, overflowing to `secondary`
+func New(local *prioritize.Engine, secondary Submitter, opts ...Option) (*Federation, error) {
+	f := &Federation{
+		local:     local,
+		secondary: secondary,
+	}
+	for _, opt := range opts {
+		if err := opt(f); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// Submit submits to the local engine, or to the secondary one if the local one is overloaded.
+//
+// Other errors of the local engine (e.g. `prioritize.ErrAlreadyClosed`)
+// are returned as is, without forwarding.
+func (f *Federation) Submit(
+	ctx context.Context,
+	priority int,
+	fn prioritize.TaskFunc,
+	arg interface{}) (*prioritize.Task, error) {
+
+	if f.overSLA() {
+		return f.secondary.Submit(ctx, priority, fn, arg)
+	}
+	task, err := f.local.Submit(ctx, priority, fn, arg)
+	if errors.Is(err, common.ErrQueueIsFull) {
+		return f.secondary.Submit(ctx, priority, fn, arg)
+	}
+	return task, err
+}
+
+func (f *Federation) overSLA() bool {
+	if f.maxPressure > 0 && f.local.Pressure() >= f.maxPressure {
+		return true
+	}
+	if f.maxQueueWait > 0 && f.local.AvgQueueWait() >= f.maxQueueWait {
+		return true
+	}
+	return false
+}
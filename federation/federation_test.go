@@ -0,0 +1,99 @@
+package federation
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aarondwi/prioritize"
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/priority"
+)
+
+func TestNewErrors(t *testing.T) {
+	_, err := New(nil, nil, WithMaxPressure(1.5))
+	if err == nil || err != common.ErrParamShouldBePositive {
+		t.Fatalf("It should error, cause pressure can't be above 1, but instead we got %v", err)
+	}
+	_, err = New(nil, nil, WithMaxQueueWait(0))
+	if err == nil || err != common.ErrParamShouldBePositive {
+		t.Fatalf("It should error, cause queue wait can't be zero, but instead we got %v", err)
+	}
+}
+
+func TestFederationOverflowsWhenFull(t *testing.T) {
+	localQ, _ := priority.NewPriorityQueue(1, 8)
+	local, _ := prioritize.New(localQ, 1)
+	defer local.Close()
+	secondaryQ, _ := priority.NewPriorityQueue(2048, 8)
+	secondary, _ := prioritize.New(secondaryQ, 1)
+	defer secondary.Close()
+
+	f, err := New(local, secondary)
+	if err != nil {
+		t.Fatalf("It should not error, because all are correct parameters, but instead we got %v", err)
+	}
+
+	// keep the local worker busy, and fill its queue
+	block := make(chan struct{})
+	blocking := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		<-block
+		return arg, nil
+	}
+	first, _ := f.Submit(context.Background(), 0, blocking, "local")
+	for local.Len() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	second, _ := f.Submit(context.Background(), 0, blocking, "local")
+
+	fn := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		return arg, nil
+	}
+	overflow, err := f.Submit(context.Background(), 0, fn, "secondary")
+	if err != nil {
+		t.Fatalf("It should be forwarded to the secondary engine, but instead we got %v", err)
+	}
+	result, err := overflow.Result()
+	if err != nil || result.(string) != "secondary" {
+		t.Fatalf("It should get the result through the same task, but instead we got %v and %v", result, err)
+	}
+
+	close(block)
+	for _, task := range []*prioritize.Task{first, second} {
+		if result, err := task.Result(); err != nil || result.(string) != "local" {
+			t.Fatalf("Expected local, but instead we got %v and %v", result, err)
+		}
+	}
+}
+
+func TestFederationOverflowsWhenOverPressure(t *testing.T) {
+	localQ, _ := priority.NewPriorityQueue(2048, 8)
+	local, _ := prioritize.New(localQ, 1)
+	defer local.Close()
+	secondaryQ, _ := priority.NewPriorityQueue(2048, 8)
+	secondary, _ := prioritize.New(secondaryQ, 1)
+	defer secondary.Close()
+
+	f, _ := New(local, secondary, WithMaxPressure(1))
+
+	// the only local worker being busy means pressure 1
+	block := make(chan struct{})
+	local.Submit(context.Background(), 0, func(ctx context.Context, arg interface{}) (interface{}, error) {
+		<-block
+		return nil, nil
+	}, nil)
+	for local.Pressure() < 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	task, _ := f.Submit(context.Background(), 0, func(ctx context.Context, arg interface{}) (interface{}, error) {
+		return "secondary", nil
+	}, nil)
+	if local.Len() != 0 {
+		t.Fatal("It should not be queued locally while over pressure")
+	}
+	if result, err := task.Result(); err != nil || result.(string) != "secondary" {
+		t.Fatalf("Expected secondary, but instead we got %v and %v", result, err)
+	}
+	close(block)
+}
@@ -0,0 +1,47 @@
+package prioritize
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/aarondwi/prioritize/common"
+)
+
+// Flush waits until every task submitted so far is done, i.e. none is queued,
+// waiting to be retried, or taken by a worker, e.g. to know a burst of work has fully drained
+// before starting the next phase of a pipeline. It returns `ctx.Err()` once `ctx` is done first.
+//
+// Submissions made while waiting are waited for too, so stop submitting first.
+func (e *Engine) Flush(ctx context.Context) error {
+	// counted before checking, so `settled` can't miss us
+	atomic.AddInt32(&e.flushers, 1)
+	defer atomic.AddInt32(&e.flushers, -1)
+
+	e.flushMu.Lock()
+	defer e.flushMu.Unlock()
+	stop := common.WakeOnDone(ctx, e.flushed)
+	defer stop()
+	for !e.idle() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		e.flushed.Wait()
+	}
+	return nil
+}
+
+// idle returns true if no task is queued, or taken by a worker
+func (e *Engine) idle() bool {
+	return atomic.LoadInt64(&e.queued) == 0 && atomic.LoadInt64(&e.taken) == 0
+}
+
+// settled is called after a task leaves the queue, or a worker is done with one,
+// to wake those waiting in `Flush` once the engine is idle
+func (e *Engine) settled() {
+	if atomic.LoadInt32(&e.flushers) == 0 || !e.idle() {
+		return
+	}
+	e.flushMu.Lock()
+	e.flushed.Broadcast()
+	e.flushMu.Unlock()
+}
@@ -0,0 +1,45 @@
+package prioritize
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aarondwi/prioritize/priority"
+)
+
+func TestEngineFlush(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 4)
+	engine, _ := New(pq, 2)
+	defer engine.Close()
+
+	if err := engine.Flush(context.Background()); err != nil {
+		t.Fatalf("It should return right away, cause nothing is submitted, but instead we got %v", err)
+	}
+
+	gate := make(chan bool)
+	var done int32
+	fn := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		<-gate
+		atomic.AddInt32(&done, 1)
+		return nil, nil
+	}
+	for i := 0; i < 10; i++ {
+		engine.Submit(context.Background(), i%4, fn, nil)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := engine.Flush(ctx); err == nil || err != context.DeadlineExceeded {
+		t.Fatalf("It should return context.DeadlineExceeded, cause tasks are still running, but instead we got %v", err)
+	}
+
+	close(gate)
+	if err := engine.Flush(context.Background()); err != nil {
+		t.Fatalf("It should return once all tasks are done, but instead we got %v", err)
+	}
+	if n := atomic.LoadInt32(&done); n != 10 {
+		t.Fatalf("It should only return once all 10 tasks are done, but instead we got %d", n)
+	}
+}
@@ -0,0 +1,82 @@
+package prioritize
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/aarondwi/prioritize/common"
+)
+
+// SubmitAndForget is the same as `Submit`, but nobody can wait for the task,
+// so no `Task` is created, and its result and error are dropped.
+// It is meant for hot paths where nobody reads results, e.g. sending notifications.
+//
+// What the worker needs to run it is carried by its item, from a pool, so it does not allocate.
+// Per task features (e.g. `WithRetry`, `WithMaxQueueWait`,
+// `WithDeadletter`, or cancelling and reaping) don't apply to it,
+// but it is still skipped if its ctx is done by the time a worker takes it.
+func (e *Engine) SubmitAndForget(
+	ctx context.Context,
+	priority int,
+	fn TaskFunc,
+	arg interface{}) error {
+
+	select {
+	case <-e.closeChan:
+		e.onRejected(priority, ErrAlreadyClosed)
+		return ErrAlreadyClosed
+	default:
+	}
+	priority, err := e.admit(ctx, priority, arg)
+	if err != nil {
+		return err
+	}
+	if e.deadlineOrder {
+		priority = 0
+	}
+
+	ft := newForgottenTask(ctx, e.wrap(fn), arg)
+	item := common.QItem{ID: e.nextID(), Priority: priority, Payload: ft}
+	if deadline, ok := ctx.Deadline(); ok {
+		item.Deadline = deadline.UnixNano()
+	}
+	atomic.AddInt64(&e.queued, 1)
+	if err = e.push(ctx, item); err != nil {
+		e.untrackForgotten(ft)
+		e.onRejected(priority, err)
+		return err
+	}
+	e.onEnqueued(priority)
+	if e.maxWorkers > 0 {
+		e.maybeGrow()
+	}
+	return nil
+}
+
+// runForgotten runs a task from `SubmitAndForget` on the worker
+func (e *Engine) runForgotten(item common.QItem, ft forgottenTask) {
+	priority := item.Priority
+	if ft.ctx.Err() != nil {
+		e.onCompleted(priority, 0, ErrCtxAlreadyCancelled)
+		return
+	}
+	if !e.circuitAllows(ft.ctx) {
+		e.onCompleted(priority, 0, ErrCircuitOpen)
+		return
+	}
+	ctx := ft.ctx
+	var runSpan Span
+	if e.tracer != nil {
+		ctx, runSpan = e.tracer.Start(ctx, SpanRun, priority)
+	}
+	atomic.AddInt32(&e.busyWorker, 1)
+	e.inflight.start(item.ID, priority)
+	_, err := ft.fn(ctx, ft.arg)
+	e.inflight.stop(item.ID)
+	e.circuitRecord(ft.ctx, err)
+	atomic.AddInt32(&e.busyWorker, -1)
+	if runSpan != nil {
+		runSpan.End(err)
+	}
+	e.onCompleted(priority, 0, err)
+}
@@ -0,0 +1,58 @@
+package prioritize
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aarondwi/prioritize/priority"
+)
+
+func TestEngineSubmitAndForget(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	engine, _ := New(pq, 1)
+
+	done := make(chan interface{}, 2)
+	fn := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		done <- arg
+		return nil, errors.New("dropped")
+	}
+	if err := engine.SubmitAndForget(context.Background(), 0, fn, 1); err != nil {
+		t.Fatalf("It should not error, instead we got %v", err)
+	}
+	if arg := <-done; arg.(int) != 1 {
+		t.Fatalf("Expected 1, but instead we got %v", arg)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	engine.SubmitAndForget(ctx, 0, fn, 2)
+	// runs after the cancelled one is popped and skipped
+	task, _ := engine.Submit(context.Background(), 0,
+		func(ctx context.Context, arg interface{}) (interface{}, error) {
+			return arg, nil
+		}, 3)
+	task.Result()
+	if len(done) != 0 || engine.Len() != 0 {
+		t.Fatalf("It should be skipped, cause its ctx is done, but instead we got %d and %d", len(done), engine.Len())
+	}
+
+	engine.Close()
+	if err := engine.SubmitAndForget(context.Background(), 0, fn, 4); err == nil || err != ErrAlreadyClosed {
+		t.Fatalf("It should return ErrAlreadyClosed, instead we got %v", err)
+	}
+}
+
+func BenchmarkEngineSubmitAndForget(b *testing.B) {
+	pq, _ := priority.NewPriorityQueue(b.N+1, 8)
+	engine, _ := New(pq, 1)
+	defer engine.Close()
+	fn := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		return nil, nil
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		engine.SubmitAndForget(context.Background(), 0, fn, nil)
+	}
+}
@@ -0,0 +1,157 @@
+package prioritize
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/aarondwi/prioritize/common"
+)
+
+// ErrFullPolicyNotSupported is returned when a full policy is requested,
+// but the queue does not implement what it needs, see `FullPolicy`
+var ErrFullPolicyNotSupported = errors.New("The queue does not support this full policy")
+
+// ErrEvicted is returned by `Task.Result()` when the task is evicted from the queue
+// to make room for a higher priority one, see `FullEvict`
+var ErrEvicted = errors.New("Task is evicted by a higher priority one")
+
+// FullPolicy is what submissions do when the queue is full, see `WithFullPolicy`
+type FullPolicy int
+
+// The policies to pick from. Each of them applies to `Submit`, `SubmitWithCallback`,
+// `SubmitBatch`, `SubmitAndForget`, `SubmitAfterTasks` and retries.
+const (
+	// FullReject returns `common.ErrQueueIsFull` right away. This is the default.
+	FullReject FullPolicy = iota
+	// FullBlock waits for a slot, just like `SubmitOrWait`,
+	// and requires the queue to implement `common.CtxPusher`
+	FullBlock
+	// FullEvict makes room by evicting a lower priority task, whose `Result()` returns `ErrEvicted`.
+	// It requires the queue to implement `common.Evicter` (e.g. `priority.PriorityQueue`)
+	FullEvict
+	// FullShed probabilistically rejects low priorities once the queue fills up, before it is full,
+	// see `WithShedding`. It requires the queue to have `Len() int` and `Cap() int`.
+	FullShed
+)
+
+// the defaults of `FullShed`, when not set with `WithShedding`
+const (
+	defaultShedThreshold   = 0.5
+	defaultShedMinPriority = 1
+)
+
+// WithFullPolicy sets what submissions do when the queue is full.
+// It returns `ErrFullPolicyNotSupported` if the queue does not implement what `policy` needs.
+//
+// `FullShed` given here starts shedding priority 0 once the queue is half full.
+// Use `WithShedding` to pick other values.
+func WithFullPolicy(policy FullPolicy) Option {
+	return func(e *Engine) error {
+		switch policy {
+		case FullReject:
+		case FullBlock:
+			if _, ok := e.queue().(common.CtxPusher); !ok {
+				return ErrFullPolicyNotSupported
+			}
+		case FullEvict:
+			if _, ok := e.queue().(common.Evicter); !ok {
+				return ErrFullPolicyNotSupported
+			}
+		case FullShed:
+			return WithShedding(defaultShedThreshold, defaultShedMinPriority)(e)
+		default:
+			return ErrFullPolicyNotSupported
+		}
+		e.fullPolicy = policy
+		return nil
+	}
+}
+
+// WithShedding sets the `FullShed` policy, rejecting submissions below `minPriority`
+// with `common.ErrQueueIsFull` once the queue is more than `threshold` (in [0, 1)) full,
+// rejecting more the fuller it is. See `common.EarlyDrop`.
+func WithShedding(threshold float64, minPriority int) Option {
+	return func(e *Engine) error {
+		if _, ok := e.queue().(sizedQueue); !ok {
+			return ErrFullPolicyNotSupported
+		}
+		ed, err := common.NewEarlyDrop(threshold, minPriority)
+		if err != nil {
+			return err
+		}
+		e.fullPolicy = FullShed
+		e.shedder = &shedder{ed: ed}
+		return nil
+	}
+}
+
+type sizedQueue interface {
+	Len() int
+	Cap() int
+}
+
+// shedder guards the `common.EarlyDrop` of `FullShed`, which is not thread(goroutine)-safe
+type shedder struct {
+	mu sync.Mutex
+	ed *common.EarlyDrop
+}
+
+// push queues `item` following the full policy, see `WithFullPolicy`
+func (e *Engine) push(ctx context.Context, item common.QItem) error {
+	err := e.retrySwapped(func(q common.QInterface) error {
+		return e.pushTo(q, ctx, item)
+	})
+	if e.fullPolicy == FullBlock && errors.Is(err, common.ErrQueueIsClosed) {
+		return ErrAlreadyClosed
+	}
+	return err
+}
+
+func (e *Engine) pushTo(q common.QInterface, ctx context.Context, item common.QItem) error {
+	switch e.fullPolicy {
+	case FullBlock:
+		return q.(common.CtxPusher).PushOrWaitCtx(ctx, item)
+	case FullEvict:
+		evicted, ok, err := q.(common.Evicter).PushOrEvict(item)
+		if ok {
+			e.evict(evicted)
+		}
+		return err
+	case FullShed:
+		sized := q.(sizedQueue)
+		e.shedder.mu.Lock()
+		shed := e.shedder.ed.Reject(item.Priority, sized.Len(), sized.Cap())
+		e.shedder.mu.Unlock()
+		if shed {
+			return common.ErrQueueIsFull
+		}
+	}
+	return q.PushOrError(item)
+}
+
+// pushTask queues the item of `task`, the way it is submitted with.
+// Most are submitted with `push` itself, so they don't keep a closure of it.
+func (e *Engine) pushTask(task *Task, item common.QItem) error {
+	if task.push != nil {
+		return task.push(item)
+	}
+	return e.push(task.ctx, item)
+}
+
+// evict completes the task of an item evicted by the queue, see `FullEvict`
+func (e *Engine) evict(item common.QItem) {
+	task, ok := item.Payload.(*Task)
+	if !ok {
+		// forgotten, nobody waits for it
+		e.untrackForgotten(item.Payload.(*forgottenTask))
+		return
+	}
+	if !e.untrack(task) {
+		return
+	}
+	if task.expiry != nil {
+		task.expiry.Stop()
+	}
+	e.complete(task, nil, ErrEvicted)
+}
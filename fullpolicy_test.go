@@ -0,0 +1,128 @@
+package prioritize
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/edf"
+	"github.com/aarondwi/prioritize/priority"
+)
+
+// fillEngine keeps the only worker busy, and fills the queue of size 2 with priority 0 tasks
+func fillEngine(t *testing.T, engine *Engine, gate chan bool) []*Task {
+	fn := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		<-gate
+		return arg, nil
+	}
+	engine.Submit(context.Background(), 0, fn, nil)
+	for engine.Len() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	tasks := make([]*Task, 0, 2)
+	for i := 0; i < 2; i++ {
+		task, err := engine.Submit(context.Background(), 0, fn, i)
+		if err != nil {
+			t.Fatalf("It should not error, cause the queue is not full yet, instead we got %v", err)
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks
+}
+
+func TestEngineFullPolicy(t *testing.T) {
+	eq, _ := edf.NewEDFQueue(2)
+	_, err := New(eq, 1, WithFullPolicy(FullEvict))
+	if err == nil || err != ErrFullPolicyNotSupported {
+		t.Fatalf("It should error, cause edf queue can't evict, instead we got %v", err)
+	}
+
+	pq, _ := priority.NewPriorityQueue(2, 4)
+	engine, _ := New(pq, 1)
+	gate := make(chan bool)
+	fillEngine(t, engine, gate)
+	_, err = engine.Submit(context.Background(), 3, nil, nil)
+	if !errors.Is(err, common.ErrQueueIsFull) {
+		t.Fatalf("It should reject by default, instead we got %v", err)
+	}
+	close(gate)
+	engine.Close()
+
+	pq, _ = priority.NewPriorityQueue(2, 4)
+	engine, _ = New(pq, 1, WithFullPolicy(FullEvict))
+	gate = make(chan bool)
+	queued := fillEngine(t, engine, gate)
+	urgent, err := engine.Submit(context.Background(), 3, func(ctx context.Context, arg interface{}) (interface{}, error) {
+		return "urgent", nil
+	}, nil)
+	if err != nil {
+		t.Fatalf("It should evict a lower priority task, instead we got %v", err)
+	}
+	if _, err := queued[0].Result(); err == nil || err != ErrEvicted {
+		t.Fatalf("The oldest lowest priority task should be evicted, but instead we got %v", err)
+	}
+	close(gate)
+	if result, err := urgent.Result(); err != nil || result != "urgent" {
+		t.Fatalf("Expected urgent, but instead we got %v and %v", result, err)
+	}
+	engine.Close()
+
+	pq, _ = priority.NewPriorityQueue(2, 4)
+	engine, _ = New(pq, 1, WithFullPolicy(FullBlock))
+	gate = make(chan bool)
+	fillEngine(t, engine, gate)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		close(gate)
+	}()
+	blocked, err := engine.Submit(context.Background(), 3, func(ctx context.Context, arg interface{}) (interface{}, error) {
+		return nil, nil
+	}, nil)
+	if err != nil {
+		t.Fatalf("It should wait for a slot, instead we got %v", err)
+	}
+	blocked.Result()
+	engine.Close()
+}
+
+func TestEngineShedding(t *testing.T) {
+	_, err := New(nil, 1, WithShedding(0.5, 1))
+	if err == nil || err != ErrFullPolicyNotSupported {
+		t.Fatalf("It should error, cause there is no queue size to shed by, instead we got %v", err)
+	}
+
+	pq, _ := priority.NewPriorityQueue(100, 4)
+	engine, err := New(pq, 1, WithShedding(0, 2))
+	if err != nil {
+		t.Fatalf("It should not error, because all are correct parameters, instead we got %v", err)
+	}
+	defer engine.Close()
+	gate := make(chan bool)
+	defer close(gate)
+	fn := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		<-gate
+		return nil, nil
+	}
+	engine.Submit(context.Background(), 3, fn, nil)
+	for engine.Len() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	shed := 0
+	for i := 0; i < 99; i++ {
+		if _, err := engine.Submit(context.Background(), 3, fn, nil); err != nil {
+			t.Fatalf("High priorities should never be shed, but instead we got %v", err)
+		}
+		if _, err := engine.Submit(context.Background(), 0, fn, nil); errors.Is(err, common.ErrQueueIsFull) {
+			shed++
+		}
+		if engine.Len() >= 99 {
+			break
+		}
+	}
+	if shed == 0 {
+		t.Fatal("Low priorities should be shed as the queue fills up, but none is")
+	}
+}
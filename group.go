@@ -0,0 +1,87 @@
+package prioritize
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// TaskGroup is a group of tasks waited for together, like errgroup, but each with its own priority.
+// Once any of them fails, the rest are cancelled. Create it with `Engine.NewGroup`.
+//
+// This struct is thread(goroutine)-safe.
+type TaskGroup struct {
+	engine *Engine
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu    sync.Mutex
+	tasks []*Task
+	err   error
+}
+
+// NewGroup creates an empty TaskGroup.
+// Its tasks get a ctx derived from `ctx`, cancelled once any of them fails.
+func (e *Engine) NewGroup(ctx context.Context) *TaskGroup {
+	ctx, cancel := context.WithCancel(ctx)
+	return &TaskGroup{engine: e, ctx: ctx, cancel: cancel}
+}
+
+// Submit is the same as `Engine.Submit`, adding the task to the group.
+// It returns `ErrCtxAlreadyCancelled` once the group is cancelled.
+func (g *TaskGroup) Submit(priority int, fn TaskFunc, arg interface{}) (*Task, error) {
+	if g.ctx.Err() != nil {
+		return nil, ErrCtxAlreadyCancelled
+	}
+	g.wg.Add(1)
+	task, err := g.engine.SubmitWithCallback(g.ctx, priority, fn, arg, g.done)
+	if err != nil {
+		g.wg.Done()
+		return nil, err
+	}
+	g.mu.Lock()
+	g.tasks = append(g.tasks, task)
+	g.mu.Unlock()
+	return task, nil
+}
+
+// done is called once each task completes
+func (g *TaskGroup) done(result interface{}, err error) {
+	defer g.wg.Done()
+	if err == nil {
+		return
+	}
+	g.mu.Lock()
+	if g.err != nil {
+		g.mu.Unlock()
+		return
+	}
+	g.err = err
+	tasks := append([]*Task(nil), g.tasks...)
+	g.mu.Unlock()
+
+	g.cancel()
+	// so the queued ones complete right away, instead of once a worker takes them
+	for _, task := range tasks {
+		// including the failed one, whose Cancel may be what we are called from
+		if atomic.LoadInt32(&task.completed) == 0 {
+			g.engine.Cancel(task)
+		}
+	}
+}
+
+// Wait waits for all tasks submitted so far, and returns their results, in submission order.
+// Just like errgroup, the ctx of the group is cancelled afterwards.
+// The error is that of the first failing task, if any. Results of failed tasks are nil.
+func (g *TaskGroup) Wait() ([]interface{}, error) {
+	g.wg.Wait()
+	g.cancel()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	results := make([]interface{}, len(g.tasks))
+	for i, task := range g.tasks {
+		results[i], _ = task.Result()
+	}
+	return results, g.err
+}
@@ -0,0 +1,76 @@
+package prioritize
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aarondwi/prioritize/priority"
+)
+
+func TestTaskGroup(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	engine, _ := New(pq, 2)
+	defer engine.Close()
+
+	g := engine.NewGroup(context.Background())
+	for i := 0; i < 5; i++ {
+		g.Submit(i%8, func(ctx context.Context, arg interface{}) (interface{}, error) {
+			return arg.(int) * 2, nil
+		}, i)
+	}
+	results, err := g.Wait()
+	if err != nil || len(results) != 5 {
+		t.Fatalf("Expected 5 results, but instead we got %v and %v", results, err)
+	}
+	for i, result := range results {
+		if result.(int) != i*2 {
+			t.Fatalf("Expected results in submission order, but instead we got %v", results)
+		}
+	}
+}
+
+func TestTaskGroupCancelsOnFailure(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	engine, _ := New(pq, 1)
+	defer engine.Close()
+
+	gate := make(chan bool)
+	errFailing := errors.New("failing")
+	g := engine.NewGroup(context.Background())
+	running, _ := g.Submit(0, func(ctx context.Context, arg interface{}) (interface{}, error) {
+		<-gate
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}, nil)
+	queued, _ := g.Submit(0, func(ctx context.Context, arg interface{}) (interface{}, error) {
+		return 1, nil
+	}, nil)
+	// cancelling any member fails the group too
+	if err := queued.Cancel(); err != nil {
+		t.Fatalf("It should not error, instead we got %v", err)
+	}
+	close(gate)
+
+	results, err := g.Wait()
+	if err == nil || err != ErrTaskCancelled {
+		t.Fatalf("Expected the first error, but instead we got %v", err)
+	}
+	if results[0] != nil || results[1] != nil {
+		t.Fatalf("Expected no results, but instead we got %v", results)
+	}
+	if _, err := running.Result(); err == nil {
+		t.Fatal("The running task should be cancelled, but instead it succeeded")
+	}
+	if _, err := g.Submit(0, nil, nil); err == nil || err != ErrCtxAlreadyCancelled {
+		t.Fatalf("It should reject new tasks once cancelled, but instead we got %v", err)
+	}
+
+	g = engine.NewGroup(context.Background())
+	g.Submit(0, func(ctx context.Context, arg interface{}) (interface{}, error) {
+		return nil, errFailing
+	}, nil)
+	if _, err := g.Wait(); err == nil || err != errFailing {
+		t.Fatalf("Expected errFailing, but instead we got %v", err)
+	}
+}
@@ -0,0 +1,607 @@
+package heap
+
+import (
+	"container/heap"
+	"context"
+	"math"
+	"sync"
+
+	"github.com/aarondwi/prioritize/common"
+)
+
+// HeapPriorityQueue is a queue which always returns the highest priority first,
+// just like `priority.PriorityQueue`, but without limiting the range of priority.
+//
+// As priorities don't fit into a fixed number of bands, this one is heap-based,
+// so push and pop are O(log n) instead of O(number of priority).
+// Items of equal priority are still returned in the order they are pushed.
+type HeapPriorityQueue struct {
+	// synchronization primitive
+	// read-only calls (e.g. Len) only take the read lock,
+	// so they don't contend with each other
+	mu       *sync.RWMutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	// broadcast once the size reaches 0, see `WaitUntilEmpty`
+	emptied *sync.Cond
+
+	items itemHeap
+
+	// simple metadata
+	sizeLimit int
+	running   bool
+	closed    chan struct{}
+	draining  bool
+	paused    bool
+
+	// nil means no callback, see `WithWatermarks`
+	watermarks *common.Watermarks
+}
+
+// Option configures optional behavior of HeapPriorityQueue
+type Option func(*HeapPriorityQueue) error
+
+// WithLess replaces how items are ordered: `less(a, b)` should return true if a goes before b.
+//
+// This allows ranking by something not fitting `Priority`, e.g. a float score or cost
+// kept by the caller for each item ID. Items `less` considers equal are still returned in push order.
+// Note that `less` is called while holding the queue lock, so it should be fast,
+// and never call the queue itself.
+// For float scores, `FloatPriority` can also encode them into `Priority` directly.
+func WithLess(less func(a, b common.QItem) bool) Option {
+	return func(hq *HeapPriorityQueue) error {
+		hq.items.less = less
+		return nil
+	}
+}
+
+// WithWatermarks calls `onHigh` once the queue holds `high` items,
+// and `onLow` once it then goes down to `low` (in [0, high)) items,
+// e.g. to pause ingestion upstream and resume it later. See `common.Watermarks`.
+//
+// Both are called while holding the queue lock, right as the size changes,
+// so they should be fast (e.g. flipping a flag), and never call the queue itself.
+func WithWatermarks(high, low int, onHigh, onLow func(size int)) Option {
+	return func(hq *HeapPriorityQueue) error {
+		w, err := common.NewWatermarks(high, low, onHigh, onLow)
+		if err != nil {
+			return err
+		}
+		hq.watermarks = w
+		return nil
+	}
+}
+
+// NewHeapPriorityQueue creates our heap-based priority queue, which caps at sizeLimit
+func NewHeapPriorityQueue(sizeLimit int, opts ...Option) (*HeapPriorityQueue, error) {
+	if sizeLimit <= 0 {
+		return nil, common.ErrParamShouldBePositive
+	}
+
+	mu := &sync.RWMutex{}
+	hq := &HeapPriorityQueue{
+		mu:       mu,
+		notEmpty: sync.NewCond(mu),
+		notFull:  sync.NewCond(mu),
+		emptied:  sync.NewCond(mu),
+		items: itemHeap{
+			arr:  make([]common.QItem, 0, sizeLimit),
+			seqs: make([]uint64, 0, sizeLimit),
+			less: higherPriorityFirst,
+		},
+		sizeLimit: sizeLimit,
+		running:   true,
+		closed:    make(chan struct{}),
+	}
+	for _, opt := range opts {
+		if err := opt(hq); err != nil {
+			return nil, err
+		}
+	}
+	return hq, nil
+}
+
+func higherPriorityFirst(a, b common.QItem) bool {
+	return a.Priority > b.Priority
+}
+
+// FloatPriority encodes `score` into an int, keeping the order,
+// so a higher score is popped first with the default ordering.
+// It needs int to be 64-bit.
+func FloatPriority(score float64) int {
+	bits := math.Float64bits(score)
+	if bits>>63 == 1 {
+		// negative, flipping all bits reverses their order too
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+	return int(bits ^ (1 << 63))
+}
+
+// PushOrError put the item into the queue, and returns error if no slot available
+func (hq *HeapPriorityQueue) PushOrError(item common.QItem) error {
+	hq.mu.Lock()
+	defer hq.mu.Unlock()
+	if err := hq.admitLocked(); err != nil {
+		return hq.queueErrorLocked("PushOrError", item, err)
+	}
+	hq.pushLocked(item)
+	return nil
+}
+
+// PushBatchOrError pushes `items` in order, only taking the lock once.
+// It stops at the first item which can't be pushed, returning how many are pushed, and its error.
+func (hq *HeapPriorityQueue) PushBatchOrError(items []common.QItem) (int, error) {
+	hq.mu.Lock()
+	defer hq.mu.Unlock()
+	for i, item := range items {
+		if err := hq.admitLocked(); err != nil {
+			return i, hq.queueErrorLocked("PushBatchOrError", item, err)
+		}
+		hq.pushLocked(item)
+	}
+	return len(items), nil
+}
+
+// PushOrWaitTillClose put the item into the queue, waiting while no slot is available,
+// instead of returning `common.ErrQueueIsFull`, so producers get backpressure.
+// It returns `common.ErrQueueIsClosed` if the queue is closed in the meantime.
+func (hq *HeapPriorityQueue) PushOrWaitTillClose(item common.QItem) error {
+	return hq.PushOrWaitCtx(context.Background(), item)
+}
+
+// PushOrWaitCtx is the same as PushOrWaitTillClose,
+// but also returns `ctx.Err()` once `ctx` is done while waiting for a slot
+func (hq *HeapPriorityQueue) PushOrWaitCtx(ctx context.Context, item common.QItem) error {
+	hq.mu.Lock()
+	defer hq.mu.Unlock()
+	err := hq.admitLocked()
+	if err == common.ErrQueueIsFull {
+		defer common.WakeOnDone(ctx, hq.notFull)()
+	}
+	for err == common.ErrQueueIsFull {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		hq.notFull.Wait()
+		err = hq.admitLocked()
+	}
+	if err != nil {
+		return hq.queueErrorLocked("PushOrWaitCtx", item, err)
+	}
+	hq.pushLocked(item)
+	return nil
+}
+
+// admitLocked returns the error a push should fail with, if any
+func (hq *HeapPriorityQueue) admitLocked() error {
+	if !hq.running || hq.draining {
+		return common.ErrQueueIsClosed
+	}
+	if hq.items.Len() == hq.sizeLimit {
+		return common.ErrQueueIsFull
+	}
+	return nil
+}
+
+// queueErrorLocked adds what the queue looks like right now to `err`, see `common.QueueError`
+func (hq *HeapPriorityQueue) queueErrorLocked(op string, item common.QItem, err error) error {
+	return &common.QueueError{Op: op, Priority: item.Priority, Size: hq.items.Len(), Limit: hq.sizeLimit, Err: err}
+}
+
+func (hq *HeapPriorityQueue) pushLocked(item common.QItem) {
+	heap.Push(&hq.items, item)
+	hq.sizeChangedLocked()
+	hq.notEmpty.Signal()
+}
+
+// sizeChangedLocked lets the watermarks, if any, see the new size,
+// and wakes those waiting for hq to be empty
+func (hq *HeapPriorityQueue) sizeChangedLocked() {
+	if hq.items.Len() == 0 {
+		hq.emptied.Broadcast()
+	}
+	if hq.watermarks != nil {
+		hq.watermarks.Update(hq.items.Len())
+	}
+}
+
+// PopOrWaitTillClose returns the highest priority item, or waits if none exists
+func (hq *HeapPriorityQueue) PopOrWaitTillClose() (common.QItem, error) {
+	return hq.PopOrWaitCtx(context.Background())
+}
+
+// PopOrWaitCtx is the same as PopOrWaitTillClose,
+// but also returns `ctx.Err()` once `ctx` is done while waiting
+func (hq *HeapPriorityQueue) PopOrWaitCtx(ctx context.Context) (common.QItem, error) {
+	hq.mu.Lock()
+	defer hq.mu.Unlock()
+	if err := hq.waitLocked(ctx); err != nil {
+		return common.MinQItem, err
+	}
+	result := heap.Pop(&hq.items).(common.QItem)
+	hq.sizeChangedLocked()
+	hq.notFull.Signal()
+	if hq.draining && hq.items.Len() == 0 {
+		hq.closeLocked()
+	}
+	return result, nil
+}
+
+// TryPop is the non-blocking version of PopOrWaitTillClose.
+// It returns `common.ErrQueueIsEmpty` right away if no item can be popped now,
+// including when the queue is paused.
+func (hq *HeapPriorityQueue) TryPop() (common.QItem, error) {
+	hq.mu.Lock()
+	defer hq.mu.Unlock()
+	if !hq.running {
+		return common.MinQItem, common.ErrQueueIsClosed
+	}
+	if hq.items.Len() == 0 || hq.paused {
+		return common.MinQItem, common.ErrQueueIsEmpty
+	}
+	result := heap.Pop(&hq.items).(common.QItem)
+	hq.sizeChangedLocked()
+	hq.notFull.Signal()
+	if hq.draining && hq.items.Len() == 0 {
+		hq.closeLocked()
+	}
+	return result, nil
+}
+
+// Peek returns the item the next pop returns, without removing it,
+// or `common.ErrQueueIsEmpty` if hq is empty.
+func (hq *HeapPriorityQueue) Peek() (common.QItem, error) {
+	hq.mu.RLock()
+	defer hq.mu.RUnlock()
+	if !hq.running {
+		return common.MinQItem, common.ErrQueueIsClosed
+	}
+	if hq.items.Len() == 0 {
+		return common.MinQItem, common.ErrQueueIsEmpty
+	}
+	return hq.items.arr[0], nil
+}
+
+// PopBatchOrWaitTillClose waits like PopOrWaitTillClose,
+// and then returns up to `max` items in the same order as popping them one by one,
+// only taking the lock once.
+func (hq *HeapPriorityQueue) PopBatchOrWaitTillClose(max int) ([]common.QItem, error) {
+	hq.mu.Lock()
+	defer hq.mu.Unlock()
+	if err := hq.waitLocked(context.Background()); err != nil {
+		return nil, err
+	}
+	results := make([]common.QItem, 0, max)
+	for len(results) < max && hq.items.Len() > 0 {
+		results = append(results, heap.Pop(&hq.items).(common.QItem))
+	}
+	hq.sizeChangedLocked()
+	hq.notFull.Broadcast()
+	if hq.draining && hq.items.Len() == 0 {
+		hq.closeLocked()
+	}
+	return results, nil
+}
+
+// waitLocked waits until there is an item,
+// or returns error if the queue is closed, or `ctx` is done, in the meantime.
+func (hq *HeapPriorityQueue) waitLocked(ctx context.Context) error {
+	if !hq.running {
+		return common.ErrQueueIsClosed
+	}
+	if hq.items.Len() == 0 || hq.paused {
+		defer common.WakeOnDone(ctx, hq.notEmpty)()
+	}
+	for hq.items.Len() == 0 || hq.paused {
+		if hq.draining && hq.items.Len() == 0 {
+			hq.closeLocked()
+			return common.ErrQueueIsClosed
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		hq.notEmpty.Wait()
+		// double check, ensuring see the changes after wait call
+		if !hq.running {
+			return common.ErrQueueIsClosed
+		}
+	}
+	return nil
+}
+
+// PeekTopK returns up to `k` items which would be popped next, in the same order,
+// without removing them. It returns an empty result if `k` is not positive.
+//
+// It only walks the top of the heap, so it is O(k log k), no matter how many items are queued.
+func (hq *HeapPriorityQueue) PeekTopK(k int) []common.QItem {
+	hq.mu.RLock()
+	defer hq.mu.RUnlock()
+	if k > hq.items.Len() {
+		k = hq.items.Len()
+	}
+	if k <= 0 {
+		return []common.QItem{}
+	}
+	results := make([]common.QItem, 0, k)
+
+	// the next item is always either the root,
+	// or a child of an item already taken
+	candidates := &indexHeap{items: &hq.items, indexes: []int{0}}
+	for len(results) < k {
+		i := heap.Pop(candidates).(int)
+		results = append(results, hq.items.arr[i])
+		for _, child := range []int{2*i + 1, 2*i + 2} {
+			if child < hq.items.Len() {
+				heap.Push(candidates, child)
+			}
+		}
+	}
+	return results
+}
+
+// Snapshot returns a copy of all items in the queue, in the order they would be popped,
+// without removing them, e.g. for debugging (see `common.DebugDump`). It is O(n log n).
+func (hq *HeapPriorityQueue) Snapshot() []common.QItem {
+	return hq.PeekTopK(math.MaxInt32)
+}
+
+// Drain removes and returns all items in the queue at once, in the order they would be popped,
+// e.g. to persist or requeue them elsewhere before calling Close.
+// It returns nil if the queue is already closed.
+func (hq *HeapPriorityQueue) Drain() []common.QItem {
+	hq.mu.Lock()
+	defer hq.mu.Unlock()
+	if !hq.running {
+		return nil
+	}
+
+	results := make([]common.QItem, 0, hq.items.Len())
+	for hq.items.Len() > 0 {
+		results = append(results, heap.Pop(&hq.items).(common.QItem))
+	}
+	hq.sizeChangedLocked()
+	hq.notFull.Broadcast()
+	if hq.draining {
+		hq.closeLocked()
+	}
+	return results
+}
+
+// Remove takes out the item with `id`, freeing its slot,
+// or returns `common.ErrItemNotFound` if it is not in the queue anymore.
+//
+// Finding the item is O(n).
+func (hq *HeapPriorityQueue) Remove(id uint64) (common.QItem, error) {
+	hq.mu.Lock()
+	defer hq.mu.Unlock()
+	if !hq.running {
+		return common.MinQItem, common.ErrQueueIsClosed
+	}
+
+	for i := range hq.items.arr {
+		if hq.items.arr[i].ID == id {
+			result := heap.Remove(&hq.items, i).(common.QItem)
+			hq.sizeChangedLocked()
+			hq.notFull.Signal()
+			if hq.draining && hq.items.Len() == 0 {
+				hq.closeLocked()
+			}
+			return result, nil
+		}
+	}
+	return common.MinQItem, common.ErrItemNotFound
+}
+
+// UpdatePriority moves the item with `id` to `newPriority`,
+// or returns `common.ErrItemNotFound` if it is not in the queue anymore.
+func (hq *HeapPriorityQueue) UpdatePriority(id uint64, newPriority int) error {
+	hq.mu.Lock()
+	defer hq.mu.Unlock()
+	if !hq.running {
+		return common.ErrQueueIsClosed
+	}
+
+	for i := range hq.items.arr {
+		if hq.items.arr[i].ID == id {
+			if hq.items.arr[i].Priority == newPriority {
+				// keeps its place among equal items
+				return nil
+			}
+			hq.items.arr[i].Priority = newPriority
+			// same as moving it to the tail of the new band in `priority.PriorityQueue`
+			hq.items.seqs[i] = hq.items.nextSeq
+			hq.items.nextSeq++
+			heap.Fix(&hq.items, i)
+			return nil
+		}
+	}
+	return common.ErrItemNotFound
+}
+
+// Len returns the number of items currently in the queue
+func (hq *HeapPriorityQueue) Len() int {
+	hq.mu.RLock()
+	defer hq.mu.RUnlock()
+	return hq.items.Len()
+}
+
+// Cap returns the maximum number of items the queue can hold
+func (hq *HeapPriorityQueue) Cap() int {
+	return hq.sizeLimit
+}
+
+// DepthPerPriority always returns nil, as priorities are not limited to a range
+// which could index the result. Use Len instead.
+func (hq *HeapPriorityQueue) DepthPerPriority() []int {
+	return nil
+}
+
+// Pause makes pops wait, without erroring, until Resume is called.
+// Pushes are still accepted in the meantime, and Drain still takes items.
+// After CloseGracefully, remaining items are still only popped once resumed.
+func (hq *HeapPriorityQueue) Pause() {
+	hq.mu.Lock()
+	hq.paused = true
+	hq.mu.Unlock()
+}
+
+// Resume lets pops take items from the queue again, waking those waiting because of Pause
+func (hq *HeapPriorityQueue) Resume() {
+	hq.mu.Lock()
+	hq.paused = false
+	hq.notEmpty.Broadcast()
+	hq.mu.Unlock()
+}
+
+// Close is the same as CloseNow
+func (hq *HeapPriorityQueue) Close() error {
+	return hq.CloseNow()
+}
+
+// CloseNow closes HeapPriorityQueue, preventing it from accepting new request.
+// Remaining items are dropped, and waiting pops return immediately.
+// Closing it again does nothing, only returning `common.ErrQueueIsClosed`.
+func (hq *HeapPriorityQueue) CloseNow() error {
+	hq.mu.Lock()
+	defer hq.mu.Unlock()
+	if !hq.running {
+		return common.ErrQueueIsClosed
+	}
+	hq.closeLocked()
+	return nil
+}
+
+// CloseGracefully stops HeapPriorityQueue from accepting new request,
+// but pops keep returning the remaining items.
+// Once it is empty, it is closed the same way as CloseNow.
+func (hq *HeapPriorityQueue) CloseGracefully() {
+	hq.mu.Lock()
+	if hq.running {
+		hq.draining = true
+		// waiting pushes should return now
+		hq.notFull.Broadcast()
+		if hq.items.Len() == 0 {
+			hq.closeLocked()
+		}
+	}
+	hq.mu.Unlock()
+}
+
+// WaitUntilEmpty waits until HeapPriorityQueue holds no item, e.g. to know a burst of work is all popped,
+// and returns nil. It returns `common.ErrQueueIsClosed` if HeapPriorityQueue is closed with items left,
+// or `ctx.Err()` once `ctx` is done while waiting.
+func (hq *HeapPriorityQueue) WaitUntilEmpty(ctx context.Context) error {
+	hq.mu.Lock()
+	defer hq.mu.Unlock()
+	if hq.items.Len() > 0 {
+		defer common.WakeOnDone(ctx, hq.emptied)()
+	}
+	for hq.items.Len() > 0 {
+		if !hq.running {
+			return common.ErrQueueIsClosed
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		hq.emptied.Wait()
+	}
+	return nil
+}
+
+// IsClosed returns whether HeapPriorityQueue is closed, after which no item is popped anymore
+func (hq *HeapPriorityQueue) IsClosed() bool {
+	hq.mu.RLock()
+	defer hq.mu.RUnlock()
+	return !hq.running
+}
+
+// Closed returns a channel which is closed once HeapPriorityQueue is closed,
+// so other goroutines can select on it
+func (hq *HeapPriorityQueue) Closed() <-chan struct{} {
+	return hq.closed
+}
+
+func (hq *HeapPriorityQueue) closeLocked() {
+	if !hq.running {
+		// already closed, hq.closed can't be closed twice
+		return
+	}
+	hq.running = false
+	close(hq.closed)
+	hq.notEmpty.Broadcast()
+	hq.notFull.Broadcast()
+	hq.emptied.Broadcast()
+}
+
+// itemHeap implements `container/heap.Interface`,
+// with the item `less` says goes first on top.
+//
+// Heap operations don't keep the order of equal items,
+// so each item also gets a sequence number when pushed, used as the tiebreaker.
+type itemHeap struct {
+	arr     []common.QItem
+	seqs    []uint64
+	nextSeq uint64
+	less    func(a, b common.QItem) bool
+}
+
+func (h *itemHeap) Len() int { return len(h.arr) }
+
+func (h *itemHeap) Less(i, j int) bool {
+	if h.less(h.arr[i], h.arr[j]) {
+		return true
+	}
+	if h.less(h.arr[j], h.arr[i]) {
+		return false
+	}
+	return h.seqs[i] < h.seqs[j]
+}
+
+func (h *itemHeap) Swap(i, j int) {
+	h.arr[i], h.arr[j] = h.arr[j], h.arr[i]
+	h.seqs[i], h.seqs[j] = h.seqs[j], h.seqs[i]
+}
+
+func (h *itemHeap) Push(x interface{}) {
+	h.arr = append(h.arr, x.(common.QItem))
+	h.seqs = append(h.seqs, h.nextSeq)
+	h.nextSeq++
+}
+
+func (h *itemHeap) Pop() interface{} {
+	n := len(h.arr)
+	item := h.arr[n-1]
+	// so its payload can be garbage collected
+	h.arr[n-1] = common.QItem{}
+	h.arr = h.arr[:n-1]
+	h.seqs = h.seqs[:n-1]
+	return item
+}
+
+// indexHeap is a heap of indexes into `items`, ordered the same way as `items`.
+// Used to walk the top of `items` without modifying it.
+type indexHeap struct {
+	items   *itemHeap
+	indexes []int
+}
+
+func (h *indexHeap) Len() int { return len(h.indexes) }
+
+func (h *indexHeap) Less(i, j int) bool {
+	return h.items.Less(h.indexes[i], h.indexes[j])
+}
+
+func (h *indexHeap) Swap(i, j int) { h.indexes[i], h.indexes[j] = h.indexes[j], h.indexes[i] }
+
+func (h *indexHeap) Push(x interface{}) {
+	h.indexes = append(h.indexes, x.(int))
+}
+
+func (h *indexHeap) Pop() interface{} {
+	n := len(h.indexes)
+	i := h.indexes[n-1]
+	h.indexes = h.indexes[:n-1]
+	return i
+}
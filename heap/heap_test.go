@@ -0,0 +1,361 @@
+package heap
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/queuetest"
+)
+
+func TestNewHeapPriorityQueueError(t *testing.T) {
+	_, err := NewHeapPriorityQueue(0)
+	if err == nil || err != common.ErrParamShouldBePositive {
+		t.Fatalf("It should error, cause sizeLimit can't be zero, but instead we got %v", err)
+	}
+}
+
+func TestHeapPriorityQueue(t *testing.T) {
+	hq, _ := NewHeapPriorityQueue(3)
+	hq.PushOrError(common.QItem{ID: 1, Priority: -5})
+	hq.PushOrError(common.QItem{ID: 2, Priority: 1000})
+	hq.PushOrError(common.QItem{ID: 3, Priority: 7})
+	err := hq.PushOrError(common.QItem{ID: 4, Priority: 1})
+	if !errors.Is(err, common.ErrQueueIsFull) {
+		t.Fatalf("It should error, cause queue is full, but instead we got %v", err)
+	}
+
+	err = hq.UpdatePriority(1, 10)
+	if err != nil {
+		t.Fatalf("It should not error, cause ID 1 is queued, but instead we got %v", err)
+	}
+	err = hq.UpdatePriority(4, 10)
+	if err == nil || err != common.ErrItemNotFound {
+		t.Fatalf("It should error, cause ID 4 is not queued, but instead we got %v", err)
+	}
+
+	expected := []uint64{2, 1, 3}
+	for _, e := range expected {
+		item, err := hq.PopOrWaitTillClose()
+		if err != nil || item.ID != e {
+			t.Fatalf("Expected ID %d, but instead we got %v and %v", e, item, err)
+		}
+	}
+
+	hq.PushOrError(common.QItem{ID: 5, Priority: 1})
+	hq.CloseGracefully()
+	if _, err = hq.Remove(5); err != nil {
+		t.Fatalf("It should remove ID 5, but instead we got %v", err)
+	}
+	_, err = hq.PopOrWaitTillClose()
+	if err == nil || err != common.ErrQueueIsClosed {
+		t.Fatalf("It should be closed after draining, but instead we got %v", err)
+	}
+}
+
+func TestHeapPriorityQueueIsStable(t *testing.T) {
+	hq, _ := NewHeapPriorityQueue(2048)
+	hq.PushOrError(common.QItem{ID: 1000, Priority: 0})
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		hq.PushOrError(common.QItem{ID: uint64(i), Priority: r.Intn(5)})
+	}
+	// moved to the back of priority 4, as if just pushed
+	hq.UpdatePriority(1000, 4)
+
+	peeked := hq.PeekTopK(1001)
+	last := common.QItem{Priority: 5}
+	for i := 0; i < 1001; i++ {
+		item, _ := hq.PopOrWaitTillClose()
+		if item.ID != peeked[i].ID {
+			t.Fatalf("PeekTopK should follow pop order, but at %d we got %v and %v", i, peeked[i], item)
+		}
+		if item.Priority == last.Priority && item.ID < last.ID {
+			t.Fatalf("Equal priorities should be in push order, but %v came after %v", item, last)
+		}
+		last = item
+	}
+	hq.Close()
+}
+
+func TestHeapPriorityQueueUpdateToSamePriority(t *testing.T) {
+	hq, _ := NewHeapPriorityQueue(2048)
+	hq.PushOrError(common.QItem{ID: 1, Priority: 2})
+	hq.PushOrError(common.QItem{ID: 2, Priority: 2})
+	// unchanged, so it keeps its place, instead of going behind ID 2
+	if err := hq.UpdatePriority(1, 2); err != nil {
+		t.Fatalf("It should not error, cause ID 1 is queued, but instead we got %v", err)
+	}
+
+	for _, e := range []uint64{1, 2} {
+		item, _ := hq.PopOrWaitTillClose()
+		if item.ID != e {
+			t.Fatalf("Expected ID %d, but instead we got %v", e, item)
+		}
+	}
+	hq.Close()
+}
+
+func TestHeapPriorityQueuePeekTopK(t *testing.T) {
+	hq, _ := NewHeapPriorityQueue(2048)
+	if items := hq.PeekTopK(3); len(items) != 0 {
+		t.Fatalf("It should be empty, but instead we got %v", items)
+	}
+
+	hq.PushOrError(common.QItem{ID: 1000, Priority: 1})
+	if items := hq.PeekTopK(-1); len(items) != 0 {
+		t.Fatalf("It should be empty, cause k is negative, but instead we got %v", items)
+	}
+	hq.PopOrWaitTillClose()
+
+	for i, p := range rand.Perm(100) {
+		hq.PushOrError(common.QItem{ID: uint64(i), Priority: p})
+	}
+	top := hq.PeekTopK(10)
+	if len(top) != 10 || hq.Len() != 100 {
+		t.Fatalf("It should return 10 items without removing them, but instead we got %d and %d", len(top), hq.Len())
+	}
+
+	popped, _ := hq.PopBatchOrWaitTillClose(10)
+	for i := range top {
+		if top[i] != popped[i] || top[i].Priority != 99-i {
+			t.Fatalf("Peeked items should be in popping order, but instead we got %v and %v", top, popped)
+		}
+	}
+
+	if items := hq.PeekTopK(1000); len(items) != 90 {
+		t.Fatalf("It should return all 90 remaining items, but instead we got %d", len(items))
+	}
+	hq.Close()
+}
+
+func TestHeapPriorityQueueWithLess(t *testing.T) {
+	// lower cost first, with costs kept by the caller
+	costs := map[uint64]float64{1: 2.5, 2: 0.1, 3: 1.75}
+	hq, _ := NewHeapPriorityQueue(2048, WithLess(func(a, b common.QItem) bool {
+		return costs[a.ID] < costs[b.ID]
+	}))
+	for id := range costs {
+		hq.PushOrError(common.QItem{ID: id})
+	}
+
+	expected := []uint64{2, 3, 1}
+	top := hq.PeekTopK(3)
+	for i, e := range expected {
+		item, _ := hq.PopOrWaitTillClose()
+		if item.ID != e || top[i].ID != e {
+			t.Fatalf("Expected ID %d, but instead we got %v and %v", e, item, top[i])
+		}
+	}
+	hq.Close()
+}
+
+func TestFloatPriority(t *testing.T) {
+	scores := []float64{-1e9, -2.5, -0.1, 0, 0.1, 2.5, 1e9}
+	for i := 1; i < len(scores); i++ {
+		if FloatPriority(scores[i-1]) >= FloatPriority(scores[i]) {
+			t.Fatalf("Order should be kept, but %v is not below %v", scores[i-1], scores[i])
+		}
+	}
+}
+
+func TestHeapPriorityQueuePushOrWaitTillClose(t *testing.T) {
+	hq, _ := NewHeapPriorityQueue(1)
+	hq.PushOrError(common.QItem{ID: 1, Priority: 1})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- hq.PushOrWaitTillClose(common.QItem{ID: 2, Priority: 2})
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("It should wait, cause the queue is full, but instead it returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	item, _ := hq.PopOrWaitTillClose()
+	if item.ID != 1 {
+		t.Fatalf("Expected ID 1, but instead we got %v", item)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("It should push once a slot is available, but instead we got %v", err)
+	}
+
+	go func() {
+		done <- hq.PushOrWaitTillClose(common.QItem{ID: 3, Priority: 2})
+	}()
+	time.Sleep(50 * time.Millisecond)
+	hq.Close()
+	if err := <-done; !errors.Is(err, common.ErrQueueIsClosed) {
+		t.Fatalf("It should return ErrQueueIsClosed, but instead we got %v", err)
+	}
+}
+
+func TestHeapPriorityQueuePopOrWaitCtx(t *testing.T) {
+	hq, _ := NewHeapPriorityQueue(8)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := hq.PopOrWaitCtx(ctx)
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	if err := <-done; err == nil || err != context.Canceled {
+		t.Fatalf("It should return context.Canceled, but instead we got %v", err)
+	}
+
+	// a cancelled pop should not take anything pushed later
+	hq.PushOrError(common.QItem{ID: 1, Priority: 5})
+	item, err := hq.PopOrWaitTillClose()
+	if err != nil || item.ID != 1 {
+		t.Fatalf("Expected ID 1, but instead we got %v and %v", item, err)
+	}
+	hq.Close()
+}
+
+func TestHeapPriorityQueueDrain(t *testing.T) {
+	hq, _ := NewHeapPriorityQueue(8)
+	hq.PushOrError(common.QItem{ID: 1, Priority: -5})
+	hq.PushOrError(common.QItem{ID: 2, Priority: 100})
+	hq.PushOrError(common.QItem{ID: 3, Priority: 7})
+
+	items := hq.Drain()
+	if len(items) != 3 || items[0].ID != 2 || items[1].ID != 3 || items[2].ID != 1 {
+		t.Fatalf("Expected IDs 2, 3, 1, but instead we got %v", items)
+	}
+	hq.CloseGracefully()
+	if _, err := hq.PopOrWaitTillClose(); err == nil || err != common.ErrQueueIsClosed {
+		t.Fatalf("It should return ErrQueueIsClosed, cause drained, but instead we got %v", err)
+	}
+}
+
+func TestHeapPriorityQueuePauseResume(t *testing.T) {
+	hq, _ := NewHeapPriorityQueue(8)
+	hq.Pause()
+	err := hq.PushOrError(common.QItem{ID: 1, Priority: 1})
+	if err != nil {
+		t.Fatalf("It should accept pushes while paused, but instead we got %v", err)
+	}
+
+	done := make(chan common.QItem, 1)
+	go func() {
+		item, _ := hq.PopOrWaitTillClose()
+		done <- item
+	}()
+	select {
+	case item := <-done:
+		t.Fatalf("It should wait, cause paused, but instead it returned %v", item)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	hq.Resume()
+	if item := <-done; item.ID != 1 {
+		t.Fatalf("Expected ID 1, but instead we got %v", item)
+	}
+	hq.Close()
+}
+
+func TestHeapPriorityQueueWaitUntilEmpty(t *testing.T) {
+	hq, _ := NewHeapPriorityQueue(8)
+
+	if err := hq.WaitUntilEmpty(context.Background()); err != nil {
+		t.Fatalf("It should return right away, cause it is empty, but instead we got %v", err)
+	}
+
+	hq.PushOrError(common.QItem{ID: 1, Priority: 1})
+	hq.PushOrError(common.QItem{ID: 2, Priority: 2})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := hq.WaitUntilEmpty(ctx); err == nil || err != context.DeadlineExceeded {
+		t.Fatalf("It should return context.DeadlineExceeded, cause nothing is popped, but instead we got %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- hq.WaitUntilEmpty(context.Background())
+	}()
+	hq.PopOrWaitTillClose()
+	time.Sleep(20 * time.Millisecond)
+	if len(done) != 0 {
+		t.Fatalf("It should still wait, cause 1 item is left")
+	}
+	hq.PopOrWaitTillClose()
+	if err := <-done; err != nil {
+		t.Fatalf("It should return once the last item is popped, but instead we got %v", err)
+	}
+
+	hq.PushOrError(common.QItem{ID: 3, Priority: 1})
+	go func() {
+		done <- hq.WaitUntilEmpty(context.Background())
+	}()
+	time.Sleep(20 * time.Millisecond)
+	hq.Close()
+	if err := <-done; err == nil || err != common.ErrQueueIsClosed {
+		t.Fatalf("It should return ErrQueueIsClosed, cause closed with items left, but instead we got %v", err)
+	}
+}
+
+func TestHeapPriorityQueueWithWatermarks(t *testing.T) {
+	_, err := NewHeapPriorityQueue(8, WithWatermarks(2, 2, nil, nil))
+	if err == nil || err != common.ErrParamShouldBePositive {
+		t.Fatalf("It should error, cause low should be below high, but instead we got %v", err)
+	}
+
+	high, low := 0, 0
+	hq, _ := NewHeapPriorityQueue(8, WithWatermarks(3, 1,
+		func(size int) { high++ },
+		func(size int) { low++ }))
+	for i := 0; i < 4; i++ {
+		hq.PushOrError(common.QItem{ID: uint64(i), Priority: 1})
+	}
+	if high != 1 || low != 0 {
+		t.Fatalf("Only the high watermark should be crossed once, but instead we got %d and %d", high, low)
+	}
+	for i := 0; i < 3; i++ {
+		hq.PopOrWaitTillClose()
+	}
+	if high != 1 || low != 1 {
+		t.Fatalf("The low watermark should be crossed once, but instead we got %d and %d", high, low)
+	}
+	hq.Close()
+}
+
+func TestHeapPriorityQueueSnapshot(t *testing.T) {
+	hq, _ := NewHeapPriorityQueue(8)
+	var _ common.Snapshotter = hq
+	for i, p := range []int{3, -1, 9, 3} {
+		hq.PushOrError(common.QItem{ID: uint64(i), Priority: p})
+	}
+
+	items := hq.Snapshot()
+	for _, id := range []uint64{2, 0, 3, 1} {
+		item, _ := hq.PopOrWaitTillClose()
+		if item.ID != id || items[0].ID != id {
+			t.Fatalf("Expected ID %d from both snapshot and pop, but instead we got %v and %v", id, items[0], item)
+		}
+		items = items[1:]
+	}
+	hq.Close()
+}
+
+func TestHeapPriorityQueueConformance(t *testing.T) {
+	queuetest.Run(t, func(sizeLimit int) (common.ExtendedQInterface, error) {
+		return NewHeapPriorityQueue(sizeLimit)
+	})
+}
+
+func TestHeapPriorityQueuePeek(t *testing.T) {
+	hq, _ := NewHeapPriorityQueue(8)
+	hq.PushOrError(common.QItem{ID: 1, Priority: 2})
+	hq.PushOrError(common.QItem{ID: 2, Priority: 5})
+	item, err := hq.Peek()
+	if err != nil || item.ID != 2 || hq.Len() != 2 {
+		t.Fatalf("It should peek ID 2 without removing it, but instead we got %v, %v and Len %d", item, err, hq.Len())
+	}
+	hq.Close()
+}
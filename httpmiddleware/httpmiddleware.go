@@ -0,0 +1,93 @@
+package httpmiddleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/aarondwi/prioritize"
+	"github.com/aarondwi/prioritize/common"
+)
+
+// PriorityFunc derives the priority of an incoming request
+type PriorityFunc func(r *http.Request) int
+
+// FromHeader reads the priority from header `name` as an integer,
+// or returns `defaultPriority` if it is missing or not an integer.
+func FromHeader(name string, defaultPriority int) PriorityFunc {
+	return func(r *http.Request) int {
+		p, err := strconv.Atoi(r.Header.Get(name))
+		if err != nil {
+			return defaultPriority
+		}
+		return p
+	}
+}
+
+// FromRoute gives the priority of the longest path prefix in `routes`
+// matching the request path, or `defaultPriority` if none matches.
+func FromRoute(routes map[string]int, defaultPriority int) PriorityFunc {
+	return func(r *http.Request) int {
+		p, longest := defaultPriority, -1
+		for prefix, priority := range routes {
+			if len(prefix) > longest && strings.HasPrefix(r.URL.Path, prefix) {
+				p, longest = priority, len(prefix)
+			}
+		}
+		return p
+	}
+}
+
+// New returns a middleware running the wrapped handler through `engine`,
+// with priority given by `priorityOf`.
+//
+// The handler is run inside a worker, while the serving goroutine waits for it.
+// If the handler panics (e.g. with `http.ErrAbortHandler`), it is panicked again on the serving goroutine.
+// If the engine rejects the request because the queue is full,
+// it responds with 429 Too Many Requests without calling the handler.
+// Priority outside of the queue's range gets 400 Bad Request,
+// and a closed engine (or a request cancelled while queued) gets 503 Service Unavailable.
+func New(engine *prioritize.Engine, priorityOf PriorityFunc) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fn := func(ctx context.Context, arg interface{}) (recovered interface{}, err error) {
+				// re-panicked on the serving goroutine, where net/http recovers it,
+				// instead of crashing the worker (and the process)
+				defer func() {
+					recovered = recover()
+				}()
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return nil, nil
+			}
+
+			task, err := engine.Submit(r.Context(), priorityOf(r), fn, nil)
+			if err != nil {
+				http.Error(w, http.StatusText(statusOf(err)), statusOf(err))
+				return
+			}
+
+			// the handler never returns error, so this is only from the engine
+			recovered, err := task.Result()
+			if err != nil {
+				http.Error(w, http.StatusText(statusOf(err)), statusOf(err))
+				return
+			}
+			if recovered != nil {
+				panic(recovered)
+			}
+		})
+	}
+}
+
+func statusOf(err error) int {
+	switch {
+	case errors.Is(err, common.ErrQueueIsFull):
+		return http.StatusTooManyRequests
+	case errors.Is(err, common.ErrPriorityOutOfRange):
+		return http.StatusBadRequest
+	default:
+		return http.StatusServiceUnavailable
+	}
+}
@@ -0,0 +1,126 @@
+package httpmiddleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aarondwi/prioritize"
+	"github.com/aarondwi/prioritize/priority"
+)
+
+func TestPriorityFuncs(t *testing.T) {
+	fromHeader := FromHeader("X-Priority", 1)
+	r := httptest.NewRequest("GET", "/", nil)
+	if p := fromHeader(r); p != 1 {
+		t.Fatalf("It should return default priority when header is missing, but instead we got %d", p)
+	}
+	r.Header.Set("X-Priority", "not-a-number")
+	if p := fromHeader(r); p != 1 {
+		t.Fatalf("It should return default priority when header is invalid, but instead we got %d", p)
+	}
+	r.Header.Set("X-Priority", "7")
+	if p := fromHeader(r); p != 7 {
+		t.Fatalf("It should return priority from header, but instead we got %d", p)
+	}
+
+	fromRoute := FromRoute(map[string]int{"/api": 2, "/api/checkout": 9}, 0)
+	cases := map[string]int{
+		"/api/checkout/pay": 9,
+		"/api/items":        2,
+		"/static/logo.png":  0,
+	}
+	for path, expected := range cases {
+		r = httptest.NewRequest("GET", path, nil)
+		if p := fromRoute(r); p != expected {
+			t.Fatalf("Path %s should get priority %d, but instead we got %d", path, expected, p)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(1, 4)
+	engine, _ := prioritize.New(pq, 1)
+	handler := New(engine, FromHeader("X-Priority", 0))(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusAccepted)
+		}))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("It should run the handler, but instead we got status %d", w.Code)
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Priority", "4")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("It should be 400, cause priority is out of range, but instead we got status %d", w.Code)
+	}
+
+	// occupy the only worker, and the only queue slot
+	started := make(chan bool)
+	gate := make(chan bool)
+	engine.Submit(context.Background(), 0,
+		func(ctx context.Context, arg interface{}) (interface{}, error) {
+			started <- true
+			<-gate
+			return nil, nil
+		}, nil)
+	<-started
+	engine.Submit(context.Background(), 0,
+		func(ctx context.Context, arg interface{}) (interface{}, error) {
+			return nil, nil
+		}, nil)
+
+	r = httptest.NewRequest("GET", "/", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("It should be 429, cause queue is full, but instead we got status %d", w.Code)
+	}
+
+	close(gate)
+	engine.CloseGracefully()
+
+	r = httptest.NewRequest("GET", "/", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("It should be 503, cause engine is closed, but instead we got status %d", w.Code)
+	}
+}
+
+func TestMiddlewareHandlerPanic(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(1, 4)
+	engine, _ := prioritize.New(pq, 1)
+	defer engine.Close()
+	handler := New(engine, FromHeader("X-Priority", 0))(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic(http.ErrAbortHandler)
+		}))
+
+	func() {
+		defer func() {
+			if r := recover(); r != http.ErrAbortHandler {
+				t.Fatalf("It should panic on the serving goroutine, but instead we got %v", r)
+			}
+		}()
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}()
+
+	// the worker survived the panic
+	handler = New(engine, FromHeader("X-Priority", 0))(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusAccepted)
+		}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("It should keep running handlers after a panic, but instead we got status %d", w.Code)
+	}
+}
@@ -0,0 +1,112 @@
+package prioritize
+
+import (
+	"sync"
+
+	"github.com/aarondwi/prioritize/common"
+)
+
+// WithMaxConcurrentPerPriority limits how many workers can run tasks of a priority at the same time,
+// e.g. `map[int]int{0: 2}` runs at most 2 priority-0 batch jobs, regardless of the number of workers.
+// Priorities not in `limits` are not limited.
+//
+// A worker popping a task over its limit holds it aside, and takes another item from the queue.
+// The held task is then run by the next worker finishing a task of the same priority,
+// so held tasks keep their order, and are never put back into the queue.
+// Only 1 task of each priority is held. A worker popping another one waits until it can be held,
+// so the queue fills up, and pushes back on submissions, as usual.
+func WithMaxConcurrentPerPriority(limits map[int]int) Option {
+	return func(e *Engine) error {
+		cl := &concurrencyLimits{byPriority: make(map[int]*priorityLimit, len(limits))}
+		cl.released = sync.NewCond(&cl.mu)
+		for priority, max := range limits {
+			if priority < 0 {
+				return common.ErrPriorityOutOfRange
+			}
+			if max <= 0 {
+				return common.ErrParamShouldBePositive
+			}
+			cl.byPriority[priority] = &priorityLimit{max: max}
+		}
+		e.limits = cl
+		return nil
+	}
+}
+
+// concurrencyLimits tracks running tasks of limited priorities, see `WithMaxConcurrentPerPriority`.
+//
+// This struct is thread(goroutine)-safe.
+type concurrencyLimits struct {
+	mu         sync.Mutex
+	byPriority map[int]*priorityLimit
+	// broadcast once held items are taken, for those waiting to hold theirs
+	released *sync.Cond
+}
+
+// maxHeldPerPriority is how many popped items of a priority are held aside at most,
+// see `WithMaxConcurrentPerPriority` and `WithRateLimit`
+const maxHeldPerPriority = 1
+
+type priorityLimit struct {
+	max     int
+	running int
+	// popped over the limit, in order
+	held []common.QItem
+}
+
+// acquire returns true if `item` can run now, taking a slot of its priority.
+// Else, `item` is held until `release` hands it to another worker,
+// waiting first while as many are held already.
+func (cl *concurrencyLimits) acquire(item common.QItem) bool {
+	pl, ok := cl.byPriority[item.Priority]
+	if !ok {
+		return true
+	}
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	for {
+		if pl.running < pl.max {
+			pl.running++
+			return true
+		}
+		if len(pl.held) < maxHeldPerPriority {
+			pl.held = append(pl.held, item)
+			return false
+		}
+		cl.released.Wait()
+	}
+}
+
+// release gives back the slot taken by a task of `priority`,
+// unless a held item can take it over, which is then returned together with true.
+func (cl *concurrencyLimits) release(priority int) (common.QItem, bool) {
+	pl, ok := cl.byPriority[priority]
+	if !ok {
+		return common.MinQItem, false
+	}
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if len(pl.held) > 0 {
+		item := pl.held[0]
+		pl.held[0] = common.QItem{}
+		pl.held = pl.held[1:]
+		cl.released.Broadcast()
+		return item, true
+	}
+	pl.running--
+	cl.released.Broadcast()
+	return common.MinQItem, false
+}
+
+// popAll takes all held items, e.g. to drop them on `CloseNow`
+func (cl *concurrencyLimits) popAll() []common.QItem {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	var items []common.QItem
+	for _, pl := range cl.byPriority {
+		items = append(items, pl.held...)
+		pl.held = nil
+	}
+	cl.released.Broadcast()
+	return items
+}
@@ -0,0 +1,96 @@
+package prioritize
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/fair"
+	"github.com/aarondwi/prioritize/priority"
+)
+
+func TestEngineMaxConcurrentPerPriority(t *testing.T) {
+	fq, _ := fair.NewFairQueue(2048, 4)
+	_, err := New(fq, 3, WithMaxConcurrentPerPriority(map[int]int{0: 0}))
+	if !errors.Is(err, common.ErrParamShouldBePositive) {
+		t.Fatalf("It should error, cause the limit is not positive, instead we got %v", err)
+	}
+
+	engine, err := New(fq, 3, WithMaxConcurrentPerPriority(map[int]int{0: 1}))
+	if err != nil {
+		t.Fatalf("It should not error, because all are correct parameters, instead we got %v", err)
+	}
+	defer engine.Close()
+
+	var running, maxRunning int32
+	batch := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		return arg, nil
+	}
+	tasks := make([]*Task, 0, 5)
+	for i := 0; i < 5; i++ {
+		task, _ := engine.Submit(context.Background(), 0, batch, i)
+		tasks = append(tasks, task)
+	}
+	// not limited, so it still gets a worker while batch jobs wait
+	urgent, _ := engine.Submit(context.Background(), 1, func(ctx context.Context, arg interface{}) (interface{}, error) {
+		return atomic.LoadInt32(&running), nil
+	}, nil)
+	if _, err := urgent.Result(); err != nil {
+		t.Fatalf("It should not error, instead we got %v", err)
+	}
+	if tasks[4].Status() == TaskSucceeded {
+		t.Fatal("The urgent task should not wait for all batch jobs to finish")
+	}
+
+	for i, task := range tasks {
+		result, err := task.Result()
+		if err != nil || result.(int) != i {
+			t.Fatalf("Expected %d, but instead we got %v and %v", i, result, err)
+		}
+	}
+	if atomic.LoadInt32(&maxRunning) != 1 {
+		t.Fatalf("Expected at most 1 batch job at a time, but instead we got %d", maxRunning)
+	}
+}
+
+func TestEngineMaxConcurrentPerPriorityPushesBack(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2, 4)
+	engine, _ := New(pq, 3, WithMaxConcurrentPerPriority(map[int]int{0: 1}))
+	defer engine.Close()
+
+	slow := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		time.Sleep(50 * time.Millisecond)
+		return arg, nil
+	}
+	// 1 runs, 1 is held, 2 wait to be held with the other workers, and 2 are queued
+	tasks := make([]*Task, 0, 6)
+	for i := 0; i < 6; i++ {
+		task, err := engine.Submit(context.Background(), 0, slow, i)
+		if err != nil {
+			t.Fatalf("It should not error, instead we got %v", err)
+		}
+		tasks = append(tasks, task)
+		time.Sleep(2 * time.Millisecond)
+	}
+	_, err := engine.Submit(context.Background(), 0, slow, 6)
+	if !errors.Is(err, common.ErrQueueIsFull) {
+		t.Fatalf("It should error, cause only 1 task is held, and the queue is full, instead we got %v", err)
+	}
+	for _, task := range tasks {
+		if _, err := task.Result(); err != nil {
+			t.Fatalf("It should not error, instead we got %v", err)
+		}
+	}
+}
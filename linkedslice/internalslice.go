@@ -1,75 +1,156 @@
-package linkedslice
-
-import (
-	"errors"
-	"sync"
-)
-
-var internalSliceSize = 256
-
-// Bounded one-way slices, not a circular one.
-// Designed this way to maintain FIFO semantic, even after it is full.
-//
-// This struct is NOT thread(goroutine)-safe.
-type internalSlice struct {
-	head      int
-	tail      int
-	sizeLimit int
-	arr       []uint64
-	next      *internalSlice
-}
-
-var internalSlicePool = &sync.Pool{
-	New: func() interface{} {
-		return &internalSlice{
-			head:      0,
-			tail:      0,
-			sizeLimit: internalSliceSize,
-			arr:       make([]uint64, internalSliceSize),
-		} // 256 * 8 = 2048 bytes / 2KB, a lot already
-	},
-}
-
-func newInternalSlice() *internalSlice {
-	return internalSlicePool.Get().(*internalSlice)
-}
-
-func putInternalSlice(is *internalSlice) {
-	is.head = 0
-	is.tail = 0
-	is.next = nil
-	internalSlicePool.Put(is)
-}
-
-var errSliceIsFull = errors.New("this slice is full")
-var errSliceIsEmpty = errors.New("this slice is empty")
-
-func (is *internalSlice) push(n uint64) error {
-	if !is.canPush() {
-		return errSliceIsFull
-	}
-	is.arr[is.head] = n
-	is.head++
-	return nil
-}
-
-func (is *internalSlice) pop() (uint64, error) {
-	if is.isEmpty() {
-		return 0, errSliceIsEmpty
-	}
-	result := is.arr[is.tail]
-	is.tail++
-	return result, nil
-}
-
-func (is *internalSlice) canPush() bool {
-	return is.head < is.sizeLimit
-}
-
-func (is *internalSlice) isEmpty() bool {
-	return is.head == 0 || is.tail == is.head
-}
-
-func (is *internalSlice) slotsUsedUp() bool {
-	return is.tail == is.sizeLimit
-}
+package linkedslice
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/aarondwi/prioritize/common"
+)
+
+var internalSliceSize = 256
+
+// pool counters, see `ReadPoolStats`
+var (
+	poolGets uint64
+	poolNews uint64
+	poolPuts uint64
+)
+
+// PoolStats tells how well internal slices are reused, across all LinkedSlices.
+//
+// If News keeps growing compared to Gets, the pool is often emptied (e.g. by GC),
+// and internal slices are allocated again.
+type PoolStats struct {
+	// Gets is how many internal slices are taken from the pool
+	Gets uint64
+
+	// News is how many of those had to be allocated, because the pool was empty
+	News uint64
+
+	// Puts is how many internal slices are returned to the pool
+	Puts uint64
+
+	// RetainedBytes estimates the memory of internal slices sitting idle in the pool.
+	// It is only an estimate, as the pool may drop them on GC without telling us.
+	RetainedBytes int64
+}
+
+// ReadPoolStats returns the current PoolStats
+func ReadPoolStats() PoolStats {
+	stats := PoolStats{
+		Gets: atomic.LoadUint64(&poolGets),
+		News: atomic.LoadUint64(&poolNews),
+		Puts: atomic.LoadUint64(&poolPuts),
+	}
+	// every one allocated is either in use (gets - puts) or in the pool
+	retained := int64(stats.News) - (int64(stats.Gets) - int64(stats.Puts))
+	if retained > 0 {
+		stats.RetainedBytes = retained * int64(internalSliceSize) * int64(unsafe.Sizeof(common.QItem{}))
+	}
+	return stats
+}
+
+// Bounded one-way slices, not a circular one.
+// Designed this way to maintain FIFO semantic, even after it is full.
+//
+// This struct is NOT thread(goroutine)-safe.
+type internalSlice struct {
+	head      int
+	tail      int
+	sizeLimit int
+	arr       []common.QItem
+	next      *internalSlice
+	prev      *internalSlice
+}
+
+var internalSlicePool = &sync.Pool{
+	New: func() interface{} {
+		atomic.AddUint64(&poolNews, 1)
+		return &internalSlice{
+			head:      0,
+			tail:      0,
+			sizeLimit: internalSliceSize,
+			arr:       make([]common.QItem, internalSliceSize),
+		} // 256 * 56 = 14336 bytes / 14KB, a lot already
+	},
+}
+
+func newInternalSlice() *internalSlice {
+	atomic.AddUint64(&poolGets, 1)
+	return internalSlicePool.Get().(*internalSlice)
+}
+
+func putInternalSlice(is *internalSlice) {
+	// so payloads of dropped items can be garbage collected
+	for i := is.tail; i < is.head; i++ {
+		is.arr[i] = common.QItem{}
+	}
+	is.head = 0
+	is.tail = 0
+	is.next = nil
+	is.prev = nil
+	atomic.AddUint64(&poolPuts, 1)
+	internalSlicePool.Put(is)
+}
+
+var errSliceIsFull = errors.New("this slice is full")
+var errSliceIsEmpty = errors.New("this slice is empty")
+
+func (is *internalSlice) push(n common.QItem) error {
+	if !is.canPush() {
+		return errSliceIsFull
+	}
+	is.arr[is.head] = n
+	is.head++
+	return nil
+}
+
+func (is *internalSlice) pop() (common.QItem, error) {
+	if is.isEmpty() {
+		return common.MinQItem, errSliceIsEmpty
+	}
+	result := is.arr[is.tail]
+	is.arr[is.tail] = common.QItem{}
+	is.tail++
+	return result, nil
+}
+
+// popNewest takes the last pushed item, the reverse of pop
+func (is *internalSlice) popNewest() (common.QItem, error) {
+	if is.isEmpty() {
+		return common.MinQItem, errSliceIsEmpty
+	}
+	is.head--
+	result := is.arr[is.head]
+	is.arr[is.head] = common.QItem{}
+	return result, nil
+}
+
+func (is *internalSlice) peek() (common.QItem, error) {
+	if is.isEmpty() {
+		return common.MinQItem, errSliceIsEmpty
+	}
+	return is.arr[is.tail], nil
+}
+
+// peekNewest returns the last pushed item, the reverse of peek
+func (is *internalSlice) peekNewest() (common.QItem, error) {
+	if is.isEmpty() {
+		return common.MinQItem, errSliceIsEmpty
+	}
+	return is.arr[is.head-1], nil
+}
+
+func (is *internalSlice) canPush() bool {
+	return is.head < is.sizeLimit
+}
+
+func (is *internalSlice) isEmpty() bool {
+	return is.head == 0 || is.tail == is.head
+}
+
+func (is *internalSlice) slotsUsedUp() bool {
+	return is.tail == is.sizeLimit
+}
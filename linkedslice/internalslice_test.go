@@ -1,71 +1,92 @@
-package linkedslice
-
-import (
-	"testing"
-)
-
-func TestInternalSlice(t *testing.T) {
-	is := newInternalSlice()
-
-	// from empty queue
-	_, err := is.pop()
-	if err == nil || err != errSliceIsEmpty {
-		t.Fatalf("it should return `errSliceIsEmpty`, but instead we got %v", err)
-	}
-
-	if !is.canPush() {
-		t.Fatal("Should be able to push, but we can't")
-	}
-
-	for i := 0; i < 128; i++ {
-		err := is.push(uint64(i))
-		if err != nil {
-			t.Fatalf("It should not return error, cause slots still available, but instead we got %v", err)
-		}
-	}
-	for i := 0; i < 128; i++ {
-		_, err := is.pop()
-		if err != nil {
-			t.Fatalf("It should not return error, cause items still available, but instead we got %v", err)
-		}
-	}
-
-	// after put half
-	_, err = is.pop()
-	if err == nil || err != errSliceIsEmpty {
-		t.Fatalf("it should return `errSliceIsEmpty`, but instead we got %v", err)
-	}
-
-	if !is.canPush() {
-		t.Fatal("Should be able to push, but we can't")
-	}
-
-	if is.slotsUsedUp() {
-		t.Fatal("tail should not be at end right now. But it is")
-	}
-
-	for i := 0; i < 128; i++ {
-		err := is.push(uint64(i))
-		if err != nil {
-			t.Fatalf("It should not return error, cause slots still available, but instead we got %v", err)
-		}
-	}
-	for i := 0; i < 128; i++ {
-		_, err := is.pop()
-		if err != nil {
-			t.Fatalf("It should not return error, cause items still available, but instead we got %v", err)
-		}
-	}
-
-	// after both is used up
-	err = is.push(200)
-	if err == nil || err != errSliceIsFull {
-		t.Fatalf("it should return `errSliceIsFull`, but instead we got %v", err)
-	}
-
-	if !is.slotsUsedUp() {
-		t.Fatal("tail should be at end right now and we can no longer pop. But it is not")
-	}
-
-	putInternalSlice(is)
-}
+package linkedslice
+
+import (
+	"testing"
+	"unsafe"
+
+	"github.com/aarondwi/prioritize/common"
+)
+
+func TestInternalSlice(t *testing.T) {
+	is := newInternalSlice()
+
+	// from empty queue
+	_, err := is.pop()
+	if err == nil || err != errSliceIsEmpty {
+		t.Fatalf("it should return `errSliceIsEmpty`, but instead we got %v", err)
+	}
+
+	if !is.canPush() {
+		t.Fatal("Should be able to push, but we can't")
+	}
+
+	for i := 0; i < 128; i++ {
+		err := is.push(common.QItem{ID: uint64(i)})
+		if err != nil {
+			t.Fatalf("It should not return error, cause slots still available, but instead we got %v", err)
+		}
+	}
+	for i := 0; i < 128; i++ {
+		_, err := is.pop()
+		if err != nil {
+			t.Fatalf("It should not return error, cause items still available, but instead we got %v", err)
+		}
+	}
+
+	// after put half
+	_, err = is.pop()
+	if err == nil || err != errSliceIsEmpty {
+		t.Fatalf("it should return `errSliceIsEmpty`, but instead we got %v", err)
+	}
+
+	if !is.canPush() {
+		t.Fatal("Should be able to push, but we can't")
+	}
+
+	if is.slotsUsedUp() {
+		t.Fatal("tail should not be at end right now. But it is")
+	}
+
+	for i := 0; i < 128; i++ {
+		err := is.push(common.QItem{ID: uint64(i)})
+		if err != nil {
+			t.Fatalf("It should not return error, cause slots still available, but instead we got %v", err)
+		}
+	}
+	for i := 0; i < 128; i++ {
+		_, err := is.pop()
+		if err != nil {
+			t.Fatalf("It should not return error, cause items still available, but instead we got %v", err)
+		}
+	}
+
+	// after both is used up
+	err = is.push(common.QItem{ID: 200})
+	if err == nil || err != errSliceIsFull {
+		t.Fatalf("it should return `errSliceIsFull`, but instead we got %v", err)
+	}
+
+	if !is.slotsUsedUp() {
+		t.Fatal("tail should be at end right now and we can no longer pop. But it is not")
+	}
+
+	putInternalSlice(is)
+}
+
+func TestReadPoolStats(t *testing.T) {
+	before := ReadPoolStats()
+	is := newInternalSlice()
+	putInternalSlice(is)
+	after := ReadPoolStats()
+
+	if after.Gets != before.Gets+1 || after.Puts != before.Puts+1 {
+		t.Fatalf("It should count 1 get and 1 put, but instead we got %v and %v", before, after)
+	}
+	if after.News < before.News {
+		t.Fatalf("News should never decrease, but instead we got %v and %v", before, after)
+	}
+	// at least the one just put back is idle
+	if after.RetainedBytes < int64(internalSliceSize)*int64(unsafe.Sizeof(common.QItem{})) {
+		t.Fatalf("Idle internal slices should be counted as retained, but instead we got %v", after)
+	}
+}
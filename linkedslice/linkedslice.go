@@ -1,113 +1,428 @@
-package linkedslice
-
-import (
-	"log"
-	"sync"
-
-	"github.com/aarondwi/prioritize/common"
-)
-
-// LinkedSlice is a queue in which never full,
-// but also don't care about priority, instead it is FIFO
-//
-// This can also be used as base of other priority queuing,
-// in which they split into multiple internal queue,
-// and need each queue to be unbounded
-//
-// There are 2 pointer needed here.
-//
-// 1. head maintains the base of the linked list, and pop always takes from head
-//
-// 2. pushPointer is a pointer pointing to which node new insert should go
-//
-// As items are popped, head gonna go forward, and the previous one will be put back to pool.
-type LinkedSlice struct {
-	mu          *sync.Mutex
-	notEmpty    *sync.Cond
-	head        *internalSlice
-	pushPointer *internalSlice
-	running     bool
-}
-
-// NewLinkedSlice creates our LinkedSlice struct
-func NewLinkedSlice() *LinkedSlice {
-	mu := &sync.Mutex{}
-	notEmpty := sync.NewCond(mu)
-
-	return &LinkedSlice{
-		mu:          mu,
-		notEmpty:    notEmpty,
-		head:        nil,
-		pushPointer: nil,
-		running:     true,
-	}
-}
-
-func (ls *LinkedSlice) checkHeadExist() {
-	if ls.head == nil {
-		ls.head = internalSlicePool.Get().(*internalSlice)
-		ls.pushPointer = ls.head
-	}
-}
-
-// PushOrError insert item into the queue.
-// But as this implementation is unbounded, error should always be nil.
-// Any error found results in panic, cause it means either
-// broken implementation, or some environment issue happens (e.g. OOM).
-func (ls *LinkedSlice) PushOrError(item common.QItem) error {
-	ls.mu.Lock()
-
-	// double check, ensuring see the changes after lock call
-	if !ls.running {
-		ls.mu.Unlock()
-		return common.ErrQueueIsClosed
-	}
-
-	ls.checkHeadExist()
-	if !ls.pushPointer.canPush() { //meaning full already
-		newSlice := internalSlicePool.Get().(*internalSlice)
-		ls.pushPointer.next = newSlice
-		ls.pushPointer = newSlice
-	}
-	err := ls.pushPointer.push(item.ID)
-	if err != nil {
-		log.Println(err)
-		panic("Some implementation/environment goes wrong, cause it should not return any error now")
-	}
-	ls.notEmpty.Signal()
-	ls.mu.Unlock()
-	return nil
-}
-
-// PopOrWaitTillClose returns 1 item from the queue, or wait if none exists
-func (ls *LinkedSlice) PopOrWaitTillClose() (common.QItem, error) {
-	ls.mu.Lock()
-	// double check, ensuring see the changes after lock call
-	if !ls.running {
-		ls.mu.Unlock()
-		return common.MinQItem, common.ErrQueueIsClosed
-	}
-
-	ls.checkHeadExist()
-	// because we handle slotsUsedUp check below
-	// we don't need to check inside this wait-loop
-	for ls.head.isEmpty() {
-		ls.notEmpty.Wait()
-	}
-	result, _ := ls.head.pop()
-	if ls.head.slotsUsedUp() {
-		usedLS := ls.head
-		ls.head = ls.head.next
-		putInternalSlice(usedLS)
-	}
-	ls.mu.Unlock()
-	return common.QItem{ID: result}, nil
-}
-
-// Close LinkedSlice, preventing it from accepting new request
-func (ls *LinkedSlice) Close() {
-	ls.mu.Lock()
-	ls.running = false
-	ls.notEmpty.Broadcast()
-	ls.mu.Unlock()
-}
+package linkedslice
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/aarondwi/prioritize/common"
+)
+
+// LinkedSlice is a queue in which never full,
+// but also don't care about priority, instead it is FIFO
+//
+// This can also be used as base of other priority queuing,
+// in which they split into multiple internal queue,
+// and need each queue to be unbounded
+//
+// There are 2 pointer needed here.
+//
+// 1. head maintains the base of the linked list, and pop always takes from head
+//
+// 2. pushPointer is a pointer pointing to which node new insert should go
+//
+// As items are popped, head gonna go forward, and the previous one will be put back to pool.
+// Nodes also link back to the previous one, so `PopNewestOrWaitTillClose` can move pushPointer backward.
+type LinkedSlice struct {
+	mu          *sync.RWMutex
+	notEmpty    *sync.Cond
+	emptied     *sync.Cond
+	head        *internalSlice
+	pushPointer *internalSlice
+	size        int
+	running     bool
+	closed      chan struct{}
+	draining    bool
+	logger      common.Logger
+}
+
+// Option configures optional behavior of LinkedSlice.
+// Unlike those of the other queues, it can't fail, so `NewLinkedSlice` keeps returning no error.
+type Option func(*LinkedSlice)
+
+// WithLogger makes LinkedSlice log to `logger` the items dropped by closing it,
+// and what goes wrong right before panicking. By default, nothing is logged.
+func WithLogger(logger common.Logger) Option {
+	return func(ls *LinkedSlice) {
+		ls.logger = logger
+	}
+}
+
+// NewLinkedSlice creates our LinkedSlice struct
+func NewLinkedSlice(opts ...Option) *LinkedSlice {
+	mu := &sync.RWMutex{}
+	notEmpty := sync.NewCond(mu)
+
+	ls := &LinkedSlice{
+		mu:          mu,
+		notEmpty:    notEmpty,
+		emptied:     sync.NewCond(mu),
+		head:        nil,
+		pushPointer: nil,
+		size:        0,
+		running:     true,
+		closed:      make(chan struct{}),
+		logger:      common.NopLogger{},
+	}
+	for _, opt := range opts {
+		opt(ls)
+	}
+	return ls
+}
+
+func (ls *LinkedSlice) checkHeadExist() {
+	if ls.head == nil {
+		ls.head = newInternalSlice()
+		ls.pushPointer = ls.head
+	}
+}
+
+// PushOrError insert item into the queue.
+// But as this implementation is unbounded, error should always be nil.
+// Any error found results in panic, cause it means either
+// broken implementation, or some environment issue happens (e.g. OOM).
+func (ls *LinkedSlice) PushOrError(item common.QItem) error {
+	ls.mu.Lock()
+
+	// double check, ensuring see the changes after lock call
+	if !ls.running || ls.draining {
+		ls.mu.Unlock()
+		return common.ErrQueueIsClosed
+	}
+
+	ls.pushLocked(item)
+	ls.notEmpty.Signal()
+	ls.mu.Unlock()
+	return nil
+}
+
+func (ls *LinkedSlice) pushLocked(item common.QItem) {
+	ls.checkHeadExist()
+	if !ls.pushPointer.canPush() { //meaning full already
+		newSlice := newInternalSlice()
+		newSlice.prev = ls.pushPointer
+		ls.pushPointer.next = newSlice
+		ls.pushPointer = newSlice
+	}
+	err := ls.pushPointer.push(item)
+	if err != nil {
+		ls.logger.Error("linkedslice push failed", "id", item.ID, "err", err)
+		panic(fmt.Sprintf(
+			"Some implementation/environment goes wrong, cause it should not return any error now: %v", err))
+	}
+	ls.size++
+}
+
+// PopOrWaitTillClose returns 1 item from the queue, or wait if none exists
+func (ls *LinkedSlice) PopOrWaitTillClose() (common.QItem, error) {
+	return ls.PopOrWaitCtx(context.Background())
+}
+
+// PopOrWaitCtx is the same as PopOrWaitTillClose,
+// but also returns `ctx.Err()` once `ctx` is done while waiting
+func (ls *LinkedSlice) PopOrWaitCtx(ctx context.Context) (common.QItem, error) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if err := ls.waitLocked(ctx); err != nil {
+		return common.MinQItem, err
+	}
+
+	// because we handle slotsUsedUp check below,
+	// size > 0 means head exists and is not empty
+	result, _ := ls.head.pop()
+	ls.size--
+	if ls.head.slotsUsedUp() {
+		usedLS := ls.head
+		ls.head = ls.head.next
+		if ls.head != nil {
+			ls.head.prev = nil
+		}
+		putInternalSlice(usedLS)
+	}
+	if ls.size == 0 {
+		ls.emptied.Broadcast()
+		if ls.draining {
+			ls.closeLocked()
+		}
+	}
+	return result, nil
+}
+
+// PopNewestOrWaitTillClose returns the last pushed item, instead of the first one,
+// or wait if none exists. This allows using LinkedSlice as a stack (LIFO).
+func (ls *LinkedSlice) PopNewestOrWaitTillClose() (common.QItem, error) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if err := ls.waitLocked(context.Background()); err != nil {
+		return common.MinQItem, err
+	}
+
+	// pushPointer is moved back below once it is empty,
+	// so size > 0 means pushPointer is not empty
+	result, _ := ls.pushPointer.popNewest()
+	ls.size--
+	if ls.pushPointer.isEmpty() && ls.pushPointer != ls.head {
+		usedLS := ls.pushPointer
+		ls.pushPointer = usedLS.prev
+		ls.pushPointer.next = nil
+		putInternalSlice(usedLS)
+	}
+	if ls.size == 0 {
+		ls.emptied.Broadcast()
+		if ls.draining {
+			ls.closeLocked()
+		}
+	}
+	return result, nil
+}
+
+// waitLocked waits until there is an item,
+// or returns error if the LinkedSlice is closed, or `ctx` is done, in the meantime.
+func (ls *LinkedSlice) waitLocked(ctx context.Context) error {
+	// double check, ensuring see the changes after lock call
+	if !ls.running {
+		return common.ErrQueueIsClosed
+	}
+	if ls.size == 0 {
+		defer common.WakeOnDone(ctx, ls.notEmpty)()
+	}
+	for ls.size == 0 {
+		if ls.draining {
+			ls.closeLocked()
+			return common.ErrQueueIsClosed
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		ls.notEmpty.Wait()
+		// double check, ensuring see the changes after wait call
+		if !ls.running {
+			return common.ErrQueueIsClosed
+		}
+	}
+	return nil
+}
+
+// Peek returns the item that would be returned by the next pop, without removing it.
+// The second return value is false if the LinkedSlice is empty.
+func (ls *LinkedSlice) Peek() (common.QItem, bool) {
+	ls.mu.RLock()
+	defer ls.mu.RUnlock()
+	if ls.head == nil {
+		return common.MinQItem, false
+	}
+	result, err := ls.head.peek()
+	if err != nil {
+		return common.MinQItem, false
+	}
+	return result, true
+}
+
+// PeekNewest returns the item that would be returned by the next `PopNewestOrWaitTillClose`,
+// without removing it. The second return value is false if the LinkedSlice is empty.
+func (ls *LinkedSlice) PeekNewest() (common.QItem, bool) {
+	ls.mu.RLock()
+	defer ls.mu.RUnlock()
+	if ls.size == 0 {
+		return common.MinQItem, false
+	}
+	// same as PopNewestOrWaitTillClose, size > 0 means pushPointer is not empty
+	result, err := ls.pushPointer.peekNewest()
+	if err != nil {
+		return common.MinQItem, false
+	}
+	return result, true
+}
+
+// Snapshot returns a copy of all items, from the oldest, without removing them.
+// It is O(n).
+func (ls *LinkedSlice) Snapshot() []common.QItem {
+	ls.mu.RLock()
+	defer ls.mu.RUnlock()
+	items := make([]common.QItem, 0, ls.size)
+	for is := ls.head; is != nil; is = is.next {
+		items = append(items, is.arr[is.tail:is.head]...)
+	}
+	return items
+}
+
+// Remove takes out the item with `id`, keeping the order of the others.
+// The second return value is false if no such item exists.
+//
+// It rebuilds the whole LinkedSlice, so it is O(n).
+// Only meant for rare operations, e.g. changing the priority of a queued item.
+func (ls *LinkedSlice) Remove(id uint64) (common.QItem, bool) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	found := false
+	result := common.MinQItem
+	items := make([]common.QItem, 0, ls.size)
+	for is := ls.head; is != nil; is = is.next {
+		for i := is.tail; i < is.head; i++ {
+			if !found && is.arr[i].ID == id {
+				found = true
+				result = is.arr[i]
+				continue
+			}
+			items = append(items, is.arr[i])
+		}
+	}
+	if !found {
+		return common.MinQItem, false
+	}
+	ls.rebuildLocked(items)
+	if ls.size == 0 {
+		ls.emptied.Broadcast()
+	}
+	return result, true
+}
+
+// Compact releases memory the LinkedSlice no longer needs,
+// e.g. after a large backlog drains.
+//
+// If it is empty, its last internal slice is returned to the pool.
+// Else, the remaining items are repacked from the start of new internal slices,
+// so slots of already popped items are not held anymore. That part is O(n).
+func (ls *LinkedSlice) Compact() {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if ls.head == nil {
+		return
+	}
+	if ls.size == 0 {
+		putInternalSlice(ls.head)
+		ls.head = nil
+		ls.pushPointer = nil
+		return
+	}
+	if ls.head.tail == 0 {
+		// already packed
+		return
+	}
+
+	items := make([]common.QItem, 0, ls.size)
+	for is := ls.head; is != nil; is = is.next {
+		items = append(items, is.arr[is.tail:is.head]...)
+	}
+	ls.rebuildLocked(items)
+}
+
+// CompactAll compacts each of `queues` (e.g. one per priority, nil until needed),
+// and sets those left empty to nil, so they are created again when needed.
+// Useful for long-lived services after a large backlog drains.
+func CompactAll(queues []*LinkedSlice) {
+	for i, ls := range queues {
+		if ls == nil {
+			continue
+		}
+		ls.Compact()
+		if ls.Len() == 0 {
+			queues[i] = nil
+		}
+	}
+}
+
+// rebuildLocked replaces all internal slices with new ones holding `items`
+func (ls *LinkedSlice) rebuildLocked(items []common.QItem) {
+	for is := ls.head; is != nil; {
+		next := is.next
+		putInternalSlice(is)
+		is = next
+	}
+	ls.head = nil
+	ls.pushPointer = nil
+	ls.size = 0
+	for _, item := range items {
+		ls.pushLocked(item)
+	}
+}
+
+// Len returns the number of items currently in the LinkedSlice.
+//
+// It only takes the read lock, so it does not contend with other readers.
+func (ls *LinkedSlice) Len() int {
+	ls.mu.RLock()
+	defer ls.mu.RUnlock()
+	return ls.size
+}
+
+// Close is the same as CloseNow
+func (ls *LinkedSlice) Close() error {
+	return ls.CloseNow()
+}
+
+// CloseNow closes LinkedSlice, preventing it from accepting new request.
+// Remaining items are dropped, and waiting pops return immediately.
+// Closing it again does nothing, only returning `common.ErrQueueIsClosed`.
+func (ls *LinkedSlice) CloseNow() error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if !ls.running {
+		return common.ErrQueueIsClosed
+	}
+	ls.closeLocked()
+	return nil
+}
+
+// CloseGracefully stops LinkedSlice from accepting new request,
+// but pops keep returning the remaining items.
+// Once it is empty, it is closed the same way as CloseNow.
+func (ls *LinkedSlice) CloseGracefully() {
+	ls.mu.Lock()
+	if ls.running {
+		ls.draining = true
+		if ls.size == 0 {
+			ls.closeLocked()
+		}
+	}
+	ls.mu.Unlock()
+}
+
+// WaitUntilEmpty waits until LinkedSlice holds no item, and returns nil.
+// It returns `common.ErrQueueIsClosed` if LinkedSlice is closed with items left,
+// or `ctx.Err()` once `ctx` is done while waiting.
+func (ls *LinkedSlice) WaitUntilEmpty(ctx context.Context) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if ls.size > 0 {
+		defer common.WakeOnDone(ctx, ls.emptied)()
+	}
+	for ls.size > 0 {
+		if !ls.running {
+			return common.ErrQueueIsClosed
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		ls.emptied.Wait()
+	}
+	return nil
+}
+
+// IsClosed returns whether LinkedSlice is closed, after which no item is popped anymore
+func (ls *LinkedSlice) IsClosed() bool {
+	ls.mu.RLock()
+	defer ls.mu.RUnlock()
+	return !ls.running
+}
+
+// Closed returns a channel which is closed once LinkedSlice is closed,
+// so other goroutines can select on it
+func (ls *LinkedSlice) Closed() <-chan struct{} {
+	return ls.closed
+}
+
+func (ls *LinkedSlice) closeLocked() {
+	if !ls.running {
+		// already closed, ls.closed can't be closed twice
+		return
+	}
+	ls.running = false
+	close(ls.closed)
+	if ls.size > 0 {
+		ls.logger.Warn("queue closed, dropping items", "dropped", ls.size)
+	}
+	ls.notEmpty.Broadcast()
+	ls.emptied.Broadcast()
+}
@@ -1,159 +1,443 @@
-package linkedslice
-
-import (
-	"log"
-	"runtime"
-	"testing"
-	"time"
-
-	"github.com/aarondwi/prioritize/common"
-)
-
-func TestLinkedSlice(t *testing.T) {
-	ls := NewLinkedSlice()
-	for i := 0; i < 1027; i++ {
-		err := ls.PushOrError(common.QItem{ID: uint64(i)})
-		if err != nil {
-			t.Fatalf("This implementation will only return nil, but instead we got %v", err)
-		}
-	}
-	for i := 0; i < 1027; i++ {
-		res, err := ls.PopOrWaitTillClose()
-		if err != nil {
-			t.Fatalf("It should not error, because not closed yet, but we got %v", err)
-		}
-		if res.ID != uint64(i) {
-			t.Fatalf("We don't receive FIFO as we expected: expected %d, got %d", uint64(i), res.ID)
-		}
-	}
-	ls.Close()
-}
-
-func TestLinkedSlicePopWait(t *testing.T) {
-	ls := NewLinkedSlice()
-
-	c := make(chan bool, 1)
-	go func() {
-		time.Sleep(200 * time.Millisecond)
-		log.Println("timeout, returning")
-		c <- false
-	}()
-
-	go func() {
-		item, err := ls.PopOrWaitTillClose()
-		if err != nil {
-			c <- false
-			return
-		}
-		if item.ID != 100 {
-			log.Printf("We received priority %d\n", item.Priority)
-			c <- false
-			return
-		}
-		c <- true
-	}()
-
-	time.Sleep(100 * time.Millisecond)
-	err := ls.PushOrError(common.QItem{ID: 100})
-	if err != nil {
-		t.Fatalf("It should not error because slots are available, but we got %v", err)
-	}
-
-	result := <-c
-	if !result {
-		t.Fatal("We should receive true, because all the above are true, but we are not")
-	}
-
-	ls.Close()
-}
-
-func TestLinkedSliceAfterClose(t *testing.T) {
-	ls := NewLinkedSlice()
-	ls.Close()
-
-	err := ls.PushOrError(common.QItem{})
-	if err == nil || err != common.ErrQueueIsClosed {
-		t.Fatalf("It should be error, cause already closed, but it is not")
-	}
-
-	_, err = ls.PopOrWaitTillClose()
-	if err == nil || err != common.ErrQueueIsClosed {
-		t.Fatalf("It should be error, cause already closed, but it is not")
-	}
-}
-
-func BenchmarkLinkedSlice(b *testing.B) {
-	ls := NewLinkedSlice()
-	for i := 0; i < b.N; i++ {
-		ls.PushOrError(common.QItem{ID: uint64(i)})
-		ls.PopOrWaitTillClose()
-	}
-	ls.Close()
-}
-
-func BenchmarkLinkedSliceInLoop(b *testing.B) {
-	ls := NewLinkedSlice()
-	for i := 0; i < b.N; i++ {
-		for j := 0; j < 128; j++ {
-			ls.PushOrError(common.QItem{ID: uint64(i*128 + j)})
-		}
-		for j := 0; j < 128; j++ {
-			ls.PopOrWaitTillClose()
-		}
-	}
-	ls.Close()
-}
-
-func BenchmarkLinkedSliceParallelOneCoreOnly(b *testing.B) {
-	ls := NewLinkedSlice()
-	runtime.GOMAXPROCS(1)
-	b.RunParallel(func(pb *testing.PB) {
-		for pb.Next() {
-			ls.PushOrError(common.QItem{})
-			ls.PopOrWaitTillClose()
-		}
-	})
-	ls.Close()
-}
-
-func BenchmarkLinkedSliceInLoopParallelOneCoreOnly(b *testing.B) {
-	ls := NewLinkedSlice()
-	runtime.GOMAXPROCS(1)
-	b.RunParallel(func(pb *testing.PB) {
-		for pb.Next() {
-			for j := 0; j < 128; j++ {
-				ls.PushOrError(common.QItem{ID: uint64(j)})
-			}
-			for j := 0; j < 128; j++ {
-				ls.PopOrWaitTillClose()
-			}
-		}
-	})
-	ls.Close()
-}
-
-func BenchmarkLinkedSliceParallel(b *testing.B) {
-	ls := NewLinkedSlice()
-	b.RunParallel(func(pb *testing.PB) {
-		for pb.Next() {
-			ls.PushOrError(common.QItem{})
-			ls.PopOrWaitTillClose()
-		}
-	})
-	ls.Close()
-}
-
-func BenchmarkLinkedSliceInLoopParallel(b *testing.B) {
-	ls := NewLinkedSlice()
-	b.RunParallel(func(pb *testing.PB) {
-		for pb.Next() {
-			for j := 0; j < 128; j++ {
-				ls.PushOrError(common.QItem{ID: uint64(j)})
-			}
-			for j := 0; j < 128; j++ {
-				ls.PopOrWaitTillClose()
-			}
-		}
-	})
-	ls.Close()
-}
+package linkedslice
+
+import (
+	"context"
+	"log"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+)
+
+func TestLinkedSlice(t *testing.T) {
+	ls := NewLinkedSlice()
+	for i := 0; i < 1027; i++ {
+		err := ls.PushOrError(common.QItem{ID: uint64(i)})
+		if err != nil {
+			t.Fatalf("This implementation will only return nil, but instead we got %v", err)
+		}
+	}
+	if ls.Len() != 1027 {
+		t.Fatalf("It should have 1027 items, but instead we got %d", ls.Len())
+	}
+	for i := 0; i < 1027; i++ {
+		res, err := ls.PopOrWaitTillClose()
+		if err != nil {
+			t.Fatalf("It should not error, because not closed yet, but we got %v", err)
+		}
+		if res.ID != uint64(i) {
+			t.Fatalf("We don't receive FIFO as we expected: expected %d, got %d", uint64(i), res.ID)
+		}
+	}
+	if ls.Len() != 0 {
+		t.Fatalf("It should be empty, but instead we got %d", ls.Len())
+	}
+	ls.Close()
+}
+
+func TestLinkedSlicePopWait(t *testing.T) {
+	ls := NewLinkedSlice()
+
+	c := make(chan bool, 1)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		log.Println("timeout, returning")
+		c <- false
+	}()
+
+	go func() {
+		item, err := ls.PopOrWaitTillClose()
+		if err != nil {
+			c <- false
+			return
+		}
+		if item.ID != 100 {
+			log.Printf("We received priority %d\n", item.Priority)
+			c <- false
+			return
+		}
+		c <- true
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	err := ls.PushOrError(common.QItem{ID: 100})
+	if err != nil {
+		t.Fatalf("It should not error because slots are available, but we got %v", err)
+	}
+
+	result := <-c
+	if !result {
+		t.Fatal("We should receive true, because all the above are true, but we are not")
+	}
+
+	ls.Close()
+}
+
+func TestLinkedSliceAfterClose(t *testing.T) {
+	ls := NewLinkedSlice()
+	ls.Close()
+
+	err := ls.PushOrError(common.QItem{})
+	if err == nil || err != common.ErrQueueIsClosed {
+		t.Fatalf("It should be error, cause already closed, but it is not")
+	}
+
+	_, err = ls.PopOrWaitTillClose()
+	if err == nil || err != common.ErrQueueIsClosed {
+		t.Fatalf("It should be error, cause already closed, but it is not")
+	}
+}
+
+func BenchmarkLinkedSlice(b *testing.B) {
+	ls := NewLinkedSlice()
+	for i := 0; i < b.N; i++ {
+		ls.PushOrError(common.QItem{ID: uint64(i)})
+		ls.PopOrWaitTillClose()
+	}
+	ls.Close()
+}
+
+func BenchmarkLinkedSliceInLoop(b *testing.B) {
+	ls := NewLinkedSlice()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < 128; j++ {
+			ls.PushOrError(common.QItem{ID: uint64(i*128 + j)})
+		}
+		for j := 0; j < 128; j++ {
+			ls.PopOrWaitTillClose()
+		}
+	}
+	ls.Close()
+}
+
+func BenchmarkLinkedSliceParallelOneCoreOnly(b *testing.B) {
+	ls := NewLinkedSlice()
+	runtime.GOMAXPROCS(1)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			ls.PushOrError(common.QItem{})
+			ls.PopOrWaitTillClose()
+		}
+	})
+	ls.Close()
+}
+
+func BenchmarkLinkedSliceInLoopParallelOneCoreOnly(b *testing.B) {
+	ls := NewLinkedSlice()
+	runtime.GOMAXPROCS(1)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			for j := 0; j < 128; j++ {
+				ls.PushOrError(common.QItem{ID: uint64(j)})
+			}
+			for j := 0; j < 128; j++ {
+				ls.PopOrWaitTillClose()
+			}
+		}
+	})
+	ls.Close()
+}
+
+func BenchmarkLinkedSliceParallel(b *testing.B) {
+	ls := NewLinkedSlice()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			ls.PushOrError(common.QItem{})
+			ls.PopOrWaitTillClose()
+		}
+	})
+	ls.Close()
+}
+
+func BenchmarkLinkedSliceInLoopParallel(b *testing.B) {
+	ls := NewLinkedSlice()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			for j := 0; j < 128; j++ {
+				ls.PushOrError(common.QItem{ID: uint64(j)})
+			}
+			for j := 0; j < 128; j++ {
+				ls.PopOrWaitTillClose()
+			}
+		}
+	})
+	ls.Close()
+}
+
+func TestLinkedSlicePeek(t *testing.T) {
+	ls := NewLinkedSlice()
+	_, ok := ls.Peek()
+	if ok {
+		t.Fatal("It should be empty, but Peek returns an item")
+	}
+
+	ls.PushOrError(common.QItem{ID: 1, Priority: 3})
+	ls.PushOrError(common.QItem{ID: 2})
+	item, ok := ls.Peek()
+	if !ok || item.ID != 1 || item.Priority != 3 {
+		t.Fatalf("It should return the first item put, but instead we got %v", item)
+	}
+	if ls.Len() != 2 {
+		t.Fatalf("Peek should not remove item, but the size is %d", ls.Len())
+	}
+	ls.Close()
+}
+
+func TestLinkedSlicePeekNewest(t *testing.T) {
+	ls := NewLinkedSlice()
+	_, ok := ls.PeekNewest()
+	if ok {
+		t.Fatal("It should be empty, but PeekNewest returns an item")
+	}
+
+	// cross an internal slice boundary
+	for i := 0; i <= internalSliceSize; i++ {
+		ls.PushOrError(common.QItem{ID: uint64(i)})
+	}
+	for i := internalSliceSize; i >= internalSliceSize-1; i-- {
+		item, ok := ls.PeekNewest()
+		if !ok || item.ID != uint64(i) {
+			t.Fatalf("It should return the last item put, %d, but instead we got %v", i, item)
+		}
+		ls.PopNewestOrWaitTillClose()
+	}
+	ls.Close()
+}
+
+func TestLinkedSliceCloseGracefully(t *testing.T) {
+	ls := NewLinkedSlice()
+	ls.PushOrError(common.QItem{ID: 1})
+	ls.CloseGracefully()
+
+	err := ls.PushOrError(common.QItem{ID: 2})
+	if err == nil || err != common.ErrQueueIsClosed {
+		t.Fatalf("It should be error, cause already closing, but instead we got %v", err)
+	}
+
+	item, err := ls.PopOrWaitTillClose()
+	if err != nil || item.ID != 1 {
+		t.Fatalf("It should return the remaining item, but instead we got %v and %v", item, err)
+	}
+
+	_, err = ls.PopOrWaitTillClose()
+	if err == nil || err != common.ErrQueueIsClosed {
+		t.Fatalf("It should be error, cause already drained, but instead we got %v", err)
+	}
+}
+
+func TestLinkedSliceCloseReleasesWaitingPop(t *testing.T) {
+	ls := NewLinkedSlice()
+
+	c := make(chan error, 1)
+	go func() {
+		_, err := ls.PopOrWaitTillClose()
+		c <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	ls.Close()
+
+	select {
+	case err := <-c:
+		if err == nil || err != common.ErrQueueIsClosed {
+			t.Fatalf("It should be error, cause already closed, but instead we got %v", err)
+		}
+	case <-time.After(200 * time.Millisecond):
+		t.Fatal("Waiting pop should be released, but it is not")
+	}
+}
+
+func TestLinkedSliceRemove(t *testing.T) {
+	ls := NewLinkedSlice()
+	for i := 0; i < 600; i++ {
+		ls.PushOrError(common.QItem{ID: uint64(i)})
+	}
+
+	_, ok := ls.Remove(1000)
+	if ok {
+		t.Fatal("It should not find ID 1000, but it does")
+	}
+
+	item, ok := ls.Remove(300)
+	if !ok || item.ID != 300 {
+		t.Fatalf("It should remove ID 300, but instead we got %v", item)
+	}
+	if ls.Len() != 599 {
+		t.Fatalf("It should have 599 items left, but instead we got %d", ls.Len())
+	}
+
+	for i := 0; i < 600; i++ {
+		if i == 300 {
+			continue
+		}
+		res, _ := ls.PopOrWaitTillClose()
+		if res.ID != uint64(i) {
+			t.Fatalf("Order should be kept after remove: expected %d, got %d", i, res.ID)
+		}
+	}
+	ls.Close()
+}
+
+func TestLinkedSliceCompact(t *testing.T) {
+	ls := NewLinkedSlice()
+	ls.Compact()
+	for i := 0; i < 300; i++ {
+		ls.PushOrError(common.QItem{ID: uint64(i)})
+	}
+	for i := 0; i < 10; i++ {
+		ls.PopOrWaitTillClose()
+	}
+
+	ls.Compact()
+	if ls.head.tail != 0 || ls.Len() != 290 {
+		t.Fatalf("It should be repacked keeping all 290 items, but instead we got tail %d and %d items", ls.head.tail, ls.Len())
+	}
+	for i := 10; i < 300; i++ {
+		res, _ := ls.PopOrWaitTillClose()
+		if res.ID != uint64(i) {
+			t.Fatalf("Compacting should keep FIFO order: expected %d, got %d", uint64(i), res.ID)
+		}
+	}
+
+	ls.Compact()
+	if ls.head != nil || ls.pushPointer != nil {
+		t.Fatal("Empty LinkedSlice should not hold any internal slice after compacting")
+	}
+	ls.PushOrError(common.QItem{ID: 1})
+	res, err := ls.PopOrWaitTillClose()
+	if err != nil || res.ID != 1 {
+		t.Fatalf("It should still work after compacting, but instead we got %v and %v", res, err)
+	}
+	ls.Close()
+}
+
+func TestCompactAll(t *testing.T) {
+	queues := []*LinkedSlice{NewLinkedSlice(), nil, NewLinkedSlice()}
+	queues[0].PushOrError(common.QItem{ID: 1})
+	queues[2].PushOrError(common.QItem{ID: 2})
+	queues[2].PopOrWaitTillClose()
+
+	CompactAll(queues)
+	if queues[0] == nil || queues[0].Len() != 1 || queues[1] != nil || queues[2] != nil {
+		t.Fatalf("It should only keep the non-empty queue, but instead we got %v", queues)
+	}
+}
+
+func TestLinkedSlicePopNewest(t *testing.T) {
+	ls := NewLinkedSlice()
+	for i := 0; i < 600; i++ {
+		ls.PushOrError(common.QItem{ID: uint64(i)})
+	}
+	// take from both ends, crossing internal slices from the back
+	for i := 0; i < 10; i++ {
+		res, _ := ls.PopOrWaitTillClose()
+		if res.ID != uint64(i) {
+			t.Fatalf("Expected oldest ID %d, but instead we got %d", i, res.ID)
+		}
+	}
+	for i := 599; i >= 200; i-- {
+		res, err := ls.PopNewestOrWaitTillClose()
+		if err != nil || res.ID != uint64(i) {
+			t.Fatalf("Expected newest ID %d, but instead we got %v and %v", i, res, err)
+		}
+	}
+
+	// pushing again continues right after the remaining ones
+	ls.PushOrError(common.QItem{ID: 1000})
+	res, _ := ls.PopNewestOrWaitTillClose()
+	if res.ID != 1000 {
+		t.Fatalf("Expected ID 1000, but instead we got %d", res.ID)
+	}
+	for i := 10; i < 200; i++ {
+		res, _ := ls.PopOrWaitTillClose()
+		if res.ID != uint64(i) {
+			t.Fatalf("Expected oldest ID %d, but instead we got %d", i, res.ID)
+		}
+	}
+	if ls.Len() != 0 {
+		t.Fatalf("It should be empty, but instead we got %d", ls.Len())
+	}
+
+	ls.CloseGracefully()
+	_, err := ls.PopNewestOrWaitTillClose()
+	if err == nil || err != common.ErrQueueIsClosed {
+		t.Fatalf("It should be closed after draining, but instead we got %v", err)
+	}
+}
+
+func TestLinkedSlicePopOrWaitCtx(t *testing.T) {
+	ls := NewLinkedSlice()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := ls.PopOrWaitCtx(ctx)
+	if err == nil || err != context.DeadlineExceeded {
+		t.Fatalf("It should return context.DeadlineExceeded, but instead we got %v", err)
+	}
+
+	ls.Close()
+	_, err = ls.PopOrWaitCtx(context.Background())
+	if err == nil || err != common.ErrQueueIsClosed {
+		t.Fatalf("It should return ErrQueueIsClosed, but instead we got %v", err)
+	}
+}
+
+func TestLinkedSliceWaitUntilEmpty(t *testing.T) {
+	ls := NewLinkedSlice()
+	ls.PushOrError(common.QItem{ID: 1})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := ls.WaitUntilEmpty(ctx); err == nil || err != context.DeadlineExceeded {
+		t.Fatalf("It should return context.DeadlineExceeded, cause nothing is popped, but instead we got %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- ls.WaitUntilEmpty(context.Background())
+	}()
+	ls.PopOrWaitTillClose()
+	if err := <-done; err != nil {
+		t.Fatalf("It should return once the last item is popped, but instead we got %v", err)
+	}
+
+	ls.PushOrError(common.QItem{ID: 2})
+	ls.Close()
+	if err := ls.WaitUntilEmpty(context.Background()); err == nil || err != common.ErrQueueIsClosed {
+		t.Fatalf("It should return ErrQueueIsClosed, cause closed with items left, but instead we got %v", err)
+	}
+}
+
+type recordingLogger struct {
+	msgs []string
+}
+
+func (l *recordingLogger) Info(msg string, keyvals ...interface{}) {
+	l.msgs = append(l.msgs, "info: "+msg)
+}
+func (l *recordingLogger) Warn(msg string, keyvals ...interface{}) {
+	l.msgs = append(l.msgs, "warn: "+msg)
+}
+func (l *recordingLogger) Error(msg string, keyvals ...interface{}) {
+	l.msgs = append(l.msgs, "error: "+msg)
+}
+
+func TestLinkedSliceWithLogger(t *testing.T) {
+	logger := &recordingLogger{}
+	ls := NewLinkedSlice(WithLogger(logger))
+	ls.PushOrError(common.QItem{ID: 1})
+	ls.PushOrError(common.QItem{ID: 2})
+	ls.CloseNow()
+	if len(logger.msgs) != 1 || logger.msgs[0] != "warn: queue closed, dropping items" {
+		t.Fatalf("It should log the dropped items, but instead we got %v", logger.msgs)
+	}
+
+	// nothing is dropped
+	logger = &recordingLogger{}
+	ls = NewLinkedSlice(WithLogger(logger))
+	ls.CloseNow()
+	if len(logger.msgs) != 0 {
+		t.Fatalf("It should not log anything, but instead we got %v", logger.msgs)
+	}
+}
@@ -0,0 +1,62 @@
+package prioritize
+
+import (
+	"context"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+)
+
+// Logger receives structured logs from the engine, see `WithLogger`.
+// It is the same as `common.Logger`, so 1 logger can be given to both the engine and its queue.
+type Logger = common.Logger
+
+// WithLogger makes the engine log to `logger`. By default, nothing is logged.
+//
+// It logs tasks dropped without running (expired, ctx already done, or engine closed) and retries,
+// slow tasks (see `WithSlowTaskThreshold`), and panicking tasks, before the panic goes on.
+func WithLogger(logger Logger) Option {
+	return func(e *Engine) error {
+		e.logger = logger
+		return nil
+	}
+}
+
+// WithSlowTaskThreshold makes the engine log a warning for tasks whose fn runs for `d` or longer,
+// see `WithLogger`.
+func WithSlowTaskThreshold(d time.Duration) Option {
+	return func(e *Engine) error {
+		if d <= 0 {
+			return common.ErrParamShouldBePositive
+		}
+		e.slowTaskThreshold = d
+		return nil
+	}
+}
+
+// runFn runs the fn of `task`, logging it, and passing it to the deadletter, if it panics
+func (e *Engine) runFn(ctx context.Context, task *Task) (interface{}, error) {
+	defer func() {
+		if r := recover(); r != nil {
+			e.logger.Error("task panicked", "id", task.id, "panic", r)
+			e.toDeadletter(task, &PanicError{Value: r})
+			panic(r)
+		}
+	}()
+	return task.fn(ctx, task.arg)
+}
+
+// logRun logs `task` if its fn ran for too long, see `WithSlowTaskThreshold`
+func (e *Engine) logRun(task *Task, priority int, ran time.Duration) {
+	if e.slowTaskThreshold > 0 && ran >= e.slowTaskThreshold {
+		e.logger.Warn("slow task", "id", task.id, "priority", priority, "ran", ran)
+	}
+}
+
+// logCompletion logs `task` if it is dropped without running
+func (e *Engine) logCompletion(task *Task, err error) {
+	switch err {
+	case ErrQueueTimeout, ErrCtxAlreadyCancelled, ErrAlreadyClosed:
+		e.logger.Warn("task dropped", "id", task.id, "err", err)
+	}
+}
@@ -0,0 +1,103 @@
+package prioritize
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/priority"
+)
+
+type recordingLogger struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (l *recordingLogger) record(msg string) {
+	l.mu.Lock()
+	l.msgs = append(l.msgs, msg)
+	l.mu.Unlock()
+}
+
+func (l *recordingLogger) Info(msg string, keyvals ...interface{})  { l.record("info: " + msg) }
+func (l *recordingLogger) Warn(msg string, keyvals ...interface{})  { l.record("warn: " + msg) }
+func (l *recordingLogger) Error(msg string, keyvals ...interface{}) { l.record("error: " + msg) }
+
+func (l *recordingLogger) count(msg string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := 0
+	for _, m := range l.msgs {
+		if m == msg {
+			n++
+		}
+	}
+	return n
+}
+
+func TestEngineWithLogger(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	_, err := New(pq, 1, WithSlowTaskThreshold(0))
+	if !errors.Is(err, common.ErrParamShouldBePositive) {
+		t.Fatalf("It should error, cause the threshold is not positive, instead we got %v", err)
+	}
+
+	logger := &recordingLogger{}
+	engine, err := New(pq, 1,
+		WithLogger(logger),
+		WithSlowTaskThreshold(10*time.Millisecond),
+		WithRetry(1, time.Millisecond, time.Millisecond))
+	if err != nil {
+		t.Fatalf("It should not error, because all are correct parameters, instead we got %v", err)
+	}
+	defer engine.Close()
+
+	task, _ := engine.Submit(context.Background(), 0, func(ctx context.Context, arg interface{}) (interface{}, error) {
+		time.Sleep(20 * time.Millisecond)
+		return nil, nil
+	}, nil)
+	task.Result()
+	if logger.count("warn: slow task") != 1 {
+		t.Fatalf("Expected the slow task to be logged, but instead we got %v", logger.msgs)
+	}
+
+	task, _ = engine.Submit(context.Background(), 0, func(ctx context.Context, arg interface{}) (interface{}, error) {
+		return nil, errors.New("failing")
+	}, nil)
+	task.Result()
+	if logger.count("info: task retried") != 1 {
+		t.Fatalf("Expected 1 retry to be logged, but instead we got %v", logger.msgs)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	task, _ = engine.Submit(ctx, 0, func(ctx context.Context, arg interface{}) (interface{}, error) {
+		return nil, nil
+	}, nil)
+	task.Result()
+	if logger.count("warn: task dropped") != 1 {
+		t.Fatalf("Expected the cancelled task to be logged as dropped, but instead we got %v", logger.msgs)
+	}
+}
+
+func TestEngineLogsPanic(t *testing.T) {
+	logger := &recordingLogger{}
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	engine, _ := New(pq, 1, WithLogger(logger))
+	defer engine.Close()
+
+	defer func() {
+		if r := recover(); r != "boom" {
+			t.Fatalf("Expected the panic to go on, but instead we got %v", r)
+		}
+		if logger.count("error: task panicked") != 1 {
+			t.Fatalf("Expected the panic to be logged, but instead we got %v", logger.msgs)
+		}
+	}()
+	engine.runFn(context.Background(), &Task{fn: func(ctx context.Context, arg interface{}) (interface{}, error) {
+		panic("boom")
+	}})
+}
@@ -0,0 +1,112 @@
+package prioritize
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// MetricsSink receives an event each time a task moves through the engine,
+// e.g. to export them to prometheus or statsd, labelled by priority. See `WithMetricsSink`.
+//
+// Its methods are called synchronously by submitters and workers,
+// so they should be fast, and thread(goroutine)-safe.
+type MetricsSink interface {
+	// Enqueued is called each time a task is put into the queue, including retries and yields
+	Enqueued(priority int)
+	// Dequeued is called each time a worker takes a task, with how long it waited in the queue
+	Dequeued(priority int, wait time.Duration)
+	// Completed is called when a task succeeds, with how long its fn ran
+	Completed(priority int, run time.Duration)
+	// Failed is called when a task completes with an error, including cancelled and expired ones
+	Failed(priority int, run time.Duration, err error)
+	// Rejected is called when a submission can't be queued, e.g. the queue is full
+	Rejected(priority int, err error)
+}
+
+// WithMetricsSink makes the engine send its events to `sink`.
+//
+// Durations are only measured for sampled tasks (see `WithTelemetrySampling`),
+// others report 0 as their wait. The same goes for run time of tasks from `SubmitAndForget`.
+func WithMetricsSink(sink MetricsSink) Option {
+	return func(e *Engine) error {
+		e.sink = sink
+		return nil
+	}
+}
+
+// Stats is a snapshot of the engine, see `Engine.Stats`
+type Stats struct {
+	// Depth is the number of submitted tasks not yet taken by any worker
+	Depth int
+	// Workers is the current number of workers, out of which Busy are running a task
+	Workers int
+	Busy    int
+
+	// Counters since the engine is created, with the same meaning as in `MetricsSink`
+	Enqueued  uint64
+	Dequeued  uint64
+	Succeeded uint64
+	Failed    uint64
+	Rejected  uint64
+
+	// Stuck is the number of running tasks found by the watchdog, see `WithStuckTaskDetection`
+	Stuck int
+
+	// Moving averages of sampled tasks, see `WithTelemetrySampling`
+	AvgQueueWait time.Duration
+	AvgRunTime   time.Duration
+}
+
+// Stats returns a snapshot of the engine, for when a `MetricsSink` is too much
+func (e *Engine) Stats() Stats {
+	return Stats{
+		Depth:        e.Len(),
+		Workers:      e.NumOfWorker(),
+		Busy:         int(atomic.LoadInt32(&e.busyWorker)),
+		Enqueued:     atomic.LoadUint64(&e.enqueued),
+		Dequeued:     atomic.LoadUint64(&e.dequeued),
+		Succeeded:    atomic.LoadUint64(&e.succeeded),
+		Failed:       atomic.LoadUint64(&e.failed),
+		Rejected:     atomic.LoadUint64(&e.rejected),
+		Stuck:        e.inflight.numOfStuck(),
+		AvgQueueWait: e.queueWait.get(),
+		AvgRunTime:   e.runTime.get(),
+	}
+}
+
+func (e *Engine) onEnqueued(priority int) {
+	atomic.AddUint64(&e.enqueued, 1)
+	if e.sink != nil {
+		e.sink.Enqueued(priority)
+	}
+}
+
+func (e *Engine) onDequeued(priority int, wait time.Duration) {
+	atomic.AddUint64(&e.dequeued, 1)
+	if e.sink != nil {
+		e.sink.Dequeued(priority, wait)
+	}
+}
+
+func (e *Engine) onRejected(priority int, err error) {
+	atomic.AddUint64(&e.rejected, 1)
+	if e.sink != nil {
+		e.sink.Rejected(priority, err)
+	}
+}
+
+func (e *Engine) onCompleted(priority int, run time.Duration, err error) {
+	if err == nil {
+		atomic.AddUint64(&e.succeeded, 1)
+	} else {
+		atomic.AddUint64(&e.failed, 1)
+	}
+	if e.sink == nil {
+		return
+	}
+	if err == nil {
+		e.sink.Completed(priority, run)
+	} else {
+		e.sink.Failed(priority, run, err)
+	}
+}
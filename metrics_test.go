@@ -0,0 +1,136 @@
+package prioritize
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aarondwi/prioritize/priority"
+)
+
+type recordingSink struct {
+	mu     sync.Mutex
+	events map[string]map[int]int
+	errs   []error
+}
+
+func newRecordingSink() *recordingSink {
+	return &recordingSink{events: make(map[string]map[int]int)}
+}
+
+func (s *recordingSink) record(event string, priority int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.events[event] == nil {
+		s.events[event] = make(map[int]int)
+	}
+	s.events[event][priority]++
+	if err != nil {
+		s.errs = append(s.errs, err)
+	}
+}
+
+func (s *recordingSink) count(event string, priority int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.events[event][priority]
+}
+
+func (s *recordingSink) Enqueued(priority int) { s.record("enqueued", priority, nil) }
+func (s *recordingSink) Dequeued(priority int, wait time.Duration) {
+	s.record("dequeued", priority, nil)
+}
+func (s *recordingSink) Completed(priority int, run time.Duration) {
+	s.record("completed", priority, nil)
+}
+func (s *recordingSink) Failed(priority int, run time.Duration, err error) {
+	s.record("failed", priority, err)
+}
+func (s *recordingSink) Rejected(priority int, err error) { s.record("rejected", priority, err) }
+
+func TestEngineMetricsSink(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(1, 8)
+	sink := newRecordingSink()
+	engine, err := New(pq, 1, WithMetricsSink(sink))
+	if err != nil {
+		t.Fatalf("It should not error, because all are correct parameters, instead we got %v", err)
+	}
+
+	errFailing := errors.New("failing")
+	gate := make(chan bool)
+	fn := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		<-gate
+		if arg != nil {
+			return nil, arg.(error)
+		}
+		return nil, nil
+	}
+	running, _ := engine.Submit(context.Background(), 3, fn, nil)
+	for engine.Len() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	queued, _ := engine.Submit(context.Background(), 5, fn, errFailing)
+	_, err = engine.Submit(context.Background(), 7, fn, nil)
+	if err == nil {
+		t.Fatal("It should error, cause the queue is full, but instead we got nil")
+	}
+
+	close(gate)
+	running.Result()
+	queued.Result()
+	engine.Close()
+
+	for _, c := range []struct {
+		event    string
+		priority int
+		expected int
+	}{
+		{"enqueued", 3, 1},
+		{"enqueued", 5, 1},
+		{"dequeued", 3, 1},
+		{"dequeued", 5, 1},
+		{"completed", 3, 1},
+		{"failed", 5, 1},
+		{"rejected", 7, 1},
+	} {
+		if got := sink.count(c.event, c.priority); got != c.expected {
+			t.Fatalf("Expected %d %s events with priority %d, but instead we got %d",
+				c.expected, c.event, c.priority, got)
+		}
+	}
+	if len(sink.errs) != 2 || !errors.Is(sink.errs[1], errFailing) {
+		t.Fatalf("Expected the queue error, then errFailing, but instead we got %v", sink.errs)
+	}
+
+	stats := engine.Stats()
+	if stats.Enqueued != 2 || stats.Dequeued != 2 || stats.Succeeded != 1 ||
+		stats.Failed != 1 || stats.Rejected != 1 || stats.Depth != 0 {
+		t.Fatalf("Expected counters to match the events, but instead we got %+v", stats)
+	}
+	if stats.Workers != 1 || stats.AvgRunTime <= 0 {
+		t.Fatalf("Expected 1 worker and a positive run time, but instead we got %+v", stats)
+	}
+}
+
+func TestEngineStatsWithoutSink(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	engine, _ := New(pq, 2)
+	defer engine.Close()
+
+	fn := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		return nil, nil
+	}
+	for i := 0; i < 10; i++ {
+		task, _ := engine.Submit(context.Background(), i%8, fn, nil)
+		task.Result()
+	}
+	engine.SubmitAndForget(context.Background(), 0, fn, nil)
+	for engine.Stats().Succeeded != 11 {
+		time.Sleep(time.Millisecond)
+	}
+	if stats := engine.Stats(); stats.Enqueued != 11 || stats.Dequeued != 11 {
+		t.Fatalf("Expected 11 enqueued and dequeued, but instead we got %+v", stats)
+	}
+}
@@ -0,0 +1,26 @@
+package prioritize
+
+// Middleware wraps the fn of every task, e.g. to log, authorize, or recover from panics,
+// just like http middleware wraps handlers. See `WithMiddleware`.
+type Middleware func(next TaskFunc) TaskFunc
+
+// WithMiddleware makes the engine wrap the fn of every submitted task with `mws`.
+// The first one is the outermost, and so runs first. Giving this option more than once
+// adds to the previous ones.
+//
+// Tasks are wrapped on submit, so a retried (see `WithRetry`) or yielding task
+// runs through the middleware again, but keeps the same wrapped fn.
+func WithMiddleware(mws ...Middleware) Option {
+	return func(e *Engine) error {
+		e.middleware = append(e.middleware, mws...)
+		return nil
+	}
+}
+
+// wrap returns `fn` wrapped with all middleware of the engine
+func (e *Engine) wrap(fn TaskFunc) TaskFunc {
+	for i := len(e.middleware) - 1; i >= 0; i-- {
+		fn = e.middleware[i](fn)
+	}
+	return fn
+}
@@ -0,0 +1,61 @@
+package prioritize
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/aarondwi/prioritize/priority"
+)
+
+func TestEngineWithMiddleware(t *testing.T) {
+	var mu sync.Mutex
+	var order []string
+	trace := func(name string) Middleware {
+		return func(next TaskFunc) TaskFunc {
+			return func(ctx context.Context, arg interface{}) (interface{}, error) {
+				mu.Lock()
+				order = append(order, name)
+				mu.Unlock()
+				return next(ctx, arg)
+			}
+		}
+	}
+	errForbidden := errors.New("forbidden")
+	auth := func(next TaskFunc) TaskFunc {
+		return func(ctx context.Context, arg interface{}) (interface{}, error) {
+			if arg.(int) < 0 {
+				return nil, errForbidden
+			}
+			return next(ctx, arg)
+		}
+	}
+
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	engine, _ := New(pq, 1, WithMiddleware(trace("outer"), trace("inner")), WithMiddleware(auth))
+	defer engine.Close()
+
+	fn := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		mu.Lock()
+		order = append(order, "fn")
+		mu.Unlock()
+		return arg, nil
+	}
+	task, _ := engine.Submit(context.Background(), 0, fn, 1)
+	result, err := task.Result()
+	if err != nil || result.(int) != 1 {
+		t.Fatalf("Expected 1, but instead we got %v and %v", result, err)
+	}
+	mu.Lock()
+	if len(order) != 3 || order[0] != "outer" || order[1] != "inner" || order[2] != "fn" {
+		t.Fatalf("Expected middleware to run in the order given, but instead we got %v", order)
+	}
+	mu.Unlock()
+
+	task, _ = engine.Submit(context.Background(), 0, fn, -1)
+	_, err = task.Result()
+	if err == nil || err != errForbidden {
+		t.Fatalf("It should be stopped by the middleware, but instead we got %v", err)
+	}
+}
@@ -0,0 +1,350 @@
+package mlfq
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/linkedslice"
+)
+
+// MLFQ is a multi-level feedback queue, just like in OS schedulers.
+//
+// All items enter the top level (numOfLevels-1), whatever their priority,
+// and pops always take from the highest non-empty level, FIFO inside a level.
+// Items which run for their whole quantum and come back (see `Requeue`)
+// are demoted 1 level, so long-running work gives way to short new ones.
+//
+// The priority of popped items is the level they are taken from.
+type MLFQ struct {
+	// synchronization primitive
+	// read-only calls (e.g. Len) only take the read lock,
+	// so they don't contend with each other
+	mu       *sync.RWMutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	// broadcast once the size reaches 0, see `WaitUntilEmpty`
+	emptied *sync.Cond
+
+	// we separate number tracking from the queues
+	// so checking numberOfTasksInEachQueue just need 1 cache miss (putting into cpu L1 cache)
+	numberOfTasksInEachQueue []int
+	queues                   []*linkedslice.LinkedSlice
+	quantum                  time.Duration
+
+	// simple metadata
+	limitPriority int
+	size          int
+	sizeLimit     int
+	running       bool
+	closed        chan struct{}
+	draining      bool
+}
+
+// NewMLFQ creates our multi-level feedback queue.
+//
+// It caps at sizeLimit, has `numOfLevels` levels,
+// and items are demoted after running `quantum` or longer.
+func NewMLFQ(sizeLimit, numOfLevels int, quantum time.Duration) (*MLFQ, error) {
+	if sizeLimit <= 0 || numOfLevels <= 0 || quantum <= 0 {
+		return nil, common.ErrParamShouldBePositive
+	}
+
+	mu := &sync.RWMutex{}
+	queues := make([]*linkedslice.LinkedSlice, numOfLevels)
+	for i := range queues {
+		queues[i] = linkedslice.NewLinkedSlice()
+	}
+	return &MLFQ{
+		mu:                       mu,
+		notEmpty:                 sync.NewCond(mu),
+		notFull:                  sync.NewCond(mu),
+		emptied:                  sync.NewCond(mu),
+		numberOfTasksInEachQueue: make([]int, numOfLevels),
+		queues:                   queues,
+		quantum:                  quantum,
+		limitPriority:            numOfLevels,
+		sizeLimit:                sizeLimit,
+		running:                  true,
+		closed:                   make(chan struct{}),
+	}, nil
+}
+
+// PushOrError put the item into the top level, and returns error if no slot available
+func (m *MLFQ) PushOrError(item common.QItem) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.pushLocked(item); err != nil {
+		return m.queueErrorLocked("PushOrError", item, err)
+	}
+	return nil
+}
+
+// PushOrWaitCtx is the same as PushOrError, but waits for a slot while the queue is full,
+// and returns `ctx.Err()` once `ctx` is done while waiting
+func (m *MLFQ) PushOrWaitCtx(ctx context.Context, item common.QItem) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	err := m.pushLocked(item)
+	if err == common.ErrQueueIsFull {
+		defer common.WakeOnDone(ctx, m.notFull)()
+	}
+	for err == common.ErrQueueIsFull {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		m.notFull.Wait()
+		err = m.pushLocked(item)
+	}
+	if err != nil {
+		return m.queueErrorLocked("PushOrWaitCtx", item, err)
+	}
+	return nil
+}
+
+// queueErrorLocked adds what m looks like right now to `err`, see `common.QueueError`
+func (m *MLFQ) queueErrorLocked(op string, item common.QItem, err error) error {
+	return &common.QueueError{Op: op, Priority: item.Priority, Size: m.size, Limit: m.sizeLimit, Err: err}
+}
+
+func (m *MLFQ) pushLocked(item common.QItem) error {
+	if !m.running || m.draining {
+		return common.ErrQueueIsClosed
+	}
+	if m.size == m.sizeLimit {
+		return common.ErrQueueIsFull
+	}
+	item.Priority = m.limitPriority - 1
+	return m.enqueueLocked(item)
+}
+
+// Requeue puts back a popped item, which is not done yet.
+// It stays in its level, or goes 1 level down if `demote` (but never below 0).
+//
+// As the item was already admitted, it is not rejected for the size limit,
+// nor while closing gracefully. Only a closed MLFQ returns error.
+func (m *MLFQ) Requeue(item common.QItem, demote bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.running {
+		return m.queueErrorLocked("Requeue", item, common.ErrQueueIsClosed)
+	}
+	if item.Priority < 0 || item.Priority >= m.limitPriority {
+		return m.queueErrorLocked("Requeue", item, common.ErrPriorityOutOfRange)
+	}
+	if demote && item.Priority > 0 {
+		item.Priority--
+	}
+	if err := m.enqueueLocked(item); err != nil {
+		return m.queueErrorLocked("Requeue", item, err)
+	}
+	return nil
+}
+
+// Quantum returns how long an item can run before being demoted on `Requeue`
+func (m *MLFQ) Quantum() time.Duration {
+	return m.quantum
+}
+
+func (m *MLFQ) enqueueLocked(item common.QItem) error {
+	err := m.queues[item.Priority].PushOrError(item)
+	// meaning already closed, cause linkedslices is unbounded
+	if err != nil {
+		return err
+	}
+	m.numberOfTasksInEachQueue[item.Priority]++
+	m.size++
+	m.notEmpty.Signal()
+	return nil
+}
+
+// PopOrWaitTillClose returns 1 QItem from the highest non-empty level, or waits if none exists
+func (m *MLFQ) PopOrWaitTillClose() (common.QItem, error) {
+	return m.PopOrWaitCtx(context.Background())
+}
+
+// PopOrWaitCtx is the same as PopOrWaitTillClose,
+// but also returns `ctx.Err()` once `ctx` is done while waiting
+func (m *MLFQ) PopOrWaitCtx(ctx context.Context) (common.QItem, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.running {
+		return common.MinQItem, common.ErrQueueIsClosed
+	}
+	if m.size == 0 {
+		defer common.WakeOnDone(ctx, m.notEmpty)()
+	}
+	for m.size == 0 {
+		if m.draining {
+			m.closeLocked()
+			return common.MinQItem, common.ErrQueueIsClosed
+		}
+		if err := ctx.Err(); err != nil {
+			return common.MinQItem, err
+		}
+		m.notEmpty.Wait()
+		// double check, ensuring see the changes after wait call
+		if !m.running {
+			return common.MinQItem, common.ErrQueueIsClosed
+		}
+	}
+	return m.popLocked()
+}
+
+// TryPop is the non-blocking version of PopOrWaitTillClose.
+// It returns `common.ErrQueueIsEmpty` right away if the queue is empty.
+func (m *MLFQ) TryPop() (common.QItem, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.running {
+		return common.MinQItem, common.ErrQueueIsClosed
+	}
+	if m.size == 0 {
+		return common.MinQItem, common.ErrQueueIsEmpty
+	}
+	return m.popLocked()
+}
+
+// popLocked takes the next item, there should be at least 1
+func (m *MLFQ) popLocked() (common.QItem, error) {
+	level := m.limitPriority - 1
+	for m.numberOfTasksInEachQueue[level] == 0 {
+		level--
+	}
+	// if we wait blindly, it gonna stuck
+	// but we are tracking it manually, ensuring it will never wait
+	result, err := m.queues[level].PopOrWaitTillClose()
+	if err != nil {
+		return common.MinQItem, err
+	}
+	m.numberOfTasksInEachQueue[level]--
+	m.size--
+	m.notFull.Signal()
+	if m.size == 0 {
+		m.emptied.Broadcast()
+		if m.draining {
+			m.closeLocked()
+		}
+	}
+	return result, nil
+}
+
+// Peek returns the oldest item of the highest non-empty level, which the next pop returns,
+// without removing it, or `common.ErrQueueIsEmpty` if the MLFQ is empty.
+func (m *MLFQ) Peek() (common.QItem, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if !m.running {
+		return common.MinQItem, common.ErrQueueIsClosed
+	}
+	for level := m.limitPriority - 1; level >= 0; level-- {
+		if m.numberOfTasksInEachQueue[level] > 0 {
+			item, _ := m.queues[level].Peek()
+			return item, nil
+		}
+	}
+	return common.MinQItem, common.ErrQueueIsEmpty
+}
+
+// Len returns the number of items currently in the MLFQ
+func (m *MLFQ) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.size
+}
+
+// Cap returns the maximum number of items the MLFQ can hold
+func (m *MLFQ) Cap() int {
+	return m.sizeLimit
+}
+
+// DepthPerPriority returns the number of items currently in each level of the MLFQ
+func (m *MLFQ) DepthPerPriority() []int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	depths := make([]int, m.limitPriority)
+	copy(depths, m.numberOfTasksInEachQueue)
+	return depths
+}
+
+// Close is the same as CloseNow
+func (m *MLFQ) Close() error {
+	return m.CloseNow()
+}
+
+// CloseNow closes MLFQ, preventing it from accepting new request.
+// Remaining items are dropped, and waiting pops return immediately.
+// Closing it again does nothing, only returning `common.ErrQueueIsClosed`.
+func (m *MLFQ) CloseNow() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.running {
+		return common.ErrQueueIsClosed
+	}
+	m.closeLocked()
+	return nil
+}
+
+// CloseGracefully stops MLFQ from accepting new request,
+// but pops keep returning the remaining items.
+// Once it is empty, it is closed the same way as CloseNow.
+func (m *MLFQ) CloseGracefully() {
+	m.mu.Lock()
+	if m.running {
+		m.draining = true
+		if m.size == 0 {
+			m.closeLocked()
+		}
+	}
+	m.mu.Unlock()
+}
+
+// WaitUntilEmpty waits until MLFQ holds no item, and returns nil.
+// It returns `common.ErrQueueIsClosed` if MLFQ is closed with items left,
+// or `ctx.Err()` once `ctx` is done while waiting.
+func (m *MLFQ) WaitUntilEmpty(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.size > 0 {
+		defer common.WakeOnDone(ctx, m.emptied)()
+	}
+	for m.size > 0 {
+		if !m.running {
+			return common.ErrQueueIsClosed
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		m.emptied.Wait()
+	}
+	return nil
+}
+
+// IsClosed returns whether MLFQ is closed, after which no item is popped anymore
+func (m *MLFQ) IsClosed() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return !m.running
+}
+
+// Closed returns a channel which is closed once MLFQ is closed,
+// so other goroutines can select on it
+func (m *MLFQ) Closed() <-chan struct{} {
+	return m.closed
+}
+
+func (m *MLFQ) closeLocked() {
+	if !m.running {
+		// already closed, m.closed can't be closed twice
+		return
+	}
+	m.running = false
+	close(m.closed)
+	for _, q := range m.queues {
+		q.Close()
+	}
+	m.notEmpty.Broadcast()
+	m.notFull.Broadcast()
+	m.emptied.Broadcast()
+}
@@ -0,0 +1,115 @@
+package mlfq
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/queuetest"
+)
+
+func TestNewMLFQErrors(t *testing.T) {
+	_, err := NewMLFQ(10, 3, 0)
+	if err == nil || err != common.ErrParamShouldBePositive {
+		t.Fatalf("It should error, cause quantum can't be zero, but instead we got %v", err)
+	}
+	_, err = NewMLFQ(10, 0, time.Second)
+	if err == nil || err != common.ErrParamShouldBePositive {
+		t.Fatalf("It should error, cause numOfLevels can't be zero, but instead we got %v", err)
+	}
+}
+
+func TestMLFQRequeue(t *testing.T) {
+	m, _ := NewMLFQ(2, 3, time.Second)
+	if m.Quantum() != time.Second {
+		t.Fatalf("Expected quantum 1s, but instead we got %v", m.Quantum())
+	}
+	m.PushOrError(common.QItem{ID: 1, Priority: 0})
+	m.PushOrError(common.QItem{ID: 2, Priority: 0})
+	err := m.PushOrError(common.QItem{ID: 3})
+	if !errors.Is(err, common.ErrQueueIsFull) {
+		t.Fatalf("It should error, cause queue is full, but instead we got %v", err)
+	}
+
+	// everything enters the top level
+	item, _ := m.PopOrWaitTillClose()
+	if item.ID != 1 || item.Priority != 2 {
+		t.Fatalf("Expected ID 1 at top level 2, but instead we got %v", item)
+	}
+	m.Requeue(item, true)
+	item, _ = m.PopOrWaitTillClose()
+	if item.ID != 2 || item.Priority != 2 {
+		t.Fatalf("Demoted item should give way, so expected ID 2, but instead we got %v", item)
+	}
+	m.Requeue(item, false)
+	item, _ = m.PopOrWaitTillClose()
+	if item.ID != 2 || item.Priority != 2 {
+		t.Fatalf("Not demoted item should stay at top, but instead we got %v", item)
+	}
+
+	item, _ = m.PopOrWaitTillClose()
+	if item.ID != 1 || item.Priority != 1 {
+		t.Fatalf("Expected ID 1 at level 1, but instead we got %v", item)
+	}
+	item.Priority = 0
+	m.Requeue(item, true)
+	item, _ = m.PopOrWaitTillClose()
+	if item.Priority != 0 {
+		t.Fatalf("It should never go below level 0, but instead we got %v", item)
+	}
+
+	m.Close()
+	err = m.Requeue(item, false)
+	if !errors.Is(err, common.ErrQueueIsClosed) {
+		t.Fatalf("It should error, cause MLFQ is closed, but instead we got %v", err)
+	}
+}
+
+func TestMLFQCloseGracefully(t *testing.T) {
+	m, _ := NewMLFQ(10, 3, time.Second)
+	m.PushOrError(common.QItem{ID: 1})
+	m.CloseGracefully()
+
+	item, err := m.PopOrWaitTillClose()
+	if err != nil || item.ID != 1 {
+		t.Fatalf("It should still return the remaining item, but instead we got %v and %v", item, err)
+	}
+	_, err = m.PopOrWaitTillClose()
+	if err == nil || err != common.ErrQueueIsClosed {
+		t.Fatalf("It should be closed after draining, but instead we got %v", err)
+	}
+}
+
+func TestMLFQWaitUntilEmpty(t *testing.T) {
+	m, _ := NewMLFQ(10, 3, time.Second)
+	m.PushOrError(common.QItem{ID: 1})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := m.WaitUntilEmpty(ctx); err == nil || err != context.DeadlineExceeded {
+		t.Fatalf("It should return context.DeadlineExceeded, cause nothing is popped, but instead we got %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- m.WaitUntilEmpty(context.Background())
+	}()
+	m.PopOrWaitTillClose()
+	if err := <-done; err != nil {
+		t.Fatalf("It should return once the last item is popped, but instead we got %v", err)
+	}
+
+	m.PushOrError(common.QItem{ID: 2})
+	m.Close()
+	if err := m.WaitUntilEmpty(context.Background()); err == nil || err != common.ErrQueueIsClosed {
+		t.Fatalf("It should return ErrQueueIsClosed, cause closed with items left, but instead we got %v", err)
+	}
+}
+
+func TestMLFQConformance(t *testing.T) {
+	queuetest.Run(t, func(sizeLimit int) (common.ExtendedQInterface, error) {
+		return NewMLFQ(sizeLimit, 3, time.Second)
+	})
+}
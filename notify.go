@@ -0,0 +1,24 @@
+package prioritize
+
+import "context"
+
+// SubmitAndNotify is the same as `SubmitWithCallback`, but no `Task` is returned,
+// so nobody can wait for it, and `onComplete` is the only way to get its result and error.
+// It is meant for hot paths which do want the outcome, unlike `SubmitAndForget`.
+//
+// As nobody keeps it, the task is put back into a pool right after `onComplete` returns,
+// and reused by later submissions, so it does not allocate in the steady state.
+// Don't keep the `Task` given to the deadletter (see `WithDeadletter`) after it returns either.
+// Tasks are not pooled with `WithMaxQueueWait` or `WithCancelledTaskReaping`,
+// as the engine may still reach them after they complete.
+func (e *Engine) SubmitAndNotify(
+	ctx context.Context,
+	priority int,
+	fn TaskFunc,
+	arg interface{},
+	onComplete func(result interface{}, err error)) error {
+
+	recycle := e.maxQueueWait == 0 && e.reapable == nil
+	_, err := e.submit(ctx, priority, fn, arg, onComplete, nil, recycle)
+	return err
+}
@@ -0,0 +1,80 @@
+package prioritize
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aarondwi/prioritize/priority"
+)
+
+func TestEngineSubmitAndNotify(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	engine, _ := New(pq, 1)
+
+	type outcome struct {
+		result interface{}
+		err    error
+	}
+	outcomes := make(chan outcome, 100)
+	onComplete := func(result interface{}, err error) {
+		outcomes <- outcome{result, err}
+	}
+
+	errFailing := errors.New("failing")
+	fn := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		if arg.(int)%2 == 1 {
+			return arg, errFailing
+		}
+		return arg, nil
+	}
+	// enough for tasks to be reused
+	for i := 0; i < 100; i++ {
+		if err := engine.SubmitAndNotify(context.Background(), 0, fn, i, onComplete); err != nil {
+			t.Fatalf("It should be accepted, but instead we got %v", err)
+		}
+	}
+	seen := make(map[int]bool)
+	for i := 0; i < 100; i++ {
+		o := <-outcomes
+		if o.err == errFailing {
+			if o.result != nil {
+				t.Fatalf("It should give no result with the error, just like Result(), but instead we got %v", o.result)
+			}
+			continue
+		}
+		if o.err != nil || o.result.(int)%2 != 0 || seen[o.result.(int)] {
+			t.Fatalf("It should give each even arg once, but instead we got %v and %v", o.result, o.err)
+		}
+		seen[o.result.(int)] = true
+	}
+	if len(seen) != 50 {
+		t.Fatalf("It should succeed 50 tasks, but instead we got %d", len(seen))
+	}
+
+	engine.Close()
+	err := engine.SubmitAndNotify(context.Background(), 0, fn, 0, onComplete)
+	if err == nil || err != ErrAlreadyClosed {
+		t.Fatalf("It should return ErrAlreadyClosed, but instead we got %v", err)
+	}
+}
+
+func BenchmarkEngineSubmitAndNotify(b *testing.B) {
+	pq, _ := priority.NewPriorityQueue(b.N+1, 8)
+	engine, _ := New(pq, 1)
+	defer engine.Close()
+	fn := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		return nil, nil
+	}
+	// bounds the queued tasks, so completed ones are reused, instead of all piling up in the queue
+	inflight := make(chan struct{}, 1024)
+	onComplete := func(result interface{}, err error) {
+		<-inflight
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		inflight <- struct{}{}
+		engine.SubmitAndNotify(context.Background(), 0, fn, nil, onComplete)
+	}
+}
@@ -0,0 +1,507 @@
+package policy
+
+import (
+	"context"
+	"sync"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/linkedslice"
+)
+
+// Policy decides which priority is popped next.
+//
+// It is only called while the queue holds its lock,
+// so it doesn't need to be goroutine-safe, and can keep its own history
+// (e.g. which priority it returned last time) between calls.
+type Policy interface {
+	// Next returns the index of the priority to pop from,
+	// given the number of items in each priority.
+	// `depths` is a copy, reused by the next call, so don't keep it.
+	// It is only called when at least 1 priority has items,
+	// and it should return one which has items.
+	Next(depths []int) int
+}
+
+// StrictPriority always pops the highest priority having items.
+// This is what `priority.PriorityQueue` does.
+type StrictPriority struct{}
+
+// Next returns the highest non-empty priority
+func (StrictPriority) Next(depths []int) int {
+	for i := len(depths) - 1; i >= 0; i-- {
+		if depths[i] > 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// RoundRobin pops 1 item from each non-empty priority in turn,
+// going from higher to lower, then wrapping around.
+//
+// The zero value starts from the highest priority.
+type RoundRobin struct {
+	started bool
+	last    int
+}
+
+// Next returns the next non-empty priority below the last returned one, wrapping around
+func (rr *RoundRobin) Next(depths []int) int {
+	start := len(depths) - 1
+	if rr.started {
+		start = rr.last - 1 + len(depths)
+	}
+	for k := 0; k < len(depths); k++ {
+		i := (start - k) % len(depths)
+		if depths[i] > 0 {
+			rr.started = true
+			rr.last = i
+			return i
+		}
+	}
+	return -1
+}
+
+// StrictPriorityWithBudget pops the highest priority having items,
+// but every `Every` pops, it pops the lowest priority having items instead,
+// so low priorities get at least 1 in `Every` pops, no matter how busy the higher ones are.
+// The count restarts each time the lowest non-empty priority is popped, even if it is the highest too.
+//
+// This sits between `StrictPriority`, which starves low priorities, and `RoundRobin`,
+// which ignores priority as long as there are items.
+// `Every` of 0 or less behaves as `StrictPriority`.
+type StrictPriorityWithBudget struct {
+	Every int
+
+	// pops since the lowest non-empty priority was last popped
+	sinceLowest int
+}
+
+// Next returns the lowest non-empty priority once the budget is used up,
+// or the highest non-empty one otherwise
+func (sp *StrictPriorityWithBudget) Next(depths []int) int {
+	lowest := -1
+	for i, d := range depths {
+		if d > 0 {
+			lowest = i
+			break
+		}
+	}
+	result := StrictPriority{}.Next(depths)
+	if sp.Every > 0 && sp.sinceLowest+1 >= sp.Every {
+		result = lowest
+	}
+
+	if result == lowest {
+		sp.sinceLowest = 0
+	} else {
+		sp.sinceLowest++
+	}
+	return result
+}
+
+// Queue is a queue which takes care of locking, waiting, and close semantics,
+// leaving which priority to pop next to its Policy.
+//
+// Like the other built-in queues, it caps at a size limit,
+// allows priority [0,numOfPriority), and is FIFO inside a priority.
+type Queue struct {
+	// synchronization primitive
+	// read-only calls (e.g. Len) only take the read lock,
+	// so they don't contend with each other
+	mu       *sync.RWMutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	// broadcast once the size reaches 0, see `WaitUntilEmpty`
+	emptied *sync.Cond
+
+	// we separate number tracking from the queues
+	// so the policy only needs to look at this
+	numberOfTasksInEachQueue []int
+	queues                   []*linkedslice.LinkedSlice
+	policy                   Policy
+	// copied from numberOfTasksInEachQueue for each call of the policy,
+	// so it can't change ours
+	depths []int
+
+	// simple metadata
+	limitPriority int
+	size          int
+	sizeLimit     int
+	running       bool
+	closed        chan struct{}
+	draining      bool
+}
+
+// NewQueue creates a Queue popping according to `policy`
+func NewQueue(sizeLimit, numOfPriority int, policy Policy) (*Queue, error) {
+	if sizeLimit <= 0 || numOfPriority <= 0 {
+		return nil, common.ErrParamShouldBePositive
+	}
+
+	mu := &sync.RWMutex{}
+	return &Queue{
+		mu:                       mu,
+		notEmpty:                 sync.NewCond(mu),
+		notFull:                  sync.NewCond(mu),
+		emptied:                  sync.NewCond(mu),
+		numberOfTasksInEachQueue: make([]int, numOfPriority),
+		queues:                   make([]*linkedslice.LinkedSlice, numOfPriority),
+		policy:                   policy,
+		depths:                   make([]int, numOfPriority),
+		limitPriority:            numOfPriority,
+		sizeLimit:                sizeLimit,
+		running:                  true,
+		closed:                   make(chan struct{}),
+	}, nil
+}
+
+// PushOrError put the item into the queue, and returns error if no slot available
+func (q *Queue) PushOrError(item common.QItem) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if item.Priority < 0 || item.Priority >= q.limitPriority {
+		return q.queueErrorLocked("PushOrError", item, common.ErrPriorityOutOfRange)
+	}
+	if err := q.pushLocked(item); err != nil {
+		return q.queueErrorLocked("PushOrError", item, err)
+	}
+	return nil
+}
+
+// PushOrWaitCtx is the same as PushOrError, but waits for a slot while the queue is full,
+// and returns `ctx.Err()` once `ctx` is done while waiting
+func (q *Queue) PushOrWaitCtx(ctx context.Context, item common.QItem) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if item.Priority < 0 || item.Priority >= q.limitPriority {
+		return q.queueErrorLocked("PushOrWaitCtx", item, common.ErrPriorityOutOfRange)
+	}
+	err := q.pushLocked(item)
+	if err == common.ErrQueueIsFull {
+		defer common.WakeOnDone(ctx, q.notFull)()
+	}
+	for err == common.ErrQueueIsFull {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		q.notFull.Wait()
+		err = q.pushLocked(item)
+	}
+	if err != nil {
+		return q.queueErrorLocked("PushOrWaitCtx", item, err)
+	}
+	return nil
+}
+
+// queueErrorLocked adds what q looks like right now to `err`, see `common.QueueError`
+func (q *Queue) queueErrorLocked(op string, item common.QItem, err error) error {
+	return &common.QueueError{Op: op, Priority: item.Priority, Size: q.size, Limit: q.sizeLimit, Err: err}
+}
+
+func (q *Queue) pushLocked(item common.QItem) error {
+	if !q.running || q.draining {
+		return common.ErrQueueIsClosed
+	}
+	if q.size == q.sizeLimit {
+		return common.ErrQueueIsFull
+	}
+
+	if q.queues[item.Priority] == nil {
+		q.queues[item.Priority] = linkedslice.NewLinkedSlice()
+	}
+	err := q.queues[item.Priority].PushOrError(item)
+	// meaning already closed, cause linkedslices is unbounded
+	if err != nil {
+		return err
+	}
+	q.numberOfTasksInEachQueue[item.Priority]++
+	q.size++
+	q.notEmpty.Signal()
+	return nil
+}
+
+// PopOrWaitTillClose returns 1 QItem from the priority chosen by the policy,
+// or waits if none exists
+func (q *Queue) PopOrWaitTillClose() (common.QItem, error) {
+	return q.PopOrWaitCtx(context.Background())
+}
+
+// PopOrWaitCtx is the same as PopOrWaitTillClose,
+// but also returns `ctx.Err()` once `ctx` is done while waiting
+func (q *Queue) PopOrWaitCtx(ctx context.Context) (common.QItem, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.waitLocked(ctx); err != nil {
+		return common.MinQItem, err
+	}
+	result, err := q.takeLocked()
+	if err != nil {
+		return common.MinQItem, err
+	}
+	if q.size == 0 {
+		q.emptied.Broadcast()
+		if q.draining {
+			q.closeLocked()
+		}
+	}
+	return result, nil
+}
+
+// TryPop is the non-blocking version of PopOrWaitTillClose.
+// It returns `common.ErrQueueIsEmpty` right away if the queue is empty.
+func (q *Queue) TryPop() (common.QItem, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.running {
+		return common.MinQItem, common.ErrQueueIsClosed
+	}
+	if q.size == 0 {
+		return common.MinQItem, common.ErrQueueIsEmpty
+	}
+	result, err := q.takeLocked()
+	if err != nil {
+		return common.MinQItem, err
+	}
+	if q.size == 0 {
+		q.emptied.Broadcast()
+		if q.draining {
+			q.closeLocked()
+		}
+	}
+	return result, nil
+}
+
+// Peek returns the oldest item of the highest non-empty priority, without removing it,
+// or `common.ErrQueueIsEmpty` if the queue is empty.
+// Which priority the next pop takes is up to the Policy,
+// so it is only the item the next pop returns with `StrictPriority`.
+func (q *Queue) Peek() (common.QItem, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if !q.running {
+		return common.MinQItem, common.ErrQueueIsClosed
+	}
+	for p := q.limitPriority - 1; p >= 0; p-- {
+		if q.numberOfTasksInEachQueue[p] > 0 {
+			item, _ := q.queues[p].Peek()
+			return item, nil
+		}
+	}
+	return common.MinQItem, common.ErrQueueIsEmpty
+}
+
+// PopBatchOrWaitTillClose waits like PopOrWaitTillClose,
+// and then returns up to `max` items in the same order as popping them one by one,
+// only taking the lock once.
+func (q *Queue) PopBatchOrWaitTillClose(max int) ([]common.QItem, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.waitLocked(context.Background()); err != nil {
+		return nil, err
+	}
+	results := make([]common.QItem, 0, max)
+	for len(results) < max && q.size > 0 {
+		result, err := q.takeLocked()
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	if q.size == 0 {
+		q.emptied.Broadcast()
+		if q.draining {
+			q.closeLocked()
+		}
+	}
+	return results, nil
+}
+
+// waitLocked waits until there is an item,
+// or returns error if the queue is closed, or `ctx` is done, in the meantime.
+func (q *Queue) waitLocked(ctx context.Context) error {
+	if !q.running {
+		return common.ErrQueueIsClosed
+	}
+	if q.size == 0 {
+		defer common.WakeOnDone(ctx, q.notEmpty)()
+	}
+	for q.size == 0 {
+		if q.draining {
+			q.closeLocked()
+			return common.ErrQueueIsClosed
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		q.notEmpty.Wait()
+		// double check, ensuring see the changes after wait call
+		if !q.running {
+			return common.ErrQueueIsClosed
+		}
+	}
+	return nil
+}
+
+// takeLocked pops 1 item from the priority chosen by the policy, q.size should be > 0
+func (q *Queue) takeLocked() (common.QItem, error) {
+	copy(q.depths, q.numberOfTasksInEachQueue)
+	p := q.policy.Next(q.depths)
+	if p < 0 || p >= q.limitPriority || q.numberOfTasksInEachQueue[p] == 0 {
+		panic("Broken policy: it should return a priority having items")
+	}
+
+	// if we wait blindly, it gonna stuck
+	// but we are tracking it manually, ensuring it will never wait
+	result, err := q.queues[p].PopOrWaitTillClose()
+	if err != nil {
+		// the only error possible here is closed already
+		return common.MinQItem, err
+	}
+	q.numberOfTasksInEachQueue[p]--
+	q.size--
+	q.notFull.Signal()
+	return result, nil
+}
+
+// Remove takes out the item with `id`, freeing its slot,
+// or returns `common.ErrItemNotFound` if it is not in the queue anymore.
+func (q *Queue) Remove(id uint64) (common.QItem, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.running {
+		return common.MinQItem, common.ErrQueueIsClosed
+	}
+
+	for p := 0; p < q.limitPriority; p++ {
+		if q.numberOfTasksInEachQueue[p] == 0 {
+			continue
+		}
+		item, ok := q.queues[p].Remove(id)
+		if !ok {
+			continue
+		}
+		q.numberOfTasksInEachQueue[p]--
+		q.size--
+		q.notFull.Signal()
+		if q.size == 0 {
+			q.emptied.Broadcast()
+			if q.draining {
+				q.closeLocked()
+			}
+		}
+		return item, nil
+	}
+	return common.MinQItem, common.ErrItemNotFound
+}
+
+// Compact releases memory held by the queue of each priority, see `linkedslice.CompactAll`.
+func (q *Queue) Compact() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	linkedslice.CompactAll(q.queues)
+}
+
+// Len returns the number of items currently in the queue
+func (q *Queue) Len() int {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.size
+}
+
+// Cap returns the maximum number of items the queue can hold
+func (q *Queue) Cap() int {
+	return q.sizeLimit
+}
+
+// DepthPerPriority returns the number of items currently in each priority
+func (q *Queue) DepthPerPriority() []int {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	depths := make([]int, q.limitPriority)
+	copy(depths, q.numberOfTasksInEachQueue)
+	return depths
+}
+
+// Close is the same as CloseNow
+func (q *Queue) Close() error {
+	return q.CloseNow()
+}
+
+// CloseNow closes Queue, preventing it from accepting new request.
+// Remaining items are dropped, and waiting pops return immediately.
+// Closing it again does nothing, only returning `common.ErrQueueIsClosed`.
+func (q *Queue) CloseNow() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.running {
+		return common.ErrQueueIsClosed
+	}
+	q.closeLocked()
+	return nil
+}
+
+// CloseGracefully stops Queue from accepting new request,
+// but pops keep returning the remaining items.
+// Once it is empty, it is closed the same way as CloseNow.
+func (q *Queue) CloseGracefully() {
+	q.mu.Lock()
+	if q.running {
+		q.draining = true
+		if q.size == 0 {
+			q.closeLocked()
+		}
+	}
+	q.mu.Unlock()
+}
+
+// WaitUntilEmpty waits until Queue holds no item, and returns nil.
+// It returns `common.ErrQueueIsClosed` if Queue is closed with items left,
+// or `ctx.Err()` once `ctx` is done while waiting.
+func (q *Queue) WaitUntilEmpty(ctx context.Context) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.size > 0 {
+		defer common.WakeOnDone(ctx, q.emptied)()
+	}
+	for q.size > 0 {
+		if !q.running {
+			return common.ErrQueueIsClosed
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		q.emptied.Wait()
+	}
+	return nil
+}
+
+// IsClosed returns whether Queue is closed, after which no item is popped anymore
+func (q *Queue) IsClosed() bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return !q.running
+}
+
+// Closed returns a channel which is closed once Queue is closed,
+// so other goroutines can select on it
+func (q *Queue) Closed() <-chan struct{} {
+	return q.closed
+}
+
+func (q *Queue) closeLocked() {
+	if !q.running {
+		// already closed, q.closed can't be closed twice
+		return
+	}
+	q.running = false
+	close(q.closed)
+	for i := 0; i < q.limitPriority; i++ {
+		if q.queues[i] != nil {
+			q.queues[i].Close()
+		}
+	}
+	q.notEmpty.Broadcast()
+	q.notFull.Broadcast()
+	q.emptied.Broadcast()
+}
@@ -0,0 +1,193 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/queuetest"
+)
+
+func TestPolicies(t *testing.T) {
+	if p := (StrictPriority{}).Next([]int{1, 0, 3, 0}); p != 2 {
+		t.Fatalf("It should return the highest non-empty priority, but instead we got %d", p)
+	}
+
+	rr := &RoundRobin{}
+	depths := []int{1, 0, 3, 1}
+	expected := []int{3, 2, 0, 3, 2}
+	for _, e := range expected {
+		if p := rr.Next(depths); p != e {
+			t.Fatalf("Expected %d, but instead we got %d", e, p)
+		}
+	}
+
+	sp := &StrictPriorityWithBudget{Every: 3}
+	expected = []int{3, 3, 0, 3, 3, 0}
+	for _, e := range expected {
+		if p := sp.Next(depths); p != e {
+			t.Fatalf("Expected %d, but instead we got %d", e, p)
+		}
+	}
+	// only 1 priority has items, so the budget restarts every pop
+	expected = []int{3, 3, 3, 3, 3, 0}
+	for i, e := range expected {
+		d := []int{0, 0, 0, 1}
+		if i >= 3 {
+			d = []int{1, 0, 1, 1}
+		}
+		if p := sp.Next(d); p != e {
+			t.Fatalf("Expected %d at %d, but instead we got %d", e, i, p)
+		}
+	}
+}
+
+// lowestFirst is a custom policy, popping the lowest non-empty priority
+type lowestFirst struct{}
+
+func (lowestFirst) Next(depths []int) int {
+	for i, d := range depths {
+		if d > 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestQueueWithCustomPolicy(t *testing.T) {
+	_, err := NewQueue(0, 4, lowestFirst{})
+	if err == nil || err != common.ErrParamShouldBePositive {
+		t.Fatalf("It should error, cause sizeLimit can't be zero, but instead we got %v", err)
+	}
+
+	q, _ := NewQueue(3, 4, lowestFirst{})
+	err = q.PushOrError(common.QItem{ID: 1, Priority: 4})
+	if !errors.Is(err, common.ErrPriorityOutOfRange) {
+		t.Fatalf("It should error, cause priority is out of range, but instead we got %v", err)
+	}
+	q.PushOrError(common.QItem{ID: 1, Priority: 3})
+	q.PushOrError(common.QItem{ID: 2, Priority: 1})
+	q.PushOrError(common.QItem{ID: 3, Priority: 1})
+	err = q.PushOrError(common.QItem{ID: 4, Priority: 0})
+	if !errors.Is(err, common.ErrQueueIsFull) {
+		t.Fatalf("It should error, cause queue is full, but instead we got %v", err)
+	}
+
+	if _, err = q.Remove(3); err != nil {
+		t.Fatalf("It should remove ID 3, but instead we got %v", err)
+	}
+	q.PushOrError(common.QItem{ID: 4, Priority: 0})
+
+	items, _ := q.PopBatchOrWaitTillClose(2)
+	if len(items) != 2 || items[0].ID != 4 || items[1].ID != 2 {
+		t.Fatalf("It should follow the custom policy, but instead we got %v", items)
+	}
+	q.CloseGracefully()
+	item, err := q.PopOrWaitTillClose()
+	if err != nil || item.ID != 1 {
+		t.Fatalf("It should still return the remaining item, but instead we got %v and %v", item, err)
+	}
+	_, err = q.PopOrWaitTillClose()
+	if err == nil || err != common.ErrQueueIsClosed {
+		t.Fatalf("It should be closed after draining, but instead we got %v", err)
+	}
+}
+
+// scribbling wipes the depths it is given, after choosing like lowestFirst
+type scribbling struct{}
+
+func (scribbling) Next(depths []int) int {
+	p := lowestFirst{}.Next(depths)
+	for i := range depths {
+		depths[i] = 0
+	}
+	return p
+}
+
+func TestQueueGivesPolicyACopy(t *testing.T) {
+	q, _ := NewQueue(2048, 4, scribbling{})
+	q.PushOrError(common.QItem{ID: 1, Priority: 3})
+	q.PushOrError(common.QItem{ID: 2, Priority: 1})
+	q.PushOrError(common.QItem{ID: 3, Priority: 1})
+
+	item, err := q.PopOrWaitTillClose()
+	if err != nil || item.ID != 2 {
+		t.Fatalf("Expected ID 2, but instead we got %v and %v", item, err)
+	}
+	if depths := q.DepthPerPriority(); !reflect.DeepEqual(depths, []int{0, 1, 0, 1}) {
+		t.Fatalf("The policy should not change the depths of the queue, but instead we got %v", depths)
+	}
+	for _, e := range []uint64{3, 1} {
+		item, err := q.PopOrWaitTillClose()
+		if err != nil || item.ID != e {
+			t.Fatalf("Expected ID %d, but instead we got %v and %v", e, item, err)
+		}
+	}
+	q.Close()
+}
+
+func TestQueueCloseWakesWaitingPop(t *testing.T) {
+	q, _ := NewQueue(10, 2, StrictPriority{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, err := q.PopOrWaitTillClose()
+		if err == nil || err != common.ErrQueueIsClosed {
+			t.Errorf("It should return ErrQueueIsClosed, but instead we got %v", err)
+		}
+	}()
+	q.Close()
+	wg.Wait()
+}
+
+func TestQueueWaitUntilEmpty(t *testing.T) {
+	q, _ := NewQueue(10, 4, lowestFirst{})
+	q.PushOrError(common.QItem{ID: 1})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := q.WaitUntilEmpty(ctx); err == nil || err != context.DeadlineExceeded {
+		t.Fatalf("It should return context.DeadlineExceeded, cause nothing is popped, but instead we got %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- q.WaitUntilEmpty(context.Background())
+	}()
+	q.PopOrWaitTillClose()
+	if err := <-done; err != nil {
+		t.Fatalf("It should return once the last item is popped, but instead we got %v", err)
+	}
+
+	q.PushOrError(common.QItem{ID: 2})
+	q.Close()
+	if err := q.WaitUntilEmpty(context.Background()); err == nil || err != common.ErrQueueIsClosed {
+		t.Fatalf("It should return ErrQueueIsClosed, cause closed with items left, but instead we got %v", err)
+	}
+}
+
+func TestQueueConformance(t *testing.T) {
+	queuetest.Run(t, func(sizeLimit int) (common.ExtendedQInterface, error) {
+		return NewQueue(sizeLimit, 4, StrictPriority{})
+	})
+}
+
+func TestQueuePeek(t *testing.T) {
+	q, _ := NewQueue(10, 4, StrictPriority{})
+	q.PushOrError(common.QItem{ID: 1, Priority: 0})
+	q.PushOrError(common.QItem{ID: 2, Priority: 3})
+	item, err := q.Peek()
+	if err != nil || item.ID != 2 {
+		t.Fatalf("It should peek ID 2, but instead we got %v and %v", item, err)
+	}
+	popped, _ := q.PopOrWaitTillClose()
+	if popped.ID != item.ID {
+		t.Fatalf("It should pop the peeked item, but instead we got %v", popped)
+	}
+	q.Close()
+}
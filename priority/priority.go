@@ -1,150 +1,1039 @@
-package priority
-
-import (
-	"sync"
-
-	"github.com/aarondwi/prioritize/common"
-	"github.com/aarondwi/prioritize/linkedslice"
-)
-
-// PriorityQueue is a queue in which
-// always try to return higher priority first
-//
-// It is not designed using heap,
-// because as we bound the number of priority allowed,
-// this implementation can reduce check-and-swap nature of `heap`-based implementation
-// and also getting a much clearer code-base
-type PriorityQueue struct {
-	// synchronization primitive
-	mu       *sync.Mutex
-	notEmpty *sync.Cond
-
-	// we separate number tracking from the priorityQueues
-	// so checking numberOfTasksInEachQueue just need 1 cache miss (putting into cpu L1 cache)
-	numberOfTasksInEachQueue []int
-
-	// we also create separate queues for each priority
-	// so it is simple to push/pop the item
-	queues []*linkedslice.LinkedSlice
-
-	// simple metadata
-	limitPriority int
-	size          int
-	sizeLimit     int
-	running       bool
-}
-
-func NewPriorityQueue(sizeLimit, numOfPriority int) (*PriorityQueue, error) {
-	if sizeLimit <= 0 || numOfPriority <= 0 {
-		return nil, common.ErrParamShouldBePositive
-	}
-
-	mu := &sync.Mutex{}
-	notEmpty := sync.NewCond(mu)
-
-	numberOfTasksInEachQueue := make([]int, numOfPriority)
-	queues := make([]*linkedslice.LinkedSlice, numOfPriority)
-
-	return &PriorityQueue{
-		mu:                       mu,
-		notEmpty:                 notEmpty,
-		numberOfTasksInEachQueue: numberOfTasksInEachQueue,
-		queues:                   queues,
-		limitPriority:            numOfPriority,
-		size:                     0,
-		sizeLimit:                sizeLimit,
-		running:                  true,
-	}, nil
-}
-
-// PushOrError put the item into the pq, and returns error if no slot available
-func (pq *PriorityQueue) PushOrError(item common.QItem) error {
-	if item.Priority < 0 || item.Priority >= pq.limitPriority {
-		return common.ErrPriorityOutOfRange
-	}
-
-	pq.mu.Lock()
-	if !pq.running {
-		pq.mu.Unlock()
-		return common.ErrQueueIsClosed
-	}
-	if pq.size == pq.sizeLimit {
-		pq.mu.Unlock()
-		return common.ErrQueueIsFull
-	}
-
-	if pq.queues[item.Priority] == nil {
-		pq.queues[item.Priority] = linkedslice.NewLinkedSlice()
-	}
-	err := pq.queues[item.Priority].PushOrError(item)
-	// meaning already closed, cause linkedslices is unbounded
-	if err != nil {
-		pq.mu.Unlock()
-		return err
-	}
-	pq.numberOfTasksInEachQueue[item.Priority]++
-	pq.size++
-
-	pq.notEmpty.Signal()
-	pq.mu.Unlock()
-	return nil
-}
-
-// PopOrWaitTillClose returns 1 QItem from pq, or waits if none exists
-func (pq *PriorityQueue) PopOrWaitTillClose() (common.QItem, error) {
-	pq.mu.Lock()
-	if !pq.running {
-		pq.mu.Unlock()
-		return common.MinQItem, common.ErrQueueIsClosed
-	}
-
-	for pq.size == 0 {
-		pq.notEmpty.Wait()
-		// double check, ensuring see the changes after wait call
-		if !pq.running {
-			pq.mu.Unlock()
-			return common.MinQItem, common.ErrQueueIsClosed
-		}
-	}
-
-	// we will undoubtedly get at least one item
-	priorityToRetrieve := -1
-	for i := pq.limitPriority - 1; i >= 0; i-- {
-		if pq.numberOfTasksInEachQueue[i] > 0 {
-			priorityToRetrieve = i
-			break
-		}
-	}
-
-	// if we wait blindly, it gonna stuck
-	// but we are tracking it manually, ensuring it will never wait
-	qitem, err := pq.queues[priorityToRetrieve].PopOrWaitTillClose()
-	if err != nil {
-		// the only error possible here is closed already
-		// so we just continue it
-		pq.mu.Unlock()
-		return common.MinQItem, err
-	}
-	result := common.QItem{
-		ID:       qitem.ID,
-		Priority: priorityToRetrieve,
-	}
-	pq.numberOfTasksInEachQueue[priorityToRetrieve]--
-	pq.size--
-
-	pq.mu.Unlock()
-	return result, nil
-}
-
-// Close PriorityQueue, preventing it from accepting new request
-func (pq *PriorityQueue) Close() {
-	pq.mu.Lock()
-	pq.running = false
-	for i := 0; i < pq.limitPriority; i++ {
-		if pq.queues[i] != nil {
-			pq.queues[i].Close()
-		}
-	}
-	pq.notEmpty.Broadcast()
-	pq.mu.Unlock()
-}
+package priority
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/linkedslice"
+)
+
+// PriorityQueue is a queue in which
+// always try to return higher priority first
+//
+// It is not designed using heap,
+// because as we bound the number of priority allowed,
+// this implementation can reduce check-and-swap nature of `heap`-based implementation
+// and also getting a much clearer code-base
+type PriorityQueue struct {
+	// synchronization primitive
+	// read-only calls (e.g. Len) only take the read lock,
+	// so they don't contend with each other
+	mu       *sync.RWMutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	// broadcast once the size reaches 0, see `WaitUntilEmpty`
+	emptied *sync.Cond
+
+	// we separate number tracking from the priorityQueues
+	// so checking numberOfTasksInEachQueue just need 1 cache miss (putting into cpu L1 cache)
+	numberOfTasksInEachQueue []int
+
+	// we also create separate queues for each priority
+	// so it is simple to push/pop the item
+	queues []*linkedslice.LinkedSlice
+
+	// simple metadata
+	limitPriority int
+	size          int
+	sizeLimit     int
+	running       bool
+	closed        chan struct{}
+	draining      bool
+	paused        bool
+
+	// number of pops waiting in `PopAtLeastOrWaitCtx` with minPriority > 0
+	filteredWaiters int
+
+	// nil means the priority is not rate-limited
+	rateLimiters []*common.TokenBucket
+
+	// see `WithLIFO`
+	lifo bool
+
+	// nil means no early drop, see `WithEarlyDrop`
+	earlyDrop *common.EarlyDrop
+	// nil means no callback, see `WithWatermarks`
+	watermarks *common.Watermarks
+	// see `WithLogger`
+	logger common.Logger
+
+	// once size reaches reservedFrom, only priorities >= reservedMinPriority are admitted,
+	// see `WithReservedHeadroom`
+	reservedFrom        int
+	reservedMinPriority int
+
+	// bands[p] is where items pushed with priority p are queued,
+	// see `RemapPriorities`
+	bands            []int
+	lastEnqueuedTime int64
+}
+
+// Option configures optional behavior of PriorityQueue
+type Option func(*PriorityQueue) error
+
+// WithLIFO makes each priority return its newest item first, instead of its oldest.
+//
+// Under overload, the oldest items are the most likely to have missed their deadline already,
+// so serving the newest first gets more requests done in time.
+func WithLIFO() Option {
+	return func(pq *PriorityQueue) error {
+		pq.lifo = true
+		return nil
+	}
+}
+
+// WithEarlyDrop makes pushes below `minPriority` probabilistically rejected
+// with `common.ErrQueueIsFull` once the queue is more than `threshold` (in [0, 1)) full,
+// rejecting more the fuller it is, so higher priorities always find room.
+// See `common.EarlyDrop`.
+func WithEarlyDrop(threshold float64, minPriority int) Option {
+	return func(pq *PriorityQueue) error {
+		ed, err := common.NewEarlyDrop(threshold, minPriority)
+		if err != nil {
+			return err
+		}
+		pq.earlyDrop = ed
+		return nil
+	}
+}
+
+// WithReservedHeadroom keeps the last `fraction` (in [0, 1]) of the capacity
+// for priorities >= `minPriority`. Lower priorities get `common.ErrQueueIsFull` once the rest is used,
+// so a flood of them can't stop urgent items from being queued.
+func WithReservedHeadroom(fraction float64, minPriority int) Option {
+	return func(pq *PriorityQueue) error {
+		if fraction < 0 || fraction > 1 {
+			return common.ErrParamShouldBePositive
+		}
+		pq.reservedFrom = pq.sizeLimit - int(math.Ceil(fraction*float64(pq.sizeLimit)))
+		pq.reservedMinPriority = minPriority
+		return nil
+	}
+}
+
+// WithRateLimit limits how many items of `priority` can be popped,
+// to `ratePerSecond` with bursts up to `burst` items.
+//
+// While its bucket is empty, the priority is skipped,
+// so lower priorities can be popped in the meantime.
+func WithRateLimit(priority int, ratePerSecond float64, burst int) Option {
+	return func(pq *PriorityQueue) error {
+		if priority < 0 || priority >= pq.limitPriority {
+			return common.ErrPriorityOutOfRange
+		}
+		tb, err := common.NewTokenBucket(ratePerSecond, burst)
+		if err != nil {
+			return err
+		}
+		pq.rateLimiters[priority] = tb
+		return nil
+	}
+}
+
+// WithWatermarks calls `onHigh` once the queue holds `high` items,
+// and `onLow` once it then goes down to `low` (in [0, high)) items,
+// e.g. to pause ingestion upstream and resume it later. See `common.Watermarks`.
+//
+// Both are called while holding the queue lock, right as the size changes,
+// so they should be fast (e.g. flipping a flag), and never call the queue itself.
+func WithWatermarks(high, low int, onHigh, onLow func(size int)) Option {
+	return func(pq *PriorityQueue) error {
+		w, err := common.NewWatermarks(high, low, onHigh, onLow)
+		if err != nil {
+			return err
+		}
+		pq.watermarks = w
+		return nil
+	}
+}
+
+// WithLogger makes the queue log to `logger` the items it drops or evicts:
+// those rejected by `WithEarlyDrop`, evicted by `PushOrEvict`, or left when closing it.
+// By default, nothing is logged.
+func WithLogger(logger common.Logger) Option {
+	return func(pq *PriorityQueue) error {
+		pq.logger = logger
+		return nil
+	}
+}
+
+// NewPriorityQueue creates our priority queue.
+//
+// It caps at sizeLimit, and allows priority [0,numOfPriority)
+func NewPriorityQueue(sizeLimit, numOfPriority int, opts ...Option) (*PriorityQueue, error) {
+	if sizeLimit <= 0 || numOfPriority <= 0 {
+		return nil, common.ErrParamShouldBePositive
+	}
+
+	mu := &sync.RWMutex{}
+	notEmpty := sync.NewCond(mu)
+	notFull := sync.NewCond(mu)
+
+	numberOfTasksInEachQueue := make([]int, numOfPriority)
+	queues := make([]*linkedslice.LinkedSlice, numOfPriority)
+
+	pq := &PriorityQueue{
+		mu:                       mu,
+		notEmpty:                 notEmpty,
+		notFull:                  notFull,
+		emptied:                  sync.NewCond(mu),
+		numberOfTasksInEachQueue: numberOfTasksInEachQueue,
+		queues:                   queues,
+		limitPriority:            numOfPriority,
+		size:                     0,
+		sizeLimit:                sizeLimit,
+		reservedFrom:             sizeLimit,
+		running:                  true,
+		closed:                   make(chan struct{}),
+		rateLimiters:             make([]*common.TokenBucket, numOfPriority),
+		bands:                    identityBands(numOfPriority),
+		logger:                   common.NopLogger{},
+	}
+	for _, opt := range opts {
+		if err := opt(pq); err != nil {
+			return nil, err
+		}
+	}
+	return pq, nil
+}
+
+// PushOrError put the item into the pq, and returns error if no slot available
+func (pq *PriorityQueue) PushOrError(item common.QItem) error {
+	pq.mu.Lock()
+	err := pq.admitLocked(item)
+	if err == nil {
+		err = pq.pushLocked(item)
+	}
+	if err != nil {
+		err = pq.queueErrorLocked("PushOrError", item, err)
+	}
+	pq.mu.Unlock()
+	return err
+}
+
+// PushBatchOrError pushes `items` in order, only taking the lock once.
+// It stops at the first item which can't be pushed, returning how many are pushed, and its error.
+func (pq *PriorityQueue) PushBatchOrError(items []common.QItem) (int, error) {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	for i, item := range items {
+		err := pq.admitLocked(item)
+		if err == nil {
+			err = pq.pushLocked(item)
+		}
+		if err != nil {
+			return i, pq.queueErrorLocked("PushBatchOrError", item, err)
+		}
+	}
+	return len(items), nil
+}
+
+// PushOrWaitTillClose put the item into the pq, waiting while no slot is available for it,
+// instead of returning `common.ErrQueueIsFull`, so producers get backpressure.
+// It returns `common.ErrQueueIsClosed` if pq is closed in the meantime.
+func (pq *PriorityQueue) PushOrWaitTillClose(item common.QItem) error {
+	return pq.PushOrWaitCtx(context.Background(), item)
+}
+
+// PushOrWaitCtx is the same as PushOrWaitTillClose,
+// but also returns `ctx.Err()` once `ctx` is done while waiting for a slot
+func (pq *PriorityQueue) PushOrWaitCtx(ctx context.Context, item common.QItem) error {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	err := pq.admitLocked(item)
+	if err == common.ErrQueueIsFull {
+		defer common.WakeOnDone(ctx, pq.notFull)()
+	}
+	for err == common.ErrQueueIsFull {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		pq.notFull.Wait()
+		err = pq.admitLocked(item)
+	}
+	if err == nil {
+		err = pq.pushLocked(item)
+	}
+	if err != nil {
+		return pq.queueErrorLocked("PushOrWaitCtx", item, err)
+	}
+	return nil
+}
+
+// admitLocked returns the error pushing `item` should fail with, if any.
+// It is the bare sentinel, so the waiting pushes can compare it,
+// and each push wraps it with `queueErrorLocked` before returning.
+func (pq *PriorityQueue) admitLocked(item common.QItem) error {
+	// checked under the lock, as the number of priorities can change, see `SetNumOfPriority`
+	if item.Priority < 0 || item.Priority >= pq.limitPriority {
+		return common.ErrPriorityOutOfRange
+	}
+	if !pq.running || pq.draining {
+		return common.ErrQueueIsClosed
+	}
+	if pq.size == pq.sizeLimit {
+		return common.ErrQueueIsFull
+	}
+	if pq.size >= pq.reservedFrom && item.Priority < pq.reservedMinPriority {
+		return common.ErrQueueIsFull
+	}
+	if pq.earlyDrop != nil && pq.earlyDrop.Reject(item.Priority, pq.size, pq.sizeLimit) {
+		pq.logger.Info("item dropped early", "id", item.ID, "priority", item.Priority, "size", pq.size)
+		return common.ErrQueueIsFull
+	}
+	return nil
+}
+
+// queueErrorLocked adds what pq looks like right now to `err`, see `common.QueueError`
+func (pq *PriorityQueue) queueErrorLocked(op string, item common.QItem, err error) error {
+	return &common.QueueError{Op: op, Priority: item.Priority, Size: pq.size, Limit: pq.sizeLimit, Err: err}
+}
+
+// PushOrEvict is like PushOrError, but if pq is full, it makes room by evicting
+// the oldest item of the lowest non-empty priority, and returns it together with true.
+// If that priority is not lower than `item`'s, nothing is evicted,
+// and it returns `common.ErrQueueIsFull`.
+//
+// Reserved headroom and early drop are not checked, as the caller chose to evict instead.
+func (pq *PriorityQueue) PushOrEvict(item common.QItem) (common.QItem, bool, error) {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	if item.Priority < 0 || item.Priority >= pq.limitPriority {
+		return common.MinQItem, false, pq.queueErrorLocked("PushOrEvict", item, common.ErrPriorityOutOfRange)
+	}
+	if !pq.running || pq.draining {
+		return common.MinQItem, false, pq.queueErrorLocked("PushOrEvict", item, common.ErrQueueIsClosed)
+	}
+
+	evicted, ok := common.MinQItem, false
+	if pq.size == pq.sizeLimit {
+		lowest := 0
+		for pq.numberOfTasksInEachQueue[lowest] == 0 {
+			lowest++
+		}
+		if lowest >= pq.bands[item.Priority] {
+			return common.MinQItem, false, pq.queueErrorLocked("PushOrEvict", item, common.ErrQueueIsFull)
+		}
+		// the queue is not closed, and it has items, so this never fails
+		evicted, _ = pq.queues[lowest].PopOrWaitTillClose()
+		pq.numberOfTasksInEachQueue[lowest]--
+		pq.size--
+		ok = true
+		pq.logger.Info("item evicted", "id", evicted.ID, "priority", evicted.Priority, "for", item.ID)
+	}
+	if err := pq.pushLocked(item); err != nil {
+		return common.MinQItem, false, pq.queueErrorLocked("PushOrEvict", item, err)
+	}
+	return evicted, ok, nil
+}
+
+// pushLocked enqueues `item`, after all admission checks are passed
+func (pq *PriorityQueue) pushLocked(item common.QItem) error {
+	item.EnqueuedAt = time.Now().UnixNano()
+	if item.EnqueuedAt <= pq.lastEnqueuedTime {
+		item.EnqueuedAt = pq.lastEnqueuedTime + 1
+	}
+	pq.lastEnqueuedTime = item.EnqueuedAt
+
+	err := pq.enqueueLocked(pq.bands[item.Priority], item)
+	// meaning already closed, cause linkedslices is unbounded
+	if err != nil {
+		return err
+	}
+	pq.size++
+	pq.sizeChangedLocked()
+
+	pq.wakePoppersLocked()
+	return nil
+}
+
+// wakePoppersLocked wakes a waiting pop for a new item.
+// If some pops only take high priorities (see `PopAtLeastOrWaitCtx`), all are woken,
+// as the one woken might not be able to take it.
+func (pq *PriorityQueue) wakePoppersLocked() {
+	if pq.filteredWaiters > 0 {
+		pq.notEmpty.Broadcast()
+	} else {
+		pq.notEmpty.Signal()
+	}
+}
+
+// PopOrWaitTillClose returns 1 QItem from pq, or waits if none exists
+func (pq *PriorityQueue) PopOrWaitTillClose() (common.QItem, error) {
+	return pq.PopOrWaitCtx(context.Background())
+}
+
+// PopOrWaitCtx is the same as PopOrWaitTillClose,
+// but also returns `ctx.Err()` once `ctx` is done while waiting
+func (pq *PriorityQueue) PopOrWaitCtx(ctx context.Context) (common.QItem, error) {
+	return pq.PopAtLeastOrWaitCtx(ctx, 0)
+}
+
+// PopAtLeastOrWaitCtx is the same as PopOrWaitCtx, but only takes items
+// whose priority is at least `minPriority`, waiting while there is none,
+// even if pq has lower priority items.
+//
+// This lets some consumers be reserved for urgent items, see `prioritize.WithReservedWorkers`.
+// If `minPriority` is not lower than the number of priorities, it waits until one is added.
+func (pq *PriorityQueue) PopAtLeastOrWaitCtx(ctx context.Context, minPriority int) (common.QItem, error) {
+	if minPriority < 0 {
+		return common.MinQItem, common.ErrPriorityOutOfRange
+	}
+	pq.mu.Lock()
+	priorityToRetrieve, err := pq.waitForAllowedPriorityLocked(ctx, minPriority)
+	if err != nil {
+		pq.mu.Unlock()
+		return common.MinQItem, err
+	}
+	result, err := pq.takeLocked(priorityToRetrieve)
+	if err != nil {
+		pq.mu.Unlock()
+		return common.MinQItem, err
+	}
+	if pq.draining && pq.size == 0 {
+		pq.closeLocked()
+	}
+	pq.mu.Unlock()
+	return result, nil
+}
+
+// TryPop is the non-blocking version of PopOrWaitTillClose.
+// It returns `common.ErrQueueIsEmpty` right away if no item can be popped now,
+// including when pq is paused, or all remaining items are rate-limited.
+func (pq *PriorityQueue) TryPop() (common.QItem, error) {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	if !pq.running {
+		return common.MinQItem, common.ErrQueueIsClosed
+	}
+	if pq.size == 0 || pq.paused {
+		return common.MinQItem, common.ErrQueueIsEmpty
+	}
+	priorityToRetrieve, _ := pq.highestAllowedPriority(time.Now(), 0)
+	if priorityToRetrieve == -1 {
+		return common.MinQItem, common.ErrQueueIsEmpty
+	}
+	result, err := pq.takeLocked(priorityToRetrieve)
+	if err != nil {
+		return common.MinQItem, err
+	}
+	if pq.draining && pq.size == 0 {
+		pq.closeLocked()
+	}
+	return result, nil
+}
+
+// Peek returns the oldest item (or the newest, with WithLIFO) of the highest non-empty priority,
+// without removing it, or `common.ErrQueueIsEmpty` if pq is empty.
+//
+// This is the item the next pop returns, unless its priority is rate-limited, or pq is paused.
+func (pq *PriorityQueue) Peek() (common.QItem, error) {
+	pq.mu.RLock()
+	defer pq.mu.RUnlock()
+	if !pq.running {
+		return common.MinQItem, common.ErrQueueIsClosed
+	}
+	for i := pq.limitPriority - 1; i >= 0; i-- {
+		if pq.numberOfTasksInEachQueue[i] == 0 {
+			continue
+		}
+		var item common.QItem
+		var ok bool
+		if pq.lifo {
+			item, ok = pq.queues[i].PeekNewest()
+		} else {
+			item, ok = pq.queues[i].Peek()
+		}
+		if ok {
+			// same as takeLocked, the priority may differ, see `RemapPriorities`
+			item.Priority = i
+			return item, nil
+		}
+	}
+	return common.MinQItem, common.ErrQueueIsEmpty
+}
+
+// PopBatchOrWaitTillClose waits like PopOrWaitTillClose,
+// and then returns up to `max` items in the same order as popping them one by one,
+// only taking the lock once.
+func (pq *PriorityQueue) PopBatchOrWaitTillClose(max int) ([]common.QItem, error) {
+	pq.mu.Lock()
+	priorityToRetrieve, err := pq.waitForAllowedPriorityLocked(context.Background(), 0)
+	if err != nil {
+		pq.mu.Unlock()
+		return nil, err
+	}
+	results := make([]common.QItem, 0, max)
+	for priorityToRetrieve != -1 {
+		result, err := pq.takeLocked(priorityToRetrieve)
+		if err != nil {
+			pq.mu.Unlock()
+			return nil, err
+		}
+		results = append(results, result)
+		if len(results) == max || pq.size == 0 {
+			break
+		}
+		priorityToRetrieve, _ = pq.highestAllowedPriority(time.Now(), 0)
+	}
+	if pq.draining && pq.size == 0 {
+		pq.closeLocked()
+	}
+	pq.mu.Unlock()
+	return results, nil
+}
+
+// waitForAllowedPriorityLocked waits until there is an item at or above `minPriority` which can be popped,
+// and returns its priority, or returns error if pq is closed, or `ctx` is done, in the meantime.
+func (pq *PriorityQueue) waitForAllowedPriorityLocked(ctx context.Context, minPriority int) (int, error) {
+	if !pq.running {
+		return -1, common.ErrQueueIsClosed
+	}
+	if minPriority > 0 {
+		pq.filteredWaiters++
+		defer func() { pq.filteredWaiters-- }()
+	}
+
+	var stop func()
+	defer func() {
+		if stop != nil {
+			stop()
+		}
+	}()
+	priorityToRetrieve := -1
+	for priorityToRetrieve == -1 {
+		for pq.size == 0 || pq.paused {
+			if pq.draining && pq.size == 0 {
+				pq.closeLocked()
+				return -1, common.ErrQueueIsClosed
+			}
+			if err := ctx.Err(); err != nil {
+				return -1, err
+			}
+			if stop == nil {
+				stop = common.WakeOnDone(ctx, pq.notEmpty)
+			}
+			pq.notEmpty.Wait()
+			// double check, ensuring see the changes after wait call
+			if !pq.running {
+				return -1, common.ErrQueueIsClosed
+			}
+		}
+
+		var delay time.Duration
+		priorityToRetrieve, delay = pq.highestAllowedPriority(time.Now(), minPriority)
+		if priorityToRetrieve == -1 {
+			// all remaining items at or above minPriority are rate-limited,
+			// or there is none at all (delay is -1)
+			if err := ctx.Err(); err != nil {
+				return -1, err
+			}
+			if stop == nil {
+				stop = common.WakeOnDone(ctx, pq.notEmpty)
+			}
+			if delay == -1 {
+				pq.notEmpty.Wait()
+			} else {
+				pq.waitFor(delay)
+			}
+			if !pq.running {
+				return -1, common.ErrQueueIsClosed
+			}
+		}
+	}
+	return priorityToRetrieve, nil
+}
+
+// takeLocked pops 1 item of `priorityToRetrieve`, which should not be empty
+func (pq *PriorityQueue) takeLocked(priorityToRetrieve int) (common.QItem, error) {
+	// if we wait blindly, it gonna stuck
+	// but we are tracking it manually, ensuring it will never wait
+	var qitem common.QItem
+	var err error
+	if pq.lifo {
+		qitem, err = pq.queues[priorityToRetrieve].PopNewestOrWaitTillClose()
+	} else {
+		qitem, err = pq.queues[priorityToRetrieve].PopOrWaitTillClose()
+	}
+	if err != nil {
+		// the only error possible here is closed already
+		// so we just continue it
+		return common.MinQItem, err
+	}
+	// keep all fields, only the priority may differ, see `RemapPriorities`
+	result := qitem
+	result.Priority = priorityToRetrieve
+	pq.numberOfTasksInEachQueue[priorityToRetrieve]--
+	pq.size--
+	pq.sizeChangedLocked()
+	pq.notFull.Broadcast()
+	return result, nil
+}
+
+// sizeChangedLocked lets the watermarks, if any, see the new size,
+// and wakes those waiting for pq to be empty
+func (pq *PriorityQueue) sizeChangedLocked() {
+	if pq.size == 0 {
+		pq.emptied.Broadcast()
+	}
+	if pq.watermarks != nil {
+		pq.watermarks.Update(pq.size)
+	}
+}
+
+// highestAllowedPriority returns the highest non-empty priority, at or above `minPriority`,
+// which is not rate-limited, taking its token if it has a rate limit.
+// If all of them are rate-limited, it returns -1 and how long until one is allowed.
+// If there is none, it returns -1 and -1.
+func (pq *PriorityQueue) highestAllowedPriority(now time.Time, minPriority int) (int, time.Duration) {
+	delay := time.Duration(-1)
+	for i := pq.limitPriority - 1; i >= minPriority; i-- {
+		if pq.numberOfTasksInEachQueue[i] == 0 {
+			continue
+		}
+		limiter := pq.rateLimiters[i]
+		if limiter == nil {
+			return i, 0
+		}
+		if limiter.Available(now) {
+			limiter.Take()
+			return i, 0
+		}
+		if d := limiter.Delay(now); delay == -1 || d < delay {
+			delay = d
+		}
+	}
+	return -1, delay
+}
+
+// waitFor waits until signalled, or `d` has passed.
+// Just like pq.notEmpty.Wait(), pq.mu should be held when calling this.
+func (pq *PriorityQueue) waitFor(d time.Duration) {
+	timer := time.AfterFunc(d, func() {
+		pq.mu.Lock()
+		pq.notEmpty.Broadcast()
+		pq.mu.Unlock()
+	})
+	pq.notEmpty.Wait()
+	timer.Stop()
+}
+
+// RemapPriorities changes, at runtime, which band each priority is queued in.
+//
+// `mapping` receives the priority an item is pushed with,
+// and returns the band (also in [0, numOfPriority)) it should be queued and popped as.
+// Queued items are moved accordingly, keeping their push order,
+// and subsequent pushes follow the same mapping.
+//
+// For example, mapping priority 0-3 into 3 collapses those into 1 band,
+// and remapping later with an identity function splits them back,
+// because items still remember the priority they are pushed with.
+// `mapping` is called while holding the lock, so it should never call pq itself.
+func (pq *PriorityQueue) RemapPriorities(mapping func(priority int) int) error {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	if !pq.running {
+		return common.ErrQueueIsClosed
+	}
+
+	bands := make([]int, pq.limitPriority)
+	for i := range bands {
+		bands[i] = mapping(i)
+		if bands[i] < 0 || bands[i] >= pq.limitPriority {
+			return common.ErrPriorityOutOfRange
+		}
+	}
+
+	items := make([]common.QItem, 0, pq.size)
+	for i := 0; i < pq.limitPriority; i++ {
+		for ; pq.numberOfTasksInEachQueue[i] > 0; pq.numberOfTasksInEachQueue[i]-- {
+			// tracked manually, so never waits
+			item, _ := pq.queues[i].PopOrWaitTillClose()
+			items = append(items, item)
+		}
+	}
+	sort.SliceStable(items, func(a, b int) bool {
+		return items[a].EnqueuedAt < items[b].EnqueuedAt
+	})
+
+	pq.bands = bands
+	for _, item := range items {
+		pq.enqueueLocked(bands[item.Priority], item)
+	}
+	if pq.filteredWaiters > 0 {
+		// some may be at or above what they wait for now
+		pq.notEmpty.Broadcast()
+	}
+	return nil
+}
+
+// AddPriorityLevel adds 1 priority above the current highest one,
+// and returns it, without recreating the queue.
+func (pq *PriorityQueue) AddPriorityLevel() (int, error) {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	if !pq.running {
+		return -1, common.ErrQueueIsClosed
+	}
+	pq.setNumOfPriorityLocked(pq.limitPriority + 1)
+	return pq.limitPriority - 1, nil
+}
+
+// SetNumOfPriority changes, at runtime, the allowed priorities to [0,n).
+//
+// Growing always succeeds, and the new priorities are queued as themselves.
+// Shrinking returns `common.ErrPriorityNotEmpty` if any removed priority still has items,
+// or `common.ErrPriorityOutOfRange` if a kept priority is remapped into a removed one
+// (see `RemapPriorities`, remap it first).
+// Items pushed with a removed priority, but remapped into a kept one, stay there as that one.
+func (pq *PriorityQueue) SetNumOfPriority(n int) error {
+	if n <= 0 {
+		return common.ErrParamShouldBePositive
+	}
+
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	if !pq.running {
+		return common.ErrQueueIsClosed
+	}
+	if n < pq.limitPriority {
+		for band := n; band < pq.limitPriority; band++ {
+			if pq.numberOfTasksInEachQueue[band] > 0 {
+				return common.ErrPriorityNotEmpty
+			}
+		}
+		for p := 0; p < n; p++ {
+			if pq.bands[p] >= n {
+				return common.ErrPriorityOutOfRange
+			}
+		}
+	}
+	pq.setNumOfPriorityLocked(n)
+	return nil
+}
+
+// setNumOfPriorityLocked resizes everything kept per priority.
+// When shrinking, removed bands should already be empty.
+func (pq *PriorityQueue) setNumOfPriorityLocked(n int) {
+	for p := n; p < pq.limitPriority; p++ {
+		if band := pq.bands[p]; band < n {
+			pq.renamePrioritiesLocked(band, n)
+		}
+	}
+	for band := n; band < pq.limitPriority; band++ {
+		if pq.queues[band] != nil {
+			// gives back its memory to the pool
+			pq.queues[band].Compact()
+		}
+	}
+
+	if n < pq.limitPriority {
+		pq.numberOfTasksInEachQueue = pq.numberOfTasksInEachQueue[:n]
+		pq.queues = pq.queues[:n]
+		pq.rateLimiters = pq.rateLimiters[:n]
+		pq.bands = pq.bands[:n]
+	}
+	for p := pq.limitPriority; p < n; p++ {
+		pq.numberOfTasksInEachQueue = append(pq.numberOfTasksInEachQueue, 0)
+		pq.queues = append(pq.queues, nil)
+		pq.rateLimiters = append(pq.rateLimiters, nil)
+		pq.bands = append(pq.bands, p)
+	}
+	pq.limitPriority = n
+	// waiting pushes may be for a removed priority
+	pq.notFull.Broadcast()
+}
+
+// renamePrioritiesLocked sets the priority of items in `band` pushed with a priority >= n to `band`,
+// so they don't refer to a removed priority anymore
+func (pq *PriorityQueue) renamePrioritiesLocked(band, n int) {
+	count := pq.numberOfTasksInEachQueue[band]
+	for i := 0; i < count; i++ {
+		// tracked manually, so never waits
+		item, _ := pq.queues[band].PopOrWaitTillClose()
+		if item.Priority >= n {
+			item.Priority = band
+		}
+		pq.queues[band].PushOrError(item)
+	}
+}
+
+// UpdatePriority moves the queued item with `id` to `newPriority`.
+// It is put behind the items already in the new priority's band.
+//
+// It is O(n) over the items in the old band, so it is meant for rare operations.
+func (pq *PriorityQueue) UpdatePriority(id uint64, newPriority int) error {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	if newPriority < 0 || newPriority >= pq.limitPriority {
+		return common.ErrPriorityOutOfRange
+	}
+	if !pq.running {
+		return common.ErrQueueIsClosed
+	}
+
+	for band := 0; band < pq.limitPriority; band++ {
+		if pq.numberOfTasksInEachQueue[band] == 0 {
+			continue
+		}
+		item, ok := pq.queues[band].Remove(id)
+		if !ok {
+			continue
+		}
+		pq.numberOfTasksInEachQueue[band]--
+		item.Priority = newPriority
+		pq.enqueueLocked(pq.bands[newPriority], item)
+		if pq.filteredWaiters > 0 {
+			// it may be at or above what they wait for now
+			pq.notEmpty.Broadcast()
+		}
+		return nil
+	}
+	return common.ErrItemNotFound
+}
+
+// Snapshot returns a copy of all items in pq, in the order they would be popped,
+// without removing them, e.g. for debugging (see `common.DebugDump`).
+// Rate limits are not accounted for. It is O(n).
+func (pq *PriorityQueue) Snapshot() []common.QItem {
+	pq.mu.RLock()
+	defer pq.mu.RUnlock()
+	results := make([]common.QItem, 0, pq.size)
+	for p := pq.limitPriority - 1; p >= 0; p-- {
+		if pq.numberOfTasksInEachQueue[p] == 0 {
+			continue
+		}
+		items := pq.queues[p].Snapshot()
+		if pq.lifo {
+			reverse(items)
+		}
+		for _, item := range items {
+			// popped with the band's priority, see `takeLocked`
+			item.Priority = p
+			results = append(results, item)
+		}
+	}
+	return results
+}
+
+// Drain removes and returns all items in pq at once, highest priority first,
+// e.g. to persist or requeue them elsewhere before calling Close.
+// Rate limits are not applied. It returns nil if pq is already closed.
+func (pq *PriorityQueue) Drain() []common.QItem {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	if !pq.running {
+		return nil
+	}
+
+	results := make([]common.QItem, 0, pq.size)
+	for p := pq.limitPriority - 1; p >= 0; p-- {
+		for pq.numberOfTasksInEachQueue[p] > 0 {
+			item, err := pq.takeLocked(p)
+			if err != nil {
+				return results
+			}
+			results = append(results, item)
+		}
+	}
+	if pq.draining {
+		pq.closeLocked()
+	}
+	return results
+}
+
+// Remove takes out the item with `id`, freeing its slot,
+// or returns `common.ErrItemNotFound` if it is not in the queue anymore.
+//
+// It is O(n) on the band of the item, see `linkedslice.LinkedSlice.Remove`.
+func (pq *PriorityQueue) Remove(id uint64) (common.QItem, error) {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	if !pq.running {
+		return common.MinQItem, common.ErrQueueIsClosed
+	}
+
+	for band := 0; band < pq.limitPriority; band++ {
+		if pq.numberOfTasksInEachQueue[band] == 0 {
+			continue
+		}
+		item, ok := pq.queues[band].Remove(id)
+		if !ok {
+			continue
+		}
+		pq.numberOfTasksInEachQueue[band]--
+		pq.size--
+		pq.sizeChangedLocked()
+		pq.notFull.Broadcast()
+		if pq.draining && pq.size == 0 {
+			pq.closeLocked()
+		}
+		return item, nil
+	}
+	return common.MinQItem, common.ErrItemNotFound
+}
+
+// enqueueLocked puts item into the internal queue of `band`, and tracks it.
+// It doesn't update pq.size, so callers can use it to move items too.
+func (pq *PriorityQueue) enqueueLocked(band int, item common.QItem) error {
+	if pq.queues[band] == nil {
+		pq.queues[band] = linkedslice.NewLinkedSlice()
+	}
+	err := pq.queues[band].PushOrError(item)
+	if err != nil {
+		return err
+	}
+	pq.numberOfTasksInEachQueue[band]++
+	return nil
+}
+
+// Compact releases memory held by the queue of each priority, see `linkedslice.CompactAll`.
+func (pq *PriorityQueue) Compact() {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	linkedslice.CompactAll(pq.queues)
+}
+
+// Len returns the number of items currently in the pq
+func (pq *PriorityQueue) Len() int {
+	pq.mu.RLock()
+	defer pq.mu.RUnlock()
+	return pq.size
+}
+
+// Cap returns the maximum number of items the pq can hold
+func (pq *PriorityQueue) Cap() int {
+	return pq.sizeLimit
+}
+
+// DepthPerPriority returns the number of items currently in each priority of the pq
+func (pq *PriorityQueue) DepthPerPriority() []int {
+	pq.mu.RLock()
+	defer pq.mu.RUnlock()
+	depths := make([]int, pq.limitPriority)
+	copy(depths, pq.numberOfTasksInEachQueue)
+	return depths
+}
+
+// Pause makes pops wait, without erroring, until Resume is called.
+// Pushes are still accepted in the meantime, and Drain still takes items.
+// After CloseGracefully, remaining items are still only popped once resumed.
+func (pq *PriorityQueue) Pause() {
+	pq.mu.Lock()
+	pq.paused = true
+	pq.mu.Unlock()
+}
+
+// Resume lets pops take items from pq again, waking those waiting because of Pause
+func (pq *PriorityQueue) Resume() {
+	pq.mu.Lock()
+	pq.paused = false
+	pq.notEmpty.Broadcast()
+	pq.mu.Unlock()
+}
+
+// Close is the same as CloseNow
+func (pq *PriorityQueue) Close() error {
+	return pq.CloseNow()
+}
+
+// CloseNow closes PriorityQueue, preventing it from accepting new request.
+// Remaining items are dropped, and waiting pops return immediately.
+// Closing it again does nothing, only returning `common.ErrQueueIsClosed`.
+func (pq *PriorityQueue) CloseNow() error {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	if !pq.running {
+		return common.ErrQueueIsClosed
+	}
+	pq.closeLocked()
+	return nil
+}
+
+// CloseGracefully stops PriorityQueue from accepting new request,
+// but pops keep returning the remaining items.
+// Once it is empty, it is closed the same way as CloseNow.
+func (pq *PriorityQueue) CloseGracefully() {
+	pq.mu.Lock()
+	if pq.running {
+		pq.draining = true
+		// waiting pushes should return now
+		pq.notFull.Broadcast()
+		if pq.size == 0 {
+			pq.closeLocked()
+		}
+	}
+	pq.mu.Unlock()
+}
+
+// WaitUntilEmpty waits until PriorityQueue holds no item, e.g. to know a burst of work is all popped,
+// and returns nil. It returns `common.ErrQueueIsClosed` if PriorityQueue is closed with items left,
+// or `ctx.Err()` once `ctx` is done while waiting.
+func (pq *PriorityQueue) WaitUntilEmpty(ctx context.Context) error {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	if pq.size > 0 {
+		defer common.WakeOnDone(ctx, pq.emptied)()
+	}
+	for pq.size > 0 {
+		if !pq.running {
+			return common.ErrQueueIsClosed
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		pq.emptied.Wait()
+	}
+	return nil
+}
+
+// IsClosed returns whether PriorityQueue is closed, after which no item is popped anymore
+func (pq *PriorityQueue) IsClosed() bool {
+	pq.mu.RLock()
+	defer pq.mu.RUnlock()
+	return !pq.running
+}
+
+// Closed returns a channel which is closed once PriorityQueue is closed,
+// so other goroutines can select on it
+func (pq *PriorityQueue) Closed() <-chan struct{} {
+	return pq.closed
+}
+
+func (pq *PriorityQueue) closeLocked() {
+	if !pq.running {
+		// already closed, pq.closed can't be closed twice
+		return
+	}
+	pq.running = false
+	close(pq.closed)
+	if pq.size > 0 {
+		pq.logger.Warn("queue closed, dropping items", "dropped", pq.size)
+	}
+	for i := 0; i < pq.limitPriority; i++ {
+		if pq.queues[i] != nil {
+			pq.queues[i].Close()
+		}
+	}
+	pq.notEmpty.Broadcast()
+	pq.notFull.Broadcast()
+	pq.emptied.Broadcast()
+}
+
+func reverse(items []common.QItem) {
+	for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+		items[i], items[j] = items[j], items[i]
+	}
+}
+
+func identityBands(numOfPriority int) []int {
+	bands := make([]int, numOfPriority)
+	for i := range bands {
+		bands[i] = i
+	}
+	return bands
+}
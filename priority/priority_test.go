@@ -1,241 +1,1041 @@
-package priority
-
-import (
-	"log"
-	"runtime"
-	"testing"
-	"time"
-
-	"github.com/aarondwi/prioritize/common"
-)
-
-func TestPriorityQueue(t *testing.T) {
-	fq, err := NewPriorityQueue(2048, 16)
-	if err != nil {
-		t.Fatalf("It should not error, cause both are positive, but we got %v", err)
-	}
-
-	err = fq.PushOrError(common.QItem{ID: 1, Priority: 8})
-	if err != nil {
-		t.Fatalf("It should not return error, cause not full yet, but we got %v", err)
-	}
-
-	err = fq.PushOrError(common.QItem{ID: 2, Priority: 13})
-	if err != nil {
-		t.Fatalf("It should not return error, cause not full yet, but we got %v", err)
-	}
-
-	err = fq.PushOrError(common.QItem{ID: 3, Priority: 13})
-	if err != nil {
-		t.Fatalf("It should not return error, cause not full yet, but we got %v", err)
-	}
-
-	result, err := fq.PopOrWaitTillClose()
-	if err != nil {
-		t.Fatalf("It should not error, cause not closed yet, but we got %v", err)
-	}
-	if result.ID != 2 || result.Priority != 13 {
-		t.Fatalf("First item with highest priority should be returned first, but instead we got %v", result)
-	}
-
-	result, err = fq.PopOrWaitTillClose()
-	if err != nil {
-		t.Fatalf("It should not error, cause not closed yet, but we got %v", err)
-	}
-	if result.ID != 3 || result.Priority != 13 {
-		t.Fatalf("Item with higher priority should be returned first, but instead we got %v", result)
-	}
-
-	result, err = fq.PopOrWaitTillClose()
-	if err != nil {
-		t.Fatalf("It should not error, cause not closed yet, but we got %v", err)
-	}
-	if result.ID != 1 || result.Priority != 8 {
-		t.Fatalf("Should not error cause we still have 1 item, but instead we got %v", result)
-	}
-	fq.Close()
-}
-
-func TestPriorityQueueValidation(t *testing.T) {
-	_, err := NewPriorityQueue(-2048, 1)
-	if err == nil || err != common.ErrParamShouldBePositive {
-		t.Fatal("It should error, cause sizeLimit can't be negative, but it is not")
-	}
-
-	_, err = NewPriorityQueue(2048, -16)
-	if err == nil || err != common.ErrParamShouldBePositive {
-		t.Fatal("It should error, cause numOfPriority can't be negative, but it is not")
-	}
-
-	pq, err := NewPriorityQueue(2048, 16)
-	if err != nil {
-		t.Fatalf("It should not error, instead we got %v", err)
-	}
-
-	err = pq.PushOrError(common.QItem{Priority: -1})
-	if err == nil || err != common.ErrPriorityOutOfRange {
-		t.Fatal("It should error, cause cannot accept negative priority, but it is not")
-	}
-
-	err = pq.PushOrError(common.QItem{Priority: 16})
-	if err == nil || err != common.ErrPriorityOutOfRange {
-		t.Fatal("It should error, cause can only accept priority [0, numOfPriority), but it is not")
-	}
-
-	if pq.size != 0 {
-		t.Fatalf("No item is added yet, but the size is %d", pq.size)
-	}
-
-	for i := 0; i < 2048; i++ {
-		err = pq.PushOrError(
-			common.QItem{ID: uint64(i), Priority: i % 16})
-		if err != nil {
-			t.Fatalf("It should not error, because slots left, but instead, at iteration %d, size %d, sizeLimit %d, we got %v", i, pq.size, pq.sizeLimit, err)
-		}
-	}
-
-	err = pq.PushOrError(common.QItem{ID: 2048, Priority: 1})
-	if err == nil {
-		t.Fatalf("It should error, because no slots left, but it is not")
-	}
-
-	pq.Close()
-}
-
-func TestPriorityQueuePopWait(t *testing.T) {
-	pq, err := NewPriorityQueue(100, 16)
-
-	c := make(chan bool, 1)
-	go func() {
-		time.Sleep(200 * time.Millisecond)
-		log.Println("timeout, returning")
-		c <- false
-	}()
-
-	go func() {
-		item, err := pq.PopOrWaitTillClose()
-		if err != nil {
-			c <- false
-			return
-		}
-		if item.Priority != 10 {
-			log.Printf("We received priority %d\n", item.Priority)
-			c <- false
-			return
-		}
-		c <- true
-	}()
-
-	time.Sleep(100 * time.Millisecond)
-	err = pq.PushOrError(common.QItem{Priority: 10})
-	if err != nil {
-		t.Fatalf("It should not error because slots are available, but we got %v", err)
-	}
-
-	result := <-c
-	if !result {
-		t.Fatal("We should receive true, because all the above are true, but we are not")
-	}
-	pq.Close()
-}
-
-func TestPriorityQueueAfterClose(t *testing.T) {
-	pq, _ := NewPriorityQueue(2000, 8)
-	pq.Close()
-
-	err := pq.PushOrError(common.QItem{})
-	if err == nil || err != common.ErrQueueIsClosed {
-		t.Fatalf("It should be error, cause already closed, but it is not")
-	}
-
-	_, err = pq.PopOrWaitTillClose()
-	if err == nil || err != common.ErrQueueIsClosed {
-		t.Fatalf("It should be error, cause already closed, but it is not")
-	}
-}
-
-func BenchmarkPriorityQueue(b *testing.B) {
-	pq, _ := NewPriorityQueue(1024, 8)
-	for i := 0; i < b.N; i++ {
-		pq.PushOrError(
-			common.QItem{ID: uint64(i), Priority: i % 8})
-		pq.PopOrWaitTillClose()
-	}
-	pq.Close()
-}
-
-func BenchmarkPriorityQueueInLoop(b *testing.B) {
-	pq, _ := NewPriorityQueue(1024, 8)
-	for i := 0; i < b.N; i++ {
-		for j := 0; j < 128; j++ {
-			pq.PushOrError(
-				common.QItem{ID: uint64(j), Priority: j % 8})
-		}
-		for j := 0; j < 128; j++ {
-			pq.PopOrWaitTillClose()
-		}
-	}
-	pq.Close()
-}
-
-func BenchmarkPriorityQueueParallelOneCoreOnly(b *testing.B) {
-	pq, _ := NewPriorityQueue(1024, 8)
-	runtime.GOMAXPROCS(1)
-	b.RunParallel(func(pb *testing.PB) {
-		j := 0
-		for pb.Next() {
-			j++
-			pq.PushOrError(
-				common.QItem{ID: uint64(j), Priority: j % 8})
-			pq.PopOrWaitTillClose()
-		}
-	})
-	pq.Close()
-}
-
-func BenchmarkPriorityQueueInLoopParallelOneCoreOnly(b *testing.B) {
-	pq, _ := NewPriorityQueue(1024, 8)
-	runtime.GOMAXPROCS(1)
-	b.RunParallel(func(pb *testing.PB) {
-		for pb.Next() {
-			for j := 0; j < 128; j++ {
-				pq.PushOrError(
-					common.QItem{ID: uint64(j), Priority: j % 8})
-			}
-			for j := 0; j < 128; j++ {
-				pq.PopOrWaitTillClose()
-			}
-		}
-	})
-	pq.Close()
-}
-
-func BenchmarkPriorityQueueParallel(b *testing.B) {
-	pq, _ := NewPriorityQueue(1024, 8)
-	b.RunParallel(func(pb *testing.PB) {
-		j := 0
-		for pb.Next() {
-			j++
-			pq.PushOrError(
-				common.QItem{ID: uint64(j), Priority: j % 8})
-			pq.PopOrWaitTillClose()
-		}
-	})
-	pq.Close()
-}
-
-func BenchmarkPriorityQueueInLoopParallel(b *testing.B) {
-	pq, _ := NewPriorityQueue(1024, 8)
-	b.RunParallel(func(pb *testing.PB) {
-		for pb.Next() {
-			for j := 0; j < 128; j++ {
-				pq.PushOrError(
-					common.QItem{ID: uint64(j), Priority: j % 8})
-			}
-			for j := 0; j < 128; j++ {
-				pq.PopOrWaitTillClose()
-			}
-		}
-	})
-	pq.Close()
-}
+package priority
+
+import (
+	"context"
+	"errors"
+	"log"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/queuetest"
+)
+
+func TestPriorityQueue(t *testing.T) {
+	fq, err := NewPriorityQueue(2048, 16)
+	if err != nil {
+		t.Fatalf("It should not error, cause both are positive, but we got %v", err)
+	}
+
+	err = fq.PushOrError(common.QItem{ID: 1, Priority: 8})
+	if err != nil {
+		t.Fatalf("It should not return error, cause not full yet, but we got %v", err)
+	}
+
+	err = fq.PushOrError(common.QItem{ID: 2, Priority: 13})
+	if err != nil {
+		t.Fatalf("It should not return error, cause not full yet, but we got %v", err)
+	}
+
+	err = fq.PushOrError(common.QItem{ID: 3, Priority: 13})
+	if err != nil {
+		t.Fatalf("It should not return error, cause not full yet, but we got %v", err)
+	}
+
+	result, err := fq.PopOrWaitTillClose()
+	if err != nil {
+		t.Fatalf("It should not error, cause not closed yet, but we got %v", err)
+	}
+	if result.ID != 2 || result.Priority != 13 {
+		t.Fatalf("First item with highest priority should be returned first, but instead we got %v", result)
+	}
+
+	result, err = fq.PopOrWaitTillClose()
+	if err != nil {
+		t.Fatalf("It should not error, cause not closed yet, but we got %v", err)
+	}
+	if result.ID != 3 || result.Priority != 13 {
+		t.Fatalf("Item with higher priority should be returned first, but instead we got %v", result)
+	}
+
+	result, err = fq.PopOrWaitTillClose()
+	if err != nil {
+		t.Fatalf("It should not error, cause not closed yet, but we got %v", err)
+	}
+	if result.ID != 1 || result.Priority != 8 {
+		t.Fatalf("Should not error cause we still have 1 item, but instead we got %v", result)
+	}
+	fq.Close()
+}
+
+func TestPriorityQueueValidation(t *testing.T) {
+	_, err := NewPriorityQueue(-2048, 1)
+	if err == nil || err != common.ErrParamShouldBePositive {
+		t.Fatal("It should error, cause sizeLimit can't be negative, but it is not")
+	}
+
+	_, err = NewPriorityQueue(2048, -16)
+	if err == nil || err != common.ErrParamShouldBePositive {
+		t.Fatal("It should error, cause numOfPriority can't be negative, but it is not")
+	}
+
+	pq, err := NewPriorityQueue(2048, 16)
+	if err != nil {
+		t.Fatalf("It should not error, instead we got %v", err)
+	}
+
+	err = pq.PushOrError(common.QItem{Priority: -1})
+	if !errors.Is(err, common.ErrPriorityOutOfRange) {
+		t.Fatal("It should error, cause cannot accept negative priority, but it is not")
+	}
+
+	err = pq.PushOrError(common.QItem{Priority: 16})
+	if !errors.Is(err, common.ErrPriorityOutOfRange) {
+		t.Fatal("It should error, cause can only accept priority [0, numOfPriority), but it is not")
+	}
+
+	if pq.Len() != 0 {
+		t.Fatalf("No item is added yet, but the size is %d", pq.Len())
+	}
+
+	for i := 0; i < 2048; i++ {
+		err = pq.PushOrError(
+			common.QItem{ID: uint64(i), Priority: i % 16})
+		if err != nil {
+			t.Fatalf("It should not error, because slots left, but instead, at iteration %d, size %d, sizeLimit %d, we got %v", i, pq.Len(), pq.Cap(), err)
+		}
+	}
+
+	if pq.Len() != 2048 || pq.Cap() != 2048 {
+		t.Fatalf("It should be full with 2048 items, but the size is %d of %d", pq.Len(), pq.Cap())
+	}
+
+	err = pq.PushOrError(common.QItem{ID: 2048, Priority: 1})
+	if err == nil {
+		t.Fatalf("It should error, because no slots left, but it is not")
+	}
+
+	pq.Close()
+}
+
+func TestPriorityQueuePopWait(t *testing.T) {
+	pq, err := NewPriorityQueue(100, 16)
+
+	c := make(chan bool, 1)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		log.Println("timeout, returning")
+		c <- false
+	}()
+
+	go func() {
+		item, err := pq.PopOrWaitTillClose()
+		if err != nil {
+			c <- false
+			return
+		}
+		if item.Priority != 10 {
+			log.Printf("We received priority %d\n", item.Priority)
+			c <- false
+			return
+		}
+		c <- true
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	err = pq.PushOrError(common.QItem{Priority: 10})
+	if err != nil {
+		t.Fatalf("It should not error because slots are available, but we got %v", err)
+	}
+
+	result := <-c
+	if !result {
+		t.Fatal("We should receive true, because all the above are true, but we are not")
+	}
+	pq.Close()
+}
+
+func TestPriorityQueueAfterClose(t *testing.T) {
+	pq, _ := NewPriorityQueue(2000, 8)
+	pq.Close()
+
+	err := pq.PushOrError(common.QItem{})
+	if !errors.Is(err, common.ErrQueueIsClosed) {
+		t.Fatalf("It should be error, cause already closed, but it is not")
+	}
+
+	_, err = pq.PopOrWaitTillClose()
+	if err == nil || err != common.ErrQueueIsClosed {
+		t.Fatalf("It should be error, cause already closed, but it is not")
+	}
+}
+
+func BenchmarkPriorityQueue(b *testing.B) {
+	pq, _ := NewPriorityQueue(1024, 8)
+	for i := 0; i < b.N; i++ {
+		pq.PushOrError(
+			common.QItem{ID: uint64(i), Priority: i % 8})
+		pq.PopOrWaitTillClose()
+	}
+	pq.Close()
+}
+
+func BenchmarkPriorityQueueInLoop(b *testing.B) {
+	pq, _ := NewPriorityQueue(1024, 8)
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < 128; j++ {
+			pq.PushOrError(
+				common.QItem{ID: uint64(j), Priority: j % 8})
+		}
+		for j := 0; j < 128; j++ {
+			pq.PopOrWaitTillClose()
+		}
+	}
+	pq.Close()
+}
+
+func BenchmarkPriorityQueueParallelOneCoreOnly(b *testing.B) {
+	pq, _ := NewPriorityQueue(1024, 8)
+	runtime.GOMAXPROCS(1)
+	b.RunParallel(func(pb *testing.PB) {
+		j := 0
+		for pb.Next() {
+			j++
+			pq.PushOrError(
+				common.QItem{ID: uint64(j), Priority: j % 8})
+			pq.PopOrWaitTillClose()
+		}
+	})
+	pq.Close()
+}
+
+func BenchmarkPriorityQueueInLoopParallelOneCoreOnly(b *testing.B) {
+	pq, _ := NewPriorityQueue(1024, 8)
+	runtime.GOMAXPROCS(1)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			for j := 0; j < 128; j++ {
+				pq.PushOrError(
+					common.QItem{ID: uint64(j), Priority: j % 8})
+			}
+			for j := 0; j < 128; j++ {
+				pq.PopOrWaitTillClose()
+			}
+		}
+	})
+	pq.Close()
+}
+
+func BenchmarkPriorityQueueParallel(b *testing.B) {
+	pq, _ := NewPriorityQueue(1024, 8)
+	b.RunParallel(func(pb *testing.PB) {
+		j := 0
+		for pb.Next() {
+			j++
+			pq.PushOrError(
+				common.QItem{ID: uint64(j), Priority: j % 8})
+			pq.PopOrWaitTillClose()
+		}
+	})
+	pq.Close()
+}
+
+func BenchmarkPriorityQueueInLoopParallel(b *testing.B) {
+	pq, _ := NewPriorityQueue(1024, 8)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			for j := 0; j < 128; j++ {
+				pq.PushOrError(
+					common.QItem{ID: uint64(j), Priority: j % 8})
+			}
+			for j := 0; j < 128; j++ {
+				pq.PopOrWaitTillClose()
+			}
+		}
+	})
+	pq.Close()
+}
+
+func TestPriorityQueueCloseGracefully(t *testing.T) {
+	pq, _ := NewPriorityQueue(2000, 8)
+	for i := 0; i < 3; i++ {
+		pq.PushOrError(common.QItem{ID: uint64(i), Priority: i})
+	}
+	pq.CloseGracefully()
+
+	err := pq.PushOrError(common.QItem{})
+	if !errors.Is(err, common.ErrQueueIsClosed) {
+		t.Fatalf("It should be error, cause already closing, but instead we got %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		_, err = pq.PopOrWaitTillClose()
+		if err != nil {
+			t.Fatalf("It should not error, cause items remain, but we got %v", err)
+		}
+	}
+
+	_, err = pq.PopOrWaitTillClose()
+	if err == nil || err != common.ErrQueueIsClosed {
+		t.Fatalf("It should be error, cause already drained, but instead we got %v", err)
+	}
+}
+
+func TestPriorityQueueCloseGracefullyReleasesWaitingPop(t *testing.T) {
+	pq, _ := NewPriorityQueue(2000, 8)
+
+	c := make(chan error, 1)
+	go func() {
+		_, err := pq.PopOrWaitTillClose()
+		c <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	pq.CloseGracefully()
+
+	select {
+	case err := <-c:
+		if err == nil || err != common.ErrQueueIsClosed {
+			t.Fatalf("It should be error, cause closed while empty, but instead we got %v", err)
+		}
+	case <-time.After(200 * time.Millisecond):
+		t.Fatal("Waiting pop should be released, but it is not")
+	}
+}
+
+func TestPriorityQueueRateLimitValidation(t *testing.T) {
+	_, err := NewPriorityQueue(2048, 16, WithRateLimit(16, 10, 1))
+	if err == nil || err != common.ErrPriorityOutOfRange {
+		t.Fatalf("It should error, cause priority is out of range, but instead we got %v", err)
+	}
+
+	_, err = NewPriorityQueue(2048, 16, WithRateLimit(3, 0, 1))
+	if err == nil || err != common.ErrParamShouldBePositive {
+		t.Fatalf("It should error, cause rate should be positive, but instead we got %v", err)
+	}
+}
+
+func TestPriorityQueueRateLimitWait(t *testing.T) {
+	pq, _ := NewPriorityQueue(2048, 16, WithRateLimit(3, 20, 1))
+	pq.PushOrError(common.QItem{ID: 1, Priority: 3})
+	pq.PushOrError(common.QItem{ID: 2, Priority: 3})
+
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		_, err := pq.PopOrWaitTillClose()
+		if err != nil {
+			t.Fatalf("It should not error, cause not closed yet, but we got %v", err)
+		}
+	}
+	// 1 token is available right away, the next one is in 1/20s
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Fatalf("Second pop should wait for the rate limit, but it only took %v", elapsed)
+	}
+	pq.Close()
+}
+
+func TestPriorityQueueRateLimitSkip(t *testing.T) {
+	pq, _ := NewPriorityQueue(2048, 16, WithRateLimit(5, 0.001, 1))
+	pq.PushOrError(common.QItem{ID: 1, Priority: 5})
+	pq.PushOrError(common.QItem{ID: 2, Priority: 5})
+	pq.PushOrError(common.QItem{ID: 3, Priority: 1})
+
+	expectedIDs := []uint64{1, 3}
+	for _, expected := range expectedIDs {
+		result, err := pq.PopOrWaitTillClose()
+		if err != nil {
+			t.Fatalf("It should not error, cause not closed yet, but we got %v", err)
+		}
+		if result.ID != expected {
+			t.Fatalf("Expected ID %d, cause priority 5 is rate-limited after 1 pop, but instead we got %v", expected, result)
+		}
+	}
+	pq.Close()
+}
+
+func TestPriorityQueueRemapPriorities(t *testing.T) {
+	pq, _ := NewPriorityQueue(2048, 8)
+
+	err := pq.RemapPriorities(func(p int) int { return p + 1 })
+	if err == nil || err != common.ErrPriorityOutOfRange {
+		t.Fatalf("It should error, cause priority 7 is mapped out of range, but instead we got %v", err)
+	}
+
+	pq.PushOrError(common.QItem{ID: 1, Priority: 0})
+	pq.PushOrError(common.QItem{ID: 2, Priority: 3})
+	pq.PushOrError(common.QItem{ID: 3, Priority: 2})
+	pq.PushOrError(common.QItem{ID: 4, Priority: 5})
+
+	// collapse 0-3 into 3
+	collapse := func(p int) int {
+		if p <= 3 {
+			return 3
+		}
+		return p
+	}
+	err = pq.RemapPriorities(collapse)
+	if err != nil {
+		t.Fatalf("It should not error, cause all are in range, but instead we got %v", err)
+	}
+	pq.PushOrError(common.QItem{ID: 5, Priority: 1})
+
+	expected := []common.QItem{
+		{ID: 4, Priority: 5},
+		{ID: 1, Priority: 3},
+		{ID: 2, Priority: 3},
+		{ID: 3, Priority: 3},
+		{ID: 5, Priority: 3},
+	}
+	for _, e := range expected {
+		result, err := pq.PopOrWaitTillClose()
+		if err != nil {
+			t.Fatalf("It should not error, cause not closed yet, but we got %v", err)
+		}
+		if result.ID != e.ID || result.Priority != e.Priority {
+			t.Fatalf("Expected %v, cause merged band keeps push order, but instead we got %v", e, result)
+		}
+	}
+
+	// split back
+	pq.PushOrError(common.QItem{ID: 6, Priority: 0})
+	pq.PushOrError(common.QItem{ID: 7, Priority: 2})
+	pq.RemapPriorities(func(p int) int { return p })
+	for _, id := range []uint64{7, 6} {
+		result, _ := pq.PopOrWaitTillClose()
+		if result.ID != id {
+			t.Fatalf("Expected ID %d, cause bands are split back, but instead we got %v", id, result)
+		}
+	}
+	pq.Close()
+}
+
+func TestPriorityQueueUpdatePriority(t *testing.T) {
+	pq, _ := NewPriorityQueue(2048, 8)
+	pq.PushOrError(common.QItem{ID: 1, Priority: 2})
+	pq.PushOrError(common.QItem{ID: 2, Priority: 1})
+
+	err := pq.UpdatePriority(2, 8)
+	if err == nil || err != common.ErrPriorityOutOfRange {
+		t.Fatalf("It should error, cause priority is out of range, but instead we got %v", err)
+	}
+	err = pq.UpdatePriority(3, 5)
+	if err == nil || err != common.ErrItemNotFound {
+		t.Fatalf("It should error, cause ID 3 is not queued, but instead we got %v", err)
+	}
+
+	err = pq.UpdatePriority(2, 5)
+	if err != nil {
+		t.Fatalf("It should not error, cause ID 2 is queued, but instead we got %v", err)
+	}
+	if pq.Len() != 2 {
+		t.Fatalf("Updating priority should not change the size, but it is %d", pq.Len())
+	}
+
+	result, _ := pq.PopOrWaitTillClose()
+	if result.ID != 2 || result.Priority != 5 {
+		t.Fatalf("Updated item should be returned first with its new priority, but instead we got %v", result)
+	}
+	result, _ = pq.PopOrWaitTillClose()
+	if result.ID != 1 {
+		t.Fatalf("Expected ID 1, but instead we got %v", result)
+	}
+	pq.Close()
+}
+
+func TestPriorityQueuePopBatch(t *testing.T) {
+	pq, _ := NewPriorityQueue(2048, 8)
+	pq.PushOrError(common.QItem{ID: 1, Priority: 3})
+	pq.PushOrError(common.QItem{ID: 2, Priority: 6})
+	pq.PushOrError(common.QItem{ID: 3, Priority: 1})
+	pq.PushOrError(common.QItem{ID: 4, Priority: 3})
+	pq.PushOrError(common.QItem{ID: 5, Priority: 0})
+
+	// same order as popping one by one
+	expectedIDs := []uint64{2, 1, 4, 3, 5}
+	first, err := pq.PopBatchOrWaitTillClose(3)
+	if err != nil || len(first) != 3 {
+		t.Fatalf("It should return 3 items, but instead we got %v and %v", first, err)
+	}
+	second, err := pq.PopBatchOrWaitTillClose(10)
+	if err != nil || len(second) != 2 {
+		t.Fatalf("It should return the remaining 2 items, but instead we got %v and %v", second, err)
+	}
+	for i, item := range append(first, second...) {
+		if item.ID != expectedIDs[i] {
+			t.Fatalf("Expected ID %d at position %d, but instead we got %v", expectedIDs[i], i, item)
+		}
+	}
+
+	pq.CloseGracefully()
+	_, err = pq.PopBatchOrWaitTillClose(10)
+	if err == nil || err != common.ErrQueueIsClosed {
+		t.Fatalf("It should be error, cause already closed, but instead we got %v", err)
+	}
+}
+
+func TestPriorityQueueRemove(t *testing.T) {
+	pq, _ := NewPriorityQueue(2, 8)
+	pq.PushOrError(common.QItem{ID: 1, Priority: 2})
+	pq.PushOrError(common.QItem{ID: 2, Priority: 1})
+
+	_, err := pq.Remove(3)
+	if err == nil || err != common.ErrItemNotFound {
+		t.Fatalf("It should error, cause ID 3 is not queued, but instead we got %v", err)
+	}
+	item, err := pq.Remove(1)
+	if err != nil || item.ID != 1 {
+		t.Fatalf("It should remove ID 1, but instead we got %v and %v", item, err)
+	}
+	if pq.Len() != 1 {
+		t.Fatalf("Removing should free the slot, but size is %d", pq.Len())
+	}
+	err = pq.PushOrError(common.QItem{ID: 3, Priority: 0})
+	if err != nil {
+		t.Fatalf("It should not error, cause a slot is freed, but instead we got %v", err)
+	}
+
+	pq.CloseGracefully()
+	pq.Remove(3)
+	result, err := pq.PopOrWaitTillClose()
+	if err != nil || result.ID != 2 {
+		t.Fatalf("Expected ID 2, but instead we got %v and %v", result, err)
+	}
+	_, err = pq.PopOrWaitTillClose()
+	if err == nil || err != common.ErrQueueIsClosed {
+		t.Fatalf("It should be closed after draining, but instead we got %v", err)
+	}
+}
+
+func TestPriorityQueueCompact(t *testing.T) {
+	pq, _ := NewPriorityQueue(2048, 8)
+	for i := 0; i < 1000; i++ {
+		pq.PushOrError(common.QItem{ID: uint64(i), Priority: i % 2})
+	}
+	for i := 0; i < 500; i++ {
+		pq.PopOrWaitTillClose()
+	}
+
+	pq.Compact()
+	if pq.queues[1] != nil || pq.queues[0] == nil {
+		t.Fatal("Only the empty priority should be released")
+	}
+	pq.PushOrError(common.QItem{ID: 1000, Priority: 1})
+	result, _ := pq.PopOrWaitTillClose()
+	if result.ID != 1000 {
+		t.Fatalf("Released priority should work again, but instead we got %v", result)
+	}
+	if pq.Len() != 500 {
+		t.Fatalf("It should still have 500 items, but instead we got %d", pq.Len())
+	}
+	pq.Close()
+}
+
+func TestPriorityQueueWithEarlyDrop(t *testing.T) {
+	_, err := NewPriorityQueue(10, 8, WithEarlyDrop(1.5, 4))
+	if err == nil || err != common.ErrParamShouldBePositive {
+		t.Fatalf("It should error, cause threshold should be below 1, but instead we got %v", err)
+	}
+
+	pq, _ := NewPriorityQueue(10, 8, WithEarlyDrop(0.5, 4))
+	for i := 0; i < 9; i++ {
+		if err = pq.PushOrError(common.QItem{ID: uint64(i), Priority: 4}); err != nil {
+			t.Fatalf("It should not reject priority at or above minPriority, but instead we got %v", err)
+		}
+	}
+	// 90% full, so low priority pushes are rejected 80% of the time
+	rejected := 0
+	for i := 0; i < 100; i++ {
+		err = pq.PushOrError(common.QItem{ID: 100, Priority: 0})
+		if errors.Is(err, common.ErrQueueIsFull) {
+			rejected++
+		} else {
+			pq.Remove(100)
+		}
+	}
+	if rejected == 0 || rejected == 100 {
+		t.Fatalf("It should reject some low priority pushes, but instead we got %d out of 100", rejected)
+	}
+	pq.Close()
+}
+
+func TestPriorityQueueWithReservedHeadroom(t *testing.T) {
+	_, err := NewPriorityQueue(10, 8, WithReservedHeadroom(1.5, 4))
+	if err == nil || err != common.ErrParamShouldBePositive {
+		t.Fatalf("It should error, cause fraction should be at most 1, but instead we got %v", err)
+	}
+
+	// the last 2 slots are reserved
+	pq, _ := NewPriorityQueue(10, 8, WithReservedHeadroom(0.2, 4))
+	for i := 0; i < 8; i++ {
+		if err = pq.PushOrError(common.QItem{ID: uint64(i), Priority: 0}); err != nil {
+			t.Fatalf("It should not error, cause not at the reserved part yet, but instead we got %v", err)
+		}
+	}
+	err = pq.PushOrError(common.QItem{ID: 8, Priority: 3})
+	if !errors.Is(err, common.ErrQueueIsFull) {
+		t.Fatalf("It should error, cause the rest is reserved, but instead we got %v", err)
+	}
+	for i := 8; i < 10; i++ {
+		if err = pq.PushOrError(common.QItem{ID: uint64(i), Priority: 4}); err != nil {
+			t.Fatalf("It should not error, cause the rest is reserved for it, but instead we got %v", err)
+		}
+	}
+	pq.Close()
+}
+
+func TestPriorityQueuePushOrEvict(t *testing.T) {
+	pq, _ := NewPriorityQueue(3, 8)
+	pq.PushOrError(common.QItem{ID: 1, Priority: 2})
+	pq.PushOrError(common.QItem{ID: 2, Priority: 1})
+	evicted, ok, err := pq.PushOrEvict(common.QItem{ID: 3, Priority: 1})
+	if err != nil || ok {
+		t.Fatalf("It should not evict, cause not full yet, but instead we got %v, %v and %v", evicted, ok, err)
+	}
+
+	_, _, err = pq.PushOrEvict(common.QItem{ID: 4, Priority: 1})
+	if !errors.Is(err, common.ErrQueueIsFull) {
+		t.Fatalf("It should error, cause nothing is lower than priority 1, but instead we got %v", err)
+	}
+	evicted, ok, err = pq.PushOrEvict(common.QItem{ID: 5, Priority: 7})
+	if err != nil || !ok || evicted.ID != 2 {
+		t.Fatalf("It should evict the oldest of priority 1, but instead we got %v, %v and %v", evicted, ok, err)
+	}
+
+	expected := []uint64{5, 1, 3}
+	for _, e := range expected {
+		item, _ := pq.PopOrWaitTillClose()
+		if item.ID != e {
+			t.Fatalf("Expected ID %d, but instead we got %v", e, item)
+		}
+	}
+	pq.Close()
+}
+
+func TestPriorityQueueWithLIFO(t *testing.T) {
+	pq, _ := NewPriorityQueue(2048, 8, WithLIFO())
+	pq.PushOrError(common.QItem{ID: 1, Priority: 2})
+	pq.PushOrError(common.QItem{ID: 2, Priority: 2})
+	pq.PushOrError(common.QItem{ID: 3, Priority: 5})
+	pq.PushOrError(common.QItem{ID: 4, Priority: 2})
+
+	expected := []uint64{3, 4, 2, 1}
+	for _, e := range expected {
+		item, _ := pq.PopOrWaitTillClose()
+		if item.ID != e {
+			t.Fatalf("Expected ID %d, but instead we got %v", e, item)
+		}
+	}
+	pq.Close()
+}
+
+func TestPriorityQueueSetNumOfPriority(t *testing.T) {
+	pq, _ := NewPriorityQueue(2048, 2)
+	p, err := pq.AddPriorityLevel()
+	if err != nil || p != 2 {
+		t.Fatalf("It should add priority 2, but instead we got %d and %v", p, err)
+	}
+	if err = pq.SetNumOfPriority(5); err != nil {
+		t.Fatalf("It should grow, but instead we got %v", err)
+	}
+	pq.PushOrError(common.QItem{ID: 1, Priority: 4})
+	pq.PushOrError(common.QItem{ID: 2, Priority: 1})
+
+	err = pq.SetNumOfPriority(3)
+	if err == nil || err != common.ErrPriorityNotEmpty {
+		t.Fatalf("It should error, cause priority 4 still has items, but instead we got %v", err)
+	}
+	item, _ := pq.PopOrWaitTillClose()
+	if item.ID != 1 {
+		t.Fatalf("Expected ID 1, but instead we got %v", item)
+	}
+	if err = pq.SetNumOfPriority(3); err != nil {
+		t.Fatalf("It should shrink, cause removed priorities are empty, but instead we got %v", err)
+	}
+	err = pq.PushOrError(common.QItem{ID: 3, Priority: 3})
+	if !errors.Is(err, common.ErrPriorityOutOfRange) {
+		t.Fatalf("It should error, cause priority 3 is removed, but instead we got %v", err)
+	}
+
+	// priority 2 is queued as 0, so it can be removed even with items
+	pq.RemapPriorities(func(p int) int {
+		if p == 2 {
+			return 0
+		}
+		return p
+	})
+	pq.PushOrError(common.QItem{ID: 4, Priority: 2})
+	if err = pq.SetNumOfPriority(2); err != nil {
+		t.Fatalf("It should shrink, cause band 2 is empty, but instead we got %v", err)
+	}
+	pq.RemapPriorities(func(p int) int { return p })
+
+	expected := []common.QItem{{ID: 2, Priority: 1}, {ID: 4, Priority: 0}}
+	for _, e := range expected {
+		item, _ := pq.PopOrWaitTillClose()
+		if item.ID != e.ID || item.Priority != e.Priority {
+			t.Fatalf("Expected %v, but instead we got %v", e, item)
+		}
+	}
+	pq.Close()
+}
+
+func TestPriorityQueuePushOrWaitTillClose(t *testing.T) {
+	pq, _ := NewPriorityQueue(1, 8)
+	pq.PushOrError(common.QItem{ID: 1, Priority: 1})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- pq.PushOrWaitTillClose(common.QItem{ID: 2, Priority: 2})
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("It should wait, cause the queue is full, but instead it returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	item, _ := pq.PopOrWaitTillClose()
+	if item.ID != 1 {
+		t.Fatalf("Expected ID 1, but instead we got %v", item)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("It should push once a slot is available, but instead we got %v", err)
+	}
+
+	go func() {
+		done <- pq.PushOrWaitTillClose(common.QItem{ID: 3, Priority: 2})
+	}()
+	time.Sleep(50 * time.Millisecond)
+	pq.Close()
+	if err := <-done; !errors.Is(err, common.ErrQueueIsClosed) {
+		t.Fatalf("It should return ErrQueueIsClosed, but instead we got %v", err)
+	}
+}
+
+func TestPriorityQueuePopOrWaitCtx(t *testing.T) {
+	pq, _ := NewPriorityQueue(2048, 16, WithRateLimit(3, 1, 1))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := pq.PopOrWaitCtx(ctx)
+	if err == nil || err != context.DeadlineExceeded {
+		t.Fatalf("It should return context.DeadlineExceeded, cause nothing is pushed, but instead we got %v", err)
+	}
+
+	// the only token is taken, so the next pop waits for the rate limit
+	pq.PushOrError(common.QItem{ID: 1, Priority: 3})
+	pq.PushOrError(common.QItem{ID: 2, Priority: 3})
+	item, err := pq.PopOrWaitCtx(context.Background())
+	if err != nil || item.ID != 1 {
+		t.Fatalf("Expected ID 1, but instead we got %v and %v", item, err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	_, err = pq.PopOrWaitCtx(ctx)
+	if err == nil || err != context.Canceled {
+		t.Fatalf("It should return context.Canceled, cause rate-limited, but instead we got %v", err)
+	}
+	if pq.Len() != 1 {
+		t.Fatalf("The rate-limited item should still be queued, but instead Len is %d", pq.Len())
+	}
+	pq.Close()
+}
+
+func TestPriorityQueueDepthPerPriority(t *testing.T) {
+	pq, _ := NewPriorityQueue(2048, 4)
+	var _ common.Inspector = pq
+
+	pq.PushOrError(common.QItem{ID: 1, Priority: 0})
+	pq.PushOrError(common.QItem{ID: 2, Priority: 3})
+	pq.PushOrError(common.QItem{ID: 3, Priority: 3})
+	if depths := pq.DepthPerPriority(); !reflect.DeepEqual(depths, []int{1, 0, 0, 2}) {
+		t.Fatalf("Expected depths [1 0 0 2], but instead we got %v", depths)
+	}
+
+	// the result is a copy
+	depths := pq.DepthPerPriority()
+	depths[0] = 100
+	pq.PopOrWaitTillClose()
+	if depths := pq.DepthPerPriority(); !reflect.DeepEqual(depths, []int{1, 0, 0, 1}) {
+		t.Fatalf("Expected depths [1 0 0 1], but instead we got %v", depths)
+	}
+	pq.Close()
+}
+
+func TestPriorityQueueDrain(t *testing.T) {
+	pq, _ := NewPriorityQueue(2048, 4)
+	pq.PushOrError(common.QItem{ID: 1, Priority: 1})
+	pq.PushOrError(common.QItem{ID: 2, Priority: 3})
+	pq.PushOrError(common.QItem{ID: 3, Priority: 1})
+
+	items := pq.Drain()
+	if len(items) != 3 || items[0].ID != 2 || items[1].ID != 1 || items[2].ID != 3 {
+		t.Fatalf("Expected IDs 2, 1, 3, but instead we got %v", items)
+	}
+	if pq.Len() != 0 {
+		t.Fatalf("It should be empty after drain, but instead Len is %d", pq.Len())
+	}
+
+	pq.Close()
+	if items := pq.Drain(); items != nil {
+		t.Fatalf("It should return nil, cause already closed, but instead we got %v", items)
+	}
+}
+
+func TestPriorityQueuePauseResume(t *testing.T) {
+	pq, _ := NewPriorityQueue(2048, 4)
+	pq.Pause()
+	err := pq.PushOrError(common.QItem{ID: 1, Priority: 1})
+	if err != nil {
+		t.Fatalf("It should accept pushes while paused, but instead we got %v", err)
+	}
+
+	done := make(chan common.QItem, 1)
+	go func() {
+		item, _ := pq.PopOrWaitTillClose()
+		done <- item
+	}()
+	select {
+	case item := <-done:
+		t.Fatalf("It should wait, cause paused, but instead it returned %v", item)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	pq.Resume()
+	if item := <-done; item.ID != 1 {
+		t.Fatalf("Expected ID 1, but instead we got %v", item)
+	}
+	pq.Close()
+}
+
+func TestPriorityQueueCloseIsIdempotent(t *testing.T) {
+	pq, _ := NewPriorityQueue(2048, 4)
+	var _ common.ClosedNotifier = pq
+	if pq.IsClosed() {
+		t.Fatal("It should not be closed yet, but it is")
+	}
+	select {
+	case <-pq.Closed():
+		t.Fatal("Closed() should not be closed yet, but it is")
+	default:
+	}
+
+	if err := pq.Close(); err != nil {
+		t.Fatalf("It should not error on the first close, but instead we got %v", err)
+	}
+	if err := pq.Close(); err == nil || err != common.ErrQueueIsClosed {
+		t.Fatalf("It should return ErrQueueIsClosed on the second close, but instead we got %v", err)
+	}
+	if !pq.IsClosed() {
+		t.Fatal("It should be closed, but it is not")
+	}
+	select {
+	case <-pq.Closed():
+	case <-time.After(time.Second):
+		t.Fatal("Closed() should be closed, but it is not")
+	}
+}
+
+func TestPriorityQueueWaitUntilEmpty(t *testing.T) {
+	pq, _ := NewPriorityQueue(2048, 4)
+
+	if err := pq.WaitUntilEmpty(context.Background()); err != nil {
+		t.Fatalf("It should return right away, cause it is empty, but instead we got %v", err)
+	}
+
+	pq.PushOrError(common.QItem{ID: 1, Priority: 1})
+	pq.PushOrError(common.QItem{ID: 2, Priority: 2})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := pq.WaitUntilEmpty(ctx); err == nil || err != context.DeadlineExceeded {
+		t.Fatalf("It should return context.DeadlineExceeded, cause nothing is popped, but instead we got %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- pq.WaitUntilEmpty(context.Background())
+	}()
+	pq.PopOrWaitTillClose()
+	time.Sleep(20 * time.Millisecond)
+	if len(done) != 0 {
+		t.Fatalf("It should still wait, cause 1 item is left")
+	}
+	pq.PopOrWaitTillClose()
+	if err := <-done; err != nil {
+		t.Fatalf("It should return once the last item is popped, but instead we got %v", err)
+	}
+
+	pq.PushOrError(common.QItem{ID: 3, Priority: 1})
+	go func() {
+		done <- pq.WaitUntilEmpty(context.Background())
+	}()
+	time.Sleep(20 * time.Millisecond)
+	pq.Close()
+	if err := <-done; err == nil || err != common.ErrQueueIsClosed {
+		t.Fatalf("It should return ErrQueueIsClosed, cause closed with items left, but instead we got %v", err)
+	}
+}
+
+func TestPriorityQueueWithWatermarks(t *testing.T) {
+	_, err := NewPriorityQueue(8, 4, WithWatermarks(2, 2, nil, nil))
+	if err == nil || err != common.ErrParamShouldBePositive {
+		t.Fatalf("It should error, cause low should be below high, but instead we got %v", err)
+	}
+
+	high, low := 0, 0
+	pq, _ := NewPriorityQueue(8, 4, WithWatermarks(3, 1,
+		func(size int) { high++ },
+		func(size int) { low++ }))
+	for i := 0; i < 4; i++ {
+		pq.PushOrError(common.QItem{ID: uint64(i), Priority: 1})
+	}
+	if high != 1 || low != 0 {
+		t.Fatalf("Only the high watermark should be crossed once, but instead we got %d and %d", high, low)
+	}
+	for i := 0; i < 3; i++ {
+		pq.PopOrWaitTillClose()
+	}
+	if high != 1 || low != 1 {
+		t.Fatalf("The low watermark should be crossed once, but instead we got %d and %d", high, low)
+	}
+	pq.Close()
+}
+
+func TestPriorityQueueSnapshot(t *testing.T) {
+	pq, _ := NewPriorityQueue(2048, 4)
+	pq.PushOrError(common.QItem{ID: 1, Priority: 1})
+	pq.PushOrError(common.QItem{ID: 2, Priority: 3})
+	pq.PushOrError(common.QItem{ID: 3, Priority: 1})
+
+	items := pq.Snapshot()
+	if len(items) != 3 || items[0].ID != 2 || items[1].ID != 1 || items[2].ID != 3 {
+		t.Fatalf("Expected IDs 2, 1, 3, but instead we got %v", items)
+	}
+	if pq.Len() != 3 {
+		t.Fatalf("Snapshot should not remove items, but instead Len is %d", pq.Len())
+	}
+	for _, id := range []uint64{2, 1, 3} {
+		item, _ := pq.PopOrWaitTillClose()
+		if item.ID != id {
+			t.Fatalf("Expected ID %d, the same order as the snapshot, but instead we got %v", id, item)
+		}
+	}
+	pq.Close()
+}
+
+func TestPriorityQueueConformance(t *testing.T) {
+	queuetest.Run(t, func(sizeLimit int) (common.ExtendedQInterface, error) {
+		return NewPriorityQueue(sizeLimit, 4)
+	})
+}
+
+func TestPriorityQueueTryPop(t *testing.T) {
+	pq, _ := NewPriorityQueue(1, 4)
+	pq.PushOrError(common.QItem{ID: 1, Priority: 2})
+	err := pq.PushOrError(common.QItem{ID: 2, Priority: 3})
+	var qerr *common.QueueError
+	if !errors.As(err, &qerr) || qerr.Op != "PushOrError" ||
+		qerr.Priority != 3 || qerr.Size != 1 || qerr.Limit != 1 {
+		t.Fatalf("It should return a QueueError with the details, but instead we got %v", err)
+	}
+	if !errors.Is(err, common.ErrQueueIsFull) {
+		t.Fatalf("It should still be ErrQueueIsFull, but instead we got %v", err)
+	}
+	pq.Pause()
+	_, err = pq.TryPop()
+	if err == nil || err != common.ErrQueueIsEmpty {
+		t.Fatalf("It should return ErrQueueIsEmpty while paused, but instead we got %v", err)
+	}
+	pq.Resume()
+	item, err := pq.TryPop()
+	if err != nil || item.ID != 1 {
+		t.Fatalf("It should pop ID 1, but instead we got %v and %v", item, err)
+	}
+	pq.Close()
+}
+
+func TestPriorityQueuePeek(t *testing.T) {
+	pq, _ := NewPriorityQueue(2048, 4, WithLIFO())
+	pq.PushOrError(common.QItem{ID: 1, Priority: 1})
+	pq.PushOrError(common.QItem{ID: 2, Priority: 2})
+	pq.PushOrError(common.QItem{ID: 3, Priority: 2})
+	item, err := pq.Peek()
+	if err != nil || item.ID != 3 || item.Priority != 2 {
+		t.Fatalf("It should peek the newest of priority 2, but instead we got %v and %v", item, err)
+	}
+	popped, _ := pq.PopOrWaitTillClose()
+	if popped != item || pq.Len() != 2 {
+		t.Fatalf("It should pop the peeked item, but instead we got %v and Len %d", popped, pq.Len())
+	}
+	pq.Close()
+	_, err = pq.Peek()
+	if !errors.Is(err, common.ErrQueueIsClosed) {
+		t.Fatalf("It should return ErrQueueIsClosed, but instead we got %v", err)
+	}
+}
+
+func TestPriorityQueuePopAtLeastOrWaitCtx(t *testing.T) {
+	var _ common.FilteredPopper = &PriorityQueue{}
+	pq, _ := NewPriorityQueue(2048, 4)
+	_, err := pq.PopAtLeastOrWaitCtx(context.Background(), -1)
+	if !errors.Is(err, common.ErrPriorityOutOfRange) {
+		t.Fatalf("It should return ErrPriorityOutOfRange, but instead we got %v", err)
+	}
+
+	pq.PushOrError(common.QItem{ID: 1, Priority: 1})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = pq.PopAtLeastOrWaitCtx(ctx, 2)
+	if err == nil || err != context.DeadlineExceeded {
+		t.Fatalf("It should wait, cause there is no item of priority 2 or higher, but instead we got %v", err)
+	}
+
+	done := make(chan common.QItem)
+	go func() {
+		item, _ := pq.PopAtLeastOrWaitCtx(context.Background(), 2)
+		done <- item
+	}()
+	time.Sleep(20 * time.Millisecond)
+	// only the filtered pop waits, it should be woken by both
+	pq.PushOrError(common.QItem{ID: 2, Priority: 0})
+	pq.PushOrError(common.QItem{ID: 3, Priority: 3})
+	if item := <-done; item.ID != 3 {
+		t.Fatalf("It should take ID 3, but instead we got %v", item)
+	}
+	for _, id := range []uint64{1, 2} {
+		item, err := pq.PopOrWaitTillClose()
+		if err != nil || item.ID != id {
+			t.Fatalf("Lower priorities should be left for other pops, but instead we got %v and %v", item, err)
+		}
+	}
+	pq.Close()
+}
+
+type recordingLogger struct {
+	msgs []string
+}
+
+func (l *recordingLogger) Info(msg string, keyvals ...interface{}) {
+	l.msgs = append(l.msgs, "info: "+msg)
+}
+func (l *recordingLogger) Warn(msg string, keyvals ...interface{}) {
+	l.msgs = append(l.msgs, "warn: "+msg)
+}
+func (l *recordingLogger) Error(msg string, keyvals ...interface{}) {
+	l.msgs = append(l.msgs, "error: "+msg)
+}
+
+func TestPriorityQueueWithLogger(t *testing.T) {
+	logger := &recordingLogger{}
+	pq, _ := NewPriorityQueue(1, 4, WithLogger(logger))
+	pq.PushOrError(common.QItem{ID: 1, Priority: 0})
+	pq.PushOrEvict(common.QItem{ID: 2, Priority: 3})
+	pq.CloseNow()
+	expected := []string{"info: item evicted", "warn: queue closed, dropping items"}
+	if !reflect.DeepEqual(logger.msgs, expected) {
+		t.Fatalf("It should log %v, but instead we got %v", expected, logger.msgs)
+	}
+
+	// the more is queued, the more likely it drops, long before getting full
+	logger = &recordingLogger{}
+	pq, _ = NewPriorityQueue(100, 4, WithEarlyDrop(0, 4), WithLogger(logger))
+	for i := 0; pq.PushOrError(common.QItem{ID: uint64(i), Priority: 0}) == nil; i++ {
+	}
+	if pq.Len() == 100 || len(logger.msgs) != 1 || logger.msgs[0] != "info: item dropped early" {
+		t.Fatalf("It should log the early drop, but instead we got %v", logger.msgs)
+	}
+}
@@ -0,0 +1,72 @@
+package prioritize
+
+import "context"
+
+// WithProgressCallback makes the engine call `fn` each time a running task reports its progress,
+// see `ReportProgress`. `fn` is called on the goroutine reporting it, so keep it short.
+//
+// Tasks of `SubmitAndNotify` are reused once completed, so don't keep the `Task` after `fn` returns.
+func WithProgressCallback(fn func(task *Task, fraction float64, stage string)) Option {
+	return func(e *Engine) error {
+		e.onProgress = fn
+		return nil
+	}
+}
+
+type progressKey struct{}
+
+// runContext is the ctx a task runs with, also carrying the task itself, for `ReportProgress`.
+// It is kept inside the task, so running a task does not allocate just for it.
+type runContext struct {
+	context.Context
+	task *Task
+}
+
+func (rc *runContext) Value(key interface{}) interface{} {
+	if key == (progressKey{}) {
+		return rc.task
+	}
+	return rc.Context.Value(key)
+}
+
+// ReportProgress lets the fn of a task, given the ctx it runs with, report how far along it is,
+// so long running tasks can be told apart from hung ones,
+// see `Task.Progress`, `WithProgressCallback`, and `Snapshot`.
+// `fraction` is clamped between 0 and 1, and `stage` is a free-form description, e.g. "indexing".
+//
+// It does nothing if `ctx` is not from a running task, e.g. from `SubmitAndForget`,
+// or after the fn returns.
+func ReportProgress(ctx context.Context, fraction float64, stage string) {
+	task, ok := ctx.Value(progressKey{}).(*Task)
+	if !ok {
+		return
+	}
+	if fraction < 0 {
+		fraction = 0
+	} else if fraction > 1 {
+		fraction = 1
+	}
+
+	task.mu.Lock()
+	if task.Status() != TaskRunning {
+		task.mu.Unlock()
+		return
+	}
+	task.progress = fraction
+	task.stage = stage
+	task.mu.Unlock()
+
+	e := task.engine
+	e.inflight.progress(task.id, fraction, stage)
+	if e.onProgress != nil {
+		e.onProgress(task, fraction, stage)
+	}
+}
+
+// Progress returns the last progress reported by the fn of the Task, see `ReportProgress`.
+// It is 0 and "" if none is reported yet, and is kept as is once the Task completes.
+func (t *Task) Progress() (fraction float64, stage string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.progress, t.stage
+}
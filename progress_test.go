@@ -0,0 +1,63 @@
+package prioritize
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aarondwi/prioritize/priority"
+)
+
+func TestEngineReportProgress(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 4)
+	type report struct {
+		id       uint64
+		fraction float64
+		stage    string
+	}
+	reports := make(chan report, 10)
+	engine, _ := New(pq, 1, WithProgressCallback(func(task *Task, fraction float64, stage string) {
+		reports <- report{task.ID(), fraction, stage}
+	}))
+	defer engine.Close()
+
+	reported := make(chan bool)
+	gate := make(chan bool)
+	task, _ := engine.Submit(context.Background(), 0, func(ctx context.Context, arg interface{}) (interface{}, error) {
+		ReportProgress(ctx, 0.42, "indexing")
+		reported <- true
+		<-gate
+		ReportProgress(ctx, 2, "done")
+		return nil, nil
+	}, nil)
+
+	<-reported
+	if fraction, stage := task.Progress(); fraction != 0.42 || stage != "indexing" {
+		t.Fatalf("It should return the reported progress, but instead we got %v and %s", fraction, stage)
+	}
+	if r := <-reports; r.id != task.ID() || r.fraction != 0.42 || r.stage != "indexing" {
+		t.Fatalf("It should call the callback with the reported progress, but instead we got %v", r)
+	}
+	inflight := engine.Snapshot().InFlight
+	if len(inflight) != 1 || inflight[0].Progress != 0.42 || inflight[0].Stage != "indexing" {
+		t.Fatalf("It should show the progress in the snapshot, but instead we got %v", inflight)
+	}
+
+	close(gate)
+	task.Result()
+	if fraction, stage := task.Progress(); fraction != 1 || stage != "done" {
+		t.Fatalf("It should clamp the fraction to 1, and keep it once completed, but instead we got %v and %s", fraction, stage)
+	}
+
+	// not from a running task, so nothing to report to
+	ReportProgress(context.Background(), 0.5, "ignored")
+	forgotten := make(chan bool)
+	engine.SubmitAndForget(context.Background(), 0, func(ctx context.Context, arg interface{}) (interface{}, error) {
+		ReportProgress(ctx, 0.5, "ignored")
+		close(forgotten)
+		return nil, nil
+	}, nil)
+	<-forgotten
+	if r := <-reports; r.fraction != 1 || len(reports) != 0 {
+		t.Fatalf("It should only report progress of running tasks, but instead we got %v and %d more", r, len(reports))
+	}
+}
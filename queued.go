@@ -0,0 +1,148 @@
+package prioritize
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/aarondwi/prioritize/common"
+)
+
+// Tasks are carried by the queue itself, in `common.QItem.Payload`,
+// either as *Task, or as *forgottenTask for `SubmitAndForget`.
+//
+// Each item leaves the queue once, either popped by a worker, or removed (e.g. cancelled),
+// evicted, or dropped on `CloseNow`, as the queue makes sure only 1 of them gets it.
+// Whoever gets it calls `untrack`, so `Len()` is just a counter.
+
+// forgottenTask is what a worker needs to run a task nobody waits for.
+// They are pooled, so `SubmitAndForget` does not allocate.
+type forgottenTask struct {
+	ctx context.Context
+	fn  TaskFunc
+	arg interface{}
+}
+
+var forgottenTaskPool = sync.Pool{
+	New: func() interface{} {
+		return &forgottenTask{}
+	},
+}
+
+func newForgottenTask(ctx context.Context, fn TaskFunc, arg interface{}) *forgottenTask {
+	ft := forgottenTaskPool.Get().(*forgottenTask)
+	ft.ctx, ft.fn, ft.arg = ctx, fn, arg
+	return ft
+}
+
+func putForgottenTask(ft *forgottenTask) {
+	*ft = forgottenTask{}
+	forgottenTaskPool.Put(ft)
+}
+
+// track is called right before the item of `task` is pushed
+func (e *Engine) track(task *Task) {
+	atomic.StoreInt32(&task.inQueue, 1)
+	atomic.AddInt64(&e.queued, 1)
+	if e.reapable != nil {
+		e.reapable.add(task)
+	}
+}
+
+// untrack is called once the item of `task` leaves the queue, or can't be pushed.
+// It returns false if it is already called since `track`.
+func (e *Engine) untrack(task *Task) bool {
+	if !atomic.CompareAndSwapInt32(&task.inQueue, 1, 0) {
+		return false
+	}
+	atomic.AddInt64(&e.queued, -1)
+	e.settled()
+	return true
+}
+
+// untrackForgotten is the same as `untrack`, for tasks from `SubmitAndForget`.
+// Unlike a task, `ft` can only be gotten by 1, so it is put back into the pool right away.
+func (e *Engine) untrackForgotten(ft *forgottenTask) {
+	atomic.AddInt64(&e.queued, -1)
+	e.settled()
+	putForgottenTask(ft)
+}
+
+// drop completes the task of `item`, which is not gonna be run as the engine is closed, see `CloseNow`
+func (e *Engine) drop(item common.QItem) {
+	e.dropWith(item, ErrAlreadyClosed)
+}
+
+// dropWith completes the task of `item`, which is not gonna be run because of `err`
+func (e *Engine) dropWith(item common.QItem, err error) {
+	switch payload := item.Payload.(type) {
+	case *Task:
+		if e.untrack(payload) {
+			if payload.expiry != nil {
+				payload.expiry.Stop()
+			}
+			e.complete(payload, nil, err)
+		}
+	case *forgottenTask:
+		e.untrackForgotten(payload)
+	}
+}
+
+// dropHeld drops the items held by the engine itself, outside of the queue,
+// i.e. in worker buffers (see `WithLocalBatch`), or held over a limit
+// (see `WithMaxConcurrentPerPriority` and `WithRateLimit`).
+func (e *Engine) dropHeld() {
+	for _, buffer := range e.buffers {
+		for _, item := range buffer.popAll() {
+			e.drop(item)
+		}
+	}
+	if e.limits != nil {
+		for _, item := range e.limits.popAll() {
+			e.drop(item)
+		}
+	}
+	if e.rates != nil {
+		for _, item := range e.rates.popAll() {
+			e.drop(item)
+		}
+	}
+}
+
+// queuedTasks keeps tasks put into the queue, to find those to reap, see `WithCancelledTaskReaping`.
+// Those already out of the queue are only cleared on each reap.
+//
+// This struct is thread(goroutine)-safe.
+type queuedTasks struct {
+	mu    sync.Mutex
+	tasks []*Task
+}
+
+func (qt *queuedTasks) add(task *Task) {
+	qt.mu.Lock()
+	qt.tasks = append(qt.tasks, task)
+	qt.mu.Unlock()
+}
+
+// cancelled returns tasks still in the queue whose context is already done,
+// clearing those out of the queue
+func (qt *queuedTasks) cancelled() []*Task {
+	qt.mu.Lock()
+	defer qt.mu.Unlock()
+	var result []*Task
+	kept := qt.tasks[:0]
+	for _, task := range qt.tasks {
+		if atomic.LoadInt32(&task.inQueue) == 0 {
+			continue
+		}
+		kept = append(kept, task)
+		if task.ctx.Err() != nil {
+			result = append(result, task)
+		}
+	}
+	for i := len(kept); i < len(qt.tasks); i++ {
+		qt.tasks[i] = nil
+	}
+	qt.tasks = kept
+	return result
+}
@@ -0,0 +1,110 @@
+// Package queuetest checks a queue against the behaviour shared by all built-in queues,
+// as documented on `common.ExtendedQInterface`.
+// You may use this to test your own queue, when implementing one yourself.
+package queuetest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+)
+
+// NewQueue creates an empty queue, which can hold up to `sizeLimit` items of priority 0.
+type NewQueue func(sizeLimit int) (common.ExtendedQInterface, error)
+
+// Run checks the queues created by `newQueue`, each behaviour in its own subtest.
+// Only items of priority 0 are pushed, so ordering between priorities is left to each queue's own tests.
+func Run(t *testing.T, newQueue NewQueue) {
+	t.Run("TryPop", func(t *testing.T) { testTryPop(t, newQueue) })
+	t.Run("Peek", func(t *testing.T) { testPeek(t, newQueue) })
+	t.Run("PushOrWaitCtx", func(t *testing.T) { testPushOrWaitCtx(t, newQueue) })
+	t.Run("QueueError", func(t *testing.T) { testQueueError(t, newQueue) })
+}
+
+func mustNew(t *testing.T, newQueue NewQueue, sizeLimit int) common.ExtendedQInterface {
+	t.Helper()
+	q, err := newQueue(sizeLimit)
+	if err != nil {
+		t.Fatalf("It should create the queue, but instead we got %v", err)
+	}
+	return q
+}
+
+func testTryPop(t *testing.T, newQueue NewQueue) {
+	q := mustNew(t, newQueue, 10)
+	_, err := q.TryPop()
+	if err == nil || err != common.ErrQueueIsEmpty {
+		t.Fatalf("It should return ErrQueueIsEmpty, but instead we got %v", err)
+	}
+	q.PushOrError(common.QItem{ID: 1})
+	item, err := q.TryPop()
+	if err != nil || item.ID != 1 {
+		t.Fatalf("It should pop ID 1, but instead we got %v and %v", item, err)
+	}
+	q.Close()
+	_, err = q.TryPop()
+	if err == nil || err != common.ErrQueueIsClosed {
+		t.Fatalf("It should return ErrQueueIsClosed, but instead we got %v", err)
+	}
+}
+
+func testPeek(t *testing.T, newQueue NewQueue) {
+	q := mustNew(t, newQueue, 10)
+	_, err := q.Peek()
+	if err == nil || err != common.ErrQueueIsEmpty {
+		t.Fatalf("It should return ErrQueueIsEmpty, but instead we got %v", err)
+	}
+	q.PushOrError(common.QItem{ID: 1})
+	q.PushOrError(common.QItem{ID: 2})
+	item, err := q.Peek()
+	if err != nil {
+		t.Fatalf("It should peek an item, but instead we got %v", err)
+	}
+	if q.Len() != 2 {
+		t.Fatalf("Peek should not remove item, but instead Len is %d", q.Len())
+	}
+	popped, _ := q.PopOrWaitTillClose()
+	if popped.ID != item.ID {
+		t.Fatalf("It should pop the peeked item, but instead we got %v", popped)
+	}
+	q.Close()
+}
+
+func testPushOrWaitCtx(t *testing.T, newQueue NewQueue) {
+	q := mustNew(t, newQueue, 1)
+	q.PushOrError(common.QItem{ID: 1})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := q.PushOrWaitCtx(ctx, common.QItem{ID: 2}); err == nil || err != context.DeadlineExceeded {
+		t.Fatalf("It should return context.DeadlineExceeded, cause the queue is full, but instead we got %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- q.PushOrWaitCtx(context.Background(), common.QItem{ID: 2})
+	}()
+	q.PopOrWaitTillClose()
+	if err := <-done; err != nil {
+		t.Fatalf("It should push once a slot is freed, but instead we got %v", err)
+	}
+	q.Close()
+}
+
+func testQueueError(t *testing.T, newQueue NewQueue) {
+	q := mustNew(t, newQueue, 1)
+	q.PushOrError(common.QItem{ID: 1})
+	err := q.PushOrError(common.QItem{ID: 2})
+	var qerr *common.QueueError
+	if !errors.As(err, &qerr) || qerr.Op != "PushOrError" ||
+		qerr.Priority != 0 || qerr.Size != 1 || qerr.Limit != 1 {
+		t.Fatalf("It should return a QueueError with the details, but instead we got %v", err)
+	}
+	if !errors.Is(err, common.ErrQueueIsFull) {
+		t.Fatalf("It should still be ErrQueueIsFull, but instead we got %v", err)
+	}
+	q.Close()
+}
@@ -0,0 +1,180 @@
+package prioritize
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+)
+
+// WithRateLimit limits how many tasks of `priority` the engine starts,
+// to `ratePerSecond` with bursts up to `burst` tasks, even if workers are idle,
+// e.g. to protect a rate-limited downstream only called by low priority tasks.
+// It can be given once for each priority to limit.
+//
+// Unlike `priority.WithRateLimit`, it works with any queue. A worker popping a task over the rate
+// holds it aside, and takes another item from the queue. Held tasks keep their order,
+// and are run by the first worker free once their token is available.
+// Only 1 task of each priority is held. A worker popping another one waits for its token instead,
+// so the queue fills up, and pushes back on submissions, as usual.
+// Idle workers are woken up for them if the queue implements `common.CtxPopper`,
+// and neither `WithMaxWorkers` nor `WithLocalBatch` is used.
+// Else, they wait until a worker goes back to the queue.
+func WithRateLimit(priority int, ratePerSecond float64, burst int) Option {
+	return func(e *Engine) error {
+		if priority < 0 {
+			return common.ErrPriorityOutOfRange
+		}
+		tb, err := common.NewTokenBucket(ratePerSecond, burst)
+		if err != nil {
+			return err
+		}
+		if e.rates == nil {
+			e.rates = &rateLimits{byPriority: make(map[int]*priorityRate), wake: e.wakeWorkers}
+		}
+		if _, ok := e.rates.byPriority[priority]; !ok {
+			e.rates.priorities = append(e.rates.priorities, priority)
+			// held items of higher priorities are run first
+			sort.Sort(sort.Reverse(sort.IntSlice(e.rates.priorities)))
+		}
+		e.rates.byPriority[priority] = &priorityRate{bucket: tb}
+		return nil
+	}
+}
+
+// rateLimits tracks the token buckets of limited priorities, see `WithRateLimit`.
+//
+// This struct is thread(goroutine)-safe.
+type rateLimits struct {
+	mu         sync.Mutex
+	byPriority map[int]*priorityRate
+	priorities []int
+	held       int
+	// wake is called once the next held item can run
+	wake  func()
+	timer *time.Timer
+}
+
+type priorityRate struct {
+	bucket *common.TokenBucket
+	// popped over the rate, in order
+	held []common.QItem
+}
+
+// acquire returns the item to run now, taking a token of its priority, together with true.
+// Else, `item` is held until `ready` returns it.
+// If as many are held already, it waits for the token, and returns the first held one,
+// holding `item` in its place.
+func (rl *rateLimits) acquire(item common.QItem) (common.QItem, bool) {
+	pr, ok := rl.byPriority[item.Priority]
+	if !ok {
+		return item, true
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := time.Now()
+	// held ones go first
+	if len(pr.held) == 0 && pr.bucket.Available(now) {
+		pr.bucket.Take()
+		return item, true
+	}
+	if len(pr.held) < maxHeldPerPriority {
+		pr.held = append(pr.held, item)
+		rl.held++
+		rl.armLocked(now)
+		return common.MinQItem, false
+	}
+	for !pr.bucket.Available(now) {
+		delay := pr.bucket.Delay(now)
+		rl.mu.Unlock()
+		time.Sleep(delay)
+		rl.mu.Lock()
+		now = time.Now()
+	}
+	pr.bucket.Take()
+	if len(pr.held) == 0 {
+		// taken by `ready` in the meantime
+		return item, true
+	}
+	first := pr.held[0]
+	copy(pr.held, pr.held[1:])
+	pr.held[len(pr.held)-1] = item
+	return first, true
+}
+
+// ready returns a held item whose token is available, taking it, together with true
+func (rl *rateLimits) ready() (common.QItem, bool) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if rl.held == 0 {
+		return common.MinQItem, false
+	}
+	now := time.Now()
+	for _, priority := range rl.priorities {
+		pr := rl.byPriority[priority]
+		if len(pr.held) > 0 && pr.bucket.Available(now) {
+			pr.bucket.Take()
+			item := pr.held[0]
+			pr.held[0] = common.QItem{}
+			pr.held = pr.held[1:]
+			rl.held--
+			return item, true
+		}
+	}
+	rl.armLocked(now)
+	return common.MinQItem, false
+}
+
+// delayLocked returns how long until the next held item can run
+func (rl *rateLimits) delayLocked(now time.Time) time.Duration {
+	var delay time.Duration = -1
+	for _, pr := range rl.byPriority {
+		if len(pr.held) == 0 {
+			continue
+		}
+		if d := pr.bucket.Delay(now); delay < 0 || d < delay {
+			delay = d
+		}
+	}
+	return delay
+}
+
+// armLocked makes sure `wake` is called once the next held item can run
+func (rl *rateLimits) armLocked(now time.Time) {
+	if rl.timer != nil {
+		return
+	}
+	rl.timer = time.AfterFunc(rl.delayLocked(now), func() {
+		rl.mu.Lock()
+		rl.timer = nil
+		rl.mu.Unlock()
+		rl.wake()
+	})
+}
+
+// wait waits until the next held item can run, and returns false if there is none,
+// so workers don't exit on close while there are still held items.
+func (rl *rateLimits) wait() bool {
+	rl.mu.Lock()
+	delay := rl.delayLocked(time.Now())
+	rl.mu.Unlock()
+	if delay < 0 {
+		return false
+	}
+	time.Sleep(delay)
+	return true
+}
+
+// popAll takes all held items, e.g. to drop them on `CloseNow`
+func (rl *rateLimits) popAll() []common.QItem {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	var items []common.QItem
+	for _, pr := range rl.byPriority {
+		items = append(items, pr.held...)
+		pr.held = nil
+	}
+	rl.held = 0
+	return items
+}
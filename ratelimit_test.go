@@ -0,0 +1,107 @@
+package prioritize
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/priority"
+)
+
+func TestEngineWithRateLimit(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 4)
+	_, err := New(pq, 1, WithRateLimit(-1, 10, 1))
+	if !errors.Is(err, common.ErrPriorityOutOfRange) {
+		t.Fatalf("It should error, cause the priority is negative, instead we got %v", err)
+	}
+	_, err = New(pq, 1, WithRateLimit(0, 0, 1))
+	if !errors.Is(err, common.ErrParamShouldBePositive) {
+		t.Fatalf("It should error, cause the rate is not positive, instead we got %v", err)
+	}
+
+	engine, err := New(pq, 4, WithRateLimit(0, 50, 1))
+	if err != nil {
+		t.Fatalf("It should not error, because all are correct parameters, instead we got %v", err)
+	}
+
+	var mu sync.Mutex
+	var limited, unlimited []time.Time
+	record := func(times *[]time.Time) TaskFunc {
+		return func(ctx context.Context, arg interface{}) (interface{}, error) {
+			mu.Lock()
+			*times = append(*times, time.Now())
+			mu.Unlock()
+			return nil, nil
+		}
+	}
+	start := time.Now()
+	tasks := make([]*Task, 0, 10)
+	for i := 0; i < 5; i++ {
+		task, _ := engine.Submit(context.Background(), 0, record(&limited), nil)
+		tasks = append(tasks, task)
+		task, _ = engine.Submit(context.Background(), 1, record(&unlimited), nil)
+		tasks = append(tasks, task)
+	}
+	for _, task := range tasks {
+		if _, err := task.Result(); err != nil {
+			t.Fatalf("It should not error, instead we got %v", err)
+		}
+	}
+	engine.Close()
+
+	// burst of 1, then 1 every 20ms
+	if elapsed := limited[4].Sub(start); elapsed < 70*time.Millisecond {
+		t.Fatalf("Expected priority 0 to be rate limited, but all ran within %v", elapsed)
+	}
+	if elapsed := unlimited[4].Sub(start); elapsed > 40*time.Millisecond {
+		t.Fatalf("Expected priority 1 not to wait for priority 0, but it took %v", elapsed)
+	}
+
+	// held tasks still run on graceful close
+	pq, _ = priority.NewPriorityQueue(2048, 4)
+	engine, _ = New(pq, 2, WithRateLimit(0, 50, 1))
+	tasks = tasks[:0]
+	for i := 0; i < 3; i++ {
+		task, _ := engine.Submit(context.Background(), 0, record(&limited), nil)
+		tasks = append(tasks, task)
+	}
+	engine.CloseGracefully()
+	for _, task := range tasks {
+		if _, err := task.Result(); err != nil {
+			t.Fatalf("It should not error, instead we got %v", err)
+		}
+	}
+}
+
+func TestEngineWithRateLimitPushesBack(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2, 4)
+	engine, _ := New(pq, 1, WithRateLimit(0, 20, 1))
+	defer engine.Close()
+
+	noop := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		return arg, nil
+	}
+	// 1 runs, 1 is held, 1 waits for its token with the worker, and 2 are queued
+	tasks := make([]*Task, 0, 5)
+	for i := 0; i < 5; i++ {
+		task, err := engine.Submit(context.Background(), 0, noop, i)
+		if err != nil {
+			t.Fatalf("It should not error, instead we got %v", err)
+		}
+		tasks = append(tasks, task)
+		time.Sleep(5 * time.Millisecond)
+	}
+	_, err := engine.Submit(context.Background(), 0, noop, 5)
+	if !errors.Is(err, common.ErrQueueIsFull) {
+		t.Fatalf("It should error, cause only 1 task is held, and the queue is full, instead we got %v", err)
+	}
+	for i, task := range tasks {
+		result, err := task.Result()
+		if err != nil || result.(int) != i {
+			t.Fatalf("Expected %d, but instead we got %v and %v", i, result, err)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package prioritize
+
+import (
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+)
+
+// WithCancelledTaskReaping makes the engine check every `interval`
+// for queued tasks whose context is already done.
+// Those are removed from the queue, freeing their slots for new submissions,
+// and their `Result()` returns `ErrCtxAlreadyCancelled` right away.
+//
+// Without this, they stay in the queue until a worker pops and skips them.
+//
+// It requires the queue to implement `common.Remover` (built-in ones do),
+// else `ErrRemoveNotSupported` is returned.
+// Each removal is O(n) on the band of the task, so don't set `interval` too low.
+func WithCancelledTaskReaping(interval time.Duration) Option {
+	return func(e *Engine) error {
+		if interval <= 0 {
+			return common.ErrParamShouldBePositive
+		}
+		if _, ok := e.queue().(common.Remover); !ok {
+			return ErrRemoveNotSupported
+		}
+		e.reapInterval = interval
+		e.reapable = &queuedTasks{}
+		return nil
+	}
+}
+
+// WithMaxQueueWait limits how long a task can wait in the queue.
+// A task not taken by any worker within `d` gets `ErrQueueTimeout` from its `Result()`,
+// and is removed from the queue right away if it implements `common.Remover`
+// (else it is skipped once a worker takes it).
+//
+// This keeps workers from running tasks the caller has long given up on.
+func WithMaxQueueWait(d time.Duration) Option {
+	return func(e *Engine) error {
+		if d <= 0 {
+			return common.ErrParamShouldBePositive
+		}
+		e.maxQueueWait = d
+		return nil
+	}
+}
+
+func (e *Engine) reapLoop() {
+	ticker := time.NewTicker(e.reapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.closeChan:
+			return
+		case <-ticker.C:
+			e.reap()
+		}
+	}
+}
+
+// reap removes queued tasks whose context is done
+func (e *Engine) reap() {
+	remover := e.queue().(common.Remover)
+	for _, task := range e.reapable.cancelled() {
+		// if it is not in the queue anymore, a worker already has it
+		// (or it is in a worker buffer), so leave it to the worker
+		if _, err := remover.Remove(task.id); err != nil {
+			continue
+		}
+		if e.untrack(task) {
+			e.complete(task, nil, ErrCtxAlreadyCancelled)
+		}
+	}
+}
+
+// expire removes `task` from the queue, after it waits longer than `WithMaxQueueWait`
+func (e *Engine) expire(task *Task) {
+	remover, ok := e.queue().(common.Remover)
+	if !ok {
+		return
+	}
+	// if it is not in the queue anymore, a worker has it, and sees it is expired
+	if _, err := remover.Remove(task.id); err != nil {
+		return
+	}
+	if e.untrack(task) {
+		e.complete(task, nil, ErrQueueTimeout)
+	}
+}
@@ -0,0 +1,128 @@
+package prioritize
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/fair"
+	"github.com/aarondwi/prioritize/priority"
+)
+
+func TestEngineWithCancelledTaskReaping(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2, 8)
+	_, err := New(pq, 1, WithCancelledTaskReaping(0))
+	if err == nil || err != common.ErrParamShouldBePositive {
+		t.Fatalf("It should error, cause interval can't be zero, instead we got %v", err)
+	}
+
+	engine, err := New(pq, 1, WithCancelledTaskReaping(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("It should not error, because all are correct parameters, instead we got %v", err)
+	}
+	defer engine.Close()
+
+	// keep the only worker busy
+	block := make(chan struct{})
+	fn := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		<-block
+		return arg, nil
+	}
+	running, _ := engine.Submit(context.Background(), 0, fn, 0)
+	for engine.Len() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled, _ := engine.Submit(ctx, 1, fn, 1)
+	kept, _ := engine.Submit(context.Background(), 2, fn, 2)
+	_, err = engine.Submit(context.Background(), 3, fn, 3)
+	if !errors.Is(err, common.ErrQueueIsFull) {
+		t.Fatalf("It should error, cause the queue is full, instead we got %v", err)
+	}
+
+	cancel()
+	_, err = cancelled.Result()
+	if err == nil || err != ErrCtxAlreadyCancelled {
+		t.Fatalf("It should be reaped while the worker is busy, instead we got %v", err)
+	}
+	if _, err = engine.Submit(context.Background(), 4, fn, 4); err != nil {
+		t.Fatalf("It should not error, cause the reaped slot is freed, instead we got %v", err)
+	}
+
+	close(block)
+	if result, err := running.Result(); err != nil || result.(int) != 0 {
+		t.Fatalf("Expected 0, but instead we got %v and %v", result, err)
+	}
+	if result, err := kept.Result(); err != nil || result.(int) != 2 {
+		t.Fatalf("Expected 2, but instead we got %v and %v", result, err)
+	}
+}
+
+func TestEngineReapWithFairQueue(t *testing.T) {
+	fq, _ := fair.NewFairQueue(2048, 8)
+	engine, _ := New(fq, 1, WithCancelledTaskReaping(time.Hour))
+	defer engine.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	block := make(chan struct{})
+	engine.Submit(context.Background(), 0, func(ctx context.Context, arg interface{}) (interface{}, error) {
+		<-block
+		return nil, nil
+	}, nil)
+	for engine.Len() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	task, _ := engine.Submit(ctx, 1, func(ctx context.Context, arg interface{}) (interface{}, error) {
+		return nil, nil
+	}, nil)
+
+	engine.reap()
+	if engine.Len() != 0 || fq.Len() != 0 {
+		t.Fatalf("It should be removed from both engine and queue, but instead we got %d and %d", engine.Len(), fq.Len())
+	}
+	if _, err := task.Result(); err != ErrCtxAlreadyCancelled {
+		t.Fatalf("It should return ErrCtxAlreadyCancelled, instead we got %v", err)
+	}
+	close(block)
+}
+
+func TestEngineWithMaxQueueWait(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	_, err := New(pq, 1, WithMaxQueueWait(0))
+	if err == nil || err != common.ErrParamShouldBePositive {
+		t.Fatalf("It should error, cause max queue wait can't be zero, instead we got %v", err)
+	}
+
+	engine, _ := New(pq, 1, WithMaxQueueWait(20*time.Millisecond))
+	defer engine.Close()
+
+	block := make(chan struct{})
+	fn := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		if arg != nil {
+			<-block
+		}
+		return "done", nil
+	}
+	running, _ := engine.Submit(context.Background(), 0, fn, true)
+	for engine.Len() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	waiting, _ := engine.Submit(context.Background(), 0, fn, nil)
+
+	_, err = waiting.Result()
+	if err == nil || err != ErrQueueTimeout {
+		t.Fatalf("It should time out while the worker is busy, instead we got %v", err)
+	}
+	if engine.Len() != 0 || pq.Len() != 0 {
+		t.Fatalf("Expired task should be removed, but instead we got %d and %d", engine.Len(), pq.Len())
+	}
+
+	close(block)
+	if result, err := running.Result(); err != nil || result.(string) != "done" {
+		t.Fatalf("Task taken in time should not be expired, but instead we got %v and %v", result, err)
+	}
+}
@@ -0,0 +1,79 @@
+package prioritize
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrInvalidSchedule is returned when the first run of a recurring task is not in the future
+var ErrInvalidSchedule = errors.New("Schedule should return a time in the future")
+
+// Schedule tells when a recurring task runs next, see `SubmitRecurring`.
+//
+// It matches the `Schedule` of most cron libraries (e.g. robfig/cron), so they can be given as is.
+type Schedule interface {
+	// Next returns the next time to run after `t`, or the zero time to stop
+	Next(t time.Time) time.Time
+}
+
+type every time.Duration
+
+func (d every) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(d))
+}
+
+// Every returns a Schedule running every `d`, starting `d` from now
+func Every(d time.Duration) Schedule {
+	return every(d)
+}
+
+// SubmitRecurring submits `fn` with `arg` each time `schedule` says so,
+// until the returned func is called, the schedule returns the zero time, or the engine is closed.
+//
+// Each run is submitted just like `SubmitAndForget`, so its result is dropped,
+// and it is skipped if the queue is full (logged, see `WithLogger`).
+// The next time is computed once a run is submitted, so runs may overlap
+// if fn runs longer than the schedule interval.
+// Calling the returned func also skips runs still queued.
+func (e *Engine) SubmitRecurring(
+	schedule Schedule,
+	priority int,
+	fn TaskFunc,
+	arg interface{}) (context.CancelFunc, error) {
+
+	select {
+	case <-e.closeChan:
+		return nil, ErrAlreadyClosed
+	default:
+	}
+	now := time.Now()
+	next := schedule.Next(now)
+	if !next.After(now) {
+		return nil, ErrInvalidSchedule
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		timer := time.NewTimer(time.Until(next))
+		defer timer.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-e.closeChan:
+				return
+			case <-timer.C:
+			}
+			if err := e.SubmitAndForget(ctx, priority, fn, arg); err != nil {
+				e.logger.Warn("recurring task not queued", "priority", priority, "err", err)
+			}
+			next = schedule.Next(time.Now())
+			if next.IsZero() {
+				return
+			}
+			timer.Reset(time.Until(next))
+		}
+	}()
+	return cancel, nil
+}
@@ -0,0 +1,73 @@
+package prioritize
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aarondwi/prioritize/priority"
+)
+
+type limitedSchedule struct {
+	d    time.Duration
+	runs int32
+}
+
+func (s *limitedSchedule) Next(t time.Time) time.Time {
+	if atomic.AddInt32(&s.runs, -1) < 0 {
+		return time.Time{}
+	}
+	return t.Add(s.d)
+}
+
+func TestEngineSubmitRecurring(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	engine, _ := New(pq, 1)
+	defer engine.Close()
+
+	_, err := engine.SubmitRecurring(Every(0), 0, nil, nil)
+	if err == nil || err != ErrInvalidSchedule {
+		t.Fatalf("It should error, cause the schedule never moves forward, instead we got %v", err)
+	}
+
+	var calls int32
+	fn := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, nil
+	}
+	cancel, err := engine.SubmitRecurring(Every(5*time.Millisecond), 0, fn, nil)
+	if err != nil {
+		t.Fatalf("It should not error, because all are correct parameters, instead we got %v", err)
+	}
+	for atomic.LoadInt32(&calls) < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+	after := atomic.LoadInt32(&calls)
+	time.Sleep(20 * time.Millisecond)
+	if atomic.LoadInt32(&calls) != after {
+		t.Fatalf("It should not run anymore after cancel, but instead it goes from %d to %d", after, calls)
+	}
+
+	var limitedCalls int32
+	_, err = engine.SubmitRecurring(&limitedSchedule{d: time.Millisecond, runs: 3}, 0,
+		func(ctx context.Context, arg interface{}) (interface{}, error) {
+			atomic.AddInt32(&limitedCalls, 1)
+			return nil, nil
+		}, nil)
+	if err != nil {
+		t.Fatalf("It should not error, because all are correct parameters, instead we got %v", err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if atomic.LoadInt32(&limitedCalls) != 3 {
+		t.Fatalf("Expected 3 runs before the schedule stops, but instead we got %d", limitedCalls)
+	}
+
+	engine.Close()
+	_, err = engine.SubmitRecurring(Every(time.Millisecond), 0, fn, nil)
+	if err == nil || err != ErrAlreadyClosed {
+		t.Fatalf("It should error, cause the engine is closed, instead we got %v", err)
+	}
+}
@@ -0,0 +1,145 @@
+package prioritize
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+)
+
+// ErrResultNotFound is returned by `Engine.LookupResult` if the task is not done yet,
+// its result is already expired or evicted, or there is no such task
+var ErrResultNotFound = errors.New("No stored result for the given task ID")
+
+// ErrResultStoreNotEnabled is returned by `Engine.LookupResult`
+// on an engine not created with `WithResultStore`
+var ErrResultStoreNotEnabled = errors.New("This engine does not store results")
+
+// WithResultStore makes the engine keep results of completed tasks for `ttl`,
+// up to `capacity` of them (the oldest are evicted first),
+// so they can be fetched by task ID with `Engine.LookupResult`.
+//
+// This lets clients (e.g. over http) submit, disconnect,
+// and come back later for the result, instead of holding the `Task` open.
+func WithResultStore(ttl time.Duration, capacity int) Option {
+	return func(e *Engine) error {
+		if ttl <= 0 || capacity <= 0 {
+			return common.ErrParamShouldBePositive
+		}
+		e.results = newResultStore(ttl, capacity)
+		return nil
+	}
+}
+
+// LookupResult returns the stored result and error of the task with `id`, see `WithResultStore`.
+//
+// Errors returned by the task itself (or the engine, e.g. `ErrCtxAlreadyCancelled`) are returned as is.
+// If there is nothing stored, it returns `ErrResultNotFound`.
+func (e *Engine) LookupResult(id uint64) (interface{}, error) {
+	if e.results == nil {
+		return nil, ErrResultStoreNotEnabled
+	}
+	return e.results.get(id, time.Now())
+}
+
+// complete sets the result of `task`, storing it if `WithResultStore` is used.
+// It returns false if `task` is already completed, e.g. cancelled, see `Engine.Cancel`.
+func (e *Engine) complete(task *Task, result interface{}, err error) bool {
+	if !task.markCompleted() {
+		return false
+	}
+	priority := 0
+	if e.sink != nil {
+		// only read under the engine lock, so skip it if nobody needs it
+		priority = task.Priority()
+	}
+	e.onCompleted(priority, task.ran, err)
+	if task.span != nil {
+		task.span.End(err)
+	}
+	e.logCompletion(task, err)
+	if e.results != nil {
+		e.results.put(task.id, result, err, time.Now())
+	}
+	task.set(result, err)
+	if task.onComplete != nil {
+		if err != nil {
+			result = nil
+		}
+		task.onComplete(result, err)
+	}
+	if task.recycle {
+		putTask(task)
+	}
+	return true
+}
+
+// resultStore keeps results in completion order,
+// which is also expiry order, as all have the same ttl.
+type resultStore struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	capacity int
+	entries  map[uint64]*list.Element
+	order    *list.List
+}
+
+type storedResult struct {
+	id        uint64
+	result    interface{}
+	err       error
+	expiredAt time.Time
+}
+
+func newResultStore(ttl time.Duration, capacity int) *resultStore {
+	return &resultStore{
+		ttl:      ttl,
+		capacity: capacity,
+		entries:  make(map[uint64]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (rs *resultStore) put(id uint64, result interface{}, err error, now time.Time) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.expireLocked(now)
+	if rs.order.Len() == rs.capacity {
+		rs.removeLocked(rs.order.Front())
+	}
+	rs.entries[id] = rs.order.PushBack(&storedResult{
+		id:        id,
+		result:    result,
+		err:       err,
+		expiredAt: now.Add(rs.ttl),
+	})
+}
+
+func (rs *resultStore) get(id uint64, now time.Time) (interface{}, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.expireLocked(now)
+	el, ok := rs.entries[id]
+	if !ok {
+		return nil, ErrResultNotFound
+	}
+	sr := el.Value.(*storedResult)
+	return sr.result, sr.err
+}
+
+// expireLocked drops all results expired at `now`
+func (rs *resultStore) expireLocked(now time.Time) {
+	for el := rs.order.Front(); el != nil; el = rs.order.Front() {
+		if now.Before(el.Value.(*storedResult).expiredAt) {
+			return
+		}
+		rs.removeLocked(el)
+	}
+}
+
+func (rs *resultStore) removeLocked(el *list.Element) {
+	delete(rs.entries, el.Value.(*storedResult).id)
+	rs.order.Remove(el)
+}
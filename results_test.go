@@ -0,0 +1,77 @@
+package prioritize
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/priority"
+)
+
+func TestEngineWithResultStore(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	_, err := New(pq, 1, WithResultStore(time.Minute, 0))
+	if err == nil || err != common.ErrParamShouldBePositive {
+		t.Fatalf("It should error, cause capacity can't be zero, instead we got %v", err)
+	}
+
+	engine, _ := New(pq, 1)
+	_, err = engine.LookupResult(1)
+	if err == nil || err != ErrResultStoreNotEnabled {
+		t.Fatalf("It should error, cause result store is not enabled, instead we got %v", err)
+	}
+	engine.Close()
+
+	pq, _ = priority.NewPriorityQueue(2048, 8)
+	engine, _ = New(pq, 1, WithResultStore(time.Minute, 2))
+	defer engine.Close()
+
+	errTask := errors.New("task error")
+	fn := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		if arg == nil {
+			return nil, errTask
+		}
+		return arg, nil
+	}
+	ids := []uint64{}
+	for _, arg := range []interface{}{1, nil, 3} {
+		task, _ := engine.Submit(context.Background(), 0, fn, arg)
+		task.Result()
+		ids = append(ids, task.ID())
+	}
+
+	_, err = engine.LookupResult(ids[0])
+	if err == nil || err != ErrResultNotFound {
+		t.Fatalf("The oldest should be evicted, cause capacity is 2, instead we got %v", err)
+	}
+	_, err = engine.LookupResult(ids[1])
+	if err == nil || err != errTask {
+		t.Fatalf("It should return the error of the task, instead we got %v", err)
+	}
+	result, err := engine.LookupResult(ids[2])
+	if err != nil || result.(int) != 3 {
+		t.Fatalf("Expected 3, but instead we got %v and %v", result, err)
+	}
+}
+
+func TestResultStoreTTL(t *testing.T) {
+	rs := newResultStore(time.Second, 10)
+	now := time.Now()
+	rs.put(1, "a", nil, now)
+	rs.put(2, "b", nil, now.Add(500*time.Millisecond))
+
+	if result, err := rs.get(1, now.Add(900*time.Millisecond)); err != nil || result.(string) != "a" {
+		t.Fatalf("It should not be expired yet, but instead we got %v and %v", result, err)
+	}
+	if _, err := rs.get(1, now.Add(time.Second)); err != ErrResultNotFound {
+		t.Fatalf("It should be expired, but instead we got %v", err)
+	}
+	if result, err := rs.get(2, now.Add(time.Second)); err != nil || result.(string) != "b" {
+		t.Fatalf("It should not be expired yet, but instead we got %v and %v", result, err)
+	}
+	if len(rs.entries) != 1 || rs.order.Len() != 1 {
+		t.Fatalf("Expired results should be dropped, but %d are left", rs.order.Len())
+	}
+}
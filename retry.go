@@ -0,0 +1,88 @@
+package prioritize
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+)
+
+// WithRetry makes the engine run a task again, up to `maxRetries` times, when it returns an error.
+// Before each retry, the task waits outside the queue for an exponential backoff,
+// starting from `baseDelay` and doubling up to `maxDelay`, with jitter,
+// so tasks failing at the same time are not retried at the same time.
+// Only the error of the last attempt is returned by `Task.Result()`.
+//
+// Tasks whose ctx is done, or returning `ErrYield`, are not retried.
+// If the retry can't be queued (e.g. the queue is full, or the engine is closed),
+// the last error is returned right away.
+func WithRetry(maxRetries int, baseDelay, maxDelay time.Duration) Option {
+	return func(e *Engine) error {
+		if maxRetries <= 0 || baseDelay <= 0 || maxDelay < baseDelay {
+			return common.ErrParamShouldBePositive
+		}
+		e.maxRetries = maxRetries
+		e.retryBaseDelay = baseDelay
+		e.retryMaxDelay = maxDelay
+		return nil
+	}
+}
+
+// retry queues `task` again after a backoff, see `WithRetry`.
+// It returns false if the task should not be retried, so `err` is its result.
+func (e *Engine) retry(item common.QItem, task *Task, err error) bool {
+	if task.attempts >= e.maxRetries || task.ctx.Err() != nil ||
+		atomic.LoadInt32(&task.completed) == 1 {
+		// e.g. cancelled while running, so nothing is waiting for it anymore
+		return false
+	}
+	task.attempts++
+	task.requeued()
+	e.logger.Info("task retried", "id", task.id, "attempt", task.attempts, "err", err)
+	// still counted as queued during the backoff, so `Flush` and `Pressure` don't miss it
+	atomic.AddInt64(&e.queued, 1)
+	time.AfterFunc(e.backoff(task.attempts), func() {
+		if e.repush(item, task) != nil {
+			e.fail(task, nil, err)
+		}
+		// counted by `repush` itself from now on, if pushed
+		atomic.AddInt64(&e.queued, -1)
+		e.settled()
+	})
+	return true
+}
+
+// repush queues `task`, after it is kept out of the queue for a while,
+// e.g. during a retry backoff. That while is not counted as queue wait.
+func (e *Engine) repush(item common.QItem, task *Task) error {
+	if !task.enqueuedAt.IsZero() {
+		task.enqueuedAt = time.Now()
+	}
+	if e.maxQueueWait > 0 {
+		task.expiry = time.AfterFunc(e.maxQueueWait, func() { e.expire(task) })
+	}
+	e.track(task)
+	if err := e.pushTask(task, item); err != nil {
+		e.untrack(task)
+		if task.expiry != nil {
+			task.expiry.Stop()
+		}
+		return err
+	}
+	e.onEnqueued(item.Priority)
+	return nil
+}
+
+// backoff returns how long to wait before the `attempt`-th retry,
+// picked randomly between half and all of the exponential delay.
+func (e *Engine) backoff(attempt int) time.Duration {
+	d := e.retryBaseDelay
+	for i := 1; i < attempt && d < e.retryMaxDelay; i++ {
+		d *= 2
+	}
+	if d > e.retryMaxDelay {
+		d = e.retryMaxDelay
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
@@ -0,0 +1,117 @@
+package prioritize
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/priority"
+)
+
+func TestEngineWithRetry(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	_, err := New(pq, 1, WithRetry(3, 10*time.Millisecond, time.Millisecond))
+	if !errors.Is(err, common.ErrParamShouldBePositive) {
+		t.Fatalf("It should error, cause max delay is below base delay, instead we got %v", err)
+	}
+
+	engine, err := New(pq, 1, WithRetry(2, time.Millisecond, 4*time.Millisecond))
+	if err != nil {
+		t.Fatalf("It should not error, because all are correct parameters, instead we got %v", err)
+	}
+	defer engine.Close()
+
+	errFlaky := errors.New("flaky")
+	var calls int32
+	flaky := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			return nil, errFlaky
+		}
+		return arg, nil
+	}
+	task, _ := engine.Submit(context.Background(), 0, flaky, 1)
+	result, err := task.Result()
+	if err != nil || result.(int) != 1 || atomic.LoadInt32(&calls) != 3 {
+		t.Fatalf("It should succeed on the last retry, but instead we got %v and %v after %d calls",
+			result, err, atomic.LoadInt32(&calls))
+	}
+
+	var failures int32
+	errAlways := errors.New("always")
+	failing := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		return nil, fmt.Errorf("attempt %d", atomic.AddInt32(&failures, 1))
+	}
+	task, _ = engine.Submit(context.Background(), 0, failing, 2)
+	_, err = task.Result()
+	if err == nil || err.Error() != "attempt 3" {
+		t.Fatalf("It should return the error of the last attempt, but instead we got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	task, _ = engine.Submit(ctx, 0, func(ctx context.Context, arg interface{}) (interface{}, error) {
+		cancel()
+		return nil, errAlways
+	}, 3)
+	_, err = task.Result()
+	if err == nil || err != errAlways {
+		t.Fatalf("It should not retry, cause ctx is done, but instead we got %v", err)
+	}
+}
+
+func TestEngineBackoff(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	engine, _ := New(pq, 1, WithRetry(10, 10*time.Millisecond, 50*time.Millisecond))
+	defer engine.Close()
+
+	for attempt, max := range map[int]time.Duration{
+		1: 10 * time.Millisecond,
+		2: 20 * time.Millisecond,
+		3: 40 * time.Millisecond,
+		9: 50 * time.Millisecond,
+	} {
+		for i := 0; i < 10; i++ {
+			d := engine.backoff(attempt)
+			if d < max/2 || d > max {
+				t.Fatalf("Expected backoff of attempt %d between %v and %v, but instead we got %v",
+					attempt, max/2, max, d)
+			}
+		}
+	}
+}
+
+func TestEngineFlushWaitsForRetry(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	engine, err := New(pq, 1, WithRetry(1, 50*time.Millisecond, 50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("It should not error, because all are correct parameters, instead we got %v", err)
+	}
+	defer engine.Close()
+
+	errFlaky := errors.New("flaky")
+	var calls int32
+	task, _ := engine.Submit(context.Background(), 0, func(ctx context.Context, arg interface{}) (interface{}, error) {
+		if atomic.AddInt32(&calls, 1) < 2 {
+			return nil, errFlaky
+		}
+		return arg, nil
+	}, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err = engine.Flush(ctx); err != nil {
+		t.Fatalf("It should flush, but instead we got %v", err)
+	}
+	select {
+	case <-task.Done():
+	default:
+		t.Fatalf("It should wait for the retry, but instead the task is still not done after %d calls",
+			atomic.LoadInt32(&calls))
+	}
+	if result, err := task.Result(); err != nil || result.(int) != 1 {
+		t.Fatalf("It should succeed on the retry, but instead we got %v and %v", result, err)
+	}
+}
@@ -0,0 +1,164 @@
+package prioritize
+
+import (
+	"context"
+	"errors"
+	"sort"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/selector"
+)
+
+// ErrUnknownQueue is returned when the router of an engine created with `NewWithRouting`
+// returns a name not given to it
+var ErrUnknownQueue = errors.New("The router returned an unknown queue name")
+
+// NewWithRouting creates a prioritization engine over several named `queues`,
+// e.g. a strict priority lane and a fair lane, whose workers are shared between all of them.
+// Each submission goes to the queue whose name is returned by `router`,
+// given the priority and arg it is submitted with. Unknown names are rejected with `ErrUnknownQueue`.
+//
+// Workers take the first item available from any of the queues, using `selector.Selector`,
+// so all queues should implement `common.CtxPopper` (as all built-in queues do),
+// else `selector.ErrCtxPopNotSupported` is returned.
+// Note the selector pops 1 item ahead from each queue, so that 1 may be passed by a later, higher one.
+//
+// The queues are owned by the engine from now on, and closed together with it.
+func NewWithRouting(
+	queues map[string]common.QInterface,
+	router func(priority int, arg interface{}) string,
+	numOfWorker int,
+	opts ...Option) (*Engine, error) {
+
+	if numOfWorker <= 0 {
+		return nil, ErrNumOfWorkerIsNegativeOrZero
+	}
+	rq, err := newRoutedQueue(queues, router)
+	if err != nil {
+		return nil, err
+	}
+	e, err := newEngine(rq, numOfWorker, opts)
+	if err != nil {
+		rq.Close()
+		return nil, err
+	}
+	return e, nil
+}
+
+// routedQueue is the queue used by an engine created with `NewWithRouting`.
+// Pushes go to the queue chosen by the router, and pops come from any of them.
+type routedQueue struct {
+	names  []string
+	queues map[string]common.QInterface
+	router func(priority int, arg interface{}) string
+	sel    *selector.Selector
+}
+
+func newRoutedQueue(
+	queues map[string]common.QInterface,
+	router func(priority int, arg interface{}) string) (*routedQueue, error) {
+
+	if len(queues) == 0 || router == nil {
+		return nil, common.ErrParamShouldBePositive
+	}
+	// sorted, so the selector is always given the same order
+	names := make([]string, 0, len(queues))
+	for name := range queues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	qs := make([]common.QInterface, len(names))
+	for i, name := range names {
+		qs[i] = queues[name]
+	}
+	sel, err := selector.New(qs...)
+	if err != nil {
+		return nil, err
+	}
+	return &routedQueue{names: names, queues: queues, router: router, sel: sel}, nil
+}
+
+// route returns the queue `item` should go to, asking the router with the arg of its task
+func (rq *routedQueue) route(item common.QItem) (common.QInterface, error) {
+	var arg interface{}
+	switch payload := item.Payload.(type) {
+	case *Task:
+		arg = payload.arg
+	case *forgottenTask:
+		arg = payload.arg
+	}
+	q, ok := rq.queues[rq.router(item.Priority, arg)]
+	if !ok {
+		return nil, ErrUnknownQueue
+	}
+	return q, nil
+}
+
+func (rq *routedQueue) PushOrError(item common.QItem) error {
+	q, err := rq.route(item)
+	if err != nil {
+		return err
+	}
+	return q.PushOrError(item)
+}
+
+// PushOrWaitCtx waits while the chosen queue is full, if it implements `common.CtxPusher`,
+// else it is the same as PushOrError
+func (rq *routedQueue) PushOrWaitCtx(ctx context.Context, item common.QItem) error {
+	q, err := rq.route(item)
+	if err != nil {
+		return err
+	}
+	if pusher, ok := q.(common.CtxPusher); ok {
+		return pusher.PushOrWaitCtx(ctx, item)
+	}
+	return q.PushOrError(item)
+}
+
+func (rq *routedQueue) PopOrWaitTillClose() (common.QItem, error) {
+	return rq.PopOrWaitCtx(context.Background())
+}
+
+func (rq *routedQueue) PopOrWaitCtx(ctx context.Context) (common.QItem, error) {
+	item, _, err := rq.sel.PopAnyCtx(ctx)
+	return item, err
+}
+
+// Remove takes out the item with `id` from whichever queue has it.
+// Queues not implementing `common.Remover` (or wrapping one which doesn't) are skipped,
+// and so is the item popped ahead by the selector.
+func (rq *routedQueue) Remove(id uint64) (common.QItem, error) {
+	for _, name := range rq.names {
+		remover, ok := rq.queues[name].(common.Remover)
+		if !ok {
+			continue
+		}
+		item, err := remover.Remove(id)
+		if err == common.ErrItemNotFound || err == common.ErrNotSupported {
+			continue
+		}
+		return item, err
+	}
+	return common.MinQItem, common.ErrItemNotFound
+}
+
+// Close closes all queues right away, dropping their items,
+// together with those popped ahead by the selector
+func (rq *routedQueue) Close() error {
+	rq.sel.Close()
+	var err error
+	for _, name := range rq.names {
+		if closeErr := rq.queues[name].Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// CloseGracefully stops accepting new items,
+// but keeps returning the remaining ones of all queues
+func (rq *routedQueue) CloseGracefully() {
+	for _, name := range rq.names {
+		rq.queues[name].CloseGracefully()
+	}
+}
@@ -0,0 +1,154 @@
+package prioritize
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/fair"
+	"github.com/aarondwi/prioritize/priority"
+)
+
+func TestEngineWithRoutingParameter(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 4)
+	queues := map[string]common.QInterface{"strict": pq}
+	router := func(priority int, arg interface{}) string { return "strict" }
+
+	_, err := NewWithRouting(queues, router, 0)
+	if err == nil || err != ErrNumOfWorkerIsNegativeOrZero {
+		t.Fatalf("It should error, cause number of worker is zero, instead we got %v", err)
+	}
+	_, err = NewWithRouting(nil, router, 1)
+	if err == nil || err != common.ErrParamShouldBePositive {
+		t.Fatalf("It should error, cause there is no queue, instead we got %v", err)
+	}
+	_, err = NewWithRouting(queues, nil, 1)
+	if err == nil || err != common.ErrParamShouldBePositive {
+		t.Fatalf("It should error, cause there is no router, instead we got %v", err)
+	}
+}
+
+func TestEngineWithRouting(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 4)
+	fq, _ := fair.NewFairQueue(2048, 4)
+	var strict, fairly int32
+	router := func(priority int, arg interface{}) string {
+		// tasks of tenants go to the fair lane
+		if _, ok := arg.(string); ok {
+			atomic.AddInt32(&fairly, 1)
+			return "fair"
+		}
+		if arg == nil {
+			return "unknown"
+		}
+		atomic.AddInt32(&strict, 1)
+		return "strict"
+	}
+	engine, err := NewWithRouting(
+		map[string]common.QInterface{"strict": pq, "fair": fq}, router, 2)
+	if err != nil {
+		t.Fatalf("It should not error, because all are correct parameters, instead we got %v", err)
+	}
+
+	fn := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		return arg, nil
+	}
+	tasks := make([]*Task, 0, 20)
+	for i := 0; i < 10; i++ {
+		task, err := engine.Submit(context.Background(), i%4, fn, i)
+		if err != nil {
+			t.Fatalf("It should be accepted, but instead we got %v", err)
+		}
+		tasks = append(tasks, task)
+		task, err = engine.Submit(context.Background(), i%4, fn, "tenant")
+		if err != nil {
+			t.Fatalf("It should be accepted, but instead we got %v", err)
+		}
+		tasks = append(tasks, task)
+	}
+	for i, task := range tasks {
+		result, err := task.Result()
+		if err != nil || (i%2 == 0 && result.(int) != i/2) || (i%2 == 1 && result.(string) != "tenant") {
+			t.Fatalf("Expected the task to run with its arg, but instead we got %v and %v", result, err)
+		}
+	}
+	if atomic.LoadInt32(&strict) != 10 || atomic.LoadInt32(&fairly) != 10 {
+		t.Fatalf("Expected 10 tasks in each queue, but instead we got %d and %d", strict, fairly)
+	}
+
+	if _, err := engine.Submit(context.Background(), 0, fn, nil); err == nil || err != ErrUnknownQueue {
+		t.Fatalf("It should return ErrUnknownQueue, but instead we got %v", err)
+	}
+	if engine.Len() != 0 {
+		t.Fatalf("It should not count the rejected task, but instead we got %d", engine.Len())
+	}
+
+	// the remaining ones are still run from both queues
+	gate := make(chan bool)
+	for i := 0; i < 2; i++ {
+		engine.Submit(context.Background(), 0, func(ctx context.Context, arg interface{}) (interface{}, error) {
+			<-gate
+			return nil, nil
+		}, 1)
+	}
+	for engine.Len() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	var ran int32
+	for i := 0; i < 4; i++ {
+		engine.SubmitAndForget(context.Background(), 0, func(ctx context.Context, arg interface{}) (interface{}, error) {
+			atomic.AddInt32(&ran, 1)
+			return nil, nil
+		}, "tenant")
+		engine.SubmitAndForget(context.Background(), 0, func(ctx context.Context, arg interface{}) (interface{}, error) {
+			atomic.AddInt32(&ran, 1)
+			return nil, nil
+		}, 1)
+	}
+	close(gate)
+	engine.CloseGracefully()
+	if atomic.LoadInt32(&ran) != 8 {
+		t.Fatalf("It should run all queued tasks before closing, but instead we got %d", ran)
+	}
+}
+
+func TestEngineWithRoutingCloseNow(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 4)
+	fq, _ := fair.NewFairQueue(2048, 4)
+	router := func(priority int, arg interface{}) string { return arg.(string) }
+	engine, _ := NewWithRouting(
+		map[string]common.QInterface{"strict": pq, "fair": fq}, router, 1)
+
+	gate := make(chan bool)
+	engine.Submit(context.Background(), 0, func(ctx context.Context, arg interface{}) (interface{}, error) {
+		<-gate
+		return nil, nil
+	}, "strict")
+	for engine.Len() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	fn := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		return nil, nil
+	}
+	tasks := make([]*Task, 0, 10)
+	for i := 0; i < 5; i++ {
+		for _, name := range []string{"strict", "fair"} {
+			task, _ := engine.Submit(context.Background(), 0, fn, name)
+			tasks = append(tasks, task)
+		}
+	}
+
+	go func() {
+		// let CloseNow drop the queued ones first
+		time.Sleep(10 * time.Millisecond)
+		close(gate)
+	}()
+	engine.CloseNow()
+	for _, task := range tasks {
+		if _, err := task.Result(); err == nil || err != ErrAlreadyClosed {
+			t.Fatalf("It should drop the queued tasks of all queues, but instead we got %v", err)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package selector
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/aarondwi/prioritize/common"
+)
+
+// ErrCtxPopNotSupported is returned by `New`
+// if any of the queues does not implement `common.CtxPopper`
+var ErrCtxPopNotSupported = errors.New("The queue does not support cancellable pops")
+
+// Selector pops from several queues at once, like `select` does for channels,
+// so 1 pool of workers can serve all of them, e.g. 1 queue per class of tenant.
+//
+// It starts 1 goroutine per queue, each popping 1 item ahead and waiting to hand it over.
+// So up to 1 item per queue is already taken out of it, but not yet returned by PopAny.
+// `Close` returns those, so they are not lost.
+//
+// This struct is thread(goroutine)-safe, if the queues are.
+type Selector struct {
+	popped chan popped
+	// closed once all queues are closed, and all their items handed over
+	allClosed chan struct{}
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu   sync.Mutex
+	held []common.QItem
+}
+
+type popped struct {
+	item common.QItem
+	from int
+}
+
+// New creates Selector over `qs`, which should all implement `common.CtxPopper`
+// (as all built-in queues do), so `Close` can stop the goroutines waiting on them.
+func New(qs ...common.QInterface) (*Selector, error) {
+	if len(qs) == 0 {
+		return nil, common.ErrParamShouldBePositive
+	}
+	poppers := make([]common.CtxPopper, len(qs))
+	for i, q := range qs {
+		popper, ok := q.(common.CtxPopper)
+		if !ok {
+			return nil, ErrCtxPopNotSupported
+		}
+		poppers[i] = popper
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Selector{
+		popped:    make(chan popped),
+		allClosed: make(chan struct{}),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+	s.wg.Add(len(poppers))
+	for i, popper := range poppers {
+		go s.popLoop(i, popper)
+	}
+	go func() {
+		s.wg.Wait()
+		close(s.allClosed)
+	}()
+	return s, nil
+}
+
+func (s *Selector) popLoop(from int, popper common.CtxPopper) {
+	defer s.wg.Done()
+	for {
+		item, err := popper.PopOrWaitCtx(s.ctx)
+		if err != nil {
+			// either the queue or the selector is closed
+			return
+		}
+		select {
+		case s.popped <- popped{item: item, from: from}:
+		case <-s.ctx.Done():
+			s.mu.Lock()
+			s.held = append(s.held, item)
+			s.mu.Unlock()
+			return
+		}
+	}
+}
+
+// PopAny returns the first item available from any of the queues,
+// and the index of the queue (in the order given to `New`) it comes from.
+//
+// It returns `common.ErrQueueIsClosed` once all queues are closed, or the Selector is closed.
+func (s *Selector) PopAny() (common.QItem, int, error) {
+	return s.PopAnyCtx(context.Background())
+}
+
+// PopAnyCtx is the same as PopAny,
+// but also returns `ctx.Err()` once `ctx` is done while waiting
+func (s *Selector) PopAnyCtx(ctx context.Context) (common.QItem, int, error) {
+	select {
+	case p := <-s.popped:
+		return p.item, p.from, nil
+	case <-s.allClosed:
+		return common.MinQItem, -1, common.ErrQueueIsClosed
+	case <-s.ctx.Done():
+		return common.MinQItem, -1, common.ErrQueueIsClosed
+	case <-ctx.Done():
+		return common.MinQItem, -1, ctx.Err()
+	}
+}
+
+// Close stops the Selector, without closing the queues.
+//
+// It returns the items already taken out of the queues, but not returned by PopAny,
+// so the caller can push them back, or handle them some other way.
+// Closing it again returns nil.
+func (s *Selector) Close() []common.QItem {
+	s.cancel()
+	s.wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	held := s.held
+	s.held = nil
+	return held
+}
@@ -0,0 +1,80 @@
+package selector
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/priority"
+)
+
+// plainQueue hides all optional interfaces of the queue it wraps
+type plainQueue struct {
+	common.QInterface
+}
+
+func TestNewErrors(t *testing.T) {
+	_, err := New()
+	if err == nil || err != common.ErrParamShouldBePositive {
+		t.Fatalf("It should error, cause no queue is given, but instead we got %v", err)
+	}
+
+	pq, _ := priority.NewPriorityQueue(16, 4)
+	_, err = New(pq, plainQueue{pq})
+	if err == nil || err != ErrCtxPopNotSupported {
+		t.Fatalf("It should error, cause a queue does not support cancellable pops, but instead we got %v", err)
+	}
+}
+
+func TestSelectorPopAny(t *testing.T) {
+	pq1, _ := priority.NewPriorityQueue(16, 4)
+	pq2, _ := priority.NewPriorityQueue(16, 4)
+	s, _ := New(pq1, pq2)
+
+	pq2.PushOrError(common.QItem{ID: 1, Priority: 2})
+	item, from, err := s.PopAny()
+	if err != nil || item.ID != 1 || from != 1 {
+		t.Fatalf("Expected ID 1 from queue 1, but instead we got %v from %d, and %v", item, from, err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		pq1.PushOrError(common.QItem{ID: 2, Priority: 2})
+	}()
+	item, from, err = s.PopAny()
+	if err != nil || item.ID != 2 || from != 0 {
+		t.Fatalf("Expected ID 2 from queue 0, but instead we got %v from %d, and %v", item, from, err)
+	}
+
+	pq1.Close()
+	pq2.Close()
+	_, _, err = s.PopAny()
+	if err == nil || err != common.ErrQueueIsClosed {
+		t.Fatalf("It should return ErrQueueIsClosed, cause all queues are closed, but instead we got %v", err)
+	}
+	s.Close()
+}
+
+func TestSelectorCloseReturnsHeldItems(t *testing.T) {
+	pq1, _ := priority.NewPriorityQueue(16, 4)
+	pq2, _ := priority.NewPriorityQueue(16, 4)
+	for i := 0; i < 3; i++ {
+		pq1.PushOrError(common.QItem{ID: uint64(i), Priority: 1})
+		pq2.PushOrError(common.QItem{ID: uint64(10 + i), Priority: 1})
+	}
+	s, _ := New(pq1, pq2)
+	time.Sleep(50 * time.Millisecond)
+
+	held := s.Close()
+	if len(held)+pq1.Len()+pq2.Len() != 6 {
+		t.Fatalf("No item should be lost, but instead %d are held, and %d and %d are queued",
+			len(held), pq1.Len(), pq2.Len())
+	}
+	_, _, err := s.PopAny()
+	if err == nil || err != common.ErrQueueIsClosed {
+		t.Fatalf("It should return ErrQueueIsClosed, cause closed, but instead we got %v", err)
+	}
+	if held := s.Close(); held != nil {
+		t.Fatalf("Closing again should return nil, but instead we got %v", held)
+	}
+}
@@ -0,0 +1,380 @@
+package sfq
+
+import (
+	"context"
+	"sync"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/linkedslice"
+)
+
+// FlowFunc returns the flow identifier of an item, e.g. the tenant or producer it comes from
+type FlowFunc func(item common.QItem) uint64
+
+// SFQueue is a stochastic fair queue.
+//
+// The highest priority having items always goes first, just like `priority.PriorityQueue`.
+// But inside a priority, items are hashed by their flow into a fixed number of buckets,
+// and pops take 1 item from each non-empty bucket in turn.
+// So one chatty producer can't monopolize a priority, even when all its items share it.
+//
+// Different flows may hash into the same bucket, sharing its turn.
+// More buckets make that less likely, at the cost of more memory.
+// Inside a bucket, it is FIFO.
+type SFQueue struct {
+	// synchronization primitive
+	// read-only calls (e.g. Len) only take the read lock,
+	// so they don't contend with each other
+	mu       *sync.RWMutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	// broadcast once the size reaches 0, see `WaitUntilEmpty`
+	emptied *sync.Cond
+
+	// numberOfTasksInEachQueue[p] is the number of items of priority p,
+	// and numberOfTasksInEachBucket[p][b] of bucket b inside it
+	numberOfTasksInEachQueue  []int
+	numberOfTasksInEachBucket [][]int
+	// created on first use, as most priority-bucket pairs may never be used
+	buckets [][]*linkedslice.LinkedSlice
+	// the bucket having its turn for each priority
+	currentBucket []int
+
+	// seed is mixed into each flow identifier before hashing.
+	// Unlike classic SFQ, it is never perturbed, so a flow always stays in its bucket,
+	// keeping FIFO inside the flow.
+	flow FlowFunc
+	seed uint64
+
+	// simple metadata
+	limitPriority int
+	numOfBuckets  int
+	size          int
+	sizeLimit     int
+	running       bool
+	closed        chan struct{}
+	draining      bool
+}
+
+// NewSFQueue creates our stochastic fair queue, which caps at sizeLimit,
+// allows priority [0,numOfPriority), and has numOfBuckets buckets per priority.
+// `flow` should not be nil.
+func NewSFQueue(sizeLimit, numOfPriority, numOfBuckets int, flow FlowFunc) (*SFQueue, error) {
+	if sizeLimit <= 0 || numOfPriority <= 0 || numOfBuckets <= 0 || flow == nil {
+		return nil, common.ErrParamShouldBePositive
+	}
+
+	mu := &sync.RWMutex{}
+	sq := &SFQueue{
+		mu:                        mu,
+		notEmpty:                  sync.NewCond(mu),
+		notFull:                   sync.NewCond(mu),
+		emptied:                   sync.NewCond(mu),
+		numberOfTasksInEachQueue:  make([]int, numOfPriority),
+		numberOfTasksInEachBucket: make([][]int, numOfPriority),
+		buckets:                   make([][]*linkedslice.LinkedSlice, numOfPriority),
+		currentBucket:             make([]int, numOfPriority),
+		flow:                      flow,
+		seed:                      uint64(numOfBuckets)*0x9e3779b97f4a7c15 + uint64(numOfPriority),
+		limitPriority:             numOfPriority,
+		numOfBuckets:              numOfBuckets,
+		sizeLimit:                 sizeLimit,
+		running:                   true,
+		closed:                    make(chan struct{}),
+	}
+	for p := range sq.buckets {
+		sq.numberOfTasksInEachBucket[p] = make([]int, numOfBuckets)
+		sq.buckets[p] = make([]*linkedslice.LinkedSlice, numOfBuckets)
+	}
+	return sq, nil
+}
+
+// bucketOf mixes the flow identifier (splitmix64 finalizer),
+// so sequential identifiers don't end up in neighbouring buckets in the same order
+func (sq *SFQueue) bucketOf(item common.QItem) int {
+	z := sq.flow(item) + sq.seed
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	z = z ^ (z >> 31)
+	return int(z % uint64(sq.numOfBuckets))
+}
+
+// PushOrError put the item into the queue, and returns error if no slot available
+func (sq *SFQueue) PushOrError(item common.QItem) error {
+	b := sq.bucketOf(item)
+
+	sq.mu.Lock()
+	defer sq.mu.Unlock()
+	if item.Priority < 0 || item.Priority >= sq.limitPriority {
+		return sq.queueErrorLocked("PushOrError", item, common.ErrPriorityOutOfRange)
+	}
+	if err := sq.pushLocked(item, b); err != nil {
+		return sq.queueErrorLocked("PushOrError", item, err)
+	}
+	return nil
+}
+
+// PushOrWaitCtx is the same as PushOrError, but waits for a slot while the queue is full,
+// and returns `ctx.Err()` once `ctx` is done while waiting
+func (sq *SFQueue) PushOrWaitCtx(ctx context.Context, item common.QItem) error {
+	b := sq.bucketOf(item)
+
+	sq.mu.Lock()
+	defer sq.mu.Unlock()
+	if item.Priority < 0 || item.Priority >= sq.limitPriority {
+		return sq.queueErrorLocked("PushOrWaitCtx", item, common.ErrPriorityOutOfRange)
+	}
+	err := sq.pushLocked(item, b)
+	if err == common.ErrQueueIsFull {
+		defer common.WakeOnDone(ctx, sq.notFull)()
+	}
+	for err == common.ErrQueueIsFull {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		sq.notFull.Wait()
+		err = sq.pushLocked(item, b)
+	}
+	if err != nil {
+		return sq.queueErrorLocked("PushOrWaitCtx", item, err)
+	}
+	return nil
+}
+
+// queueErrorLocked adds what sq looks like right now to `err`, see `common.QueueError`
+func (sq *SFQueue) queueErrorLocked(op string, item common.QItem, err error) error {
+	return &common.QueueError{Op: op, Priority: item.Priority, Size: sq.size, Limit: sq.sizeLimit, Err: err}
+}
+
+func (sq *SFQueue) pushLocked(item common.QItem, b int) error {
+	if !sq.running || sq.draining {
+		return common.ErrQueueIsClosed
+	}
+	if sq.size == sq.sizeLimit {
+		return common.ErrQueueIsFull
+	}
+
+	p := item.Priority
+	if sq.buckets[p][b] == nil {
+		sq.buckets[p][b] = linkedslice.NewLinkedSlice()
+	}
+	err := sq.buckets[p][b].PushOrError(item)
+	// meaning already closed, cause linkedslices is unbounded
+	if err != nil {
+		return err
+	}
+	sq.numberOfTasksInEachBucket[p][b]++
+	sq.numberOfTasksInEachQueue[p]++
+	sq.size++
+	sq.notEmpty.Signal()
+	return nil
+}
+
+// PopOrWaitTillClose returns 1 QItem from the bucket having its turn in the highest priority,
+// or waits if none exists
+func (sq *SFQueue) PopOrWaitTillClose() (common.QItem, error) {
+	return sq.PopOrWaitCtx(context.Background())
+}
+
+// PopOrWaitCtx is the same as PopOrWaitTillClose,
+// but also returns `ctx.Err()` once `ctx` is done while waiting
+func (sq *SFQueue) PopOrWaitCtx(ctx context.Context) (common.QItem, error) {
+	sq.mu.Lock()
+	defer sq.mu.Unlock()
+	if !sq.running {
+		return common.MinQItem, common.ErrQueueIsClosed
+	}
+	if sq.size == 0 {
+		defer common.WakeOnDone(ctx, sq.notEmpty)()
+	}
+	for sq.size == 0 {
+		if sq.draining {
+			sq.closeLocked()
+			return common.MinQItem, common.ErrQueueIsClosed
+		}
+		if err := ctx.Err(); err != nil {
+			return common.MinQItem, err
+		}
+		sq.notEmpty.Wait()
+		// double check, ensuring see the changes after wait call
+		if !sq.running {
+			return common.MinQItem, common.ErrQueueIsClosed
+		}
+	}
+	return sq.popLocked()
+}
+
+// TryPop is the non-blocking version of PopOrWaitTillClose.
+// It returns `common.ErrQueueIsEmpty` right away if the queue is empty.
+func (sq *SFQueue) TryPop() (common.QItem, error) {
+	sq.mu.Lock()
+	defer sq.mu.Unlock()
+	if !sq.running {
+		return common.MinQItem, common.ErrQueueIsClosed
+	}
+	if sq.size == 0 {
+		return common.MinQItem, common.ErrQueueIsEmpty
+	}
+	return sq.popLocked()
+}
+
+// popLocked takes the next item, there should be at least 1
+func (sq *SFQueue) popLocked() (common.QItem, error) {
+	p, b := sq.nextLocked()
+
+	// if we wait blindly, it gonna stuck
+	// but we are tracking it manually, ensuring it will never wait
+	result, err := sq.buckets[p][b].PopOrWaitTillClose()
+	if err != nil {
+		return common.MinQItem, err
+	}
+	sq.numberOfTasksInEachBucket[p][b]--
+	sq.numberOfTasksInEachQueue[p]--
+	sq.size--
+	sq.currentBucket[p] = (b + 1) % sq.numOfBuckets
+
+	sq.notFull.Signal()
+	if sq.size == 0 {
+		sq.emptied.Broadcast()
+		if sq.draining {
+			sq.closeLocked()
+		}
+	}
+	return result, nil
+}
+
+// nextLocked returns the highest non-empty priority, and its bucket having the turn,
+// there should be at least 1 item
+func (sq *SFQueue) nextLocked() (p, b int) {
+	p = sq.limitPriority - 1
+	for sq.numberOfTasksInEachQueue[p] == 0 {
+		p--
+	}
+	b = sq.currentBucket[p]
+	for sq.numberOfTasksInEachBucket[p][b] == 0 {
+		b = (b + 1) % sq.numOfBuckets
+	}
+	return p, b
+}
+
+// Peek returns the item the next pop returns, without removing it,
+// or `common.ErrQueueIsEmpty` if the queue is empty.
+func (sq *SFQueue) Peek() (common.QItem, error) {
+	sq.mu.RLock()
+	defer sq.mu.RUnlock()
+	if !sq.running {
+		return common.MinQItem, common.ErrQueueIsClosed
+	}
+	if sq.size == 0 {
+		return common.MinQItem, common.ErrQueueIsEmpty
+	}
+	p, b := sq.nextLocked()
+	item, _ := sq.buckets[p][b].Peek()
+	return item, nil
+}
+
+// Len returns the number of items currently in the queue
+func (sq *SFQueue) Len() int {
+	sq.mu.RLock()
+	defer sq.mu.RUnlock()
+	return sq.size
+}
+
+// Cap returns the maximum number of items the queue can hold
+func (sq *SFQueue) Cap() int {
+	return sq.sizeLimit
+}
+
+// DepthPerPriority returns the number of items currently in each priority, summed over all buckets
+func (sq *SFQueue) DepthPerPriority() []int {
+	sq.mu.RLock()
+	defer sq.mu.RUnlock()
+	depths := make([]int, sq.limitPriority)
+	copy(depths, sq.numberOfTasksInEachQueue)
+	return depths
+}
+
+// Close is the same as CloseNow
+func (sq *SFQueue) Close() error {
+	return sq.CloseNow()
+}
+
+// CloseNow closes SFQueue, preventing it from accepting new request.
+// Remaining items are dropped, and waiting pops return immediately.
+// Closing it again does nothing, only returning `common.ErrQueueIsClosed`.
+func (sq *SFQueue) CloseNow() error {
+	sq.mu.Lock()
+	defer sq.mu.Unlock()
+	if !sq.running {
+		return common.ErrQueueIsClosed
+	}
+	sq.closeLocked()
+	return nil
+}
+
+// CloseGracefully stops SFQueue from accepting new request,
+// but pops keep returning the remaining items.
+// Once it is empty, it is closed the same way as CloseNow.
+func (sq *SFQueue) CloseGracefully() {
+	sq.mu.Lock()
+	if sq.running {
+		sq.draining = true
+		if sq.size == 0 {
+			sq.closeLocked()
+		}
+	}
+	sq.mu.Unlock()
+}
+
+// WaitUntilEmpty waits until SFQueue holds no item, and returns nil.
+// It returns `common.ErrQueueIsClosed` if SFQueue is closed with items left,
+// or `ctx.Err()` once `ctx` is done while waiting.
+func (sq *SFQueue) WaitUntilEmpty(ctx context.Context) error {
+	sq.mu.Lock()
+	defer sq.mu.Unlock()
+	if sq.size > 0 {
+		defer common.WakeOnDone(ctx, sq.emptied)()
+	}
+	for sq.size > 0 {
+		if !sq.running {
+			return common.ErrQueueIsClosed
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		sq.emptied.Wait()
+	}
+	return nil
+}
+
+// IsClosed returns whether SFQueue is closed, after which no item is popped anymore
+func (sq *SFQueue) IsClosed() bool {
+	sq.mu.RLock()
+	defer sq.mu.RUnlock()
+	return !sq.running
+}
+
+// Closed returns a channel which is closed once SFQueue is closed,
+// so other goroutines can select on it
+func (sq *SFQueue) Closed() <-chan struct{} {
+	return sq.closed
+}
+
+func (sq *SFQueue) closeLocked() {
+	if !sq.running {
+		// already closed, sq.closed can't be closed twice
+		return
+	}
+	sq.running = false
+	close(sq.closed)
+	for _, buckets := range sq.buckets {
+		for _, q := range buckets {
+			if q != nil {
+				q.Close()
+			}
+		}
+	}
+	sq.notEmpty.Broadcast()
+	sq.notFull.Broadcast()
+	sq.emptied.Broadcast()
+}
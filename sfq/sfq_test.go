@@ -0,0 +1,122 @@
+package sfq
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/queuetest"
+)
+
+// byTenant treats ID / 1000 as the flow, e.g. the tenant
+func byTenant(item common.QItem) uint64 {
+	return item.ID / 1000
+}
+
+func TestNewSFQueueErrors(t *testing.T) {
+	_, err := NewSFQueue(2048, 8, 16, nil)
+	if err == nil || err != common.ErrParamShouldBePositive {
+		t.Fatalf("It should error, cause flow can't be nil, but instead we got %v", err)
+	}
+	_, err = NewSFQueue(2048, 8, 0, byTenant)
+	if err == nil || err != common.ErrParamShouldBePositive {
+		t.Fatalf("It should error, cause numOfBuckets can't be zero, but instead we got %v", err)
+	}
+
+	sq, _ := NewSFQueue(1, 8, 16, byTenant)
+	err = sq.PushOrError(common.QItem{ID: 1, Priority: 8})
+	if !errors.Is(err, common.ErrPriorityOutOfRange) {
+		t.Fatalf("It should error, cause priority is out of range, but instead we got %v", err)
+	}
+	sq.PushOrError(common.QItem{ID: 1})
+	err = sq.PushOrError(common.QItem{ID: 2})
+	if !errors.Is(err, common.ErrQueueIsFull) {
+		t.Fatalf("It should error, cause queue is full, but instead we got %v", err)
+	}
+}
+
+func TestSFQueueChattyFlowDoesNotMonopolize(t *testing.T) {
+	sq, _ := NewSFQueue(2048, 2, 1024, byTenant)
+	// tenant 1 floods first, tenant 2 only has a few
+	for i := 0; i < 100; i++ {
+		sq.PushOrError(common.QItem{ID: uint64(1000 + i), Priority: 0})
+	}
+	for i := 0; i < 3; i++ {
+		sq.PushOrError(common.QItem{ID: uint64(2000 + i), Priority: 0})
+	}
+	sq.PushOrError(common.QItem{ID: 3000, Priority: 1})
+
+	item, _ := sq.PopOrWaitTillClose()
+	if item.ID != 3000 {
+		t.Fatalf("Higher priority should still go first, but instead we got %v", item)
+	}
+	served := make(map[uint64]int)
+	for i := 0; i < 6; i++ {
+		item, _ := sq.PopOrWaitTillClose()
+		served[byTenant(item)]++
+	}
+	if served[1] != 3 || served[2] != 3 {
+		t.Fatalf("Both tenants should take turns, but instead we got %v", served)
+	}
+
+	sq.CloseGracefully()
+	for i := 0; i < 97; i++ {
+		item, err := sq.PopOrWaitTillClose()
+		if err != nil || byTenant(item) != 1 {
+			t.Fatalf("It should still return the remaining items, but instead we got %v and %v", item, err)
+		}
+	}
+	_, err := sq.PopOrWaitTillClose()
+	if err == nil || err != common.ErrQueueIsClosed {
+		t.Fatalf("It should be closed after draining, but instead we got %v", err)
+	}
+}
+
+func TestSFQueueWaitUntilEmpty(t *testing.T) {
+	sq, _ := NewSFQueue(2048, 8, 16, byTenant)
+	sq.PushOrError(common.QItem{ID: 1})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := sq.WaitUntilEmpty(ctx); err == nil || err != context.DeadlineExceeded {
+		t.Fatalf("It should return context.DeadlineExceeded, cause nothing is popped, but instead we got %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- sq.WaitUntilEmpty(context.Background())
+	}()
+	sq.PopOrWaitTillClose()
+	if err := <-done; err != nil {
+		t.Fatalf("It should return once the last item is popped, but instead we got %v", err)
+	}
+
+	sq.PushOrError(common.QItem{ID: 2})
+	sq.Close()
+	if err := sq.WaitUntilEmpty(context.Background()); err == nil || err != common.ErrQueueIsClosed {
+		t.Fatalf("It should return ErrQueueIsClosed, cause closed with items left, but instead we got %v", err)
+	}
+}
+
+func TestSFQueueConformance(t *testing.T) {
+	queuetest.Run(t, func(sizeLimit int) (common.ExtendedQInterface, error) {
+		return NewSFQueue(sizeLimit, 2, 4, byTenant)
+	})
+}
+
+func TestSFQueuePeek(t *testing.T) {
+	sq, _ := NewSFQueue(10, 2, 4, byTenant)
+	sq.PushOrError(common.QItem{ID: 1, Priority: 0})
+	sq.PushOrError(common.QItem{ID: 2, Priority: 1})
+	item, err := sq.Peek()
+	if err != nil || item.ID != 2 {
+		t.Fatalf("It should peek ID 2, but instead we got %v and %v", item, err)
+	}
+	popped, _ := sq.PopOrWaitTillClose()
+	if popped.ID != item.ID {
+		t.Fatalf("It should pop the peeked item, but instead we got %v", popped)
+	}
+	sq.Close()
+}
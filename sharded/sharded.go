@@ -0,0 +1,521 @@
+package sharded
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/linkedslice"
+)
+
+// ShardedQueue is a priority queue split into `common.ShardCount()` shards, each with its own lock,
+// so concurrent pushes and pops mostly don't contend with each other.
+// Every `reshardEvery` pushes, it checks the shard count again,
+// and re-shards if it changed (e.g. GOMAXPROCS is updated at runtime).
+//
+// Pushes are spread over the shards in turn. A pop starts from the next shard in turn,
+// and steals from the others if it is empty. Inside a shard, the highest priority goes first,
+// but across shards it is only approximate: a pop may return a lower priority item
+// from its shard, while another shard still has a higher one.
+// If you need strict ordering, use `priority.PriorityQueue`.
+//
+// Only waiting pops and pushes, pops waking them up, and closing, take the queue-wide lock.
+type ShardedQueue struct {
+	// accessed atomically, keep it first so it is 64-bit aligned
+	size int64
+
+	pushCursor uint32
+	popCursor  uint32
+	// number of pops waiting on notEmpty, accessed atomically
+	waiters int32
+	// number of pushes waiting on notFull, and of those waiting on emptied, accessed atomically,
+	// so pops only take mu when someone waits for them
+	fullWaiters  int32
+	emptyWaiters int32
+
+	shards        []*shard
+	limitPriority int
+	sizeLimit     int
+
+	// pushes and pops take the read lock, so they don't contend with each other,
+	// and closing and re-sharding take the write lock, so no push or pop is half-done after it
+	state    sync.RWMutex
+	running  bool
+	closed   chan struct{}
+	draining bool
+
+	// only for waiting pops and pushes, and those waiting on emptied, see `WaitUntilEmpty`
+	mu       sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	emptied  *sync.Cond
+}
+
+// reshardEvery is how many pushes are done between checking `common.ShardCount()`,
+// as it takes a runtime-wide lock
+const reshardEvery = 1024
+
+// shard is a small priority queue, which never waits
+type shard struct {
+	mu                       sync.Mutex
+	numberOfTasksInEachQueue []int
+	queues                   []*linkedslice.LinkedSlice
+}
+
+func (s *shard) push(item common.QItem) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.queues[item.Priority].PushOrError(item)
+	if err != nil {
+		return err
+	}
+	s.numberOfTasksInEachQueue[item.Priority]++
+	return nil
+}
+
+// peek returns the highest priority item in this shard without removing it, if any
+func (s *shard) peek() (common.QItem, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for p := len(s.queues) - 1; p >= 0; p-- {
+		if s.numberOfTasksInEachQueue[p] > 0 {
+			return s.queues[p].Peek()
+		}
+	}
+	return common.MinQItem, false
+}
+
+// tryPop returns the highest priority item in this shard, if any
+func (s *shard) tryPop() (common.QItem, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for p := len(s.queues) - 1; p >= 0; p-- {
+		if s.numberOfTasksInEachQueue[p] == 0 {
+			continue
+		}
+		// we are tracking it manually, ensuring it will never wait
+		item, err := s.queues[p].PopOrWaitTillClose()
+		if err != nil {
+			// closed
+			return common.MinQItem, false
+		}
+		s.numberOfTasksInEachQueue[p]--
+		return item, true
+	}
+	return common.MinQItem, false
+}
+
+func newShard(numOfPriority int) *shard {
+	queues := make([]*linkedslice.LinkedSlice, numOfPriority)
+	for p := range queues {
+		queues[p] = linkedslice.NewLinkedSlice()
+	}
+	return &shard{
+		numberOfTasksInEachQueue: make([]int, numOfPriority),
+		queues:                   queues,
+	}
+}
+
+// NewShardedQueue creates our sharded queue, which caps at sizeLimit,
+// and allows priority [0,numOfPriority)
+func NewShardedQueue(sizeLimit, numOfPriority int) (*ShardedQueue, error) {
+	if sizeLimit <= 0 || numOfPriority <= 0 {
+		return nil, common.ErrParamShouldBePositive
+	}
+
+	shards := make([]*shard, common.ShardCount())
+	for i := range shards {
+		shards[i] = newShard(numOfPriority)
+	}
+	sq := &ShardedQueue{
+		shards:        shards,
+		limitPriority: numOfPriority,
+		sizeLimit:     sizeLimit,
+		running:       true,
+		closed:        make(chan struct{}),
+	}
+	sq.notEmpty = sync.NewCond(&sq.mu)
+	sq.notFull = sync.NewCond(&sq.mu)
+	sq.emptied = sync.NewCond(&sq.mu)
+	return sq, nil
+}
+
+// PushOrError put the item into the queue, and returns error if no slot available
+func (sq *ShardedQueue) PushOrError(item common.QItem) error {
+	if item.Priority < 0 || item.Priority >= sq.limitPriority {
+		return sq.queueError("PushOrError", item, common.ErrPriorityOutOfRange)
+	}
+	if err := sq.push(item); err != nil {
+		return sq.queueError("PushOrError", item, err)
+	}
+	sq.pushed()
+	return nil
+}
+
+// PushOrWaitCtx is the same as PushOrError, but waits for a slot while the queue is full,
+// and returns `ctx.Err()` once `ctx` is done while waiting
+func (sq *ShardedQueue) PushOrWaitCtx(ctx context.Context, item common.QItem) error {
+	if item.Priority < 0 || item.Priority >= sq.limitPriority {
+		return sq.queueError("PushOrWaitCtx", item, common.ErrPriorityOutOfRange)
+	}
+	err := sq.push(item)
+	if err == common.ErrQueueIsFull {
+		err = sq.waitToPush(ctx, item)
+	} else if err != nil {
+		err = sq.queueError("PushOrWaitCtx", item, err)
+	}
+	if err != nil {
+		return err
+	}
+	sq.pushed()
+	return nil
+}
+
+// waitToPush pushes `item` once there is a slot.
+// Announced before trying, pops take mu once they are done,
+// so they can't free a slot between trying and waiting.
+func (sq *ShardedQueue) waitToPush(ctx context.Context, item common.QItem) error {
+	sq.mu.Lock()
+	defer sq.mu.Unlock()
+	atomic.AddInt32(&sq.fullWaiters, 1)
+	defer atomic.AddInt32(&sq.fullWaiters, -1)
+	defer common.WakeOnDone(ctx, sq.notFull)()
+	for {
+		err := sq.push(item)
+		if err != common.ErrQueueIsFull {
+			if err != nil {
+				return sq.queueError("PushOrWaitCtx", item, err)
+			}
+			return nil
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		sq.notFull.Wait()
+	}
+}
+
+// queueError adds what sq looks like right now to `err`, see `common.QueueError`.
+// Unlike the other queues, the size is read without any lock, so it is only a snapshot.
+func (sq *ShardedQueue) queueError(op string, item common.QItem, err error) error {
+	return &common.QueueError{Op: op, Priority: item.Priority, Size: int(atomic.LoadInt64(&sq.size)), Limit: sq.sizeLimit, Err: err}
+}
+
+// pushed wakes a waiting pop, if any.
+// It is checked after pushing, see PopOrWaitTillClose.
+func (sq *ShardedQueue) pushed() {
+	if atomic.LoadInt32(&sq.waiters) > 0 {
+		sq.mu.Lock()
+		sq.notEmpty.Signal()
+		sq.mu.Unlock()
+	}
+}
+
+func (sq *ShardedQueue) push(item common.QItem) error {
+	i := atomic.AddUint32(&sq.pushCursor, 1)
+	if i%reshardEvery == 0 {
+		sq.reshard(common.ShardCount())
+	}
+
+	sq.state.RLock()
+	defer sq.state.RUnlock()
+	if !sq.running || sq.draining {
+		return common.ErrQueueIsClosed
+	}
+	if atomic.AddInt64(&sq.size, 1) > int64(sq.sizeLimit) {
+		atomic.AddInt64(&sq.size, -1)
+		return common.ErrQueueIsFull
+	}
+
+	err := sq.shards[i%uint32(len(sq.shards))].push(item)
+	// meaning already closed, cause linkedslices is unbounded
+	if err != nil {
+		atomic.AddInt64(&sq.size, -1)
+		return err
+	}
+	return nil
+}
+
+// reshard changes the number of shards to `n`, if it is not already.
+// New shards start empty, and the items of removed ones are moved into those kept.
+func (sq *ShardedQueue) reshard(n int) {
+	sq.state.RLock()
+	same := len(sq.shards) == n
+	sq.state.RUnlock()
+	if same {
+		return
+	}
+
+	sq.state.Lock()
+	defer sq.state.Unlock()
+	// e.g. another push re-sharded in the meantime
+	if len(sq.shards) == n || !sq.running {
+		return
+	}
+	if n > len(sq.shards) {
+		for len(sq.shards) < n {
+			sq.shards = append(sq.shards, newShard(sq.limitPriority))
+		}
+		return
+	}
+	for i, s := range sq.shards[n:] {
+		for p, q := range s.queues {
+			for ; s.numberOfTasksInEachQueue[p] > 0; s.numberOfTasksInEachQueue[p]-- {
+				// we are tracking it manually, ensuring it will never wait
+				item, _ := q.PopOrWaitTillClose()
+				sq.shards[i%n].push(item)
+			}
+		}
+	}
+	sq.shards = sq.shards[:n:n]
+}
+
+// tryPop returns an item from the next shard in turn, or steals from the others
+func (sq *ShardedQueue) tryPop() (common.QItem, bool) {
+	sq.state.RLock()
+	defer sq.state.RUnlock()
+	n := uint32(len(sq.shards))
+	start := atomic.AddUint32(&sq.popCursor, 1)
+	for k := uint32(0); k < n; k++ {
+		if item, ok := sq.shards[(start+k)%n].tryPop(); ok {
+			atomic.AddInt64(&sq.size, -1)
+			return item, true
+		}
+	}
+	return common.MinQItem, false
+}
+
+func (sq *ShardedQueue) status() (running, draining bool) {
+	sq.state.RLock()
+	defer sq.state.RUnlock()
+	return sq.running, sq.draining
+}
+
+// PopOrWaitTillClose returns 1 QItem, or waits if none exists
+func (sq *ShardedQueue) PopOrWaitTillClose() (common.QItem, error) {
+	return sq.PopOrWaitCtx(context.Background())
+}
+
+// PopOrWaitCtx is the same as PopOrWaitTillClose,
+// but also returns `ctx.Err()` once `ctx` is done while waiting
+func (sq *ShardedQueue) PopOrWaitCtx(ctx context.Context) (common.QItem, error) {
+	running, _ := sq.status()
+	if !running {
+		return common.MinQItem, common.ErrQueueIsClosed
+	}
+	if item, ok := sq.tryPop(); ok {
+		sq.popped()
+		return item, nil
+	}
+
+	sq.mu.Lock()
+	defer sq.mu.Unlock()
+	// announced before checking the shards again, so a push done after that check
+	// sees it and signals, as we only stop holding mu inside Wait
+	atomic.AddInt32(&sq.waiters, 1)
+	defer atomic.AddInt32(&sq.waiters, -1)
+	defer common.WakeOnDone(ctx, sq.notEmpty)()
+	for {
+		running, draining := sq.status()
+		if !running {
+			return common.MinQItem, common.ErrQueueIsClosed
+		}
+		if item, ok := sq.tryPop(); ok {
+			sq.poppedLocked()
+			return item, nil
+		}
+		if draining && atomic.LoadInt64(&sq.size) == 0 {
+			sq.closeLocked()
+			return common.MinQItem, common.ErrQueueIsClosed
+		}
+		if err := ctx.Err(); err != nil {
+			return common.MinQItem, err
+		}
+		sq.notEmpty.Wait()
+	}
+}
+
+// TryPop is the non-blocking version of PopOrWaitTillClose.
+// It returns `common.ErrQueueIsEmpty` right away if no shard has an item.
+func (sq *ShardedQueue) TryPop() (common.QItem, error) {
+	if running, _ := sq.status(); !running {
+		return common.MinQItem, common.ErrQueueIsClosed
+	}
+	item, ok := sq.tryPop()
+	if !ok {
+		return common.MinQItem, common.ErrQueueIsEmpty
+	}
+	sq.popped()
+	return item, nil
+}
+
+// Peek returns the highest priority item among those at the head of each shard,
+// without removing it, or `common.ErrQueueIsEmpty` if the queue is empty.
+// As pops start from the next shard in turn, the next pop may return another one.
+func (sq *ShardedQueue) Peek() (common.QItem, error) {
+	if running, _ := sq.status(); !running {
+		return common.MinQItem, common.ErrQueueIsClosed
+	}
+	sq.state.RLock()
+	defer sq.state.RUnlock()
+	result, found := common.MinQItem, false
+	for _, s := range sq.shards {
+		item, ok := s.peek()
+		if ok && (!found || item.Priority > result.Priority) {
+			result, found = item, true
+		}
+	}
+	if !found {
+		return common.MinQItem, common.ErrQueueIsEmpty
+	}
+	return result, nil
+}
+
+// popped is called once an item is popped without holding mu.
+// It only takes mu if someone waits for it, or to close the queue once drained.
+func (sq *ShardedQueue) popped() {
+	if atomic.LoadInt32(&sq.fullWaiters) == 0 && atomic.LoadInt32(&sq.emptyWaiters) == 0 {
+		if _, draining := sq.status(); !draining {
+			return
+		}
+	}
+	sq.mu.Lock()
+	sq.poppedLocked()
+	sq.mu.Unlock()
+}
+
+// poppedLocked wakes a waiting push, and those waiting for the queue to be empty, if it is,
+// and closes it once drained
+func (sq *ShardedQueue) poppedLocked() {
+	sq.notFull.Signal()
+	if atomic.LoadInt64(&sq.size) == 0 {
+		sq.emptied.Broadcast()
+	}
+	sq.closeIfDrainedLocked()
+}
+
+func (sq *ShardedQueue) closeIfDrainedLocked() {
+	_, draining := sq.status()
+	if draining && atomic.LoadInt64(&sq.size) == 0 {
+		sq.closeLocked()
+	}
+}
+
+// Len returns the number of items currently in the queue
+func (sq *ShardedQueue) Len() int {
+	return int(atomic.LoadInt64(&sq.size))
+}
+
+// Cap returns the maximum number of items the queue can hold
+func (sq *ShardedQueue) Cap() int {
+	return sq.sizeLimit
+}
+
+// DepthPerPriority returns the number of items currently in each priority, summed over all shards.
+// As each shard is counted separately, it is not an atomic snapshot under concurrent pushes and pops.
+func (sq *ShardedQueue) DepthPerPriority() []int {
+	depths := make([]int, sq.limitPriority)
+	sq.state.RLock()
+	defer sq.state.RUnlock()
+	for _, s := range sq.shards {
+		s.mu.Lock()
+		for p, n := range s.numberOfTasksInEachQueue {
+			depths[p] += n
+		}
+		s.mu.Unlock()
+	}
+	return depths
+}
+
+// Close is the same as CloseNow
+func (sq *ShardedQueue) Close() error {
+	return sq.CloseNow()
+}
+
+// CloseNow closes ShardedQueue, preventing it from accepting new request.
+// Remaining items are dropped, and waiting pops return immediately.
+// Closing it again does nothing, only returning `common.ErrQueueIsClosed`.
+func (sq *ShardedQueue) CloseNow() error {
+	sq.mu.Lock()
+	defer sq.mu.Unlock()
+	if running, _ := sq.status(); !running {
+		return common.ErrQueueIsClosed
+	}
+	sq.closeLocked()
+	return nil
+}
+
+// CloseGracefully stops ShardedQueue from accepting new request,
+// but pops keep returning the remaining items.
+// Once it is empty, it is closed the same way as CloseNow.
+func (sq *ShardedQueue) CloseGracefully() {
+	sq.mu.Lock()
+	sq.state.Lock()
+	sq.draining = true
+	sq.state.Unlock()
+	// waiting pops need to recheck whether it is empty
+	sq.notEmpty.Broadcast()
+	sq.closeIfDrainedLocked()
+	sq.mu.Unlock()
+}
+
+// WaitUntilEmpty waits until ShardedQueue holds no item, and returns nil.
+// It returns `common.ErrQueueIsClosed` if ShardedQueue is closed with items left,
+// or `ctx.Err()` once `ctx` is done while waiting.
+func (sq *ShardedQueue) WaitUntilEmpty(ctx context.Context) error {
+	sq.mu.Lock()
+	defer sq.mu.Unlock()
+	atomic.AddInt32(&sq.emptyWaiters, 1)
+	defer atomic.AddInt32(&sq.emptyWaiters, -1)
+	if atomic.LoadInt64(&sq.size) > 0 {
+		defer common.WakeOnDone(ctx, sq.emptied)()
+	}
+	// announced before checking, pops take mu once they are done,
+	// so they can't reach 0 between checking and waiting
+	for atomic.LoadInt64(&sq.size) > 0 {
+		if running, _ := sq.status(); !running {
+			return common.ErrQueueIsClosed
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		sq.emptied.Wait()
+	}
+	return nil
+}
+
+// IsClosed returns whether ShardedQueue is closed, after which no item is popped anymore
+func (sq *ShardedQueue) IsClosed() bool {
+	running, _ := sq.status()
+	return !running
+}
+
+// Closed returns a channel which is closed once ShardedQueue is closed,
+// so other goroutines can select on it
+func (sq *ShardedQueue) Closed() <-chan struct{} {
+	return sq.closed
+}
+
+// closeLocked needs mu to be held, so no pop is between checking `running` and waiting
+func (sq *ShardedQueue) closeLocked() {
+	sq.state.Lock()
+	if !sq.running {
+		// already closed, sq.closed can't be closed twice
+		sq.state.Unlock()
+		return
+	}
+	sq.running = false
+	sq.state.Unlock()
+	close(sq.closed)
+	for _, s := range sq.shards {
+		s.mu.Lock()
+		for _, q := range s.queues {
+			q.Close()
+		}
+		s.mu.Unlock()
+	}
+	sq.notEmpty.Broadcast()
+	sq.notFull.Broadcast()
+	sq.emptied.Broadcast()
+}
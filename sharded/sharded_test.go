@@ -0,0 +1,298 @@
+package sharded
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/queuetest"
+)
+
+func TestNewShardedQueueErrors(t *testing.T) {
+	_, err := NewShardedQueue(0, 8)
+	if err == nil || err != common.ErrParamShouldBePositive {
+		t.Fatalf("It should error, cause sizeLimit can't be zero, but instead we got %v", err)
+	}
+
+	sq, _ := NewShardedQueue(1, 8)
+	err = sq.PushOrError(common.QItem{ID: 1, Priority: 8})
+	if !errors.Is(err, common.ErrPriorityOutOfRange) {
+		t.Fatalf("It should error, cause priority is out of range, but instead we got %v", err)
+	}
+	sq.PushOrError(common.QItem{ID: 1})
+	err = sq.PushOrError(common.QItem{ID: 2})
+	if !errors.Is(err, common.ErrQueueIsFull) {
+		t.Fatalf("It should error, cause queue is full, but instead we got %v", err)
+	}
+}
+
+func TestShardedQueueConcurrent(t *testing.T) {
+	sq, _ := NewShardedQueue(2048, 8)
+	numOfPoppers, numOfItems := 8, 10000
+
+	var mu sync.Mutex
+	seen := make(map[uint64]bool)
+	var wg sync.WaitGroup
+	for i := 0; i < numOfPoppers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				item, err := sq.PopOrWaitTillClose()
+				if err != nil {
+					return
+				}
+				mu.Lock()
+				if seen[item.ID] {
+					t.Errorf("ID %d should only be popped once", item.ID)
+				}
+				seen[item.ID] = true
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for i := 0; i < numOfItems; i++ {
+		for errors.Is(sq.PushOrError(common.QItem{ID: uint64(i), Priority: i % 8}), common.ErrQueueIsFull) {
+		}
+	}
+	sq.CloseGracefully()
+	wg.Wait()
+
+	if len(seen) != numOfItems {
+		t.Fatalf("All %d items should be popped, but instead we got %d", numOfItems, len(seen))
+	}
+	err := sq.PushOrError(common.QItem{ID: 1})
+	if !errors.Is(err, common.ErrQueueIsClosed) {
+		t.Fatalf("It should be closed, but instead we got %v", err)
+	}
+}
+
+func TestShardedQueueConcurrentWaitingPushes(t *testing.T) {
+	sq, _ := NewShardedQueue(4, 8)
+	numOfPushers, numOfItems := 8, 2000
+
+	var wg sync.WaitGroup
+	for i := 0; i < numOfPushers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := i; j < numOfItems; j += numOfPushers {
+				if err := sq.PushOrWaitCtx(context.Background(), common.QItem{ID: uint64(j), Priority: j % 8}); err != nil {
+					t.Errorf("It should wait for a slot, but instead we got %v", err)
+				}
+			}
+		}(i)
+	}
+	popped := make(chan int)
+	go func() {
+		n := 0
+		for {
+			if _, err := sq.PopOrWaitTillClose(); err != nil {
+				popped <- n
+				return
+			}
+			n++
+		}
+	}()
+
+	// pops free slots without the queue-wide lock, unless someone waits for them
+	wg.Wait()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := sq.WaitUntilEmpty(ctx); err != nil {
+		t.Fatalf("It should return once all are popped, but instead we got %v", err)
+	}
+	sq.CloseGracefully()
+	if n := <-popped; n != numOfItems {
+		t.Fatalf("All %d items should be popped, but instead we got %d", numOfItems, n)
+	}
+}
+
+func TestShardedQueueCloseWakesWaitingPop(t *testing.T) {
+	sq, _ := NewShardedQueue(10, 2)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, err := sq.PopOrWaitTillClose()
+		if err == nil || err != common.ErrQueueIsClosed {
+			t.Errorf("It should return ErrQueueIsClosed, but instead we got %v", err)
+		}
+	}()
+	sq.Close()
+	wg.Wait()
+}
+
+func BenchmarkShardedQueueParallel(b *testing.B) {
+	sq, _ := NewShardedQueue(1024, 8)
+	b.RunParallel(func(pb *testing.PB) {
+		j := 0
+		for pb.Next() {
+			j++
+			sq.PushOrError(
+				common.QItem{ID: uint64(j), Priority: j % 8})
+			sq.PopOrWaitTillClose()
+		}
+	})
+	sq.Close()
+}
+
+func BenchmarkShardedQueueInLoopParallel(b *testing.B) {
+	sq, _ := NewShardedQueue(1024, 8)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			for j := 0; j < 128; j++ {
+				sq.PushOrError(
+					common.QItem{ID: uint64(j), Priority: j % 8})
+			}
+			for j := 0; j < 128; j++ {
+				sq.PopOrWaitTillClose()
+			}
+		}
+	})
+	sq.Close()
+}
+
+func TestShardedQueuePopOrWaitCtx(t *testing.T) {
+	sq, _ := NewShardedQueue(64, 4)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := sq.PopOrWaitCtx(ctx)
+	if err == nil || err != context.DeadlineExceeded {
+		t.Fatalf("It should return context.DeadlineExceeded, but instead we got %v", err)
+	}
+	sq.Close()
+}
+
+func TestShardedQueueDepthPerPriority(t *testing.T) {
+	sq, _ := NewShardedQueue(64, 3)
+	for i := 0; i < 10; i++ {
+		sq.PushOrError(common.QItem{ID: uint64(i), Priority: i % 2})
+	}
+	if depths := sq.DepthPerPriority(); !reflect.DeepEqual(depths, []int{5, 5, 0}) {
+		t.Fatalf("Expected depths [5 5 0], but instead we got %v", depths)
+	}
+	sq.Close()
+}
+
+func TestShardedQueueCloseIsIdempotent(t *testing.T) {
+	sq, _ := NewShardedQueue(64, 4)
+	var _ common.ClosedNotifier = sq
+	if sq.IsClosed() {
+		t.Fatal("It should not be closed yet, but it is")
+	}
+	select {
+	case <-sq.Closed():
+		t.Fatal("Closed() should not be closed yet, but it is")
+	default:
+	}
+
+	if err := sq.Close(); err != nil {
+		t.Fatalf("It should not error on the first close, but instead we got %v", err)
+	}
+	if err := sq.Close(); err == nil || err != common.ErrQueueIsClosed {
+		t.Fatalf("It should return ErrQueueIsClosed on the second close, but instead we got %v", err)
+	}
+	if !sq.IsClosed() {
+		t.Fatal("It should be closed, but it is not")
+	}
+	select {
+	case <-sq.Closed():
+	case <-time.After(time.Second):
+		t.Fatal("Closed() should be closed, but it is not")
+	}
+}
+
+func TestShardedQueueWaitUntilEmpty(t *testing.T) {
+	sq, _ := NewShardedQueue(10, 4)
+	sq.PushOrError(common.QItem{ID: 1})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := sq.WaitUntilEmpty(ctx); err == nil || err != context.DeadlineExceeded {
+		t.Fatalf("It should return context.DeadlineExceeded, cause nothing is popped, but instead we got %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- sq.WaitUntilEmpty(context.Background())
+	}()
+	sq.PopOrWaitTillClose()
+	if err := <-done; err != nil {
+		t.Fatalf("It should return once the last item is popped, but instead we got %v", err)
+	}
+
+	sq.PushOrError(common.QItem{ID: 2})
+	sq.Close()
+	if err := sq.WaitUntilEmpty(context.Background()); err == nil || err != common.ErrQueueIsClosed {
+		t.Fatalf("It should return ErrQueueIsClosed, cause closed with items left, but instead we got %v", err)
+	}
+}
+
+func TestShardedQueueConformance(t *testing.T) {
+	queuetest.Run(t, func(sizeLimit int) (common.ExtendedQInterface, error) {
+		return NewShardedQueue(sizeLimit, 4)
+	})
+}
+
+func TestShardedQueuePeek(t *testing.T) {
+	sq, _ := NewShardedQueue(10, 4)
+	sq.PushOrError(common.QItem{ID: 1, Priority: 0})
+	sq.PushOrError(common.QItem{ID: 2, Priority: 3})
+	item, err := sq.Peek()
+	if err != nil || item.ID != 2 {
+		t.Fatalf("It should peek ID 2, but instead we got %v and %v", item, err)
+	}
+	sq.Close()
+}
+
+func TestShardedQueueReshard(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	sq, _ := NewShardedQueue(4096, 4)
+	if len(sq.shards) != common.ShardCount() {
+		t.Fatalf("It should have %d shards, but instead we got %d", common.ShardCount(), len(sq.shards))
+	}
+	for i := 0; i < 100; i++ {
+		sq.PushOrError(common.QItem{ID: uint64(i), Priority: i % 4})
+	}
+
+	// shrinking moves the items of the removed shards into those kept
+	runtime.GOMAXPROCS(1)
+	for i := 100; i < reshardEvery; i++ {
+		sq.PushOrError(common.QItem{ID: uint64(i), Priority: i % 4})
+	}
+	if len(sq.shards) != common.ShardCount() {
+		t.Fatalf("It should re-shard to %d shards, but instead we got %d", common.ShardCount(), len(sq.shards))
+	}
+	depths := sq.DepthPerPriority()
+	for p, n := range depths {
+		if n != reshardEvery/4 {
+			t.Fatalf("Priority %d should still have %d items, but instead we got %d", p, reshardEvery/4, n)
+		}
+	}
+
+	// growing adds empty shards
+	sq.reshard(32)
+	if len(sq.shards) != 32 {
+		t.Fatalf("It should re-shard to 32 shards, but instead we got %d", len(sq.shards))
+	}
+	seen := make(map[uint64]bool)
+	for {
+		item, err := sq.TryPop()
+		if err != nil {
+			break
+		}
+		seen[item.ID] = true
+	}
+	if len(seen) != reshardEvery || sq.Len() != 0 {
+		t.Fatalf("All %d items should be popped, but instead we got %d, with %d left",
+			reshardEvery, len(seen), sq.Len())
+	}
+}
@@ -0,0 +1,159 @@
+package prioritize
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+)
+
+// Snapshot is a point-in-time view of the engine, see `Engine.Snapshot`.
+// It only has plain fields, so it can be marshalled as is, e.g. to JSON for a health endpoint.
+type Snapshot struct {
+	// Pending is the number of submitted tasks not yet taken by any worker
+	Pending int
+	// PendingPerPriority is Pending split by priority, indexed by priority.
+	// It is nil if the queue doesn't implement `common.Inspector`, or has no fixed range of priority.
+	PendingPerPriority []int
+	// InFlight are the tasks currently run by workers, oldest first
+	InFlight []InFlightTask
+
+	Workers int
+	// Processed is the number of tasks completed by workers, i.e. Succeeded + Failed
+	Processed uint64
+	Succeeded uint64
+	Failed    uint64
+	Rejected  uint64
+}
+
+// InFlightTask is a task currently run by a worker, see `Snapshot`
+type InFlightTask struct {
+	ID        uint64
+	Priority  int
+	StartedAt time.Time
+	// Stuck is true once reported by the watchdog, see `WithStuckTaskDetection`
+	Stuck bool
+	// Progress and Stage are the last reported by its fn, see `ReportProgress`
+	Progress float64
+	Stage    string
+}
+
+// Snapshot returns the current state of the engine, in more detail than `Stats`.
+// It locks the running tasks while copying them, so don't call it in a tight loop.
+func (e *Engine) Snapshot() Snapshot {
+	var perPriority []int
+	if inspector, ok := e.queue().(common.Inspector); ok {
+		perPriority = inspector.DepthPerPriority()
+	}
+	succeeded := atomic.LoadUint64(&e.succeeded)
+	failed := atomic.LoadUint64(&e.failed)
+	return Snapshot{
+		Pending:            e.Len(),
+		PendingPerPriority: perPriority,
+		InFlight:           e.inflight.list(),
+		Workers:            e.NumOfWorker(),
+		Processed:          succeeded + failed,
+		Succeeded:          succeeded,
+		Failed:             failed,
+		Rejected:           atomic.LoadUint64(&e.rejected),
+	}
+}
+
+// inflightTasks keeps track of the tasks currently run by workers, by their ID.
+// Entries are kept by value, so starting a task doesn't allocate once the map has grown.
+//
+// It is split into shards, each with its own lock, so workers don't all contend on 1 lock.
+// The number of shards follows `common.ShardCount()` on creation. Unlike `sharded.ShardedQueue`,
+// it is never re-balanced, as it only ever holds as many tasks as there are workers.
+type inflightTasks struct {
+	shards []*inflightShard
+	mask   uint64
+}
+
+type inflightShard struct {
+	sync.Mutex
+	running map[uint64]InFlightTask
+	stuck   int
+}
+
+func newInflightTasks() *inflightTasks {
+	n := common.ShardCount()
+	it := &inflightTasks{shards: make([]*inflightShard, n), mask: uint64(n - 1)}
+	for i := range it.shards {
+		it.shards[i] = &inflightShard{running: make(map[uint64]InFlightTask)}
+	}
+	return it
+}
+
+func (it *inflightTasks) start(id uint64, priority int) {
+	s := it.shards[id&it.mask]
+	s.Lock()
+	s.running[id] = InFlightTask{ID: id, Priority: priority, StartedAt: time.Now()}
+	s.Unlock()
+}
+
+func (it *inflightTasks) stop(id uint64) {
+	s := it.shards[id&it.mask]
+	s.Lock()
+	if s.running[id].Stuck {
+		s.stuck--
+	}
+	delete(s.running, id)
+	s.Unlock()
+}
+
+func (it *inflightTasks) progress(id uint64, fraction float64, stage string) {
+	s := it.shards[id&it.mask]
+	s.Lock()
+	if t, ok := s.running[id]; ok {
+		t.Progress = fraction
+		t.Stage = stage
+		s.running[id] = t
+	}
+	s.Unlock()
+}
+
+func (it *inflightTasks) numOfStuck() int {
+	total := 0
+	for _, s := range it.shards {
+		s.Lock()
+		total += s.stuck
+		s.Unlock()
+	}
+	return total
+}
+
+func (it *inflightTasks) list() []InFlightTask {
+	tasks := make([]InFlightTask, 0)
+	for _, s := range it.shards {
+		s.Lock()
+		for _, t := range s.running {
+			tasks = append(tasks, t)
+		}
+		s.Unlock()
+	}
+	sort.Slice(tasks, func(i, j int) bool {
+		return tasks[i].StartedAt.Before(tasks[j].StartedAt)
+	})
+	return tasks
+}
+
+// markStuck marks and returns the tasks running for `threshold` or longer, not yet marked
+func (it *inflightTasks) markStuck(now time.Time, threshold time.Duration) []InFlightTask {
+	var stuck []InFlightTask
+	for _, s := range it.shards {
+		s.Lock()
+		for id, t := range s.running {
+			if !t.Stuck && now.Sub(t.StartedAt) >= threshold {
+				t.Stuck = true
+				s.running[id] = t
+				s.stuck++
+				stuck = append(stuck, t)
+			}
+		}
+		s.Unlock()
+	}
+	return stuck
+}
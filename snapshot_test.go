@@ -0,0 +1,54 @@
+package prioritize
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aarondwi/prioritize/priority"
+)
+
+func TestEngineSnapshot(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 4)
+	engine, _ := New(pq, 1)
+	defer engine.Close()
+
+	done, _ := engine.Submit(context.Background(), 0, func(ctx context.Context, arg interface{}) (interface{}, error) {
+		return nil, nil
+	}, nil)
+	done.Result()
+	gate := make(chan bool)
+	fn := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		<-gate
+		return nil, nil
+	}
+	running, _ := engine.Submit(context.Background(), 1, fn, nil)
+	for engine.Len() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	engine.Submit(context.Background(), 2, fn, nil)
+	engine.Submit(context.Background(), 2, fn, nil)
+	engine.Submit(context.Background(), 3, fn, nil)
+
+	snapshot := engine.Snapshot()
+	if snapshot.Pending != 3 || len(snapshot.PendingPerPriority) != 4 ||
+		snapshot.PendingPerPriority[2] != 2 || snapshot.PendingPerPriority[3] != 1 {
+		t.Fatalf("Expected 3 pending tasks, 2 of priority 2 and 1 of priority 3, but instead we got %v", snapshot)
+	}
+	if len(snapshot.InFlight) != 1 || snapshot.InFlight[0].ID != running.ID() ||
+		snapshot.InFlight[0].Priority != 1 || snapshot.InFlight[0].StartedAt.IsZero() {
+		t.Fatalf("Expected the running task to be in flight, but instead we got %v", snapshot.InFlight)
+	}
+	if snapshot.Processed != 1 || snapshot.Succeeded != 1 || snapshot.Workers != 1 {
+		t.Fatalf("Expected 1 processed task by 1 worker, but instead we got %v", snapshot)
+	}
+	if _, err := json.Marshal(snapshot); err != nil {
+		t.Fatalf("It should be marshallable to JSON, but instead we got %v", err)
+	}
+
+	close(gate)
+	for engine.Len() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,102 @@
+package prioritize
+
+import (
+	"context"
+	"sync"
+)
+
+// StreamTaskFunc is a task producing many partial results, see `Engine.SubmitStream`.
+// Each is sent with `emit`, which waits until there is room for it in `Task.Results()`.
+// `emit` returns the error of `ctx` once it is done (e.g. the task is cancelled) without sending,
+// in which case fn should stop.
+type StreamTaskFunc func(ctx context.Context, arg interface{}, emit func(result interface{}) error) error
+
+// SubmitStream is the same as `Submit`, but for a fn producing many partial results,
+// which are received from `Task.Results()`, holding up to `buffer` not yet received.
+// The channel is closed once the task completes, after which `Task.Result()` returns its error, if any.
+//
+// Note the worker waits on `emit` while the buffer is full, so keep receiving from the channel
+// (or cancel the task), else it is stuck. If the task is retried (see `WithRetry`),
+// results emitted by failed attempts are already received, so only retry tasks which can handle it.
+func (e *Engine) SubmitStream(
+	ctx context.Context,
+	priority int,
+	fn StreamTaskFunc,
+	arg interface{},
+	buffer int) (*Task, error) {
+
+	if buffer < 0 {
+		buffer = 0
+	}
+	s := &stream{results: make(chan interface{}, buffer)}
+	wrapped := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		if !s.begin() {
+			return nil, ErrTaskCancelled
+		}
+		defer s.end()
+		return nil, fn(ctx, arg, func(result interface{}) error {
+			select {
+			case s.results <- result:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}
+	task, err := e.submit(ctx, priority, wrapped, arg, func(interface{}, error) {
+		s.complete()
+	}, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	task.stream = s
+	return task, nil
+}
+
+// Results returns the channel the partial results of the Task are sent to, see `Engine.SubmitStream`.
+// It is nil for tasks not submitted with `SubmitStream`.
+func (t *Task) Results() <-chan interface{} {
+	if t.stream == nil {
+		return nil
+	}
+	return t.stream.results
+}
+
+// stream closes its channel once the task is completed, and its fn is not running,
+// as the task can be completed while fn still runs, e.g. by `Engine.Cancel`.
+type stream struct {
+	results chan interface{}
+
+	mu        sync.Mutex
+	running   bool
+	completed bool
+}
+
+// begin returns false if the task is already completed, so fn should not run
+func (s *stream) begin() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.completed {
+		return false
+	}
+	s.running = true
+	return true
+}
+
+func (s *stream) end() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running = false
+	if s.completed {
+		close(s.results)
+	}
+}
+
+func (s *stream) complete() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.completed = true
+	if !s.running {
+		close(s.results)
+	}
+}
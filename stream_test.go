@@ -0,0 +1,100 @@
+package prioritize
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aarondwi/prioritize/priority"
+)
+
+func TestEngineSubmitStream(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 4)
+	engine, _ := New(pq, 1)
+	defer engine.Close()
+
+	errPartial := errors.New("partial")
+	task, err := engine.SubmitStream(context.Background(), 0,
+		func(ctx context.Context, arg interface{}, emit func(interface{}) error) error {
+			for i := 0; i < arg.(int); i++ {
+				if err := emit(i); err != nil {
+					return err
+				}
+			}
+			return errPartial
+		}, 5, 1)
+	if err != nil {
+		t.Fatalf("It should be accepted, but instead we got %v", err)
+	}
+
+	expected := 0
+	for result := range task.Results() {
+		if result.(int) != expected {
+			t.Fatalf("Expected %d, but instead we got %v", expected, result)
+		}
+		expected++
+	}
+	if expected != 5 {
+		t.Fatalf("It should receive all 5 results, but instead we got %d", expected)
+	}
+	if _, err := task.Result(); err == nil || err != errPartial {
+		t.Fatalf("It should return the final error once the channel is closed, but instead we got %v", err)
+	}
+
+	plain, _ := engine.Submit(context.Background(), 0, func(ctx context.Context, arg interface{}) (interface{}, error) {
+		return nil, nil
+	}, nil)
+	if plain.Results() != nil {
+		t.Fatalf("It should have no results channel for tasks not submitted with SubmitStream")
+	}
+}
+
+func TestEngineSubmitStreamCancelled(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 4)
+	engine, _ := New(pq, 1)
+	defer engine.Close()
+
+	emitted := make(chan error)
+	task, _ := engine.SubmitStream(context.Background(), 0,
+		func(ctx context.Context, arg interface{}, emit func(interface{}) error) error {
+			emit(1)
+			// nobody receives this one, until cancelled
+			err := emit(2)
+			emitted <- err
+			return err
+		}, nil, 0)
+
+	if result := <-task.Results(); result.(int) != 1 {
+		t.Fatalf("Expected 1, but instead we got %v", result)
+	}
+	task.Cancel()
+	if err := <-emitted; err == nil || err != context.Canceled {
+		t.Fatalf("It should stop waiting to emit once cancelled, but instead we got %v", err)
+	}
+	if _, ok := <-task.Results(); ok {
+		t.Fatalf("It should close the channel once fn returns")
+	}
+	if _, err := task.Result(); err == nil || err != ErrTaskCancelled {
+		t.Fatalf("It should return ErrTaskCancelled, but instead we got %v", err)
+	}
+
+	// cancelled while queued, so it never runs, and its channel is closed on completion
+	gate := make(chan bool)
+	engine.Submit(context.Background(), 0, func(ctx context.Context, arg interface{}) (interface{}, error) {
+		<-gate
+		return nil, nil
+	}, nil)
+	for engine.Len() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	queued, _ := engine.SubmitStream(context.Background(), 0,
+		func(ctx context.Context, arg interface{}, emit func(interface{}) error) error {
+			return emit(1)
+		}, nil, 1)
+	queued.Cancel()
+	close(gate)
+	if _, ok := <-queued.Results(); ok {
+		t.Fatalf("It should close the channel of a task which never runs")
+	}
+}
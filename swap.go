@@ -0,0 +1,148 @@
+package prioritize
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/aarondwi/prioritize/common"
+)
+
+// ErrSwapNotSupported is returned when swapping the queue of an engine created with `NewWithTenants`,
+// as its tenants are kept in the queue itself
+var ErrSwapNotSupported = errors.New("The queue of this engine can't be swapped")
+
+// SwapQueue replaces the queue of the engine with `newQ`, e.g. to change the scheduling policy
+// (priority to fair) during an incident, without dropping queued tasks.
+//
+// New submissions go to `newQ` right away, and workers move over to it.
+// The old queue is closed gracefully, and its remaining items are moved into `newQ`
+// (all at once, if it implements `common.Drainer`, as built-in ones do).
+// Those not fitting in `newQ` are completed with its error (e.g. `common.ErrQueueIsFull`),
+// and the first such error is returned, once all others are moved.
+// A paused engine (see `Pause`) stays paused, with `newQ` paused before it takes over.
+//
+// `newQ` should be empty, not used elsewhere, and implement whatever the options of the engine need,
+// e.g. `common.FilteredPopper` with `WithReservedWorkers`, else the error of that option is returned.
+// It returns `ErrAlreadyClosed` if the engine is closed, and `ErrSwapNotSupported` for tenant engines.
+// While being moved, an item is in neither queue, so a task cancelled then (see `Engine.Cancel`)
+// is only skipped once popped, just like with queues not implementing `common.Remover`.
+func (e *Engine) SwapQueue(newQ common.QInterface) error {
+	e.swapMu.Lock()
+	defer e.swapMu.Unlock()
+	select {
+	case <-e.closeChan:
+		return ErrAlreadyClosed
+	default:
+	}
+	if e.tenants != nil {
+		return ErrSwapNotSupported
+	}
+	if err := e.checkQueue(newQ); err != nil {
+		return err
+	}
+	if e.paused {
+		newQ.(common.Pauser).Pause()
+	}
+
+	old := e.queue()
+	e.setQueue(newQ)
+	// once counted, those failing on the old queue try again on the new one
+	atomic.AddUint64(&e.swaps, 1)
+	old.CloseGracefully()
+
+	var err error
+	move := func(item common.QItem) {
+		if pushErr := newQ.PushOrError(item); pushErr != nil {
+			e.dropWith(item, pushErr)
+			if err == nil {
+				err = pushErr
+			}
+		}
+	}
+	if drainer, ok := old.(common.Drainer); ok {
+		for _, item := range drainer.Drain() {
+			move(item)
+		}
+	}
+	if pauser, ok := old.(common.Pauser); ok {
+		// else pops below, and those of workers, wait
+		pauser.Resume()
+	}
+	for {
+		item, popErr := old.PopOrWaitTillClose()
+		if popErr != nil {
+			break
+		}
+		move(item)
+	}
+	return err
+}
+
+// checkQueue returns the error of the option `q` does not implement what it needs
+func (e *Engine) checkQueue(q common.QInterface) error {
+	if _, ok := q.(common.FilteredPopper); !ok && e.reservedWorkers > 0 {
+		return ErrReservationNotSupported
+	}
+	if _, ok := q.(common.CtxPopper); !ok && e.maxWorkers > 0 {
+		return ErrAutoscaleNotSupported
+	}
+	if _, ok := q.(common.Remover); !ok && e.reapable != nil {
+		return ErrRemoveNotSupported
+	}
+	if _, ok := q.(common.Pauser); !ok && e.paused {
+		return ErrPauseNotSupported
+	}
+	switch e.fullPolicy {
+	case FullBlock:
+		if _, ok := q.(common.CtxPusher); !ok {
+			return ErrFullPolicyNotSupported
+		}
+	case FullEvict:
+		if _, ok := q.(common.Evicter); !ok {
+			return ErrFullPolicyNotSupported
+		}
+	case FullShed:
+		if _, ok := q.(sizedQueue); !ok {
+			return ErrFullPolicyNotSupported
+		}
+	}
+	return nil
+}
+
+// queueRef wraps the queue, as `atomic.Value` only takes values of the same type
+type queueRef struct {
+	q common.QInterface
+}
+
+// queue returns the current queue, which may be swapped at any time, see `SwapQueue`
+func (e *Engine) queue() common.QInterface {
+	return e.q.Load().(queueRef).q
+}
+
+func (e *Engine) setQueue(q common.QInterface) {
+	e.q.Store(queueRef{q: q})
+}
+
+// swappedSince returns true if `err` is from a queue swapped out since `swaps` is loaded,
+// so whatever failed should be tried again on the new queue
+func (e *Engine) swappedSince(swaps uint64, err error) bool {
+	return errors.Is(err, common.ErrQueueIsClosed) && atomic.LoadUint64(&e.swaps) != swaps
+}
+
+// retrySwapped calls `push` with the current queue,
+// again as long as it fails because that queue is swapped out in the meantime
+func (e *Engine) retrySwapped(push func(q common.QInterface) error) error {
+	for {
+		swaps := atomic.LoadUint64(&e.swaps)
+		err := push(e.queue())
+		if !e.swappedSince(swaps, err) {
+			return err
+		}
+	}
+}
+
+// waitSwap waits for a swap in progress, so closing gets the new queue
+func (e *Engine) waitSwap() {
+	e.swapMu.Lock()
+	e.swapMu.Unlock()
+}
@@ -0,0 +1,118 @@
+package prioritize
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/fair"
+	"github.com/aarondwi/prioritize/priority"
+)
+
+func TestEngineSwapQueue(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 4)
+	engine, _ := New(pq, 1)
+
+	gate := make(chan bool)
+	engine.Submit(context.Background(), 0, func(ctx context.Context, arg interface{}) (interface{}, error) {
+		<-gate
+		return nil, nil
+	}, nil)
+	for engine.Len() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	fn := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		return arg, nil
+	}
+	tasks := make([]*Task, 0, 20)
+	for i := 0; i < 10; i++ {
+		task, _ := engine.Submit(context.Background(), i%4, fn, i)
+		tasks = append(tasks, task)
+	}
+
+	fq, _ := fair.NewFairQueue(2048, 4)
+	if err := engine.SwapQueue(fq); err != nil {
+		t.Fatalf("It should swap the queue, but instead we got %v", err)
+	}
+	if pq.Len() != 0 || fq.Len() != 10 || engine.Len() != 10 {
+		t.Fatalf("Expected the queued tasks to be moved, but instead we got %d, %d and %d", pq.Len(), fq.Len(), engine.Len())
+	}
+	for i := 10; i < 20; i++ {
+		task, err := engine.Submit(context.Background(), i%4, fn, i)
+		if err != nil {
+			t.Fatalf("It should accept submissions into the new queue, but instead we got %v", err)
+		}
+		tasks = append(tasks, task)
+	}
+	if fq.Len() != 20 {
+		t.Fatalf("Expected new submissions in the new queue, but instead we got %d", fq.Len())
+	}
+
+	close(gate)
+	for i, task := range tasks {
+		if result, err := task.Result(); err != nil || result.(int) != i {
+			t.Fatalf("Expected %d, but instead we got %v and %v", i, result, err)
+		}
+	}
+
+	engine.CloseGracefully()
+	if err := engine.SwapQueue(pq); err == nil || err != ErrAlreadyClosed {
+		t.Fatalf("It should return ErrAlreadyClosed, but instead we got %v", err)
+	}
+}
+
+func TestEngineSwapQueueNotSupported(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 4)
+	engine, _ := New(pq, 2, WithReservedWorkers(1, 2))
+	fq, _ := fair.NewFairQueue(2048, 4)
+	if err := engine.SwapQueue(fq); err == nil || err != ErrReservationNotSupported {
+		t.Fatalf("It should return ErrReservationNotSupported, but instead we got %v", err)
+	}
+	engine.Close()
+
+	tenants, _ := NewWithTenants(func() (common.QInterface, error) {
+		return fair.NewFairQueue(2048, 4)
+	}, nil, 1)
+	if err := tenants.SwapQueue(fq); err == nil || err != ErrSwapNotSupported {
+		t.Fatalf("It should return ErrSwapNotSupported, but instead we got %v", err)
+	}
+	tenants.Close()
+}
+
+func TestEngineSwapQueuePausedAndFull(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 4)
+	engine, _ := New(pq, 1)
+	engine.Pause()
+
+	fn := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		return arg, nil
+	}
+	tasks := make([]*Task, 0, 3)
+	for i := 0; i < 3; i++ {
+		task, _ := engine.Submit(context.Background(), 3-i, fn, i)
+		tasks = append(tasks, task)
+	}
+
+	// only room for 2, the highest priorities go first
+	fq, _ := fair.NewFairQueue(2, 4)
+	if err := engine.SwapQueue(fq); !errors.Is(err, common.ErrQueueIsFull) {
+		t.Fatalf("It should return ErrQueueIsFull, but instead we got %v", err)
+	}
+	if _, err := tasks[2].Result(); !errors.Is(err, common.ErrQueueIsFull) {
+		t.Fatalf("It should complete the task not fitting with ErrQueueIsFull, but instead we got %v", err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if fq.Len() != 2 || engine.Len() != 2 {
+		t.Fatalf("It should stay paused, but instead we got %d and %d queued", fq.Len(), engine.Len())
+	}
+	engine.Resume()
+	for i, task := range tasks[:2] {
+		if result, err := task.Result(); err != nil || result.(int) != i {
+			t.Fatalf("Expected %d, but instead we got %v and %v", i, result, err)
+		}
+	}
+	engine.Close()
+}
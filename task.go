@@ -1,62 +1,225 @@
-package prioritize
-
-import (
-	"context"
-	"sync"
-)
-
-// TaskFunc is our interface, to be implemented by user
-type TaskFunc func(context.Context, interface{}) (interface{}, error)
-
-// Task is the main object that prioritize schedules.
-// It is is basically a `promise` implementation.
-type Task struct {
-	ctx      context.Context
-	priority int
-	fn       TaskFunc
-	arg      interface{}
-	wg       *sync.WaitGroup
-	result   interface{}
-	err      error
-}
-
-// newTask creates a prioritize.Task object with the given parameter
-//
-// I don't think, currently, exposing this to public is good idea.
-// If it is published, I would be tempted to make `GetTask` and `PutTask` API,
-// because pooling will make this library faster.
-//
-// But that also opens a bad chance for user to misuse the api (waiting for already-put Task, etc)
-// which would make a lot more problem to explain.
-func newTask(
-	ctx context.Context,
-	priority int,
-	fn TaskFunc,
-	arg interface{}) *Task {
-	wg := &sync.WaitGroup{}
-	wg.Add(1)
-	return &Task{
-		ctx:      ctx,
-		priority: priority,
-		fn:       fn,
-		arg:      arg,
-		wg:       wg,
-		result:   nil,
-		err:      nil,
-	}
-}
-
-func (t *Task) set(result interface{}, err error) {
-	t.result = result
-	t.err = err
-	t.wg.Done()
-}
-
-// Result waits until the Task object completes
-func (t *Task) Result() (interface{}, error) {
-	t.wg.Wait()
-	if t.err != nil {
-		return nil, t.err
-	}
-	return t.result, nil
-}
+package prioritize
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+)
+
+// TaskFunc is our interface, to be implemented by user
+type TaskFunc func(context.Context, interface{}) (interface{}, error)
+
+// Task is the main object that prioritize schedules.
+// It is is basically a `promise` implementation.
+type Task struct {
+	id       uint64
+	ctx      context.Context
+	priority int
+	fn       TaskFunc
+	arg      interface{}
+	done     chan struct{}
+	status   int32
+	result   interface{}
+	err      error
+
+	// only set if this task is sampled for telemetry
+	enqueuedAt time.Time
+	// how long its fn ran last time, guarded by mu
+	ran time.Duration
+	// last reported by its fn, guarded by mu, see `ReportProgress`
+	progress float64
+	stage    string
+	// the ctx its fn runs with, see `Task.start`
+	runCtx runContext
+
+	// only set with `WithTracer`, see `SpanTask`
+	span Span
+
+	// only set with `WithMaxQueueWait`, fires when the task waits too long
+	expiry *time.Timer
+
+	// only set with `Engine.SubmitWithCallback`
+	onComplete func(result interface{}, err error)
+	// only set with `Engine.SubmitStream`
+	stream *stream
+
+	// how it is put into the queue, and how many times it has been, see `WithRetry`.
+	// If nil, it is put with `Engine.push`.
+	push     func(common.QItem) error
+	attempts int
+	// put back into the pool once completed, see `Engine.SubmitAndNotify`
+	recycle bool
+
+	// the engine it is submitted to, see `Cancel`
+	engine *Engine
+	// guards cancel, and completing while it is set, see `Engine.Cancel`
+	mu        sync.Mutex
+	cancel    context.CancelFunc
+	completed int32
+	// 1 while its item is in the queue, or held by the engine, see `Engine.track`
+	inQueue int32
+
+	// tasks this one waits for, see `Engine.DeclareDependency`.
+	// Guarded by the engine lock.
+	dependencies []*Task
+}
+
+var taskPool = sync.Pool{
+	New: func() interface{} {
+		return &Task{}
+	},
+}
+
+// newTask creates a prioritize.Task object with the given parameter.
+// If `recycle` is true, it has no done channel, and is put back into the pool once completed.
+//
+// I don't think, currently, exposing this to public is good idea.
+// If it is published, I would be tempted to make `GetTask` and `PutTask` API,
+// because pooling will make this library faster.
+//
+// But that also opens a bad chance for user to misuse the api (waiting for already-put Task, etc)
+// which would make a lot more problem to explain.
+// So only tasks nobody has a handle to are recycled, see `Engine.SubmitAndNotify`.
+func newTask(
+	ctx context.Context,
+	priority int,
+	fn TaskFunc,
+	arg interface{},
+	recycle bool) *Task {
+	t := taskPool.Get().(*Task)
+	t.ctx = ctx
+	t.priority = priority
+	t.fn = fn
+	t.arg = arg
+	t.recycle = recycle
+	if !recycle {
+		t.done = make(chan struct{})
+	}
+	return t
+}
+
+// putTask puts a completed task back into the pool, see `Engine.SubmitAndNotify`
+func putTask(t *Task) {
+	*t = Task{}
+	taskPool.Put(t)
+}
+
+// markCompleted returns false if the Task is already completed (e.g. cancelled),
+// so only the first one calling it can `set` it.
+func (t *Task) markCompleted() bool {
+	return atomic.CompareAndSwapInt32(&t.completed, 0, 1)
+}
+
+func (t *Task) set(result interface{}, err error) {
+	t.result = result
+	t.err = err
+	switch err {
+	case nil:
+		atomic.StoreInt32(&t.status, int32(TaskSucceeded))
+	case ErrTaskCancelled, ErrCtxAlreadyCancelled:
+		atomic.StoreInt32(&t.status, int32(TaskCancelled))
+	default:
+		atomic.StoreInt32(&t.status, int32(TaskFailed))
+	}
+	if t.done != nil {
+		close(t.done)
+	}
+}
+
+// setRan records how long fn ran, for whoever completes the Task
+func (t *Task) setRan(ran time.Duration) {
+	t.mu.Lock()
+	t.ran = ran
+	t.mu.Unlock()
+}
+
+// ID returns the ID of the Task, unique inside its engine.
+// With `WithResultStore`, it can be used to fetch the result later, see `Engine.LookupResult`.
+func (t *Task) ID() uint64 {
+	return t.id
+}
+
+// Priority returns the priority the Task is submitted with,
+// or boosted to, see `Engine.DeclareDependency`
+func (t *Task) Priority() int {
+	t.engine.RLock()
+	defer t.engine.RUnlock()
+	return t.priority
+}
+
+// Arg returns the arg the Task is submitted with, e.g. to persist a failed one, see `WithDeadletter`
+func (t *Task) Arg() interface{} {
+	return t.arg
+}
+
+// Done returns a channel which is closed once the Task completes,
+// so it can be waited on together with other channels, before calling `Result()`.
+func (t *Task) Done() <-chan struct{} {
+	return t.done
+}
+
+// TaskStatus is where a Task is in its lifecycle, see `Task.Status`
+type TaskStatus int32
+
+// The statuses of a Task, in the order it goes through them
+const (
+	// TaskQueued is waiting for a worker, or to be retried, see `WithRetry`
+	TaskQueued TaskStatus = iota
+	// TaskRunning is taken by a worker, and its fn is running
+	TaskRunning
+	// TaskSucceeded has completed without error
+	TaskSucceeded
+	// TaskFailed has completed with an error, returned by its fn or the engine
+	TaskFailed
+	// TaskCancelled has completed with `ErrTaskCancelled` or `ErrCtxAlreadyCancelled`
+	TaskCancelled
+)
+
+func (s TaskStatus) String() string {
+	switch s {
+	case TaskQueued:
+		return "queued"
+	case TaskRunning:
+		return "running"
+	case TaskSucceeded:
+		return "succeeded"
+	case TaskFailed:
+		return "failed"
+	case TaskCancelled:
+		return "cancelled"
+	}
+	return "unknown"
+}
+
+// Status returns where the Task is right now, without waiting
+func (t *Task) Status() TaskStatus {
+	return TaskStatus(atomic.LoadInt32(&t.status))
+}
+
+// requeued marks a running Task as queued again, unless it is completed in the meantime
+func (t *Task) requeued() {
+	atomic.CompareAndSwapInt32(&t.status, int32(TaskRunning), int32(TaskQueued))
+}
+
+// Result waits until the Task object completes
+func (t *Task) Result() (interface{}, error) {
+	<-t.done
+	if t.err != nil {
+		return nil, t.err
+	}
+	return t.result, nil
+}
+
+// ResultWithContext is the same as `Result`, but stops waiting once `ctx` is done,
+// returning `ctx.Err()`. The Task itself is left as is, use `Cancel` to stop it too.
+func (t *Task) ResultWithContext(ctx context.Context) (interface{}, error) {
+	select {
+	case <-t.done:
+		return t.Result()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
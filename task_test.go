@@ -0,0 +1,77 @@
+package prioritize
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aarondwi/prioritize/priority"
+)
+
+func TestTaskDoneAndStatus(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	engine, _ := New(pq, 1)
+	defer engine.Close()
+
+	started := make(chan struct{})
+	block := make(chan struct{})
+	running, _ := engine.Submit(context.Background(), 0,
+		func(ctx context.Context, arg interface{}) (interface{}, error) {
+			close(started)
+			<-block
+			return nil, errors.New("failing")
+		}, nil)
+	<-started
+	queued, _ := engine.Submit(context.Background(), 0,
+		func(ctx context.Context, arg interface{}) (interface{}, error) {
+			return arg, nil
+		}, 1)
+	cancelled, _ := engine.Submit(context.Background(), 0,
+		func(ctx context.Context, arg interface{}) (interface{}, error) {
+			return arg, nil
+		}, 2)
+	cancelled.Cancel()
+
+	if running.Status() != TaskRunning || queued.Status() != TaskQueued {
+		t.Fatalf("Expected running and queued, but instead we got %v and %v", running.Status(), queued.Status())
+	}
+	select {
+	case <-queued.Done():
+		t.Fatal("It should not be done yet, but it is")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	close(block)
+	<-queued.Done()
+	if running.Status() != TaskFailed || queued.Status() != TaskSucceeded || cancelled.Status() != TaskCancelled {
+		t.Fatalf("Expected failed, succeeded and cancelled, but instead we got %v, %v and %v",
+			running.Status(), queued.Status(), cancelled.Status())
+	}
+}
+
+func TestTaskResultWithContext(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	engine, _ := New(pq, 1)
+	defer engine.Close()
+
+	block := make(chan struct{})
+	task, _ := engine.Submit(context.Background(), 0,
+		func(ctx context.Context, arg interface{}) (interface{}, error) {
+			<-block
+			return arg, nil
+		}, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := task.ResultWithContext(ctx)
+	if err == nil || err != context.DeadlineExceeded {
+		t.Fatalf("It should give up waiting, but instead we got %v", err)
+	}
+
+	close(block)
+	result, err := task.ResultWithContext(context.Background())
+	if err != nil || result.(int) != 1 {
+		t.Fatalf("Expected 1, but instead we got %v and %v", result, err)
+	}
+}
@@ -0,0 +1,37 @@
+package prioritize
+
+import (
+	"sync"
+	"time"
+)
+
+// ewma is an exponentially weighted moving average of durations.
+//
+// This struct is thread(goroutine)-safe.
+type ewma struct {
+	mu          sync.Mutex
+	alpha       float64
+	value       float64
+	initialized bool
+}
+
+func newEWMA(alpha float64) *ewma {
+	return &ewma{alpha: alpha}
+}
+
+func (a *ewma) observe(d time.Duration) {
+	a.mu.Lock()
+	if !a.initialized {
+		a.value = float64(d)
+		a.initialized = true
+	} else {
+		a.value = a.alpha*float64(d) + (1-a.alpha)*a.value
+	}
+	a.mu.Unlock()
+}
+
+func (a *ewma) get() time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return time.Duration(a.value)
+}
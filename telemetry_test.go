@@ -0,0 +1,21 @@
+package prioritize
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEWMA(t *testing.T) {
+	a := newEWMA(0.5)
+	if a.get() != 0 {
+		t.Fatalf("It should be 0 before any observation, but instead we got %v", a.get())
+	}
+	a.observe(100 * time.Millisecond)
+	if a.get() != 100*time.Millisecond {
+		t.Fatalf("First observation should be taken as is, but instead we got %v", a.get())
+	}
+	a.observe(200 * time.Millisecond)
+	if a.get() != 150*time.Millisecond {
+		t.Fatalf("It should move halfway to 200ms, but instead we got %v", a.get())
+	}
+}
@@ -0,0 +1,264 @@
+package prioritize
+
+import (
+	"context"
+	"sync"
+
+	"github.com/aarondwi/prioritize/common"
+)
+
+// tenantQueue is the queue used by an engine created with `NewWithTenants`.
+//
+// Each tenant gets its own sub-queue, and pops are distributed between tenants
+// using smooth weighted round robin, so a tenant with weight 3
+// gets 3 times as many pops as a tenant with weight 1, when both are busy.
+// Inside a tenant, the order follows its sub-queue (e.g. by priority).
+//
+// Just like the priority queues, we track the number of items of each tenant here,
+// so popping from the chosen sub-queue never waits.
+// A tenant is forgotten (and its sub-queue closed) once it has no item left,
+// so a stream of distinct tenants doesn't grow the queue without bound.
+type tenantQueue struct {
+	mu       *sync.Mutex
+	notEmpty *sync.Cond
+
+	newQueue func() (common.QInterface, error)
+	weights  map[string]int
+
+	// order keeps tenants in creation order, so ties are broken consistently
+	tenants map[string]*tenantState
+	order   []*tenantState
+
+	size     int
+	running  bool
+	draining bool
+}
+
+type tenantState struct {
+	name          string
+	q             common.QInterface
+	weight        int
+	currentWeight int
+	pending       int
+	// pops counted out of `pending`, not yet returned by the sub-queue
+	popping int
+}
+
+func newTenantQueue(
+	newQueue func() (common.QInterface, error),
+	weights map[string]int) (*tenantQueue, error) {
+
+	for _, w := range weights {
+		if w <= 0 {
+			return nil, common.ErrParamShouldBePositive
+		}
+	}
+
+	mu := &sync.Mutex{}
+	return &tenantQueue{
+		mu:       mu,
+		notEmpty: sync.NewCond(mu),
+		newQueue: newQueue,
+		weights:  weights,
+		tenants:  make(map[string]*tenantState),
+		running:  true,
+	}, nil
+}
+
+// PushOrError puts the item into the default tenant
+func (tq *tenantQueue) PushOrError(item common.QItem) error {
+	return tq.pushForTenant("", item)
+}
+
+func (tq *tenantQueue) pushForTenant(tenant string, item common.QItem) error {
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+	if !tq.running || tq.draining {
+		return common.ErrQueueIsClosed
+	}
+
+	ts, ok := tq.tenants[tenant]
+	if !ok {
+		q, err := tq.newQueue()
+		if err != nil {
+			return err
+		}
+		weight, ok := tq.weights[tenant]
+		if !ok {
+			weight = 1
+		}
+		ts = &tenantState{name: tenant, q: q, weight: weight}
+		tq.tenants[tenant] = ts
+		tq.order = append(tq.order, ts)
+	}
+
+	// pushed while holding our lock,
+	// so `pending` never counts an item the sub-queue doesn't have
+	err := ts.q.PushOrError(item)
+	if err != nil {
+		return err
+	}
+	ts.pending++
+	tq.size++
+	tq.notEmpty.Signal()
+	return nil
+}
+
+// PopOrWaitTillClose returns 1 QItem from the next tenant, or waits if none exists
+func (tq *tenantQueue) PopOrWaitTillClose() (common.QItem, error) {
+	return tq.PopOrWaitCtx(context.Background())
+}
+
+// PopOrWaitCtx is the same as PopOrWaitTillClose,
+// but also returns `ctx.Err()` once `ctx` is done while waiting
+func (tq *tenantQueue) PopOrWaitCtx(ctx context.Context) (common.QItem, error) {
+	tq.mu.Lock()
+	if !tq.running {
+		tq.mu.Unlock()
+		return common.MinQItem, common.ErrQueueIsClosed
+	}
+	if tq.size == 0 {
+		defer common.WakeOnDone(ctx, tq.notEmpty)()
+	}
+	for tq.size == 0 {
+		if tq.draining {
+			tq.closeLocked()
+			tq.mu.Unlock()
+			return common.MinQItem, common.ErrQueueIsClosed
+		}
+		if err := ctx.Err(); err != nil {
+			tq.mu.Unlock()
+			return common.MinQItem, err
+		}
+		tq.notEmpty.Wait()
+		// double check, ensuring see the changes after wait call
+		if !tq.running {
+			tq.mu.Unlock()
+			return common.MinQItem, common.ErrQueueIsClosed
+		}
+	}
+
+	// smooth weighted round robin, only between tenants having items
+	var chosen *tenantState
+	total := 0
+	for _, ts := range tq.order {
+		if ts.pending == 0 {
+			continue
+		}
+		ts.currentWeight += ts.weight
+		total += ts.weight
+		if chosen == nil || ts.currentWeight > chosen.currentWeight {
+			chosen = ts
+		}
+	}
+	chosen.currentWeight -= total
+	chosen.pending--
+	chosen.popping++
+	tq.size--
+	if tq.draining && tq.size == 0 {
+		tq.closeLocked()
+	}
+	tq.mu.Unlock()
+
+	// don't hold our lock here,
+	// as the sub-queue may still wait, e.g. because of its rate limit
+	item, err := chosen.q.PopOrWaitTillClose()
+
+	tq.mu.Lock()
+	chosen.popping--
+	tq.forgetIfEmptyLocked(chosen)
+	tq.mu.Unlock()
+	return item, err
+}
+
+// forgetIfEmptyLocked removes `ts` once it has no item left, nor pops in progress.
+// Pushing for it again creates a new sub-queue.
+func (tq *tenantQueue) forgetIfEmptyLocked(ts *tenantState) {
+	if ts.pending > 0 || ts.popping > 0 || tq.tenants[ts.name] != ts {
+		return
+	}
+	delete(tq.tenants, ts.name)
+	for i, other := range tq.order {
+		if other == ts {
+			tq.order = append(tq.order[:i], tq.order[i+1:]...)
+			break
+		}
+	}
+	ts.q.Close()
+}
+
+// Remove takes out the item with `id` from whichever tenant has it.
+// Sub-queues not implementing `common.Remover` are skipped.
+func (tq *tenantQueue) Remove(id uint64) (common.QItem, error) {
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+	if !tq.running {
+		return common.MinQItem, common.ErrQueueIsClosed
+	}
+
+	for _, ts := range tq.order {
+		// items not counted in `pending` are reserved for pops in progress
+		if ts.pending == 0 {
+			continue
+		}
+		remover, ok := ts.q.(common.Remover)
+		if !ok {
+			continue
+		}
+		item, err := remover.Remove(id)
+		if err == common.ErrItemNotFound || err == common.ErrNotSupported {
+			continue
+		}
+		if err != nil {
+			return common.MinQItem, err
+		}
+		ts.pending--
+		tq.size--
+		if tq.draining && tq.size == 0 {
+			tq.closeLocked()
+		}
+		tq.forgetIfEmptyLocked(ts)
+		return item, nil
+	}
+	return common.MinQItem, common.ErrItemNotFound
+}
+
+// Close closes all sub-queues right away
+func (tq *tenantQueue) Close() error {
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+	if !tq.running && !tq.draining {
+		return common.ErrQueueIsClosed
+	}
+	tq.running = false
+	tq.draining = false
+	for _, ts := range tq.order {
+		ts.q.Close()
+	}
+	tq.notEmpty.Broadcast()
+	return nil
+}
+
+// CloseGracefully stops accepting new items,
+// but keeps returning the remaining ones of all tenants
+func (tq *tenantQueue) CloseGracefully() {
+	tq.mu.Lock()
+	if tq.running {
+		tq.draining = true
+		for _, ts := range tq.order {
+			ts.q.CloseGracefully()
+		}
+		if tq.size == 0 {
+			tq.closeLocked()
+		}
+	}
+	tq.mu.Unlock()
+}
+
+// closeLocked only stops our own waiting pops.
+// Sub-queues are already closing gracefully,
+// so items already counted out of `size` can still be popped from them.
+func (tq *tenantQueue) closeLocked() {
+	tq.running = false
+	tq.notEmpty.Broadcast()
+}
@@ -0,0 +1,127 @@
+package prioritize
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/fair"
+	"github.com/aarondwi/prioritize/priority"
+)
+
+func newFairQueueForTenant() (common.QInterface, error) {
+	return fair.NewFairQueue(2048, 16)
+}
+
+func TestEngineWithTenantsValidation(t *testing.T) {
+	_, err := NewWithTenants(newFairQueueForTenant, nil, 0)
+	if err == nil || err != ErrNumOfWorkerIsNegativeOrZero {
+		t.Fatalf("It should error, cause number of worker is zero, instead we got %v", err)
+	}
+
+	_, err = NewWithTenants(newFairQueueForTenant, map[string]int{"a": 0}, 1)
+	if err == nil || err != common.ErrParamShouldBePositive {
+		t.Fatalf("It should error, cause weight is zero, instead we got %v", err)
+	}
+
+	pq, _ := priority.NewPriorityQueue(2048, 16)
+	engine, _ := New(pq, 1)
+	_, err = engine.SubmitForTenant(context.Background(), "a", 1, nil, nil)
+	if err == nil || err != ErrTenantsNotEnabled {
+		t.Fatalf("It should error, cause engine is not created with tenants, instead we got %v", err)
+	}
+	engine.Close()
+}
+
+func TestEngineWithTenantsWeighted(t *testing.T) {
+	engine, err := NewWithTenants(
+		newFairQueueForTenant, map[string]int{"a": 3, "b": 1}, 1)
+	if err != nil {
+		t.Fatalf("It should not error, because all are correct parameters, instead we got %v", err)
+	}
+
+	// block the only worker, so all tasks below are queued before any runs
+	started := make(chan bool)
+	gate := make(chan bool)
+	engine.Submit(context.Background(), 0,
+		func(ctx context.Context, arg interface{}) (interface{}, error) {
+			started <- true
+			<-gate
+			return nil, nil
+		}, nil)
+	<-started
+
+	mu := sync.Mutex{}
+	order := make([]string, 0, 16)
+	fn := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		mu.Lock()
+		order = append(order, arg.(string))
+		mu.Unlock()
+		return nil, nil
+	}
+
+	tasks := make([]*Task, 0, 16)
+	for i := 0; i < 8; i++ {
+		for _, tenant := range []string{"a", "b"} {
+			task, err := engine.SubmitForTenant(context.Background(), tenant, 1, fn, tenant)
+			if err != nil {
+				t.Fatalf("It should not error, because not closed yet, instead we got %v", err)
+			}
+			tasks = append(tasks, task)
+		}
+	}
+	close(gate)
+	for _, task := range tasks {
+		task.Result()
+	}
+
+	countA := 0
+	for _, tenant := range order[:8] {
+		if tenant == "a" {
+			countA++
+		}
+	}
+	if countA != 6 {
+		t.Fatalf("Tenant a should get 3 out of every 4 tasks, but instead we got order %v", order)
+	}
+	engine.CloseGracefully()
+}
+
+func TestTenantQueueForgetsDrainedTenants(t *testing.T) {
+	tq, _ := newTenantQueue(newFairQueueForTenant, map[string]int{"a": 3})
+	for i := 0; i < 100; i++ {
+		tq.pushForTenant(fmt.Sprintf("tenant-%d", i), common.QItem{ID: uint64(i), Priority: 1})
+	}
+	tq.pushForTenant("a", common.QItem{ID: 100, Priority: 1})
+	if len(tq.tenants) != 101 || len(tq.order) != 101 {
+		t.Fatalf("It should track 101 tenants, but instead we got %d", len(tq.tenants))
+	}
+
+	if _, err := tq.Remove(50); err != nil {
+		t.Fatalf("It should remove the item, but instead we got %v", err)
+	}
+	if _, ok := tq.tenants["tenant-50"]; ok || len(tq.order) != 100 {
+		t.Fatalf("It should forget the tenant whose only item is removed, but instead %d are left", len(tq.order))
+	}
+	for i := 0; i < 100; i++ {
+		if _, err := tq.PopOrWaitTillClose(); err != nil {
+			t.Fatalf("It should pop, but instead we got %v", err)
+		}
+	}
+	if len(tq.tenants) != 0 || len(tq.order) != 0 {
+		t.Fatalf("It should forget drained tenants, but instead %d are left", len(tq.tenants))
+	}
+
+	// pushing for a forgotten tenant starts over, with its configured weight
+	tq.pushForTenant("a", common.QItem{ID: 101, Priority: 1})
+	if ts := tq.tenants["a"]; ts == nil || ts.weight != 3 || ts.pending != 1 {
+		t.Fatalf("It should track tenant a again, but instead we got %v", ts)
+	}
+	item, err := tq.PopOrWaitTillClose()
+	if err != nil || item.ID != 101 {
+		t.Fatalf("It should pop the item of tenant a, but instead we got %v and %v", item, err)
+	}
+	tq.Close()
+}
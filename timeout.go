@@ -0,0 +1,71 @@
+package prioritize
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+)
+
+// ErrTaskTimedOut is returned when a task runs longer than the timeout given with `SubmitWithTimeout`
+var ErrTaskTimedOut = errors.New("Task runs longer than its timeout")
+
+// SubmitWithTimeout is the same as `Submit`, but the task can only run for `timeout`.
+//
+// Its ctx is cancelled once `timeout` passes, and its `Result()` returns `ErrTaskTimedOut`,
+// even if fn ignores its ctx and keeps running. In that case, the worker doesn't wait for it,
+// and takes the next task, while fn is left to finish in its own goroutine,
+// so count those with `TimedOutTasks`. The timeout only starts once a worker takes the task.
+func (e *Engine) SubmitWithTimeout(
+	ctx context.Context,
+	priority int,
+	timeout time.Duration,
+	fn TaskFunc,
+	arg interface{}) (*Task, error) {
+
+	if timeout <= 0 {
+		return nil, common.ErrParamShouldBePositive
+	}
+	return e.Submit(ctx, priority, e.withTimeout(timeout, fn), arg)
+}
+
+type taskOutcome struct {
+	result interface{}
+	err    error
+}
+
+// withTimeout wraps `fn`, running it in its own goroutine,
+// so the caller can give up on it after `timeout`.
+func (e *Engine) withTimeout(timeout time.Duration, fn TaskFunc) TaskFunc {
+	return func(ctx context.Context, arg interface{}) (interface{}, error) {
+		timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		// buffered, so fn's goroutine can exit even if nobody waits anymore
+		done := make(chan taskOutcome, 1)
+		go func() {
+			result, err := fn(timeoutCtx, arg)
+			done <- taskOutcome{result, err}
+		}()
+
+		select {
+		case outcome := <-done:
+			return outcome.result, outcome.err
+		case <-timeoutCtx.Done():
+			if err := ctx.Err(); err != nil {
+				// cancelled by the submitter, not timed out
+				return nil, err
+			}
+			atomic.AddUint64(&e.timedOut, 1)
+			return nil, ErrTaskTimedOut
+		}
+	}
+}
+
+// TimedOutTasks returns how many tasks have run longer than their timeout,
+// see `SubmitWithTimeout`
+func (e *Engine) TimedOutTasks() uint64 {
+	return atomic.LoadUint64(&e.timedOut)
+}
@@ -0,0 +1,64 @@
+package prioritize
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/priority"
+)
+
+func TestEngineSubmitWithTimeout(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	engine, _ := New(pq, 1)
+	defer engine.Close()
+
+	fn := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		return arg, nil
+	}
+	_, err := engine.SubmitWithTimeout(context.Background(), 0, 0, fn, 1)
+	if !errors.Is(err, common.ErrParamShouldBePositive) {
+		t.Fatalf("It should error, cause timeout can't be zero, instead we got %v", err)
+	}
+
+	task, _ := engine.SubmitWithTimeout(context.Background(), 0, time.Second, fn, 1)
+	if result, err := task.Result(); err != nil || result.(int) != 1 {
+		t.Fatalf("Expected 1, but instead we got %v and %v", result, err)
+	}
+
+	// ignores its ctx
+	hung := make(chan struct{})
+	defer close(hung)
+	task, _ = engine.SubmitWithTimeout(context.Background(), 0, 20*time.Millisecond,
+		func(ctx context.Context, arg interface{}) (interface{}, error) {
+			<-hung
+			return arg, nil
+		}, 2)
+	_, err = task.Result()
+	if err == nil || err != ErrTaskTimedOut {
+		t.Fatalf("It should return ErrTaskTimedOut, but instead we got %v", err)
+	}
+	if engine.TimedOutTasks() != 1 {
+		t.Fatalf("Expected 1 timed out task, but instead we got %d", engine.TimedOutTasks())
+	}
+
+	// the only worker should not be pinned by the hung task
+	task, _ = engine.Submit(context.Background(), 0, fn, 3)
+	if result, err := task.Result(); err != nil || result.(int) != 3 {
+		t.Fatalf("Expected 3, but instead we got %v and %v", result, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	task, _ = engine.SubmitWithTimeout(ctx, 0, time.Second,
+		func(ctx context.Context, arg interface{}) (interface{}, error) {
+			cancel()
+			<-hung
+			return arg, nil
+		}, 4)
+	_, err = task.Result()
+	if err == nil || err != context.Canceled {
+		t.Fatalf("It should return context.Canceled, cause it is cancelled by the submitter, but instead we got %v", err)
+	}
+}
@@ -0,0 +1,245 @@
+package timepolicy
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+)
+
+// ErrInvalidWindow is returned when a window has no `Adjust`,
+// or its `Start`/`End` is outside of [0, 24h)
+var ErrInvalidWindow = errors.New("window should have Adjust, and Start/End within a day")
+
+// Window changes priorities during part of each day.
+//
+// `Start` and `End` are offsets from midnight, in the clock's location.
+// If `Start` is after `End`, the window wraps around midnight,
+// e.g. Start 22h and End 6h covers the night.
+type Window struct {
+	Start  time.Duration
+	End    time.Duration
+	Adjust func(priority int) int
+}
+
+func (w Window) contains(offset time.Duration) bool {
+	if w.Start <= w.End {
+		return offset >= w.Start && offset < w.End
+	}
+	return offset >= w.Start || offset < w.End
+}
+
+// Queue wraps another queue, adjusting the priority of each item
+// by the first window the clock is in when the item is pushed.
+// Items pushed outside of any window keep their priority.
+//
+// For example, batch work can be boosted during off-peak hours,
+// and suppressed during business hours.
+// The adjusted priority should be within the range of the wrapped queue,
+// else it is rejected with its error (e.g. `common.ErrPriorityOutOfRange`).
+//
+// This struct is thread(goroutine)-safe, if the wrapped queue is.
+type Queue struct {
+	q       common.QInterface
+	windows []Window
+	now     func() time.Time
+}
+
+// Option configures optional behavior of Queue
+type Option func(*Queue) error
+
+// WithClock makes the Queue read the time from `now`, instead of `time.Now`.
+// Mainly for testing.
+func WithClock(now func() time.Time) Option {
+	return func(tq *Queue) error {
+		tq.now = now
+		return nil
+	}
+}
+
+// New creates Queue wrapping `q`, with `windows` checked in order
+func New(q common.QInterface, windows []Window, opts ...Option) (*Queue, error) {
+	for _, w := range windows {
+		if w.Adjust == nil ||
+			w.Start < 0 || w.Start >= 24*time.Hour ||
+			w.End < 0 || w.End >= 24*time.Hour {
+			return nil, ErrInvalidWindow
+		}
+	}
+	tq := &Queue{
+		q:       q,
+		windows: windows,
+		now:     time.Now,
+	}
+	for _, opt := range opts {
+		if err := opt(tq); err != nil {
+			return nil, err
+		}
+	}
+	return tq, nil
+}
+
+// effectivePriority returns `priority` adjusted by the current window, if any
+func (tq *Queue) effectivePriority(priority int) int {
+	now := tq.now()
+	// from the wall clock, as a day is 23 or 25 hours long when DST changes
+	h, m, sec := now.Clock()
+	offset := time.Duration(h)*time.Hour + time.Duration(m)*time.Minute +
+		time.Duration(sec)*time.Second + time.Duration(now.Nanosecond())
+	for _, w := range tq.windows {
+		if w.contains(offset) {
+			return w.Adjust(priority)
+		}
+	}
+	return priority
+}
+
+// PushOrError adjusts the item's priority, then pushes it into the wrapped queue
+func (tq *Queue) PushOrError(item common.QItem) error {
+	item.Priority = tq.effectivePriority(item.Priority)
+	return tq.q.PushOrError(item)
+}
+
+// PushOrWaitCtx is the same as PushOrError, but waits for a slot while the wrapped queue is full,
+// if it implements `common.CtxPusher`, else it is the same as PushOrError
+func (tq *Queue) PushOrWaitCtx(ctx context.Context, item common.QItem) error {
+	item.Priority = tq.effectivePriority(item.Priority)
+	if pusher, ok := tq.q.(common.CtxPusher); ok {
+		return pusher.PushOrWaitCtx(ctx, item)
+	}
+	return tq.q.PushOrError(item)
+}
+
+// PopOrWaitTillClose pops from the wrapped queue.
+// The returned item has the adjusted priority.
+func (tq *Queue) PopOrWaitTillClose() (common.QItem, error) {
+	return tq.q.PopOrWaitTillClose()
+}
+
+// PopOrWaitCtx is the same as PopOrWaitTillClose, but also returns `ctx.Err()`
+// once `ctx` is done while waiting. If the wrapped queue does not implement
+// `common.CtxPopper`, it waits just like PopOrWaitTillClose.
+func (tq *Queue) PopOrWaitCtx(ctx context.Context) (common.QItem, error) {
+	if ctxPopper, ok := tq.q.(common.CtxPopper); ok {
+		return ctxPopper.PopOrWaitCtx(ctx)
+	}
+	return tq.q.PopOrWaitTillClose()
+}
+
+// TryPop pops from the wrapped queue without waiting,
+// or returns `common.ErrNotSupported` if it does not implement `common.TryPopper`
+func (tq *Queue) TryPop() (common.QItem, error) {
+	if popper, ok := tq.q.(common.TryPopper); ok {
+		return popper.TryPop()
+	}
+	return common.MinQItem, common.ErrNotSupported
+}
+
+// Peek returns the item at the head of the wrapped queue without removing it,
+// or `common.ErrNotSupported` if the wrapped queue can't peek
+func (tq *Queue) Peek() (common.QItem, error) {
+	if q, ok := tq.q.(interface{ Peek() (common.QItem, error) }); ok {
+		return q.Peek()
+	}
+	return common.MinQItem, common.ErrNotSupported
+}
+
+// PopBatchOrWaitTillClose pops several items if the wrapped queue implements
+// `common.BatchPopper`, else only 1 item
+func (tq *Queue) PopBatchOrWaitTillClose(max int) ([]common.QItem, error) {
+	if batchPopper, ok := tq.q.(common.BatchPopper); ok {
+		return batchPopper.PopBatchOrWaitTillClose(max)
+	}
+	item, err := tq.q.PopOrWaitTillClose()
+	if err != nil {
+		return nil, err
+	}
+	return []common.QItem{item}, nil
+}
+
+// UpdatePriority adjusts `newPriority` by the current window,
+// then updates it in the wrapped queue.
+// If the wrapped queue does not implement `common.PriorityUpdater`,
+// it returns `common.ErrNotSupported`.
+func (tq *Queue) UpdatePriority(id uint64, newPriority int) error {
+	updater, ok := tq.q.(common.PriorityUpdater)
+	if !ok {
+		return common.ErrNotSupported
+	}
+	return updater.UpdatePriority(id, tq.effectivePriority(newPriority))
+}
+
+// Remove takes out the item with `id` from the wrapped queue.
+// If the wrapped queue does not implement `common.Remover`,
+// it returns `common.ErrNotSupported`.
+func (tq *Queue) Remove(id uint64) (common.QItem, error) {
+	remover, ok := tq.q.(common.Remover)
+	if !ok {
+		return common.MinQItem, common.ErrNotSupported
+	}
+	return remover.Remove(id)
+}
+
+// Len returns the number of items in the wrapped queue, or 0 if it can't tell
+func (tq *Queue) Len() int {
+	if q, ok := tq.q.(interface{ Len() int }); ok {
+		return q.Len()
+	}
+	return 0
+}
+
+// Cap returns the capacity of the wrapped queue, or 0 if it can't tell
+func (tq *Queue) Cap() int {
+	if q, ok := tq.q.(interface{ Cap() int }); ok {
+		return q.Cap()
+	}
+	return 0
+}
+
+// DepthPerPriority returns the number of items in each priority of the wrapped queue,
+// or nil if it can't tell
+func (tq *Queue) DepthPerPriority() []int {
+	if q, ok := tq.q.(interface{ DepthPerPriority() []int }); ok {
+		return q.DepthPerPriority()
+	}
+	return nil
+}
+
+// WaitUntilEmpty waits until the wrapped queue holds no item,
+// or returns `common.ErrNotSupported` if it does not implement `common.EmptyWaiter`
+func (tq *Queue) WaitUntilEmpty(ctx context.Context) error {
+	waiter, ok := tq.q.(common.EmptyWaiter)
+	if !ok {
+		return common.ErrNotSupported
+	}
+	return waiter.WaitUntilEmpty(ctx)
+}
+
+// Close closes the wrapped queue
+func (tq *Queue) Close() error {
+	return tq.q.Close()
+}
+
+// IsClosed returns whether the wrapped queue is closed,
+// or false if it does not implement `common.ClosedNotifier`
+func (tq *Queue) IsClosed() bool {
+	if notifier, ok := tq.q.(common.ClosedNotifier); ok {
+		return notifier.IsClosed()
+	}
+	return false
+}
+
+// Closed returns the channel of the wrapped queue closed once it is closed,
+// or nil if it does not implement `common.ClosedNotifier`
+func (tq *Queue) Closed() <-chan struct{} {
+	if notifier, ok := tq.q.(common.ClosedNotifier); ok {
+		return notifier.Closed()
+	}
+	return nil
+}
+
+// CloseGracefully closes the wrapped queue gracefully
+func (tq *Queue) CloseGracefully() {
+	tq.q.CloseGracefully()
+}
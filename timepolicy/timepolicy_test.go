@@ -0,0 +1,156 @@
+package timepolicy
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/priority"
+	"github.com/aarondwi/prioritize/queuetest"
+)
+
+func TestNewErrors(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	_, err := New(pq, []Window{{Start: 0, End: time.Hour}})
+	if err == nil || err != ErrInvalidWindow {
+		t.Fatalf("It should error, cause Adjust is nil, but instead we got %v", err)
+	}
+	_, err = New(pq, []Window{{Start: 0, End: 24 * time.Hour, Adjust: func(p int) int { return p }}})
+	if err == nil || err != ErrInvalidWindow {
+		t.Fatalf("It should error, cause End is not within a day, but instead we got %v", err)
+	}
+}
+
+func TestQueueAdjustsByWindow(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	now := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	tq, err := New(pq, []Window{
+		// business hours, suppress everything
+		{Start: 9 * time.Hour, End: 17 * time.Hour, Adjust: func(p int) int { return 0 }},
+		// night, wrapping midnight, boost
+		{Start: 22 * time.Hour, End: 6 * time.Hour, Adjust: func(p int) int { return p + 4 }},
+	}, WithClock(func() time.Time { return now }))
+	if err != nil {
+		t.Fatalf("It should not error, because all are correct parameters, but instead we got %v", err)
+	}
+
+	tq.PushOrError(common.QItem{ID: 1, Priority: 3})
+	now = time.Date(2020, 1, 1, 18, 0, 0, 0, time.UTC)
+	tq.PushOrError(common.QItem{ID: 2, Priority: 2})
+	now = time.Date(2020, 1, 2, 1, 0, 0, 0, time.UTC)
+	tq.PushOrError(common.QItem{ID: 3, Priority: 1})
+	err = tq.PushOrError(common.QItem{ID: 4, Priority: 6})
+	if !errors.Is(err, common.ErrPriorityOutOfRange) {
+		t.Fatalf("It should error, cause adjusted priority is out of range, but instead we got %v", err)
+	}
+	if tq.Len() != 3 || tq.Cap() != 2048 {
+		t.Fatalf("It should pass through Len and Cap, but instead we got %d and %d", tq.Len(), tq.Cap())
+	}
+
+	expected := []common.QItem{{ID: 3, Priority: 5}, {ID: 2, Priority: 2}, {ID: 1, Priority: 0}}
+	for _, e := range expected {
+		item, err := tq.PopOrWaitTillClose()
+		if err != nil || item.ID != e.ID || item.Priority != e.Priority {
+			t.Fatalf("Expected %v, but instead we got %v and %v", e, item, err)
+		}
+	}
+	tq.Close()
+	_, err = tq.PopOrWaitTillClose()
+	if err == nil || err != common.ErrQueueIsClosed {
+		t.Fatalf("It should be closed, but instead we got %v", err)
+	}
+}
+
+func TestQueueAdjustsByWallClockOnDSTDays(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("It needs the time zone database, but instead we got %v", err)
+	}
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	// clocks go forward at 2am, so only 9 hours passed since midnight
+	now := time.Date(2020, 3, 8, 10, 30, 0, 0, loc)
+	tq, _ := New(pq, []Window{
+		{Start: 10 * time.Hour, End: 11 * time.Hour, Adjust: func(p int) int { return p + 1 }},
+	}, WithClock(func() time.Time { return now }))
+
+	tq.PushOrError(common.QItem{ID: 1, Priority: 1})
+	item, err := tq.PopOrWaitTillClose()
+	if err != nil || item.Priority != 2 {
+		t.Fatalf("It should be adjusted at 10:30 on the wall clock, but instead we got %v and %v", item, err)
+	}
+	tq.Close()
+}
+
+func TestQueueUnsupportedByWrappedQueue(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	// hides the methods of pq not in common.QInterface
+	tq, _ := New(struct{ common.QInterface }{pq}, []Window{{Start: 0, End: time.Hour, Adjust: func(p int) int { return p }}})
+	tq.PushOrError(common.QItem{ID: 1, Priority: 1})
+
+	if err := tq.UpdatePriority(1, 2); err == nil || err != common.ErrNotSupported {
+		t.Fatalf("It should return ErrNotSupported, cause the wrapped queue can't update priority, but instead we got %v", err)
+	}
+	if _, err := tq.Remove(1); err == nil || err != common.ErrNotSupported {
+		t.Fatalf("It should return ErrNotSupported, cause the wrapped queue can't remove, but instead we got %v", err)
+	}
+	tq.Close()
+}
+
+func TestQueueClosedNotifier(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	tq, _ := New(pq, []Window{{Start: 0, End: time.Hour, Adjust: func(p int) int { return p }}})
+
+	tq.CloseGracefully()
+	if !tq.IsClosed() {
+		t.Fatal("It should be closed, cause the wrapped queue is empty, but it is not")
+	}
+	<-tq.Closed()
+	if err := tq.Close(); err == nil || err != common.ErrQueueIsClosed {
+		t.Fatalf("It should return ErrQueueIsClosed, cause already closed, but instead we got %v", err)
+	}
+}
+
+func TestQueueWaitUntilEmpty(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(16, 8)
+	tq, _ := New(pq, []Window{{Start: 0, End: time.Hour, Adjust: func(p int) int { return p }}})
+	tq.PushOrError(common.QItem{ID: 1, Priority: 1})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- tq.WaitUntilEmpty(context.Background())
+	}()
+	tq.PopOrWaitTillClose()
+	if err := <-done; err != nil {
+		t.Fatalf("It should return once the wrapped queue is empty, but instead we got %v", err)
+	}
+
+	// hides the methods of pq not in common.QInterface
+	hidden, _ := New(struct{ common.QInterface }{pq}, []Window{{Start: 0, End: time.Hour, Adjust: func(p int) int { return p }}})
+	if err := hidden.WaitUntilEmpty(context.Background()); err == nil || err != common.ErrNotSupported {
+		t.Fatalf("It should return ErrNotSupported, cause the wrapped queue can't wait, but instead we got %v", err)
+	}
+}
+
+func TestQueueConformance(t *testing.T) {
+	queuetest.Run(t, func(sizeLimit int) (common.ExtendedQInterface, error) {
+		pq, err := priority.NewPriorityQueue(sizeLimit, 8)
+		if err != nil {
+			return nil, err
+		}
+		return New(pq, []Window{{Start: 0, End: time.Hour, Adjust: func(p int) int { return p }}})
+	})
+}
+
+func TestQueueExtendedQInterfaceUnsupportedByWrappedQueue(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	// hides the methods of pq not in common.QInterface
+	hidden, _ := New(struct{ common.QInterface }{pq}, []Window{{Start: 0, End: time.Hour, Adjust: func(p int) int { return p }}})
+	if _, err := hidden.TryPop(); err == nil || err != common.ErrNotSupported {
+		t.Fatalf("It should return ErrNotSupported, cause the wrapped queue can't try to pop, but instead we got %v", err)
+	}
+	if _, err := hidden.Peek(); err == nil || err != common.ErrNotSupported {
+		t.Fatalf("It should return ErrNotSupported, cause the wrapped queue can't peek, but instead we got %v", err)
+	}
+}
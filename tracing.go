@@ -0,0 +1,45 @@
+package prioritize
+
+import "context"
+
+// Tracer lets the engine trace tasks, e.g. with OpenTelemetry,
+// without the engine depending on any tracing library. See `WithTracer`.
+//
+// With OpenTelemetry, `Start` is a call to `trace.Tracer.Start`,
+// with the priority as an attribute, and `Span` wraps the returned `trace.Span`.
+type Tracer interface {
+	// Start starts a span named `name`, as a child of the span in `ctx`, if any,
+	// and returns a ctx carrying the new span.
+	Start(ctx context.Context, name string, priority int) (context.Context, Span)
+}
+
+// Span is a span started by a `Tracer`
+type Span interface {
+	// AddEvent records that `name` happens now
+	AddEvent(name string)
+	// End ends the span, with the error the traced work ends with, if any
+	End(err error)
+}
+
+// The names of spans and events the engine gives to its `Tracer`
+const (
+	// SpanTask covers a task from its submit until it completes
+	SpanTask = "prioritize.task"
+	// SpanRun covers each run of the fn of a task, as a child of its SpanTask
+	SpanRun = "prioritize.run"
+	// EventDequeued is added to SpanTask each time a worker takes the task,
+	// so the time since the span started (or since its previous SpanRun ended) is the queue wait
+	EventDequeued = "dequeued"
+)
+
+// WithTracer makes the engine trace each task with `tracer`.
+//
+// `Submit` starts a SpanTask, as a child of the span of its ctx, if any,
+// and the ctx given to fn carries a SpanRun, so spans started by fn are nested under it.
+// Tasks from `SubmitAndForget` only get a SpanRun, directly under the span of their ctx.
+func WithTracer(tracer Tracer) Option {
+	return func(e *Engine) error {
+		e.tracer = tracer
+		return nil
+	}
+}
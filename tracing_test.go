@@ -0,0 +1,86 @@
+package prioritize
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/aarondwi/prioritize/priority"
+)
+
+type spanKey struct{}
+
+type recordedSpan struct {
+	tracer   *recordingTracer
+	name     string
+	parent   *recordedSpan
+	priority int
+	events   []string
+	ended    bool
+	err      error
+}
+
+func (s *recordedSpan) AddEvent(name string) {
+	s.tracer.mu.Lock()
+	s.events = append(s.events, name)
+	s.tracer.mu.Unlock()
+}
+
+func (s *recordedSpan) End(err error) {
+	s.tracer.mu.Lock()
+	s.ended = true
+	s.err = err
+	s.tracer.mu.Unlock()
+}
+
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string, priority int) (context.Context, Span) {
+	parent, _ := ctx.Value(spanKey{}).(*recordedSpan)
+	span := &recordedSpan{tracer: t, name: name, parent: parent, priority: priority}
+	t.mu.Lock()
+	t.spans = append(t.spans, span)
+	t.mu.Unlock()
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func TestEngineWithTracer(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	tracer := &recordingTracer{}
+	engine, _ := New(pq, 1, WithTracer(tracer))
+	defer engine.Close()
+
+	caller := &recordedSpan{tracer: tracer, name: "caller"}
+	ctx := context.WithValue(context.Background(), spanKey{}, caller)
+	errFailing := errors.New("failing")
+	var inner *recordedSpan
+	task, _ := engine.Submit(ctx, 3, func(ctx context.Context, arg interface{}) (interface{}, error) {
+		inner = ctx.Value(spanKey{}).(*recordedSpan)
+		return nil, errFailing
+	}, nil)
+	task.Result()
+
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	if len(tracer.spans) != 2 {
+		t.Fatalf("Expected a task and a run span, but instead we got %d spans", len(tracer.spans))
+	}
+	taskSpan, runSpan := tracer.spans[0], tracer.spans[1]
+	if taskSpan.name != SpanTask || taskSpan.parent != caller || taskSpan.priority != 3 {
+		t.Fatalf("Expected the task span under the caller, but instead we got %+v", taskSpan)
+	}
+	if len(taskSpan.events) != 1 || taskSpan.events[0] != EventDequeued {
+		t.Fatalf("Expected the dequeued event, but instead we got %v", taskSpan.events)
+	}
+	if runSpan.name != SpanRun || runSpan.parent != taskSpan || inner != runSpan {
+		t.Fatalf("Expected fn to run inside a run span under the task span, but instead we got %+v", runSpan)
+	}
+	if !taskSpan.ended || taskSpan.err != errFailing || !runSpan.ended || runSpan.err != errFailing {
+		t.Fatalf("Expected both spans ended with errFailing, but instead we got %v and %v",
+			taskSpan.err, runSpan.err)
+	}
+}
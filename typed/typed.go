@@ -0,0 +1,122 @@
+// Package typed wraps `prioritize.Engine` with type parameters,
+// so task functions take their own argument type `A`, and results come back as `R`,
+// without type assertions in the caller.
+//
+// It is a thin layer over the untyped engine, so arguments and results
+// are still boxed into interface{} inside it.
+package typed
+
+import (
+	"context"
+
+	"github.com/aarondwi/prioritize"
+	"github.com/aarondwi/prioritize/common"
+)
+
+// TaskFunc is the typed version of `prioritize.TaskFunc`
+type TaskFunc[A, R any] func(ctx context.Context, arg A) (R, error)
+
+// Engine submits tasks taking `A`, and returning `R`, to an untyped engine.
+type Engine[A, R any] struct {
+	e *prioritize.Engine
+}
+
+// New creates a new untyped engine, see `prioritize.New`, and wraps it.
+func New[A, R any](q common.QInterface, numOfWorker int, opts ...prioritize.Option) (*Engine[A, R], error) {
+	e, err := prioritize.New(q, numOfWorker, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return Wrap[A, R](e), nil
+}
+
+// Wrap wraps an existing untyped engine, e.g. to share its workers between several types of task.
+func Wrap[A, R any](e *prioritize.Engine) *Engine[A, R] {
+	return &Engine[A, R]{e: e}
+}
+
+// Untyped returns the wrapped engine, e.g. to check its `Pressure()`, or close it
+func (te *Engine[A, R]) Untyped() *prioritize.Engine {
+	return te.e
+}
+
+// Submit is the typed version of `prioritize.Engine.Submit`
+func (te *Engine[A, R]) Submit(
+	ctx context.Context,
+	priority int,
+	fn TaskFunc[A, R],
+	arg A) (*Task[R], error) {
+
+	t, err := te.e.Submit(ctx, priority, untyped(fn), arg)
+	if err != nil {
+		return nil, err
+	}
+	return &Task[R]{t: t}, nil
+}
+
+// SubmitOrWait is the typed version of `prioritize.Engine.SubmitOrWait`
+func (te *Engine[A, R]) SubmitOrWait(
+	ctx context.Context,
+	priority int,
+	fn TaskFunc[A, R],
+	arg A) (*Task[R], error) {
+
+	t, err := te.e.SubmitOrWait(ctx, priority, untyped(fn), arg)
+	if err != nil {
+		return nil, err
+	}
+	return &Task[R]{t: t}, nil
+}
+
+func untyped[A, R any](fn TaskFunc[A, R]) prioritize.TaskFunc {
+	return func(ctx context.Context, arg interface{}) (interface{}, error) {
+		return fn(ctx, arg.(A))
+	}
+}
+
+// Task is the typed version of `prioritize.Task`
+type Task[R any] struct {
+	t *prioritize.Task
+}
+
+// Untyped returns the wrapped task
+func (t *Task[R]) Untyped() *prioritize.Task {
+	return t.t
+}
+
+// ID is the same as `prioritize.Task.ID`
+func (t *Task[R]) ID() uint64 {
+	return t.t.ID()
+}
+
+// Done is the same as `prioritize.Task.Done`
+func (t *Task[R]) Done() <-chan struct{} {
+	return t.t.Done()
+}
+
+// Status is the same as `prioritize.Task.Status`
+func (t *Task[R]) Status() prioritize.TaskStatus {
+	return t.t.Status()
+}
+
+// Cancel is the same as `prioritize.Task.Cancel`
+func (t *Task[R]) Cancel() error {
+	return t.t.Cancel()
+}
+
+// Result waits until the task completes, just like `prioritize.Task.Result`.
+// If there is an error, the result is the zero value of `R`.
+func (t *Task[R]) Result() (R, error) {
+	return typedResult[R](t.t.Result())
+}
+
+// ResultWithContext is the typed version of `prioritize.Task.ResultWithContext`
+func (t *Task[R]) ResultWithContext(ctx context.Context) (R, error) {
+	return typedResult[R](t.t.ResultWithContext(ctx))
+}
+
+func typedResult[R any](result interface{}, err error) (R, error) {
+	// a nil interface{} is not an R, but its zero value is what we want anyway
+	r, _ := result.(R)
+	return r, err
+}
@@ -0,0 +1,76 @@
+package typed
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/aarondwi/prioritize"
+	"github.com/aarondwi/prioritize/priority"
+)
+
+func TestEngine(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	_, err := New[int, string](pq, 0)
+	if err == nil || err != prioritize.ErrNumOfWorkerIsNegativeOrZero {
+		t.Fatalf("It should pass through the error of the untyped engine, but instead we got %v", err)
+	}
+
+	engine, err := New[int, string](pq, 1)
+	if err != nil {
+		t.Fatalf("It should not error, because all are correct parameters, instead we got %v", err)
+	}
+	defer engine.Untyped().Close()
+
+	task, err := engine.Submit(context.Background(), 0,
+		func(ctx context.Context, arg int) (string, error) {
+			return strconv.Itoa(arg), nil
+		}, 42)
+	if err != nil {
+		t.Fatalf("It should not error, instead we got %v", err)
+	}
+	result, err := task.Result()
+	if err != nil || result != "42" {
+		t.Fatalf("Expected \"42\", but instead we got %v and %v", result, err)
+	}
+	if task.Status() != prioritize.TaskSucceeded {
+		t.Fatalf("Expected succeeded, but instead we got %v", task.Status())
+	}
+
+	errFailing := errors.New("failing")
+	task, _ = engine.Submit(context.Background(), 0,
+		func(ctx context.Context, arg int) (string, error) {
+			return "ignored", errFailing
+		}, 1)
+	result, err = task.ResultWithContext(context.Background())
+	if err != errFailing || result != "" {
+		t.Fatalf("Expected errFailing and the zero value, but instead we got %q and %v", result, err)
+	}
+}
+
+func TestWrapSharesWorkers(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	e, _ := prioritize.New(pq, 1)
+	defer e.Close()
+
+	ints := Wrap[int, int](e)
+	errs := Wrap[string, error](e)
+	square, _ := ints.Submit(context.Background(), 0,
+		func(ctx context.Context, arg int) (int, error) {
+			return arg * arg, nil
+		}, 3)
+	parse, _ := errs.Submit(context.Background(), 0,
+		func(ctx context.Context, arg string) (error, error) {
+			_, err := strconv.Atoi(arg)
+			return err, nil
+		}, "1")
+
+	if result, err := square.Result(); err != nil || result != 9 {
+		t.Fatalf("Expected 9, but instead we got %v and %v", result, err)
+	}
+	// R is an interface, and the task returns a nil one
+	if result, err := parse.Result(); err != nil || result != nil {
+		t.Fatalf("Expected nil, but instead we got %v and %v", result, err)
+	}
+}
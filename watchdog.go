@@ -0,0 +1,57 @@
+package prioritize
+
+import (
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+)
+
+// StuckTaskSink is optionally implemented by a `MetricsSink`,
+// to also be told about stuck tasks, see `WithStuckTaskDetection`
+type StuckTaskSink interface {
+	// Stuck is called once per task, when its fn has been running for longer than the threshold
+	Stuck(priority int, id uint64, elapsed time.Duration)
+}
+
+// WithStuckTaskDetection starts a watchdog, checking every `threshold / 2`
+// for tasks whose fn has been running for `threshold` or longer.
+// Each is reported once, still running, as a warning to the logger (see `WithLogger`),
+// and to the metrics sink, if it implements `StuckTaskSink`.
+// The number of such tasks is also in `Stats().Stuck`.
+//
+// Unlike `WithSlowTaskThreshold`, this catches a wedged fn before it returns, if it ever does.
+func WithStuckTaskDetection(threshold time.Duration) Option {
+	return func(e *Engine) error {
+		if threshold <= 0 {
+			return common.ErrParamShouldBePositive
+		}
+		e.stuckThreshold = threshold
+		return nil
+	}
+}
+
+func (e *Engine) watchLoop() {
+	ticker := time.NewTicker(e.stuckThreshold / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.closeChan:
+			return
+		case now := <-ticker.C:
+			e.reportStuck(now)
+		}
+	}
+}
+
+// reportStuck reports tasks running for too long, outside the lock of the running tasks
+func (e *Engine) reportStuck(now time.Time) {
+	stuck := e.inflight.markStuck(now, e.stuckThreshold)
+	sink, _ := e.sink.(StuckTaskSink)
+	for _, rt := range stuck {
+		elapsed := now.Sub(rt.StartedAt)
+		e.logger.Warn("stuck task", "id", rt.ID, "priority", rt.Priority, "elapsed", elapsed)
+		if sink != nil {
+			sink.Stuck(rt.Priority, rt.ID, elapsed)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package prioritize
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/priority"
+)
+
+type stuckSink struct {
+	*recordingSink
+}
+
+func (s stuckSink) Stuck(priority int, id uint64, elapsed time.Duration) {
+	s.record("stuck", priority, nil)
+}
+
+func TestEngineWithStuckTaskDetection(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	_, err := New(pq, 1, WithStuckTaskDetection(0))
+	if !errors.Is(err, common.ErrParamShouldBePositive) {
+		t.Fatalf("It should error, cause the threshold is not positive, instead we got %v", err)
+	}
+
+	logger := &recordingLogger{}
+	sink := stuckSink{newRecordingSink()}
+	engine, err := New(pq, 1,
+		WithLogger(logger),
+		WithMetricsSink(sink),
+		WithStuckTaskDetection(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("It should not error, because all are correct parameters, instead we got %v", err)
+	}
+	defer engine.Close()
+
+	gate := make(chan bool)
+	task, _ := engine.Submit(context.Background(), 3, func(ctx context.Context, arg interface{}) (interface{}, error) {
+		<-gate
+		return nil, nil
+	}, nil)
+	for engine.Stats().Stuck != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	// reported only once, no matter how long it is stuck
+	time.Sleep(30 * time.Millisecond)
+	if logger.count("warn: stuck task") != 1 || sink.count("stuck", 3) != 1 {
+		t.Fatalf("Expected the stuck task to be reported once, but instead we got %v", logger.msgs)
+	}
+
+	close(gate)
+	task.Result()
+	if stuck := engine.Stats().Stuck; stuck != 0 {
+		t.Fatalf("Expected no stuck task once it returns, but instead we got %d", stuck)
+	}
+}
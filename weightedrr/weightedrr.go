@@ -0,0 +1,75 @@
+package weightedrr
+
+import (
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/policy"
+)
+
+// WeightedRoundRobinPriorityQueue is a queue in which
+// each non-empty priority gets up to weights[priority] pops per rotation,
+// going from the highest priority downwards, and then rolled back from highest.
+//
+// Unlike `fair.FairQueue`, in which every priority gets 1 pop per rotation,
+// this lets higher priorities get proportionally more,
+// while lower ones still get their turn every rotation, so they are never starved.
+//
+// Locking, waiting, and close semantics are the same as `policy.Queue`.
+type WeightedRoundRobinPriorityQueue struct {
+	*policy.Queue
+}
+
+// NewWeightedRoundRobinPriorityQueue creates our weighted round robin queue.
+//
+// It caps at sizeLimit, and allows priority [0,len(weights)),
+// in which all weights should be positive.
+func NewWeightedRoundRobinPriorityQueue(sizeLimit int, weights []int) (*WeightedRoundRobinPriorityQueue, error) {
+	if len(weights) == 0 {
+		return nil, common.ErrParamShouldBePositive
+	}
+	for _, w := range weights {
+		if w <= 0 {
+			return nil, common.ErrParamShouldBePositive
+		}
+	}
+
+	q, err := policy.NewQueue(sizeLimit, len(weights), &weightedPolicy{
+		weights: weights,
+		current: -1,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &WeightedRoundRobinPriorityQueue{Queue: q}, nil
+}
+
+// weightedPolicy implements `policy.Policy`.
+// It is only called under the queue lock, so it needs no lock itself.
+type weightedPolicy struct {
+	weights []int
+
+	// the priority being served, and how many pops it got in this turn
+	current int
+	served  int
+}
+
+func (wp *weightedPolicy) Next(depths []int) int {
+	if wp.current != -1 && depths[wp.current] > 0 && wp.served < wp.weights[wp.current] {
+		wp.served++
+		return wp.current
+	}
+
+	// move on to the next non-empty priority, going downwards
+	start := len(depths) - 1
+	if wp.current != -1 {
+		start = wp.current - 1 + len(depths)
+	}
+	for k := 0; k < len(depths); k++ {
+		i := (start - k) % len(depths)
+		if depths[i] > 0 {
+			wp.current = i
+			wp.served = 1
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,45 @@
+package weightedrr
+
+import (
+	"testing"
+
+	"github.com/aarondwi/prioritize/common"
+)
+
+func TestNewWeightedRoundRobinPriorityQueueErrors(t *testing.T) {
+	_, err := NewWeightedRoundRobinPriorityQueue(10, nil)
+	if err == nil || err != common.ErrParamShouldBePositive {
+		t.Fatalf("It should error, cause there is no weight, but instead we got %v", err)
+	}
+	_, err = NewWeightedRoundRobinPriorityQueue(10, []int{1, 0})
+	if err == nil || err != common.ErrParamShouldBePositive {
+		t.Fatalf("It should error, cause weight can't be zero, but instead we got %v", err)
+	}
+	_, err = NewWeightedRoundRobinPriorityQueue(0, []int{1, 2})
+	if err == nil || err != common.ErrParamShouldBePositive {
+		t.Fatalf("It should error, cause sizeLimit can't be zero, but instead we got %v", err)
+	}
+}
+
+func TestWeightedRoundRobinPriorityQueue(t *testing.T) {
+	q, _ := NewWeightedRoundRobinPriorityQueue(2048, []int{1, 2, 3})
+	for i := 0; i < 5; i++ {
+		for p := 0; p < 3; p++ {
+			q.PushOrError(common.QItem{ID: uint64(i*3 + p), Priority: p})
+		}
+	}
+
+	// 3 of priority 2, 2 of priority 1, 1 of priority 0, and again,
+	// until priority 2 runs out and the others keep rotating
+	expected := []int{2, 2, 2, 1, 1, 0, 2, 2, 1, 1, 0, 1, 0, 0, 0}
+	for i, e := range expected {
+		item, err := q.PopOrWaitTillClose()
+		if err != nil || item.Priority != e {
+			t.Fatalf("Expected priority %d at %d, but instead we got %v and %v", e, i, item, err)
+		}
+	}
+	if q.Len() != 0 {
+		t.Fatalf("It should be empty, but instead we got %d", q.Len())
+	}
+	q.Close()
+}
@@ -0,0 +1,105 @@
+package prioritize
+
+import (
+	"context"
+	"sync"
+
+	"github.com/aarondwi/prioritize/common"
+)
+
+// localBuffer holds items a worker took from the queue in 1 batch,
+// see `WithLocalBatch`.
+//
+// The owner pops from the front, keeping the queue order,
+// while other workers steal from the back.
+type localBuffer struct {
+	mu    sync.Mutex
+	items []common.QItem
+}
+
+func (lb *localBuffer) pop() (common.QItem, bool) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if len(lb.items) == 0 {
+		return common.MinQItem, false
+	}
+	item := lb.items[0]
+	// so its payload can be garbage collected
+	lb.items[0] = common.QItem{}
+	lb.items = lb.items[1:]
+	return item, true
+}
+
+// popAll takes all the items, e.g. to drop them on `CloseNow`
+func (lb *localBuffer) popAll() []common.QItem {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	items := lb.items
+	lb.items = nil
+	return items
+}
+
+func (lb *localBuffer) pushAll(items []common.QItem) {
+	lb.mu.Lock()
+	lb.items = append(lb.items, items...)
+	lb.mu.Unlock()
+}
+
+// stealHalf takes the back half (rounded up) of the items
+func (lb *localBuffer) stealHalf() []common.QItem {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	n := (len(lb.items) + 1) / 2
+	if n == 0 {
+		return nil
+	}
+	stolen := make([]common.QItem, n)
+	copy(stolen, lb.items[len(lb.items)-n:])
+	for i := len(lb.items) - n; i < len(lb.items); i++ {
+		lb.items[i] = common.QItem{}
+	}
+	lb.items = lb.items[:len(lb.items)-n]
+	return stolen
+}
+
+// next returns the next item worker `i` should run
+func (e *Engine) next(i int) (common.QItem, error) {
+	if int32(i) < e.reservedWorkers {
+		// the first ones, which never exit early, see `WithReservedWorkers`
+		return e.queue().(common.FilteredPopper).PopAtLeastOrWaitCtx(
+			context.Background(), e.reservedMinPriority)
+	}
+	if e.buffers == nil {
+		if e.maxWorkers > 0 {
+			return e.popOrIdle()
+		}
+		if popper, ok := e.queue().(common.CtxPopper); ok {
+			// woken up by `wakeWorkers`
+			return popper.PopOrWaitCtx(e.wake.Load().(*wakeSignal).ctx)
+		}
+		return e.queue().PopOrWaitTillClose()
+	}
+
+	own := e.buffers[i]
+	if item, ok := own.pop(); ok {
+		return item, nil
+	}
+	for k := 1; k < len(e.buffers); k++ {
+		stolen := e.buffers[(i+k)%len(e.buffers)].stealHalf()
+		if len(stolen) > 0 {
+			own.pushAll(stolen[1:])
+			return stolen[0], nil
+		}
+	}
+
+	batchPopper, ok := e.queue().(common.BatchPopper)
+	if !ok {
+		return e.queue().PopOrWaitTillClose()
+	}
+	items, err := batchPopper.PopBatchOrWaitTillClose(e.localBatch)
+	if err != nil {
+		return common.MinQItem, err
+	}
+	own.pushAll(items[1:])
+	return items[0], nil
+}
@@ -0,0 +1,65 @@
+package prioritize
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aarondwi/prioritize/common"
+	"github.com/aarondwi/prioritize/priority"
+)
+
+func TestLocalBuffer(t *testing.T) {
+	lb := &localBuffer{}
+	_, ok := lb.pop()
+	if ok {
+		t.Fatal("It should be empty, but pop returns an item")
+	}
+	if stolen := lb.stealHalf(); len(stolen) != 0 {
+		t.Fatalf("Nothing should be stolen from empty buffer, but instead we got %v", stolen)
+	}
+
+	lb.pushAll([]common.QItem{{ID: 1}, {ID: 2}, {ID: 3}, {ID: 4}, {ID: 5}})
+	stolen := lb.stealHalf()
+	if len(stolen) != 3 || stolen[0].ID != 3 || stolen[2].ID != 5 {
+		t.Fatalf("It should steal the back half, but instead we got %v", stolen)
+	}
+	for _, id := range []uint64{1, 2} {
+		item, ok := lb.pop()
+		if !ok || item.ID != id {
+			t.Fatalf("Owner should pop from the front, expected %d but instead we got %v", id, item)
+		}
+	}
+}
+
+func TestEngineWithLocalBatch(t *testing.T) {
+	pq, _ := priority.NewPriorityQueue(2048, 8)
+	_, err := New(pq, 4, WithLocalBatch(0))
+	if err == nil || err != common.ErrParamShouldBePositive {
+		t.Fatalf("It should error, cause batch size can't be zero, instead we got %v", err)
+	}
+
+	engine, err := New(pq, 4, WithLocalBatch(8))
+	if err != nil {
+		t.Fatalf("It should not error, because all are correct parameters, instead we got %v", err)
+	}
+	fn := func(ctx context.Context, arg interface{}) (interface{}, error) {
+		return arg.(int) * 2, nil
+	}
+
+	tasks := make([]*Task, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		task, err := engine.Submit(context.Background(), i%8, fn, i)
+		if err != nil {
+			t.Fatalf("It should not error, because not closed yet, instead we got %v", err)
+		}
+		tasks = append(tasks, task)
+	}
+	engine.CloseGracefully()
+
+	for i, task := range tasks {
+		result, err := task.Result()
+		if err != nil || result.(int) != i*2 {
+			t.Fatalf("Expected %d, but instead we got %v and %v", i*2, result, err)
+		}
+	}
+}